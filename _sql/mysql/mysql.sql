@@ -1,3 +1,4 @@
 source msgstore_database.sql;
 source sessions_table.sql;
-source messages_table.sql;
\ No newline at end of file
+source messages_table.sql;
+source session_values_table.sql;
\ No newline at end of file
@@ -0,0 +1,21 @@
+-- Use one of the following instead of messages_table.sql, with the matching SQLStorePartitionBy setting.
+-- The store creates the partitions themselves as sessions are created and reset.
+
+DROP TABLE IF EXISTS messages;
+
+-- SQLStorePartitionBy=session_id
+CREATE TABLE messages (
+  session_id VARCHAR(128) NOT NULL,
+  msgseqnum INT NOT NULL, 
+  message TEXT NOT NULL,
+  PRIMARY KEY (session_id, msgseqnum)
+) PARTITION BY LIST (session_id);
+
+-- SQLStorePartitionBy=session_date
+-- CREATE TABLE messages (
+--   session_id VARCHAR(128) NOT NULL,
+--   msgseqnum INT NOT NULL, 
+--   message TEXT NOT NULL,
+--   session_date DATE NOT NULL,
+--   PRIMARY KEY (session_id, msgseqnum, session_date)
+-- ) PARTITION BY RANGE (session_date);
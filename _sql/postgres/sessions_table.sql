@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS sessions;
+
+CREATE TABLE sessions (
+  session_id VARCHAR(128) NOT NULL,
+  creation_time TIMESTAMP NOT NULL,
+  incoming_seqnum INT NOT NULL, 
+  outgoing_seqnum INT NOT NULL,
+  reset_generation INT NOT NULL DEFAULT 0,
+  lease_owner VARCHAR(128) NULL,
+  lease_expires TIMESTAMP NULL,
+  PRIMARY KEY (session_id)
+);
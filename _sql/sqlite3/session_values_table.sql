@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS session_values;
+
+CREATE TABLE session_values (
+  session_id VARCHAR(64) NOT NULL,
+  name VARCHAR(128) NOT NULL,
+  value TEXT NOT NULL,
+  PRIMARY KEY (session_id, name)
+);
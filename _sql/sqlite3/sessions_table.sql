@@ -5,5 +5,8 @@ CREATE TABLE sessions (
   creation_time DATETIME NOT NULL,
   incoming_seqnum INT NOT NULL, 
   outgoing_seqnum INT NOT NULL,
+  reset_generation INT NOT NULL DEFAULT 0,
+  lease_owner VARCHAR(128) NULL,
+  lease_expires DATETIME NULL,
   PRIMARY KEY (session_id)
 );
@@ -0,0 +1,432 @@
+package msgstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// archiveFormat and archiveVersion identify the objects written by an Archiver.  The version is raised whenever the
+	// format changes in a way older readers cannot skip over.
+	archiveFormat  = "msgstore-archive"
+	archiveVersion = 1
+
+	// defaultArchiveInterval is how often a started Archiver archives unless WithArchiverInterval is given
+	defaultArchiveInterval = time.Hour
+)
+
+// archiveHeader is the first record of an archive object
+type archiveHeader struct {
+	Format       string    `json:"format"`
+	Version      int       `json:"version"`
+	SessionID    string    `json:"session_id"`
+	BeginSeqNum  int       `json:"begin_seq_num"`
+	EndSeqNum    int       `json:"end_seq_num"`
+	CreationTime time.Time `json:"creation_time"`
+	ArchivedAt   time.Time `json:"archived_at"`
+}
+
+// archiveKeyTimeLayout formats the creation time of a store in the keys of its archive objects, at a fixed width so
+// that the keys sort in creation order
+const archiveKeyTimeLayout = "20060102T150405.000000000Z"
+
+// ErrArchiveExists is returned by ArchiveStorage.Put when an object is already stored under the key
+var ErrArchiveExists = errors.New("archive object already exists")
+
+// ArchiveStorage is the object storage an Archiver writes to, typically a bucket of S3 or GCS, for which it is
+// implemented over their clients.  Keys are paths separated by "/".
+type ArchiveStorage interface {
+	// Put stores the object read from r under key, failing with ErrArchiveExists if an object is already stored under it
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get returns the object stored under key, which the caller closes
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns the keys of the objects whose keys begin with prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// dirArchiveStorage stores the objects of an ArchiveStorage as files under a directory
+type dirArchiveStorage struct {
+	dir string
+}
+
+// NewDirArchiveStorage returns an ArchiveStorage storing objects as files under dir, e.g. on a mounted network share or
+// for tests
+func NewDirArchiveStorage(dir string) ArchiveStorage {
+	return dirArchiveStorage{dir: dir}
+}
+
+func (s dirArchiveStorage) Put(ctx context.Context, key string, r io.Reader) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".archive-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// unlike a rename, a link fails rather than replacing an existing object
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if os.IsExist(err) {
+			return ErrArchiveExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (s dirArchiveStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, filepath.FromSlash(key)))
+}
+
+func (s dirArchiveStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), ".archive-") {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return keys, err
+}
+
+// ArchivedRange is a range of messages of a session an Archiver moved to an object
+type ArchivedRange struct {
+	SessionID string
+	// Key is the key of the object in the ArchiveStorage
+	Key string
+	// BeginSeqNum and EndSeqNum bound the seqnums of the range, inclusively
+	BeginSeqNum, EndSeqNum int
+	// Messages is the number of messages archived
+	Messages int
+}
+
+// ArchiverOption configures an Archiver
+type ArchiverOption func(*Archiver)
+
+// WithArchiverClock tells the age of messages by clock, and stamps the archives with it.  Defaults to the system clock.
+func WithArchiverClock(clock Clock) ArchiverOption {
+	return func(a *Archiver) { a.clock = clock }
+}
+
+// WithArchiverLogger reports the ranges archived, and the failures, to logger.  Defaults to discarding them.
+func WithArchiverLogger(logger Logger) ArchiverOption {
+	return func(a *Archiver) { a.logger = logger }
+}
+
+// WithArchiverInterval archives every interval once started.  Defaults to every hour.
+func WithArchiverInterval(interval time.Duration) ArchiverOption {
+	return func(a *Archiver) { a.interval = interval }
+}
+
+// WithArchiverPrefix prepends prefix to the keys of the archive objects, e.g. "fix/prod/".  Defaults to none.
+func WithArchiverPrefix(prefix string) ArchiverOption {
+	return func(a *Archiver) { a.prefix = prefix }
+}
+
+// Archiver moves the messages of the stores registered with it older than a threshold to object storage, keeping the
+// primary stores small while the history stays available through Rehydrate.  The age of messages is told by
+// MessageMetaStore or TimedMessageStore, which the stores must implement.  It is safe for concurrent use, but the
+// stores are archived from the goroutine of Start or the caller of Archive, so they must be safe for concurrent use.
+//
+// Each run writes the messages of a session past the threshold to an object under the key
+// "<prefix><session ID, path escaped>/<begin seqnum>-<end seqnum>.jsonl.gz", with the seqnums zero padded to 12 digits,
+// and only once it is stored deletes them from the store with DeleteMessagesUpTo.  The object is a gzip stream of JSON
+// records, one per line: a header
+//
+//	{"format":"msgstore-archive","version":1,"session_id":"FIX.4.4-A-B","begin_seq_num":1,"end_seq_num":500,"archived_at":"2024-03-01T12:00:00Z"}
+//
+// followed by a record per message in seqnum order, {"seq_num":1,"message":"<base64>"}, as in the archives of
+// BackupMessageStore.  Readers should ignore the fields they do not know.  A run is built in memory before it is stored,
+// so the interval should be short enough for the messages aging during it to fit.
+type Archiver struct {
+	storage  ArchiveStorage
+	maxAge   time.Duration
+	clock    Clock
+	logger   Logger
+	interval time.Duration
+	prefix   string
+
+	mu     sync.Mutex
+	stores map[string]MessageStore
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewArchiver returns an Archiver moving messages older than maxAge to storage
+func NewArchiver(storage ArchiveStorage, maxAge time.Duration, opts ...ArchiverOption) *Archiver {
+	a := &Archiver{storage: storage, maxAge: maxAge, interval: defaultArchiveInterval, stores: make(map[string]MessageStore)}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Register archives store, the store of sessionID, replacing any store registered for sessionID
+func (a *Archiver) Register(sessionID string, store MessageStore) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.stores[sessionID] = store
+}
+
+// Unregister stops archiving the store of sessionID
+func (a *Archiver) Unregister(sessionID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.stores, sessionID)
+}
+
+// Archive archives the messages past the threshold of every registered store, returning the ranges archived in session
+// order and the first failure.  A store failing is left for the next run, without stopping the others.
+func (a *Archiver) Archive(ctx context.Context) ([]ArchivedRange, error) {
+	a.mu.Lock()
+	stores := make(map[string]MessageStore, len(a.stores))
+	sessionIDs := make([]string, 0, len(a.stores))
+	for sessionID, store := range a.stores {
+		stores[sessionID] = store
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	a.mu.Unlock()
+	sort.Strings(sessionIDs)
+
+	var archived []ArchivedRange
+	var firstErr error
+	for _, sessionID := range sessionIDs {
+		r, err := a.archive(ctx, sessionID, stores[sessionID])
+		if err != nil {
+			a.logf("msgstore: archiving session %s failed: %s", sessionID, err.Error())
+			if firstErr == nil {
+				firstErr = fmt.Errorf("session %s: %w", sessionID, err)
+			}
+			continue
+		}
+		if r.Messages > 0 {
+			a.logf("msgstore: archived %d messages of session %s to %s", r.Messages, sessionID, r.Key)
+			archived = append(archived, r)
+		}
+	}
+	return archived, firstErr
+}
+
+// archive moves the messages of store past the threshold to an object
+func (a *Archiver) archive(ctx context.Context, sessionID string, store MessageStore) (r ArchivedRange, err error) {
+	now := clockNow(a.clock)
+	r.SessionID = sessionID
+	endSeqNum, supported, err := retentionAgeBoundary(store, now.Add(-a.maxAge))
+	if err != nil {
+		return r, err
+	}
+	if !supported {
+		return r, errors.New("store does not record when messages were stored")
+	}
+
+	beginSeqNum := 1
+	if stats, ok := store.(MessageStats); ok {
+		if beginSeqNum, err = stats.FirstSeqNum(); err != nil {
+			return r, err
+		}
+		if beginSeqNum == 0 {
+			return r, nil
+		}
+	}
+	if endSeqNum < beginSeqNum {
+		return r, nil
+	}
+	var records []backupMessage
+	err = store.IterateMessages(beginSeqNum, endSeqNum, func(seqNum int, msg []byte) error {
+		records = append(records, backupMessage{SeqNum: seqNum, Message: msg})
+		return nil
+	})
+	if err != nil || len(records) == 0 {
+		return r, err
+	}
+	r.BeginSeqNum, r.EndSeqNum, r.Messages = records[0].SeqNum, records[len(records)-1].SeqNum, len(records)
+	creationTime := store.CreationTime()
+	r.Key = a.archiveKey(sessionID, creationTime, r.BeginSeqNum, r.EndSeqNum)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	header := archiveHeader{Format: archiveFormat, Version: archiveVersion, SessionID: sessionID, BeginSeqNum: r.BeginSeqNum, EndSeqNum: r.EndSeqNum, CreationTime: creationTime, ArchivedAt: now}
+	if err := enc.Encode(header); err != nil {
+		return r, err
+	}
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			return r, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return r, err
+	}
+
+	if err := a.storage.Put(ctx, r.Key, &buf); err != nil {
+		return r, fmt.Errorf("unable to store archive %s: %w", r.Key, err)
+	}
+	return r, store.DeleteMessagesUpTo(endSeqNum)
+}
+
+// sessionPrefix returns the prefix of the keys of the archive objects of sessionID
+func (a *Archiver) sessionPrefix(sessionID string) string {
+	return a.prefix + url.PathEscape(sessionID) + "/"
+}
+
+// archiveKey returns the key of the archive object of the range of sessionID, stored while the store of the session had
+// creationTime.  The creation time keeps apart the ranges of the same seqnums archived before and after a reset.
+func (a *Archiver) archiveKey(sessionID string, creationTime time.Time, beginSeqNum, endSeqNum int) string {
+	return fmt.Sprintf("%s%s-%012d-%012d.jsonl.gz", a.sessionPrefix(sessionID), creationTime.UTC().Format(archiveKeyTimeLayout), beginSeqNum, endSeqNum)
+}
+
+// Rehydrate returns the archived messages of sessionID from beginSeqNum to endSeqNum in seqnum order, which can be
+// saved back to the store with SaveMessages to serve resends of them.  A seqnum archived before and after a reset is
+// returned as last archived.
+func (a *Archiver) Rehydrate(ctx context.Context, sessionID string, beginSeqNum, endSeqNum int) ([]SeqMsg, error) {
+	prefix := a.sessionPrefix(sessionID)
+	keys, err := a.storage.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	msgs := make(map[int][]byte)
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		if len(name) < len(archiveKeyTimeLayout) {
+			continue
+		}
+		var objectBegin, objectEnd int
+		if _, err := fmt.Sscanf(name[len(archiveKeyTimeLayout):], "-%d-%d.jsonl.gz", &objectBegin, &objectEnd); err != nil {
+			continue
+		}
+		if objectEnd < beginSeqNum || objectBegin > endSeqNum {
+			continue
+		}
+		if err := a.readArchive(ctx, key, func(seqNum int, msg []byte) {
+			if seqNum >= beginSeqNum && seqNum <= endSeqNum {
+				msgs[seqNum] = msg
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	rehydrated := make([]SeqMsg, 0, len(msgs))
+	for seqNum, msg := range msgs {
+		rehydrated = append(rehydrated, SeqMsg{SeqNum: seqNum, Msg: msg})
+	}
+	sort.Slice(rehydrated, func(i, j int) bool { return rehydrated[i].SeqNum < rehydrated[j].SeqNum })
+	return rehydrated, nil
+}
+
+// readArchive calls fn with each message of the archive object stored under key
+func (a *Archiver) readArchive(ctx context.Context, key string, fn func(seqNum int, msg []byte)) error {
+	rc, err := a.storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return fmt.Errorf("unable to read archive %s: %w", key, err)
+	}
+	dec := json.NewDecoder(zr)
+	var header archiveHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("unable to read archive %s: %w", key, err)
+	}
+	if header.Format != archiveFormat {
+		return fmt.Errorf("unable to read archive %s: not a %s archive", key, archiveFormat)
+	}
+	if header.Version > archiveVersion {
+		return fmt.Errorf("unable to read archive %s: unsupported version: %d", key, header.Version)
+	}
+
+	for dec.More() {
+		var record backupMessage
+		if err := dec.Decode(&record); err != nil {
+			return fmt.Errorf("unable to read archive %s: %w", key, err)
+		}
+		fn(record.SeqNum, record.Message)
+	}
+	return nil
+}
+
+// Start archives every interval in the background until Stop
+func (a *Archiver) Start() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.stop != nil {
+		return
+	}
+	a.stop, a.done = make(chan struct{}), make(chan struct{})
+	go a.run(a.stop, a.done)
+}
+
+func (a *Archiver) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			a.Archive(context.Background())
+		}
+	}
+}
+
+// Stop stops the background runs of Start, waiting for any run in progress
+func (a *Archiver) Stop() {
+	a.mu.Lock()
+	stop, done := a.stop, a.done
+	a.stop, a.done = nil, nil
+	a.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (a *Archiver) logf(format string, v ...interface{}) {
+	if a.logger != nil {
+		a.logger.Printf(format, v...)
+	}
+}
@@ -0,0 +1,178 @@
+package msgstore
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newArchivedSession returns a timed store of a session with a message saved every hour for 10 hours up to the time of
+// clock
+func newArchivedSession(t *testing.T, clock *manualClock) *timedStore {
+	inner, _ := NewMemoryStoreFactory().Create("FIX.4.4-A-B")
+	store := &timedStore{MessageStore: inner, clock: clock, storedAt: make(map[int]time.Time)}
+	require.Nil(t, store.SetCreationTime(clock.Now()))
+	for seqNum := 1; seqNum <= 10; seqNum++ {
+		require.Nil(t, store.SaveMessage(seqNum, []byte(fmt.Sprintf("msg%d", seqNum))))
+		clock.Set(clock.Now().Add(time.Hour))
+	}
+	require.Nil(t, store.SetNextSenderMsgSeqNum(11))
+	return store
+}
+
+func TestArchiver(t *testing.T) {
+	dir := path.Join(os.TempDir(), fmt.Sprintf("Archiver-%d", os.Getpid()))
+	defer os.RemoveAll(dir)
+
+	// Given an archiver of messages older than 4 hours
+	clock := &manualClock{t: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}
+	store := newArchivedSession(t, clock)
+	archiver := NewArchiver(NewDirArchiveStorage(dir), 4*time.Hour, WithArchiverClock(clock), WithArchiverPrefix("prod/"))
+	archiver.Register("FIX.4.4-A-B", store)
+
+	// When it archives
+	archived, err := archiver.Archive(context.Background())
+
+	// Then the older messages should be moved to an object
+	require.Nil(t, err)
+	require.Equal(t, []ArchivedRange{{SessionID: "FIX.4.4-A-B", Key: "prod/FIX.4.4-A-B/20240301T000000.000000000Z-000000000001-000000000006.jsonl.gz", BeginSeqNum: 1, EndSeqNum: 6, Messages: 6}}, archived)
+	msgs, err := store.GetMessages(1, 10)
+	require.Nil(t, err)
+	assert.Len(t, msgs, 4)
+
+	// And the object should be in the documented format
+	f, err := os.Open(path.Join(dir, "prod", "FIX.4.4-A-B", "20240301T000000.000000000Z-000000000001-000000000006.jsonl.gz"))
+	require.Nil(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.Nil(t, err)
+	dec := json.NewDecoder(zr)
+	var header map[string]interface{}
+	require.Nil(t, dec.Decode(&header))
+	assert.Equal(t, "msgstore-archive", header["format"])
+	assert.Equal(t, "FIX.4.4-A-B", header["session_id"])
+	var record map[string]interface{}
+	require.Nil(t, dec.Decode(&record))
+	assert.Equal(t, float64(1), record["seq_num"])
+}
+
+func TestArchiver_Rehydrate(t *testing.T) {
+	dir := path.Join(os.TempDir(), fmt.Sprintf("ArchiverRehydrate-%d", os.Getpid()))
+	defer os.RemoveAll(dir)
+
+	// Given a session archived over two runs
+	clock := &manualClock{t: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}
+	store := newArchivedSession(t, clock)
+	archiver := NewArchiver(NewDirArchiveStorage(dir), 8*time.Hour, WithArchiverClock(clock))
+	archiver.Register("FIX.4.4-A-B", store)
+	_, err := archiver.Archive(context.Background())
+	require.Nil(t, err)
+	clock.Set(clock.Now().Add(4 * time.Hour))
+	archived, err := archiver.Archive(context.Background())
+	require.Nil(t, err)
+	require.Len(t, archived, 1)
+	assert.Equal(t, 3, archived[0].BeginSeqNum)
+
+	// When a range spanning both is rehydrated
+	msgs, err := archiver.Rehydrate(context.Background(), "FIX.4.4-A-B", 2, 4)
+
+	// Then its messages should be returned in seqnum order
+	require.Nil(t, err)
+	assert.Equal(t, []SeqMsg{{SeqNum: 2, Msg: []byte("msg2")}, {SeqNum: 3, Msg: []byte("msg3")}, {SeqNum: 4, Msg: []byte("msg4")}}, msgs)
+
+	// And they can be saved back to the store
+	require.Nil(t, store.SaveMessages(msgs))
+	msg, found, err := store.GetMessage(3)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("msg3"), msg)
+}
+
+func TestArchiver_NothingToArchive(t *testing.T) {
+	dir := path.Join(os.TempDir(), fmt.Sprintf("ArchiverNothing-%d", os.Getpid()))
+	defer os.RemoveAll(dir)
+
+	// Given an archiver of messages older than a day, and a session of younger ones
+	clock := &manualClock{t: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}
+	store := newArchivedSession(t, clock)
+	storage := NewDirArchiveStorage(dir)
+	archiver := NewArchiver(storage, 24*time.Hour, WithArchiverClock(clock))
+	archiver.Register("FIX.4.4-A-B", store)
+
+	// When it archives
+	archived, err := archiver.Archive(context.Background())
+
+	// Then nothing should be archived
+	require.Nil(t, err)
+	assert.Empty(t, archived)
+	keys, err := storage.List(context.Background(), "")
+	require.Nil(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestArchiver_AfterReset(t *testing.T) {
+	dir := path.Join(os.TempDir(), fmt.Sprintf("ArchiverReset-%d", os.Getpid()))
+	defer os.RemoveAll(dir)
+
+	// Given a session archived, then reset and written again over the same seqnums
+	clock := &manualClock{t: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}
+	store := newArchivedSession(t, clock)
+	archiver := NewArchiver(NewDirArchiveStorage(dir), 4*time.Hour, WithArchiverClock(clock))
+	archiver.Register("FIX.4.4-A-B", store)
+	first, err := archiver.Archive(context.Background())
+	require.Nil(t, err)
+	require.Nil(t, store.Reset())
+	require.Nil(t, store.SetCreationTime(clock.Now()))
+	for seqNum := 1; seqNum <= 10; seqNum++ {
+		require.Nil(t, store.SaveMessage(seqNum, []byte(fmt.Sprintf("new%d", seqNum))))
+		clock.Set(clock.Now().Add(time.Hour))
+	}
+
+	// When it archives again
+	second, err := archiver.Archive(context.Background())
+
+	// Then the range should be archived to a new object rather than over the first
+	require.Nil(t, err)
+	require.Len(t, first, 1)
+	require.Len(t, second, 1)
+	assert.NotEqual(t, first[0].Key, second[0].Key)
+	keys, err := NewDirArchiveStorage(dir).List(context.Background(), "")
+	require.Nil(t, err)
+	assert.Len(t, keys, 2)
+
+	// And the messages rehydrated should be those archived last
+	msgs, err := archiver.Rehydrate(context.Background(), "FIX.4.4-A-B", 1, 1)
+	require.Nil(t, err)
+	assert.Equal(t, []SeqMsg{{SeqNum: 1, Msg: []byte("new1")}}, msgs)
+}
+
+func TestDirArchiveStorage_PutExisting(t *testing.T) {
+	dir := path.Join(os.TempDir(), fmt.Sprintf("DirArchiveStorage-%d", os.Getpid()))
+	defer os.RemoveAll(dir)
+
+	// Given an object stored under a key
+	storage := NewDirArchiveStorage(dir)
+	require.Nil(t, storage.Put(context.Background(), "a/b", strings.NewReader("first")))
+
+	// When another is put under it
+	err := storage.Put(context.Background(), "a/b", strings.NewReader("second"))
+
+	// Then it should be refused, keeping the first
+	assert.Equal(t, ErrArchiveExists, err)
+	rc, err := storage.Get(context.Background(), "a/b")
+	require.Nil(t, err)
+	defer rc.Close()
+	body, err := ioutil.ReadAll(rc)
+	require.Nil(t, err)
+	assert.Equal(t, "first", string(body))
+}
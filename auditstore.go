@@ -0,0 +1,302 @@
+package msgstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// SeqNumAuditEntry records an operation that changed, or tried to change, the seqnums of a session
+type SeqNumAuditEntry struct {
+	Time      time.Time `json:"time"`
+	SessionID string    `json:"session_id"`
+	// Op is the operation, named as in the metrics of the backends, e.g. "set_next_sender_seqnum" or "reset"
+	Op                     string `json:"op"`
+	OldNextSenderMsgSeqNum int    `json:"old_next_sender_msg_seq_num"`
+	NewNextSenderMsgSeqNum int    `json:"new_next_sender_msg_seq_num"`
+	OldNextTargetMsgSeqNum int    `json:"old_next_target_msg_seq_num"`
+	NewNextTargetMsgSeqNum int    `json:"new_next_target_msg_seq_num"`
+	// Reason is the reason given with WithAuditReason, if any
+	Reason string `json:"reason,omitempty"`
+	// Error is the failure of the operation, if it failed
+	Error string `json:"error,omitempty"`
+}
+
+// SeqNumAuditSink receives the entries of the audit stores.  It is append-only: entries are never updated or removed.
+type SeqNumAuditSink interface {
+	Append(entry SeqNumAuditEntry) error
+}
+
+// jsonAuditSink writes entries to its writer as JSON records, one per line
+type jsonAuditSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONAuditSink returns a SeqNumAuditSink writing each entry to w as a JSON record, one per line.  It is safe for
+// concurrent use, so the audit stores of every session can share it, e.g. over a file opened with os.O_APPEND.
+func NewJSONAuditSink(w io.Writer) SeqNumAuditSink {
+	return &jsonAuditSink{enc: json.NewEncoder(w)}
+}
+
+func (s *jsonAuditSink) Append(entry SeqNumAuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.enc.Encode(entry)
+}
+
+type auditReasonKey struct{}
+
+// WithAuditReason returns ctx carrying the reason the audit stores record for the seqnum changes made with it, e.g.
+// "ops ticket 4711: counterparty requested reset"
+func WithAuditReason(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, auditReasonKey{}, reason)
+}
+
+// AuditOption configures a store created by NewAuditStore
+type AuditOption func(*auditStore)
+
+// WithAuditClock stamps the audit entries with the time told by clock.  Defaults to the system clock.
+func WithAuditClock(clock Clock) AuditOption {
+	return func(store *auditStore) { store.clock = clock }
+}
+
+type auditStore struct {
+	inner     MessageStoreV2
+	sessionID string
+	sink      SeqNumAuditSink
+	clock     Clock
+}
+
+// NewAuditStore returns a ContextMessageStore that records every IncrNext*, SetNext*, Reset and Restore of inner, a
+// store of sessionID, and every transaction setting seqnums, to sink, with the seqnums before and after and the reason
+// given to the Context method with WithAuditReason.  Failed operations are recorded too.  An entry that sink fails to
+// append fails the operation, which has already been made, so that changes do not go unaudited silently.
+func NewAuditStore(inner MessageStore, sessionID string, sink SeqNumAuditSink, opts ...AuditOption) ContextMessageStore {
+	store := &auditStore{inner: AdaptMessageStore(inner), sessionID: sessionID, sink: sink}
+	for _, opt := range opts {
+		opt(store)
+	}
+	return store
+}
+
+// audit applies op to the inner store and records it, returning the failure of op or else of the sink
+func (store *auditStore) audit(ctx context.Context, operation string, op func() error) error {
+	entry := SeqNumAuditEntry{
+		SessionID:              store.sessionID,
+		Op:                     operation,
+		OldNextSenderMsgSeqNum: store.inner.NextSenderMsgSeqNum(),
+		OldNextTargetMsgSeqNum: store.inner.NextTargetMsgSeqNum(),
+	}
+	entry.Reason, _ = ctx.Value(auditReasonKey{}).(string)
+
+	err := op()
+	entry.Time = clockNow(store.clock)
+	entry.NewNextSenderMsgSeqNum = store.inner.NextSenderMsgSeqNum()
+	entry.NewNextTargetMsgSeqNum = store.inner.NextTargetMsgSeqNum()
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	if appendErr := store.sink.Append(entry); appendErr != nil && err == nil {
+		return fmt.Errorf("unable to audit %s: %w", operation, appendErr)
+	}
+	return err
+}
+
+func (store *auditStore) NextSenderMsgSeqNum() int {
+	return store.inner.NextSenderMsgSeqNum()
+}
+
+func (store *auditStore) NextTargetMsgSeqNum() int {
+	return store.inner.NextTargetMsgSeqNum()
+}
+
+func (store *auditStore) IncrNextSenderMsgSeqNum() error {
+	return store.IncrNextSenderMsgSeqNumContext(context.Background())
+}
+
+func (store *auditStore) IncrNextSenderMsgSeqNumContext(ctx context.Context) error {
+	return store.audit(ctx, "incr_next_sender_seqnum", func() error { return store.inner.IncrNextSenderMsgSeqNum(ctx) })
+}
+
+func (store *auditStore) IncrNextTargetMsgSeqNum() error {
+	return store.IncrNextTargetMsgSeqNumContext(context.Background())
+}
+
+func (store *auditStore) IncrNextTargetMsgSeqNumContext(ctx context.Context) error {
+	return store.audit(ctx, "incr_next_target_seqnum", func() error { return store.inner.IncrNextTargetMsgSeqNum(ctx) })
+}
+
+func (store *auditStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.SetNextSenderMsgSeqNumContext(context.Background(), next)
+}
+
+func (store *auditStore) SetNextSenderMsgSeqNumContext(ctx context.Context, next int) error {
+	return store.audit(ctx, "set_next_sender_seqnum", func() error { return store.inner.SetNextSenderMsgSeqNum(ctx, next) })
+}
+
+func (store *auditStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.SetNextTargetMsgSeqNumContext(context.Background(), next)
+}
+
+func (store *auditStore) SetNextTargetMsgSeqNumContext(ctx context.Context, next int) error {
+	return store.audit(ctx, "set_next_target_seqnum", func() error { return store.inner.SetNextTargetMsgSeqNum(ctx, next) })
+}
+
+func (store *auditStore) CreationTime() time.Time {
+	return store.inner.CreationTime()
+}
+
+func (store *auditStore) SetCreationTime(t time.Time) error {
+	return store.inner.SetCreationTime(context.Background(), t)
+}
+
+func (store *auditStore) SetCreationTimeContext(ctx context.Context, t time.Time) error {
+	return store.inner.SetCreationTime(ctx, t)
+}
+
+func (store *auditStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.inner.SaveMessage(context.Background(), seqNum, msg)
+}
+
+func (store *auditStore) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) error {
+	return store.inner.SaveMessage(ctx, seqNum, msg)
+}
+
+func (store *auditStore) SaveMessages(msgs []SeqMsg) error {
+	return store.inner.SaveMessages(context.Background(), msgs)
+}
+
+func (store *auditStore) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) error {
+	return store.inner.SaveMessages(ctx, msgs)
+}
+
+func (store *auditStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.inner.GetMessages(context.Background(), beginSeqNum, endSeqNum)
+}
+
+func (store *auditStore) GetMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.inner.GetMessages(ctx, beginSeqNum, endSeqNum)
+}
+
+func (store *auditStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return store.inner.GetMessagesSince(context.Background(), seqNum)
+}
+
+func (store *auditStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.inner.GetMessagesDescending(context.Background(), beginSeqNum, endSeqNum)
+}
+
+func (store *auditStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return store.inner.GetMessage(context.Background(), seqNum)
+}
+
+func (store *auditStore) GetMessageContext(ctx context.Context, seqNum int) ([]byte, bool, error) {
+	return store.inner.GetMessage(ctx, seqNum)
+}
+
+func (store *auditStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.inner.IterateMessages(context.Background(), beginSeqNum, endSeqNum, fn)
+}
+
+func (store *auditStore) IterateMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.inner.IterateMessages(ctx, beginSeqNum, endSeqNum, fn)
+}
+
+func (store *auditStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return store.inner.StreamMessages(ctx, beginSeqNum, endSeqNum)
+}
+
+func (store *auditStore) BeginTx() (StoreTx, error) {
+	return store.BeginTxContext(context.Background())
+}
+
+// BeginTxContext starts a transaction of inner, whose Commit is recorded if it sets seqnums, with the reason ctx carries
+func (store *auditStore) BeginTxContext(ctx context.Context) (StoreTx, error) {
+	tx, err := store.inner.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &auditTx{StoreTx: tx, store: store, ctx: ctx}, nil
+}
+
+func (store *auditStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.inner.DeleteMessagesUpTo(context.Background(), seqNum)
+}
+
+func (store *auditStore) DeleteMessagesUpToContext(ctx context.Context, seqNum int) error {
+	return store.inner.DeleteMessagesUpTo(ctx, seqNum)
+}
+
+func (store *auditStore) Backup(w io.Writer) error {
+	return store.inner.Backup(context.Background(), w)
+}
+
+func (store *auditStore) Restore(r io.Reader) error {
+	ctx := context.Background()
+	return store.audit(ctx, "restore", func() error { return store.inner.Restore(ctx, r) })
+}
+
+func (store *auditStore) HealthCheck(ctx context.Context) error {
+	return store.inner.HealthCheck(ctx)
+}
+
+func (store *auditStore) Flush() error {
+	return store.inner.Flush(context.Background())
+}
+
+func (store *auditStore) Refresh() error {
+	return store.inner.Refresh(context.Background())
+}
+
+func (store *auditStore) RefreshContext(ctx context.Context) error {
+	return store.inner.Refresh(ctx)
+}
+
+func (store *auditStore) Reset() error {
+	return store.ResetContext(context.Background())
+}
+
+func (store *auditStore) ResetContext(ctx context.Context) error {
+	return store.audit(ctx, "reset", func() error { return store.inner.Reset(ctx) })
+}
+
+func (store *auditStore) Close() error {
+	return store.inner.Close()
+}
+
+// auditTx is a transaction of the inner store of an auditStore, recording its Commit if it sets seqnums
+type auditTx struct {
+	StoreTx
+	store   *auditStore
+	ctx     context.Context
+	seqNums bool
+}
+
+func (tx *auditTx) SetNextSenderMsgSeqNum(next int) error {
+	if err := tx.StoreTx.SetNextSenderMsgSeqNum(next); err != nil {
+		return err
+	}
+	tx.seqNums = true
+	return nil
+}
+
+func (tx *auditTx) SetNextTargetMsgSeqNum(next int) error {
+	if err := tx.StoreTx.SetNextTargetMsgSeqNum(next); err != nil {
+		return err
+	}
+	tx.seqNums = true
+	return nil
+}
+
+func (tx *auditTx) Commit() error {
+	if !tx.seqNums {
+		return tx.StoreTx.Commit()
+	}
+	return tx.store.audit(tx.ctx, "commit_tx", tx.StoreTx.Commit)
+}
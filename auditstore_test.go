@@ -0,0 +1,119 @@
+package msgstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// AuditStoreTestSuite runs all tests in the MessageStoreTestSuite against an audit store over the MemoryStore
+type AuditStoreTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *AuditStoreTestSuite) SetupTest() {
+	inner, err := NewMemoryStoreFactory().Create("session")
+	require.Nil(suite.T(), err)
+	suite.msgStore = NewAuditStore(inner, "session", NewJSONAuditSink(&bytes.Buffer{}))
+}
+
+func TestAuditStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(AuditStoreTestSuite))
+}
+
+// recordingAuditSink holds the entries appended to it, failing with err if set
+type recordingAuditSink struct {
+	entries []SeqNumAuditEntry
+	err     error
+}
+
+func (s *recordingAuditSink) Append(entry SeqNumAuditEntry) error {
+	s.entries = append(s.entries, entry)
+	return s.err
+}
+
+func TestAuditStore(t *testing.T) {
+	// Given an audit store
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	sink := &recordingAuditSink{}
+	inner, _ := NewMemoryStoreFactory().Create("FIX.4.4-SENDER-TARGET")
+	store := NewAuditStore(inner, "FIX.4.4-SENDER-TARGET", sink, WithAuditClock(fixedClock{now}))
+
+	// When its seqnums are changed, with and without a reason, and messages saved
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	require.Nil(t, store.SaveMessage(1, []byte("msg")))
+	require.Nil(t, store.SetNextTargetMsgSeqNumContext(WithAuditReason(context.Background(), "ops ticket 4711"), 10))
+	require.Nil(t, store.Reset())
+
+	// Then each seqnum change should be recorded, with the seqnums before and after
+	assert.Equal(t, []SeqNumAuditEntry{
+		{Time: now, SessionID: "FIX.4.4-SENDER-TARGET", Op: "incr_next_sender_seqnum",
+			OldNextSenderMsgSeqNum: 1, NewNextSenderMsgSeqNum: 2, OldNextTargetMsgSeqNum: 1, NewNextTargetMsgSeqNum: 1},
+		{Time: now, SessionID: "FIX.4.4-SENDER-TARGET", Op: "set_next_target_seqnum", Reason: "ops ticket 4711",
+			OldNextSenderMsgSeqNum: 2, NewNextSenderMsgSeqNum: 2, OldNextTargetMsgSeqNum: 1, NewNextTargetMsgSeqNum: 10},
+		{Time: now, SessionID: "FIX.4.4-SENDER-TARGET", Op: "reset",
+			OldNextSenderMsgSeqNum: 2, NewNextSenderMsgSeqNum: 1, OldNextTargetMsgSeqNum: 10, NewNextTargetMsgSeqNum: 1},
+	}, sink.entries)
+}
+
+func TestAuditStore_Transaction(t *testing.T) {
+	// Given an audit store
+	sink := &recordingAuditSink{}
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	store := NewAuditStore(inner, "session", sink)
+
+	// When a transaction setting the seqnums commits
+	tx, err := store.BeginTxContext(WithAuditReason(context.Background(), "logon"))
+	require.Nil(t, err)
+	require.Nil(t, tx.SaveMessage(1, []byte("logon")))
+	require.Nil(t, tx.SetNextSenderMsgSeqNum(2))
+	require.Nil(t, tx.Commit())
+
+	// Then its commit should be recorded
+	require.Len(t, sink.entries, 1)
+	assert.Equal(t, "commit_tx", sink.entries[0].Op)
+	assert.Equal(t, "logon", sink.entries[0].Reason)
+	assert.Equal(t, 2, sink.entries[0].NewNextSenderMsgSeqNum)
+}
+
+func TestAuditStore_SinkFailure(t *testing.T) {
+	// Given an audit store whose sink fails
+	sink := &recordingAuditSink{err: errors.New("disk full")}
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	store := NewAuditStore(inner, "session", sink)
+
+	// When the seqnums are changed
+	err := store.SetNextSenderMsgSeqNum(5)
+
+	// Then the failure should be returned, though the change was made
+	assert.EqualError(t, err, "unable to audit set_next_sender_seqnum: disk full")
+	assert.Equal(t, 5, store.NextSenderMsgSeqNum())
+}
+
+func TestJSONAuditSink(t *testing.T) {
+	// Given a JSON audit sink
+	var buf bytes.Buffer
+	sink := NewJSONAuditSink(&buf)
+
+	// When entries are appended
+	require.Nil(t, sink.Append(SeqNumAuditEntry{SessionID: "session", Op: "reset", OldNextSenderMsgSeqNum: 5, NewNextSenderMsgSeqNum: 1}))
+	require.Nil(t, sink.Append(SeqNumAuditEntry{SessionID: "session", Op: "incr_next_sender_seqnum", Error: "disk full"}))
+
+	// Then they should be written one per line
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var entry SeqNumAuditEntry
+	require.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "reset", entry.Op)
+	assert.Equal(t, 5, entry.OldNextSenderMsgSeqNum)
+	assert.Contains(t, lines[1], `"error":"disk full"`)
+	assert.NotContains(t, lines[0], `"reason"`)
+}
@@ -0,0 +1,128 @@
+package msgstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// backupFormat and backupVersion identify the archives written by BackupMessageStore.  The version is raised whenever
+// the archive changes in a way older readers cannot skip over.
+const (
+	backupFormat  = "msgstore-backup"
+	backupVersion = 1
+
+	// restoreBatchSize is the number of messages RestoreMessageStore saves at a time
+	restoreBatchSize = 1000
+)
+
+// backupHeader is the first record of an archive
+type backupHeader struct {
+	Format              string    `json:"format"`
+	Version             int       `json:"version"`
+	CreationTime        time.Time `json:"creation_time"`
+	NextSenderMsgSeqNum int       `json:"next_sender_msg_seq_num"`
+	NextTargetMsgSeqNum int       `json:"next_target_msg_seq_num"`
+}
+
+// backupMessage is a record of an archive following the header, one per stored message in seqnum order
+type backupMessage struct {
+	SeqNum  int    `json:"seq_num"`
+	Message []byte `json:"message"`
+}
+
+// BackupMessageStore writes the seqnums, creation time and messages of store to w as a portable archive of JSON records,
+// one per line, that RestoreMessageStore can restore into a store of any backend.  The messages are streamed rather than
+// held in memory.  It implements Backup for every MessageStore of the package, and is exported for other implementations.
+func BackupMessageStore(store MessageStore, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	header := backupHeader{
+		Format:              backupFormat,
+		Version:             backupVersion,
+		CreationTime:        store.CreationTime(),
+		NextSenderMsgSeqNum: store.NextSenderMsgSeqNum(),
+		NextTargetMsgSeqNum: store.NextTargetMsgSeqNum(),
+	}
+	if err := enc.Encode(header); err != nil {
+		return fmt.Errorf("unable to write backup: %w", err)
+	}
+
+	// the messages stored are those sent, unless the store can tell its range from its index
+	beginSeqNum, endSeqNum := 1, header.NextSenderMsgSeqNum-1
+	if stats, ok := store.(MessageStats); ok {
+		first, err := stats.FirstSeqNum()
+		if err != nil {
+			return err
+		}
+		last, err := stats.LastSeqNum()
+		if err != nil {
+			return err
+		}
+		if first > 0 && first < beginSeqNum {
+			beginSeqNum = first
+		}
+		if last > endSeqNum {
+			endSeqNum = last
+		}
+	}
+
+	return store.IterateMessages(beginSeqNum, endSeqNum, func(seqNum int, msg []byte) error {
+		if err := enc.Encode(backupMessage{SeqNum: seqNum, Message: msg}); err != nil {
+			return fmt.Errorf("unable to write backup: %w", err)
+		}
+		return nil
+	})
+}
+
+// RestoreMessageStore resets store and restores into it the seqnums, creation time and messages of an archive written
+// by BackupMessageStore.  The whole archive is read and checked before store is reset, so a truncated or corrupt
+// archive leaves store as it was.  It implements Restore for every MessageStore of the package, and is exported for
+// other implementations.
+func RestoreMessageStore(store MessageStore, r io.Reader) error {
+	dec := json.NewDecoder(r)
+	var header backupHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("unable to read backup: %w", err)
+	}
+	if header.Format != backupFormat {
+		return fmt.Errorf("unable to read backup: not a %s archive", backupFormat)
+	}
+	if header.Version > backupVersion {
+		return fmt.Errorf("unable to read backup: unsupported version: %d", header.Version)
+	}
+
+	var msgs []SeqMsg
+	for dec.More() {
+		var record backupMessage
+		if err := dec.Decode(&record); err != nil {
+			return fmt.Errorf("unable to read backup: %w", err)
+		}
+		if record.SeqNum <= 0 || (len(msgs) > 0 && record.SeqNum <= msgs[len(msgs)-1].SeqNum) {
+			return fmt.Errorf("unable to read backup: message out of order: %d", record.SeqNum)
+		}
+		msgs = append(msgs, SeqMsg{SeqNum: record.SeqNum, Msg: record.Message})
+	}
+
+	if err := store.Reset(); err != nil {
+		return err
+	}
+	for len(msgs) > 0 {
+		n := restoreBatchSize
+		if n > len(msgs) {
+			n = len(msgs)
+		}
+		if err := store.SaveMessages(msgs[:n]); err != nil {
+			return err
+		}
+		msgs = msgs[n:]
+	}
+
+	if err := store.SetNextSenderMsgSeqNum(header.NextSenderMsgSeqNum); err != nil {
+		return err
+	}
+	if err := store.SetNextTargetMsgSeqNum(header.NextTargetMsgSeqNum); err != nil {
+		return err
+	}
+	return store.SetCreationTime(header.CreationTime)
+}
@@ -0,0 +1,70 @@
+package msgstore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupMessageStore_RestoreIntoOtherBackend(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("BackupMessageStore-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+
+	// Given a memory store with seqnums, a creation time and messages
+	src, err := NewMemoryStoreFactory().Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	creationTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.Nil(t, src.SetCreationTime(creationTime))
+	require.Nil(t, src.SaveMessage(1, []byte("hello")))
+	require.Nil(t, src.SaveMessage(2, []byte("world")))
+	require.Nil(t, src.SetNextSenderMsgSeqNum(3))
+	require.Nil(t, src.SetNextTargetMsgSeqNum(7))
+
+	// When it is backed up and restored into a file store holding another session
+	var archive bytes.Buffer
+	require.Nil(t, src.Backup(&archive))
+	dst, err := NewFileStoreFactory(map[string]string{FileStorePath: rootPath}).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer dst.Close()
+	require.Nil(t, dst.SaveMessage(5, []byte("stale")))
+	require.Nil(t, dst.Restore(&archive))
+
+	// Then the file store should hold the memory store's session, and nothing else
+	require.Nil(t, dst.Refresh())
+	assert.True(t, creationTime.Equal(dst.CreationTime()))
+	assert.Equal(t, 3, dst.NextSenderMsgSeqNum())
+	assert.Equal(t, 7, dst.NextTargetMsgSeqNum())
+	msgs, err := dst.GetMessages(1, 5)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("hello"), []byte("world")}, msgs)
+}
+
+func TestRestoreMessageStore_RejectsUnknownArchives(t *testing.T) {
+	var testCases = []string{
+		``,
+		`{"format":"something-else","version":1}`,
+		`{"format":"msgstore-backup","version":99}`,
+		"{\"format\":\"msgstore-backup\",\"version\":1}\n{\"seq_num\":1,\"message\":\"aGVsbG8=\"}\n{\"seq_num\":2,\"mess",
+		"{\"format\":\"msgstore-backup\",\"version\":1}\n{\"seq_num\":2,\"message\":\"aGVsbG8=\"}\n{\"seq_num\":1,\"message\":\"aGVsbG8=\"}",
+	}
+
+	for _, archive := range testCases {
+		store, err := NewMemoryStoreFactory().Create("FIX.4.4-SENDER-TARGET")
+		require.Nil(t, err)
+		require.Nil(t, store.SaveMessage(1, []byte("kept")))
+
+		assert.NotNil(t, store.Restore(strings.NewReader(archive)), archive)
+
+		// the store should be left as it was
+		_, found, err := store.GetMessage(1)
+		require.Nil(t, err)
+		assert.True(t, found, archive)
+	}
+}
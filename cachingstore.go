@@ -0,0 +1,362 @@
+package msgstore
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+type cachingStore struct {
+	storeDecorator
+	maxMsgs int
+
+	mu sync.Mutex
+	// lru holds the cached messages as SeqMsgs, the most recently used at the front
+	lru  *list.List
+	msgs map[int]*list.Element
+}
+
+// NewCachingStore returns a MessageStore that keeps the maxMsgs most recently saved or read messages of inner in an LRU
+// cache, so that resend requests for recent ranges never reach the backend.  The seqnums are read from inner, which the
+// stores of the package keep in memory.  A range is served from the cache only if every seqnum of it up to the last one
+// sent is cached, and is otherwise read from inner and cached on the way.
+//
+// The cache must be the only writer of the session.  Cached messages from the next sender seqnum up are dropped when it
+// is set, as they belong to a superseded sequence, and the whole cache is dropped on Refresh, Reset and Restore.  Under
+// DuplicateMessageIgnore inner keeps the first message saved for a seqnum while the cache would hold the last, so such
+// stores should not be wrapped.  The optional interfaces of inner are forwarded, see storeDecorator.
+func NewCachingStore(inner MessageStore, maxMsgs int) MessageStore {
+	return &cachingStore{storeDecorator: newStoreDecorator(inner), maxMsgs: maxMsgs, lru: list.New(), msgs: make(map[int]*list.Element)}
+}
+
+// put caches a copy of msg, which the caller may reuse, as the most recently used message, evicting the least recently
+// used beyond the maximum
+func (store *cachingStore) put(seqNum int, msg []byte) {
+	if store.maxMsgs <= 0 {
+		return
+	}
+	msg = append([]byte(nil), msg...)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if elem, ok := store.msgs[seqNum]; ok {
+		elem.Value = SeqMsg{SeqNum: seqNum, Msg: msg}
+		store.lru.MoveToFront(elem)
+		return
+	}
+	store.msgs[seqNum] = store.lru.PushFront(SeqMsg{SeqNum: seqNum, Msg: msg})
+	for store.lru.Len() > store.maxMsgs {
+		oldest := store.lru.Back()
+		store.lru.Remove(oldest)
+		delete(store.msgs, oldest.Value.(SeqMsg).SeqNum)
+	}
+}
+
+// get returns a copy of the cached message of seqNum, which the caller may modify, reporting whether there is one
+func (store *cachingStore) get(seqNum int) ([]byte, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	elem, ok := store.msgs[seqNum]
+	if !ok {
+		return nil, false
+	}
+	store.lru.MoveToFront(elem)
+	return append([]byte(nil), elem.Value.(SeqMsg).Msg...), true
+}
+
+// getRange returns copies of the cached messages of the range up to the last seqnum sent, which the caller may modify,
+// reporting whether all of them are cached
+func (store *cachingStore) getRange(beginSeqNum, endSeqNum int) ([]SeqMsg, bool) {
+	if last := store.inner.NextSenderMsgSeqNum() - 1; endSeqNum > last {
+		endSeqNum = last
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if endSeqNum < beginSeqNum || endSeqNum-beginSeqNum >= len(store.msgs) {
+		return nil, false
+	}
+	msgs := make([]SeqMsg, 0, endSeqNum-beginSeqNum+1)
+	for seqNum := beginSeqNum; seqNum <= endSeqNum; seqNum++ {
+		elem, ok := store.msgs[seqNum]
+		if !ok {
+			return nil, false
+		}
+		cached := elem.Value.(SeqMsg)
+		msgs = append(msgs, SeqMsg{SeqNum: seqNum, Msg: append([]byte(nil), cached.Msg...)})
+	}
+	for i := len(msgs) - 1; i >= 0; i-- {
+		store.lru.MoveToFront(store.msgs[msgs[i].SeqNum])
+	}
+	return msgs, true
+}
+
+// drop removes the cached messages of seqnums matching fn
+func (store *cachingStore) drop(fn func(seqNum int) bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for seqNum, elem := range store.msgs {
+		if fn(seqNum) {
+			store.lru.Remove(elem)
+			delete(store.msgs, seqNum)
+		}
+	}
+}
+
+// clear removes every cached message
+func (store *cachingStore) clear() {
+	store.drop(func(int) bool { return true })
+}
+
+func (store *cachingStore) NextSenderMsgSeqNum() int {
+	return store.inner.NextSenderMsgSeqNum()
+}
+
+func (store *cachingStore) NextTargetMsgSeqNum() int {
+	return store.inner.NextTargetMsgSeqNum()
+}
+
+func (store *cachingStore) IncrNextSenderMsgSeqNum() error {
+	return store.inner.IncrNextSenderMsgSeqNum()
+}
+
+func (store *cachingStore) IncrNextTargetMsgSeqNum() error {
+	return store.inner.IncrNextTargetMsgSeqNum()
+}
+
+func (store *cachingStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.SetNextSenderMsgSeqNumContext(context.Background(), next)
+}
+
+// SetNextSenderMsgSeqNumContext sets the next sender seqnum of inner, dropping the cached messages from it up
+func (store *cachingStore) SetNextSenderMsgSeqNumContext(ctx context.Context, next int) error {
+	if err := store.storeDecorator.SetNextSenderMsgSeqNumContext(ctx, next); err != nil {
+		return err
+	}
+	store.drop(func(seqNum int) bool { return seqNum >= next })
+	return nil
+}
+
+func (store *cachingStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.inner.SetNextTargetMsgSeqNum(next)
+}
+
+func (store *cachingStore) CreationTime() time.Time {
+	return store.inner.CreationTime()
+}
+
+func (store *cachingStore) SetCreationTime(t time.Time) error {
+	return store.inner.SetCreationTime(t)
+}
+
+func (store *cachingStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.SaveMessageContext(context.Background(), seqNum, msg)
+}
+
+func (store *cachingStore) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) error {
+	if err := store.storeDecorator.SaveMessageContext(ctx, seqNum, msg); err != nil {
+		return err
+	}
+	store.put(seqNum, msg)
+	return nil
+}
+
+// SaveMessageWithMeta saves the message to inner, caching it only if it is outgoing, as incoming messages are not read
+// back for resends and would otherwise take the place of the outgoing message of their seqnum
+func (store *cachingStore) SaveMessageWithMeta(seqNum int, msg []byte, meta MessageMeta) error {
+	if err := store.storeDecorator.SaveMessageWithMeta(seqNum, msg, meta); err != nil {
+		return err
+	}
+	if meta.Direction == "" || meta.Direction == MessageOutgoing {
+		store.put(seqNum, msg)
+	}
+	return nil
+}
+
+func (store *cachingStore) SaveMessages(msgs []SeqMsg) error {
+	return store.SaveMessagesContext(context.Background(), msgs)
+}
+
+func (store *cachingStore) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) error {
+	if err := store.storeDecorator.SaveMessagesContext(ctx, msgs); err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		store.put(m.SeqNum, m.Msg)
+	}
+	return nil
+}
+
+func (store *cachingStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.GetMessagesContext(context.Background(), beginSeqNum, endSeqNum)
+}
+
+func (store *cachingStore) GetMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int) ([][]byte, error) {
+	var msgs [][]byte
+	err := store.IterateMessagesContext(ctx, beginSeqNum, endSeqNum, func(_ int, msg []byte) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	return msgs, err
+}
+
+func (store *cachingStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return GetMessagesAfter(store, seqNum)
+}
+
+func (store *cachingStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return GetMessagesReversed(store, beginSeqNum, endSeqNum)
+}
+
+func (store *cachingStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return store.GetMessageContext(context.Background(), seqNum)
+}
+
+func (store *cachingStore) GetMessageContext(ctx context.Context, seqNum int) ([]byte, bool, error) {
+	if msg, ok := store.get(seqNum); ok {
+		return msg, true, nil
+	}
+	msg, found, err := store.storeDecorator.GetMessageContext(ctx, seqNum)
+	if err == nil && found {
+		store.put(seqNum, msg)
+	}
+	return msg, found, err
+}
+
+func (store *cachingStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.IterateMessagesContext(context.Background(), beginSeqNum, endSeqNum, fn)
+}
+
+// IterateMessagesContext calls fn with the cached messages of the range if all of them are cached, and otherwise with
+// those read from inner, caching them
+func (store *cachingStore) IterateMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	if msgs, ok := store.getRange(beginSeqNum, endSeqNum); ok {
+		for _, m := range msgs {
+			if err := fn(m.SeqNum, m.Msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return store.storeDecorator.IterateMessagesContext(ctx, beginSeqNum, endSeqNum, func(seqNum int, msg []byte) error {
+		store.put(seqNum, msg)
+		return fn(seqNum, msg)
+	})
+}
+
+func (store *cachingStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+func (store *cachingStore) BeginTx() (StoreTx, error) {
+	return store.BeginTxContext(context.Background())
+}
+
+// BeginTxContext starts a transaction of inner, whose writes are applied to the cache once it commits
+func (store *cachingStore) BeginTxContext(ctx context.Context) (StoreTx, error) {
+	tx, err := store.storeDecorator.BeginTxContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &cachingTx{StoreTx: tx, store: store}, nil
+}
+
+func (store *cachingStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.DeleteMessagesUpToContext(context.Background(), seqNum)
+}
+
+func (store *cachingStore) DeleteMessagesUpToContext(ctx context.Context, seqNum int) error {
+	if err := store.storeDecorator.DeleteMessagesUpToContext(ctx, seqNum); err != nil {
+		return err
+	}
+	store.drop(func(s int) bool { return s <= seqNum })
+	return nil
+}
+
+func (store *cachingStore) Backup(w io.Writer) error {
+	return store.inner.Backup(w)
+}
+
+func (store *cachingStore) Restore(r io.Reader) error {
+	defer store.clear()
+	return store.inner.Restore(r)
+}
+
+func (store *cachingStore) HealthCheck(ctx context.Context) error {
+	return store.inner.HealthCheck(ctx)
+}
+
+func (store *cachingStore) Flush() error {
+	return store.inner.Flush()
+}
+
+func (store *cachingStore) Refresh() error {
+	return store.RefreshContext(context.Background())
+}
+
+func (store *cachingStore) RefreshContext(ctx context.Context) error {
+	defer store.clear()
+	return store.storeDecorator.RefreshContext(ctx)
+}
+
+func (store *cachingStore) Reset() error {
+	return store.ResetContext(context.Background())
+}
+
+func (store *cachingStore) ResetContext(ctx context.Context) error {
+	defer store.clear()
+	return store.storeDecorator.ResetContext(ctx)
+}
+
+// ResetWithoutDeletingMessages resets inner keeping its messages, which are no longer read, so the cache is dropped
+func (store *cachingStore) ResetWithoutDeletingMessages() error {
+	defer store.clear()
+	return store.storeDecorator.ResetWithoutDeletingMessages()
+}
+
+func (store *cachingStore) Close() error {
+	store.clear()
+	return store.inner.Close()
+}
+
+// cachingTx is a transaction of the inner store of a cachingStore, recording its writes for the cache
+type cachingTx struct {
+	StoreTx
+	store      *cachingStore
+	msgs       []SeqMsg
+	nextSender int
+}
+
+func (tx *cachingTx) SaveMessage(seqNum int, msg []byte) error {
+	if err := tx.StoreTx.SaveMessage(seqNum, msg); err != nil {
+		return err
+	}
+	tx.msgs = append(tx.msgs, SeqMsg{SeqNum: seqNum, Msg: msg})
+	return nil
+}
+
+func (tx *cachingTx) SetNextSenderMsgSeqNum(next int) error {
+	if err := tx.StoreTx.SetNextSenderMsgSeqNum(next); err != nil {
+		return err
+	}
+	tx.nextSender = next
+	return nil
+}
+
+// Commit commits the transaction of inner, and then applies its writes to the cache like those made outside one
+func (tx *cachingTx) Commit() error {
+	if err := tx.StoreTx.Commit(); err != nil {
+		return err
+	}
+	if tx.nextSender > 0 {
+		tx.store.drop(func(seqNum int) bool { return seqNum >= tx.nextSender })
+	}
+	for _, m := range tx.msgs {
+		tx.store.put(m.SeqNum, m.Msg)
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package msgstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// CachingStoreTestSuite runs all tests in the MessageStoreTestSuite against a caching store over the MemoryStore
+type CachingStoreTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *CachingStoreTestSuite) SetupTest() {
+	inner, err := NewMemoryStoreFactory().Create("session")
+	require.Nil(suite.T(), err)
+	suite.msgStore = NewCachingStore(inner, 3)
+}
+
+func TestCachingStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(CachingStoreTestSuite))
+}
+
+// countingStore counts the reads of messages made on its store
+type countingStore struct {
+	MessageStore
+	reads int
+}
+
+func (store *countingStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	store.reads++
+	return store.MessageStore.GetMessage(seqNum)
+}
+
+func (store *countingStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	store.reads++
+	return store.MessageStore.IterateMessages(beginSeqNum, endSeqNum, fn)
+}
+
+// newCountingCachingStore returns a caching store of maxMsgs messages over a counted memory store holding messages 1 to 5
+func newCountingCachingStore(t *testing.T, maxMsgs int) (MessageStore, *countingStore) {
+	memStore, err := NewMemoryStoreFactory().Create("session")
+	require.Nil(t, err)
+	inner := &countingStore{MessageStore: memStore}
+	store := NewCachingStore(inner, maxMsgs)
+	for seqNum := 1; seqNum <= 5; seqNum++ {
+		require.Nil(t, store.SaveMessage(seqNum, []byte{byte('0' + seqNum)}))
+		require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	}
+	return store, inner
+}
+
+func TestCachingStore_ServesRecentMessages(t *testing.T) {
+	// Given a caching store of 3 messages that has saved 5
+	store, inner := newCountingCachingStore(t, 3)
+
+	// When the most recent ones are read
+	msgs, err := store.GetMessages(3, 10)
+	require.Nil(t, err)
+	msg, found, err := store.GetMessage(5)
+	require.Nil(t, err)
+
+	// Then they should be served from the cache
+	assert.Equal(t, [][]byte{[]byte("3"), []byte("4"), []byte("5")}, msgs)
+	assert.True(t, found)
+	assert.Equal(t, []byte("5"), msg)
+	assert.Equal(t, 0, inner.reads)
+
+	// And older ones should be read from the inner store
+	msgs, err = store.GetMessages(1, 5)
+	require.Nil(t, err)
+	assert.Len(t, msgs, 5)
+	assert.Equal(t, 1, inner.reads)
+}
+
+func TestCachingStore_Evicts(t *testing.T) {
+	// Given a caching store of 3 messages that has saved 5
+	store, inner := newCountingCachingStore(t, 3)
+
+	// When an evicted message is read
+	msg, found, err := store.GetMessage(1)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("1"), msg)
+	assert.Equal(t, 1, inner.reads)
+
+	// Then it should be cached in place of the least recently used one
+	_, _, err = store.GetMessage(1)
+	require.Nil(t, err)
+	assert.Equal(t, 1, inner.reads)
+	_, err = store.GetMessages(3, 5)
+	require.Nil(t, err)
+	assert.Equal(t, 2, inner.reads)
+}
+
+func TestCachingStore_Invalidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		invalidate func(store MessageStore) error
+		reads      int
+	}{
+		{"SetNextSenderMsgSeqNum", func(store MessageStore) error { return store.SetNextSenderMsgSeqNum(4) }, 1},
+		{"SetNextTargetMsgSeqNum", func(store MessageStore) error { return store.SetNextTargetMsgSeqNum(4) }, 0},
+		{"DeleteMessagesUpTo", func(store MessageStore) error { return store.DeleteMessagesUpTo(4) }, 1},
+		{"Refresh", func(store MessageStore) error { return store.Refresh() }, 1},
+		{"Reset", func(store MessageStore) error { return store.Reset() }, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Given a caching store holding messages 1 to 5
+			store, inner := newCountingCachingStore(t, 5)
+
+			// When it is invalidated
+			require.Nil(t, tt.invalidate(store))
+
+			// Then message 4 should be read from the inner store only if it was dropped
+			_, _, err := store.GetMessage(4)
+			require.Nil(t, err)
+			assert.Equal(t, tt.reads, inner.reads)
+		})
+	}
+}
+
+func TestCachingStore_SetNextSenderMsgSeqNum(t *testing.T) {
+	// Given a caching store holding messages 1 to 5
+	store, _ := newCountingCachingStore(t, 5)
+
+	// When the sender seqnum is set back and message 4 saved again
+	require.Nil(t, store.SetNextSenderMsgSeqNum(4))
+	require.Nil(t, store.SaveMessage(4, []byte("four")))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+
+	// Then the range should hold the new message, and none of the superseded sequence
+	msgs, err := store.GetMessages(1, 10)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("1"), []byte("2"), []byte("3"), []byte("four")}, msgs)
+}
+
+func TestCachingStore_BeginTx(t *testing.T) {
+	// Given a caching store holding messages 1 to 5
+	store, inner := newCountingCachingStore(t, 5)
+
+	// When a transaction saves message 6, but is rolled back
+	tx, err := store.BeginTx()
+	require.Nil(t, err)
+	require.Nil(t, tx.SaveMessage(6, []byte("6")))
+	require.Nil(t, tx.Rollback())
+
+	// Then it should not be cached
+	_, found, err := store.GetMessage(6)
+	require.Nil(t, err)
+	assert.False(t, found)
+	assert.Equal(t, 1, inner.reads)
+
+	// When a transaction saves it and commits
+	tx, err = store.BeginTx()
+	require.Nil(t, err)
+	require.Nil(t, tx.SaveMessage(6, []byte("6")))
+	require.Nil(t, tx.SetNextSenderMsgSeqNum(7))
+	require.Nil(t, tx.Commit())
+
+	// Then it should be served from the cache
+	msgs, err := store.GetMessages(4, 6)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("4"), []byte("5"), []byte("6")}, msgs)
+	assert.Equal(t, 1, inner.reads)
+}
+
+func TestCachingStore_CopiesSavedMessages(t *testing.T) {
+	// Given a caching store
+	inner, err := NewMemoryStoreFactory().Create("session")
+	require.Nil(t, err)
+	store := NewCachingStore(inner, 3)
+
+	// When a message is saved, and its buffer then reused by the caller
+	buf := []byte("one")
+	require.Nil(t, store.SaveMessage(1, buf))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	copy(buf, "two")
+
+	// Then the message served from the cache should be the one saved
+	msg, found, err := store.GetMessage(1)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("one"), msg)
+}
+
+func TestCachingStore_CopiesServedMessages(t *testing.T) {
+	// Given a caching store holding two messages
+	inner, err := NewMemoryStoreFactory().Create("session")
+	require.Nil(t, err)
+	store := NewCachingStore(inner, 3)
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+	require.Nil(t, store.SaveMessage(2, []byte("two")))
+	require.Nil(t, store.SetNextSenderMsgSeqNum(3))
+
+	// When the messages served from the cache are modified by the caller
+	msg, found, err := store.GetMessage(1)
+	require.Nil(t, err)
+	require.True(t, found)
+	copy(msg, "xxx")
+	msgs, err := store.GetMessages(1, 2)
+	require.Nil(t, err)
+	copy(msgs[1], "yyy")
+
+	// Then later resends should still be served the messages saved
+	msgs, err = store.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("one"), []byte("two")}, msgs)
+}
+
+// outgoingMetaStore implements MessageMetaStore over a memory store, keeping only the outgoing messages, which are
+// the ones the backends read back for resends
+type outgoingMetaStore struct {
+	MessageStore
+}
+
+func (store outgoingMetaStore) SaveMessageWithMeta(seqNum int, msg []byte, meta MessageMeta) error {
+	if meta.Direction == MessageIncoming {
+		return nil
+	}
+	return store.SaveMessage(seqNum, msg)
+}
+
+func (store outgoingMetaStore) GetStoredMessages(filter MessageFilter) ([]StoredMessage, error) {
+	return nil, ErrUnsupported
+}
+
+func TestCachingStore_SaveMessageWithMeta(t *testing.T) {
+	// Given a caching store over a store recording message directions
+	inner, err := NewMemoryStoreFactory().Create("session")
+	require.Nil(t, err)
+	store := NewCachingStore(outgoingMetaStore{inner}, 3)
+	metaStore, ok := store.(MessageMetaStore)
+	require.True(t, ok)
+
+	// When an outgoing and an incoming message are saved under the same seqnum
+	require.Nil(t, metaStore.SaveMessageWithMeta(1, []byte("sent"), MessageMeta{Direction: MessageOutgoing}))
+	require.Nil(t, metaStore.SaveMessageWithMeta(1, []byte("received"), MessageMeta{Direction: MessageIncoming}))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+
+	// Then a resend should be served the outgoing message
+	msgs, err := store.GetMessages(1, 1)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("sent")}, msgs)
+	msg, found, err := store.GetMessage(1)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("sent"), msg)
+}
@@ -0,0 +1,592 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by the operations a circuit breaker store fails fast, see NewCircuitBreakerStore
+var ErrCircuitOpen = errors.New("message store circuit breaker is open")
+
+// CircuitState is the state of the circuit of a circuit breaker store
+type CircuitState int
+
+const (
+	// CircuitClosed passes operations to the backend
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails operations fast, or buffers the writes, until the cool-down has passed
+	CircuitOpen
+	// CircuitHalfOpen passes a single trial operation to the backend, deciding whether the circuit closes or opens again
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreakerOption configures a store created by NewCircuitBreakerStore
+type CircuitBreakerOption func(*circuitBreakerStore)
+
+// WithCircuitBreakerClock times the cool-down by clock.  Defaults to the system clock.
+func WithCircuitBreakerClock(clock Clock) CircuitBreakerOption {
+	return func(store *circuitBreakerStore) { store.clock = clock }
+}
+
+// WithCircuitBreakerStateChange calls fn with each change of the state of the circuit, e.g. to alert on or to export
+// it.  fn is called after the operation changing the state has released the store, so it may use the store.
+func WithCircuitBreakerStateChange(fn func(from, to CircuitState)) CircuitBreakerOption {
+	return func(store *circuitBreakerStore) { store.onStateChange = fn }
+}
+
+// WithCircuitBreakerFailures counts the failures for which isFailure is true towards opening the circuit.  Defaults to
+// IsBackendFailure, counting the failures of the backend but not the operations it refused.
+func WithCircuitBreakerFailures(isFailure func(err error) bool) CircuitBreakerOption {
+	return func(store *circuitBreakerStore) { store.isFailure = isFailure }
+}
+
+// WithCircuitBreakerDegradeToMemory buffers the saves and seqnum changes in memory while the circuit is open, instead
+// of failing them, and writes them to the backend as the trial of the half-open circuit, so that sessions keep running
+// through an outage.  The reads, deletes and other operations still fail fast.  The buffered writes are lost if the
+// process exits before the backend recovers.
+func WithCircuitBreakerDegradeToMemory() CircuitBreakerOption {
+	return func(store *circuitBreakerStore) { store.degrade = true }
+}
+
+// circuitBuffer holds the writes made while the circuit of a degrading store is open
+type circuitBuffer struct {
+	msgs            []SeqMsg
+	nextSender      int
+	nextTarget      int
+	creationTime    time.Time
+	creationTimeSet bool
+}
+
+// replay makes the writes of the buffer on store, returning the number of messages saved.  The messages are saved one
+// at a time, so that a replay failing part way is resumed after the last message saved rather than saving it again.
+func (b circuitBuffer) replay(store MessageStore) (saved int, err error) {
+	for _, m := range b.msgs {
+		if err = store.SaveMessage(m.SeqNum, m.Msg); err != nil {
+			return
+		}
+		saved++
+	}
+	if err = store.SetNextSenderMsgSeqNum(b.nextSender); err != nil {
+		return
+	}
+	if err = store.SetNextTargetMsgSeqNum(b.nextTarget); err != nil {
+		return
+	}
+	if b.creationTimeSet {
+		err = store.SetCreationTime(b.creationTime)
+	}
+	return
+}
+
+// sameSeqNums reports whether the buffer holds the seqnums and creation time of other
+func (b circuitBuffer) sameSeqNums(other circuitBuffer) bool {
+	return b.nextSender == other.nextSender && b.nextTarget == other.nextTarget &&
+		b.creationTimeSet == other.creationTimeSet && b.creationTime.Equal(other.creationTime)
+}
+
+type circuitBreakerStore struct {
+	storeDecorator
+	threshold     int
+	coolDown      time.Duration
+	clock         Clock
+	onStateChange func(from, to CircuitState)
+	isFailure     func(err error) bool
+	degrade       bool
+
+	// replayMu is held while the buffer is replayed, which is done without holding mu, and is taken before mu
+	replayMu sync.Mutex
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	buffer   *circuitBuffer
+	changes  []CircuitState
+}
+
+// NewCircuitBreakerStore returns a MessageStore that opens its circuit after threshold consecutive failures of inner,
+// then fails its operations fast with ErrCircuitOpen for coolDown rather than waiting on a backend that is down.  After
+// coolDown the next operation is passed to inner as a trial, closing the circuit if it succeeds and opening it again if
+// it fails, while the others keep failing fast.  The cached seqnum getters and Close always pass to inner.  The optional
+// interfaces of inner are forwarded through the circuit, see storeDecorator, their writes failing fast rather than
+// being buffered.
+func NewCircuitBreakerStore(inner MessageStore, threshold int, coolDown time.Duration, opts ...CircuitBreakerOption) MessageStore {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	store := &circuitBreakerStore{storeDecorator: newStoreDecorator(inner), threshold: threshold, coolDown: coolDown, isFailure: IsBackendFailure}
+	for _, opt := range opts {
+		opt(store)
+	}
+	return store
+}
+
+// setState changes the state of the circuit, noting the change for unlock to report.  The store must be locked.
+func (store *circuitBreakerStore) setState(state CircuitState) {
+	if state == store.state {
+		return
+	}
+	store.changes = append(store.changes, store.state, state)
+	store.state = state
+	if state == CircuitOpen {
+		store.openedAt = clockNow(store.clock)
+	}
+	if state == CircuitClosed {
+		store.failures = 0
+	}
+}
+
+// unlock unlocks the store and reports the changes of state made while it was locked
+func (store *circuitBreakerStore) unlock() {
+	changes := store.changes
+	store.changes = nil
+	store.mu.Unlock()
+
+	if store.onStateChange != nil {
+		for i := 0; i < len(changes); i += 2 {
+			store.onStateChange(changes[i], changes[i+1])
+		}
+	}
+}
+
+// acquire returns ErrCircuitOpen if an operation is to fail fast, and otherwise whether it is the trial of the
+// half-open circuit.  The writes buffered by a degrading store are the trial, see closeCircuit.
+func (store *circuitBreakerStore) acquire() (trial bool, err error) {
+	store.mu.Lock()
+	defer store.unlock()
+
+	switch store.state {
+	case CircuitClosed:
+		return false, nil
+	case CircuitOpen:
+		if clockNow(store.clock).Sub(store.openedAt) < store.coolDown {
+			return false, ErrCircuitOpen
+		}
+		store.setState(CircuitHalfOpen)
+		if store.buffer == nil {
+			return true, nil
+		}
+		if !store.closeCircuit() {
+			return false, ErrCircuitOpen
+		}
+		return false, nil
+	default:
+		return false, ErrCircuitOpen
+	}
+}
+
+// closeCircuit closes the circuit, first draining the buffer of the writes made while it was open or half-open into
+// inner, and reports whether it did.  Should the replay fail, the circuit is opened again and the writes left are kept
+// buffered.  The store must be locked, and is unlocked during the replay, see replayBuffer.
+func (store *circuitBreakerStore) closeCircuit() bool {
+	for store.buffer != nil {
+		if err := store.replayBuffer(); err != nil {
+			store.setState(CircuitOpen)
+			return false
+		}
+	}
+	store.setState(CircuitClosed)
+	return true
+}
+
+// replayBuffer replays a snapshot of the buffer into inner without holding the store, so that its readers are not
+// blocked for the length of a backend catch-up, then drops the messages saved from the buffer, and the buffer itself
+// unless writes were buffered meanwhile.  The store must be locked, and is unlocked during the replay.
+func (store *circuitBreakerStore) replayBuffer() error {
+	store.mu.Unlock()
+	store.replayMu.Lock()
+	defer store.replayMu.Unlock()
+	store.mu.Lock()
+
+	// Close may have replayed the buffer while the store was unlocked
+	if store.buffer == nil {
+		return nil
+	}
+	snapshot := *store.buffer
+	store.mu.Unlock()
+	saved, err := snapshot.replay(store.inner)
+	store.mu.Lock()
+
+	store.buffer.msgs = store.buffer.msgs[saved:]
+	if err == nil && len(store.buffer.msgs) == 0 && store.buffer.sameSeqNums(snapshot) {
+		store.buffer = nil
+	}
+	return err
+}
+
+// release records the outcome err of an operation
+func (store *circuitBreakerStore) release(trial bool, err error) {
+	store.mu.Lock()
+	defer store.unlock()
+
+	failed := store.isFailure(err)
+	switch {
+	case trial && failed:
+		store.setState(CircuitOpen)
+	case trial:
+		store.closeCircuit()
+	case store.state != CircuitClosed:
+	case failed:
+		store.failures++
+		if store.failures >= store.threshold {
+			store.setState(CircuitOpen)
+		}
+	default:
+		store.failures = 0
+	}
+}
+
+// do runs op on the inner store unless the circuit is open
+func (store *circuitBreakerStore) do(op func() error) error {
+	trial, err := store.acquire()
+	if err != nil {
+		return err
+	}
+	err = op()
+	store.release(trial, err)
+	return err
+}
+
+// write runs op on the inner store unless the circuit is open, in which case a degrading store applies buffered to its
+// buffer instead
+func (store *circuitBreakerStore) write(op func() error, buffered func(b *circuitBuffer)) error {
+	err := store.do(op)
+	if err != ErrCircuitOpen || !store.degrade {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.unlock()
+
+	if store.buffer == nil {
+		store.buffer = &circuitBuffer{
+			nextSender: store.inner.NextSenderMsgSeqNum(),
+			nextTarget: store.inner.NextTargetMsgSeqNum(),
+		}
+	}
+	buffered(store.buffer)
+	return nil
+}
+
+// NextSenderMsgSeqNum returns the buffered seqnum while writes are buffered
+func (store *circuitBreakerStore) NextSenderMsgSeqNum() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.buffer != nil {
+		return store.buffer.nextSender
+	}
+	return store.inner.NextSenderMsgSeqNum()
+}
+
+// NextTargetMsgSeqNum returns the buffered seqnum while writes are buffered
+func (store *circuitBreakerStore) NextTargetMsgSeqNum() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.buffer != nil {
+		return store.buffer.nextTarget
+	}
+	return store.inner.NextTargetMsgSeqNum()
+}
+
+func (store *circuitBreakerStore) IncrNextSenderMsgSeqNum() error {
+	return store.IncrNextSenderMsgSeqNumContext(context.Background())
+}
+
+func (store *circuitBreakerStore) IncrNextSenderMsgSeqNumContext(ctx context.Context) error {
+	return store.write(func() error { return store.storeDecorator.IncrNextSenderMsgSeqNumContext(ctx) },
+		func(b *circuitBuffer) { b.nextSender++ })
+}
+
+func (store *circuitBreakerStore) IncrNextTargetMsgSeqNum() error {
+	return store.IncrNextTargetMsgSeqNumContext(context.Background())
+}
+
+func (store *circuitBreakerStore) IncrNextTargetMsgSeqNumContext(ctx context.Context) error {
+	return store.write(func() error { return store.storeDecorator.IncrNextTargetMsgSeqNumContext(ctx) },
+		func(b *circuitBuffer) { b.nextTarget++ })
+}
+
+func (store *circuitBreakerStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.SetNextSenderMsgSeqNumContext(context.Background(), next)
+}
+
+func (store *circuitBreakerStore) SetNextSenderMsgSeqNumContext(ctx context.Context, next int) error {
+	return store.write(func() error { return store.storeDecorator.SetNextSenderMsgSeqNumContext(ctx, next) },
+		func(b *circuitBuffer) { b.nextSender = next })
+}
+
+func (store *circuitBreakerStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.SetNextTargetMsgSeqNumContext(context.Background(), next)
+}
+
+func (store *circuitBreakerStore) SetNextTargetMsgSeqNumContext(ctx context.Context, next int) error {
+	return store.write(func() error { return store.storeDecorator.SetNextTargetMsgSeqNumContext(ctx, next) },
+		func(b *circuitBuffer) { b.nextTarget = next })
+}
+
+// CreationTime returns the buffered creation time while it is buffered
+func (store *circuitBreakerStore) CreationTime() time.Time {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.buffer != nil && store.buffer.creationTimeSet {
+		return store.buffer.creationTime
+	}
+	return store.inner.CreationTime()
+}
+
+func (store *circuitBreakerStore) SetCreationTime(t time.Time) error {
+	return store.SetCreationTimeContext(context.Background(), t)
+}
+
+func (store *circuitBreakerStore) SetCreationTimeContext(ctx context.Context, t time.Time) error {
+	return store.write(func() error { return store.storeDecorator.SetCreationTimeContext(ctx, t) },
+		func(b *circuitBuffer) { b.creationTime, b.creationTimeSet = t, true })
+}
+
+func (store *circuitBreakerStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.SaveMessageContext(context.Background(), seqNum, msg)
+}
+
+func (store *circuitBreakerStore) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) error {
+	return store.write(func() error { return store.storeDecorator.SaveMessageContext(ctx, seqNum, msg) },
+		func(b *circuitBuffer) {
+			b.msgs = append(b.msgs, SeqMsg{SeqNum: seqNum, Msg: append([]byte(nil), msg...)})
+		})
+}
+
+func (store *circuitBreakerStore) SaveMessageWithMeta(seqNum int, msg []byte, meta MessageMeta) error {
+	return store.do(func() error { return store.storeDecorator.SaveMessageWithMeta(seqNum, msg, meta) })
+}
+
+func (store *circuitBreakerStore) SaveMessages(msgs []SeqMsg) error {
+	return store.SaveMessagesContext(context.Background(), msgs)
+}
+
+func (store *circuitBreakerStore) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) error {
+	return store.write(func() error { return store.storeDecorator.SaveMessagesContext(ctx, msgs) },
+		func(b *circuitBuffer) {
+			for _, m := range msgs {
+				b.msgs = append(b.msgs, SeqMsg{SeqNum: m.SeqNum, Msg: append([]byte(nil), m.Msg...)})
+			}
+		})
+}
+
+func (store *circuitBreakerStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.GetMessagesContext(context.Background(), beginSeqNum, endSeqNum)
+}
+
+func (store *circuitBreakerStore) GetMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int) (msgs [][]byte, err error) {
+	err = store.do(func() error {
+		msgs, err = store.storeDecorator.GetMessagesContext(ctx, beginSeqNum, endSeqNum)
+		return err
+	})
+	return msgs, err
+}
+
+func (store *circuitBreakerStore) GetMessagesSince(seqNum int) (msgs [][]byte, err error) {
+	err = store.do(func() error {
+		msgs, err = store.inner.GetMessagesSince(seqNum)
+		return err
+	})
+	return msgs, err
+}
+
+func (store *circuitBreakerStore) GetMessagesDescending(beginSeqNum, endSeqNum int) (msgs [][]byte, err error) {
+	err = store.do(func() error {
+		msgs, err = store.inner.GetMessagesDescending(beginSeqNum, endSeqNum)
+		return err
+	})
+	return msgs, err
+}
+
+func (store *circuitBreakerStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return store.GetMessageContext(context.Background(), seqNum)
+}
+
+func (store *circuitBreakerStore) GetMessageContext(ctx context.Context, seqNum int) (msg []byte, found bool, err error) {
+	err = store.do(func() error {
+		msg, found, err = store.storeDecorator.GetMessageContext(ctx, seqNum)
+		return err
+	})
+	return msg, found, err
+}
+
+func (store *circuitBreakerStore) GetStoredMessages(filter MessageFilter) (msgs []StoredMessage, err error) {
+	err = store.do(func() error {
+		msgs, err = store.storeDecorator.GetStoredMessages(filter)
+		return err
+	})
+	return msgs, err
+}
+
+func (store *circuitBreakerStore) LastSeqNumStoredBefore(direction MessageDirection, t time.Time) (seqNum int, err error) {
+	err = store.do(func() error {
+		seqNum, err = store.storeDecorator.LastSeqNumStoredBefore(direction, t)
+		return err
+	})
+	return seqNum, err
+}
+
+func (store *circuitBreakerStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.IterateMessagesContext(context.Background(), beginSeqNum, endSeqNum, fn)
+}
+
+func (store *circuitBreakerStore) IterateMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.do(func() error { return store.storeDecorator.IterateMessagesContext(ctx, beginSeqNum, endSeqNum, fn) })
+}
+
+func (store *circuitBreakerStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+func (store *circuitBreakerStore) MessageCount() (count int, err error) {
+	err = store.do(func() error {
+		count, err = store.storeDecorator.MessageCount()
+		return err
+	})
+	return count, err
+}
+
+func (store *circuitBreakerStore) FirstSeqNum() (seqNum int, err error) {
+	err = store.do(func() error {
+		seqNum, err = store.storeDecorator.FirstSeqNum()
+		return err
+	})
+	return seqNum, err
+}
+
+func (store *circuitBreakerStore) LastSeqNum() (seqNum int, err error) {
+	err = store.do(func() error {
+		seqNum, err = store.storeDecorator.LastSeqNum()
+		return err
+	})
+	return seqNum, err
+}
+
+func (store *circuitBreakerStore) SetSessionValue(key, value string) error {
+	return store.do(func() error { return store.storeDecorator.SetSessionValue(key, value) })
+}
+
+func (store *circuitBreakerStore) GetSessionValue(key string) (value string, found bool, err error) {
+	err = store.do(func() error {
+		value, found, err = store.storeDecorator.GetSessionValue(key)
+		return err
+	})
+	return value, found, err
+}
+
+func (store *circuitBreakerStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.DeleteMessagesUpToContext(context.Background(), seqNum)
+}
+
+func (store *circuitBreakerStore) DeleteMessagesUpToContext(ctx context.Context, seqNum int) error {
+	return store.do(func() error { return store.storeDecorator.DeleteMessagesUpToContext(ctx, seqNum) })
+}
+
+func (store *circuitBreakerStore) BeginTx() (StoreTx, error) {
+	return store.BeginTxContext(context.Background())
+}
+
+// BeginTxContext of a degrading store returns a buffered transaction while the circuit is open, whose Commit is
+// buffered.  The Commit of the transactions of inner counts towards opening the circuit.
+func (store *circuitBreakerStore) BeginTxContext(ctx context.Context) (StoreTx, error) {
+	var tx StoreTx
+	err := store.do(func() (err error) {
+		tx, err = store.storeDecorator.BeginTxContext(ctx)
+		return err
+	})
+	if err == ErrCircuitOpen && store.degrade {
+		return BeginBufferedTx(store), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &circuitBreakerTx{StoreTx: tx, store: store}, nil
+}
+
+func (store *circuitBreakerStore) Backup(w io.Writer) error {
+	return store.do(func() error { return store.inner.Backup(w) })
+}
+
+func (store *circuitBreakerStore) Restore(r io.Reader) error {
+	return store.do(func() error { return store.inner.Restore(r) })
+}
+
+func (store *circuitBreakerStore) HealthCheck(ctx context.Context) error {
+	return store.do(func() error { return store.inner.HealthCheck(ctx) })
+}
+
+func (store *circuitBreakerStore) Flush() error {
+	return store.do(store.inner.Flush)
+}
+
+func (store *circuitBreakerStore) Refresh() error {
+	return store.RefreshContext(context.Background())
+}
+
+func (store *circuitBreakerStore) RefreshContext(ctx context.Context) error {
+	return store.do(func() error { return store.storeDecorator.RefreshContext(ctx) })
+}
+
+func (store *circuitBreakerStore) Reset() error {
+	return store.ResetContext(context.Background())
+}
+
+func (store *circuitBreakerStore) ResetContext(ctx context.Context) error {
+	return store.do(func() error { return store.storeDecorator.ResetContext(ctx) })
+}
+
+func (store *circuitBreakerStore) ResetWithoutDeletingMessages() error {
+	return store.do(store.storeDecorator.ResetWithoutDeletingMessages)
+}
+
+// Close writes any buffered writes to inner, whatever the state of the circuit, before closing it.  They are lost if
+// that fails.
+func (store *circuitBreakerStore) Close() error {
+	store.replayMu.Lock()
+	defer store.replayMu.Unlock()
+
+	store.mu.Lock()
+	buffer := store.buffer
+	store.buffer = nil
+	store.mu.Unlock()
+
+	if buffer != nil {
+		if _, err := buffer.replay(store.inner); err != nil {
+			store.inner.Close()
+			return err
+		}
+	}
+	return store.inner.Close()
+}
+
+// circuitBreakerTx counts the outcome of the Commit of a transaction of the inner store
+type circuitBreakerTx struct {
+	StoreTx
+	store *circuitBreakerStore
+}
+
+func (tx *circuitBreakerTx) Commit() error {
+	err := tx.StoreTx.Commit()
+	tx.store.release(false, err)
+	return err
+}
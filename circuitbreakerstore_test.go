@@ -0,0 +1,233 @@
+package msgstore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// CircuitBreakerStoreTestSuite runs all tests in the MessageStoreTestSuite against a circuit breaker store
+type CircuitBreakerStoreTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *CircuitBreakerStoreTestSuite) SetupTest() {
+	inner, err := NewMemoryStoreFactory().Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(suite.T(), err)
+	suite.msgStore = NewCircuitBreakerStore(inner, 3, time.Second)
+}
+
+func TestCircuitBreakerStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(CircuitBreakerStoreTestSuite))
+}
+
+// newBrokenCircuit returns a circuit breaker store opening after 2 failures, over a store failing every operation,
+// with its clock and the recorded changes of its state
+func newBrokenCircuit(t *testing.T, opts ...CircuitBreakerOption) (MessageStore, FaultStore, *manualClock, *[]CircuitState) {
+	inner, err := NewMemoryStoreFactory().Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	faulty := NewFaultStore(inner, WithFault(Fault{Err: errors.New("connection refused")}))
+	clock := &manualClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	var changes []CircuitState
+	opts = append(opts, WithCircuitBreakerClock(clock), WithCircuitBreakerStateChange(func(from, to CircuitState) {
+		changes = append(changes, to)
+	}))
+	return NewCircuitBreakerStore(faulty, 2, time.Minute, opts...), faulty, clock, &changes
+}
+
+func TestCircuitBreakerStore_OpensAndCloses(t *testing.T) {
+	// Given a circuit breaker store whose backend fails
+	store, faulty, clock, changes := newBrokenCircuit(t)
+
+	// When it fails as many times in a row as the threshold
+	assert.EqualError(t, store.SaveMessage(1, []byte("msg1")), "connection refused")
+	assert.EqualError(t, store.SaveMessage(1, []byte("msg1")), "connection refused")
+
+	// Then its operations should fail fast
+	assert.Equal(t, ErrCircuitOpen, store.SaveMessage(1, []byte("msg1")))
+	_, _, err := store.GetMessage(1)
+	assert.Equal(t, ErrCircuitOpen, err)
+	assert.Equal(t, []CircuitState{CircuitOpen}, *changes)
+
+	// When the cool-down has passed and the trial fails
+	clock.Set(clock.Now().Add(time.Minute))
+	assert.EqualError(t, store.SaveMessage(1, []byte("msg1")), "connection refused")
+
+	// Then it should open again
+	assert.Equal(t, ErrCircuitOpen, store.SaveMessage(1, []byte("msg1")))
+	assert.Equal(t, []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitOpen}, *changes)
+
+	// When the backend recovers and the cool-down has passed
+	faulty.Clear()
+	clock.Set(clock.Now().Add(time.Minute))
+
+	// Then the trial should close it
+	require.Nil(t, store.SaveMessage(1, []byte("msg1")))
+	assert.Equal(t, []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitOpen, CircuitHalfOpen, CircuitClosed}, *changes)
+	msg, found, err := store.GetMessage(1)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("msg1"), msg)
+}
+
+func TestCircuitBreakerStore_IgnoresLogicalFailures(t *testing.T) {
+	// Given a circuit breaker store refusing duplicates
+	inner, err := NewMemoryStoreFactory().Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	store := NewCircuitBreakerStore(NewFaultStore(inner, WithFault(Fault{Err: ErrDuplicateMessage})), 1, time.Minute)
+
+	// When duplicates are refused
+	assert.Equal(t, ErrDuplicateMessage, store.SaveMessage(1, []byte("msg1")))
+
+	// Then the circuit should stay closed
+	assert.Equal(t, ErrDuplicateMessage, store.SaveMessage(1, []byte("msg1")))
+}
+
+func TestCircuitBreakerStore_DegradeToMemory(t *testing.T) {
+	// Given a degrading circuit breaker store whose backend fails until its circuit opens
+	store, faulty, clock, changes := newBrokenCircuit(t, WithCircuitBreakerDegradeToMemory())
+	store.SaveMessage(1, []byte("msg1"))
+	store.SaveMessage(1, []byte("msg1"))
+
+	// When the session keeps writing
+	require.Nil(t, store.SaveMessage(1, []byte("msg1")))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	tx, err := store.BeginTx()
+	require.Nil(t, err)
+	require.Nil(t, tx.SaveMessage(2, []byte("msg2")))
+	require.Nil(t, tx.SetNextSenderMsgSeqNum(3))
+	require.Nil(t, tx.Commit())
+
+	// Then the writes should be buffered, and the reads fail fast
+	assert.Equal(t, 3, store.NextSenderMsgSeqNum())
+	_, _, err = store.GetMessage(1)
+	assert.Equal(t, ErrCircuitOpen, err)
+
+	// When the backend recovers and the cool-down has passed
+	faulty.Clear()
+	clock.Set(clock.Now().Add(time.Minute))
+	msgs, err := store.GetMessages(1, 2)
+
+	// Then the buffered writes should be written to it
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("msg1"), []byte("msg2")}, msgs)
+	assert.Equal(t, 3, faulty.NextSenderMsgSeqNum())
+	assert.Equal(t, []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed}, *changes)
+}
+
+func TestCircuitBreakerStore_DrainsWritesBufferedWhileHalfOpen(t *testing.T) {
+	// Given a degrading circuit breaker store whose trial is under way after the cool-down
+	store, faulty, clock, _ := newBrokenCircuit(t, WithCircuitBreakerDegradeToMemory())
+	store.SaveMessage(1, []byte("msg1"))
+	store.SaveMessage(1, []byte("msg1"))
+	faulty.Clear()
+	clock.Set(clock.Now().Add(time.Minute))
+	breaker := store.(*circuitBreakerStore)
+	trial, err := breaker.acquire()
+	require.Nil(t, err)
+	require.True(t, trial)
+
+	// When a write arrives while the circuit is half-open, and the trial then succeeds
+	require.Nil(t, store.SaveMessage(1, []byte("msg1")))
+	breaker.release(trial, nil)
+
+	// Then the buffered write should be drained as the circuit closes
+	msg, found, err := faulty.GetMessage(1)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("msg1"), msg)
+	assert.Nil(t, breaker.buffer)
+}
+
+func TestCircuitBreakerStore_ResumesPartialReplay(t *testing.T) {
+	// Given a degrading circuit breaker store that buffered three messages while its backend was down
+	inner, err := NewMemoryStoreFactory().Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	observer := &recordingObserver{}
+	faulty := NewFaultStore(NewObservedStore(inner, "FIX.4.4-SENDER-TARGET", observer), WithFault(Fault{Err: errors.New("connection refused"), Times: 2}))
+	clock := &manualClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	store := NewCircuitBreakerStore(faulty, 2, time.Minute, WithCircuitBreakerClock(clock), WithCircuitBreakerDegradeToMemory())
+	store.SaveMessage(1, []byte("msg1"))
+	store.SaveMessage(1, []byte("msg1"))
+	for seqNum := 1; seqNum <= 3; seqNum++ {
+		require.Nil(t, store.SaveMessage(seqNum, []byte(fmt.Sprintf("msg%d", seqNum))))
+	}
+
+	// When the replay fails after the first message, and succeeds after the next cool-down
+	faulty.Inject(Fault{Ops: []string{"save_message"}, Err: errors.New("connection refused"), After: 1, Times: 1})
+	clock.Set(clock.Now().Add(time.Minute))
+	_, _, err = store.GetMessage(1)
+	assert.Equal(t, ErrCircuitOpen, err)
+	clock.Set(clock.Now().Add(time.Minute))
+	msgs, err := store.GetMessages(1, 3)
+
+	// Then every message should be saved once, the replay resuming after the last one saved
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("msg1"), []byte("msg2"), []byte("msg3")}, msgs)
+	assert.Equal(t, []string{
+		"FIX.4.4-SENDER-TARGET save msg1",
+		"FIX.4.4-SENDER-TARGET save msg2",
+		"FIX.4.4-SENDER-TARGET save msg3",
+	}, observer.events)
+}
+
+// stalledSaveStore signals started on its first SaveMessage, and saves messages once released
+type stalledSaveStore struct {
+	MessageStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (store stalledSaveStore) SaveMessage(seqNum int, msg []byte) error {
+	select {
+	case store.started <- struct{}{}:
+	default:
+	}
+	<-store.release
+	return store.MessageStore.SaveMessage(seqNum, msg)
+}
+
+func TestCircuitBreakerStore_ReplaysWithoutBlocking(t *testing.T) {
+	// Given a degrading circuit breaker store that buffered a message, whose caller then reused its buffer
+	inner, err := NewMemoryStoreFactory().Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	stalled := stalledSaveStore{inner, make(chan struct{}, 1), make(chan struct{})}
+	faulty := NewFaultStore(stalled, WithFault(Fault{Err: errors.New("connection refused")}))
+	clock := &manualClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	store := NewCircuitBreakerStore(faulty, 2, time.Minute, WithCircuitBreakerClock(clock), WithCircuitBreakerDegradeToMemory())
+	store.SaveMessage(1, []byte("msg1"))
+	store.SaveMessage(1, []byte("msg1"))
+	buf := []byte("msg1")
+	require.Nil(t, store.SaveMessage(1, buf))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	copy(buf, "xxxx")
+
+	// When the backend recovers, and its replay stalls
+	faulty.Clear()
+	clock.Set(clock.Now().Add(time.Minute))
+	replayed := make(chan error, 1)
+	go func() {
+		_, _, err := store.GetMessage(1)
+		replayed <- err
+	}()
+	<-stalled.started
+
+	// Then the store should still be read, and written to the buffer
+	assert.Equal(t, 2, store.NextSenderMsgSeqNum())
+	require.Nil(t, store.SaveMessage(2, []byte("msg2")))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+
+	// And once the replay goes through, both the message saved and the one buffered meanwhile should be written
+	close(stalled.release)
+	require.Nil(t, <-replayed)
+	msgs, err := inner.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("msg1"), []byte("msg2")}, msgs)
+	assert.Equal(t, 3, inner.NextSenderMsgSeqNum())
+	assert.Nil(t, store.(*circuitBreakerStore).buffer)
+}
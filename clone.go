@@ -0,0 +1,94 @@
+package msgstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CloneMessageStoreSession copies the seqnums, creation time and messages of the session srcID of factory to its session
+// dstID, replacing whatever dstID stored.  The session is streamed through BackupMessageStore and RestoreMessageStore
+// rather than held in memory.  It implements CloneSession for every SessionCloner of the package, and is exported for
+// other implementations.
+//
+// srcID must exist, as creating its store would otherwise create it empty and clone that over dstID.  It is looked up
+// with ListSessions where factory is a SessionLister, and otherwise taken not to exist while its store is as newly
+// created, with initial seqnums and no messages, in which case its store has been created by the time the clone fails.
+func CloneMessageStoreSession(factory MessageStoreFactory, srcID, dstID string) (err error) {
+	if srcID == dstID {
+		return errors.New("unable to clone a session onto itself")
+	}
+
+	lister, listed := factory.(SessionLister)
+	if listed {
+		found, err := hasSession(lister, srcID)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("unable to clone session: %s: not found", srcID)
+		}
+	}
+
+	src, err := factory.Create(srcID)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if !listed {
+		empty, err := isNewStore(src)
+		if err != nil {
+			return err
+		}
+		if empty {
+			return fmt.Errorf("unable to clone session: %s: not found", srcID)
+		}
+	}
+
+	dst, err := factory.Create(dstID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	pr, pw := io.Pipe()
+	backupDone := make(chan struct{})
+	go func() {
+		defer close(backupDone)
+		pw.CloseWithError(src.Backup(pw))
+	}()
+
+	err = dst.Restore(pr)
+	// unblocks the backup if the restore gave up before reading all of it
+	pr.CloseWithError(errors.New("restore stopped reading"))
+	<-backupDone
+	return err
+}
+
+// hasSession reports whether lister lists sessionID
+func hasSession(lister SessionLister, sessionID string) (bool, error) {
+	sessions, err := lister.ListSessions()
+	if err != nil {
+		return false, err
+	}
+	for _, session := range sessions {
+		if session.SessionID == sessionID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isNewStore reports whether store is as newly created, with initial seqnums and no messages
+func isNewStore(store MessageStore) (bool, error) {
+	if store.NextSenderMsgSeqNum() != 1 || store.NextTargetMsgSeqNum() != 1 {
+		return false, nil
+	}
+	last, err := lastMessageSeqNum(store)
+	return last == 0, err
+}
@@ -0,0 +1,84 @@
+package msgstore
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloneMessageStoreSession(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("CloneMessageStoreSession-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+	factory := NewFileStoreFactory(map[string]string{FileStorePath: rootPath})
+
+	// Given a session with messages
+	src, err := factory.Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	require.Nil(t, src.SaveMessage(1, []byte("hello")))
+	require.Nil(t, src.SaveMessage(2, []byte("world")))
+	require.Nil(t, src.SetNextSenderMsgSeqNum(3))
+	require.Nil(t, src.SetNextTargetMsgSeqNum(7))
+	require.Nil(t, src.Close())
+
+	// When it is cloned to a new session identity
+	require.Nil(t, factory.(SessionCloner).CloneSession("FIX.4.4-SENDER-TARGET", "FIX.4.4-SENDER-NEWTARGET"))
+
+	// Then the clone should have its seqnums, creation time and messages
+	src, err = factory.Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer src.Close()
+	dst, err := factory.Create("FIX.4.4-SENDER-NEWTARGET")
+	require.Nil(t, err)
+	defer dst.Close()
+	assert.Equal(t, 3, dst.NextSenderMsgSeqNum())
+	assert.Equal(t, 7, dst.NextTargetMsgSeqNum())
+	assert.True(t, src.CreationTime().Equal(dst.CreationTime()))
+	msgs, err := dst.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("hello"), []byte("world")}, msgs)
+}
+
+func TestCloneMessageStoreSession_OntoItself(t *testing.T) {
+	// Given a session, When it is cloned onto itself, Then it should fail
+	err := CloneMessageStoreSession(NewMemoryStoreFactory(), "FIX.4.4-SENDER-TARGET", "FIX.4.4-SENDER-TARGET")
+	assert.NotNil(t, err)
+}
+
+func TestCloneMessageStoreSession_MissingSource(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("CloneMessageStoreSessionMissing-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+	factory := NewFileStoreFactory(map[string]string{FileStorePath: rootPath})
+
+	// Given a session with messages
+	dst, err := factory.Create("FIX.4.4-SENDER-NEWTARGET")
+	require.Nil(t, err)
+	require.Nil(t, dst.SaveMessage(1, []byte("hello")))
+	require.Nil(t, dst.SetNextSenderMsgSeqNum(2))
+	require.Nil(t, dst.Close())
+
+	// When a session that does not exist is cloned over it
+	err = factory.(SessionCloner).CloneSession("FIX.4.4-SENDER-TARGET", "FIX.4.4-SENDER-NEWTARGET")
+
+	// Then it should fail, without creating the source or touching the session
+	assert.EqualError(t, err, "unable to clone session: FIX.4.4-SENDER-TARGET: not found")
+	sessions, err := factory.(SessionLister).ListSessions()
+	require.Nil(t, err)
+	require.Len(t, sessions, 1)
+	dst, err = factory.Create("FIX.4.4-SENDER-NEWTARGET")
+	require.Nil(t, err)
+	defer dst.Close()
+	assert.Equal(t, 2, dst.NextSenderMsgSeqNum())
+}
+
+func TestCloneMessageStoreSession_NewSourceStore(t *testing.T) {
+	// Given a factory that cannot list its sessions, When a session whose store is as newly created is cloned
+	factory := factoryFunc(func(string) (MessageStore, error) { return NewMemoryStoreFactory().Create("session") })
+	err := CloneMessageStoreSession(factory, "FIX.4.4-SENDER-TARGET", "FIX.4.4-SENDER-NEWTARGET")
+
+	// Then it should fail as not found
+	assert.EqualError(t, err, "unable to clone session: FIX.4.4-SENDER-TARGET: not found")
+}
@@ -0,0 +1,302 @@
+package msgstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+const (
+	// gzipMessageMarker leads every gzip compressed message
+	gzipMessageMarker byte = 0x03
+	// snappyMessageMarker leads every snappy compressed message
+	snappyMessageMarker byte = 0x04
+
+	// maxDecompressedMessageSize bounds the size a message decompresses to, so that a corrupt or hostile record cannot
+	// exhaust memory
+	maxDecompressedMessageSize = 64 << 20
+)
+
+// MessageCompression is the algorithm a compressing store compresses messages with, see NewCompressingStore
+type MessageCompression int
+
+const (
+	// CompressionZstd compresses best at a moderate cost, and is what the sql and mongo backends compress with
+	CompressionZstd MessageCompression = iota
+	// CompressionGzip is the slowest, for consumers of the stored data that can only read gzip
+	CompressionGzip
+	// CompressionSnappy is the fastest and compresses least
+	CompressionSnappy
+)
+
+type compressingStore struct {
+	storeDecorator
+	compression MessageCompression
+}
+
+// NewCompressingStore returns a MessageStore that compresses each message with compression before saving it to inner,
+// and decompresses the messages read.  Compressed messages are marked by a leading byte naming their algorithm, so
+// messages saved uncompressed or with another algorithm, before or after the store was set up, are still read as is.
+// inner can be of any backend that stores messages as bytes, so the sql backend requires SQLStoreMessageColumnType
+// "binary".  Wrap a store created by NewEncryptingStore to encrypt the compressed messages.  The optional interfaces of
+// inner are forwarded, see storeDecorator, compressing the messages saved with their meta too.
+func NewCompressingStore(inner MessageStore, compression MessageCompression) (MessageStore, error) {
+	switch compression {
+	case CompressionZstd, CompressionGzip, CompressionSnappy:
+	default:
+		return nil, fmt.Errorf("unknown message compression: %d", compression)
+	}
+	return &compressingStore{storeDecorator: newStoreDecorator(inner), compression: compression}, nil
+}
+
+// compress returns msg compressed behind the marker byte of the store's algorithm
+func (store *compressingStore) compress(msg []byte) ([]byte, error) {
+	switch store.compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		buf.WriteByte(gzipMessageMarker)
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(msg); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionSnappy:
+		return append([]byte{snappyMessageMarker}, snappy.Encode(nil, msg)...), nil
+	default:
+		return compressMessage(msg), nil
+	}
+}
+
+// decompress decompresses a message according to its marker byte, returning messages without one as is.  Gzip messages
+// larger than maxDecompressedMessageSize once decompressed are refused.
+func (store *compressingStore) decompress(message []byte) ([]byte, error) {
+	if len(message) == 0 {
+		return message, nil
+	}
+	switch message[0] {
+	case gzipMessageMarker:
+		zr, err := gzip.NewReader(bytes.NewReader(message[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress message: %w", err)
+		}
+		msg, err := ioutil.ReadAll(io.LimitReader(zr, maxDecompressedMessageSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress message: %w", err)
+		}
+		if len(msg) > maxDecompressedMessageSize {
+			return nil, fmt.Errorf("unable to decompress message: larger than %d bytes", maxDecompressedMessageSize)
+		}
+		return msg, nil
+	case snappyMessageMarker:
+		msg, err := snappy.Decode(nil, message[1:])
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress message: %w", err)
+		}
+		return msg, nil
+	default:
+		return decompressMessage(message)
+	}
+}
+
+func (store *compressingStore) NextSenderMsgSeqNum() int {
+	return store.inner.NextSenderMsgSeqNum()
+}
+
+func (store *compressingStore) NextTargetMsgSeqNum() int {
+	return store.inner.NextTargetMsgSeqNum()
+}
+
+func (store *compressingStore) IncrNextSenderMsgSeqNum() error {
+	return store.inner.IncrNextSenderMsgSeqNum()
+}
+
+func (store *compressingStore) IncrNextTargetMsgSeqNum() error {
+	return store.inner.IncrNextTargetMsgSeqNum()
+}
+
+func (store *compressingStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.inner.SetNextSenderMsgSeqNum(next)
+}
+
+func (store *compressingStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.inner.SetNextTargetMsgSeqNum(next)
+}
+
+func (store *compressingStore) CreationTime() time.Time {
+	return store.inner.CreationTime()
+}
+
+func (store *compressingStore) SetCreationTime(t time.Time) error {
+	return store.inner.SetCreationTime(t)
+}
+
+func (store *compressingStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.SaveMessageContext(context.Background(), seqNum, msg)
+}
+
+func (store *compressingStore) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) error {
+	compressed, err := store.compress(msg)
+	if err != nil {
+		return err
+	}
+	return store.storeDecorator.SaveMessageContext(ctx, seqNum, compressed)
+}
+
+func (store *compressingStore) SaveMessageWithMeta(seqNum int, msg []byte, meta MessageMeta) error {
+	compressed, err := store.compress(msg)
+	if err != nil {
+		return err
+	}
+	return store.storeDecorator.SaveMessageWithMeta(seqNum, compressed, meta)
+}
+
+func (store *compressingStore) SaveMessages(msgs []SeqMsg) error {
+	return store.SaveMessagesContext(context.Background(), msgs)
+}
+
+func (store *compressingStore) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) error {
+	compressed := make([]SeqMsg, len(msgs))
+	for i, m := range msgs {
+		msg, err := store.compress(m.Msg)
+		if err != nil {
+			return err
+		}
+		compressed[i] = SeqMsg{SeqNum: m.SeqNum, Msg: msg}
+	}
+	return store.storeDecorator.SaveMessagesContext(ctx, compressed)
+}
+
+func (store *compressingStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.GetMessagesContext(context.Background(), beginSeqNum, endSeqNum)
+}
+
+func (store *compressingStore) GetMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int) ([][]byte, error) {
+	var msgs [][]byte
+	err := store.IterateMessagesContext(ctx, beginSeqNum, endSeqNum, func(_ int, msg []byte) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	return msgs, err
+}
+
+func (store *compressingStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return GetMessagesAfter(store, seqNum)
+}
+
+func (store *compressingStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return GetMessagesReversed(store, beginSeqNum, endSeqNum)
+}
+
+func (store *compressingStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return store.GetMessageContext(context.Background(), seqNum)
+}
+
+func (store *compressingStore) GetMessageContext(ctx context.Context, seqNum int) ([]byte, bool, error) {
+	msg, found, err := store.storeDecorator.GetMessageContext(ctx, seqNum)
+	if err != nil || !found {
+		return msg, found, err
+	}
+	if msg, err = store.decompress(msg); err != nil {
+		return nil, false, err
+	}
+	return msg, true, nil
+}
+
+func (store *compressingStore) GetStoredMessages(filter MessageFilter) ([]StoredMessage, error) {
+	msgs, err := store.storeDecorator.GetStoredMessages(filter)
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		if msgs[i].Msg, err = store.decompress(msgs[i].Msg); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+func (store *compressingStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.IterateMessagesContext(context.Background(), beginSeqNum, endSeqNum, fn)
+}
+
+func (store *compressingStore) IterateMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.storeDecorator.IterateMessagesContext(ctx, beginSeqNum, endSeqNum, func(seqNum int, msg []byte) error {
+		msg, err := store.decompress(msg)
+		if err != nil {
+			return err
+		}
+		return fn(seqNum, msg)
+	})
+}
+
+func (store *compressingStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+func (store *compressingStore) BeginTx() (StoreTx, error) {
+	return store.BeginTxContext(context.Background())
+}
+
+// BeginTxContext starts a transaction of inner, whose messages are compressed like those saved outside one
+func (store *compressingStore) BeginTxContext(ctx context.Context) (StoreTx, error) {
+	tx, err := store.storeDecorator.BeginTxContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &compressingTx{StoreTx: tx, store: store}, nil
+}
+
+func (store *compressingStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.inner.DeleteMessagesUpTo(seqNum)
+}
+
+func (store *compressingStore) Backup(w io.Writer) error {
+	return store.inner.Backup(w)
+}
+
+func (store *compressingStore) Restore(r io.Reader) error {
+	return store.inner.Restore(r)
+}
+
+func (store *compressingStore) HealthCheck(ctx context.Context) error {
+	return store.inner.HealthCheck(ctx)
+}
+
+func (store *compressingStore) Flush() error {
+	return store.inner.Flush()
+}
+
+func (store *compressingStore) Refresh() error {
+	return store.inner.Refresh()
+}
+
+func (store *compressingStore) Reset() error {
+	return store.inner.Reset()
+}
+
+func (store *compressingStore) Close() error {
+	return store.inner.Close()
+}
+
+// compressingTx is a transaction of the inner store of a compressingStore, compressing its messages
+type compressingTx struct {
+	StoreTx
+	store *compressingStore
+}
+
+func (tx *compressingTx) SaveMessage(seqNum int, msg []byte) error {
+	compressed, err := tx.store.compress(msg)
+	if err != nil {
+		return err
+	}
+	return tx.StoreTx.SaveMessage(seqNum, compressed)
+}
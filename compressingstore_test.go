@@ -0,0 +1,75 @@
+package msgstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// CompressingStoreTestSuite runs all tests in the MessageStoreTestSuite against a compressing store over the MemoryStore
+type CompressingStoreTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *CompressingStoreTestSuite) SetupTest() {
+	inner, err := NewMemoryStoreFactory().Create("session")
+	require.Nil(suite.T(), err)
+	suite.msgStore, err = NewCompressingStore(inner, CompressionGzip)
+	require.Nil(suite.T(), err)
+}
+
+func TestCompressingStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(CompressingStoreTestSuite))
+}
+
+func TestCompressingStore_MixedData(t *testing.T) {
+	// Given a store holding a message saved uncompressed
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	require.Nil(t, inner.SaveMessage(1, []byte("8=FIX.4.4")))
+	msg := bytes.Repeat([]byte("8=FIX.4.4\x019=100\x0135=D\x01"), 20)
+
+	// When messages are saved through compressing stores of each algorithm
+	for i, compression := range []MessageCompression{CompressionZstd, CompressionGzip, CompressionSnappy} {
+		store, err := NewCompressingStore(inner, compression)
+		require.Nil(t, err)
+		require.Nil(t, store.SaveMessage(i+2, msg))
+	}
+
+	// Then any compressing store should read all of them back
+	store, err := NewCompressingStore(inner, CompressionSnappy)
+	require.Nil(t, err)
+	msgs, err := store.GetMessages(1, 4)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("8=FIX.4.4"), msg, msg, msg}, msgs)
+}
+
+func TestCompressingStore_DecompressedSizeLimit(t *testing.T) {
+	// Given a stored message that decompresses past the limit
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	var buf bytes.Buffer
+	buf.WriteByte(gzipMessageMarker)
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(make([]byte, maxDecompressedMessageSize+1))
+	require.Nil(t, err)
+	require.Nil(t, zw.Close())
+	require.Nil(t, inner.SaveMessage(1, buf.Bytes()))
+
+	// When it is read through a compressing store
+	store, err := NewCompressingStore(inner, CompressionGzip)
+	require.Nil(t, err)
+	_, _, err = store.GetMessage(1)
+
+	// Then it should be refused
+	assert.EqualError(t, err, fmt.Sprintf("unable to decompress message: larger than %d bytes", maxDecompressedMessageSize))
+}
+
+func TestNewCompressingStore_UnknownCompression(t *testing.T) {
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	_, err := NewCompressingStore(inner, MessageCompression(9))
+	assert.EqualError(t, err, "unknown message compression: 9")
+}
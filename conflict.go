@@ -0,0 +1,98 @@
+package msgstore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrExternallyModified is matched with errors.Is by the errors Refresh returns under conflict detection, when the
+// persisted session has changed since the store last loaded or wrote it in a way its own engine never changes it, e.g.
+// because another engine instance is using the same store.  The store is left as it was, rather than silently adopting
+// the persisted state; a new store must be created to adopt it.
+var ErrExternallyModified = errors.New("session was modified externally")
+
+// CreationTimeMismatchError is returned by Refresh when the creation time of the stored session differs from the one the
+// store holds, meaning the session was reset out-of-band, e.g. by another engine or by hand
+type CreationTimeMismatchError struct {
+	SessionID string
+	// Cached is the creation time the store holds, and Stored the one found in the database
+	Cached time.Time
+	Stored time.Time
+}
+
+func (e *CreationTimeMismatchError) Error() string {
+	return fmt.Sprintf("creation time of session %s changed from %s to %s", e.SessionID, e.Cached.UTC().Format(time.RFC3339Nano),
+		e.Stored.UTC().Format(time.RFC3339Nano))
+}
+
+// Is reports the error as an ErrExternallyModified
+func (e *CreationTimeMismatchError) Is(target error) bool {
+	return target == ErrExternallyModified
+}
+
+// SeqNumRegressionError is returned by Refresh under conflict detection when a stored seqnum is below the one the store
+// holds, meaning another engine or a manual edit moved it backward
+type SeqNumRegressionError struct {
+	SessionID string
+	// Direction is MessageOutgoing for the next sender seqnum, and MessageIncoming for the next target seqnum
+	Direction MessageDirection
+	// Cached is the next seqnum the store holds, and Stored the one found in storage
+	Cached int
+	Stored int
+}
+
+func (e *SeqNumRegressionError) Error() string {
+	name := "sender"
+	if e.Direction == MessageIncoming {
+		name = "target"
+	}
+	return fmt.Sprintf("next %s seqnum of session %s moved backward from %d to %d", name, e.SessionID, e.Cached, e.Stored)
+}
+
+// Is reports the error as an ErrExternallyModified
+func (e *SeqNumRegressionError) Is(target error) bool {
+	return target == ErrExternallyModified
+}
+
+// sessionSnapshot is the state of a session that a store holds, taken by Refresh before reloading it under conflict
+// detection
+type sessionSnapshot struct {
+	creationTime        time.Time
+	nextSenderMsgSeqNum int
+	nextTargetMsgSeqNum int
+}
+
+func snapshotSession(store MessageStore) sessionSnapshot {
+	return sessionSnapshot{
+		creationTime:        store.CreationTime(),
+		nextSenderMsgSeqNum: store.NextSenderMsgSeqNum(),
+		nextTargetMsgSeqNum: store.NextTargetMsgSeqNum(),
+	}
+}
+
+// restore puts the snapshot back into the cache of a store that found a conflict
+func (s sessionSnapshot) restore(cache *memoryStore) {
+	cache.creationTime = s.creationTime
+	cache.SetNextSenderMsgSeqNum(s.nextSenderMsgSeqNum)
+	cache.SetNextTargetMsgSeqNum(s.nextTargetMsgSeqNum)
+}
+
+// detectConflict compares the state a store reloaded with the snapshot taken before.  Creation times closer than
+// precision, the resolution the backend persists them at, are taken as equal.
+func (s sessionSnapshot) detectConflict(sessionID string, reloaded sessionSnapshot, precision time.Duration) error {
+	diff := reloaded.creationTime.Sub(s.creationTime)
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > 0 && diff >= precision {
+		return &CreationTimeMismatchError{SessionID: sessionID, Cached: s.creationTime, Stored: reloaded.creationTime}
+	}
+	if reloaded.nextSenderMsgSeqNum < s.nextSenderMsgSeqNum {
+		return &SeqNumRegressionError{SessionID: sessionID, Direction: MessageOutgoing, Cached: s.nextSenderMsgSeqNum, Stored: reloaded.nextSenderMsgSeqNum}
+	}
+	if reloaded.nextTargetMsgSeqNum < s.nextTargetMsgSeqNum {
+		return &SeqNumRegressionError{SessionID: sessionID, Direction: MessageIncoming, Cached: s.nextTargetMsgSeqNum, Stored: reloaded.nextTargetMsgSeqNum}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package msgstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreationTimeMismatchError(t *testing.T) {
+	err := &CreationTimeMismatchError{
+		SessionID: "FIX.4.4-SENDER-TARGET",
+		Cached:    time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Stored:    time.Date(2020, 1, 3, 3, 4, 5, 0, time.UTC),
+	}
+	assert.Equal(t, "creation time of session FIX.4.4-SENDER-TARGET changed from 2020-01-02T03:04:05Z to 2020-01-03T03:04:05Z", err.Error())
+	assert.True(t, errors.Is(err, ErrExternallyModified))
+}
+
+func TestSeqNumRegressionError(t *testing.T) {
+	err := &SeqNumRegressionError{SessionID: "FIX.4.4-SENDER-TARGET", Direction: MessageIncoming, Cached: 10, Stored: 3}
+	assert.Equal(t, "next target seqnum of session FIX.4.4-SENDER-TARGET moved backward from 10 to 3", err.Error())
+	assert.True(t, errors.Is(err, ErrExternallyModified))
+
+	err.Direction = MessageOutgoing
+	assert.Equal(t, "next sender seqnum of session FIX.4.4-SENDER-TARGET moved backward from 10 to 3", err.Error())
+}
+
+func TestSessionSnapshot_DetectConflict(t *testing.T) {
+	creationTime := time.Date(2020, 1, 2, 3, 4, 5, 600, time.UTC)
+	before := sessionSnapshot{creationTime: creationTime, nextSenderMsgSeqNum: 5, nextTargetMsgSeqNum: 7}
+
+	var testCases = []struct {
+		name      string
+		reloaded  sessionSnapshot
+		precision time.Duration
+		expected  error
+	}{
+		{name: "unchanged", reloaded: before},
+		{name: "seqnums moved forward", reloaded: sessionSnapshot{creationTime: creationTime, nextSenderMsgSeqNum: 6, nextTargetMsgSeqNum: 9}},
+		{name: "creation time within precision", reloaded: sessionSnapshot{creationTime: creationTime.Truncate(time.Second), nextSenderMsgSeqNum: 5, nextTargetMsgSeqNum: 7}, precision: time.Second},
+		{
+			name:     "creation time changed",
+			reloaded: sessionSnapshot{creationTime: creationTime.Add(time.Second), nextSenderMsgSeqNum: 5, nextTargetMsgSeqNum: 7},
+			expected: &CreationTimeMismatchError{SessionID: "FIX.4.4-SENDER-TARGET", Cached: creationTime, Stored: creationTime.Add(time.Second)},
+		},
+		{
+			name:     "sender seqnum moved backward",
+			reloaded: sessionSnapshot{creationTime: creationTime, nextSenderMsgSeqNum: 1, nextTargetMsgSeqNum: 7},
+			expected: &SeqNumRegressionError{SessionID: "FIX.4.4-SENDER-TARGET", Direction: MessageOutgoing, Cached: 5, Stored: 1},
+		},
+		{
+			name:     "target seqnum moved backward",
+			reloaded: sessionSnapshot{creationTime: creationTime, nextSenderMsgSeqNum: 5, nextTargetMsgSeqNum: 2},
+			expected: &SeqNumRegressionError{SessionID: "FIX.4.4-SENDER-TARGET", Direction: MessageIncoming, Cached: 7, Stored: 2},
+		},
+	}
+
+	for _, tc := range testCases {
+		err := before.detectConflict("FIX.4.4-SENDER-TARGET", tc.reloaded, tc.precision)
+		assert.Equal(t, tc.expected, err, tc.name)
+	}
+}
@@ -0,0 +1,164 @@
+package msgstore
+
+import (
+	"context"
+	"time"
+)
+
+// storeDecorator is embedded by the stores wrapping another, inner, so that wrapping a store does not hide the optional
+// interfaces of its backend: it forwards SessionValueStore, SeqNumResetter, MessageStats, MessageMetaStore,
+// MessageTimeStats and the Context methods of ContextMessageStore to inner.  The methods of an interface inner does not implement fail with
+// ErrUnsupported, but for MessageStats, which are then told by reading inner, and the Context methods, whose contexts
+// are then only checked before each operation, as by AdaptMessageStore.
+//
+// A wrapper overrides the methods of the operations it changes, reaching inner through those of the decorator.
+type storeDecorator struct {
+	inner MessageStore
+	// ctxInner is inner as a MessageStoreV2, given the contexts of the Context methods
+	ctxInner MessageStoreV2
+}
+
+func newStoreDecorator(inner MessageStore) storeDecorator {
+	return storeDecorator{inner: inner, ctxInner: AdaptMessageStore(inner)}
+}
+
+func (d *storeDecorator) SetSessionValue(key, value string) error {
+	values, ok := d.inner.(SessionValueStore)
+	if !ok {
+		return ErrUnsupported
+	}
+	return values.SetSessionValue(key, value)
+}
+
+func (d *storeDecorator) GetSessionValue(key string) (string, bool, error) {
+	values, ok := d.inner.(SessionValueStore)
+	if !ok {
+		return "", false, ErrUnsupported
+	}
+	return values.GetSessionValue(key)
+}
+
+func (d *storeDecorator) ResetWithoutDeletingMessages() error {
+	resetter, ok := d.inner.(SeqNumResetter)
+	if !ok {
+		return ErrUnsupported
+	}
+	return resetter.ResetWithoutDeletingMessages()
+}
+
+// scanStats returns the count and range of the messages of inner up to the last seqnum sent, for an inner store that
+// does not implement MessageStats
+func (d *storeDecorator) scanStats() (count, first, last int, err error) {
+	err = d.inner.IterateMessages(1, d.inner.NextSenderMsgSeqNum()-1, func(seqNum int, _ []byte) error {
+		if count == 0 {
+			first = seqNum
+		}
+		count, last = count+1, seqNum
+		return nil
+	})
+	return
+}
+
+func (d *storeDecorator) MessageCount() (int, error) {
+	if stats, ok := d.inner.(MessageStats); ok {
+		return stats.MessageCount()
+	}
+	count, _, _, err := d.scanStats()
+	return count, err
+}
+
+func (d *storeDecorator) FirstSeqNum() (int, error) {
+	if stats, ok := d.inner.(MessageStats); ok {
+		return stats.FirstSeqNum()
+	}
+	_, first, _, err := d.scanStats()
+	return first, err
+}
+
+func (d *storeDecorator) LastSeqNum() (int, error) {
+	if stats, ok := d.inner.(MessageStats); ok {
+		return stats.LastSeqNum()
+	}
+	_, _, last, err := d.scanStats()
+	return last, err
+}
+
+func (d *storeDecorator) SaveMessageWithMeta(seqNum int, msg []byte, meta MessageMeta) error {
+	metaStore, ok := d.inner.(MessageMetaStore)
+	if !ok {
+		return ErrUnsupported
+	}
+	return metaStore.SaveMessageWithMeta(seqNum, msg, meta)
+}
+
+func (d *storeDecorator) GetStoredMessages(filter MessageFilter) ([]StoredMessage, error) {
+	metaStore, ok := d.inner.(MessageMetaStore)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return metaStore.GetStoredMessages(filter)
+}
+
+func (d *storeDecorator) LastSeqNumStoredBefore(direction MessageDirection, t time.Time) (int, error) {
+	stats, ok := d.inner.(MessageTimeStats)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	return stats.LastSeqNumStoredBefore(direction, t)
+}
+
+func (d *storeDecorator) IncrNextSenderMsgSeqNumContext(ctx context.Context) error {
+	return d.ctxInner.IncrNextSenderMsgSeqNum(ctx)
+}
+
+func (d *storeDecorator) IncrNextTargetMsgSeqNumContext(ctx context.Context) error {
+	return d.ctxInner.IncrNextTargetMsgSeqNum(ctx)
+}
+
+func (d *storeDecorator) SetNextSenderMsgSeqNumContext(ctx context.Context, next int) error {
+	return d.ctxInner.SetNextSenderMsgSeqNum(ctx, next)
+}
+
+func (d *storeDecorator) SetNextTargetMsgSeqNumContext(ctx context.Context, next int) error {
+	return d.ctxInner.SetNextTargetMsgSeqNum(ctx, next)
+}
+
+func (d *storeDecorator) SetCreationTimeContext(ctx context.Context, t time.Time) error {
+	return d.ctxInner.SetCreationTime(ctx, t)
+}
+
+func (d *storeDecorator) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) error {
+	return d.ctxInner.SaveMessage(ctx, seqNum, msg)
+}
+
+func (d *storeDecorator) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) error {
+	return d.ctxInner.SaveMessages(ctx, msgs)
+}
+
+func (d *storeDecorator) GetMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return d.ctxInner.GetMessages(ctx, beginSeqNum, endSeqNum)
+}
+
+func (d *storeDecorator) GetMessageContext(ctx context.Context, seqNum int) ([]byte, bool, error) {
+	return d.ctxInner.GetMessage(ctx, seqNum)
+}
+
+func (d *storeDecorator) IterateMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return d.ctxInner.IterateMessages(ctx, beginSeqNum, endSeqNum, fn)
+}
+
+func (d *storeDecorator) DeleteMessagesUpToContext(ctx context.Context, seqNum int) error {
+	return d.ctxInner.DeleteMessagesUpTo(ctx, seqNum)
+}
+
+func (d *storeDecorator) BeginTxContext(ctx context.Context) (StoreTx, error) {
+	return d.ctxInner.BeginTx(ctx)
+}
+
+func (d *storeDecorator) RefreshContext(ctx context.Context) error {
+	return d.ctxInner.Refresh(ctx)
+}
+
+func (d *storeDecorator) ResetContext(ctx context.Context) error {
+	return d.ctxInner.Reset(ctx)
+}
@@ -0,0 +1,118 @@
+package msgstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decoratedStores returns a store of each wrapper of the package built on storeDecorator, over the store inner returns
+func decoratedStores(t *testing.T, inner func() MessageStore) map[string]MessageStore {
+	innerFactory := factoryFunc(func(string) (MessageStore, error) { return inner(), nil })
+	stores := map[string]MessageStore{
+		"caching":      NewCachingStore(inner(), 3),
+		"observed":     NewObservedStore(inner(), "session"),
+		"circuit":      NewCircuitBreakerStore(inner(), 3, time.Second),
+		"write-behind": NewWriteBehindStore(inner(), 4),
+	}
+	var err error
+	if stores["compressing"], err = NewCompressingStore(inner(), CompressionGzip); err != nil {
+		t.Fatal(err)
+	}
+	if stores["instrumented"], err = NewInstrumentedStore(inner(), "session", prometheus.NewRegistry()); err != nil {
+		t.Fatal(err)
+	}
+	if stores["quota"], err = NewQuotaStore(inner(), "session", Quota{MaxMessages: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if stores["replicating"], err = NewReplicatingStoreFactory(innerFactory, innerFactory, ReplicationFail).Create("session"); err != nil {
+		t.Fatal(err)
+	}
+	if stores["failover"], err = NewFailoverStoreFactory([]MessageStoreFactory{innerFactory}).Create("session"); err != nil {
+		t.Fatal(err)
+	}
+	return stores
+}
+
+// factoryFunc is a MessageStoreFactory creating stores with its function
+type factoryFunc func(sessionID string) (MessageStore, error)
+
+func (f factoryFunc) Create(sessionID string) (MessageStore, error) { return f(sessionID) }
+func (f factoryFunc) Close() error                                  { return nil }
+
+func newDecoratedMemoryStore() MessageStore {
+	store, _ := NewMemoryStoreFactory().Create("session")
+	return store
+}
+
+func TestStoreDecorator_ForwardsOptionalInterfaces(t *testing.T) {
+	for name, store := range decoratedStores(t, newDecoratedMemoryStore) {
+		// Given a wrapper around a memory store holding two messages
+		require.Nil(t, store.SaveMessage(1, []byte("one")), name)
+		require.Nil(t, store.SaveMessage(2, []byte("two")), name)
+		require.Nil(t, store.SetNextSenderMsgSeqNum(3), name)
+
+		// When its session values and stats are used
+		values, ok := store.(SessionValueStore)
+		require.True(t, ok, name)
+		require.Nil(t, values.SetSessionValue("key", "value"), name)
+		value, found, err := values.GetSessionValue("key")
+		require.Nil(t, err, name)
+		stats, ok := store.(MessageStats)
+		require.True(t, ok, name)
+		count, err := stats.MessageCount()
+		require.Nil(t, err, name)
+
+		// Then they should be those of the memory store
+		assert.True(t, found, name)
+		assert.Equal(t, "value", value, name)
+		assert.Equal(t, 2, count, name)
+	}
+}
+
+func TestStoreDecorator_Unsupported(t *testing.T) {
+	// the memory store, hiding its optional interfaces
+	hidden := func() MessageStore { return struct{ MessageStore }{newDecoratedMemoryStore()} }
+
+	for name, store := range decoratedStores(t, hidden) {
+		// Given a wrapper around a store implementing none of the optional interfaces, holding two messages
+		require.Nil(t, store.SaveMessage(1, []byte("one")), name)
+		require.Nil(t, store.SaveMessage(2, []byte("two")), name)
+		require.Nil(t, store.SetNextSenderMsgSeqNum(3), name)
+
+		// Then its session values and resets keeping messages should be unsupported
+		assert.Equal(t, ErrUnsupported, store.(SessionValueStore).SetSessionValue("key", "value"), name)
+		assert.Equal(t, ErrUnsupported, store.(SeqNumResetter).ResetWithoutDeletingMessages(), name)
+
+		// But its stats should be told by reading the messages
+		first, err := store.(MessageStats).FirstSeqNum()
+		require.Nil(t, err, name)
+		last, err := store.(MessageStats).LastSeqNum()
+		require.Nil(t, err, name)
+		assert.Equal(t, 1, first, name)
+		assert.Equal(t, 2, last, name)
+	}
+}
+
+func TestStoreDecorator_Context(t *testing.T) {
+	for name, store := range decoratedStores(t, newDecoratedMemoryStore) {
+		// Given a wrapper, and a cancelled context
+		ctxStore, ok := store.(ContextMessageStore)
+		require.True(t, ok, name)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// When a message is saved with it
+		err := ctxStore.SaveMessageContext(ctx, 1, []byte("one"))
+
+		// Then the save should be abandoned before reaching the memory store
+		assert.Equal(t, context.Canceled, err, name)
+		_, found, err := store.GetMessage(1)
+		require.Nil(t, err, name)
+		assert.False(t, found, name)
+	}
+}
@@ -0,0 +1,179 @@
+package msgstore
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+type encryptingStore struct {
+	inner    MessageStore
+	provider MessageKeyProvider
+}
+
+// NewEncryptingStore returns a MessageStore that seals each message with AES-256-GCM under the current key of provider
+// before saving it to inner, and opens the messages read.  Each ciphertext records the ID of its key, so keys can be
+// rotated without re-encrypting the messages saved under earlier ones, as long as provider still returns them.  Messages
+// saved before encryption was enabled are read as is.  inner can be of any backend that stores messages as bytes, so
+// the sql backend requires SQLStoreMessageColumnType "binary".  Backup and Restore move the ciphertexts, so archives
+// stay encrypted.
+func NewEncryptingStore(inner MessageStore, provider MessageKeyProvider) MessageStore {
+	return &encryptingStore{inner: inner, provider: provider}
+}
+
+// open decrypts a message read from the inner store, returning messages saved unencrypted as is
+func (store *encryptingStore) open(message []byte) ([]byte, error) {
+	if len(message) == 0 || message[0] != encryptedMessageMarker {
+		return message, nil
+	}
+	return decryptMessage(store.provider, message)
+}
+
+func (store *encryptingStore) NextSenderMsgSeqNum() int {
+	return store.inner.NextSenderMsgSeqNum()
+}
+
+func (store *encryptingStore) NextTargetMsgSeqNum() int {
+	return store.inner.NextTargetMsgSeqNum()
+}
+
+func (store *encryptingStore) IncrNextSenderMsgSeqNum() error {
+	return store.inner.IncrNextSenderMsgSeqNum()
+}
+
+func (store *encryptingStore) IncrNextTargetMsgSeqNum() error {
+	return store.inner.IncrNextTargetMsgSeqNum()
+}
+
+func (store *encryptingStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.inner.SetNextSenderMsgSeqNum(next)
+}
+
+func (store *encryptingStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.inner.SetNextTargetMsgSeqNum(next)
+}
+
+func (store *encryptingStore) CreationTime() time.Time {
+	return store.inner.CreationTime()
+}
+
+func (store *encryptingStore) SetCreationTime(t time.Time) error {
+	return store.inner.SetCreationTime(t)
+}
+
+func (store *encryptingStore) SaveMessage(seqNum int, msg []byte) error {
+	sealed, err := encryptMessage(store.provider, msg)
+	if err != nil {
+		return err
+	}
+	return store.inner.SaveMessage(seqNum, sealed)
+}
+
+func (store *encryptingStore) SaveMessages(msgs []SeqMsg) error {
+	sealed := make([]SeqMsg, len(msgs))
+	for i, m := range msgs {
+		msg, err := encryptMessage(store.provider, m.Msg)
+		if err != nil {
+			return err
+		}
+		sealed[i] = SeqMsg{SeqNum: m.SeqNum, Msg: msg}
+	}
+	return store.inner.SaveMessages(sealed)
+}
+
+func (store *encryptingStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	var msgs [][]byte
+	err := store.IterateMessages(beginSeqNum, endSeqNum, func(_ int, msg []byte) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	return msgs, err
+}
+
+func (store *encryptingStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return GetMessagesAfter(store, seqNum)
+}
+
+func (store *encryptingStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return GetMessagesReversed(store, beginSeqNum, endSeqNum)
+}
+
+func (store *encryptingStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	msg, found, err := store.inner.GetMessage(seqNum)
+	if err != nil || !found {
+		return msg, found, err
+	}
+	if msg, err = store.open(msg); err != nil {
+		return nil, false, err
+	}
+	return msg, true, nil
+}
+
+func (store *encryptingStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.inner.IterateMessages(beginSeqNum, endSeqNum, func(seqNum int, msg []byte) error {
+		msg, err := store.open(msg)
+		if err != nil {
+			return err
+		}
+		return fn(seqNum, msg)
+	})
+}
+
+func (store *encryptingStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+// BeginTx starts a transaction of inner, whose messages are encrypted like those saved outside one
+func (store *encryptingStore) BeginTx() (StoreTx, error) {
+	tx, err := store.inner.BeginTx()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingTx{StoreTx: tx, provider: store.provider}, nil
+}
+
+func (store *encryptingStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.inner.DeleteMessagesUpTo(seqNum)
+}
+
+func (store *encryptingStore) Backup(w io.Writer) error {
+	return store.inner.Backup(w)
+}
+
+func (store *encryptingStore) Restore(r io.Reader) error {
+	return store.inner.Restore(r)
+}
+
+func (store *encryptingStore) HealthCheck(ctx context.Context) error {
+	return store.inner.HealthCheck(ctx)
+}
+
+func (store *encryptingStore) Flush() error {
+	return store.inner.Flush()
+}
+
+func (store *encryptingStore) Refresh() error {
+	return store.inner.Refresh()
+}
+
+func (store *encryptingStore) Reset() error {
+	return store.inner.Reset()
+}
+
+func (store *encryptingStore) Close() error {
+	return store.inner.Close()
+}
+
+// encryptingTx is a transaction of the inner store of an encryptingStore, encrypting its messages
+type encryptingTx struct {
+	StoreTx
+	provider MessageKeyProvider
+}
+
+func (tx *encryptingTx) SaveMessage(seqNum int, msg []byte) error {
+	sealed, err := encryptMessage(tx.provider, msg)
+	if err != nil {
+		return err
+	}
+	return tx.StoreTx.SaveMessage(seqNum, sealed)
+}
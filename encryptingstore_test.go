@@ -0,0 +1,53 @@
+package msgstore
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// EncryptingStoreTestSuite runs all tests in the MessageStoreTestSuite against an encrypting store over the MemoryStore
+type EncryptingStoreTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *EncryptingStoreTestSuite) SetupTest() {
+	inner, err := NewMemoryStoreFactory().Create("session")
+	require.Nil(suite.T(), err)
+	suite.msgStore = NewEncryptingStore(inner, newStaticKeyProvider())
+}
+
+func TestEncryptingStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(EncryptingStoreTestSuite))
+}
+
+func TestEncryptingStore_KeyRotation(t *testing.T) {
+	// Given an encrypting store over a store holding a message saved before encryption
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	require.Nil(t, inner.SaveMessage(1, []byte("plain")))
+	provider := newStaticKeyProvider()
+	store := NewEncryptingStore(inner, provider)
+
+	// When messages are saved either side of a key rotation
+	require.Nil(t, store.SaveMessage(2, []byte("first key")))
+	provider.current = "k2"
+	require.Nil(t, store.SaveMessage(3, []byte("second key")))
+
+	// Then the inner store should hold them encrypted
+	sealed, _, err := inner.GetMessage(2)
+	require.Nil(t, err)
+	assert.False(t, bytes.Contains(sealed, []byte("first key")))
+
+	// And all of them should be read back
+	msgs, err := store.GetMessages(1, 3)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("plain"), []byte("first key"), []byte("second key")}, msgs)
+
+	// Unless a key is no longer provided
+	delete(provider.keys, "k1")
+	_, _, err = store.GetMessage(2)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,66 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// StoreError is returned by the MessageStores of the package when an operation of their backend fails.  It tells where
+// the failure happened and wraps the underlying error, which callers reach with errors.Is and errors.As, e.g.
+// errors.Is(err, ErrDuplicateMessage) or errors.As(err, &pgErr) for a driver error.
+type StoreError struct {
+	// Backend is the name the backend is registered under, e.g. "file" or "sql"
+	Backend   string
+	SessionID string
+	// Op is the name of the failed operation, as reported to metrics, e.g. "save_message"
+	Op string
+	// SeqNum is the seqnum of the message the operation was given, or 0 if it was given none
+	SeqNum int
+	Err    error
+}
+
+func (e *StoreError) Error() string {
+	if e.SeqNum > 0 {
+		return fmt.Sprintf("msgstore: %s: session %s: %s of seqnum %d: %s", e.Backend, e.SessionID, e.Op, e.SeqNum, e.Err.Error())
+	}
+	return fmt.Sprintf("msgstore: %s: session %s: %s: %s", e.Backend, e.SessionID, e.Op, e.Err.Error())
+}
+
+// Unwrap returns the underlying error
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+// wrapStoreError wraps *err in a StoreError, unless it is nil or was already wrapped by an operation the failed one
+// called, so that the innermost operation is reported
+func wrapStoreError(backend, sessionID, operation string, seqNum int, err *error) {
+	if *err == nil {
+		return
+	}
+	var storeErr *StoreError
+	if errors.As(*err, &storeErr) {
+		return
+	}
+	*err = &StoreError{Backend: backend, SessionID: sessionID, Op: operation, SeqNum: seqNum, Err: *err}
+}
+
+// IsBackendFailure reports whether err, a failure of a store of the package, tells of its backend failing, rather than
+// of the operation being refused, as duplicates, read-only and write-once stores, exceeded quotas, finished
+// transactions, closed stores and unsupported operations are, or of its caller cancelling it.  It is how the failover
+// and circuit breaker stores tell an outage, and IsTransientError the failures worth retrying.
+func IsBackendFailure(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, ErrDuplicateMessage),
+		errors.Is(err, ErrReadOnly),
+		errors.Is(err, ErrWriteOnce),
+		errors.Is(err, ErrTxDone),
+		errors.Is(err, ErrStoreClosed),
+		errors.Is(err, ErrQuotaExceeded),
+		errors.Is(err, ErrUnsupported),
+		errors.Is(err, context.Canceled):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package msgstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapStoreError(t *testing.T) {
+	// Given an operation failing with a driver error
+	cause := errors.New("connection reset by peer")
+	err := fmt.Errorf("unable to write to file: %w", cause)
+
+	// When it is wrapped
+	wrapStoreError("sql", "FIX.4.4-SENDER-TARGET", "save_message", 7, &err)
+
+	// Then it should tell where it failed, and unwrap to the driver error
+	var storeErr *StoreError
+	require.True(t, errors.As(err, &storeErr))
+	assert.Equal(t, "save_message", storeErr.Op)
+	assert.True(t, errors.Is(err, cause))
+	assert.Equal(t, "msgstore: sql: session FIX.4.4-SENDER-TARGET: save_message of seqnum 7: unable to write to file: connection reset by peer", err.Error())
+
+	// And wrapping it again in an outer operation should keep the innermost
+	wrapStoreError("sql", "FIX.4.4-SENDER-TARGET", "reset", 0, &err)
+	assert.Equal(t, storeErr, err)
+
+	// And a nil error should be left nil
+	var none error
+	wrapStoreError("sql", "FIX.4.4-SENDER-TARGET", "reset", 0, &none)
+	assert.Nil(t, none)
+}
+
+func TestFileStore_StoreError(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("FileStoreStoreError-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+	store, err := NewFileStoreFactory(map[string]string{FileStorePath: rootPath, FileStoreDuplicateMessagePolicy: "error"}).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Given a saved message
+	require.Nil(t, store.SaveMessage(1, []byte("first")))
+
+	// When another message is saved with the same seqnum
+	err = store.SaveMessage(1, []byte("second"))
+
+	// Then the error should carry the backend, session, operation and seqnum
+	assert.Equal(t, &StoreError{Backend: "file", SessionID: "FIX.4.4-SENDER-TARGET", Op: "save_message", SeqNum: 1, Err: ErrDuplicateMessage}, err)
+}
@@ -0,0 +1,477 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// defaultFailoverThreshold is the number of consecutive failures after which a failover store moves to its next backend
+const defaultFailoverThreshold = 3
+
+// FailoverStore is implemented by the stores of NewFailoverStoreFactory, to tell which backend is authoritative for the
+// session and to move it back to the primary once that has recovered
+type FailoverStore interface {
+	// Active returns the index among the factories of the backend in use, 0 being the primary
+	Active() int
+	// Resync merges the session of the backend in use into the primary, saving its messages over those the primary
+	// kept from before the failover and then copying its seqnums, and makes the primary the backend in use again.  It
+	// fails, leaving the backend in use as it was, if the primary has not recovered.
+	Resync() error
+}
+
+// FailoverOption configures the stores of NewFailoverStoreFactory
+type FailoverOption func(*failoverStoreFactory)
+
+// WithFailoverThreshold fails over after threshold consecutive operations of the backend in use failed.  Defaults to 3.
+func WithFailoverThreshold(threshold int) FailoverOption {
+	return func(f *failoverStoreFactory) { f.threshold = threshold }
+}
+
+// WithFailoverErrorFilter counts only the failures for which isFailure returns true towards failing over.  Defaults to
+// IsBackendFailure, counting the failures of the backend but not the operations it refused.
+func WithFailoverErrorFilter(isFailure func(err error) bool) FailoverOption {
+	return func(f *failoverStoreFactory) { f.isFailure = isFailure }
+}
+
+// WithFailoverLogger reports the failovers and resyncs of the stores to logger.  Defaults to discarding them.
+func WithFailoverLogger(logger Logger) FailoverOption {
+	return func(f *failoverStoreFactory) { f.logger = logger }
+}
+
+type failoverStoreFactory struct {
+	factories []MessageStoreFactory
+	threshold int
+	isFailure func(err error) bool
+	logger    Logger
+}
+
+type failoverStore struct {
+	*failoverStoreFactory
+	sessionID string
+
+	mu sync.Mutex
+	// stores holds the decorator of the store of each factory, nil until it is first used
+	stores   []*storeDecorator
+	active   int
+	failures int
+}
+
+// NewFailoverStoreFactory returns a MessageStoreFactory whose stores use the store of the first of factories, the
+// primary, and fail over to the store of the next one when it keeps failing, retrying the failed operation there.  The
+// next store is given the seqnums and creation time of the failed one, which the stores of the package keep in memory,
+// but not its messages, so resends of those are answered with gap fills.  Stores are created on first use, and a
+// backend that cannot be created is skipped.  Resync, see FailoverStore, moves a session back to the primary.  The
+// optional interfaces of the store in use are forwarded, see storeDecorator, failing over like the other operations.
+func NewFailoverStoreFactory(factories []MessageStoreFactory, opts ...FailoverOption) MessageStoreFactory {
+	f := &failoverStoreFactory{factories: factories, threshold: defaultFailoverThreshold, isFailure: IsBackendFailure}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// Create creates a new failover store of the MessageStore interface on the first backend that can create one
+func (f *failoverStoreFactory) Create(sessionID string) (MessageStore, error) {
+	if len(f.factories) == 0 {
+		return nil, errors.New("no backend to create the store on")
+	}
+	store := &failoverStore{failoverStoreFactory: f, sessionID: sessionID, stores: make([]*storeDecorator, len(f.factories))}
+
+	var err error
+	for i := range f.factories {
+		if _, err = store.storeAt(i); err == nil {
+			store.active = i
+			return store, nil
+		}
+		store.logf("msgstore: unable to create the store of session %s on backend %d: %s", sessionID, i, err.Error())
+	}
+	return nil, err
+}
+
+// Close closes every factory, returning the first error
+func (f *failoverStoreFactory) Close() (err error) {
+	for _, factory := range f.factories {
+		if closeErr := factory.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (f *failoverStoreFactory) logf(format string, v ...interface{}) {
+	if f.logger != nil {
+		f.logger.Printf(format, v...)
+	}
+}
+
+// storeAt returns the decorator of the store of the backend at index i, creating the store on first use
+func (store *failoverStore) storeAt(i int) (*storeDecorator, error) {
+	if store.stores[i] == nil {
+		s, err := store.factories[i].Create(store.sessionID)
+		if err != nil {
+			return nil, err
+		}
+		d := newStoreDecorator(s)
+		store.stores[i] = &d
+	}
+	return store.stores[i], nil
+}
+
+// do applies op to the store in use, failing over and retrying op once the failures reach the threshold
+func (store *failoverStore) do(op func(d *storeDecorator) error) error {
+	return store.doRetrying(op, op)
+}
+
+// doRetrying applies op to the store in use, failing over and applying retry instead once the failures reach the
+// threshold
+func (store *failoverStore) doRetrying(op, retry func(d *storeDecorator) error) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	err := op(store.stores[store.active])
+	if err == nil || !store.isFailure(err) {
+		store.failures = 0
+		return err
+	}
+	if store.failures++; store.failures < store.threshold {
+		return err
+	}
+	if !store.failover() {
+		return err
+	}
+	return retry(store.stores[store.active])
+}
+
+// incr increments the seqnum told by seqNum on the store in use.  The stores of the package advance their seqnums in
+// memory before persisting them, so the failed store, whose seqnums the next one is given, may already have advanced
+// it: rather than incrementing it again, the seqnum intended before the first attempt is set on the next store.
+func (store *failoverStore) incr(seqNum func(s MessageStore) int, incr func(d *storeDecorator) error, set func(d *storeDecorator, next int) error) error {
+	var next int
+	return store.doRetrying(func(d *storeDecorator) error {
+		next = seqNum(d.inner) + 1
+		return incr(d)
+	}, func(d *storeDecorator) error {
+		return set(d, next)
+	})
+}
+
+// failover makes the next backend that can take over the session the one in use, reporting whether there was one
+func (store *failoverStore) failover() bool {
+	failed := store.stores[store.active]
+	for i := store.active + 1; i < len(store.stores); i++ {
+		next, err := store.storeAt(i)
+		if err == nil {
+			err = copySeqNums(failed.inner, next.inner)
+		}
+		if err != nil {
+			store.logf("msgstore: unable to fail session %s over to backend %d: %s", store.sessionID, i, err.Error())
+			continue
+		}
+		store.logf("msgstore: session %s failed over from backend %d to backend %d", store.sessionID, store.active, i)
+		store.active, store.failures = i, 0
+		return true
+	}
+	store.logf("msgstore: session %s has no backend left to fail over to from backend %d", store.sessionID, store.active)
+	return false
+}
+
+// copySeqNums gives dst the seqnums and creation time of src
+func copySeqNums(src, dst MessageStore) error {
+	if err := dst.SetCreationTime(src.CreationTime()); err != nil {
+		return err
+	}
+	if err := dst.SetNextSenderMsgSeqNum(src.NextSenderMsgSeqNum()); err != nil {
+		return err
+	}
+	return dst.SetNextTargetMsgSeqNum(src.NextTargetMsgSeqNum())
+}
+
+// Active returns the index of the backend in use, see FailoverStore
+func (store *failoverStore) Active() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.active
+}
+
+// Resync migrates the store in use into the primary without resetting it, see FailoverStore
+func (store *failoverStore) Resync() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.active == 0 {
+		return nil
+	}
+	primary, err := store.storeAt(0)
+	if err != nil {
+		return err
+	}
+
+	if err := Migrate(context.Background(), store.stores[store.active].inner, primary.inner); err != nil {
+		return fmt.Errorf("unable to resync the primary: %w", err)
+	}
+
+	store.logf("msgstore: session %s resynced from backend %d to the primary", store.sessionID, store.active)
+	store.active, store.failures = 0, 0
+	return nil
+}
+
+// current returns the decorator of the store in use
+func (store *failoverStore) current() *storeDecorator {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.stores[store.active]
+}
+
+func (store *failoverStore) NextSenderMsgSeqNum() int {
+	return store.current().inner.NextSenderMsgSeqNum()
+}
+
+func (store *failoverStore) NextTargetMsgSeqNum() int {
+	return store.current().inner.NextTargetMsgSeqNum()
+}
+
+func (store *failoverStore) IncrNextSenderMsgSeqNum() error {
+	return store.IncrNextSenderMsgSeqNumContext(context.Background())
+}
+
+func (store *failoverStore) IncrNextSenderMsgSeqNumContext(ctx context.Context) error {
+	return store.incr(MessageStore.NextSenderMsgSeqNum,
+		func(d *storeDecorator) error { return d.IncrNextSenderMsgSeqNumContext(ctx) },
+		func(d *storeDecorator, next int) error { return d.SetNextSenderMsgSeqNumContext(ctx, next) })
+}
+
+func (store *failoverStore) IncrNextTargetMsgSeqNum() error {
+	return store.IncrNextTargetMsgSeqNumContext(context.Background())
+}
+
+func (store *failoverStore) IncrNextTargetMsgSeqNumContext(ctx context.Context) error {
+	return store.incr(MessageStore.NextTargetMsgSeqNum,
+		func(d *storeDecorator) error { return d.IncrNextTargetMsgSeqNumContext(ctx) },
+		func(d *storeDecorator, next int) error { return d.SetNextTargetMsgSeqNumContext(ctx, next) })
+}
+
+func (store *failoverStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.SetNextSenderMsgSeqNumContext(context.Background(), next)
+}
+
+func (store *failoverStore) SetNextSenderMsgSeqNumContext(ctx context.Context, next int) error {
+	return store.do(func(d *storeDecorator) error { return d.SetNextSenderMsgSeqNumContext(ctx, next) })
+}
+
+func (store *failoverStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.SetNextTargetMsgSeqNumContext(context.Background(), next)
+}
+
+func (store *failoverStore) SetNextTargetMsgSeqNumContext(ctx context.Context, next int) error {
+	return store.do(func(d *storeDecorator) error { return d.SetNextTargetMsgSeqNumContext(ctx, next) })
+}
+
+func (store *failoverStore) CreationTime() time.Time {
+	return store.current().inner.CreationTime()
+}
+
+func (store *failoverStore) SetCreationTime(t time.Time) error {
+	return store.SetCreationTimeContext(context.Background(), t)
+}
+
+func (store *failoverStore) SetCreationTimeContext(ctx context.Context, t time.Time) error {
+	return store.do(func(d *storeDecorator) error { return d.SetCreationTimeContext(ctx, t) })
+}
+
+func (store *failoverStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.SaveMessageContext(context.Background(), seqNum, msg)
+}
+
+func (store *failoverStore) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) error {
+	return store.do(func(d *storeDecorator) error { return d.SaveMessageContext(ctx, seqNum, msg) })
+}
+
+func (store *failoverStore) SaveMessageWithMeta(seqNum int, msg []byte, meta MessageMeta) error {
+	return store.do(func(d *storeDecorator) error { return d.SaveMessageWithMeta(seqNum, msg, meta) })
+}
+
+func (store *failoverStore) SaveMessages(msgs []SeqMsg) error {
+	return store.SaveMessagesContext(context.Background(), msgs)
+}
+
+func (store *failoverStore) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) error {
+	return store.do(func(d *storeDecorator) error { return d.SaveMessagesContext(ctx, msgs) })
+}
+
+func (store *failoverStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.GetMessagesContext(context.Background(), beginSeqNum, endSeqNum)
+}
+
+func (store *failoverStore) GetMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int) (msgs [][]byte, err error) {
+	err = store.do(func(d *storeDecorator) (err error) {
+		msgs, err = d.GetMessagesContext(ctx, beginSeqNum, endSeqNum)
+		return err
+	})
+	return msgs, err
+}
+
+func (store *failoverStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return GetMessagesAfter(store, seqNum)
+}
+
+func (store *failoverStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return GetMessagesReversed(store, beginSeqNum, endSeqNum)
+}
+
+func (store *failoverStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return store.GetMessageContext(context.Background(), seqNum)
+}
+
+func (store *failoverStore) GetMessageContext(ctx context.Context, seqNum int) (msg []byte, found bool, err error) {
+	err = store.do(func(d *storeDecorator) (err error) {
+		msg, found, err = d.GetMessageContext(ctx, seqNum)
+		return err
+	})
+	return msg, found, err
+}
+
+func (store *failoverStore) GetStoredMessages(filter MessageFilter) (msgs []StoredMessage, err error) {
+	err = store.do(func(d *storeDecorator) (err error) {
+		msgs, err = d.GetStoredMessages(filter)
+		return err
+	})
+	return msgs, err
+}
+
+func (store *failoverStore) LastSeqNumStoredBefore(direction MessageDirection, t time.Time) (seqNum int, err error) {
+	err = store.do(func(d *storeDecorator) (err error) {
+		seqNum, err = d.LastSeqNumStoredBefore(direction, t)
+		return err
+	})
+	return seqNum, err
+}
+
+func (store *failoverStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.IterateMessagesContext(context.Background(), beginSeqNum, endSeqNum, fn)
+}
+
+// IterateMessagesContext iterates the messages of the store in use.  Should it fail over part way, fn is called again
+// from beginSeqNum with the messages of the next store.
+func (store *failoverStore) IterateMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.do(func(d *storeDecorator) error { return d.IterateMessagesContext(ctx, beginSeqNum, endSeqNum, fn) })
+}
+
+func (store *failoverStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+func (store *failoverStore) MessageCount() (count int, err error) {
+	err = store.do(func(d *storeDecorator) (err error) {
+		count, err = d.MessageCount()
+		return err
+	})
+	return count, err
+}
+
+func (store *failoverStore) FirstSeqNum() (seqNum int, err error) {
+	err = store.do(func(d *storeDecorator) (err error) {
+		seqNum, err = d.FirstSeqNum()
+		return err
+	})
+	return seqNum, err
+}
+
+func (store *failoverStore) LastSeqNum() (seqNum int, err error) {
+	err = store.do(func(d *storeDecorator) (err error) {
+		seqNum, err = d.LastSeqNum()
+		return err
+	})
+	return seqNum, err
+}
+
+func (store *failoverStore) SetSessionValue(key, value string) error {
+	return store.do(func(d *storeDecorator) error { return d.SetSessionValue(key, value) })
+}
+
+func (store *failoverStore) GetSessionValue(key string) (value string, found bool, err error) {
+	err = store.do(func(d *storeDecorator) (err error) {
+		value, found, err = d.GetSessionValue(key)
+		return err
+	})
+	return value, found, err
+}
+
+// BeginTx starts a transaction buffered until Commit, which fails over like the store's other writes, see
+// BeginBufferedTx
+func (store *failoverStore) BeginTx() (StoreTx, error) {
+	return BeginBufferedTx(store), nil
+}
+
+// BeginTxContext buffers the transaction like BeginTx, its Commit writing without a context
+func (store *failoverStore) BeginTxContext(ctx context.Context) (StoreTx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return store.BeginTx()
+}
+
+func (store *failoverStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.DeleteMessagesUpToContext(context.Background(), seqNum)
+}
+
+func (store *failoverStore) DeleteMessagesUpToContext(ctx context.Context, seqNum int) error {
+	return store.do(func(d *storeDecorator) error { return d.DeleteMessagesUpToContext(ctx, seqNum) })
+}
+
+func (store *failoverStore) Backup(w io.Writer) error {
+	return store.current().inner.Backup(w)
+}
+
+func (store *failoverStore) Restore(r io.Reader) error {
+	return store.current().inner.Restore(r)
+}
+
+func (store *failoverStore) HealthCheck(ctx context.Context) error {
+	return store.current().inner.HealthCheck(ctx)
+}
+
+func (store *failoverStore) Flush() error {
+	return store.do(func(d *storeDecorator) error { return d.inner.Flush() })
+}
+
+func (store *failoverStore) Refresh() error {
+	return store.RefreshContext(context.Background())
+}
+
+func (store *failoverStore) RefreshContext(ctx context.Context) error {
+	return store.do(func(d *storeDecorator) error { return d.RefreshContext(ctx) })
+}
+
+func (store *failoverStore) Reset() error {
+	return store.ResetContext(context.Background())
+}
+
+func (store *failoverStore) ResetContext(ctx context.Context) error {
+	return store.do(func(d *storeDecorator) error { return d.ResetContext(ctx) })
+}
+
+func (store *failoverStore) ResetWithoutDeletingMessages() error {
+	return store.do(func(d *storeDecorator) error { return d.ResetWithoutDeletingMessages() })
+}
+
+// Close closes every store created, returning the first error
+func (store *failoverStore) Close() (err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, d := range store.stores {
+		if d == nil {
+			continue
+		}
+		if closeErr := d.inner.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+package msgstore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// FailoverStoreTestSuite runs all tests in the MessageStoreTestSuite against a failover store
+type FailoverStoreTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *FailoverStoreTestSuite) SetupTest() {
+	store, err := NewFailoverStoreFactory([]MessageStoreFactory{NewMemoryStoreFactory(), NewMemoryStoreFactory()}).Create("session")
+	require.Nil(suite.T(), err)
+	suite.msgStore = store
+}
+
+func TestFailoverStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(FailoverStoreTestSuite))
+}
+
+// downStore fails every save while down
+type downStore struct {
+	MessageStore
+	down bool
+}
+
+func (store *downStore) SaveMessage(seqNum int, msg []byte) error {
+	if store.down {
+		return errors.New("connection refused")
+	}
+	return store.MessageStore.SaveMessage(seqNum, msg)
+}
+
+// IncrNextSenderMsgSeqNum advances the seqnum in memory before failing to persist it while down, as the sql and file
+// stores do
+func (store *downStore) IncrNextSenderMsgSeqNum() error {
+	if err := store.MessageStore.IncrNextSenderMsgSeqNum(); err != nil || !store.down {
+		return err
+	}
+	return errors.New("connection refused")
+}
+
+func (store *downStore) IncrNextTargetMsgSeqNum() error {
+	if err := store.MessageStore.IncrNextTargetMsgSeqNum(); err != nil || !store.down {
+		return err
+	}
+	return errors.New("connection refused")
+}
+
+func TestFailoverStore_FailsOver(t *testing.T) {
+	// Given a failover store over a primary that goes down after saving a message
+	memStore, _ := NewMemoryStoreFactory().Create("session")
+	primary := &downStore{MessageStore: memStore}
+	secondary, _ := NewMemoryStoreFactory().Create("session")
+	store, err := NewFailoverStoreFactory([]MessageStoreFactory{sessionFactory{primary}, sessionFactory{secondary}},
+		WithFailoverThreshold(2)).Create("session")
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	primary.down = true
+
+	// When saves fail below the threshold
+	err = store.SaveMessage(2, []byte("two"))
+
+	// Then the failure should be returned, and the primary kept
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, store.(FailoverStore).Active())
+
+	// When the threshold is reached
+	err = store.SaveMessage(2, []byte("two"))
+
+	// Then the save should be retried on the secondary, given the primary's seqnums
+	require.Nil(t, err)
+	assert.Equal(t, 1, store.(FailoverStore).Active())
+	assert.Equal(t, 2, secondary.NextSenderMsgSeqNum())
+	msg, found, err := secondary.GetMessage(2)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("two"), msg)
+}
+
+// duplicateStore rejects every save as a duplicate
+type duplicateStore struct {
+	MessageStore
+}
+
+func (duplicateStore) SaveMessage(seqNum int, msg []byte) error {
+	return &StoreError{Backend: "memory", Op: "save_message", SeqNum: seqNum, Err: ErrDuplicateMessage}
+}
+
+func TestFailoverStore_IgnoresDuplicates(t *testing.T) {
+	// Given a failover store over a primary rejecting duplicates
+	memStore, _ := NewMemoryStoreFactory().Create("session")
+	store, err := NewFailoverStoreFactory([]MessageStoreFactory{sessionFactory{duplicateStore{memStore}}, NewMemoryStoreFactory()},
+		WithFailoverThreshold(1)).Create("session")
+	require.Nil(t, err)
+
+	// When a duplicate is saved
+	err = store.SaveMessage(1, []byte("one"))
+
+	// Then it should fail without failing over
+	assert.True(t, errors.Is(err, ErrDuplicateMessage))
+	assert.Equal(t, 0, store.(FailoverStore).Active())
+}
+
+func TestFailoverStore_Resync(t *testing.T) {
+	// Given a failover store that has failed over from its primary
+	memStore, _ := NewMemoryStoreFactory().Create("session")
+	primary := &downStore{MessageStore: memStore, down: true}
+	secondary, _ := NewMemoryStoreFactory().Create("session")
+	store, err := NewFailoverStoreFactory([]MessageStoreFactory{sessionFactory{primary}, sessionFactory{secondary}},
+		WithFailoverThreshold(1)).Create("session")
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	require.Equal(t, 1, store.(FailoverStore).Active())
+
+	// When the primary recovers and the session is resynced
+	primary.down = false
+	require.Nil(t, store.(FailoverStore).Resync())
+
+	// Then the primary should hold the session and be in use again
+	assert.Equal(t, 0, store.(FailoverStore).Active())
+	assert.Equal(t, 2, primary.NextSenderMsgSeqNum())
+	msg, found, err := primary.GetMessage(1)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("one"), msg)
+}
+
+func TestFailoverStore_ResyncKeepsPrimaryMessages(t *testing.T) {
+	// Given a failover store whose primary saved a message before going down, and its secondary one after
+	memStore, _ := NewMemoryStoreFactory().Create("session")
+	primary := &downStore{MessageStore: memStore}
+	secondary, _ := NewMemoryStoreFactory().Create("session")
+	store, err := NewFailoverStoreFactory([]MessageStoreFactory{sessionFactory{primary}, sessionFactory{secondary}},
+		WithFailoverThreshold(1)).Create("session")
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	primary.down = true
+	require.Nil(t, store.SaveMessage(2, []byte("two")))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	require.Equal(t, 1, store.(FailoverStore).Active())
+
+	// When the primary recovers and the session is resynced
+	primary.down = false
+	require.Nil(t, store.(FailoverStore).Resync())
+
+	// Then the primary should hold the messages from both sides of the outage
+	msgs, err := primary.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("one"), []byte("two")}, msgs)
+	assert.Equal(t, 3, primary.NextSenderMsgSeqNum())
+}
+
+func TestFailoverStore_RefusedOperations(t *testing.T) {
+	// Given a failover store whose primary refuses saves for its quota
+	memStore, _ := NewMemoryStoreFactory().Create("session")
+	primary, err := NewQuotaStore(memStore, "session", Quota{MaxMessages: 1})
+	require.Nil(t, err)
+	secondary, _ := NewMemoryStoreFactory().Create("session")
+	store, err := NewFailoverStoreFactory([]MessageStoreFactory{sessionFactory{primary}, sessionFactory{secondary}},
+		WithFailoverThreshold(1)).Create("session")
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+
+	// When a save is refused
+	err = store.SaveMessage(2, []byte("two"))
+
+	// Then it should fail without failing over
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	assert.Equal(t, 0, store.(FailoverStore).Active())
+}
+
+func TestFailoverStore_FailsOverIncr(t *testing.T) {
+	var testCases = []struct {
+		name   string
+		incr   func(s MessageStore) error
+		seqNum func(s MessageStore) int
+	}{
+		{name: "sender", incr: MessageStore.IncrNextSenderMsgSeqNum, seqNum: MessageStore.NextSenderMsgSeqNum},
+		{name: "target", incr: MessageStore.IncrNextTargetMsgSeqNum, seqNum: MessageStore.NextTargetMsgSeqNum},
+	}
+
+	for _, tc := range testCases {
+		// Given a failover store over a primary that goes down after a seqnum was incremented
+		memStore, _ := NewMemoryStoreFactory().Create("session")
+		primary := &downStore{MessageStore: memStore}
+		secondary, _ := NewMemoryStoreFactory().Create("session")
+		store, err := NewFailoverStoreFactory([]MessageStoreFactory{sessionFactory{primary}, sessionFactory{secondary}},
+			WithFailoverThreshold(1)).Create("session")
+		require.Nil(t, err, tc.name)
+		require.Nil(t, tc.incr(store), tc.name)
+		primary.down = true
+
+		// When the seqnum is incremented again, failing on the primary after it advanced it
+		require.Nil(t, tc.incr(store), tc.name)
+
+		// Then the secondary should be in use, the seqnum incremented exactly once
+		require.Equal(t, 1, store.(FailoverStore).Active(), tc.name)
+		assert.Equal(t, 3, tc.seqNum(secondary), tc.name)
+		assert.Equal(t, 3, tc.seqNum(store), tc.name)
+	}
+}
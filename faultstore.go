@@ -0,0 +1,294 @@
+package msgstore
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Fault describes the failures a FaultStore injects into the operations of its inner store
+type Fault struct {
+	// Ops are the operations to inject into, named as the operations of the instrumented store, e.g. "save_message",
+	// "incr_next_sender_seqnum" or "commit_tx".  Every operation is injected into if empty.
+	Ops []string
+	// Err is returned by the operations injected into.  If nil, only Latency is injected.
+	Err error
+	// Latency delays the operations injected into
+	Latency time.Duration
+	// Probability is the chance, between 0 and 1, that an operation is injected into.  Every operation is if zero.
+	Probability float64
+	// After is the number of operations to let through before injecting
+	After int
+	// Times is the number of operations to inject into, after which the fault is spent.  Unlimited if zero.
+	Times int
+	// Applied makes the operations injected into take effect on the inner store before Err is returned, as for a write
+	// that was persisted but whose acknowledgement was lost
+	Applied bool
+}
+
+// FaultStore is a MessageStore injecting faults into the operations of another, for exercising the recovery of
+// engines against realistic failures of a store in tests
+type FaultStore interface {
+	MessageStore
+	// Inject adds fault to those injected, e.g. partway through a scenario
+	Inject(fault Fault)
+	// Clear removes all faults, so that the store behaves as its inner store again
+	Clear()
+}
+
+// FaultOption configures a store created by NewFaultStore
+type FaultOption func(*faultStore)
+
+// WithFault injects fault from the start
+func WithFault(fault Fault) FaultOption {
+	return func(store *faultStore) { store.faults = append(store.faults, &faultState{Fault: fault}) }
+}
+
+// WithFaultSeed seeds the source deciding whether faults with a Probability are injected, for reproducible runs.
+// Defaults to seeding it with the time.
+func WithFaultSeed(seed int64) FaultOption {
+	return func(store *faultStore) { store.rand = rand.New(rand.NewSource(seed)) }
+}
+
+// faultState is a fault with the count of the operations it has seen and injected into
+type faultState struct {
+	Fault
+	seen     int
+	injected int
+}
+
+// matches reports whether the fault applies to op
+func (f *faultState) matches(op string) bool {
+	if len(f.Ops) == 0 {
+		return true
+	}
+	for _, o := range f.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+type faultStore struct {
+	inner MessageStore
+
+	mu     sync.Mutex
+	faults []*faultState
+	rand   *rand.Rand
+}
+
+// NewFaultStore returns a FaultStore over inner injecting the given faults.  It is meant for tests, and safe for
+// concurrent use if inner is.
+func NewFaultStore(inner MessageStore, opts ...FaultOption) FaultStore {
+	store := &faultStore{inner: inner}
+	for _, opt := range opts {
+		opt(store)
+	}
+	if store.rand == nil {
+		store.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return store
+}
+
+func (store *faultStore) Inject(fault Fault) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.faults = append(store.faults, &faultState{Fault: fault})
+}
+
+func (store *faultStore) Clear() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.faults = nil
+}
+
+// inject applies the latency of the faults injected into op, returning whether the operation is to be applied
+// regardless of the first of their errors, which is returned
+func (store *faultStore) inject(op string) (applied bool, err error) {
+	var latency time.Duration
+
+	store.mu.Lock()
+	for _, f := range store.faults {
+		if !f.matches(op) {
+			continue
+		}
+		f.seen++
+		if f.seen <= f.After || (f.Times > 0 && f.injected >= f.Times) {
+			continue
+		}
+		if f.Probability > 0 && store.rand.Float64() >= f.Probability {
+			continue
+		}
+		f.injected++
+		latency += f.Latency
+		if err == nil && f.Err != nil {
+			err, applied = f.Err, f.Applied
+		}
+	}
+	store.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return applied, err
+}
+
+// do runs fn as op, unless a fault injected into op fails it, in which case fn runs only if the fault is Applied
+func (store *faultStore) do(op string, fn func() error) error {
+	applied, err := store.inject(op)
+	if err == nil {
+		return fn()
+	}
+	if applied {
+		if fnErr := fn(); fnErr != nil {
+			return fnErr
+		}
+	}
+	return err
+}
+
+func (store *faultStore) NextSenderMsgSeqNum() int {
+	return store.inner.NextSenderMsgSeqNum()
+}
+
+func (store *faultStore) NextTargetMsgSeqNum() int {
+	return store.inner.NextTargetMsgSeqNum()
+}
+
+func (store *faultStore) IncrNextSenderMsgSeqNum() error {
+	return store.do("incr_next_sender_seqnum", store.inner.IncrNextSenderMsgSeqNum)
+}
+
+func (store *faultStore) IncrNextTargetMsgSeqNum() error {
+	return store.do("incr_next_target_seqnum", store.inner.IncrNextTargetMsgSeqNum)
+}
+
+func (store *faultStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.do("set_next_sender_seqnum", func() error { return store.inner.SetNextSenderMsgSeqNum(next) })
+}
+
+func (store *faultStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.do("set_next_target_seqnum", func() error { return store.inner.SetNextTargetMsgSeqNum(next) })
+}
+
+func (store *faultStore) CreationTime() time.Time {
+	return store.inner.CreationTime()
+}
+
+func (store *faultStore) SetCreationTime(t time.Time) error {
+	return store.do("set_creation_time", func() error { return store.inner.SetCreationTime(t) })
+}
+
+func (store *faultStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.do("save_message", func() error { return store.inner.SaveMessage(seqNum, msg) })
+}
+
+func (store *faultStore) SaveMessages(msgs []SeqMsg) error {
+	return store.do("save_messages", func() error { return store.inner.SaveMessages(msgs) })
+}
+
+func (store *faultStore) GetMessages(beginSeqNum, endSeqNum int) (msgs [][]byte, err error) {
+	err = store.do("get_messages", func() error {
+		msgs, err = store.inner.GetMessages(beginSeqNum, endSeqNum)
+		return err
+	})
+	return msgs, err
+}
+
+func (store *faultStore) GetMessagesSince(seqNum int) (msgs [][]byte, err error) {
+	err = store.do("get_messages_since", func() error {
+		msgs, err = store.inner.GetMessagesSince(seqNum)
+		return err
+	})
+	return msgs, err
+}
+
+func (store *faultStore) GetMessagesDescending(beginSeqNum, endSeqNum int) (msgs [][]byte, err error) {
+	err = store.do("get_messages_descending", func() error {
+		msgs, err = store.inner.GetMessagesDescending(beginSeqNum, endSeqNum)
+		return err
+	})
+	return msgs, err
+}
+
+func (store *faultStore) GetMessage(seqNum int) (msg []byte, found bool, err error) {
+	err = store.do("get_message", func() error {
+		msg, found, err = store.inner.GetMessage(seqNum)
+		return err
+	})
+	return msg, found, err
+}
+
+func (store *faultStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.do("iterate_messages", func() error { return store.inner.IterateMessages(beginSeqNum, endSeqNum, fn) })
+}
+
+// StreamMessages streams the range with IterateMessages, so that the faults injected into "iterate_messages" fail it
+func (store *faultStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+func (store *faultStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.do("delete_messages", func() error { return store.inner.DeleteMessagesUpTo(seqNum) })
+}
+
+func (store *faultStore) BeginTx() (tx StoreTx, err error) {
+	err = store.do("begin_tx", func() error {
+		tx, err = store.inner.BeginTx()
+		return err
+	})
+	if err != nil {
+		if tx != nil {
+			tx.Rollback()
+		}
+		return nil, err
+	}
+	return &faultTx{StoreTx: tx, store: store}, nil
+}
+
+func (store *faultStore) Backup(w io.Writer) error {
+	return store.do("backup", func() error { return store.inner.Backup(w) })
+}
+
+func (store *faultStore) Restore(r io.Reader) error {
+	return store.do("restore", func() error { return store.inner.Restore(r) })
+}
+
+func (store *faultStore) HealthCheck(ctx context.Context) error {
+	return store.do("health_check", func() error { return store.inner.HealthCheck(ctx) })
+}
+
+func (store *faultStore) Flush() error {
+	return store.do("flush", store.inner.Flush)
+}
+
+func (store *faultStore) Refresh() error {
+	return store.do("refresh", store.inner.Refresh)
+}
+
+func (store *faultStore) Reset() error {
+	return store.do("reset", store.inner.Reset)
+}
+
+func (store *faultStore) Close() error {
+	return store.inner.Close()
+}
+
+// faultTx is a transaction of the inner store of a faultStore, injecting faults into its Commit and Rollback
+type faultTx struct {
+	StoreTx
+	store *faultStore
+}
+
+func (tx *faultTx) Commit() error {
+	return tx.store.do("commit_tx", tx.StoreTx.Commit)
+}
+
+func (tx *faultTx) Rollback() error {
+	return tx.store.do("rollback_tx", tx.StoreTx.Rollback)
+}
@@ -0,0 +1,108 @@
+package msgstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// FaultStoreTestSuite runs all tests in the MessageStoreTestSuite against a fault store over the MemoryStore
+type FaultStoreTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *FaultStoreTestSuite) SetupTest() {
+	inner, err := NewMemoryStoreFactory().Create("session")
+	require.Nil(suite.T(), err)
+	suite.msgStore = NewFaultStore(inner, WithFault(Fault{Latency: time.Microsecond}))
+}
+
+func TestFaultStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(FaultStoreTestSuite))
+}
+
+func TestFaultStore_PartialFailure(t *testing.T) {
+	// Given a fault store failing the second sender seqnum increment
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	store := NewFaultStore(inner, WithFault(Fault{Ops: []string{"incr_next_sender_seqnum"}, Err: errors.New("timeout"), After: 1, Times: 1}))
+
+	// When two messages are sent
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	require.Nil(t, store.SaveMessage(2, []byte("two")))
+	err := store.IncrNextSenderMsgSeqNum()
+
+	// Then the second should be saved but its increment fail, once
+	assert.EqualError(t, err, "timeout")
+	msgs, err := store.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, 2, store.NextSenderMsgSeqNum())
+	assert.Nil(t, store.IncrNextSenderMsgSeqNum())
+	assert.Equal(t, 3, store.NextSenderMsgSeqNum())
+}
+
+func TestFaultStore_Applied(t *testing.T) {
+	// Given a fault store losing the acknowledgement of saves
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	store := NewFaultStore(inner, WithFault(Fault{Ops: []string{"save_message"}, Err: errors.New("connection reset"), Applied: true}))
+
+	// When a message is saved
+	err := store.SaveMessage(1, []byte("one"))
+
+	// Then the save should fail, though the message is stored
+	assert.EqualError(t, err, "connection reset")
+	_, found, err := inner.GetMessage(1)
+	require.Nil(t, err)
+	assert.True(t, found)
+}
+
+func TestFaultStore_Probability(t *testing.T) {
+	// Given two fault stores failing saves at random with the same seed
+	fault := Fault{Ops: []string{"save_message"}, Err: errors.New("flaky"), Probability: 0.5}
+	inner1, _ := NewMemoryStoreFactory().Create("session")
+	store1 := NewFaultStore(inner1, WithFault(fault), WithFaultSeed(42))
+	inner2, _ := NewMemoryStoreFactory().Create("session")
+	store2 := NewFaultStore(inner2, WithFault(fault), WithFaultSeed(42))
+
+	// When each saves the same messages
+	var failed1, failed2 []int
+	for seqNum := 1; seqNum <= 100; seqNum++ {
+		if store1.SaveMessage(seqNum, []byte("msg")) != nil {
+			failed1 = append(failed1, seqNum)
+		}
+		if store2.SaveMessage(seqNum, []byte("msg")) != nil {
+			failed2 = append(failed2, seqNum)
+		}
+	}
+
+	// Then some but not all should fail, the same in both
+	assert.NotEmpty(t, failed1)
+	assert.Less(t, len(failed1), 100)
+	assert.Equal(t, failed1, failed2)
+}
+
+func TestFaultStore_InjectAndClear(t *testing.T) {
+	// Given a fault store
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	store := NewFaultStore(inner)
+
+	// When latency and an error are injected into every operation partway through
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+	store.Inject(Fault{Latency: 20 * time.Millisecond})
+	store.Inject(Fault{Err: errors.New("disk full")})
+	start := time.Now()
+	err := store.Flush()
+
+	// Then the operations should be delayed and fail until the faults are cleared
+	assert.EqualError(t, err, "disk full")
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(20*time.Millisecond))
+	_, err = store.GetMessages(1, 1)
+	assert.EqualError(t, err, "disk full")
+	store.Clear()
+	assert.Nil(t, store.Flush())
+}
@@ -1,17 +1,28 @@
 package msgstore
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
 const (
 	// FileStorePath is the name of the filesystem directory that will be used.
 	FileStorePath string = "FileStorePath"
+	// FileStoreDuplicateMessagePolicy is one of "error", "replace" or "ignore", see DuplicateMessagePolicy.  Optional, defaults to "replace".
+	FileStoreDuplicateMessagePolicy string = "FileStoreDuplicateMessagePolicy"
+	// FileStoreDetectConflicts, when set to "Y", makes Refresh fail with an error matching ErrExternallyModified if the
+	// seqnums in the files moved backward or the creation time changed since the store last loaded or wrote them, leaving
+	// the store as it was rather than adopting them.  Optional, defaults to "N".
+	FileStoreDetectConflicts string = "FileStoreDetectConflicts"
 )
 
 type msgDef struct {
@@ -20,7 +31,10 @@ type msgDef struct {
 }
 
 type fileStoreFactory struct {
-	settings map[string]string
+	settings   map[string]string
+	clock      Clock
+	serializer RecordSerializer
+	closed     *factoryClosed
 }
 
 type fileStore struct {
@@ -32,11 +46,16 @@ type fileStore struct {
 	sessionFname       string
 	senderSeqNumsFname string
 	targetSeqNumsFname string
+	valuesFname        string
+	compactFname       string
 	bodyFile           *os.File
 	headerFile         *os.File
 	sessionFile        *os.File
 	senderSeqNumsFile  *os.File
 	targetSeqNumsFile  *os.File
+	duplicatePolicy    DuplicateMessagePolicy
+	detectConflicts    bool
+	serializer         RecordSerializer
 }
 
 // removeFile behaves like os.Remove, except that no error is returned if the file does not exist
@@ -52,7 +71,7 @@ func removeFile(fname string) error {
 func openOrCreateFile(fname string, perm os.FileMode) (f *os.File, err error) {
 	if f, err = os.OpenFile(fname, os.O_RDWR, perm); err != nil {
 		if f, err = os.OpenFile(fname, os.O_RDWR|os.O_CREATE, perm); err != nil {
-			return nil, fmt.Errorf("error opening or creating file: %s: %s", fname, err.Error())
+			return nil, fmt.Errorf("error opening or creating file: %s: %w", fname, err)
 		}
 	}
 	return f, nil
@@ -70,49 +89,197 @@ func closeFile(f *os.File) error {
 	return nil
 }
 
+// FileStoreOption configures optional behavior of the stores created by a file MessageStoreFactory
+type FileStoreOption func(*fileStoreFactory)
+
+// WithFileClock stamps the creation time of the stores with the time told by clock.  Defaults to the system clock.
+func WithFileClock(clock Clock) FileStoreOption {
+	return func(f *fileStoreFactory) { f.clock = clock }
+}
+
+// WithFileRecordSerializer saves each message as a record wrapped by serializer in an envelope carrying its metadata, see
+// RecordSerializer
+func WithFileRecordSerializer(serializer RecordSerializer) FileStoreOption {
+	return func(f *fileStoreFactory) { f.serializer = serializer }
+}
+
 // NewFileStoreFactory returns a file-based implementation of MessageStoreFactory
-func NewFileStoreFactory(settings map[string]string) MessageStoreFactory {
-	return fileStoreFactory{settings: settings}
+func NewFileStoreFactory(settings map[string]string, opts ...FileStoreOption) MessageStoreFactory {
+	f := fileStoreFactory{settings: settings, closed: &factoryClosed{}}
+	for _, opt := range opts {
+		opt(&f)
+	}
+	return f
 }
 
 // Create creates a new FileStore implementation of the MessageStore interface
 func (f fileStoreFactory) Create(sessionID string) (msgStore MessageStore, err error) {
+	if f.closed.isClosed() {
+		return nil, ErrFactoryClosed
+	}
 	dirname, ok := f.settings[FileStorePath]
 	if !ok {
 		return nil, fmt.Errorf("sessionID: %s: required setting not found: %s", sessionID, FileStorePath)
 	}
-	return newFileStore(sessionID, dirname)
+	duplicatePolicy := DuplicateMessageReplace
+	if policyStr, ok := f.settings[FileStoreDuplicateMessagePolicy]; ok {
+		if duplicatePolicy, err = parseDuplicateMessagePolicy(policyStr); err != nil {
+			return nil, fmt.Errorf("sessionID: %s: invalid setting: %s: %w", sessionID, FileStoreDuplicateMessagePolicy, err)
+		}
+	}
+	detectConflicts := false
+	if detectStr, ok := f.settings[FileStoreDetectConflicts]; ok {
+		if detectConflicts, err = parseBoolSetting(detectStr); err != nil {
+			return nil, fmt.Errorf("sessionID: %s: invalid setting: %s: %w", sessionID, FileStoreDetectConflicts, err)
+		}
+	}
+
+	store, err := newFileStore(sessionID, dirname, duplicatePolicy, f.clock)
+	if err != nil {
+		return nil, err
+	}
+	store.detectConflicts = detectConflicts
+	store.serializer = f.serializer
+	return store, nil
 }
 
-func newFileStore(sessionID string, dirname string) (*fileStore, error) {
+// Close only makes Create fail, as the file stores share nothing
+func (f fileStoreFactory) Close() error {
+	f.closed.close()
+	return nil
+}
+
+func newFileStore(sessionID string, dirname string, duplicatePolicy DuplicateMessagePolicy, clock Clock) (*fileStore, error) {
 	if err := os.MkdirAll(dirname, os.ModePerm); err != nil {
 		return nil, err
 	}
 
-	store := &fileStore{
+	store := buildFileStore(sessionID, dirname, duplicatePolicy, clock)
+	if err := store.refresh(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// buildFileStore returns the store of a session without touching its files
+func buildFileStore(sessionID string, dirname string, duplicatePolicy DuplicateMessagePolicy, clock Clock) *fileStore {
+	return &fileStore{
 		sessionID:          sessionID,
-		cache:              &memoryStore{},
+		cache:              &memoryStore{clock: clock},
 		offsets:            make(map[int]msgDef),
 		bodyFname:          path.Join(dirname, fmt.Sprintf("%s.%s", sessionID, "body")),
 		headerFname:        path.Join(dirname, fmt.Sprintf("%s.%s", sessionID, "header")),
 		sessionFname:       path.Join(dirname, fmt.Sprintf("%s.%s", sessionID, "session")),
 		senderSeqNumsFname: path.Join(dirname, fmt.Sprintf("%s.%s", sessionID, "senderseqnums")),
 		targetSeqNumsFname: path.Join(dirname, fmt.Sprintf("%s.%s", sessionID, "targetseqnums")),
+		valuesFname:        path.Join(dirname, fmt.Sprintf("%s.%s", sessionID, "values")),
+		compactFname:       path.Join(dirname, fmt.Sprintf("%s.%s", sessionID, "compact")),
+		duplicatePolicy:    duplicatePolicy,
 	}
+}
 
-	if err := store.Refresh(); err != nil {
-		return nil, err
+// CloneSession copies the session srcID to the session dstID, see SessionCloner
+func (f fileStoreFactory) CloneSession(srcID, dstID string) error {
+	return CloneMessageStoreSession(f, srcID, dstID)
+}
+
+// RenameSession moves the files of the session oldID, including those archived by ResetWithoutDeletingMessages, to the
+// session newID, see SessionRenamer.  A filesystem cannot rename several files at once, so the session file, which
+// ListSessions finds sessions by, is renamed last.
+func (f fileStoreFactory) RenameSession(oldID, newID string) error {
+	dirname, ok := f.settings[FileStorePath]
+	if !ok {
+		return fmt.Errorf("required setting not found: %s", FileStorePath)
 	}
 
-	return store, nil
+	oldStore := buildFileStore(oldID, dirname, DuplicateMessageReplace, f.clock)
+	newStore := buildFileStore(newID, dirname, DuplicateMessageReplace, f.clock)
+	if _, err := os.Stat(newStore.sessionFname); err == nil {
+		return fmt.Errorf("unable to rename session: %s: already stored", newID)
+	}
+	if _, err := os.Stat(oldStore.sessionFname); err != nil {
+		return fmt.Errorf("unable to rename session: %s: not found", oldID)
+	}
+
+	entries, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		return fmt.Errorf("unable to read directory: %s: %w", dirname, err)
+	}
+	renames := map[string]string{
+		oldStore.bodyFname:          newStore.bodyFname,
+		oldStore.headerFname:        newStore.headerFname,
+		oldStore.senderSeqNumsFname: newStore.senderSeqNumsFname,
+		oldStore.targetSeqNumsFname: newStore.targetSeqNumsFname,
+		oldStore.valuesFname:        newStore.valuesFname,
+	}
+	for _, entry := range entries {
+		for _, suffix := range []string{"body", "header"} {
+			prefix := fmt.Sprintf("%s.%s.", oldID, suffix)
+			if !strings.HasPrefix(entry.Name(), prefix) {
+				continue
+			}
+			if generation, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), prefix)); err == nil {
+				renames[path.Join(dirname, entry.Name())] = path.Join(dirname, fmt.Sprintf("%s.%s.%d", newID, suffix, generation))
+			}
+		}
+	}
+
+	for oldFname, newFname := range renames {
+		if err := os.Rename(oldFname, newFname); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to rename file: %s: %w", oldFname, err)
+		}
+	}
+	if err := os.Rename(oldStore.sessionFname, newStore.sessionFname); err != nil {
+		return fmt.Errorf("unable to rename file: %s: %w", oldStore.sessionFname, err)
+	}
+	return nil
 }
 
-// Reset deletes the store files and sets the seqnums back to 1
-func (store *fileStore) Reset() error {
+// ListSessions returns every session with files in the factory's directory, see SessionLister.  The files are only read.
+func (f fileStoreFactory) ListSessions() ([]SessionInfo, error) {
+	dirname, ok := f.settings[FileStorePath]
+	if !ok {
+		return nil, fmt.Errorf("required setting not found: %s", FileStorePath)
+	}
+
+	entries, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read directory: %s: %w", dirname, err)
+	}
+
+	var infos []SessionInfo
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".session") {
+			continue
+		}
+		store := buildFileStore(strings.TrimSuffix(entry.Name(), ".session"), dirname, DuplicateMessageReplace, f.clock)
+		if _, err := store.populateCache(); err != nil {
+			return nil, err
+		}
+		infos = append(infos, SessionInfo{
+			SessionID:           store.sessionID,
+			CreationTime:        store.cache.CreationTime(),
+			NextSenderMsgSeqNum: store.cache.NextSenderMsgSeqNum(),
+			NextTargetMsgSeqNum: store.cache.NextTargetMsgSeqNum(),
+			MessageCount:        int64(len(store.offsets)),
+		})
+	}
+	return infos, nil
+}
+
+// Reset deletes the store files and sets the seqnums back to 1.  The session values file is kept.
+func (store *fileStore) Reset() (err error) {
+	defer wrapStoreError("file", store.sessionID, "reset", 0, &err)
+
 	store.cache.Reset()
 	if err := store.Close(); err != nil {
 		return err
 	}
+	// a compaction left uncompleted must not be completed over the reset files
+	if err := removeFile(store.compactFname); err != nil {
+		return err
+	}
 	if err := removeFile(store.bodyFname); err != nil {
 		return err
 	}
@@ -128,16 +295,91 @@ func (store *fileStore) Reset() error {
 	if err := removeFile(store.targetSeqNumsFname); err != nil {
 		return err
 	}
-	return store.Refresh()
+	return store.refresh()
+}
+
+// ResetWithoutDeletingMessages sets the seqnums back to 1 like Reset, but renames the body and header files rather than
+// deleting them, suffixed with their reset generation, e.g. "FIX.4.4-SENDER-TARGET.body.1", see SeqNumResetter
+func (store *fileStore) ResetWithoutDeletingMessages() (err error) {
+	defer wrapStoreError("file", store.sessionID, "reset", 0, &err)
+
+	generation, err := store.nextResetGeneration()
+	if err != nil {
+		return err
+	}
+
+	store.cache.Reset()
+	if err := store.Close(); err != nil {
+		return err
+	}
+	for _, fname := range []string{store.bodyFname, store.headerFname} {
+		archiveFname := fmt.Sprintf("%s.%d", fname, generation)
+		if err := os.Rename(fname, archiveFname); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to rename file: %s: %w", fname, err)
+		}
+	}
+	if err := removeFile(store.sessionFname); err != nil {
+		return err
+	}
+	if err := removeFile(store.senderSeqNumsFname); err != nil {
+		return err
+	}
+	if err := removeFile(store.targetSeqNumsFname); err != nil {
+		return err
+	}
+	return store.refresh()
+}
+
+// nextResetGeneration returns the generation after the highest one the header files have been archived under
+func (store *fileStore) nextResetGeneration() (int, error) {
+	dirname, prefix := path.Split(store.headerFname + ".")
+	entries, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read directory: %s: %w", dirname, err)
+	}
+
+	last := 0
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		if generation, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), prefix)); err == nil && generation > last {
+			last = generation
+		}
+	}
+	return last + 1, nil
 }
 
 // Refresh closes the store files and then reloads from them
 func (store *fileStore) Refresh() (err error) {
+	defer wrapStoreError("file", store.sessionID, "refresh", 0, &err)
+
+	before := snapshotSession(store)
+	if err := store.refresh(); err != nil {
+		return err
+	}
+
+	// the session file holds the creation time to the nanosecond
+	if store.detectConflicts {
+		if err := before.detectConflict(store.sessionID, snapshotSession(store), 0); err != nil {
+			before.restore(store.cache)
+			return err
+		}
+	}
+	return nil
+}
+
+// refresh closes the store files and then reloads from them, adopting whatever they hold
+func (store *fileStore) refresh() (err error) {
 	store.cache.Reset()
+	store.offsets = make(map[int]msgDef)
 
 	if err = store.Close(); err != nil {
 		return err
 	}
+	if err := store.completeCompaction(); err != nil {
+		return err
+	}
 
 	creationTimePopulated, err := store.populateCache()
 	if err != nil {
@@ -204,36 +446,46 @@ func (store *fileStore) populateCache() (creationTimePopulated bool, err error)
 		}
 	}
 
+	store.cache.sessionValues = nil
+	if valuesBytes, err := ioutil.ReadFile(store.valuesFname); err == nil {
+		if err := json.Unmarshal(valuesBytes, &store.cache.sessionValues); err != nil {
+			return creationTimePopulated, fmt.Errorf("unable to read file: %s: %w", store.valuesFname, err)
+		}
+	}
+
 	return creationTimePopulated, nil
 }
 
 func (store *fileStore) setSession() error {
 	if _, err := store.sessionFile.Seek(0, os.SEEK_SET); err != nil {
-		return fmt.Errorf("unable to rewind file: %s: %s", store.sessionFname, err.Error())
+		return fmt.Errorf("unable to rewind file: %s: %w", store.sessionFname, err)
+	}
+	if err := store.sessionFile.Truncate(0); err != nil {
+		return fmt.Errorf("unable to truncate file: %s: %w", store.sessionFname, err)
 	}
 
 	data, err := store.cache.CreationTime().MarshalText()
 	if err != nil {
-		return fmt.Errorf("unable to marshal session time to file: %s: %s", store.sessionFname, err.Error())
+		return fmt.Errorf("unable to marshal session time to file: %s: %w", store.sessionFname, err)
 	}
 	if _, err := store.sessionFile.Write(data); err != nil {
-		return fmt.Errorf("unable to write to file: %s: %s", store.sessionFname, err.Error())
+		return fmt.Errorf("unable to write to file: %s: %w", store.sessionFname, err)
 	}
 	if err := store.sessionFile.Sync(); err != nil {
-		return fmt.Errorf("unable to flush file: %s: %s", store.sessionFname, err.Error())
+		return fmt.Errorf("unable to flush file: %s: %w", store.sessionFname, err)
 	}
 	return nil
 }
 
 func (store *fileStore) setSeqNum(f *os.File, seqNum int) error {
 	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
-		return fmt.Errorf("unable to rewind file: %s: %s", f.Name(), err.Error())
+		return fmt.Errorf("unable to rewind file: %s: %w", f.Name(), err)
 	}
 	if _, err := fmt.Fprintf(f, "%019d", seqNum); err != nil {
-		return fmt.Errorf("unable to write to file: %s: %s", f.Name(), err.Error())
+		return fmt.Errorf("unable to write to file: %s: %w", f.Name(), err)
 	}
 	if err := f.Sync(); err != nil {
-		return fmt.Errorf("unable to flush file: %s: %s", f.Name(), err.Error())
+		return fmt.Errorf("unable to flush file: %s: %w", f.Name(), err)
 	}
 	return nil
 }
@@ -249,25 +501,33 @@ func (store *fileStore) NextTargetMsgSeqNum() int {
 }
 
 // SetNextSenderMsgSeqNum sets the next MsgSeqNum that will be sent
-func (store *fileStore) SetNextSenderMsgSeqNum(next int) error {
+func (store *fileStore) SetNextSenderMsgSeqNum(next int) (err error) {
+	defer wrapStoreError("file", store.sessionID, "set_next_sender_seqnum", 0, &err)
+
 	store.cache.SetNextSenderMsgSeqNum(next)
 	return store.setSeqNum(store.senderSeqNumsFile, next)
 }
 
 // SetNextTargetMsgSeqNum sets the next MsgSeqNum that should be received
-func (store *fileStore) SetNextTargetMsgSeqNum(next int) error {
+func (store *fileStore) SetNextTargetMsgSeqNum(next int) (err error) {
+	defer wrapStoreError("file", store.sessionID, "set_next_target_seqnum", 0, &err)
+
 	store.cache.SetNextTargetMsgSeqNum(next)
 	return store.setSeqNum(store.targetSeqNumsFile, next)
 }
 
 // IncrNextSenderMsgSeqNum increments the next MsgSeqNum that will be sent
-func (store *fileStore) IncrNextSenderMsgSeqNum() error {
+func (store *fileStore) IncrNextSenderMsgSeqNum() (err error) {
+	defer wrapStoreError("file", store.sessionID, "set_next_sender_seqnum", 0, &err)
+
 	store.cache.IncrNextSenderMsgSeqNum()
 	return store.setSeqNum(store.senderSeqNumsFile, store.cache.NextSenderMsgSeqNum())
 }
 
 // IncrNextTargetMsgSeqNum increments the next MsgSeqNum that should be received
-func (store *fileStore) IncrNextTargetMsgSeqNum() error {
+func (store *fileStore) IncrNextTargetMsgSeqNum() (err error) {
+	defer wrapStoreError("file", store.sessionID, "set_next_target_seqnum", 0, &err)
+
 	store.cache.IncrNextTargetMsgSeqNum()
 	return store.setSeqNum(store.targetSeqNumsFile, store.cache.NextTargetMsgSeqNum())
 }
@@ -277,33 +537,105 @@ func (store *fileStore) CreationTime() time.Time {
 	return store.cache.CreationTime()
 }
 
-func (store *fileStore) SaveMessage(seqNum int, msg []byte) error {
+func (store *fileStore) SaveMessage(seqNum int, msg []byte) (err error) {
+	defer wrapStoreError("file", store.sessionID, "save_message", seqNum, &err)
+
+	return store.saveMessages([]SeqMsg{{SeqNum: seqNum, Msg: msg}})
+}
+
+// SetCreationTime sets the creation time of the store, rewriting the session file
+func (store *fileStore) SetCreationTime(t time.Time) (err error) {
+	defer wrapStoreError("file", store.sessionID, "set_creation_time", 0, &err)
+
+	store.cache.SetCreationTime(t)
+	return store.setSession()
+}
+
+// SaveMessages appends a batch of messages to the files, syncing them once for the whole batch.  Under
+// DuplicateMessageError nothing is written if any of the messages is already stored.
+func (store *fileStore) SaveMessages(msgs []SeqMsg) (err error) {
+	defer wrapStoreError("file", store.sessionID, "save_messages", 0, &err)
+
+	return store.saveMessages(msgs)
+}
+
+// saveMessages implements SaveMessages
+func (store *fileStore) saveMessages(msgs []SeqMsg) error {
+	if store.duplicatePolicy == DuplicateMessageError {
+		for _, m := range msgs {
+			if _, exists := store.offsets[m.SeqNum]; exists {
+				return ErrDuplicateMessage
+			}
+		}
+	}
+
+	written := false
+	for _, m := range msgs {
+		if _, exists := store.offsets[m.SeqNum]; exists && store.duplicatePolicy == DuplicateMessageIgnore {
+			continue
+		}
+		msg := m.Msg
+		if store.serializer != nil {
+			var err error
+			record := MessageRecord{SessionID: store.sessionID, SeqNum: m.SeqNum, StoredAt: store.cache.now(), Msg: msg}
+			if msg, err = encodeRecord(store.serializer, record); err != nil {
+				return err
+			}
+		}
+		if err := store.writeMessage(m.SeqNum, msg); err != nil {
+			return err
+		}
+		written = true
+	}
+	if !written {
+		return nil
+	}
+
+	if err := store.bodyFile.Sync(); err != nil {
+		return fmt.Errorf("unable to flush file: %s: %w", store.bodyFname, err)
+	}
+	if err := store.headerFile.Sync(); err != nil {
+		return fmt.Errorf("unable to flush file: %s: %w", store.headerFname, err)
+	}
+	return nil
+}
+
+// writeMessage appends a message to the files without syncing them
+func (store *fileStore) writeMessage(seqNum int, msg []byte) error {
 	offset, err := store.bodyFile.Seek(0, os.SEEK_END)
 	if err != nil {
-		return fmt.Errorf("unable to seek to end of file: %s: %s", store.bodyFname, err.Error())
+		return fmt.Errorf("unable to seek to end of file: %s: %w", store.bodyFname, err)
 	}
 	if _, err := store.headerFile.Seek(0, os.SEEK_END); err != nil {
-		return fmt.Errorf("unable to seek to end of file: %s: %s", store.headerFname, err.Error())
+		return fmt.Errorf("unable to seek to end of file: %s: %w", store.headerFname, err)
 	}
 	if _, err := fmt.Fprintf(store.headerFile, "%d,%d,%d\n", seqNum, offset, len(msg)); err != nil {
-		return fmt.Errorf("unable to write to file: %s: %s", store.headerFname, err.Error())
+		return fmt.Errorf("unable to write to file: %s: %w", store.headerFname, err)
 	}
 
 	store.offsets[seqNum] = msgDef{offset: offset, size: len(msg)}
 
 	if _, err := store.bodyFile.Write(msg); err != nil {
-		return fmt.Errorf("unable to write to file: %s: %s", store.bodyFname, err.Error())
+		return fmt.Errorf("unable to write to file: %s: %w", store.bodyFname, err)
 	}
-	if err := store.bodyFile.Sync(); err != nil {
-		return fmt.Errorf("unable to flush file: %s: %s", store.bodyFname, err.Error())
+	return nil
+}
+
+// GetMessage reads the message stored for seqNum from the body file, reporting whether there is one
+func (store *fileStore) GetMessage(seqNum int) (msg []byte, found bool, err error) {
+	defer wrapStoreError("file", store.sessionID, "get_message", seqNum, &err)
+
+	if msg, found, err = store.readMessage(seqNum); err != nil || !found {
+		return nil, found, err
 	}
-	if err := store.headerFile.Sync(); err != nil {
-		return fmt.Errorf("unable to flush file: %s: %s", store.headerFname, err.Error())
+	if msg, err = decodeRecord(store.serializer, msg); err != nil {
+		return nil, true, err
 	}
-	return nil
+	return msg, true, nil
 }
 
-func (store *fileStore) getMessage(seqNum int) (msg []byte, found bool, err error) {
+// readMessage reads the message stored for seqNum from the body file as it is stored
+func (store *fileStore) readMessage(seqNum int) (msg []byte, found bool, err error) {
 	msgInfo, found := store.offsets[seqNum]
 	if !found {
 		return
@@ -311,7 +643,7 @@ func (store *fileStore) getMessage(seqNum int) (msg []byte, found bool, err erro
 
 	msg = make([]byte, msgInfo.size)
 	if _, err = store.bodyFile.ReadAt(msg, msgInfo.offset); err != nil {
-		return nil, true, fmt.Errorf("unable to read from file: %s: %s", store.bodyFname, err.Error())
+		return nil, true, fmt.Errorf("unable to read from file: %s: %w", store.bodyFname, err)
 	}
 
 	return msg, true, nil
@@ -320,7 +652,7 @@ func (store *fileStore) getMessage(seqNum int) (msg []byte, found bool, err erro
 func (store *fileStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
 	var msgs [][]byte
 	for seqNum := beginSeqNum; seqNum <= endSeqNum; seqNum++ {
-		m, found, err := store.getMessage(seqNum)
+		m, found, err := store.GetMessage(seqNum)
 		if err != nil {
 			return nil, err
 		}
@@ -331,6 +663,272 @@ func (store *fileStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error
 	return msgs, nil
 }
 
+// GetMessagesSince returns the messages stored for seqnums after seqNum, see GetMessagesAfter
+func (store *fileStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return GetMessagesAfter(store, seqNum)
+}
+
+// GetMessagesDescending returns the messages in the range most recent first, see GetMessagesReversed
+func (store *fileStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return GetMessagesReversed(store, beginSeqNum, endSeqNum)
+}
+
+// IterateMessages calls fn with each message in the range in seqnum order, reading them from the body file one at a time
+func (store *fileStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	for seqNum := beginSeqNum; seqNum <= endSeqNum; seqNum++ {
+		m, found, err := store.GetMessage(seqNum)
+		if err != nil {
+			return err
+		}
+		if found {
+			if err := fn(seqNum, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StreamMessages streams the messages in the range in seqnum order, see StreamMessageStore.  The offsets of the range
+// are copied, and the body file opened again, before the stream starts, so that the store can be written to, and even
+// compacted, while it is read.
+func (store *fileStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	snapshot := &fileStore{sessionID: store.sessionID, bodyFname: store.bodyFname, serializer: store.serializer, offsets: make(map[int]msgDef)}
+	for seqNum, msgInfo := range store.offsets {
+		if seqNum >= beginSeqNum && seqNum <= endSeqNum {
+			snapshot.offsets[seqNum] = msgInfo
+		}
+	}
+	bodyFile, err := os.Open(store.bodyFname)
+	if err != nil {
+		err = fmt.Errorf("unable to open file: %s: %w", store.bodyFname, err)
+		wrapStoreError("file", store.sessionID, "stream_messages", beginSeqNum, &err)
+		return failedStream(err)
+	}
+	snapshot.bodyFile = bodyFile
+
+	msgs, errs := StreamMessageStore(ctx, snapshot, beginSeqNum, endSeqNum)
+	closedErrs := make(chan error, 1)
+	go func() {
+		defer close(closedErrs)
+		defer bodyFile.Close()
+		for err := range errs {
+			closedErrs <- err
+		}
+	}()
+	return msgs, closedErrs
+}
+
+// BeginTx starts a transaction buffered until Commit, whose messages are synced to the files together, see
+// BeginBufferedTx
+func (store *fileStore) BeginTx() (StoreTx, error) {
+	return BeginBufferedTx(store), nil
+}
+
+// SetSessionValue stores value under key in the session values file, which is rewritten alongside and renamed over the
+// original so that a crash leaves either the old values or the new
+func (store *fileStore) SetSessionValue(key, value string) (err error) {
+	defer wrapStoreError("file", store.sessionID, "set_session_value", 0, &err)
+
+	values := make(map[string]string, len(store.cache.sessionValues)+1)
+	for k, v := range store.cache.sessionValues {
+		values[k] = v
+	}
+	values[key] = value
+
+	valuesBytes, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	tmpValuesFname := store.valuesFname + ".tmp"
+	tmpValuesFile, err := os.OpenFile(tmpValuesFname, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return fmt.Errorf("unable to create file: %s: %w", tmpValuesFname, err)
+	}
+	_, err = tmpValuesFile.Write(valuesBytes)
+	if err == nil {
+		err = tmpValuesFile.Sync()
+	}
+	tmpValuesFile.Close()
+	if err != nil {
+		return fmt.Errorf("unable to write to file: %s: %w", tmpValuesFname, err)
+	}
+	if err := os.Rename(tmpValuesFname, store.valuesFname); err != nil {
+		return fmt.Errorf("unable to rename file: %s: %w", tmpValuesFname, err)
+	}
+	return store.cache.SetSessionValue(key, value)
+}
+
+// GetSessionValue returns the value stored under key, see SessionValueStore
+func (store *fileStore) GetSessionValue(key string) (string, bool, error) {
+	return store.cache.GetSessionValue(key)
+}
+
+// MessageCount returns the number of messages in the header index, see MessageStats
+func (store *fileStore) MessageCount() (int, error) {
+	return len(store.offsets), nil
+}
+
+// FirstSeqNum returns the lowest seqnum in the header index, see MessageStats
+func (store *fileStore) FirstSeqNum() (int, error) {
+	first := 0
+	for seqNum := range store.offsets {
+		if first == 0 || seqNum < first {
+			first = seqNum
+		}
+	}
+	return first, nil
+}
+
+// LastSeqNum returns the highest seqnum in the header index, see MessageStats
+func (store *fileStore) LastSeqNum() (int, error) {
+	last := 0
+	for seqNum := range store.offsets {
+		if seqNum > last {
+			last = seqNum
+		}
+	}
+	return last, nil
+}
+
+// DeleteMessagesUpTo compacts the files, rewriting the body and header with only the messages after seqNum.  The
+// compacted files are written and synced alongside and committed by a marker file, and only then renamed over the
+// originals.  A compaction interrupted between the two renames, by a crash or a failed rename, is completed when the
+// store is next opened or refreshed.
+func (store *fileStore) DeleteMessagesUpTo(seqNum int) (err error) {
+	defer wrapStoreError("file", store.sessionID, "delete_messages", seqNum, &err)
+
+	var remaining []int
+	deleted := false
+	for n := range store.offsets {
+		if n > seqNum {
+			remaining = append(remaining, n)
+		} else {
+			deleted = true
+		}
+	}
+	if !deleted {
+		return nil
+	}
+	sort.Ints(remaining)
+
+	tmpBodyFname, tmpHeaderFname := store.compactedFnames()
+	if err := store.writeCompacted(tmpBodyFname, tmpHeaderFname, remaining); err != nil {
+		removeFile(tmpBodyFname)
+		removeFile(tmpHeaderFname)
+		return err
+	}
+	if err := writeFileSync(store.compactFname, nil); err != nil {
+		removeFile(tmpBodyFname)
+		removeFile(tmpHeaderFname)
+		return err
+	}
+
+	// refresh renames the compacted files over the originals once they are closed
+	return store.refresh()
+}
+
+// compactedFnames returns the names of the files DeleteMessagesUpTo writes the compacted body and header to
+func (store *fileStore) compactedFnames() (bodyFname, headerFname string) {
+	return store.bodyFname + ".tmp", store.headerFname + ".tmp"
+}
+
+// completeCompaction renames the compacted body and header of a compaction committed by DeleteMessagesUpTo over the
+// originals, each unless already renamed, or removes those of a compaction left uncommitted
+func (store *fileStore) completeCompaction() error {
+	tmpBodyFname, tmpHeaderFname := store.compactedFnames()
+	if _, err := os.Stat(store.compactFname); os.IsNotExist(err) {
+		if err := removeFile(tmpBodyFname); err != nil {
+			return err
+		}
+		return removeFile(tmpHeaderFname)
+	} else if err != nil {
+		return fmt.Errorf("unable to read file: %s: %w", store.compactFname, err)
+	}
+
+	if err := os.Rename(tmpBodyFname, store.bodyFname); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to rename file: %s: %w", tmpBodyFname, err)
+	}
+	if err := os.Rename(tmpHeaderFname, store.headerFname); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to rename file: %s: %w", tmpHeaderFname, err)
+	}
+	return removeFile(store.compactFname)
+}
+
+// writeCompacted writes the messages stored for seqNums to new body and header files
+func (store *fileStore) writeCompacted(bodyFname, headerFname string, seqNums []int) error {
+	bodyFile, err := os.OpenFile(bodyFname, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return fmt.Errorf("unable to create file: %s: %w", bodyFname, err)
+	}
+	defer bodyFile.Close()
+	headerFile, err := os.OpenFile(headerFname, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return fmt.Errorf("unable to create file: %s: %w", headerFname, err)
+	}
+	defer headerFile.Close()
+
+	var offset int64
+	for _, seqNum := range seqNums {
+		msg, _, err := store.readMessage(seqNum)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(headerFile, "%d,%d,%d\n", seqNum, offset, len(msg)); err != nil {
+			return fmt.Errorf("unable to write to file: %s: %w", headerFname, err)
+		}
+		if _, err := bodyFile.Write(msg); err != nil {
+			return fmt.Errorf("unable to write to file: %s: %w", bodyFname, err)
+		}
+		offset += int64(len(msg))
+	}
+
+	if err := bodyFile.Sync(); err != nil {
+		return fmt.Errorf("unable to flush file: %s: %w", bodyFname, err)
+	}
+	if err := headerFile.Sync(); err != nil {
+		return fmt.Errorf("unable to flush file: %s: %w", headerFname, err)
+	}
+	return nil
+}
+
+// Backup writes the session to w as a portable archive, see BackupMessageStore
+func (store *fileStore) Backup(w io.Writer) error {
+	return BackupMessageStore(store, w)
+}
+
+// Restore resets the session and restores into it an archive written by Backup, see RestoreMessageStore
+func (store *fileStore) Restore(r io.Reader) error {
+	return RestoreMessageStore(store, r)
+}
+
+// HealthCheck verifies that the store's files are open and the session file can be read
+func (store *fileStore) HealthCheck(ctx context.Context) (err error) {
+	defer wrapStoreError("file", store.sessionID, "health_check", 0, &err)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if store.bodyFile == nil || store.headerFile == nil {
+		return fmt.Errorf("store is closed: %s", store.sessionID)
+	}
+	if _, err := store.bodyFile.Stat(); err != nil {
+		return fmt.Errorf("unable to stat file: %s: %w", store.bodyFname, err)
+	}
+	if _, err := store.headerFile.Stat(); err != nil {
+		return fmt.Errorf("unable to stat file: %s: %w", store.headerFname, err)
+	}
+	if _, err := ioutil.ReadFile(store.sessionFname); err != nil {
+		return fmt.Errorf("unable to read file: %s: %w", store.sessionFname, err)
+	}
+	return nil
+}
+
+// Flush does nothing, as every write is synced to the files before it returns
+func (store *fileStore) Flush() error {
+	return nil
+}
+
 // Close closes the store's files
 func (store *fileStore) Close() error {
 	if err := closeFile(store.bodyFile); err != nil {
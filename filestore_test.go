@@ -1,12 +1,15 @@
 package msgstore
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
@@ -36,3 +39,261 @@ func (suite *FileStoreTestSuite) TearDownTest() {
 func TestFileStoreTestSuite(t *testing.T) {
 	suite.Run(t, new(FileStoreTestSuite))
 }
+
+func TestFileStore_DuplicateMessagePolicy(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("FileStoreDuplicateMessagePolicy-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+
+	var testCases = []struct {
+		policy      string
+		expectedErr error
+		expectedMsg string
+	}{
+		{policy: "", expectedErr: nil, expectedMsg: "second"},
+		{policy: "replace", expectedErr: nil, expectedMsg: "second"},
+		{policy: "ignore", expectedErr: nil, expectedMsg: "first"},
+		{policy: "error", expectedErr: ErrDuplicateMessage, expectedMsg: "first"},
+	}
+
+	for _, tc := range testCases {
+		settings := map[string]string{FileStorePath: path.Join(rootPath, fmt.Sprintf("%d", time.Now().UnixNano()))}
+		if tc.policy != "" {
+			settings[FileStoreDuplicateMessagePolicy] = tc.policy
+		}
+		store, err := NewFileStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+		require.Nil(t, err)
+
+		// Given a saved message
+		require.Nil(t, store.SaveMessage(1, []byte("first")))
+
+		// When another message is saved with the same seqnum
+		assert.True(t, errors.Is(store.SaveMessage(1, []byte("second")), tc.expectedErr), tc.policy)
+
+		// Then the stored message should follow the policy, including after a reload
+		require.Nil(t, store.Refresh())
+		msgs, err := store.GetMessages(1, 1)
+		require.Nil(t, err)
+		require.Len(t, msgs, 1)
+		assert.Equal(t, tc.expectedMsg, string(msgs[0]), tc.policy)
+		store.Close()
+	}
+
+	_, err := NewFileStoreFactory(map[string]string{FileStorePath: rootPath, FileStoreDuplicateMessagePolicy: "bogus"}).Create("FIX.4.4-SENDER-TARGET")
+	assert.NotNil(t, err)
+}
+
+func TestFileStoreFactory_ListSessions(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("FileStoreListSessions-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+	factory := NewFileStoreFactory(map[string]string{FileStorePath: rootPath})
+
+	// Given two sessions, one with messages
+	first, err := factory.Create("FIX.4.4-FIRST-TARGET")
+	require.Nil(t, err)
+	defer first.Close()
+	require.Nil(t, first.SaveMessage(1, []byte("hello")))
+	require.Nil(t, first.SaveMessage(2, []byte("world")))
+	require.Nil(t, first.SetNextSenderMsgSeqNum(3))
+	second, err := factory.Create("FIX.4.4-SECOND-TARGET")
+	require.Nil(t, err)
+	defer second.Close()
+
+	// When the factory lists the sessions
+	infos, err := factory.(SessionLister).ListSessions()
+	require.Nil(t, err)
+
+	// Then both should be listed in order, as stored
+	require.Len(t, infos, 2)
+	assert.Equal(t, "FIX.4.4-FIRST-TARGET", infos[0].SessionID)
+	assert.Equal(t, 3, infos[0].NextSenderMsgSeqNum)
+	assert.Equal(t, int64(2), infos[0].MessageCount)
+	assert.True(t, first.CreationTime().Equal(infos[0].CreationTime))
+	assert.Equal(t, "FIX.4.4-SECOND-TARGET", infos[1].SessionID)
+	assert.Equal(t, int64(0), infos[1].MessageCount)
+}
+
+func TestFileStore_ResetWithoutDeletingMessages(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("FileStoreResetWithoutDeletingMessages-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+	store, err := NewFileStoreFactory(map[string]string{FileStorePath: rootPath}).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Given messages saved before two resets
+	require.Nil(t, store.SaveMessage(1, []byte("first")))
+	require.Nil(t, store.SetNextSenderMsgSeqNum(2))
+	require.Nil(t, store.(SeqNumResetter).ResetWithoutDeletingMessages())
+	require.Nil(t, store.SaveMessage(1, []byte("second")))
+
+	// When the store is reset again without deleting the messages
+	require.Nil(t, store.(SeqNumResetter).ResetWithoutDeletingMessages())
+
+	// Then the seqnums should be back to 1 and the old messages hidden
+	assert.Equal(t, 1, store.NextSenderMsgSeqNum())
+	msgs, err := store.GetMessages(1, 1)
+	require.Nil(t, err)
+	assert.Empty(t, msgs)
+
+	// And each generation's messages should have been kept in its own files
+	for generation, msg := range []string{"first", "second"} {
+		body, err := ioutil.ReadFile(path.Join(rootPath, fmt.Sprintf("FIX.4.4-SENDER-TARGET.body.%d", generation+1)))
+		require.Nil(t, err)
+		assert.Equal(t, msg, string(body))
+	}
+}
+
+func TestFileStore_InterruptedCompaction(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("FileStoreInterruptedCompaction-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+
+	// Given a compaction committed but interrupted after renaming the body only
+	store, err := newFileStore("FIX.4.4-A-B", rootPath, DuplicateMessageError, nil)
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessages([]SeqMsg{{SeqNum: 1, Msg: []byte("msg1")}, {SeqNum: 2, Msg: []byte("msg2")}, {SeqNum: 3, Msg: []byte("msg3")}}))
+	tmpBodyFname, tmpHeaderFname := store.compactedFnames()
+	require.Nil(t, store.writeCompacted(tmpBodyFname, tmpHeaderFname, []int{3}))
+	require.Nil(t, writeFileSync(store.compactFname, nil))
+	require.Nil(t, store.Close())
+	require.Nil(t, os.Rename(tmpBodyFname, store.bodyFname))
+
+	// When the store is opened again
+	store, err = newFileStore("FIX.4.4-A-B", rootPath, DuplicateMessageError, nil)
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Then the compaction should be completed
+	msgs, err := store.GetMessages(1, 3)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("msg3")}, msgs)
+	_, err = os.Stat(store.compactFname)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileStore_UncommittedCompaction(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("FileStoreUncommittedCompaction-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+
+	// Given compacted files written without being committed
+	store, err := newFileStore("FIX.4.4-A-B", rootPath, DuplicateMessageError, nil)
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessages([]SeqMsg{{SeqNum: 1, Msg: []byte("msg1")}, {SeqNum: 2, Msg: []byte("msg2")}}))
+	tmpBodyFname, tmpHeaderFname := store.compactedFnames()
+	require.Nil(t, store.writeCompacted(tmpBodyFname, tmpHeaderFname, []int{2}))
+	require.Nil(t, store.Close())
+
+	// When the store is opened again
+	store, err = newFileStore("FIX.4.4-A-B", rootPath, DuplicateMessageError, nil)
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Then the compacted files should be discarded, keeping every message
+	msgs, err := store.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("msg1"), []byte("msg2")}, msgs)
+	_, err = os.Stat(tmpBodyFname)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileStoreFactory_WithFileClock(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("FileStoreWithFileClock-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+
+	// Given a file store factory with a fixed clock
+	clock := fixedClock{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	store, err := NewFileStoreFactory(map[string]string{FileStorePath: rootPath}, WithFileClock(clock)).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// When the new session's creation time is read back from its files
+	require.Nil(t, store.Refresh())
+
+	// Then it should be the time told by the clock
+	assert.True(t, clock.t.Equal(store.CreationTime()))
+}
+
+func TestFileStoreFactory_Close(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("FileStoreFactoryClose-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+
+	// Given a file store factory, passed by value as the factories are
+	factory := NewFileStoreFactory(map[string]string{FileStorePath: rootPath})
+	copied := factory
+
+	// When it is closed
+	require.Nil(t, factory.Close())
+
+	// Then its copies should refuse to create stores
+	_, err := copied.Create("FIX.4.4-SENDER-TARGET")
+	assert.Equal(t, ErrFactoryClosed, err)
+}
+
+func TestFileStoreFactory_RenameSession(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("FileStoreRenameSession-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+	factory := NewFileStoreFactory(map[string]string{FileStorePath: rootPath})
+
+	// Given a session with current and archived messages
+	store, err := factory.Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessage(1, []byte("archived")))
+	require.Nil(t, store.(SeqNumResetter).ResetWithoutDeletingMessages())
+	require.Nil(t, store.SaveMessage(1, []byte("hello")))
+	require.Nil(t, store.SetNextSenderMsgSeqNum(2))
+	require.Nil(t, store.Close())
+
+	// When it is renamed
+	require.Nil(t, factory.(SessionRenamer).RenameSession("FIX.4.4-SENDER-TARGET", "FIX.4.4-SENDER-NEWTARGET"))
+
+	// Then its files should all be stored under the new sessionID
+	renamed, err := factory.Create("FIX.4.4-SENDER-NEWTARGET")
+	require.Nil(t, err)
+	defer renamed.Close()
+	assert.Equal(t, 2, renamed.NextSenderMsgSeqNum())
+	msgs, err := renamed.GetMessages(1, 1)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("hello")}, msgs)
+	_, err = os.Stat(path.Join(rootPath, "FIX.4.4-SENDER-NEWTARGET.body.1"))
+	assert.Nil(t, err)
+	infos, err := factory.(SessionLister).ListSessions()
+	require.Nil(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "FIX.4.4-SENDER-NEWTARGET", infos[0].SessionID)
+}
+
+func TestFileStore_DetectConflicts(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("FileStoreDetectConflicts-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+	settings := map[string]string{FileStorePath: rootPath, FileStoreDetectConflicts: "Y"}
+
+	// Given a store detecting conflicts, with seqnums
+	store, err := NewFileStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+	require.Nil(t, store.SetNextSenderMsgSeqNum(5))
+	require.Nil(t, store.SetNextTargetMsgSeqNum(7))
+	require.Nil(t, store.Refresh())
+
+	// When another store moves the sender seqnum backward
+	other, err := NewFileStoreFactory(map[string]string{FileStorePath: rootPath}).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	require.Nil(t, other.SetNextSenderMsgSeqNum(2))
+	require.Nil(t, other.Close())
+
+	// Then Refresh should report the regression
+	err = store.Refresh()
+	var regression *SeqNumRegressionError
+	require.True(t, errors.As(err, &regression), "unexpected error: %v", err)
+	assert.True(t, errors.Is(err, ErrExternallyModified))
+	assert.Equal(t, MessageOutgoing, regression.Direction)
+	assert.Equal(t, 5, regression.Cached)
+	assert.Equal(t, 2, regression.Stored)
+
+	// And leave the store as it was
+	assert.Equal(t, 5, store.NextSenderMsgSeqNum())
+	assert.Equal(t, 7, store.NextTargetMsgSeqNum())
+
+	// And a reset by the store itself should not be reported
+	require.Nil(t, store.Reset())
+	assert.Nil(t, store.Refresh())
+	assert.Equal(t, 1, store.NextSenderMsgSeqNum())
+}
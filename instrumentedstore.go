@@ -0,0 +1,343 @@
+package msgstore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// storeCollectors are the collectors of the instrumented stores sharing a registerer
+type storeCollectors struct {
+	saved     *prometheus.CounterVec
+	read      *prometheus.CounterVec
+	failures  *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+}
+
+type instrumentedStore struct {
+	storeDecorator
+	sessionID string
+	*storeCollectors
+}
+
+// NewInstrumentedStore returns a MessageStore that exports metrics of the operations of inner, a store of sessionID,
+// whatever its backend, registering four collectors with registerer:
+//
+//	msgstore_messages_saved_total counts the messages saved, by session
+//	msgstore_messages_read_total counts the messages read, by session
+//	msgstore_operation_errors_total counts failed operations, by session and operation
+//	msgstore_operation_duration_seconds is a histogram of operation latency, by session and operation
+//
+// Operations are named as in the metrics of the backends, e.g. "incr_next_sender_seqnum", whose latency is what to alert
+// on as it nears the heartbeat interval.  Collectors already registered by an earlier call are reused, so the stores of
+// every session can share a registerer.  The optional interfaces of inner are forwarded, see storeDecorator.
+func NewInstrumentedStore(inner MessageStore, sessionID string, registerer prometheus.Registerer) (MessageStore, error) {
+	saved := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "msgstore",
+		Name:      "messages_saved_total",
+		Help:      "Number of messages saved by session.",
+	}, []string{"session"})
+
+	read := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "msgstore",
+		Name:      "messages_read_total",
+		Help:      "Number of messages read by session.",
+	}, []string{"session"})
+
+	failures := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "msgstore",
+		Name:      "operation_errors_total",
+		Help:      "Number of failed message store operations by session and operation.",
+	}, []string{"session", "operation"})
+
+	durations := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "msgstore",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of message store operations by session and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"session", "operation"})
+
+	var err error
+	if saved, err = registerCounterVec(registerer, saved); err != nil {
+		return nil, err
+	}
+	if read, err = registerCounterVec(registerer, read); err != nil {
+		return nil, err
+	}
+	if failures, err = registerCounterVec(registerer, failures); err != nil {
+		return nil, err
+	}
+	if err := registerer.Register(durations); err != nil {
+		existing, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		if durations, ok = existing.ExistingCollector.(*prometheus.HistogramVec); !ok {
+			return nil, err
+		}
+	}
+
+	collectors := &storeCollectors{saved: saved, read: read, failures: failures, durations: durations}
+	return &instrumentedStore{storeDecorator: newStoreDecorator(inner), sessionID: sessionID, storeCollectors: collectors}, nil
+}
+
+// registerCounterVec registers counter with registerer, returning the counter registered by an earlier call instead
+func registerCounterVec(registerer prometheus.Registerer, counter *prometheus.CounterVec) (*prometheus.CounterVec, error) {
+	err := registerer.Register(counter)
+	if err == nil {
+		return counter, nil
+	}
+	existing, ok := err.(prometheus.AlreadyRegisteredError)
+	if !ok {
+		return nil, err
+	}
+	if counter, ok = existing.ExistingCollector.(*prometheus.CounterVec); !ok {
+		return nil, err
+	}
+	return counter, nil
+}
+
+// observe records the duration and any failure of an operation begun at start, to be deferred
+func (store *instrumentedStore) observe(operation string, start time.Time, err *error) {
+	store.durations.WithLabelValues(store.sessionID, operation).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		store.failures.WithLabelValues(store.sessionID, operation).Inc()
+	}
+}
+
+func (store *instrumentedStore) NextSenderMsgSeqNum() int {
+	return store.inner.NextSenderMsgSeqNum()
+}
+
+func (store *instrumentedStore) NextTargetMsgSeqNum() int {
+	return store.inner.NextTargetMsgSeqNum()
+}
+
+func (store *instrumentedStore) IncrNextSenderMsgSeqNum() error {
+	return store.IncrNextSenderMsgSeqNumContext(context.Background())
+}
+
+func (store *instrumentedStore) IncrNextSenderMsgSeqNumContext(ctx context.Context) (err error) {
+	defer store.observe("incr_next_sender_seqnum", time.Now(), &err)
+	return store.storeDecorator.IncrNextSenderMsgSeqNumContext(ctx)
+}
+
+func (store *instrumentedStore) IncrNextTargetMsgSeqNum() error {
+	return store.IncrNextTargetMsgSeqNumContext(context.Background())
+}
+
+func (store *instrumentedStore) IncrNextTargetMsgSeqNumContext(ctx context.Context) (err error) {
+	defer store.observe("incr_next_target_seqnum", time.Now(), &err)
+	return store.storeDecorator.IncrNextTargetMsgSeqNumContext(ctx)
+}
+
+func (store *instrumentedStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.SetNextSenderMsgSeqNumContext(context.Background(), next)
+}
+
+func (store *instrumentedStore) SetNextSenderMsgSeqNumContext(ctx context.Context, next int) (err error) {
+	defer store.observe("set_next_sender_seqnum", time.Now(), &err)
+	return store.storeDecorator.SetNextSenderMsgSeqNumContext(ctx, next)
+}
+
+func (store *instrumentedStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.SetNextTargetMsgSeqNumContext(context.Background(), next)
+}
+
+func (store *instrumentedStore) SetNextTargetMsgSeqNumContext(ctx context.Context, next int) (err error) {
+	defer store.observe("set_next_target_seqnum", time.Now(), &err)
+	return store.storeDecorator.SetNextTargetMsgSeqNumContext(ctx, next)
+}
+
+func (store *instrumentedStore) CreationTime() time.Time {
+	return store.inner.CreationTime()
+}
+
+func (store *instrumentedStore) SetCreationTime(t time.Time) error {
+	return store.SetCreationTimeContext(context.Background(), t)
+}
+
+func (store *instrumentedStore) SetCreationTimeContext(ctx context.Context, t time.Time) (err error) {
+	defer store.observe("set_creation_time", time.Now(), &err)
+	return store.storeDecorator.SetCreationTimeContext(ctx, t)
+}
+
+func (store *instrumentedStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.SaveMessageContext(context.Background(), seqNum, msg)
+}
+
+func (store *instrumentedStore) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) (err error) {
+	defer store.observe("save_message", time.Now(), &err)
+	if err = store.storeDecorator.SaveMessageContext(ctx, seqNum, msg); err == nil {
+		store.saved.WithLabelValues(store.sessionID).Inc()
+	}
+	return err
+}
+
+func (store *instrumentedStore) SaveMessageWithMeta(seqNum int, msg []byte, meta MessageMeta) (err error) {
+	defer store.observe("save_message", time.Now(), &err)
+	if err = store.storeDecorator.SaveMessageWithMeta(seqNum, msg, meta); err == nil {
+		store.saved.WithLabelValues(store.sessionID).Inc()
+	}
+	return err
+}
+
+func (store *instrumentedStore) SaveMessages(msgs []SeqMsg) error {
+	return store.SaveMessagesContext(context.Background(), msgs)
+}
+
+func (store *instrumentedStore) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) (err error) {
+	defer store.observe("save_messages", time.Now(), &err)
+	if err = store.storeDecorator.SaveMessagesContext(ctx, msgs); err == nil {
+		store.saved.WithLabelValues(store.sessionID).Add(float64(len(msgs)))
+	}
+	return err
+}
+
+func (store *instrumentedStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.GetMessagesContext(context.Background(), beginSeqNum, endSeqNum)
+}
+
+func (store *instrumentedStore) GetMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int) (msgs [][]byte, err error) {
+	defer store.observe("get_messages", time.Now(), &err)
+	msgs, err = store.storeDecorator.GetMessagesContext(ctx, beginSeqNum, endSeqNum)
+	store.read.WithLabelValues(store.sessionID).Add(float64(len(msgs)))
+	return msgs, err
+}
+
+func (store *instrumentedStore) GetMessagesSince(seqNum int) (msgs [][]byte, err error) {
+	defer store.observe("get_messages_since", time.Now(), &err)
+	msgs, err = store.inner.GetMessagesSince(seqNum)
+	store.read.WithLabelValues(store.sessionID).Add(float64(len(msgs)))
+	return msgs, err
+}
+
+func (store *instrumentedStore) GetMessagesDescending(beginSeqNum, endSeqNum int) (msgs [][]byte, err error) {
+	defer store.observe("get_messages_descending", time.Now(), &err)
+	msgs, err = store.inner.GetMessagesDescending(beginSeqNum, endSeqNum)
+	store.read.WithLabelValues(store.sessionID).Add(float64(len(msgs)))
+	return msgs, err
+}
+
+func (store *instrumentedStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return store.GetMessageContext(context.Background(), seqNum)
+}
+
+func (store *instrumentedStore) GetMessageContext(ctx context.Context, seqNum int) (msg []byte, found bool, err error) {
+	defer store.observe("get_message", time.Now(), &err)
+	if msg, found, err = store.storeDecorator.GetMessageContext(ctx, seqNum); found {
+		store.read.WithLabelValues(store.sessionID).Inc()
+	}
+	return msg, found, err
+}
+
+func (store *instrumentedStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.IterateMessagesContext(context.Background(), beginSeqNum, endSeqNum, fn)
+}
+
+func (store *instrumentedStore) IterateMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) (err error) {
+	defer store.observe("iterate_messages", time.Now(), &err)
+	read := store.read.WithLabelValues(store.sessionID)
+	return store.storeDecorator.IterateMessagesContext(ctx, beginSeqNum, endSeqNum, func(seqNum int, msg []byte) error {
+		read.Inc()
+		return fn(seqNum, msg)
+	})
+}
+
+func (store *instrumentedStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+func (store *instrumentedStore) BeginTx() (StoreTx, error) {
+	return store.BeginTxContext(context.Background())
+}
+
+func (store *instrumentedStore) BeginTxContext(ctx context.Context) (_ StoreTx, err error) {
+	defer store.observe("begin_tx", time.Now(), &err)
+	tx, err := store.storeDecorator.BeginTxContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedTx{StoreTx: tx, store: store}, nil
+}
+
+func (store *instrumentedStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.DeleteMessagesUpToContext(context.Background(), seqNum)
+}
+
+func (store *instrumentedStore) DeleteMessagesUpToContext(ctx context.Context, seqNum int) (err error) {
+	defer store.observe("delete_messages", time.Now(), &err)
+	return store.storeDecorator.DeleteMessagesUpToContext(ctx, seqNum)
+}
+
+func (store *instrumentedStore) Backup(w io.Writer) (err error) {
+	defer store.observe("backup", time.Now(), &err)
+	return store.inner.Backup(w)
+}
+
+func (store *instrumentedStore) Restore(r io.Reader) (err error) {
+	defer store.observe("restore", time.Now(), &err)
+	return store.inner.Restore(r)
+}
+
+func (store *instrumentedStore) HealthCheck(ctx context.Context) (err error) {
+	defer store.observe("health_check", time.Now(), &err)
+	return store.inner.HealthCheck(ctx)
+}
+
+func (store *instrumentedStore) Flush() (err error) {
+	defer store.observe("flush", time.Now(), &err)
+	return store.inner.Flush()
+}
+
+func (store *instrumentedStore) Refresh() error {
+	return store.RefreshContext(context.Background())
+}
+
+func (store *instrumentedStore) RefreshContext(ctx context.Context) (err error) {
+	defer store.observe("refresh", time.Now(), &err)
+	return store.storeDecorator.RefreshContext(ctx)
+}
+
+func (store *instrumentedStore) Reset() error {
+	return store.ResetContext(context.Background())
+}
+
+func (store *instrumentedStore) ResetContext(ctx context.Context) (err error) {
+	defer store.observe("reset", time.Now(), &err)
+	return store.storeDecorator.ResetContext(ctx)
+}
+
+func (store *instrumentedStore) ResetWithoutDeletingMessages() (err error) {
+	defer store.observe("reset_without_deleting_messages", time.Now(), &err)
+	return store.storeDecorator.ResetWithoutDeletingMessages()
+}
+
+func (store *instrumentedStore) Close() error {
+	return store.inner.Close()
+}
+
+// instrumentedTx is a transaction of the inner store of an instrumentedStore, whose messages are counted once it commits
+type instrumentedTx struct {
+	StoreTx
+	store *instrumentedStore
+	saved int
+}
+
+func (tx *instrumentedTx) SaveMessage(seqNum int, msg []byte) error {
+	if err := tx.StoreTx.SaveMessage(seqNum, msg); err != nil {
+		return err
+	}
+	tx.saved++
+	return nil
+}
+
+func (tx *instrumentedTx) Commit() (err error) {
+	defer tx.store.observe("commit_tx", time.Now(), &err)
+	if err = tx.StoreTx.Commit(); err == nil {
+		tx.store.saved.WithLabelValues(tx.store.sessionID).Add(float64(tx.saved))
+	}
+	return err
+}
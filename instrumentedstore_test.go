@@ -0,0 +1,57 @@
+package msgstore
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// InstrumentedStoreTestSuite runs all tests in the MessageStoreTestSuite against an instrumented store over the
+// MemoryStore
+type InstrumentedStoreTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *InstrumentedStoreTestSuite) SetupTest() {
+	inner, err := NewMemoryStoreFactory().Create("session")
+	require.Nil(suite.T(), err)
+	suite.msgStore, err = NewInstrumentedStore(inner, "session", prometheus.NewRegistry())
+	require.Nil(suite.T(), err)
+}
+
+func TestInstrumentedStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(InstrumentedStoreTestSuite))
+}
+
+func TestInstrumentedStore(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	// Given the instrumented stores of two sessions sharing a registry
+	inner1, _ := NewMemoryStoreFactory().Create("FIX.4.4-A-B")
+	store1, err := NewInstrumentedStore(inner1, "FIX.4.4-A-B", registry)
+	require.Nil(t, err)
+	inner2, _ := NewMemoryStoreFactory().Create("FIX.4.4-C-D")
+	store2, err := NewInstrumentedStore(failingSaveStore{inner2}, "FIX.4.4-C-D", registry)
+	require.Nil(t, err)
+
+	// When each operates on its session
+	require.Nil(t, store1.SaveMessage(1, []byte("one")))
+	require.Nil(t, store1.IncrNextSenderMsgSeqNum())
+	_, err = store1.GetMessages(1, 1)
+	require.Nil(t, err)
+	assert.NotNil(t, store2.SaveMessages([]SeqMsg{{SeqNum: 1, Msg: []byte("one")}}))
+
+	// Then they should be recorded by the same collectors, by session and operation
+	i1 := store1.(*instrumentedStore)
+	i2 := store2.(*instrumentedStore)
+	assert.True(t, i1.saved == i2.saved)
+	assert.True(t, i1.durations == i2.durations)
+	assert.Equal(t, 1, testutil.CollectAndCount(i1.saved))
+	assert.Equal(t, 1, testutil.CollectAndCount(i1.read))
+	assert.Equal(t, 1, testutil.CollectAndCount(i1.failures))
+	assert.Equal(t, 4, testutil.CollectAndCount(i1.durations))
+}
@@ -0,0 +1,11 @@
+package msgstore
+
+import "time"
+
+// StoreMetrics receives the latency and outcome of every operation of the stores of a factory, e.g. to alert on slow
+// seqnum persistence before it causes FIX timeouts.  The operations of each backend are listed by WithSQLStoreMetrics
+// and WithMongoMetrics.  err is nil for operations that succeeded.
+// Implementations are shared by the stores of a factory, so must be safe for concurrent use.
+type StoreMetrics interface {
+	ObserveOperation(sessionID, operation string, duration time.Duration, err error)
+}
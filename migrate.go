@@ -0,0 +1,138 @@
+package msgstore
+
+import (
+	"context"
+	"time"
+)
+
+// defaultMigrateBatchSize is the number of messages Migrate saves at a time
+const defaultMigrateBatchSize = 500
+
+// MigrateProgress reports how far Migrate has copied a session
+type MigrateProgress struct {
+	// LastSeqNum is the seqnum up to which the messages have been copied, from which a migration can be resumed with
+	// WithMigrateResumeAfter
+	LastSeqNum int
+	// EndSeqNum is the seqnum up to which the messages are to be copied
+	EndSeqNum int
+	// Copied is the number of messages copied so far by this run
+	Copied int
+}
+
+// MigrateOption configures Migrate
+type MigrateOption func(*migrateOptions)
+
+type migrateOptions struct {
+	batchSize   int
+	progress    func(MigrateProgress)
+	resumeAfter int
+	rate        float64
+}
+
+// WithMigrateBatchSize copies the messages batchSize at a time, each batch in a single SaveMessages, which backends with
+// native batching save in one round trip.  Defaults to 500.
+func WithMigrateBatchSize(batchSize int) MigrateOption {
+	return func(o *migrateOptions) { o.batchSize = batchSize }
+}
+
+// WithMigrateProgress calls progress after each batch is copied
+func WithMigrateProgress(progress func(MigrateProgress)) MigrateOption {
+	return func(o *migrateOptions) { o.progress = progress }
+}
+
+// WithMigrateResumeAfter resumes an interrupted migration, taking the messages up to seqNum, the last LastSeqNum
+// reported to the progress callback, as copied
+func WithMigrateResumeAfter(seqNum int) MigrateOption {
+	return func(o *migrateOptions) { o.resumeAfter = seqNum }
+}
+
+// WithMigrateRateLimit copies at most messagesPerSecond messages a second, pausing between batches, so that a
+// migration does not starve the sessions running against either backend.  Defaults to no limit.
+func WithMigrateRateLimit(messagesPerSecond float64) MigrateOption {
+	return func(o *migrateOptions) { o.rate = messagesPerSecond }
+}
+
+// Migrate copies the messages, then the creation time and seqnums, of the session of src to the session of dst, e.g.
+// from a file store to a postgres one, leaving src as it was.  The messages are streamed in batches rather than held in
+// memory, and messages dst already stores are overwritten according to its DuplicateMessagePolicy.  As the seqnums are
+// copied last, a dst whose seqnums match those of src has been migrated completely.  Neither store must be written to
+// until the migration ends.  Cancelling ctx stops the migration between batches, after which it can be resumed.
+func Migrate(ctx context.Context, src, dst MessageStore, opts ...MigrateOption) error {
+	o := migrateOptions{batchSize: defaultMigrateBatchSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.batchSize < 1 {
+		o.batchSize = 1
+	}
+
+	endSeqNum, err := lastMessageSeqNum(src)
+	if err != nil {
+		return err
+	}
+
+	progress := MigrateProgress{LastSeqNum: o.resumeAfter, EndSeqNum: endSeqNum}
+	start := time.Now()
+	batch := make([]SeqMsg, 0, o.batchSize)
+
+	flush := func(lastSeqNum int) error {
+		if len(batch) > 0 {
+			if err := dst.SaveMessages(batch); err != nil {
+				return err
+			}
+		}
+		progress.LastSeqNum = lastSeqNum
+		progress.Copied += len(batch)
+		batch = batch[:0]
+		if o.progress != nil {
+			o.progress(progress)
+		}
+		return pace(ctx, start, progress.Copied, o.rate)
+	}
+
+	if o.resumeAfter < endSeqNum {
+		save := func(seqNum int, msg []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			batch = append(batch, SeqMsg{SeqNum: seqNum, Msg: msg})
+			if len(batch) < o.batchSize {
+				return nil
+			}
+			return flush(seqNum)
+		}
+		if contextStore, ok := src.(ContextMessageStore); ok {
+			err = contextStore.IterateMessagesContext(ctx, o.resumeAfter+1, endSeqNum, save)
+		} else {
+			err = src.IterateMessages(o.resumeAfter+1, endSeqNum, save)
+		}
+		if err != nil {
+			return err
+		}
+		if err := flush(endSeqNum); err != nil {
+			return err
+		}
+	}
+
+	return copySeqNums(src, dst)
+}
+
+// pace waits until copied messages are no more than rate a second since start, or ctx is done
+func pace(ctx context.Context, start time.Time, copied int, rate float64) error {
+	if rate <= 0 {
+		return ctx.Err()
+	}
+	wait := time.Duration(float64(copied)/rate*float64(time.Second)) - time.Since(start)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,93 @@
+package msgstore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMigrationSource returns a memory store holding msgs messages, sent and received
+func newMigrationSource(t *testing.T, msgs int) MessageStore {
+	src, err := NewMemoryStoreFactory().Create("session")
+	require.Nil(t, err)
+	for seqNum := 1; seqNum <= msgs; seqNum++ {
+		require.Nil(t, src.SaveMessage(seqNum, []byte(fmt.Sprintf("msg%d", seqNum))))
+	}
+	require.Nil(t, src.SetNextSenderMsgSeqNum(msgs+1))
+	require.Nil(t, src.SetNextTargetMsgSeqNum(42))
+	require.Nil(t, src.SetCreationTime(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)))
+	return src
+}
+
+func TestMigrate(t *testing.T) {
+	// Given a session in one store and an empty one
+	src := newMigrationSource(t, 12)
+	dst, _ := NewMemoryStoreFactory().Create("session")
+
+	// When it is migrated in batches
+	var reports []MigrateProgress
+	err := Migrate(context.Background(), src, dst, WithMigrateBatchSize(5), WithMigrateProgress(func(p MigrateProgress) {
+		reports = append(reports, p)
+	}))
+
+	// Then the messages, seqnums and creation time should be copied, with the progress of each batch
+	require.Nil(t, err)
+	srcMsgs, _ := src.GetMessages(1, 12)
+	dstMsgs, err := dst.GetMessages(1, 12)
+	require.Nil(t, err)
+	assert.Equal(t, srcMsgs, dstMsgs)
+	assert.Equal(t, 13, dst.NextSenderMsgSeqNum())
+	assert.Equal(t, 42, dst.NextTargetMsgSeqNum())
+	assert.True(t, src.CreationTime().Equal(dst.CreationTime()))
+	assert.Equal(t, []MigrateProgress{
+		{LastSeqNum: 5, EndSeqNum: 12, Copied: 5},
+		{LastSeqNum: 10, EndSeqNum: 12, Copied: 10},
+		{LastSeqNum: 12, EndSeqNum: 12, Copied: 12},
+	}, reports)
+}
+
+func TestMigrate_Resume(t *testing.T) {
+	// Given a migration cancelled after its first batch
+	src := newMigrationSource(t, 10)
+	dst, _ := NewMemoryStoreFactory().Create("session")
+	ctx, cancel := context.WithCancel(context.Background())
+	var last MigrateProgress
+	err := Migrate(ctx, src, dst, WithMigrateBatchSize(4), WithMigrateProgress(func(p MigrateProgress) {
+		last = p
+		cancel()
+	}))
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, 4, last.LastSeqNum)
+	assert.Equal(t, 1, dst.NextSenderMsgSeqNum())
+
+	// When it is resumed from its last progress
+	var copied int
+	err = Migrate(context.Background(), src, dst, WithMigrateBatchSize(4), WithMigrateResumeAfter(last.LastSeqNum),
+		WithMigrateProgress(func(p MigrateProgress) { copied = p.Copied }))
+
+	// Then only the rest should be copied, completing the migration
+	require.Nil(t, err)
+	assert.Equal(t, 6, copied)
+	dstMsgs, err := dst.GetMessages(1, 10)
+	require.Nil(t, err)
+	assert.Len(t, dstMsgs, 10)
+	assert.Equal(t, 11, dst.NextSenderMsgSeqNum())
+}
+
+func TestMigrate_RateLimit(t *testing.T) {
+	// Given a session of 10 messages
+	src := newMigrationSource(t, 10)
+	dst, _ := NewMemoryStoreFactory().Create("session")
+
+	// When it is migrated at 200 messages a second
+	start := time.Now()
+	err := Migrate(context.Background(), src, dst, WithMigrateBatchSize(2), WithMigrateRateLimit(200))
+
+	// Then it should take at least 50ms
+	require.Nil(t, err)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+}
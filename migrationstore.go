@@ -0,0 +1,324 @@
+package msgstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// MigrationCutover switches the migration stores sharing it from reading the old backend to reading the new one.  It is
+// safe for concurrent use, so a cutover can be triggered by an admin endpoint while sessions are running.
+type MigrationCutover struct {
+	cutOver int32
+}
+
+// CutOver makes the migration stores read from the new backend from now on
+func (c *MigrationCutover) CutOver() {
+	atomic.StoreInt32(&c.cutOver, 1)
+}
+
+// IsCutOver reports whether the migration stores read from the new backend
+func (c *MigrationCutover) IsCutOver() bool {
+	return atomic.LoadInt32(&c.cutOver) == 1
+}
+
+// MigrationDifference is a disagreement between the old and new backends of a migration store, or between the stores
+// compared by Verify
+type MigrationDifference struct {
+	// SeqNum is the seqnum of the differing message, or 0 for differing session seqnums or creation times
+	SeqNum      int
+	Description string
+}
+
+// MigrationVerifier is implemented by migration stores, to check that the new backend holds what the old one does
+// before cutting over
+type MigrationVerifier interface {
+	// VerifyMigration compares the session seqnums and the messages from beginSeqNum to endSeqNum of both backends,
+	// returning the differences found
+	VerifyMigration(beginSeqNum, endSeqNum int) ([]MigrationDifference, error)
+}
+
+type migrationStoreFactory struct {
+	oldFactory, newFactory MessageStoreFactory
+	cutover                *MigrationCutover
+}
+
+type migrationStore struct {
+	oldStore, newStore storeDecorator
+	cutover            *MigrationCutover
+}
+
+// NewMigrationStoreFactory returns a MessageStoreFactory whose stores write to the stores of both oldFactory and
+// newFactory, e.g. mongo and postgres, reading from the old ones until cutover is cut over and from the new ones after,
+// so that sessions can be moved to another backend without downtime.  Writes go to the backend being read first, and
+// fail if either backend fails.  When a store is created before the cutover, the new backend's creation time and
+// seqnums are set to the old one's, and whenever the session is reset the other backend is given the creation time of
+// the one being read; messages saved before dual writing began are not copied, so the cutover should wait until they
+// have left the resend window, and VerifyMigration agrees.
+func NewMigrationStoreFactory(oldFactory, newFactory MessageStoreFactory, cutover *MigrationCutover) MessageStoreFactory {
+	return migrationStoreFactory{oldFactory: oldFactory, newFactory: newFactory, cutover: cutover}
+}
+
+// Create creates a new migration store of the MessageStore interface
+func (f migrationStoreFactory) Create(sessionID string) (MessageStore, error) {
+	oldStore, err := f.oldFactory.Create(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	newStore, err := f.newFactory.Create(sessionID)
+	if err != nil {
+		oldStore.Close()
+		return nil, err
+	}
+
+	store := &migrationStore{oldStore: newStoreDecorator(oldStore), newStore: newStoreDecorator(newStore), cutover: f.cutover}
+	if !f.cutover.IsCutOver() {
+		if err = syncSession(context.Background(), &store.newStore, oldStore); err != nil {
+			oldStore.Close()
+			newStore.Close()
+			return nil, fmt.Errorf("unable to copy seqnums to the new store: %w", err)
+		}
+	}
+	return store, nil
+}
+
+// Close closes both factories, returning the first error
+func (f migrationStoreFactory) Close() error {
+	oldErr := f.oldFactory.Close()
+	if err := f.newFactory.Close(); err != nil && oldErr == nil {
+		return err
+	}
+	return oldErr
+}
+
+// CloneSession copies the session srcID from the backend being read to the session dstID of both backends, see
+// SessionCloner
+func (f migrationStoreFactory) CloneSession(srcID, dstID string) error {
+	return CloneMessageStoreSession(f, srcID, dstID)
+}
+
+// RenameSession moves the session oldID to the session newID in both backends, see SessionRenamer.  Should the new
+// backend fail to rename it, the old backend's rename is rolled back, and should that fail too the error names the
+// backends left holding the session under each ID.
+func (f migrationStoreFactory) RenameSession(oldID, newID string) error {
+	oldRenamer, oldOK := f.oldFactory.(SessionRenamer)
+	newRenamer, newOK := f.newFactory.(SessionRenamer)
+	if !oldOK || !newOK {
+		return errors.New("both backends must be able to rename their sessions")
+	}
+	if err := oldRenamer.RenameSession(oldID, newID); err != nil {
+		return err
+	}
+	err := newRenamer.RenameSession(oldID, newID)
+	if err == nil {
+		return nil
+	}
+	if rollbackErr := oldRenamer.RenameSession(newID, oldID); rollbackErr != nil {
+		return fmt.Errorf("unable to rename session %s to %s in the new backend, which keeps %s while the old backend "+
+			"holds %s, as rolling it back failed: %v: %w", oldID, newID, oldID, newID, rollbackErr, err)
+	}
+	return fmt.Errorf("unable to rename session %s to %s in the new backend, rolled back in the old backend: %w", oldID, newID, err)
+}
+
+// ListSessions lists the sessions of the backend being read, if its factory is a SessionLister
+func (f migrationStoreFactory) ListSessions() ([]SessionInfo, error) {
+	primary := f.oldFactory
+	if f.cutover.IsCutOver() {
+		primary = f.newFactory
+	}
+	lister, ok := primary.(SessionLister)
+	if !ok {
+		return nil, errors.New("the backend being read cannot list its sessions")
+	}
+	return lister.ListSessions()
+}
+
+// stores returns the store being read, followed by the other
+func (store *migrationStore) stores() (primary, secondary *storeDecorator) {
+	if store.cutover.IsCutOver() {
+		return &store.newStore, &store.oldStore
+	}
+	return &store.oldStore, &store.newStore
+}
+
+// write applies op to the store being read and then to the other, failing if either fails
+func (store *migrationStore) write(op func(MessageStore) error) error {
+	primary, secondary := store.stores()
+	return writeBoth(primary, secondary, func(d *storeDecorator) error { return op(d.inner) }, func(err error) error { return err })
+}
+
+func (store *migrationStore) NextSenderMsgSeqNum() int {
+	primary, _ := store.stores()
+	return primary.inner.NextSenderMsgSeqNum()
+}
+
+func (store *migrationStore) NextTargetMsgSeqNum() int {
+	primary, _ := store.stores()
+	return primary.inner.NextTargetMsgSeqNum()
+}
+
+func (store *migrationStore) IncrNextSenderMsgSeqNum() error {
+	return store.write(func(s MessageStore) error { return s.IncrNextSenderMsgSeqNum() })
+}
+
+func (store *migrationStore) IncrNextTargetMsgSeqNum() error {
+	return store.write(func(s MessageStore) error { return s.IncrNextTargetMsgSeqNum() })
+}
+
+func (store *migrationStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.write(func(s MessageStore) error { return s.SetNextSenderMsgSeqNum(next) })
+}
+
+func (store *migrationStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.write(func(s MessageStore) error { return s.SetNextTargetMsgSeqNum(next) })
+}
+
+func (store *migrationStore) CreationTime() time.Time {
+	primary, _ := store.stores()
+	return primary.inner.CreationTime()
+}
+
+func (store *migrationStore) SetCreationTime(t time.Time) error {
+	return store.write(func(s MessageStore) error { return s.SetCreationTime(t) })
+}
+
+func (store *migrationStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.write(func(s MessageStore) error { return s.SaveMessage(seqNum, msg) })
+}
+
+func (store *migrationStore) SaveMessages(msgs []SeqMsg) error {
+	return store.write(func(s MessageStore) error { return s.SaveMessages(msgs) })
+}
+
+func (store *migrationStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	primary, _ := store.stores()
+	return primary.inner.GetMessages(beginSeqNum, endSeqNum)
+}
+
+func (store *migrationStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	primary, _ := store.stores()
+	return primary.inner.GetMessagesSince(seqNum)
+}
+
+func (store *migrationStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	primary, _ := store.stores()
+	return primary.inner.GetMessagesDescending(beginSeqNum, endSeqNum)
+}
+
+func (store *migrationStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	primary, _ := store.stores()
+	return primary.inner.GetMessage(seqNum)
+}
+
+func (store *migrationStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	primary, _ := store.stores()
+	return primary.inner.IterateMessages(beginSeqNum, endSeqNum, fn)
+}
+
+func (store *migrationStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	primary, _ := store.stores()
+	return primary.inner.StreamMessages(ctx, beginSeqNum, endSeqNum)
+}
+
+// BeginTx starts a transaction buffered until Commit, which writes to both stores like the store's other writes, see
+// BeginBufferedTx
+func (store *migrationStore) BeginTx() (StoreTx, error) {
+	return BeginBufferedTx(store), nil
+}
+
+func (store *migrationStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.write(func(s MessageStore) error { return s.DeleteMessagesUpTo(seqNum) })
+}
+
+// Backup writes the session of the store being read to w
+func (store *migrationStore) Backup(w io.Writer) error {
+	primary, _ := store.stores()
+	return primary.inner.Backup(w)
+}
+
+// Restore restores the archive into the migration store, and so into both backends
+func (store *migrationStore) Restore(r io.Reader) error {
+	return RestoreMessageStore(store, r)
+}
+
+func (store *migrationStore) HealthCheck(ctx context.Context) error {
+	return store.write(func(s MessageStore) error { return s.HealthCheck(ctx) })
+}
+
+func (store *migrationStore) Flush() error {
+	return store.write(func(s MessageStore) error { return s.Flush() })
+}
+
+func (store *migrationStore) Refresh() error {
+	return store.write(func(s MessageStore) error { return s.Refresh() })
+}
+
+// Reset resets both backends, and then gives the other the new creation time of the backend being read
+func (store *migrationStore) Reset() error {
+	if err := store.write(func(s MessageStore) error { return s.Reset() }); err != nil {
+		return err
+	}
+	primary, secondary := store.stores()
+	return syncSession(context.Background(), secondary, primary.inner)
+}
+
+// Close closes both stores, returning the first error
+func (store *migrationStore) Close() error {
+	oldErr := store.oldStore.inner.Close()
+	if newErr := store.newStore.inner.Close(); oldErr == nil {
+		return newErr
+	}
+	return oldErr
+}
+
+// VerifyMigration compares both backends, see MigrationVerifier.  Each backend is refreshed first, so that the
+// comparison is of what they have persisted.
+func (store *migrationStore) VerifyMigration(beginSeqNum, endSeqNum int) ([]MigrationDifference, error) {
+	if err := store.Refresh(); err != nil {
+		return nil, err
+	}
+
+	var differences []MigrationDifference
+	if oldNext, newNext := store.oldStore.inner.NextSenderMsgSeqNum(), store.newStore.inner.NextSenderMsgSeqNum(); oldNext != newNext {
+		differences = append(differences, MigrationDifference{Description: fmt.Sprintf("next sender seqnum is %d in the old store, %d in the new", oldNext, newNext)})
+	}
+	if oldNext, newNext := store.oldStore.inner.NextTargetMsgSeqNum(), store.newStore.inner.NextTargetMsgSeqNum(); oldNext != newNext {
+		differences = append(differences, MigrationDifference{Description: fmt.Sprintf("next target seqnum is %d in the old store, %d in the new", oldNext, newNext)})
+	}
+
+	oldMsgs, err := seqMsgsInRange(store.oldStore.inner, beginSeqNum, endSeqNum)
+	if err != nil {
+		return nil, err
+	}
+	newMsgs, err := seqMsgsInRange(store.newStore.inner, beginSeqNum, endSeqNum)
+	if err != nil {
+		return nil, err
+	}
+	for seqNum := beginSeqNum; seqNum <= endSeqNum; seqNum++ {
+		oldMsg, inOld := oldMsgs[seqNum]
+		newMsg, inNew := newMsgs[seqNum]
+		switch {
+		case inOld && !inNew:
+			differences = append(differences, MigrationDifference{SeqNum: seqNum, Description: "message missing from the new store"})
+		case inNew && !inOld:
+			differences = append(differences, MigrationDifference{SeqNum: seqNum, Description: "message missing from the old store"})
+		case inOld && !bytes.Equal(oldMsg, newMsg):
+			differences = append(differences, MigrationDifference{SeqNum: seqNum, Description: "message differs between the stores"})
+		}
+	}
+	return differences, nil
+}
+
+// seqMsgsInRange returns a store's messages in the range by seqnum
+func seqMsgsInRange(store MessageStore, beginSeqNum, endSeqNum int) (map[int][]byte, error) {
+	msgs := make(map[int][]byte)
+	err := store.IterateMessages(beginSeqNum, endSeqNum, func(seqNum int, msg []byte) error {
+		msgs[seqNum] = msg
+		return nil
+	})
+	return msgs, err
+}
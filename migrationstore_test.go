@@ -0,0 +1,127 @@
+package msgstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// MigrationStoreTestSuite runs all tests in the MessageStoreTestSuite against the migration store
+type MigrationStoreTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *MigrationStoreTestSuite) SetupTest() {
+	store, err := NewMigrationStoreFactory(NewMemoryStoreFactory(), NewMemoryStoreFactory(), &MigrationCutover{}).Create("session")
+	require.Nil(suite.T(), err)
+	suite.msgStore = store
+}
+
+func TestMigrationStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(MigrationStoreTestSuite))
+}
+
+// sessionFactory creates its one store for every session, so that tests can see what a migration store has written
+type sessionFactory struct {
+	store MessageStore
+}
+
+func (f sessionFactory) Create(sessionID string) (MessageStore, error) {
+	return f.store, nil
+}
+
+func (f sessionFactory) Close() error {
+	return nil
+}
+
+func TestMigrationStore_Cutover(t *testing.T) {
+	// Given an old backend holding a session, and an empty new one
+	oldStore, _ := NewMemoryStoreFactory().Create("session")
+	newStore, _ := NewMemoryStoreFactory().Create("session")
+	require.Nil(t, oldStore.SetNextSenderMsgSeqNum(10))
+	require.Nil(t, oldStore.SetNextTargetMsgSeqNum(20))
+	require.Nil(t, oldStore.SetCreationTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	// When a migration store is created
+	cutover := &MigrationCutover{}
+	store, err := NewMigrationStoreFactory(sessionFactory{oldStore}, sessionFactory{newStore}, cutover).Create("session")
+	require.Nil(t, err)
+
+	// Then the new backend should be given the old one's creation time and seqnums
+	assert.True(t, oldStore.CreationTime().Equal(newStore.CreationTime()))
+	assert.Equal(t, 10, newStore.NextSenderMsgSeqNum())
+	assert.Equal(t, 20, newStore.NextTargetMsgSeqNum())
+
+	// And writes should go to both
+	require.Nil(t, store.SaveMessage(10, []byte("ten")))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	assert.Equal(t, 11, oldStore.NextSenderMsgSeqNum())
+	assert.Equal(t, 11, newStore.NextSenderMsgSeqNum())
+	differences, err := store.(MigrationVerifier).VerifyMigration(1, 10)
+	require.Nil(t, err)
+	assert.Empty(t, differences)
+
+	// When the backends disagree
+	require.Nil(t, oldStore.SaveMessage(9, []byte("nine")))
+	require.Nil(t, newStore.SaveMessage(10, []byte("TEN")))
+	require.Nil(t, newStore.IncrNextTargetMsgSeqNum())
+
+	// Then the verification should report it
+	differences, err = store.(MigrationVerifier).VerifyMigration(1, 10)
+	require.Nil(t, err)
+	assert.Equal(t, []MigrationDifference{
+		{Description: "next target seqnum is 20 in the old store, 21 in the new"},
+		{SeqNum: 9, Description: "message missing from the new store"},
+		{SeqNum: 10, Description: "message differs between the stores"},
+	}, differences)
+
+	// And reads should come from the old backend until the cutover
+	msgs, err := store.GetMessages(10, 10)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("ten")}, msgs)
+	assert.Equal(t, 20, store.NextTargetMsgSeqNum())
+
+	cutover.CutOver()
+	msgs, err = store.GetMessages(10, 10)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("TEN")}, msgs)
+	assert.Equal(t, 21, store.NextTargetMsgSeqNum())
+}
+
+// failingRenamer is a factory whose renames fail
+type failingRenamer struct {
+	MessageStoreFactory
+}
+
+func (f failingRenamer) RenameSession(oldID, newID string) error {
+	return errors.New("rename failed")
+}
+
+func TestMigrationStoreFactory_RenameSessionRollsBack(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("MigrationRenameSession-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+
+	// Given an old file backend holding a session, and a new backend whose renames fail
+	oldFactory := NewFileStoreFactory(map[string]string{FileStorePath: rootPath})
+	store, err := oldFactory.Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	require.Nil(t, store.Close())
+	factory := NewMigrationStoreFactory(oldFactory, failingRenamer{NewMemoryStoreFactory()}, &MigrationCutover{})
+
+	// When the session is renamed
+	err = factory.(SessionRenamer).RenameSession("FIX.4.4-SENDER-TARGET", "FIX.4.4-SENDER-NEWTARGET")
+
+	// Then it should fail, leaving the old backend's session under its old ID
+	assert.EqualError(t, err, "unable to rename session FIX.4.4-SENDER-TARGET to FIX.4.4-SENDER-NEWTARGET in the new backend, rolled back in the old backend: rename failed")
+	sessions, err := oldFactory.(SessionLister).ListSessions()
+	require.Nil(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "FIX.4.4-SENDER-TARGET", sessions[0].SessionID)
+}
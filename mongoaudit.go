@@ -0,0 +1,42 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// WithMongoCreationTimeAudit makes Refresh compare the store's creation time with the stored session's before reloading,
+// failing with an error wrapping a *CreationTimeMismatchError and leaving the store as it was if they differ, rather than
+// silently adopting the stored state.  A new store must be created to adopt it.  Defaults to adopting the stored state.
+func WithMongoCreationTimeAudit() MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.auditCreationTime = true }
+}
+
+// WithMongoConflictDetection makes Refresh fail with an error matching ErrExternallyModified if the stored seqnums moved
+// backward or the creation time changed since the store last loaded or wrote them, leaving the store as it was rather
+// than adopting them.  Unlike WithMongoCreationTimeAudit, it checks the state the store reloaded, so it catches seqnums
+// moved backward without a reset.
+func WithMongoConflictDetection() MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.detectConflicts = true }
+}
+
+// auditCreationTime checks the stored session's creation time against the store's.  BSON dates hold milliseconds, so
+// the store's is compared at that precision.
+func (store *mongoStore) auditCreationTime(ctx context.Context) error {
+	var session sessionData
+	err := store.sessionsCollection.FindOne(ctx, store.sessionFilter()).Decode(&session)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// a missing document is recreated from the store by populateCache
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if cached := store.creationTime.Truncate(time.Millisecond); !cached.Equal(session.CreationTime) {
+		return &CreationTimeMismatchError{SessionID: store.sessionID, Cached: cached, Stored: session.CreationTime}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package msgstore
+
+import (
+	"errors"
+	"time"
+)
+
+func (s *MongoStoreSuite) TestMongoStore_CreationTimeAudit() {
+	// Given an audited store with seqnums
+	factory := NewMongoStoreFactory(s.mongoCxn, "automated_testing_mongostore", WithMongoCreationTimeAudit())
+	store, err := factory.Create(s.sessionID)
+	s.Require().Nil(err)
+	defer store.Close()
+	s.Require().Nil(store.Reset())
+	s.Require().Nil(store.SetNextSenderMsgSeqNum(5))
+	s.Require().Nil(store.Refresh())
+
+	// When the session is reset by another store
+	time.Sleep(10 * time.Millisecond)
+	s.Require().Nil(s.msgStore.Reset())
+
+	// Then Refresh should report the changed creation time
+	err = store.Refresh()
+	var mismatch *CreationTimeMismatchError
+	s.Require().True(errors.As(err, &mismatch), "unexpected error: %v", err)
+	s.True(errors.Is(err, ErrExternallyModified))
+	s.WithinDuration(s.msgStore.CreationTime(), mismatch.Stored, time.Millisecond)
+
+	// And leave the store as it was
+	s.Equal(5, store.NextSenderMsgSeqNum())
+
+	// And a new store should adopt the stored session
+	adopted, err := factory.Create(s.sessionID)
+	s.Require().Nil(err)
+	defer adopted.Close()
+	s.Require().Nil(adopted.Refresh())
+	s.Equal(1, adopted.NextSenderMsgSeqNum())
+}
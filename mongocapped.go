@@ -0,0 +1,90 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoNamespaceExists is the server error code for creating a collection that exists
+const mongoNamespaceExists = 48
+
+// mongoCappedMessages bounds a capped messages collection
+type mongoCappedMessages struct {
+	sizeInBytes  int64
+	maxDocuments int64
+}
+
+// WithMongoCappedMessages creates the messages collection as a capped collection of at most sizeInBytes, and of at most
+// maxDocuments messages unless it is 0, from which the server evicts the oldest messages of any session as new ones
+// are saved.  It suits sessions needing only a bounded resend window, with resends of evicted messages gap filled.
+// An existing messages collection must already be capped, e.g. with convertToCapped.  Deleting from a capped collection,
+// as Reset does, requires MongoDB 5.0 or later, and capped collections can neither be sharded nor expire messages by
+// TTL.  Defaults to an uncapped collection.
+func WithMongoCappedMessages(sizeInBytes, maxDocuments int64) MongoStoreOption {
+	return func(f *mongoStoreFactory) {
+		f.cappedMessages = &mongoCappedMessages{sizeInBytes: sizeInBytes, maxDocuments: maxDocuments}
+	}
+}
+
+// checkCappedMessages rejects capped collection settings that the server would refuse or that other options conflict with
+func checkCappedMessages(f mongoStoreFactory) error {
+	if f.cappedMessages == nil {
+		return nil
+	}
+	switch {
+	case f.cappedMessages.sizeInBytes <= 0:
+		return fmt.Errorf("capped messages size must be positive, not %d", f.cappedMessages.sizeInBytes)
+	case f.shardKey != "":
+		return errors.New("capped messages cannot be sharded")
+	case f.messageTTL > 0:
+		return errors.New("capped messages cannot expire by TTL")
+	case f.compatibility == MongoCompatibilityDocumentDB:
+		return errors.New("capped messages are not supported in documentdb compatibility mode")
+	}
+	return nil
+}
+
+// ensureCappedMessages creates the capped messages collection, or checks that the existing one is capped
+func (store *mongoStore) ensureCappedMessages(ctx context.Context, capped *mongoCappedMessages) error {
+	if capped == nil {
+		return nil
+	}
+
+	opts := options.CreateCollection().SetCapped(true).SetSizeInBytes(capped.sizeInBytes)
+	if capped.maxDocuments > 0 {
+		opts.SetMaxDocuments(capped.maxDocuments)
+	}
+	db := store.messagesCollection.Database()
+	err := db.CreateCollection(ctx, store.messagesCollection.Name(), opts)
+	if cmdErr, ok := err.(mongo.CommandError); !ok || cmdErr.Code != mongoNamespaceExists {
+		if err != nil {
+			return fmt.Errorf("unable to create capped messages collection: %w", err)
+		}
+		return nil
+	}
+
+	var listed struct {
+		Cursor struct {
+			FirstBatch []struct {
+				Options struct {
+					Capped bool `bson:"capped"`
+				} `bson:"options"`
+			} `bson:"firstBatch"`
+		} `bson:"cursor"`
+	}
+	if err = db.RunCommand(ctx, bson.D{
+		{Key: "listCollections", Value: 1},
+		{Key: "filter", Value: bson.M{"name": store.messagesCollection.Name()}},
+	}).Decode(&listed); err != nil {
+		return fmt.Errorf("unable to inspect messages collection: %w", err)
+	}
+	if len(listed.Cursor.FirstBatch) == 0 || !listed.Cursor.FirstBatch[0].Options.Capped {
+		return fmt.Errorf("messages collection %s exists and is not capped", store.messagesCollection.Name())
+	}
+	return nil
+}
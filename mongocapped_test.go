@@ -0,0 +1,46 @@
+package msgstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckCappedMessages(t *testing.T) {
+	factory := func(opts ...MongoStoreOption) mongoStoreFactory {
+		return NewMongoStoreFactory("mongodb://localhost:27017", "db", opts...).(mongoStoreFactory)
+	}
+
+	assert.Nil(t, checkCappedMessages(factory()))
+	assert.Nil(t, checkCappedMessages(factory(WithMongoCappedMessages(1<<20, 0))))
+	assert.NotNil(t, checkCappedMessages(factory(WithMongoCappedMessages(0, 1000))))
+	assert.NotNil(t, checkCappedMessages(factory(WithMongoCappedMessages(1<<20, 0), WithMongoMessageTTL(time.Hour))))
+	assert.NotNil(t, checkCappedMessages(factory(WithMongoCappedMessages(1<<20, 0), WithMongoShardKey(MongoShardKeyHashedSessionID))))
+	assert.NotNil(t, checkCappedMessages(factory(WithMongoCappedMessages(1<<20, 0), WithMongoCompatibility(MongoCompatibilityDocumentDB))))
+}
+
+func (s *MongoStoreSuite) TestMongoStore_CappedMessages() {
+	// Given a store of a session with its own capped collection of three messages
+	store, err := NewMongoStoreFactory(s.mongoCxn, "automated_testing_mongostore",
+		WithMongoSessionCollectionPrefix("capped_"), WithMongoCappedMessages(1<<20, 3)).Create(s.sessionID)
+	s.Require().Nil(err)
+	defer store.Close()
+	defer store.(*mongoStore).messagesCollection.Drop(context.Background())
+
+	// When more messages are saved than it holds
+	for seqNum := 1; seqNum <= 5; seqNum++ {
+		s.Require().Nil(store.SaveMessage(seqNum, []byte("msg")))
+	}
+
+	// Then only the newest should be kept
+	msgs, err := store.GetMessages(1, 5)
+	s.Require().Nil(err)
+	s.Len(msgs, 3)
+
+	// And a store on an uncapped collection should be refused
+	s.Require().Nil(s.msgStore.SaveMessage(1, []byte("msg")))
+	_, err = NewMongoStoreFactory(s.mongoCxn, "automated_testing_mongostore", WithMongoCappedMessages(1<<20, 3)).Create(s.sessionID)
+	s.NotNil(err)
+}
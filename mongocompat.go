@@ -0,0 +1,77 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MongoCompatibility selects a service that implements a subset of the MongoDB API, so that the mongo store avoids the
+// features the service lacks
+type MongoCompatibility string
+
+const (
+	// MongoCompatibilityDocumentDB targets Amazon DocumentDB
+	MongoCompatibilityDocumentDB MongoCompatibility = "documentdb"
+	// MongoCompatibilityCosmosDB targets Azure Cosmos DB for MongoDB
+	MongoCompatibilityCosmosDB MongoCompatibility = "cosmosdb"
+)
+
+// ErrMongoChangeStreamsUnsupported is returned by WatchSession when the server was found not to support change streams
+var ErrMongoChangeStreamsUnsupported = errors.New("change streams are not supported by the mongo server")
+
+// WithMongoCompatibility makes the stores work against a service implementing a subset of the MongoDB API:
+//
+// Retryable writes are disabled.  The TTL index of WithMongoMessageTTL is recreated rather than modified when its
+// retention changes, and on Cosmos DB it is kept on the service's _ts timestamp rather than stored_at.  WithMongoShardKey
+// is refused, as the services manage sharding themselves.  When a store is created the server is probed, and should it
+// lack transactions SaveMessageAndIncrNextSenderMsgSeqNum falls back to separate writes and BeginTx to buffered
+// transactions, while should it lack change streams WatchSession returns ErrMongoChangeStreamsUnsupported.  Defaults to a
+// genuine MongoDB deployment.
+func WithMongoCompatibility(compatibility MongoCompatibility) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.compatibility = compatibility }
+}
+
+// mongoCapabilities records which optional server features a store may use
+type mongoCapabilities struct {
+	transactions  bool
+	changeStreams bool
+}
+
+// allMongoCapabilities is assumed of genuine MongoDB deployments, which report failures as the features are used
+var allMongoCapabilities = mongoCapabilities{transactions: true, changeStreams: true}
+
+// checkMongoCompatibility rejects options that the compatibility mode cannot honor
+func checkMongoCompatibility(f mongoStoreFactory) error {
+	switch f.compatibility {
+	case "":
+		return nil
+	case MongoCompatibilityDocumentDB, MongoCompatibilityCosmosDB:
+		if f.shardKey != "" {
+			return fmt.Errorf("shard keys cannot be set in %s compatibility mode", f.compatibility)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown mongo compatibility: %s", f.compatibility)
+}
+
+// probeCapabilities asks the server which optional features it supports.  Both transactions and change streams need a
+// replica set or a sharded cluster, from wire versions 7 and 6 respectively.
+func (store *mongoStore) probeCapabilities(ctx context.Context) (mongoCapabilities, error) {
+	var hello struct {
+		SetName        string `bson:"setName"`
+		Msg            string `bson:"msg"`
+		MaxWireVersion int    `bson:"maxWireVersion"`
+	}
+	if err := store.client.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello); err != nil {
+		return mongoCapabilities{}, fmt.Errorf("unable to probe server capabilities: %w", err)
+	}
+
+	replicated := hello.SetName != "" || hello.Msg == "isdbgrid"
+	return mongoCapabilities{
+		transactions:  replicated && hello.MaxWireVersion >= 7,
+		changeStreams: replicated && hello.MaxWireVersion >= 6,
+	}, nil
+}
@@ -0,0 +1,48 @@
+package msgstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMongoStoreFactory_Compatibility(t *testing.T) {
+	// Given a factory in DocumentDB compatibility mode
+	f := NewMongoStoreFactory("mongodb://localhost:27017", "db", WithMongoCompatibility(MongoCompatibilityDocumentDB)).(mongoStoreFactory)
+
+	// Then retryable writes should be disabled
+	require.Nil(t, checkMongoCompatibility(f))
+	opts, err := f.clientOptions()
+	require.Nil(t, err)
+	require.NotNil(t, opts.RetryWrites)
+	assert.False(t, *opts.RetryWrites)
+
+	// And a factory without it should enable them
+	opts, err = NewMongoStoreFactory("mongodb://localhost:27017", "db").(mongoStoreFactory).clientOptions()
+	require.Nil(t, err)
+	require.NotNil(t, opts.RetryWrites)
+	assert.True(t, *opts.RetryWrites)
+
+	// When sharding is also asked for
+	f = NewMongoStoreFactory("mongodb://localhost:27017", "db", WithMongoCompatibility(MongoCompatibilityCosmosDB),
+		WithMongoShardKey(MongoShardKeyHashedSessionID)).(mongoStoreFactory)
+
+	// Then the factory should be refused
+	assert.NotNil(t, checkMongoCompatibility(f))
+	_, err = f.Create("session")
+	assert.NotNil(t, err)
+
+	// And an unknown mode should be refused too
+	assert.NotNil(t, checkMongoCompatibility(NewMongoStoreFactory("mongodb://localhost:27017", "db", WithMongoCompatibility("dynamodb")).(mongoStoreFactory)))
+}
+
+func TestMongoStore_WatchSessionWithoutChangeStreams(t *testing.T) {
+	// Given a store on a server found to lack change streams
+	store := &mongoStore{capabilities: mongoCapabilities{transactions: true}}
+
+	// Then watching should fail up front
+	err := store.WatchSession(context.Background(), nil, func(MongoSessionEvent) error { return nil })
+	assert.Equal(t, ErrMongoChangeStreamsUnsupported, err)
+}
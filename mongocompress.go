@@ -0,0 +1,14 @@
+package msgstore
+
+// WithMongoMessageCompression zstd compresses each message before it is saved, cutting the storage and replication
+// bandwidth of verbose sessions severalfold.  Compressed messages are marked by a leading byte, so messages saved
+// without compression, before or after it is turned on, are still read as is.  Defaults to no compression.
+func WithMongoMessageCompression() MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.compressMessages = true }
+}
+
+// WithMongoRecordSerializer saves each message as a record wrapped by serializer in an envelope carrying its metadata,
+// before compressing it as configured, see RecordSerializer
+func WithMongoRecordSerializer(serializer RecordSerializer) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.serializer = serializer }
+}
@@ -0,0 +1,53 @@
+package msgstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMongoStore_NewMessageDataCompression(t *testing.T) {
+	msg := []byte("8=FIX.4.4\x019=5\x0135=0\x0110=000\x01")
+
+	// messages are saved as is by default
+	store := &mongoStore{sessionID: "session"}
+	data, err := store.newMessageData(1, msg)
+	require.Nil(t, err)
+	assert.Equal(t, msg, data.Message)
+
+	// and compressed behind the marker with compression on
+	store.compressMessages = true
+	data, err = store.newMessageData(1, msg)
+	require.Nil(t, err)
+	compressed := data.Message
+	assert.Equal(t, zstdMessageMarker, compressed[0])
+	decoded, err := decompressMessage(compressed)
+	require.Nil(t, err)
+	assert.Equal(t, msg, decoded)
+}
+
+func (s *MongoStoreSuite) TestMongoStore_MessageCompression() {
+	// Given a message saved before compression was turned on
+	s.Require().Nil(s.msgStore.Reset())
+	s.Require().Nil(s.msgStore.SaveMessage(1, []byte("8=FIX.4.4\x0135=D\x01")))
+
+	// When a message is saved with compression on
+	store, err := NewMongoStoreFactory(s.mongoCxn, "automated_testing_mongostore", WithMongoMessageCompression()).Create(s.sessionID)
+	s.Require().Nil(err)
+	defer store.Close()
+	s.Require().Nil(store.SaveMessage(2, []byte("8=FIX.4.4\x0135=8\x01")))
+
+	// Then it should be stored compressed
+	var stored messageData
+	s.Require().Nil(store.(*mongoStore).messagesCollection.FindOne(context.Background(),
+		bson.M{"session_id": s.sessionID, "msg_seq_num": 2}).Decode(&stored))
+	s.Equal(zstdMessageMarker, stored.Message[0])
+
+	// And both messages should be read as saved
+	msgs, err := store.GetMessages(1, 2)
+	s.Require().Nil(err)
+	s.Equal([][]byte{[]byte("8=FIX.4.4\x0135=D\x01"), []byte("8=FIX.4.4\x0135=8\x01")}, msgs)
+}
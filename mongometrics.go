@@ -0,0 +1,54 @@
+package msgstore
+
+import "time"
+
+// MongoStoreLogger receives the slow operation reports of the mongo stores.  *log.Logger implements it.
+type MongoStoreLogger interface {
+	Printf(format string, v ...interface{})
+}
+
+// WithMongoMetrics reports the latency and outcome of every operation of the factory's stores to metrics, through the
+// same interface as the sql stores so that one implementation, e.g. NewPrometheusStoreMetrics, can serve both.
+// The operations are "reset", "refresh", "set_next_sender_seqnum", "set_next_target_seqnum", "set_creation_time",
+// "save_message", "save_messages", "save_message_and_incr_next_sender_seqnum", "get_message", "get_messages",
+// "iterate_messages", "message_count", "first_seqnum", "last_seqnum", "delete_messages", "set_session_value",
+// "get_session_value", "health_check" and "list_sessions"; the Incr seqnum methods report as their Set counterparts.
+func WithMongoMetrics(metrics StoreMetrics) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.metrics = metrics }
+}
+
+// WithMongoSlowOperationLog logs every operation of the factory's stores that takes threshold or longer to logger,
+// along with its session and outcome.  Defaults to logging nothing.
+func WithMongoSlowOperationLog(logger MongoStoreLogger, threshold time.Duration) MongoStoreOption {
+	return func(f *mongoStoreFactory) {
+		f.slowLogger = logger
+		f.slowThreshold = threshold
+	}
+}
+
+// observe reports an operation started at start to the store's metrics and slow operation log, if any, and then wraps
+// its error in a StoreError.  It is deferred by each operation with a pointer to its named error result, so that the
+// outcome is known when it is called.
+func (store *mongoStore) observe(operation string, start time.Time, err *error) {
+	store.observeSeqNum(operation, 0, start, err)
+}
+
+// observeSeqNum is like observe, for the operations on the message of seqNum
+func (store *mongoStore) observeSeqNum(operation string, seqNum int, start time.Time, err *error) {
+	defer wrapStoreError("mongo", store.sessionID, operation, seqNum, err)
+	if store.metrics == nil && store.slowLogger == nil {
+		return
+	}
+
+	duration := time.Since(start)
+	if store.metrics != nil {
+		store.metrics.ObserveOperation(store.sessionID, operation, duration, *err)
+	}
+	if store.slowLogger != nil && duration >= store.slowThreshold {
+		if *err != nil {
+			store.slowLogger.Printf("msgstore: slow mongo %s of session %s took %s and failed: %s", operation, store.sessionID, duration, (*err).Error())
+		} else {
+			store.slowLogger.Printf("msgstore: slow mongo %s of session %s took %s", operation, store.sessionID, duration)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package msgstore
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMongoStore_Observe(t *testing.T) {
+	var logged bytes.Buffer
+	metrics := &recordingStoreMetrics{}
+	store := &mongoStore{sessionID: "FIX.4.4-SENDER-TARGET", metrics: metrics, slowLogger: log.New(&logged, "", 0), slowThreshold: time.Hour}
+
+	// When a fast operation succeeds
+	var err error
+	store.observe("save_message", time.Now(), &err)
+
+	// Then it should be reported to the metrics, but not logged
+	assert.Equal(t, []recordedOperation{{"FIX.4.4-SENDER-TARGET", "save_message", nil}}, metrics.operations)
+	assert.Empty(t, logged.String())
+
+	// When an operation fails after taking longer than the threshold
+	cause := errors.New("primary stepped down")
+	err = cause
+	store.observe("reset", time.Now().Add(-2*time.Hour), &err)
+
+	// Then it should be logged with its outcome too
+	assert.Equal(t, recordedOperation{"FIX.4.4-SENDER-TARGET", "reset", cause}, metrics.operations[1])
+	assert.Contains(t, logged.String(), "slow mongo reset of session FIX.4.4-SENDER-TARGET")
+	assert.Contains(t, logged.String(), "primary stepped down")
+
+	// And its error should be wrapped with where it failed
+	assert.Equal(t, &StoreError{Backend: "mongo", SessionID: "FIX.4.4-SENDER-TARGET", Op: "reset", Err: cause}, err)
+
+	// And a store with neither should observe nothing
+	(&mongoStore{}).observe("reset", time.Now(), &err)
+}
@@ -0,0 +1,44 @@
+package msgstore
+
+import (
+	"strings"
+)
+
+// MongoSessionIDPlaceholder is replaced by the sessionID in the templates of WithMongoSessionDatabase and
+// WithMongoSessionCollectionPrefix
+const MongoSessionIDPlaceholder = "{sessionID}"
+
+// mongoDatabaseNameReplacer replaces the characters that cannot appear in a database name
+var mongoDatabaseNameReplacer = strings.NewReplacer("/", "_", "\\", "_", ".", "_", " ", "_", "\"", "_", "$", "_",
+	"*", "_", "<", "_", ">", "_", ":", "_", "|", "_", "?", "_")
+
+// mongoCollectionNameReplacer replaces the characters that cannot appear in a collection name
+var mongoCollectionNameReplacer = strings.NewReplacer("$", "_", "\x00", "_")
+
+// WithMongoSessionDatabase stores each session in its own database, named by replacing MongoSessionIDPlaceholder in
+// template with the sessionID, e.g. "fix_{sessionID}", in place of the factory's dbName.  Characters that database names
+// cannot hold, such as the ':' and '>' of FIX session IDs, are replaced with '_', so sessionIDs differing only in
+// those characters share a database.  Database names are limited to 64 bytes.
+func WithMongoSessionDatabase(template string) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.sessionDatabase = template }
+}
+
+// WithMongoSessionCollectionPrefix stores each session in its own collections, named by replacing
+// MongoSessionIDPlaceholder in template with the sessionID, e.g. "{sessionID}_", and prefixing the result, after the
+// factory's table prefix, to the collection names.  Each session's collections can then be dropped, or given a
+// retention, independently of the others.
+func WithMongoSessionCollectionPrefix(template string) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.sessionCollections = template }
+}
+
+// sessionNamespace returns the database and the collection prefix holding the session
+func (f mongoStoreFactory) sessionNamespace(sessionID string) (dbName, collectionPrefix string) {
+	dbName, collectionPrefix = f.dbName, f.tablePrefix
+	if f.sessionDatabase != "" {
+		dbName = strings.Replace(f.sessionDatabase, MongoSessionIDPlaceholder, mongoDatabaseNameReplacer.Replace(sessionID), -1)
+	}
+	if f.sessionCollections != "" {
+		collectionPrefix += strings.Replace(f.sessionCollections, MongoSessionIDPlaceholder, mongoCollectionNameReplacer.Replace(sessionID), -1)
+	}
+	return dbName, collectionPrefix
+}
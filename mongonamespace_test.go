@@ -0,0 +1,33 @@
+package msgstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMongoStoreFactory_SessionNamespace(t *testing.T) {
+	// Given a factory sharing its database and collections among sessions
+	f := NewMongoStoreFactoryWithTablePrefix("mongodb://localhost:27017", "db", "fix_").(mongoStoreFactory)
+
+	// Then every session should be stored in them
+	dbName, prefix := f.sessionNamespace("FIX.4.2:SENDER->TARGET")
+	assert.Equal(t, "db", dbName)
+	assert.Equal(t, "fix_", prefix)
+
+	// When each session is given its own database
+	f = NewMongoStoreFactoryWithTablePrefix("mongodb://localhost:27017", "db", "fix_", WithMongoSessionDatabase("tenant_{sessionID}")).(mongoStoreFactory)
+
+	// Then it should be named for the session, without the characters database names cannot hold
+	dbName, prefix = f.sessionNamespace("FIX.4.2:SENDER->TARGET")
+	assert.Equal(t, "tenant_FIX_4_2_SENDER-_TARGET", dbName)
+	assert.Equal(t, "fix_", prefix)
+
+	// When each session is given its own collections instead
+	f = NewMongoStoreFactoryWithTablePrefix("mongodb://localhost:27017", "db", "fix_", WithMongoSessionCollectionPrefix("{sessionID}.")).(mongoStoreFactory)
+
+	// Then they should be prefixed with the session after the table prefix
+	dbName, prefix = f.sessionNamespace("FIX.4.2:SENDER->TARGET")
+	assert.Equal(t, "db", dbName)
+	assert.Equal(t, "fix_FIX.4.2:SENDER->TARGET.", prefix)
+}
@@ -0,0 +1,102 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultMongoPurgeBatchSize is the span of seqnums each delete of a purge covers
+const defaultMongoPurgeBatchSize = 1000
+
+// MongoMessagePurger is implemented by the mongo stores, so that operators can reclaim the space of old messages
+// without a full Reset.  The seqnums are left untouched, so resend requests for purged messages are gap filled.
+type MongoMessagePurger interface {
+	// DeleteMessagesBefore deletes the session's messages stored before t, returning how many were deleted.  Messages
+	// saved before stored_at was recorded are never deleted by time.
+	DeleteMessagesBefore(t time.Time) (int64, error)
+	// DeleteMessagesBelow deletes the session's messages with seqnums below seqNum, returning how many were deleted
+	DeleteMessagesBelow(seqNum int) (int64, error)
+}
+
+// WithMongoPurgeBatchSize sets the span of seqnums each delete of DeleteMessagesBefore and DeleteMessagesBelow covers,
+// so that no single delete holds the collection for long.  Defaults to 1000.
+func WithMongoPurgeBatchSize(size int) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.purgeBatchSize = size }
+}
+
+// DeleteMessagesBefore deletes the session's messages stored before t, see MongoMessagePurger
+func (store *mongoStore) DeleteMessagesBefore(t time.Time) (int64, error) {
+	return store.DeleteMessagesBeforeContext(context.Background(), t)
+}
+
+// DeleteMessagesBeforeContext is like DeleteMessagesBefore, but the database operations are bounded by ctx
+func (store *mongoStore) DeleteMessagesBeforeContext(ctx context.Context, t time.Time) (deleted int64, err error) {
+	defer store.observe("delete_messages", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "delete_messages")
+	defer cancel()
+
+	return store.purgeBatches(ctx, bson.M{"stored_at": bson.M{"$lt": t.UTC()}})
+}
+
+// DeleteMessagesBelow deletes the session's messages with seqnums below seqNum, see MongoMessagePurger
+func (store *mongoStore) DeleteMessagesBelow(seqNum int) (int64, error) {
+	return store.DeleteMessagesBelowContext(context.Background(), seqNum)
+}
+
+// DeleteMessagesBelowContext is like DeleteMessagesBelow, but the database operations are bounded by ctx
+func (store *mongoStore) DeleteMessagesBelowContext(ctx context.Context, seqNum int) (deleted int64, err error) {
+	defer store.observe("delete_messages", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "delete_messages")
+	defer cancel()
+
+	return store.purgeBatches(ctx, bson.M{"msg_seq_num": bson.M{"$lt": seqNum}})
+}
+
+// DeleteMessagesUpTo deletes the session's messages with seqnums up to and including seqNum, see MessageStore
+func (store *mongoStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.DeleteMessagesUpToContext(context.Background(), seqNum)
+}
+
+// DeleteMessagesUpToContext is like DeleteMessagesUpTo, but the database operations are bounded by ctx
+func (store *mongoStore) DeleteMessagesUpToContext(ctx context.Context, seqNum int) (err error) {
+	defer store.observeSeqNum("delete_messages", seqNum, time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "delete_messages")
+	defer cancel()
+
+	_, err = store.purgeBatches(ctx, bson.M{"msg_seq_num": bson.M{"$lte": seqNum}})
+	return err
+}
+
+// purgeBatches deletes the session's messages matching condition, a span of the purge batch size seqnums at a time
+// starting from the lowest seqnum matching it
+func (store *mongoStore) purgeBatches(ctx context.Context, condition bson.M) (deleted int64, err error) {
+	filter := bson.M{"session_id": store.sessionID, "$and": bson.A{condition}}
+	lowest := options.FindOne().SetSort(bson.D{{Key: "msg_seq_num", Value: 1}}).SetProjection(bson.M{"msg_seq_num": 1})
+
+	for {
+		var min messageData
+		if err = store.messagesCollection.FindOne(ctx, filter, lowest).Decode(&min); errors.Is(err, mongo.ErrNoDocuments) {
+			return deleted, nil
+		} else if err != nil {
+			return deleted, err
+		}
+
+		result, err := store.messagesCollection.DeleteMany(ctx, bson.M{
+			"session_id":  store.sessionID,
+			"msg_seq_num": bson.M{"$gte": min.MsgSeqNum, "$lt": min.MsgSeqNum + store.purgeBatchSize},
+			"$and":        bson.A{condition},
+		})
+		if err != nil {
+			return deleted, err
+		}
+		deleted += result.DeletedCount
+	}
+}
@@ -0,0 +1,54 @@
+package msgstore
+
+import (
+	"time"
+)
+
+func (s *MongoStoreSuite) TestMongoStore_DeleteMessagesBelow() {
+	// Given a session with five messages, purged two seqnums at a time
+	store, err := NewMongoStoreFactory(s.mongoCxn, "automated_testing_mongostore", WithMongoPurgeBatchSize(2)).Create(s.sessionID)
+	s.Require().Nil(err)
+	defer store.Close()
+	s.Require().Nil(store.Reset())
+	for seqNum := 1; seqNum <= 5; seqNum++ {
+		s.Require().Nil(store.SaveMessage(seqNum, []byte("msg")))
+	}
+
+	// When the messages below 4 are deleted
+	deleted, err := store.(MongoMessagePurger).DeleteMessagesBelow(4)
+	s.Require().Nil(err)
+
+	// Then only the later messages should remain
+	s.Equal(int64(3), deleted)
+	msgs, err := store.GetMessages(1, 5)
+	s.Require().Nil(err)
+	s.Len(msgs, 2)
+
+	// And deleting them again should find nothing to delete
+	deleted, err = store.(MongoMessagePurger).DeleteMessagesBelow(4)
+	s.Require().Nil(err)
+	s.Equal(int64(0), deleted)
+}
+
+func (s *MongoStoreSuite) TestMongoStore_DeleteMessagesBefore() {
+	purger, ok := s.msgStore.(MongoMessagePurger)
+	s.Require().True(ok)
+
+	// Given a message saved before a cutoff and another after it
+	s.Require().Nil(s.msgStore.Reset())
+	s.Require().Nil(s.msgStore.SaveMessage(1, []byte("old")))
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	s.Require().Nil(s.msgStore.SaveMessage(2, []byte("new")))
+
+	// When the messages before the cutoff are deleted
+	deleted, err := purger.DeleteMessagesBefore(cutoff)
+	s.Require().Nil(err)
+
+	// Then only the newer message should remain
+	s.Equal(int64(1), deleted)
+	msgs, err := s.msgStore.GetMessages(1, 2)
+	s.Require().Nil(err)
+	s.Equal([][]byte{[]byte("new")}, msgs)
+}
@@ -0,0 +1,81 @@
+package msgstore
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// defaultMongoRetryMaxAttempts and defaultMongoRetryBackoff retry for around 8s, long enough for a replica set election
+	defaultMongoRetryMaxAttempts = 6
+	defaultMongoRetryBackoff     = 250 * time.Millisecond
+)
+
+// transientMongoErrorCodes are the server error codes of a primary stepping down or a node shutting down, after which
+// an operation succeeds against the newly elected primary
+var transientMongoErrorCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	9001:  true, // SocketException
+	10107: true, // NotWritablePrimary
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotPrimaryNoSecondaryOk
+	13436: true, // NotPrimaryOrSecondary
+}
+
+// WithMongoRetry sets how many attempts the store makes at an idempotent operation that fails while the replica set
+// fails over, waiting backoff before the second attempt and doubling the wait each time after.  Seqnum increments and
+// saves under DuplicateMessageError are not idempotent, and are left to the driver's retryable writes, which retry once.
+// Defaults to 6 attempts starting 250ms apart.  A maxAttempts of 1 disables retries.
+func WithMongoRetry(maxAttempts int, backoff time.Duration) MongoStoreOption {
+	return func(f *mongoStoreFactory) {
+		f.retryMaxAttempts = maxAttempts
+		f.retryBackoff = backoff
+	}
+}
+
+// isTransientMongoError reports whether err is likely to succeed if the operation is retried, e.g. after an election
+func isTransientMongoError(err error) bool {
+	switch err {
+	case nil, mongo.ErrNoDocuments, context.Canceled, context.DeadlineExceeded:
+		return false
+	}
+	if mongo.IsNetworkError(err) {
+		return true
+	}
+
+	switch e := err.(type) {
+	case mongo.CommandError:
+		return transientMongoErrorCodes[int(e.Code)] || e.HasErrorLabel("RetryableWriteError")
+	case mongo.WriteException:
+		if e.WriteConcernError != nil && transientMongoErrorCodes[e.WriteConcernError.Code] {
+			return true
+		}
+		return e.HasErrorLabel("RetryableWriteError")
+	}
+	return false
+}
+
+// withRetry runs the idempotent op until it succeeds, fails with an error that isn't transient, or runs out of attempts
+func (store *mongoStore) withRetry(ctx context.Context, op func() error) error {
+	backoff := store.retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= store.retryMaxAttempts || !isTransientMongoError(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,53 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestIsTransientMongoError(t *testing.T) {
+	assert.False(t, isTransientMongoError(nil))
+	assert.False(t, isTransientMongoError(mongo.ErrNoDocuments))
+	assert.False(t, isTransientMongoError(context.DeadlineExceeded))
+	assert.False(t, isTransientMongoError(errors.New("bad value")))
+	assert.False(t, isTransientMongoError(mongo.CommandError{Code: 2, Message: "BadValue"}))
+
+	// step-downs, whether reported by a command or a write concern, are transient
+	assert.True(t, isTransientMongoError(mongo.CommandError{Code: 10107, Message: "not primary"}))
+	assert.True(t, isTransientMongoError(mongo.CommandError{Code: 1, Labels: []string{"RetryableWriteError"}}))
+	assert.True(t, isTransientMongoError(mongo.WriteException{WriteConcernError: &mongo.WriteConcernError{Code: 189}}))
+	assert.False(t, isTransientMongoError(mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000}}}))
+}
+
+func TestMongoStore_WithRetry(t *testing.T) {
+	store := &mongoStore{retryMaxAttempts: 3, retryBackoff: time.Millisecond}
+	stepDown := mongo.CommandError{Code: 189, Message: "primary stepped down"}
+
+	// an operation failing over should be retried until it succeeds
+	attempts := 0
+	err := store.withRetry(context.Background(), func() error {
+		if attempts++; attempts < 3 {
+			return stepDown
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+
+	// but no more than the maximum attempts
+	attempts = 0
+	err = store.withRetry(context.Background(), func() error { attempts++; return stepDown })
+	assert.Equal(t, stepDown, err)
+	assert.Equal(t, 3, attempts)
+
+	// and other errors should not be retried
+	attempts = 0
+	err = store.withRetry(context.Background(), func() error { attempts++; return ErrDuplicateMessage })
+	assert.Equal(t, ErrDuplicateMessage, err)
+	assert.Equal(t, 1, attempts)
+}
@@ -0,0 +1,165 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// MongoSessionInfo describes a session known to a mongo store, and is kept for code written before SessionInfo
+type MongoSessionInfo = SessionInfo
+
+// MongoSessionLister is implemented by the mongo factories and stores, and is kept for code written before SessionLister
+type MongoSessionLister = SessionLister
+
+// CloneSession copies the session srcID to the session dstID, see SessionCloner
+func (f mongoStoreFactory) CloneSession(srcID, dstID string) error {
+	return CloneMessageStoreSession(f, srcID, dstID)
+}
+
+// RenameSession moves the session oldID to the session newID, see SessionRenamer.  The documents are updated in one
+// transaction with WithMongoTransactions, and otherwise the messages first and the session document last.  Sessions
+// stored in their own databases or collections cannot be renamed.
+func (f mongoStoreFactory) RenameSession(oldID, newID string) error {
+	return f.RenameSessionContext(context.Background(), oldID, newID)
+}
+
+// RenameSessionContext is like RenameSession, but the database operations are bounded by ctx
+func (f mongoStoreFactory) RenameSessionContext(ctx context.Context, oldID, newID string) error {
+	if f.sessionDatabase != "" || f.sessionCollections != "" {
+		return errors.New("sessions stored in their own databases or collections cannot be renamed")
+	}
+
+	clientOptions, err := f.clientOptions()
+	if err != nil {
+		return err
+	}
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(f.dbName)
+	sessions := db.Collection(f.tablePrefix+"sessions", f.collectionOptions(readpref.Primary()))
+	messages := db.Collection(f.tablePrefix+"messages", f.collectionOptions(readpref.Primary()))
+	rename := func(ctx context.Context) error {
+		return renameMongoSession(ctx, sessions, messages, oldID, newID)
+	}
+
+	if !f.transactions {
+		return rename(ctx)
+	}
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, rename(sessCtx)
+	})
+	return err
+}
+
+// renameMongoSession rebinds the documents of the session oldID to newID, provided newID has no session document yet
+func renameMongoSession(ctx context.Context, sessions, messages *mongo.Collection, oldID, newID string) error {
+	if n, err := sessions.CountDocuments(ctx, bson.M{"session_id": newID}); err != nil {
+		return err
+	} else if n > 0 {
+		return fmt.Errorf("unable to rename session: %s: already stored", newID)
+	}
+	if n, err := sessions.CountDocuments(ctx, bson.M{"session_id": oldID}); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("unable to rename session: %s: not found", oldID)
+	}
+
+	rebind := bson.M{"$set": bson.M{"session_id": newID}}
+	if _, err := messages.UpdateMany(ctx, bson.M{"session_id": oldID}, rebind); err != nil {
+		return err
+	}
+	_, err := sessions.UpdateOne(ctx, bson.M{"session_id": oldID}, rebind)
+	return err
+}
+
+// ListSessions returns every session in the factory's sessions collection, see SessionLister.  Factories storing
+// each session in its own database or collections cannot list them.
+func (f mongoStoreFactory) ListSessions() ([]SessionInfo, error) {
+	return f.ListSessionsContext(context.Background())
+}
+
+// ListSessionsContext is like ListSessions, but the database operations are bounded by ctx
+func (f mongoStoreFactory) ListSessionsContext(ctx context.Context) ([]SessionInfo, error) {
+	if f.sessionDatabase != "" || f.sessionCollections != "" {
+		return nil, errors.New("sessions stored in their own databases or collections cannot be listed")
+	}
+
+	clientOptions, err := f.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(f.dbName)
+	sessions := db.Collection(f.tablePrefix+"sessions", f.collectionOptions(readpref.Primary()))
+	messages := db.Collection(f.tablePrefix+"messages", f.collectionOptions(readpref.Primary()))
+	return listMongoSessions(ctx, sessions, messages)
+}
+
+// ListSessions returns every session in the store's sessions collection, see SessionLister
+func (store *mongoStore) ListSessions() ([]SessionInfo, error) {
+	return store.ListSessionsContext(context.Background())
+}
+
+// ListSessionsContext is like ListSessions, but the database operations are bounded by ctx
+func (store *mongoStore) ListSessionsContext(ctx context.Context) (infos []SessionInfo, err error) {
+	defer store.observe("list_sessions", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "list_sessions")
+	defer cancel()
+
+	return listMongoSessions(ctx, store.sessionsCollection, store.messagesCollection)
+}
+
+// listMongoSessions reads every session document of a sessions collection, counting its messages in the messages collection
+func listMongoSessions(ctx context.Context, sessions, messages *mongo.Collection) ([]SessionInfo, error) {
+	cursor, err := sessions.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "session_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var infos []SessionInfo
+	for cursor.Next(ctx) {
+		var session sessionData
+		if err = cursor.Decode(&session); err != nil {
+			return nil, err
+		}
+		infos = append(infos, SessionInfo{
+			SessionID:           session.SessionID,
+			CreationTime:        session.CreationTime,
+			NextSenderMsgSeqNum: session.OutgoingSeqNum,
+			NextTargetMsgSeqNum: session.IncomingSeqNum,
+		})
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range infos {
+		if infos[i].MessageCount, err = messages.CountDocuments(ctx, bson.M{"session_id": infos[i].SessionID}); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
@@ -0,0 +1,50 @@
+package msgstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (s *MongoStoreSuite) TestMongoStore_ListSessions() {
+	// Given two sessions with their own seqnums
+	factory := NewMongoStoreFactory(s.mongoCxn, "automated_testing_mongostore")
+	other, err := factory.Create("ListSessions-other")
+	s.Require().Nil(err)
+	defer other.Close()
+	s.Require().Nil(other.Reset())
+	s.Require().Nil(other.SetNextSenderMsgSeqNum(5))
+	s.Require().Nil(other.SetNextTargetMsgSeqNum(7))
+
+	// When the factory lists the sessions
+	infos, err := factory.(SessionLister).ListSessions()
+	s.Require().Nil(err)
+
+	// Then the other session should be among them, as stored
+	var found *SessionInfo
+	for i := range infos {
+		if infos[i].SessionID == "ListSessions-other" {
+			found = &infos[i]
+		}
+	}
+	s.Require().NotNil(found)
+	s.Equal(5, found.NextSenderMsgSeqNum)
+	s.Equal(7, found.NextTargetMsgSeqNum)
+	s.Equal(int64(0), found.MessageCount)
+	s.WithinDuration(other.CreationTime(), found.CreationTime, time.Millisecond)
+
+	// And the store should list the same sessions
+	storeInfos, err := s.msgStore.(SessionLister).ListSessions()
+	s.Require().Nil(err)
+	s.Equal(len(infos), len(storeInfos))
+}
+
+func TestMongoStoreFactory_ListSessionsPerSessionNamespace(t *testing.T) {
+	// Given a factory storing each session in its own database
+	f := NewMongoStoreFactory("mongodb://localhost:27017", "db", WithMongoSessionDatabase("fix_{sessionID}")).(mongoStoreFactory)
+
+	// Then its sessions cannot be listed
+	_, err := f.ListSessions()
+	assert.NotNil(t, err)
+}
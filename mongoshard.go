@@ -0,0 +1,72 @@
+package msgstore
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MongoShardKey selects the shard key layout of the mongo store's collections on a sharded cluster.  Every query and
+// update the store makes includes the session_id, so each one is routed to a single shard under either layout.
+type MongoShardKey string
+
+const (
+	// MongoShardKeyHashedSessionID shards both collections on a hash of session_id, spreading sessions evenly over the shards
+	MongoShardKeyHashedSessionID MongoShardKey = "hashed_session_id"
+	// MongoShardKeySessionIDRange shards the messages collection on session_id and msg_seq_num ranges and the sessions
+	// collection on session_id ranges, so that a resend range is read from as few chunks as possible
+	MongoShardKeySessionIDRange MongoShardKey = "session_id_range"
+)
+
+// mongoAlreadyInitialized is the server error code for enabling sharding or sharding a collection a second time
+const mongoAlreadyInitialized = 23
+
+// WithMongoShardKey shards the store's database and collections with the key layout when a store is created, leaving
+// collections that are already sharded as they are.  The connection must be to a mongos router, with privileges to
+// shard collections.  Defaults to leaving sharding to the operator.
+func WithMongoShardKey(key MongoShardKey) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.shardKey = key }
+}
+
+// mongoShardKeys returns the shard key documents of the messages and sessions collections for a layout
+func mongoShardKeys(key MongoShardKey) (messages, sessions bson.D, err error) {
+	switch key {
+	case MongoShardKeyHashedSessionID:
+		hashed := bson.D{{Key: "session_id", Value: "hashed"}}
+		return hashed, hashed, nil
+	case MongoShardKeySessionIDRange:
+		return bson.D{{Key: "session_id", Value: 1}, {Key: "msg_seq_num", Value: 1}}, bson.D{{Key: "session_id", Value: 1}}, nil
+	}
+	return nil, nil, fmt.Errorf("unknown shard key: %s", key)
+}
+
+// ensureSharding shards the store's collections with the key layout
+func (store *mongoStore) ensureSharding(ctx context.Context, key MongoShardKey) error {
+	if key == "" {
+		return nil
+	}
+	messagesKey, sessionsKey, err := mongoShardKeys(key)
+	if err != nil {
+		return err
+	}
+
+	db := store.messagesCollection.Database()
+	admin := store.client.Database("admin")
+	commands := []bson.D{
+		{{Key: "enableSharding", Value: db.Name()}},
+		{{Key: "shardCollection", Value: db.Name() + "." + store.messagesCollection.Name()}, {Key: "key", Value: messagesKey}},
+		{{Key: "shardCollection", Value: db.Name() + "." + store.sessionsCollection.Name()}, {Key: "key", Value: sessionsKey}},
+	}
+	for _, cmd := range commands {
+		err := admin.RunCommand(ctx, cmd).Err()
+		if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Code == mongoAlreadyInitialized {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to %s: %w", cmd[0].Key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package msgstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMongoShardKeys(t *testing.T) {
+	messages, sessions, err := mongoShardKeys(MongoShardKeyHashedSessionID)
+	require.Nil(t, err)
+	assert.Equal(t, bson.D{{Key: "session_id", Value: "hashed"}}, messages)
+	assert.Equal(t, bson.D{{Key: "session_id", Value: "hashed"}}, sessions)
+
+	messages, sessions, err = mongoShardKeys(MongoShardKeySessionIDRange)
+	require.Nil(t, err)
+	assert.Equal(t, bson.D{{Key: "session_id", Value: 1}, {Key: "msg_seq_num", Value: 1}}, messages)
+	assert.Equal(t, bson.D{{Key: "session_id", Value: 1}}, sessions)
+
+	_, _, err = mongoShardKeys("bogus")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,80 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MessageCount returns the number of the session's messages, see MessageStats
+func (store *mongoStore) MessageCount() (int, error) {
+	return store.MessageCountContext(context.Background())
+}
+
+// MessageCountContext is like MessageCount, but the database operation is bounded by ctx
+func (store *mongoStore) MessageCountContext(ctx context.Context) (count int, err error) {
+	defer store.observe("message_count", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "message_count")
+	defer cancel()
+
+	err = store.withRetry(ctx, func() error {
+		n, err := store.messagesCollection.CountDocuments(ctx, bson.M{"session_id": store.sessionID})
+		count = int(n)
+		return err
+	})
+	return count, err
+}
+
+// FirstSeqNum returns the lowest seqnum of the session's messages, or 0 if it has none, see MessageStats
+func (store *mongoStore) FirstSeqNum() (int, error) {
+	return store.FirstSeqNumContext(context.Background())
+}
+
+// FirstSeqNumContext is like FirstSeqNum, but the database operation is bounded by ctx
+func (store *mongoStore) FirstSeqNumContext(ctx context.Context) (seqNum int, err error) {
+	defer store.observe("first_seqnum", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "first_seqnum")
+	defer cancel()
+
+	return store.boundarySeqNum(ctx, 1)
+}
+
+// LastSeqNum returns the highest seqnum of the session's messages, or 0 if it has none, see MessageStats
+func (store *mongoStore) LastSeqNum() (int, error) {
+	return store.LastSeqNumContext(context.Background())
+}
+
+// LastSeqNumContext is like LastSeqNum, but the database operation is bounded by ctx
+func (store *mongoStore) LastSeqNumContext(ctx context.Context) (seqNum int, err error) {
+	defer store.observe("last_seqnum", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "last_seqnum")
+	defer cancel()
+
+	return store.boundarySeqNum(ctx, -1)
+}
+
+// boundarySeqNum reads the seqnum of the session's first message in the given sort order from the index, without
+// fetching the message
+func (store *mongoStore) boundarySeqNum(ctx context.Context, order int) (seqNum int, err error) {
+	opts := options.FindOne().SetSort(bson.D{{Key: "msg_seq_num", Value: order}}).SetProjection(bson.M{"msg_seq_num": 1})
+	err = store.withRetry(ctx, func() error {
+		var msgData messageData
+		err := store.messagesCollection.FindOne(ctx, bson.M{"session_id": store.sessionID}, opts).Decode(&msgData)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			seqNum = 0
+			return nil
+		} else if err != nil {
+			return err
+		}
+		seqNum = msgData.MsgSeqNum
+		return nil
+	})
+	return seqNum, err
+}
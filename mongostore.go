@@ -1,40 +1,255 @@
 package msgstore
 
 import (
-	"github.com/globalsign/mgo"
-	"github.com/globalsign/mgo/bson"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
 	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
+// defaultMongoServerSelectionTimeout bounds how long an operation waits for a suitable server, matching the former mgo dial timeout
+const defaultMongoServerSelectionTimeout = 10 * time.Second
+
 type mongoStoreFactory struct {
-	dbURL       string
-	dbName      string
-	tablePrefix string
+	dbURL                  string
+	dbName                 string
+	tablePrefix            string
+	duplicatePolicy        DuplicateMessagePolicy
+	serverSelectionTimeout time.Duration
+	connectTimeout         time.Duration
+	socketTimeout          time.Duration
+	heartbeatInterval      time.Duration
+	maxPoolSize            uint64
+	tlsConfig              *tls.Config
+	tlsFiles               *mongoTLSFiles
+	credential             *options.Credential
+	transactions           bool
+	writeConcern           *writeconcern.WriteConcern
+	readConcern            *readconcern.ReadConcern
+	readPreference         *readpref.ReadPref
+	messageTTL             time.Duration
+	shardKey               MongoShardKey
+	compatibility          MongoCompatibility
+	sessionDatabase        string
+	sessionCollections     string
+	compressMessages       bool
+	serializer             RecordSerializer
+	purgeBatchSize         int
+	retryMaxAttempts       int
+	retryBackoff           time.Duration
+	metrics                StoreMetrics
+	slowLogger             MongoStoreLogger
+	slowThreshold          time.Duration
+	cappedMessages         *mongoCappedMessages
+	timeouts               mongoOperationTimeouts
+	auditCreationTime      bool
+	detectConflicts        bool
+	clock                  Clock
+	uniqueSeqNumIndex      bool
+	seqNumIndexes          *mongoEnsuredIndexes
+	closed                 *factoryClosed
+}
+
+// MongoStoreOption configures optional behavior of the stores created by a mongo MessageStoreFactory
+type MongoStoreOption func(*mongoStoreFactory)
+
+// WithMongoDuplicateMessagePolicy sets what SaveMessage does when a message is already stored for the seqnum.  Defaults to DuplicateMessageError.
+func WithMongoDuplicateMessagePolicy(policy DuplicateMessagePolicy) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.duplicatePolicy = policy }
+}
+
+// WithMongoUniqueSeqNumIndex makes the factory create a unique index on the session_id and msg_seq_num fields of each
+// messages collection, once per collection when its first store is created, so that the server rejects a second
+// message saved under a seqnum even when two saves race each other.  Without it, duplicates are only refused by a
+// lookup before the insert.  Creating the index fails, and so does Create, while the collection already holds two
+// messages of a session under the same seqnum, e.g. those saved by earlier versions; remove them before enabling it.
+func WithMongoUniqueSeqNumIndex() MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.uniqueSeqNumIndex = true }
+}
+
+// WithMongoClock stamps the creation time and stored messages of the stores with the time told by clock.  Defaults to
+// the system clock.
+func WithMongoClock(clock Clock) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.clock = clock }
+}
+
+// WithMongoServerSelectionTimeout sets how long an operation waits for a suitable server before failing.  Defaults to 10s.
+func WithMongoServerSelectionTimeout(timeout time.Duration) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.serverSelectionTimeout = timeout }
+}
+
+// WithMongoConnectTimeout sets how long opening a connection may take.  Defaults to the driver's 30s.
+func WithMongoConnectTimeout(timeout time.Duration) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.connectTimeout = timeout }
+}
+
+// WithMongoSocketTimeout sets how long a read or write on a connection may block before failing, so that a hung node
+// cannot stall the session indefinitely.  Should exceed the slowest expected operation.  Defaults to no timeout.
+func WithMongoSocketTimeout(timeout time.Duration) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.socketTimeout = timeout }
+}
+
+// WithMongoHeartbeatInterval sets how often the driver checks the state of each server, which bounds how long it takes to
+// notice a failover.  Defaults to the driver's 10s.
+func WithMongoHeartbeatInterval(interval time.Duration) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.heartbeatInterval = interval }
+}
+
+// WithMongoMaxPoolSize caps the number of connections each store keeps to each server.  Defaults to the driver's 100.
+func WithMongoMaxPoolSize(size uint64) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.maxPoolSize = size }
+}
+
+// WithMongoTransactions makes SaveMessageAndIncrNextSenderMsgSeqNum save the message and advance the seqnum in a
+// multi-document transaction, see AtomicMessageSaver, and BeginTx start one rather than buffer the writes until Commit.
+// Transactions require a replica set or sharded cluster.
+func WithMongoTransactions() MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.transactions = true }
+}
+
+// WithMongoWriteConcern sets the write concern of every write, e.g. writeconcern.New(writeconcern.WMajority(), writeconcern.J(true))
+// so that seqnums survive a failover.  Defaults to the connection string's, or else the server's.
+func WithMongoWriteConcern(concern *writeconcern.WriteConcern) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.writeConcern = concern }
+}
+
+// WithMongoReadConcern sets the read concern of every read, e.g. readconcern.Majority().  Defaults to the connection string's,
+// or else the server's.
+func WithMongoReadConcern(concern *readconcern.ReadConcern) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.readConcern = concern }
+}
+
+// WithMongoReadPreference sets which members GetMessages reads resend ranges from, e.g. readpref.Nearest().  The session
+// document and every other read of the messages, such as the duplicate checks of the saves, are always from the
+// primary, so that a store never starts from stale seqnums nor misses a message just saved.  Defaults to the primary.
+func WithMongoReadPreference(preference *readpref.ReadPref) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.readPreference = preference }
 }
 
 type mongoStore struct {
 	sessionID          string
 	cache              *memoryStore
 	creationTime       time.Time
-	dbCtx              *mgo.Session
-	dbName             string
-	messagesCollection string
-	sessionsCollection string
+	client             *mongo.Client
+	messagesCollection *mongo.Collection
+	resendCollection   *mongo.Collection
+	sessionsCollection *mongo.Collection
+	duplicatePolicy    DuplicateMessagePolicy
+	transactions       bool
+	compatibility      MongoCompatibility
+	capabilities       mongoCapabilities
+	compressMessages   bool
+	serializer         RecordSerializer
+	purgeBatchSize     int
+	retryMaxAttempts   int
+	retryBackoff       time.Duration
+	metrics            StoreMetrics
+	slowLogger         MongoStoreLogger
+	slowThreshold      time.Duration
+	timeouts           mongoOperationTimeouts
+	auditCreation      bool
+	detectConflicts    bool
+	clock              Clock
 }
 
-// NewMongoStoreFactory returns a transactional, mongo-based implementation of MessageStoreFactory
-func NewMongoStoreFactory(dbURL string, dbName string) MessageStoreFactory {
-	return NewMongoStoreFactoryWithTablePrefix(dbURL, dbName, "")
+// NewMongoStoreFactory returns a transactional, mongo-based implementation of MessageStoreFactory.
+// dbURL is a mongodb:// or mongodb+srv:// connection string, which also selects the authentication mechanism, e.g.
+// authMechanism=SCRAM-SHA-256, or authMechanism=MONGODB-X509 with tls=true&tlsCertificateKeyFile=<path>.
+func NewMongoStoreFactory(dbURL string, dbName string, opts ...MongoStoreOption) MessageStoreFactory {
+	return NewMongoStoreFactoryWithTablePrefix(dbURL, dbName, "", opts...)
 }
 
 //NewMongoStoreFactoryWithTablePrefix returns an initialized MessageStoreFactory that will use the provided prefix for table names
-func NewMongoStoreFactoryWithTablePrefix(dbURL string, dbName string, tablePrefix string) MessageStoreFactory {
-	return mongoStoreFactory{dbURL: dbURL, dbName: dbName, tablePrefix: tablePrefix}
+func NewMongoStoreFactoryWithTablePrefix(dbURL string, dbName string, tablePrefix string, opts ...MongoStoreOption) MessageStoreFactory {
+	f := mongoStoreFactory{
+		dbURL:                  dbURL,
+		dbName:                 dbName,
+		tablePrefix:            tablePrefix,
+		duplicatePolicy:        DuplicateMessageError,
+		serverSelectionTimeout: defaultMongoServerSelectionTimeout,
+		purgeBatchSize:         defaultMongoPurgeBatchSize,
+		retryMaxAttempts:       defaultMongoRetryMaxAttempts,
+		retryBackoff:           defaultMongoRetryBackoff,
+		seqNumIndexes:          &mongoEnsuredIndexes{},
+		closed:                 &factoryClosed{},
+	}
+	for _, opt := range opts {
+		opt(&f)
+	}
+	return f
 }
 
 // Create creates a new MongoStore implementation of the MessageStore interface
 func (f mongoStoreFactory) Create(sessionID string) (msgStore MessageStore, err error) {
-	return newMongoStore(f.dbURL, sessionID, f.dbName, f.tablePrefix)
+	if f.closed.isClosed() {
+		return nil, ErrFactoryClosed
+	}
+	return newMongoStore(f, sessionID)
+}
+
+// Close only makes Create fail, as each mongo store connects its own client, which its Close disconnects
+func (f mongoStoreFactory) Close() error {
+	f.closed.close()
+	return nil
+}
+
+// clientOptions returns the driver options for the factory's connection string and settings
+func (f mongoStoreFactory) clientOptions() (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(f.dbURL).SetServerSelectionTimeout(f.serverSelectionTimeout)
+	if f.connectTimeout > 0 {
+		opts.SetConnectTimeout(f.connectTimeout)
+	}
+	if f.socketTimeout > 0 {
+		opts.SetSocketTimeout(f.socketTimeout)
+	}
+	if f.heartbeatInterval > 0 {
+		opts.SetHeartbeatInterval(f.heartbeatInterval)
+	}
+	if f.maxPoolSize > 0 {
+		opts.SetMaxPoolSize(f.maxPoolSize)
+	}
+	if f.compatibility != "" {
+		opts.SetRetryWrites(false)
+	} else if opts.RetryWrites == nil {
+		opts.SetRetryWrites(true)
+	}
+	if opts.RetryReads == nil {
+		opts.SetRetryReads(true)
+	}
+
+	tlsConfig, err := f.buildTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if f.credential != nil {
+		opts.SetAuth(*f.credential)
+	}
+	return opts, nil
+}
+
+// collectionOptions returns the read and write settings of a collection, read from members matching preference
+func (f mongoStoreFactory) collectionOptions(preference *readpref.ReadPref) *options.CollectionOptions {
+	opts := options.Collection().SetReadPreference(preference)
+	if f.writeConcern != nil {
+		opts.SetWriteConcern(f.writeConcern)
+	}
+	if f.readConcern != nil {
+		opts.SetReadConcern(f.readConcern)
+	}
+	return opts
 }
 
 type sessionData struct {
@@ -45,66 +260,236 @@ type sessionData struct {
 }
 
 type messageData struct {
-	SessionID string `bson:"session_id"`
-	Message   []byte `bson:"message,omitempty"`
-	MsgSeqNum int    `bson:"msg_seq_num,omitempty"`
+	SessionID string    `bson:"session_id"`
+	Message   []byte    `bson:"message,omitempty"`
+	MsgSeqNum int       `bson:"msg_seq_num,omitempty"`
+	StoredAt  time.Time `bson:"stored_at,omitempty"`
 }
 
-func newMongoStore(dbURL string, sessionID string, dbName string, tablePrefix string) (store *mongoStore, err error) {
+func newMongoStore(f mongoStoreFactory, sessionID string) (store *mongoStore, err error) {
 	store = &mongoStore{
-		sessionID:          sessionID,
-		creationTime:       time.Now(),
-		dbName:             dbName,
-		cache:              &memoryStore{},
-		messagesCollection: tablePrefix + "messages",
-		sessionsCollection: tablePrefix + "sessions",
+		sessionID:        sessionID,
+		cache:            &memoryStore{},
+		clock:            f.clock,
+		duplicatePolicy:  f.duplicatePolicy,
+		transactions:     f.transactions,
+		compatibility:    f.compatibility,
+		capabilities:     allMongoCapabilities,
+		compressMessages: f.compressMessages,
+		serializer:       f.serializer,
+		purgeBatchSize:   f.purgeBatchSize,
+		retryMaxAttempts: f.retryMaxAttempts,
+		retryBackoff:     f.retryBackoff,
+		metrics:          f.metrics,
+		slowLogger:       f.slowLogger,
+		slowThreshold:    f.slowThreshold,
+		timeouts:         f.timeouts,
+		auditCreation:    f.auditCreationTime,
+		detectConflicts:  f.detectConflicts,
 	}
+	store.creationTime = clockNow(store.clock)
 
-	if store.dbCtx, err = mgo.Dial(dbURL); err != nil {
-		return
-	} else if err = store.cache.Reset(); err != nil {
-		return
-	} else if err = store.populateCache(); err != nil {
-		return
+	if err = checkMongoCompatibility(f); err != nil {
+		return nil, err
+	} else if err = checkCappedMessages(f); err != nil {
+		return nil, err
+	}
+	if f.purgeBatchSize < 1 {
+		return nil, fmt.Errorf("purge batch size must be positive, not %d", f.purgeBatchSize)
+	}
+	if f.retryMaxAttempts < 1 {
+		return nil, fmt.Errorf("retry attempts must be positive, not %d", f.retryMaxAttempts)
+	}
+	clientOptions, err := f.clientOptions()
+	if err != nil {
+		return nil, err
 	}
 
-	return
+	ctx, cancel := store.withTimeout(context.Background(), "create")
+	defer cancel()
+	if store.client, err = mongo.Connect(ctx, clientOptions); err != nil {
+		return nil, err
+	}
+	dbName, collectionPrefix := f.sessionNamespace(sessionID)
+	db := store.client.Database(dbName)
+	resendReadPreference := f.readPreference
+	if resendReadPreference == nil {
+		resendReadPreference = readpref.Primary()
+	}
+	// every other read of the messages, such as the duplicate checks of the saves, must see the writes before it
+	store.messagesCollection = db.Collection(collectionPrefix+"messages", f.collectionOptions(readpref.Primary()))
+	store.resendCollection = db.Collection(collectionPrefix+"messages", f.collectionOptions(resendReadPreference))
+	store.sessionsCollection = db.Collection(collectionPrefix+"sessions", f.collectionOptions(readpref.Primary()))
+
+	if f.compatibility != "" {
+		if store.capabilities, err = store.probeCapabilities(ctx); err != nil {
+			store.client.Disconnect(context.Background())
+			return nil, err
+		}
+	}
+
+	if err = store.cache.Reset(); err != nil {
+		store.client.Disconnect(context.Background())
+		return nil, err
+	} else if err = store.ensureCappedMessages(ctx, f.cappedMessages); err != nil {
+		store.client.Disconnect(context.Background())
+		return nil, err
+	} else if err = store.ensureSharding(ctx, f.shardKey); err != nil {
+		store.client.Disconnect(context.Background())
+		return nil, err
+	} else if err = store.ensureMessageSeqNumIndex(ctx, f); err != nil {
+		store.client.Disconnect(context.Background())
+		return nil, err
+	} else if err = store.ensureMessageTTLIndex(ctx, f.messageTTL); err != nil {
+		store.client.Disconnect(context.Background())
+		return nil, err
+	} else if err = store.populateCache(ctx); err != nil {
+		store.client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// mongoMessageSeqNumIndex names the unique index on the messages collection's session_id and msg_seq_num fields
+const mongoMessageSeqNumIndex = "session_id_msg_seq_num_unique"
+
+// mongoEnsuredIndexes records the messages collections of a factory whose seqnum index has been created, shared by
+// the copies of the factory so that the index is only built once per collection
+type mongoEnsuredIndexes struct {
+	mu          sync.Mutex
+	collections map[string]bool
+}
+
+// ensureMessageSeqNumIndex creates the unique index on the messages collection's session_id and msg_seq_num fields,
+// if f is configured WithMongoUniqueSeqNumIndex and no earlier store of f has created it.  A failed creation, e.g. on
+// duplicate seqnums, is retried by the next store.
+func (store *mongoStore) ensureMessageSeqNumIndex(ctx context.Context, f mongoStoreFactory) error {
+	if !f.uniqueSeqNumIndex {
+		return nil
+	}
+	namespace := store.messagesCollection.Database().Name() + "." + store.messagesCollection.Name()
+
+	f.seqNumIndexes.mu.Lock()
+	defer f.seqNumIndexes.mu.Unlock()
+	if f.seqNumIndexes.collections[namespace] {
+		return nil
+	}
+
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "session_id", Value: 1}, {Key: "msg_seq_num", Value: 1}},
+		Options: options.Index().SetName(mongoMessageSeqNumIndex).SetUnique(true),
+	}
+	if _, err := store.messagesCollection.Indexes().CreateOne(ctx, index); err != nil {
+		return fmt.Errorf("unable to create message seqnum index on %s: %w", namespace, err)
+	}
+	if f.seqNumIndexes.collections == nil {
+		f.seqNumIndexes.collections = make(map[string]bool)
+	}
+	f.seqNumIndexes.collections[namespace] = true
+	return nil
+}
+
+// sessionFilter selects the store's session document
+func (store *mongoStore) sessionFilter() bson.M {
+	return bson.M{"session_id": store.sessionID}
+}
+
+// upsertSession $sets the given fields of the store's session document, leaving the others untouched.  A document that has
+// gone missing, e.g. after a manual cleanup, is recreated with the remaining fields taken from the cache.
+func (store *mongoStore) upsertSession(ctx context.Context, set bson.M) error {
+	cached := bson.M{
+		"creation_time":    store.creationTime,
+		"incoming_seq_num": store.cache.NextTargetMsgSeqNum(),
+		"outgoing_seq_num": store.cache.NextSenderMsgSeqNum(),
+	}
+	onInsert := bson.M{}
+	for field, value := range cached {
+		if _, ok := set[field]; !ok {
+			onInsert[field] = value
+		}
+	}
+
+	update := bson.M{"$set": set}
+	if len(onInsert) > 0 {
+		update["$setOnInsert"] = onInsert
+	}
+	_, err := store.sessionsCollection.UpdateOne(ctx, store.sessionFilter(), update, options.Update().SetUpsert(true))
+	return err
 }
 
 // Reset deletes the store records and sets the seqnums back to 1
-func (store *mongoStore) Reset() (err error) {
-	messageFilter := &messageData{SessionID: store.sessionID}
+func (store *mongoStore) Reset() error {
+	return store.ResetContext(context.Background())
+}
+
+// ResetContext is like Reset, but the database operations are bounded by ctx
+func (store *mongoStore) ResetContext(ctx context.Context) (err error) {
+	defer store.observe("reset", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "reset")
+	defer cancel()
 
-	if _, err = store.dbCtx.DB(store.dbName).C(store.messagesCollection).RemoveAll(messageFilter); err != nil {
+	if err = store.withRetry(ctx, func() error {
+		_, err := store.messagesCollection.DeleteMany(ctx, store.sessionFilter())
+		return err
+	}); err != nil {
 		return
 	} else if err = store.cache.Reset(); err != nil {
 		return
 	}
 
-	store.creationTime = time.Now()
-	sessionFilter := &sessionData{SessionID: store.sessionID}
-	sessionUpdate := &sessionData{
-		SessionID:      store.sessionID,
-		CreationTime:   store.creationTime,
-		IncomingSeqNum: store.cache.NextTargetMsgSeqNum(),
-		OutgoingSeqNum: store.cache.NextSenderMsgSeqNum(),
-	}
-	err = store.dbCtx.DB(store.dbName).C(store.sessionsCollection).Update(sessionFilter, sessionUpdate)
-	return
+	store.creationTime = clockNow(store.clock)
+	return store.withRetry(ctx, func() error {
+		return store.upsertSession(ctx, bson.M{
+			"creation_time":    store.creationTime,
+			"incoming_seq_num": store.cache.NextTargetMsgSeqNum(),
+			"outgoing_seq_num": store.cache.NextSenderMsgSeqNum(),
+		})
+	})
 }
 
 // Refresh reloads the store from the database
 func (store *mongoStore) Refresh() error {
-	if err := store.cache.Reset(); err != nil {
+	return store.RefreshContext(context.Background())
+}
+
+// RefreshContext is like Refresh, but the database operations are bounded by ctx
+func (store *mongoStore) RefreshContext(ctx context.Context) (err error) {
+	defer store.observe("refresh", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "refresh")
+	defer cancel()
+
+	before := snapshotSession(store)
+	if err = store.withRetry(ctx, func() error {
+		if store.auditCreation {
+			if err := store.auditCreationTime(ctx); err != nil {
+				return err
+			}
+		}
+		if err := store.cache.Reset(); err != nil {
+			return err
+		}
+		return store.populateCache(ctx)
+	}); err != nil {
 		return err
 	}
-	return store.populateCache()
+
+	// BSON dates hold the creation time to the millisecond
+	if store.detectConflicts {
+		if err = before.detectConflict(store.sessionID, snapshotSession(store), time.Millisecond); err != nil {
+			before.restore(store.cache)
+			store.creationTime = before.creationTime
+			return err
+		}
+	}
+	return nil
 }
 
-func (store *mongoStore) populateCache() (err error) {
-	query := store.dbCtx.DB(store.dbName).C(store.sessionsCollection).Find(&sessionData{SessionID: store.sessionID})
+func (store *mongoStore) populateCache(ctx context.Context) (err error) {
 	sessionData := &sessionData{}
-	if err = query.One(sessionData); err == nil {
+	if err = store.sessionsCollection.FindOne(ctx, store.sessionFilter()).Decode(sessionData); err == nil {
 		// session record found, load it
 		store.creationTime = sessionData.CreationTime
 		if err = store.cache.SetNextTargetMsgSeqNum(sessionData.IncomingSeqNum); err != nil {
@@ -112,12 +497,12 @@ func (store *mongoStore) populateCache() (err error) {
 		} else if err = store.cache.SetNextSenderMsgSeqNum(sessionData.OutgoingSeqNum); err != nil {
 			return
 		}
-	} else if err == mgo.ErrNotFound {
+	} else if errors.Is(err, mongo.ErrNoDocuments) {
 		sessionData.SessionID = store.sessionID
 		sessionData.IncomingSeqNum = store.cache.NextTargetMsgSeqNum()
 		sessionData.OutgoingSeqNum = store.cache.NextSenderMsgSeqNum()
 		sessionData.CreationTime = store.creationTime
-		err = store.dbCtx.DB(store.dbName).C(store.sessionsCollection).Insert(sessionData)
+		_, err = store.sessionsCollection.InsertOne(ctx, sessionData)
 	}
 	return
 }
@@ -134,14 +519,17 @@ func (store *mongoStore) NextTargetMsgSeqNum() int {
 
 // SetNextSenderMsgSeqNum sets the next MsgSeqNum that will be sent
 func (store *mongoStore) SetNextSenderMsgSeqNum(next int) error {
-	sessionFilter := &sessionData{SessionID: store.sessionID}
-	sessionUpdate := &sessionData{
-		SessionID:      store.sessionID,
-		IncomingSeqNum: store.cache.NextTargetMsgSeqNum(),
-		OutgoingSeqNum: next,
-		CreationTime:   store.creationTime,
-	}
-	if err := store.dbCtx.DB(store.dbName).C(store.sessionsCollection).Update(sessionFilter, sessionUpdate); err != nil {
+	return store.SetNextSenderMsgSeqNumContext(context.Background(), next)
+}
+
+// SetNextSenderMsgSeqNumContext is like SetNextSenderMsgSeqNum, but the database operation is bounded by ctx
+func (store *mongoStore) SetNextSenderMsgSeqNumContext(ctx context.Context, next int) (err error) {
+	defer store.observe("set_next_sender_seqnum", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "set_next_sender_seqnum")
+	defer cancel()
+
+	if err := store.withRetry(ctx, func() error { return store.upsertSession(ctx, bson.M{"outgoing_seq_num": next}) }); err != nil {
 		return err
 	}
 	return store.cache.SetNextSenderMsgSeqNum(next)
@@ -149,14 +537,17 @@ func (store *mongoStore) SetNextSenderMsgSeqNum(next int) error {
 
 // SetNextTargetMsgSeqNum sets the next MsgSeqNum that should be received
 func (store *mongoStore) SetNextTargetMsgSeqNum(next int) error {
-	sessionFilter := &sessionData{SessionID: store.sessionID}
-	sessionUpdate := &sessionData{
-		SessionID:      store.sessionID,
-		IncomingSeqNum: next,
-		OutgoingSeqNum: store.cache.NextSenderMsgSeqNum(),
-		CreationTime:   store.creationTime,
-	}
-	if err := store.dbCtx.DB(store.dbName).C(store.sessionsCollection).Update(sessionFilter, sessionUpdate); err != nil {
+	return store.SetNextTargetMsgSeqNumContext(context.Background(), next)
+}
+
+// SetNextTargetMsgSeqNumContext is like SetNextTargetMsgSeqNum, but the database operation is bounded by ctx
+func (store *mongoStore) SetNextTargetMsgSeqNumContext(ctx context.Context, next int) (err error) {
+	defer store.observe("set_next_target_seqnum", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "set_next_target_seqnum")
+	defer cancel()
+
+	if err := store.withRetry(ctx, func() error { return store.upsertSession(ctx, bson.M{"incoming_seq_num": next}) }); err != nil {
 		return err
 	}
 	return store.cache.SetNextTargetMsgSeqNum(next)
@@ -164,18 +555,59 @@ func (store *mongoStore) SetNextTargetMsgSeqNum(next int) error {
 
 // IncrNextSenderMsgSeqNum increments the next MsgSeqNum that will be sent
 func (store *mongoStore) IncrNextSenderMsgSeqNum() error {
-	if err := store.cache.IncrNextSenderMsgSeqNum(); err != nil {
+	return store.IncrNextSenderMsgSeqNumContext(context.Background())
+}
+
+// IncrNextSenderMsgSeqNumContext is like IncrNextSenderMsgSeqNum, but the database operation is bounded by ctx
+func (store *mongoStore) IncrNextSenderMsgSeqNumContext(ctx context.Context) (err error) {
+	defer store.observe("set_next_sender_seqnum", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "set_next_sender_seqnum")
+	defer cancel()
+
+	next, err := store.incrSeqNum(ctx, "outgoing_seq_num", store.cache.NextSenderMsgSeqNum())
+	if err != nil {
 		return err
 	}
-	return store.SetNextSenderMsgSeqNum(store.cache.NextSenderMsgSeqNum())
+	return store.cache.SetNextSenderMsgSeqNum(next)
 }
 
 // IncrNextTargetMsgSeqNum increments the next MsgSeqNum that should be received
 func (store *mongoStore) IncrNextTargetMsgSeqNum() error {
-	if err := store.cache.IncrNextTargetMsgSeqNum(); err != nil {
+	return store.IncrNextTargetMsgSeqNumContext(context.Background())
+}
+
+// IncrNextTargetMsgSeqNumContext is like IncrNextTargetMsgSeqNum, but the database operation is bounded by ctx
+func (store *mongoStore) IncrNextTargetMsgSeqNumContext(ctx context.Context) (err error) {
+	defer store.observe("set_next_target_seqnum", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "set_next_target_seqnum")
+	defer cancel()
+
+	next, err := store.incrSeqNum(ctx, "incoming_seq_num", store.cache.NextTargetMsgSeqNum())
+	if err != nil {
 		return err
 	}
-	return store.SetNextTargetMsgSeqNum(store.cache.NextTargetMsgSeqNum())
+	return store.cache.SetNextTargetMsgSeqNum(next)
+}
+
+// incrSeqNum increments a seqnum field of the session document with a single $inc findAndModify, returning the new value.
+// Incrementing the stored value rather than writing the cached value plus one keeps stores sharing the session from
+// losing each other's increments.  A missing document is recreated with the field set to cached plus one.
+func (store *mongoStore) incrSeqNum(ctx context.Context, field string, cached int) (int, error) {
+	var session sessionData
+	err := store.sessionsCollection.FindOneAndUpdate(ctx, store.sessionFilter(), bson.M{"$inc": bson.M{field: 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&session)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return cached + 1, store.upsertSession(ctx, bson.M{field: cached + 1})
+	}
+	if err != nil {
+		return 0, err
+	}
+	if field == "incoming_seq_num" {
+		return session.IncomingSeqNum, nil
+	}
+	return session.OutgoingSeqNum, nil
 }
 
 // CreationTime returns the creation time of the store
@@ -183,17 +615,301 @@ func (store *mongoStore) CreationTime() time.Time {
 	return store.creationTime
 }
 
-func (store *mongoStore) SaveMessage(seqNum int, msg []byte) (err error) {
-	messageInsert := &messageData{
+// SetCreationTime sets the creation time of the session
+func (store *mongoStore) SetCreationTime(t time.Time) error {
+	return store.SetCreationTimeContext(context.Background(), t)
+}
+
+// SetCreationTimeContext is like SetCreationTime, but the database operation is bounded by ctx
+func (store *mongoStore) SetCreationTimeContext(ctx context.Context, t time.Time) (err error) {
+	defer store.observe("set_creation_time", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "set_creation_time")
+	defer cancel()
+
+	if err := store.withRetry(ctx, func() error { return store.upsertSession(ctx, bson.M{"creation_time": t}) }); err != nil {
+		return err
+	}
+	store.creationTime = t
+	return nil
+}
+
+// newMessageData returns the document saving msg, stamped with the time it is stored and serialized and compressed as
+// configured
+func (store *mongoStore) newMessageData(seqNum int, msg []byte) (*messageData, error) {
+	storedAt := clockNow(store.clock).UTC()
+	if store.serializer != nil {
+		var err error
+		record := MessageRecord{SessionID: store.sessionID, SeqNum: seqNum, StoredAt: storedAt, Msg: msg}
+		if msg, err = encodeRecord(store.serializer, record); err != nil {
+			return nil, err
+		}
+	}
+	if store.compressMessages {
+		msg = compressMessage(msg)
+	}
+	return &messageData{
 		MsgSeqNum: seqNum,
 		Message:   msg,
 		SessionID: store.sessionID,
+		StoredAt:  storedAt,
+	}, nil
+}
+
+// decodeMessage decompresses and unwraps a stored message according to its marker bytes, returning messages without a
+// marker as is
+func (store *mongoStore) decodeMessage(message []byte) ([]byte, error) {
+	message, err := decompressMessage(message)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecord(store.serializer, message)
+}
+
+func (store *mongoStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.SaveMessageContext(context.Background(), seqNum, msg)
+}
+
+// SaveMessageContext is like SaveMessage, but the database operations are bounded by ctx
+func (store *mongoStore) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) (err error) {
+	defer store.observeSeqNum("save_message", seqNum, time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "save_message")
+	defer cancel()
+
+	return store.saveMessageRetried(ctx, seqNum, msg)
+}
+
+// saveMessageRetried saves msg, retrying as long as the duplicate message policy makes the save idempotent
+func (store *mongoStore) saveMessageRetried(ctx context.Context, seqNum int, msg []byte) error {
+	if store.duplicatePolicy == DuplicateMessageError {
+		return store.saveMessage(ctx, seqNum, msg)
+	}
+	return store.withRetry(ctx, func() error { return store.saveMessage(ctx, seqNum, msg) })
+}
+
+// saveMessage saves msg under the duplicate message policy
+func (store *mongoStore) saveMessage(ctx context.Context, seqNum int, msg []byte) (err error) {
+	messageInsert, err := store.newMessageData(seqNum, msg)
+	if err != nil {
+		return err
+	}
+	messageFilter := bson.M{"session_id": store.sessionID, "msg_seq_num": seqNum}
+
+	switch store.duplicatePolicy {
+	case DuplicateMessageReplace:
+		_, err = store.messagesCollection.ReplaceOne(ctx, messageFilter, messageInsert, options.Replace().SetUpsert(true))
+	case DuplicateMessageIgnore:
+		_, err = store.messagesCollection.UpdateOne(ctx, messageFilter, bson.M{"$setOnInsert": messageInsert}, options.Update().SetUpsert(true))
+	default:
+		// a unique seqnum index, if any, also rejects the duplicates saved concurrently since the lookup
+		var count int64
+		if count, err = store.messagesCollection.CountDocuments(ctx, messageFilter); err != nil {
+			return
+		} else if count > 0 {
+			return ErrDuplicateMessage
+		}
+		if _, err = store.messagesCollection.InsertOne(ctx, messageInsert); mongo.IsDuplicateKeyError(err) {
+			return ErrDuplicateMessage
+		}
 	}
-	err = store.dbCtx.DB(store.dbName).C(store.messagesCollection).Insert(messageInsert)
 	return
 }
 
-func (store *mongoStore) GetMessages(beginSeqNum, endSeqNum int) (msgs [][]byte, err error) {
+// SaveMessages saves a batch of messages in a single round trip, with InsertMany or, when duplicates are replaced or
+// ignored, an unordered BulkWrite of upserts
+func (store *mongoStore) SaveMessages(msgs []SeqMsg) error {
+	return store.SaveMessagesContext(context.Background(), msgs)
+}
+
+// SaveMessagesContext is like SaveMessages, but the database operations are bounded by ctx
+func (store *mongoStore) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) (err error) {
+	defer store.observe("save_messages", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "save_messages")
+	defer cancel()
+
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	seqNums := make([]int, len(msgs))
+	for i, m := range msgs {
+		seqNums[i] = m.SeqNum
+	}
+
+	switch store.duplicatePolicy {
+	case DuplicateMessageReplace, DuplicateMessageIgnore:
+		models := make([]mongo.WriteModel, len(msgs))
+		for i, m := range msgs {
+			messageInsert, err := store.newMessageData(m.SeqNum, m.Msg)
+			if err != nil {
+				return err
+			}
+			messageFilter := bson.M{"session_id": store.sessionID, "msg_seq_num": m.SeqNum}
+			if store.duplicatePolicy == DuplicateMessageReplace {
+				models[i] = mongo.NewReplaceOneModel().SetFilter(messageFilter).SetReplacement(messageInsert).SetUpsert(true)
+			} else {
+				models[i] = mongo.NewUpdateOneModel().SetFilter(messageFilter).SetUpdate(bson.M{"$setOnInsert": messageInsert}).SetUpsert(true)
+			}
+		}
+		err = store.withRetry(ctx, func() error {
+			_, err := store.messagesCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+			return err
+		})
+	default:
+		// duplicates are looked for up front so that a batch is not partly inserted, and a unique seqnum index, if
+		// any, rejects those saved concurrently since
+		var count int64
+		if count, err = store.messagesCollection.CountDocuments(ctx, bson.M{"session_id": store.sessionID, "msg_seq_num": bson.M{"$in": seqNums}}); err != nil {
+			return
+		} else if count > 0 {
+			return ErrDuplicateMessage
+		}
+
+		docs := make([]interface{}, len(msgs))
+		for i, m := range msgs {
+			if docs[i], err = store.newMessageData(m.SeqNum, m.Msg); err != nil {
+				return err
+			}
+		}
+		if _, err = store.messagesCollection.InsertMany(ctx, docs); mongo.IsDuplicateKeyError(err) {
+			return ErrDuplicateMessage
+		}
+	}
+	return
+}
+
+// SaveMessageAndIncrNextSenderMsgSeqNum saves an outgoing message and increments the next sender seqnum.  With
+// WithMongoTransactions both writes are committed together, otherwise they are made one after the other.
+func (store *mongoStore) SaveMessageAndIncrNextSenderMsgSeqNum(seqNum int, msg []byte) error {
+	return store.SaveMessageAndIncrNextSenderMsgSeqNumContext(context.Background(), seqNum, msg)
+}
+
+// SaveMessageAndIncrNextSenderMsgSeqNumContext is like SaveMessageAndIncrNextSenderMsgSeqNum, but the database operations
+// are bounded by ctx
+func (store *mongoStore) SaveMessageAndIncrNextSenderMsgSeqNumContext(ctx context.Context, seqNum int, msg []byte) (err error) {
+	defer store.observe("save_message_and_incr_next_sender_seqnum", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "save_message_and_incr_next_sender_seqnum")
+	defer cancel()
+
+	var next int
+	save := store.saveMessageRetried
+	write := func(ctx context.Context) (err error) {
+		if err = save(ctx, seqNum, msg); err != nil {
+			return err
+		}
+		next, err = store.incrSeqNum(ctx, "outgoing_seq_num", store.cache.NextSenderMsgSeqNum())
+		return err
+	}
+
+	if store.transactions && store.capabilities.transactions {
+		session, err := store.client.StartSession()
+		if err != nil {
+			return err
+		}
+		defer session.EndSession(ctx)
+		// WithTransaction retries the whole transaction, as a write cannot be retried within an aborted one
+		save = store.saveMessage
+
+		if _, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+			return nil, write(sessCtx)
+		}); err != nil {
+			return err
+		}
+	} else if err := write(ctx); err != nil {
+		return err
+	}
+
+	// the cache only advances once the seqnum is durable
+	return store.cache.SetNextSenderMsgSeqNum(next)
+}
+
+func (store *mongoStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.GetMessagesContext(context.Background(), beginSeqNum, endSeqNum)
+}
+
+// GetMessagesContext is like GetMessages, but the database operation is bounded by ctx
+func (store *mongoStore) GetMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int) (msgs [][]byte, err error) {
+	defer store.observe("get_messages", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "get_messages")
+	defer cancel()
+
+	err = store.iterateMessagesRetried(ctx, beginSeqNum, endSeqNum, func(_ int, msg []byte) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	return msgs, err
+}
+
+// GetMessagesSince returns the messages stored for seqnums after seqNum, see GetMessagesAfter
+func (store *mongoStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return GetMessagesAfter(store, seqNum)
+}
+
+// GetMessagesDescending returns the messages in the range most recent first, see GetMessagesReversed
+func (store *mongoStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return GetMessagesReversed(store, beginSeqNum, endSeqNum)
+}
+
+// IterateMessages calls fn with each message in the range in seqnum order, reading them from the cursor one at a time
+// rather than holding them all in memory.  Iteration stops at the first error fn returns, which is returned.
+func (store *mongoStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.IterateMessagesContext(context.Background(), beginSeqNum, endSeqNum, fn)
+}
+
+// IterateMessagesContext is like IterateMessages, but the whole iteration is bounded by ctx
+func (store *mongoStore) IterateMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	var fnErr error
+	err := store.iterateMessagesObserved(ctx, beginSeqNum, endSeqNum, func(seqNum int, msg []byte) error {
+		fnErr = fn(seqNum, msg)
+		return fnErr
+	})
+	// the error of fn is the caller's own, so is returned as it is rather than in a StoreError
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+// iterateMessagesObserved is IterateMessagesContext, observed and with its errors wrapped in a StoreError
+func (store *mongoStore) iterateMessagesObserved(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) (err error) {
+	defer store.observe("iterate_messages", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "iterate_messages")
+	defer cancel()
+
+	return store.iterateMessagesRetried(ctx, beginSeqNum, endSeqNum, fn)
+}
+
+// StreamMessages streams the messages in the range in seqnum order, see StreamMessageStore
+func (store *mongoStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+// iterateMessagesRetried is iterateMessages, retried from the message after the last one fn was given
+func (store *mongoStore) iterateMessagesRetried(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	next := beginSeqNum
+	var fnErr error
+	err := store.withRetry(ctx, func() error {
+		return store.iterateMessages(ctx, next, endSeqNum, func(seqNum int, msg []byte) error {
+			if fnErr = fn(seqNum, msg); fnErr != nil {
+				return errStopIteration
+			}
+			next = seqNum + 1
+			return nil
+		})
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+// iterateMessages reads the messages in the range in seqnum order
+func (store *mongoStore) iterateMessages(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
 	//Use a range for the sequence filter
 	seqFilter := bson.M{
 		"session_id": store.sessionID,
@@ -203,16 +919,94 @@ func (store *mongoStore) GetMessages(beginSeqNum, endSeqNum int) (msgs [][]byte,
 		},
 	}
 
-	iter := store.dbCtx.DB(store.dbName).C(store.messagesCollection).Find(seqFilter).Sort("msg_seq_num").Iter()
-	msgData := &messageData{}
-	for iter.Next(msgData) {
-		msgs = append(msgs, msgData.Message)
+	cursor, err := store.resendCollection.Find(ctx, seqFilter, options.Find().SetSort(bson.D{{Key: "msg_seq_num", Value: 1}}))
+	if err != nil {
+		return err
 	}
-	err = iter.Close()
-	return
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		msgData := &messageData{}
+		if err = cursor.Decode(msgData); err != nil {
+			return err
+		}
+		msg, err := store.decodeMessage(msgData.Message)
+		if err != nil {
+			return err
+		}
+		if err = fn(msgData.MsgSeqNum, msg); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
 }
 
-func (store *mongoStore) Close() error {
-	store.dbCtx.Close()
+// GetMessage returns the message stored for seqNum, reporting whether there is one
+func (store *mongoStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return store.GetMessageContext(context.Background(), seqNum)
+}
+
+// GetMessageContext is like GetMessage, but the database operation is bounded by ctx
+func (store *mongoStore) GetMessageContext(ctx context.Context, seqNum int) (msg []byte, found bool, err error) {
+	defer store.observeSeqNum("get_message", seqNum, time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "get_message")
+	defer cancel()
+
+	err = store.withRetry(ctx, func() error {
+		var msgData messageData
+		err := store.messagesCollection.FindOne(ctx, bson.M{"session_id": store.sessionID, "msg_seq_num": seqNum}).Decode(&msgData)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			msg, found = nil, false
+			return nil
+		} else if err != nil {
+			return err
+		}
+		msg, found = msgData.Message, true
+		return nil
+	})
+	if err != nil || !found {
+		return nil, false, err
+	}
+	if msg, err = store.decodeMessage(msg); err != nil {
+		return nil, false, err
+	}
+	return msg, true, nil
+}
+
+// Backup writes the session to w as a portable archive, see BackupMessageStore
+func (store *mongoStore) Backup(w io.Writer) error {
+	return BackupMessageStore(store, w)
+}
+
+// Restore resets the session and restores into it an archive written by Backup, see RestoreMessageStore
+func (store *mongoStore) Restore(r io.Reader) error {
+	return RestoreMessageStore(store, r)
+}
+
+// HealthCheck verifies the server can be reached and the session document can be read, see MessageStore
+func (store *mongoStore) HealthCheck(ctx context.Context) (err error) {
+	defer store.observe("health_check", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx, "health_check")
+	defer cancel()
+
+	return store.withRetry(ctx, func() error {
+		if err := store.client.Ping(ctx, nil); err != nil {
+			return err
+		}
+		if err := store.sessionsCollection.FindOne(ctx, store.sessionFilter()).Err(); err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+		return nil
+	})
+}
+
+// Flush does nothing, as every write is acknowledged by the server before it returns
+func (store *mongoStore) Flush() error {
 	return nil
 }
+
+func (store *mongoStore) Close() error {
+	return store.client.Disconnect(context.Background())
+}
@@ -1,10 +1,20 @@
 package msgstore
 
 import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 	"log"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestMongoStoreSuite(t *testing.T) {
@@ -34,3 +44,224 @@ func (s *MongoStoreSuite) SetupTest() {
 func (s *MongoStoreSuite) TeardownTest() {
 	s.msgStore.Close()
 }
+
+func (s *MongoStoreSuite) TestMongoStore_MissingSessionDocument() {
+	store := s.msgStore.(*mongoStore)
+
+	// Given a session document deleted from under the store
+	_, err := store.sessionsCollection.DeleteMany(context.Background(), store.sessionFilter())
+	s.Require().Nil(err)
+
+	// Then seqnum writes and Reset should recreate it
+	s.Require().Nil(store.SetNextSenderMsgSeqNum(5))
+	s.Require().Nil(store.Refresh())
+	s.Equal(5, store.NextSenderMsgSeqNum())
+
+	_, err = store.sessionsCollection.DeleteMany(context.Background(), store.sessionFilter())
+	s.Require().Nil(err)
+	s.Require().Nil(store.Reset())
+	s.Require().Nil(store.Refresh())
+	s.Equal(1, store.NextSenderMsgSeqNum())
+}
+
+func (s *MongoStoreSuite) TestMongoStore_SaveMessageAndIncrNextSenderMsgSeqNum() {
+	saver, ok := s.msgStore.(AtomicMessageSaver)
+	s.Require().True(ok)
+
+	// When a message is saved along with its seqnum
+	s.Require().Nil(s.msgStore.Reset())
+	s.Require().Nil(saver.SaveMessageAndIncrNextSenderMsgSeqNum(1, []byte("one")))
+
+	// Then both should be persisted
+	s.Require().Nil(s.msgStore.Refresh())
+	s.Equal(2, s.msgStore.NextSenderMsgSeqNum())
+	msgs, err := s.msgStore.GetMessages(1, 1)
+	s.Require().Nil(err)
+	s.Equal([][]byte{[]byte("one")}, msgs)
+
+	// And a failed save should leave the seqnum where it was
+	s.NotNil(saver.SaveMessageAndIncrNextSenderMsgSeqNum(1, []byte("one")))
+	s.Equal(2, s.msgStore.NextSenderMsgSeqNum())
+}
+
+func (s *MongoStoreSuite) TestMongoStore_SaveMessages() {
+	saver, ok := s.msgStore.(MessageBatchSaver)
+	s.Require().True(ok)
+
+	// When a batch of messages is saved
+	s.Require().Nil(s.msgStore.Reset())
+	s.Require().Nil(saver.SaveMessages([]SeqMsg{{SeqNum: 1, Msg: []byte("one")}, {SeqNum: 2, Msg: []byte("two")}}))
+
+	// Then they should all be stored
+	msgs, err := s.msgStore.GetMessages(1, 2)
+	s.Require().Nil(err)
+	s.Equal([][]byte{[]byte("one"), []byte("two")}, msgs)
+
+	// And a batch repeating a seqnum should be refused
+	s.True(errors.Is(saver.SaveMessages([]SeqMsg{{SeqNum: 2, Msg: []byte("two")}, {SeqNum: 3, Msg: []byte("three")}}), ErrDuplicateMessage))
+}
+
+func (s *MongoStoreSuite) TestMongoStore_SeqNumUpdatesKeepCreationTime() {
+	// Given a session with a known creation time
+	s.Require().Nil(s.msgStore.Reset())
+	creationTime := s.msgStore.CreationTime()
+
+	// When the seqnums are updated and the store reloaded
+	s.Require().Nil(s.msgStore.SetNextSenderMsgSeqNum(5))
+	s.Require().Nil(s.msgStore.SetNextTargetMsgSeqNum(7))
+	s.Require().Nil(s.msgStore.Refresh())
+
+	// Then only the seqnums should have changed
+	s.WithinDuration(creationTime, s.msgStore.CreationTime(), time.Millisecond)
+	s.Equal(5, s.msgStore.NextSenderMsgSeqNum())
+	s.Equal(7, s.msgStore.NextTargetMsgSeqNum())
+}
+
+func (s *MongoStoreSuite) TestMongoStore_IncrSharedSession() {
+	// Given two stores on the same session, one of which has built the unique seqnum index
+	other, err := NewMongoStoreFactory(s.mongoCxn, "automated_testing_mongostore", WithMongoUniqueSeqNumIndex()).Create(s.sessionID)
+	s.Require().Nil(err)
+	defer other.Close()
+	s.Require().Nil(s.msgStore.Reset())
+
+	// When each increments the sender seqnum without refreshing
+	s.Require().Nil(s.msgStore.IncrNextSenderMsgSeqNum())
+	s.Require().Nil(other.IncrNextSenderMsgSeqNum())
+
+	// Then neither increment should be lost
+	s.Equal(3, other.NextSenderMsgSeqNum())
+	s.Require().Nil(s.msgStore.Refresh())
+	s.Equal(3, s.msgStore.NextSenderMsgSeqNum())
+}
+
+func TestMongoStoreFactory_ClientOptions(t *testing.T) {
+	// Given a factory with the default options
+	f := NewMongoStoreFactory("mongodb://localhost:27017", "db").(mongoStoreFactory)
+
+	// Then servers should be selected within the default timeout
+	opts, err := f.clientOptions()
+	require.Nil(t, err)
+	assert.Equal(t, defaultMongoServerSelectionTimeout, *opts.ServerSelectionTimeout)
+
+	// When the timeout is overridden
+	f = NewMongoStoreFactory("mongodb://localhost:27017", "db", WithMongoServerSelectionTimeout(time.Second)).(mongoStoreFactory)
+
+	// Then the driver should be given it
+	opts, err = f.clientOptions()
+	require.Nil(t, err)
+	assert.Equal(t, time.Second, *opts.ServerSelectionTimeout)
+	assert.Nil(t, opts.SocketTimeout)
+
+	// When the pool and the other timeouts are configured
+	f = NewMongoStoreFactory("mongodb://localhost:27017", "db", WithMongoConnectTimeout(2*time.Second), WithMongoSocketTimeout(3*time.Second),
+		WithMongoHeartbeatInterval(4*time.Second), WithMongoMaxPoolSize(5)).(mongoStoreFactory)
+
+	// Then the driver should be given them too
+	opts, err = f.clientOptions()
+	require.Nil(t, err)
+	assert.Equal(t, 2*time.Second, *opts.ConnectTimeout)
+	assert.Equal(t, 3*time.Second, *opts.SocketTimeout)
+	assert.Equal(t, 4*time.Second, *opts.HeartbeatInterval)
+	assert.Equal(t, uint64(5), *opts.MaxPoolSize)
+}
+
+func TestMongoStoreFactory_Close(t *testing.T) {
+	// Given a mongo store factory that has been closed
+	factory := NewMongoStoreFactory("mongodb://localhost:27017", "db")
+	require.Nil(t, factory.Close())
+
+	// When a store is created
+	_, err := factory.Create("FIX.4.4-SENDER-TARGET")
+
+	// Then it should be refused before connecting
+	assert.Equal(t, ErrFactoryClosed, err)
+}
+
+func TestMongoStoreFactory_CollectionOptions(t *testing.T) {
+	// Given a factory writing with majority concern and reading resends from the nearest member
+	concern := writeconcern.New(writeconcern.WMajority(), writeconcern.J(true))
+	f := NewMongoStoreFactory("mongodb://localhost:27017", "db",
+		WithMongoWriteConcern(concern), WithMongoReadConcern(readconcern.Majority()), WithMongoReadPreference(readpref.Nearest())).(mongoStoreFactory)
+
+	// Then the collections should be given the concerns and the preference
+	opts := f.collectionOptions(f.readPreference)
+	assert.Equal(t, concern, opts.WriteConcern)
+	assert.Equal(t, readconcern.Majority(), opts.ReadConcern)
+	assert.Equal(t, readpref.Nearest(), opts.ReadPreference)
+
+	// And a factory without them should leave the concerns to the connection string
+	opts = NewMongoStoreFactory("mongodb://localhost:27017", "db").(mongoStoreFactory).collectionOptions(readpref.Primary())
+	assert.Nil(t, opts.WriteConcern)
+	assert.Nil(t, opts.ReadConcern)
+}
+
+func (s *MongoStoreSuite) TestMongoStore_ConcurrentDuplicateSave() {
+	// Given two stores on the same session, one of which has built the unique seqnum index
+	other, err := NewMongoStoreFactory(s.mongoCxn, "automated_testing_mongostore", WithMongoUniqueSeqNumIndex()).Create(s.sessionID)
+	s.Require().Nil(err)
+	defer other.Close()
+	s.Require().Nil(s.msgStore.Reset())
+
+	// When both save a message under the same seqnum at once
+	errs := make(chan error, 2)
+	for _, store := range []MessageStore{s.msgStore, other} {
+		go func(store MessageStore) { errs <- store.SaveMessage(1, []byte("one")) }(store)
+	}
+	first, second := <-errs, <-errs
+
+	// Then exactly one should be saved, and the other refused as a duplicate
+	if first != nil {
+		first, second = second, first
+	}
+	s.Nil(first)
+	s.True(errors.Is(second, ErrDuplicateMessage))
+}
+
+func (s *MongoStoreSuite) TestMongoStore_UniqueSeqNumIndexOnDuplicates() {
+	// Given a messages collection already holding two messages of the session under the same seqnum
+	legacy, err := NewMongoStoreFactory(s.mongoCxn, "automated_testing_mongostore",
+		WithMongoSessionCollectionPrefix("seqnumindex_")).Create(s.sessionID)
+	s.Require().Nil(err)
+	defer legacy.Close()
+	messages := legacy.(*mongoStore).messagesCollection
+	defer messages.Drop(context.Background())
+	for i := 0; i < 2; i++ {
+		_, err = messages.InsertOne(context.Background(), messageData{SessionID: s.sessionID, Message: []byte("one"), MsgSeqNum: 1})
+		s.Require().Nil(err)
+	}
+
+	// When a factory with the unique seqnum index creates a store on it
+	factory := NewMongoStoreFactory(s.mongoCxn, "automated_testing_mongostore",
+		WithMongoSessionCollectionPrefix("seqnumindex_"), WithMongoUniqueSeqNumIndex())
+	_, err = factory.Create(s.sessionID)
+
+	// Then the index build should fail, and so should Create
+	s.NotNil(err)
+
+	// And once the duplicate is removed, the next Create should build the index
+	_, err = messages.DeleteOne(context.Background(), bson.M{"session_id": s.sessionID, "msg_seq_num": 1})
+	s.Require().Nil(err)
+	store, err := factory.Create(s.sessionID)
+	s.Require().Nil(err)
+	defer store.Close()
+	s.True(s.hasSeqNumIndex(messages))
+
+	// And later stores of the factory should not build it again
+	s.Require().Nil(messages.Indexes().DropOne(context.Background(), mongoMessageSeqNumIndex))
+	other, err := factory.Create(s.sessionID)
+	s.Require().Nil(err)
+	defer other.Close()
+	s.False(s.hasSeqNumIndex(messages))
+}
+
+// hasSeqNumIndex tells whether messages has the unique seqnum index
+func (s *MongoStoreSuite) hasSeqNumIndex(messages *mongo.Collection) bool {
+	specs, err := messages.Indexes().ListSpecifications(context.Background())
+	s.Require().Nil(err)
+	for _, spec := range specs {
+		if spec.Name == mongoMessageSeqNumIndex {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package msgstore
+
+import (
+	"context"
+	"time"
+)
+
+// mongoOperationTimeouts holds the timeouts of a store's operations
+type mongoOperationTimeouts struct {
+	all         time.Duration
+	byOperation map[string]time.Duration
+}
+
+// WithMongoOperationTimeout bounds every operation of the factory's stores, retries included, so that a stalled server
+// fails the operation rather than the session's heartbeats.  Operations are also bounded by the context passed to their
+// Context variants, whichever ends first.  Defaults to no timeout.
+func WithMongoOperationTimeout(timeout time.Duration) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.timeouts.all = timeout }
+}
+
+// WithMongoOperationTimeoutFor bounds one operation, named as in WithMongoMetrics or "create" for the startup of a store,
+// overriding WithMongoOperationTimeout, e.g. to allow "get_messages" longer than "save_message" for large resends
+func WithMongoOperationTimeoutFor(operation string, timeout time.Duration) MongoStoreOption {
+	return func(f *mongoStoreFactory) {
+		// copied, so that factories built from the same options never share the map
+		byOperation := make(map[string]time.Duration, len(f.timeouts.byOperation)+1)
+		for op, t := range f.timeouts.byOperation {
+			byOperation[op] = t
+		}
+		byOperation[operation] = timeout
+		f.timeouts.byOperation = byOperation
+	}
+}
+
+// timeoutFor returns the timeout of an operation, or 0 for none
+func (t mongoOperationTimeouts) timeoutFor(operation string) time.Duration {
+	if timeout, ok := t.byOperation[operation]; ok {
+		return timeout
+	}
+	return t.all
+}
+
+// withTimeout bounds ctx by the timeout of the operation, if one is configured
+func (store *mongoStore) withTimeout(ctx context.Context, operation string) (context.Context, context.CancelFunc) {
+	if timeout := store.timeouts.timeoutFor(operation); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
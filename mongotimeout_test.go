@@ -0,0 +1,44 @@
+package msgstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMongoStore_WithTimeout(t *testing.T) {
+	f := NewMongoStoreFactory("mongodb://localhost:27017", "db",
+		WithMongoOperationTimeout(time.Second), WithMongoOperationTimeoutFor("get_messages", time.Minute)).(mongoStoreFactory)
+	store := &mongoStore{timeouts: f.timeouts}
+	assert.Implements(t, (*ContextMessageStore)(nil), store)
+
+	// operations should be bounded by the default timeout
+	ctx, cancel := store.withTimeout(context.Background(), "save_message")
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Second), deadline, 100*time.Millisecond)
+
+	// unless they have their own
+	ctx, cancel = store.withTimeout(context.Background(), "get_messages")
+	defer cancel()
+	deadline, _ = ctx.Deadline()
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, 100*time.Millisecond)
+
+	// and a caller's earlier deadline should still apply
+	parent, cancelParent := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelParent()
+	ctx, cancel = store.withTimeout(parent, "get_messages")
+	defer cancel()
+	deadline, _ = ctx.Deadline()
+	parentDeadline, _ := parent.Deadline()
+	assert.Equal(t, parentDeadline, deadline)
+
+	// and stores without timeouts should leave operations unbounded
+	ctx, cancel = (&mongoStore{}).withTimeout(context.Background(), "reset")
+	defer cancel()
+	_, ok = ctx.Deadline()
+	assert.False(t, ok)
+}
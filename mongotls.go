@@ -0,0 +1,81 @@
+package msgstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoTLSFiles are the PEM files given to WithMongoTLSFiles, read when a store is created
+type mongoTLSFiles struct {
+	caFile, certFile, keyFile string
+}
+
+// WithMongoTLSConfig connects over TLS configured by config, e.g. to present a client certificate for mutual TLS.
+// It takes precedence over any TLS settings in the connection string.
+func WithMongoTLSConfig(config *tls.Config) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.tlsConfig = config }
+}
+
+// WithMongoTLSFiles connects over TLS, trusting the CA bundle in the PEM file caFile and presenting the client certificate
+// in the PEM files certFile and keyFile for mutual TLS.  caFile may be empty to trust the system roots, and certFile and
+// keyFile may both be empty to present no certificate.  Combined with WithMongoTLSConfig, the files are added to a copy of
+// its config.  The files are read by Create, which fails if they cannot be loaded.
+func WithMongoTLSFiles(caFile, certFile, keyFile string) MongoStoreOption {
+	return func(f *mongoStoreFactory) {
+		f.tlsFiles = &mongoTLSFiles{caFile: caFile, certFile: certFile, keyFile: keyFile}
+	}
+}
+
+// WithMongoCredential authenticates with mechanism, e.g. "SCRAM-SHA-256" or "MONGODB-X509", against the source database,
+// which defaults to "admin" when empty.  Under MONGODB-X509 the identity is taken from the client certificate, so username
+// may be empty and password is ignored.  It takes precedence over any credentials in the connection string.
+func WithMongoCredential(mechanism, source, username, password string) MongoStoreOption {
+	return func(f *mongoStoreFactory) {
+		f.credential = &options.Credential{
+			AuthMechanism: mechanism,
+			AuthSource:    source,
+			Username:      username,
+			Password:      password,
+			PasswordSet:   password != "",
+		}
+	}
+}
+
+// buildTLSConfig returns the TLS configuration given by the factory's options, or nil to leave TLS to the connection string
+func (f mongoStoreFactory) buildTLSConfig() (*tls.Config, error) {
+	if f.tlsFiles == nil {
+		return f.tlsConfig, nil
+	}
+
+	config := &tls.Config{}
+	if f.tlsConfig != nil {
+		config = f.tlsConfig.Clone()
+	}
+
+	if f.tlsFiles.caFile != "" {
+		pem, err := ioutil.ReadFile(f.tlsFiles.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %w", err)
+		}
+		if config.RootCAs == nil {
+			config.RootCAs = x509.NewCertPool()
+		}
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file: %s", f.tlsFiles.caFile)
+		}
+	}
+
+	if f.tlsFiles.certFile != "" || f.tlsFiles.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.tlsFiles.certFile, f.tlsFiles.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+
+	return config, nil
+}
@@ -0,0 +1,91 @@
+package msgstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificate writes a self-signed certificate and its key to PEM files in dir
+func writeTestCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "msgstore-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	certFile = path.Join(dir, "cert.pem")
+	keyFile = path.Join(dir, "key.pem")
+	require.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestMongoStoreFactory_TLSFiles(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("MongoStoreTLS-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+	certFile, keyFile := writeTestCertificate(t, rootPath)
+
+	// Given a factory configured for mutual TLS from files, on top of a base config
+	base := &tls.Config{ServerName: "mongo.example.com"}
+	f := NewMongoStoreFactory("mongodb://localhost:27017", "db",
+		WithMongoTLSConfig(base), WithMongoTLSFiles(certFile, certFile, keyFile)).(mongoStoreFactory)
+
+	// Then the driver should trust the CA and present the client certificate
+	opts, err := f.clientOptions()
+	require.Nil(t, err)
+	require.NotNil(t, opts.TLSConfig)
+	assert.NotNil(t, opts.TLSConfig.RootCAs)
+	assert.Len(t, opts.TLSConfig.Certificates, 1)
+	assert.Equal(t, "mongo.example.com", opts.TLSConfig.ServerName)
+
+	// And the base config should be left as it was
+	assert.Nil(t, base.RootCAs)
+	assert.Empty(t, base.Certificates)
+
+	// When the CA file is missing
+	f = NewMongoStoreFactory("mongodb://localhost:27017", "db", WithMongoTLSFiles(path.Join(rootPath, "missing.pem"), "", "")).(mongoStoreFactory)
+
+	// Then creating a store should fail
+	_, err = f.clientOptions()
+	assert.NotNil(t, err)
+	_, err = f.Create("FIX.4.4-SENDER-TARGET")
+	assert.NotNil(t, err)
+}
+
+func TestMongoStoreFactory_Credential(t *testing.T) {
+	// Given a factory authenticating with a client certificate
+	f := NewMongoStoreFactory("mongodb://localhost:27017", "db", WithMongoCredential("MONGODB-X509", "$external", "", "")).(mongoStoreFactory)
+
+	// Then the driver should be given the mechanism without a password
+	opts, err := f.clientOptions()
+	require.Nil(t, err)
+	require.NotNil(t, opts.Auth)
+	assert.Equal(t, "MONGODB-X509", opts.Auth.AuthMechanism)
+	assert.Equal(t, "$external", opts.Auth.AuthSource)
+	assert.False(t, opts.Auth.PasswordSet)
+}
@@ -0,0 +1,66 @@
+package msgstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoMessageTTLIndex names the TTL index on the messages collection's stored_at field
+const mongoMessageTTLIndex = "stored_at_ttl"
+
+// mongoIndexOptionsConflict is the server error code for creating an index that exists with other options
+const mongoIndexOptionsConflict = 85
+
+// WithMongoMessageTTL keeps messages for the retention period ttl, after which the server's TTL monitor deletes them in
+// the background, typically within a minute of expiry.  Each message is stamped with a stored_at time when it is saved;
+// messages saved before stored_at was recorded never expire.  The TTL index is created, or its retention updated, when
+// a store is created.  Defaults to keeping messages until Reset.
+func WithMongoMessageTTL(ttl time.Duration) MongoStoreOption {
+	return func(f *mongoStoreFactory) { f.messageTTL = ttl }
+}
+
+// ensureMessageTTLIndex creates the TTL index expiring messages after ttl, or changes the retention of an existing one
+func (store *mongoStore) ensureMessageTTLIndex(ctx context.Context, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	if ttl < time.Second {
+		return fmt.Errorf("message TTL must be at least 1s, not %s", ttl)
+	}
+	seconds := int32(ttl / time.Second)
+
+	// Cosmos DB only expires documents on its own last modified timestamp, which messages are never updated after saving
+	key := "stored_at"
+	if store.compatibility == MongoCompatibilityCosmosDB {
+		key = "_ts"
+	}
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: key, Value: 1}},
+		Options: options.Index().SetName(mongoMessageTTLIndex).SetExpireAfterSeconds(seconds),
+	}
+
+	_, err := store.messagesCollection.Indexes().CreateOne(ctx, index)
+	if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Code == mongoIndexOptionsConflict {
+		if store.compatibility != "" {
+			// the compatible services cannot collMod an index, so it is replaced
+			if _, err = store.messagesCollection.Indexes().DropOne(ctx, mongoMessageTTLIndex); err == nil {
+				_, err = store.messagesCollection.Indexes().CreateOne(ctx, index)
+			}
+		} else {
+			// the index exists with another retention, which collMod changes in place
+			err = store.messagesCollection.Database().RunCommand(ctx, bson.D{
+				{Key: "collMod", Value: store.messagesCollection.Name()},
+				{Key: "index", Value: bson.D{{Key: "name", Value: mongoMessageTTLIndex}, {Key: "expireAfterSeconds", Value: seconds}}},
+			}).Err()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("unable to create message TTL index: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package msgstore
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func (s *MongoStoreSuite) TestMongoStore_MessageTTL() {
+	// Given a store keeping messages for an hour, recreated with a longer retention
+	factory := NewMongoStoreFactory(s.mongoCxn, "automated_testing_mongostore", WithMongoMessageTTL(time.Hour))
+	store, err := factory.Create(s.sessionID)
+	s.Require().Nil(err)
+	s.Require().Nil(store.Close())
+	store, err = NewMongoStoreFactory(s.mongoCxn, "automated_testing_mongostore", WithMongoMessageTTL(2*time.Hour)).Create(s.sessionID)
+	s.Require().Nil(err)
+	defer store.Close()
+
+	// When a message is saved
+	s.Require().Nil(store.Reset())
+	s.Require().Nil(store.SaveMessage(1, []byte("one")))
+
+	// Then it should be stamped with its store time
+	var doc messageData
+	mongoStore := store.(*mongoStore)
+	s.Require().Nil(mongoStore.messagesCollection.FindOne(context.Background(), bson.M{"session_id": s.sessionID, "msg_seq_num": 1}).Decode(&doc))
+	s.WithinDuration(time.Now(), doc.StoredAt, time.Minute)
+}
+
+func (s *MongoStoreSuite) TestMongoStore_MessageTTLTooShort() {
+	_, err := NewMongoStoreFactory(s.mongoCxn, "automated_testing_mongostore", WithMongoMessageTTL(time.Millisecond)).Create(s.sessionID)
+	s.NotNil(err)
+}
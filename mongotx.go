@@ -0,0 +1,123 @@
+package msgstore
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// mongoStoreTx is a StoreTx in a multi-document transaction
+type mongoStoreTx struct {
+	store      *mongoStore
+	ctx        mongo.SessionContext
+	nextSender int
+	nextTarget int
+	done       bool
+}
+
+// BeginTx starts a multi-document transaction with WithMongoTransactions on servers supporting them, and otherwise a
+// transaction buffered until Commit, see StoreTx and BeginBufferedTx
+func (store *mongoStore) BeginTx() (StoreTx, error) {
+	return store.BeginTxContext(context.Background())
+}
+
+// BeginTxContext is like BeginTx, but the database operations of a multi-document transaction are bounded by ctx.  Those
+// of a buffered transaction are not.
+func (store *mongoStore) BeginTxContext(ctx context.Context) (_ StoreTx, err error) {
+	if !store.transactions || !store.capabilities.transactions {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return BeginBufferedTx(store), nil
+	}
+	defer store.observe("begin_tx", time.Now(), &err)
+
+	session, err := store.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	if err = session.StartTransaction(); err != nil {
+		session.EndSession(ctx)
+		return nil, err
+	}
+	return &mongoStoreTx{
+		store:      store,
+		ctx:        mongo.NewSessionContext(ctx, session),
+		nextSender: store.cache.NextSenderMsgSeqNum(),
+		nextTarget: store.cache.NextTargetMsgSeqNum(),
+	}, nil
+}
+
+func (t *mongoStoreTx) SaveMessage(seqNum int, msg []byte) (err error) {
+	defer t.store.observeSeqNum("save_message", seqNum, time.Now(), &err)
+
+	if t.done {
+		return ErrTxDone
+	}
+	ctx, cancel := t.store.withTimeout(t.ctx, "save_message")
+	defer cancel()
+
+	return t.store.saveMessage(ctx, seqNum, msg)
+}
+
+func (t *mongoStoreTx) SetNextSenderMsgSeqNum(next int) (err error) {
+	defer t.store.observe("set_next_sender_seqnum", time.Now(), &err)
+
+	if t.done {
+		return ErrTxDone
+	}
+	ctx, cancel := t.store.withTimeout(t.ctx, "set_next_sender_seqnum")
+	defer cancel()
+
+	if err := t.store.upsertSession(ctx, bson.M{"outgoing_seq_num": next}); err != nil {
+		return err
+	}
+	t.nextSender = next
+	return nil
+}
+
+func (t *mongoStoreTx) SetNextTargetMsgSeqNum(next int) (err error) {
+	defer t.store.observe("set_next_target_seqnum", time.Now(), &err)
+
+	if t.done {
+		return ErrTxDone
+	}
+	ctx, cancel := t.store.withTimeout(t.ctx, "set_next_target_seqnum")
+	defer cancel()
+
+	if err := t.store.upsertSession(ctx, bson.M{"incoming_seq_num": next}); err != nil {
+		return err
+	}
+	t.nextTarget = next
+	return nil
+}
+
+// Commit commits the multi-document transaction, and then updates the store's seqnums
+func (t *mongoStoreTx) Commit() (err error) {
+	defer t.store.observe("commit_tx", time.Now(), &err)
+
+	if t.done {
+		return ErrTxDone
+	}
+	t.done = true
+	defer t.ctx.EndSession(t.ctx)
+
+	if err := t.ctx.CommitTransaction(t.ctx); err != nil {
+		return err
+	}
+	t.store.cache.SetNextSenderMsgSeqNum(t.nextSender)
+	return t.store.cache.SetNextTargetMsgSeqNum(t.nextTarget)
+}
+
+func (t *mongoStoreTx) Rollback() (err error) {
+	if t.done {
+		return ErrTxDone
+	}
+	defer t.store.observe("rollback_tx", time.Now(), &err)
+
+	t.done = true
+	defer t.ctx.EndSession(t.ctx)
+	return t.ctx.AbortTransaction(t.ctx)
+}
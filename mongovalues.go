@@ -0,0 +1,77 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SetSessionValue stores value under key in the "values" field of the session document, see SessionValueStore.  Keys
+// must be usable as mongo field names, so may not contain "." or start with "$".
+func (store *mongoStore) SetSessionValue(key, value string) error {
+	return store.SetSessionValueContext(context.Background(), key, value)
+}
+
+// SetSessionValueContext is like SetSessionValue, but the database operation is bounded by ctx
+func (store *mongoStore) SetSessionValueContext(ctx context.Context, key, value string) (err error) {
+	defer store.observe("set_session_value", time.Now(), &err)
+
+	if err = checkMongoSessionValueKey(key); err != nil {
+		return err
+	}
+
+	ctx, cancel := store.withTimeout(ctx, "set_session_value")
+	defer cancel()
+
+	return store.withRetry(ctx, func() error {
+		return store.upsertSession(ctx, bson.M{"values." + key: value})
+	})
+}
+
+// GetSessionValue returns the value stored under key, see SessionValueStore
+func (store *mongoStore) GetSessionValue(key string) (string, bool, error) {
+	return store.GetSessionValueContext(context.Background(), key)
+}
+
+// GetSessionValueContext is like GetSessionValue, but the database operation is bounded by ctx
+func (store *mongoStore) GetSessionValueContext(ctx context.Context, key string) (value string, found bool, err error) {
+	defer store.observe("get_session_value", time.Now(), &err)
+
+	if err = checkMongoSessionValueKey(key); err != nil {
+		return "", false, err
+	}
+
+	ctx, cancel := store.withTimeout(ctx, "get_session_value")
+	defer cancel()
+
+	err = store.withRetry(ctx, func() error {
+		var session struct {
+			Values map[string]string `bson:"values"`
+		}
+		opts := options.FindOne().SetProjection(bson.M{"values." + key: 1})
+		err := store.sessionsCollection.FindOne(ctx, store.sessionFilter(), opts).Decode(&session)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			value, found = "", false
+			return nil
+		} else if err != nil {
+			return err
+		}
+		value, found = session.Values[key]
+		return nil
+	})
+	return value, found, err
+}
+
+// checkMongoSessionValueKey rejects keys that mongo would read as a path or operator rather than a field name
+func checkMongoSessionValueKey(key string) error {
+	if key == "" || strings.Contains(key, ".") || strings.HasPrefix(key, "$") {
+		return fmt.Errorf("invalid session value key: %q", key)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package msgstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckMongoSessionValueKey(t *testing.T) {
+	var testCases = []struct {
+		key   string
+		valid bool
+	}{
+		{key: "LastLogon", valid: true},
+		{key: "reset_reason", valid: true},
+		{key: ""},
+		{key: "last.logon"},
+		{key: "$set"},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.valid, checkMongoSessionValueKey(tc.key) == nil, tc.key)
+	}
+}
@@ -0,0 +1,103 @@
+package msgstore
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoSessionEvent is a change to a session persisted by a mongo store: either a saved message, or an update of the
+// session's seqnums, such as an increment or a Reset
+type MongoSessionEvent struct {
+	// Message is the saved message, or nil for a seqnum update
+	Message *SeqMsg
+	// NextSenderMsgSeqNum and NextTargetMsgSeqNum are the session's seqnums after a seqnum update
+	NextSenderMsgSeqNum int
+	NextTargetMsgSeqNum int
+	// ResumeToken may be passed to WatchSession to resume watching after this event
+	ResumeToken []byte
+}
+
+// MongoSessionWatcher is implemented by the mongo stores, so that downstream services such as drop copies can tail a
+// session's persisted traffic without polling.  Change streams require a replica set or sharded cluster.
+type MongoSessionWatcher interface {
+	// WatchSession calls fn with each change to the session as it is persisted, until ctx is done or fn returns an error,
+	// which is returned.  With a resumeToken from an earlier event, the changes after that event are replayed first.
+	WatchSession(ctx context.Context, resumeToken []byte, fn func(MongoSessionEvent) error) error
+}
+
+// mongoChangeEvent holds the parts of a change stream event WatchSession uses
+type mongoChangeEvent struct {
+	NS struct {
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	FullDocument bson.Raw `bson:"fullDocument"`
+}
+
+// WatchSession calls fn with each change to the session as it is persisted, see MongoSessionWatcher
+func (store *mongoStore) WatchSession(ctx context.Context, resumeToken []byte, fn func(MongoSessionEvent) error) error {
+	if !store.capabilities.changeStreams {
+		return ErrMongoChangeStreamsUnsupported
+	}
+
+	messages := store.messagesCollection.Name()
+	sessions := store.sessionsCollection.Name()
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.M{
+			"ns.coll":                 bson.M{"$in": bson.A{messages, sessions}},
+			"operationType":           bson.M{"$in": bson.A{"insert", "update", "replace"}},
+			"fullDocument.session_id": store.sessionID,
+		}}},
+	}
+
+	// seqnum updates only $set the changed fields, so the whole session document is looked up for each
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if resumeToken != nil {
+		opts.SetResumeAfter(bson.Raw(resumeToken))
+	}
+
+	stream, err := store.messagesCollection.Database().Watch(ctx, pipeline, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var change mongoChangeEvent
+		if err := stream.Decode(&change); err != nil {
+			return err
+		}
+
+		event := MongoSessionEvent{ResumeToken: []byte(stream.ResumeToken())}
+		switch change.NS.Coll {
+		case messages:
+			var msg messageData
+			if err := bson.Unmarshal(change.FullDocument, &msg); err != nil {
+				return err
+			}
+			message, err := store.decodeMessage(msg.Message)
+			if err != nil {
+				return err
+			}
+			event.Message = &SeqMsg{SeqNum: msg.MsgSeqNum, Msg: message}
+		case sessions:
+			var session sessionData
+			if err := bson.Unmarshal(change.FullDocument, &session); err != nil {
+				return err
+			}
+			event.NextSenderMsgSeqNum = session.OutgoingSeqNum
+			event.NextTargetMsgSeqNum = session.IncomingSeqNum
+		}
+
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+
+	if err := stream.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return ctx.Err()
+}
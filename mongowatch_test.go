@@ -0,0 +1,51 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+func (s *MongoStoreSuite) TestMongoStore_WatchSession() {
+	if len(os.Getenv("MONGODB_TEST_REPLICA_SET")) <= 0 {
+		log.Println("MONGODB_TEST_REPLICA_SET environment arg is not provided, skipping change streams...")
+		s.T().SkipNow()
+	}
+
+	watcher, ok := s.msgStore.(MongoSessionWatcher)
+	s.Require().True(ok)
+	s.Require().Nil(s.msgStore.Reset())
+
+	// Given a watch on the session
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	events := make(chan MongoSessionEvent, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- watcher.WatchSession(ctx, nil, func(event MongoSessionEvent) error {
+			events <- event
+			if event.Message == nil {
+				return errors.New("seen seqnum update")
+			}
+			return nil
+		})
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	// When a message is saved and the seqnum advanced
+	s.Require().Nil(s.msgStore.SaveMessage(1, []byte("one")))
+	s.Require().Nil(s.msgStore.IncrNextSenderMsgSeqNum())
+
+	// Then both should be observed, in order
+	s.Equal("seen seqnum update", (<-done).Error())
+	message := <-events
+	s.Require().NotNil(message.Message)
+	s.Equal(1, message.Message.SeqNum)
+	s.Equal([]byte("one"), message.Message.Msg)
+	update := <-events
+	s.Nil(update.Message)
+	s.Equal(2, update.NextSenderMsgSeqNum)
+	s.NotEmpty(update.ResumeToken)
+}
@@ -0,0 +1,311 @@
+package msgstore
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// SeqNumChange is a change of the seqnums of a session, see StoreObserver
+type SeqNumChange struct {
+	// Op is the operation changing them, named as in the metrics of the backends, e.g. "incr_next_sender_seqnum",
+	// "commit_tx" or "refresh"
+	Op                     string
+	OldNextSenderMsgSeqNum int
+	NewNextSenderMsgSeqNum int
+	OldNextTargetMsgSeqNum int
+	NewNextTargetMsgSeqNum int
+}
+
+// StoreObserver is notified of the persistence events of a store wrapped with NewObservedStore, e.g. to replicate them,
+// to export metrics or to trigger business logic.  Its methods are called once the event has been persisted, on the
+// goroutine of the operation, which they hold up, so they should return quickly and hand any slow work to another.
+type StoreObserver interface {
+	// OnSave is called with the messages saved by SaveMessage, SaveMessages or the Commit of a transaction
+	OnSave(sessionID string, msgs []SeqMsg)
+	// OnSeqNumChange is called when an operation has changed the seqnums.  Operations leaving them as they were,
+	// such as setting a seqnum to its value, are not reported.
+	OnSeqNumChange(sessionID string, change SeqNumChange)
+	// OnReset is called when the session has been reset, its messages deleted and its seqnums set back to 1.  The
+	// change of the seqnums is not reported separately.
+	OnReset(sessionID string)
+}
+
+// StoreObserverFuncs is a StoreObserver calling its funcs, any of which may be nil to ignore those events
+type StoreObserverFuncs struct {
+	Save         func(sessionID string, msgs []SeqMsg)
+	SeqNumChange func(sessionID string, change SeqNumChange)
+	Reset        func(sessionID string)
+}
+
+func (f StoreObserverFuncs) OnSave(sessionID string, msgs []SeqMsg) {
+	if f.Save != nil {
+		f.Save(sessionID, msgs)
+	}
+}
+
+func (f StoreObserverFuncs) OnSeqNumChange(sessionID string, change SeqNumChange) {
+	if f.SeqNumChange != nil {
+		f.SeqNumChange(sessionID, change)
+	}
+}
+
+func (f StoreObserverFuncs) OnReset(sessionID string) {
+	if f.Reset != nil {
+		f.Reset(sessionID)
+	}
+}
+
+type observedStore struct {
+	storeDecorator
+	sessionID string
+	observers []StoreObserver
+}
+
+// NewObservedStore returns a MessageStore notifying observers, in order, of the saves, seqnum changes and resets of
+// inner, the store of sessionID, whatever its backend.  Failed operations are not reported.  The optional interfaces of
+// inner are forwarded, see storeDecorator, reporting their saves and resets too.
+func NewObservedStore(inner MessageStore, sessionID string, observers ...StoreObserver) MessageStore {
+	return &observedStore{storeDecorator: newStoreDecorator(inner), sessionID: sessionID, observers: observers}
+}
+
+// notifySave notifies the observers of the save of msgs
+func (store *observedStore) notifySave(msgs []SeqMsg) {
+	for _, observer := range store.observers {
+		observer.OnSave(store.sessionID, msgs)
+	}
+}
+
+// seqNums runs op on the inner store, notifying the observers of any change of the seqnums it makes
+func (store *observedStore) seqNums(operation string, op func() error) error {
+	change := SeqNumChange{
+		Op:                     operation,
+		OldNextSenderMsgSeqNum: store.inner.NextSenderMsgSeqNum(),
+		OldNextTargetMsgSeqNum: store.inner.NextTargetMsgSeqNum(),
+	}
+	if err := op(); err != nil {
+		return err
+	}
+	change.NewNextSenderMsgSeqNum = store.inner.NextSenderMsgSeqNum()
+	change.NewNextTargetMsgSeqNum = store.inner.NextTargetMsgSeqNum()
+
+	if change.NewNextSenderMsgSeqNum != change.OldNextSenderMsgSeqNum ||
+		change.NewNextTargetMsgSeqNum != change.OldNextTargetMsgSeqNum {
+		for _, observer := range store.observers {
+			observer.OnSeqNumChange(store.sessionID, change)
+		}
+	}
+	return nil
+}
+
+func (store *observedStore) NextSenderMsgSeqNum() int {
+	return store.inner.NextSenderMsgSeqNum()
+}
+
+func (store *observedStore) NextTargetMsgSeqNum() int {
+	return store.inner.NextTargetMsgSeqNum()
+}
+
+func (store *observedStore) IncrNextSenderMsgSeqNum() error {
+	return store.IncrNextSenderMsgSeqNumContext(context.Background())
+}
+
+func (store *observedStore) IncrNextSenderMsgSeqNumContext(ctx context.Context) error {
+	return store.seqNums("incr_next_sender_seqnum", func() error {
+		return store.storeDecorator.IncrNextSenderMsgSeqNumContext(ctx)
+	})
+}
+
+func (store *observedStore) IncrNextTargetMsgSeqNum() error {
+	return store.IncrNextTargetMsgSeqNumContext(context.Background())
+}
+
+func (store *observedStore) IncrNextTargetMsgSeqNumContext(ctx context.Context) error {
+	return store.seqNums("incr_next_target_seqnum", func() error {
+		return store.storeDecorator.IncrNextTargetMsgSeqNumContext(ctx)
+	})
+}
+
+func (store *observedStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.SetNextSenderMsgSeqNumContext(context.Background(), next)
+}
+
+func (store *observedStore) SetNextSenderMsgSeqNumContext(ctx context.Context, next int) error {
+	return store.seqNums("set_next_sender_seqnum", func() error {
+		return store.storeDecorator.SetNextSenderMsgSeqNumContext(ctx, next)
+	})
+}
+
+func (store *observedStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.SetNextTargetMsgSeqNumContext(context.Background(), next)
+}
+
+func (store *observedStore) SetNextTargetMsgSeqNumContext(ctx context.Context, next int) error {
+	return store.seqNums("set_next_target_seqnum", func() error {
+		return store.storeDecorator.SetNextTargetMsgSeqNumContext(ctx, next)
+	})
+}
+
+func (store *observedStore) CreationTime() time.Time {
+	return store.inner.CreationTime()
+}
+
+func (store *observedStore) SetCreationTime(t time.Time) error {
+	return store.inner.SetCreationTime(t)
+}
+
+func (store *observedStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.SaveMessageContext(context.Background(), seqNum, msg)
+}
+
+func (store *observedStore) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) error {
+	if err := store.storeDecorator.SaveMessageContext(ctx, seqNum, msg); err != nil {
+		return err
+	}
+	store.notifySave([]SeqMsg{{SeqNum: seqNum, Msg: msg}})
+	return nil
+}
+
+func (store *observedStore) SaveMessageWithMeta(seqNum int, msg []byte, meta MessageMeta) error {
+	if err := store.storeDecorator.SaveMessageWithMeta(seqNum, msg, meta); err != nil {
+		return err
+	}
+	store.notifySave([]SeqMsg{{SeqNum: seqNum, Msg: msg}})
+	return nil
+}
+
+func (store *observedStore) SaveMessages(msgs []SeqMsg) error {
+	return store.SaveMessagesContext(context.Background(), msgs)
+}
+
+func (store *observedStore) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) error {
+	if err := store.storeDecorator.SaveMessagesContext(ctx, msgs); err != nil {
+		return err
+	}
+	if len(msgs) > 0 {
+		store.notifySave(msgs)
+	}
+	return nil
+}
+
+func (store *observedStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.inner.GetMessages(beginSeqNum, endSeqNum)
+}
+
+func (store *observedStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return store.inner.GetMessagesSince(seqNum)
+}
+
+func (store *observedStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.inner.GetMessagesDescending(beginSeqNum, endSeqNum)
+}
+
+func (store *observedStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return store.inner.GetMessage(seqNum)
+}
+
+func (store *observedStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.inner.IterateMessages(beginSeqNum, endSeqNum, fn)
+}
+
+func (store *observedStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+func (store *observedStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.inner.DeleteMessagesUpTo(seqNum)
+}
+
+// BeginTxContext returns a transaction of inner whose Commit notifies the observers of its saves and seqnum changes
+func (store *observedStore) BeginTx() (StoreTx, error) {
+	return store.BeginTxContext(context.Background())
+}
+
+func (store *observedStore) BeginTxContext(ctx context.Context) (StoreTx, error) {
+	tx, err := store.storeDecorator.BeginTxContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &observedTx{StoreTx: tx, store: store}, nil
+}
+
+func (store *observedStore) Backup(w io.Writer) error {
+	return store.inner.Backup(w)
+}
+
+// Restore notifies the observers of any change of the seqnums, but not of the messages restored
+func (store *observedStore) Restore(r io.Reader) error {
+	return store.seqNums("restore", func() error { return store.inner.Restore(r) })
+}
+
+func (store *observedStore) HealthCheck(ctx context.Context) error {
+	return store.inner.HealthCheck(ctx)
+}
+
+func (store *observedStore) Flush() error {
+	return store.inner.Flush()
+}
+
+func (store *observedStore) Refresh() error {
+	return store.RefreshContext(context.Background())
+}
+
+// RefreshContext notifies the observers of any change of the seqnums made by another process
+func (store *observedStore) RefreshContext(ctx context.Context) error {
+	return store.seqNums("refresh", func() error { return store.storeDecorator.RefreshContext(ctx) })
+}
+
+func (store *observedStore) Reset() error {
+	return store.ResetContext(context.Background())
+}
+
+func (store *observedStore) ResetContext(ctx context.Context) error {
+	return store.notifyReset(func() error { return store.storeDecorator.ResetContext(ctx) })
+}
+
+func (store *observedStore) ResetWithoutDeletingMessages() error {
+	return store.notifyReset(store.storeDecorator.ResetWithoutDeletingMessages)
+}
+
+// notifyReset runs reset on the inner store, notifying the observers once it succeeds
+func (store *observedStore) notifyReset(reset func() error) error {
+	if err := reset(); err != nil {
+		return err
+	}
+	for _, observer := range store.observers {
+		observer.OnReset(store.sessionID)
+	}
+	return nil
+}
+
+func (store *observedStore) Close() error {
+	return store.inner.Close()
+}
+
+// observedTx is a transaction of the inner store of an observedStore, holding its saves for its Commit to report
+// before its seqnum changes
+type observedTx struct {
+	StoreTx
+	store *observedStore
+	msgs  []SeqMsg
+}
+
+func (tx *observedTx) SaveMessage(seqNum int, msg []byte) error {
+	if err := tx.StoreTx.SaveMessage(seqNum, msg); err != nil {
+		return err
+	}
+	tx.msgs = append(tx.msgs, SeqMsg{SeqNum: seqNum, Msg: msg})
+	return nil
+}
+
+func (tx *observedTx) Commit() error {
+	return tx.store.seqNums("commit_tx", func() error {
+		if err := tx.StoreTx.Commit(); err != nil {
+			return err
+		}
+		if len(tx.msgs) > 0 {
+			tx.store.notifySave(tx.msgs)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,93 @@
+package msgstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// ObservedStoreTestSuite runs all tests in the MessageStoreTestSuite against an observed store
+type ObservedStoreTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *ObservedStoreTestSuite) SetupTest() {
+	inner, err := NewMemoryStoreFactory().Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(suite.T(), err)
+	suite.msgStore = NewObservedStore(inner, "FIX.4.4-SENDER-TARGET", StoreObserverFuncs{})
+}
+
+func TestObservedStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(ObservedStoreTestSuite))
+}
+
+// recordingObserver records the events it is notified of as strings
+type recordingObserver struct {
+	events []string
+}
+
+func (o *recordingObserver) OnSave(sessionID string, msgs []SeqMsg) {
+	for _, msg := range msgs {
+		o.events = append(o.events, sessionID+" save "+string(msg.Msg))
+	}
+}
+
+func (o *recordingObserver) OnSeqNumChange(sessionID string, change SeqNumChange) {
+	o.events = append(o.events, sessionID+" "+change.Op)
+}
+
+func (o *recordingObserver) OnReset(sessionID string) {
+	o.events = append(o.events, sessionID+" reset")
+}
+
+func TestObservedStore(t *testing.T) {
+	// Given an observed store
+	inner, err := NewMemoryStoreFactory().Create("FIX.4.4-A-B")
+	require.Nil(t, err)
+	observer := &recordingObserver{}
+	var changes []SeqNumChange
+	store := NewObservedStore(inner, "FIX.4.4-A-B", observer, StoreObserverFuncs{
+		SeqNumChange: func(sessionID string, change SeqNumChange) { changes = append(changes, change) },
+	})
+
+	// When it is written
+	require.Nil(t, store.SaveMessage(1, []byte("msg1")))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	require.Nil(t, store.SetNextTargetMsgSeqNum(1))
+	tx, err := store.BeginTx()
+	require.Nil(t, err)
+	require.Nil(t, tx.SaveMessage(2, []byte("msg2")))
+	require.Nil(t, tx.SetNextSenderMsgSeqNum(3))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, store.Reset())
+
+	// Then the observers should be notified of each event, but not of the seqnum left as it was
+	assert.Equal(t, []string{
+		"FIX.4.4-A-B save msg1",
+		"FIX.4.4-A-B incr_next_sender_seqnum",
+		"FIX.4.4-A-B save msg2",
+		"FIX.4.4-A-B commit_tx",
+		"FIX.4.4-A-B reset",
+	}, observer.events)
+	assert.Equal(t, []SeqNumChange{
+		{Op: "incr_next_sender_seqnum", OldNextSenderMsgSeqNum: 1, NewNextSenderMsgSeqNum: 2, OldNextTargetMsgSeqNum: 1, NewNextTargetMsgSeqNum: 1},
+		{Op: "commit_tx", OldNextSenderMsgSeqNum: 2, NewNextSenderMsgSeqNum: 3, OldNextTargetMsgSeqNum: 1, NewNextTargetMsgSeqNum: 1},
+	}, changes)
+}
+
+func TestObservedStore_Failure(t *testing.T) {
+	// Given an observed store whose saves fail
+	inner, err := NewMemoryStoreFactory().Create("FIX.4.4-A-B")
+	require.Nil(t, err)
+	observer := &recordingObserver{}
+	store := NewObservedStore(failingSaveStore{inner}, "FIX.4.4-A-B", observer)
+
+	// When a save fails
+	err = store.SaveMessages([]SeqMsg{{SeqNum: 1, Msg: []byte("msg1")}})
+
+	// Then the observers should not be notified
+	assert.EqualError(t, err, "disk full")
+	assert.Empty(t, observer.events)
+}
@@ -0,0 +1,853 @@
+package msgstore
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type pgxStoreFactory struct {
+	connString      string
+	tablePrefix     string
+	duplicatePolicy DuplicateMessagePolicy
+	createTables    bool
+	clock           Clock
+	tlsConfig       *tls.Config
+	detectConflicts bool
+	serializer      RecordSerializer
+
+	mu     sync.Mutex
+	pool   *pgxpool.Pool
+	refs   int
+	closed bool
+}
+
+// PgxStoreOption configures optional behavior of the stores created by a pgx MessageStoreFactory
+type PgxStoreOption func(*pgxStoreFactory)
+
+// WithPgxTableNamePrefix prepends prefix to the names of the database tables
+func WithPgxTableNamePrefix(prefix string) PgxStoreOption {
+	return func(f *pgxStoreFactory) { f.tablePrefix = prefix }
+}
+
+// WithPgxDuplicateMessagePolicy sets what SaveMessage does when a message is already stored for the seqnum.  Defaults to DuplicateMessageError.
+func WithPgxDuplicateMessagePolicy(policy DuplicateMessagePolicy) PgxStoreOption {
+	return func(f *pgxStoreFactory) { f.duplicatePolicy = policy }
+}
+
+// WithPgxClock stamps the creation time of the stores with the time told by clock.  Defaults to the system clock.
+func WithPgxClock(clock Clock) PgxStoreOption {
+	return func(f *pgxStoreFactory) { f.clock = clock }
+}
+
+// WithPgxCreateTables creates the sessions, messages and session values tables at startup if they don't exist
+func WithPgxCreateTables() PgxStoreOption {
+	return func(f *pgxStoreFactory) { f.createTables = true }
+}
+
+// WithPgxConflictDetection makes Refresh fail with an error matching ErrExternallyModified if the stored seqnums moved
+// backward or the creation time changed since the store last loaded or wrote them, leaving the store as it was rather
+// than adopting them
+func WithPgxConflictDetection() PgxStoreOption {
+	return func(f *pgxStoreFactory) { f.detectConflicts = true }
+}
+
+// WithPgxRecordSerializer saves each message as a record wrapped by serializer in an envelope carrying its metadata, see
+// RecordSerializer
+func WithPgxRecordSerializer(serializer RecordSerializer) PgxStoreOption {
+	return func(f *pgxStoreFactory) { f.serializer = serializer }
+}
+
+type pgxStore struct {
+	sessionID       string
+	cache           *memoryStore
+	pool            *pgxpool.Pool
+	releasePool     func()
+	duplicatePolicy DuplicateMessagePolicy
+	sessionsTable   string
+	messagesTable   string
+	messagesIdent   pgx.Identifier
+	valuesTable     string
+	detectConflicts bool
+	serializer      RecordSerializer
+}
+
+// NewPgxStoreFactory returns a postgres implementation of MessageStoreFactory that talks to the database with pgx rather than
+// database/sql, using the binary protocol, COPY for batch saves and a BYTEA message column.  The stores share one connection
+// pool, opened from connString by the first Create and closed with the last store.
+func NewPgxStoreFactory(connString string, opts ...PgxStoreOption) MessageStoreFactory {
+	f := &pgxStoreFactory{connString: connString, duplicatePolicy: DuplicateMessageError}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// Create creates a new pgx implementation of the MessageStore interface
+func (f *pgxStoreFactory) Create(sessionID string) (msgStore MessageStore, err error) {
+	pool, err := f.acquirePool()
+	if err != nil {
+		return nil, fmt.Errorf("sessionID: %s: %w", sessionID, err)
+	}
+
+	store, err := newPgxStore(sessionID, f, pool)
+	if err != nil {
+		f.releasePool()
+		return nil, fmt.Errorf("sessionID: %s: %w", sessionID, err)
+	}
+	return store, nil
+}
+
+// Close stops the factory from creating stores.  The connection pool is closed with the last store using it.
+func (f *pgxStoreFactory) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	return nil
+}
+
+func (f *pgxStoreFactory) acquirePool() (*pgxpool.Pool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, ErrFactoryClosed
+	}
+
+	if f.pool == nil {
+		config, err := pgxpool.ParseConfig(f.connString)
+		if err != nil {
+			return nil, err
+		}
+		if f.tlsConfig != nil {
+			config.ConnConfig.TLSConfig = f.tlsConfig
+		}
+		pool, err := pgxpool.ConnectConfig(context.Background(), config)
+		if err != nil {
+			return nil, err
+		}
+		f.pool = pool
+	}
+	f.refs++
+	return f.pool, nil
+}
+
+func (f *pgxStoreFactory) releasePool() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.refs--; f.refs == 0 {
+		f.pool.Close()
+		f.pool = nil
+	}
+}
+
+// CloneSession copies the session srcID to the session dstID, see SessionCloner
+func (f *pgxStoreFactory) CloneSession(srcID, dstID string) error {
+	return CloneMessageStoreSession(f, srcID, dstID)
+}
+
+// RenameSession moves the session oldID to the session newID in one transaction, see SessionRenamer
+func (f *pgxStoreFactory) RenameSession(oldID, newID string) error {
+	return f.RenameSessionContext(context.Background(), oldID, newID)
+}
+
+// RenameSessionContext is like RenameSession, but the database operations are bounded by ctx
+func (f *pgxStoreFactory) RenameSessionContext(ctx context.Context, oldID, newID string) error {
+	pool, err := f.acquirePool()
+	if err != nil {
+		return err
+	}
+	defer f.releasePool()
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	sessionsTable := pgx.Identifier{f.tablePrefix + "sessions"}.Sanitize()
+	var exists bool
+	if err := tx.QueryRow(ctx, fmt.Sprintf(`SELECT EXISTS(SELECT 1 FROM %s WHERE session_id=$1)`, sessionsTable), newID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("unable to rename session: %s: already stored", newID)
+	}
+
+	tag, err := tx.Exec(ctx, fmt.Sprintf(`UPDATE %s SET session_id=$1 WHERE session_id=$2`, sessionsTable), newID, oldID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("unable to rename session: %s: not found", oldID)
+	}
+	for _, table := range []string{f.tablePrefix + "messages", f.tablePrefix + "session_values"} {
+		if _, err := tx.Exec(ctx, fmt.Sprintf(`UPDATE %s SET session_id=$1 WHERE session_id=$2`, pgx.Identifier{table}.Sanitize()), newID, oldID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// ListSessions returns every session in the factory's sessions table, see SessionLister
+func (f *pgxStoreFactory) ListSessions() ([]SessionInfo, error) {
+	return f.ListSessionsContext(context.Background())
+}
+
+// ListSessionsContext is like ListSessions, but the database operation is bounded by ctx
+func (f *pgxStoreFactory) ListSessionsContext(ctx context.Context) ([]SessionInfo, error) {
+	pool, err := f.acquirePool()
+	if err != nil {
+		return nil, err
+	}
+	defer f.releasePool()
+
+	sessionsTable := pgx.Identifier{f.tablePrefix + "sessions"}.Sanitize()
+	messagesTable := pgx.Identifier{f.tablePrefix + "messages"}.Sanitize()
+	rows, err := pool.Query(ctx, fmt.Sprintf(`SELECT s.session_id, s.creation_time, s.incoming_seqnum, s.outgoing_seqnum, COUNT(m.msgseqnum) FROM %s s LEFT JOIN %s m ON m.session_id=s.session_id GROUP BY s.session_id, s.creation_time, s.incoming_seqnum, s.outgoing_seqnum ORDER BY s.session_id`,
+		sessionsTable, messagesTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var infos []SessionInfo
+	for rows.Next() {
+		var info SessionInfo
+		if err := rows.Scan(&info.SessionID, &info.CreationTime, &info.NextTargetMsgSeqNum, &info.NextSenderMsgSeqNum, &info.MessageCount); err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, rows.Err()
+}
+
+func newPgxStore(sessionID string, f *pgxStoreFactory, pool *pgxpool.Pool) (*pgxStore, error) {
+	store := &pgxStore{
+		sessionID:       sessionID,
+		cache:           &memoryStore{clock: f.clock},
+		pool:            pool,
+		releasePool:     f.releasePool,
+		duplicatePolicy: f.duplicatePolicy,
+		sessionsTable:   pgx.Identifier{f.tablePrefix + "sessions"}.Sanitize(),
+		messagesTable:   pgx.Identifier{f.tablePrefix + "messages"}.Sanitize(),
+		messagesIdent:   pgx.Identifier{f.tablePrefix + "messages"},
+		valuesTable:     pgx.Identifier{f.tablePrefix + "session_values"}.Sanitize(),
+		detectConflicts: f.detectConflicts,
+		serializer:      f.serializer,
+	}
+	store.cache.Reset()
+
+	ctx := context.Background()
+	if f.createTables {
+		if err := store.createTables(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := store.populateCache(ctx); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *pgxStore) createTables(ctx context.Context) error {
+	ddl := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (session_id VARCHAR(128) NOT NULL, creation_time TIMESTAMP NOT NULL, incoming_seqnum INT NOT NULL, outgoing_seqnum INT NOT NULL, PRIMARY KEY (session_id))`, store.sessionsTable),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (session_id VARCHAR(128) NOT NULL, msgseqnum INT NOT NULL, message BYTEA NOT NULL, PRIMARY KEY (session_id, msgseqnum))`, store.messagesTable),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (session_id VARCHAR(128) NOT NULL, name VARCHAR(128) NOT NULL, value TEXT NOT NULL, PRIMARY KEY (session_id, name))`, store.valuesTable),
+	}
+	for _, stmt := range ddl {
+		if _, err := store.pool.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("unable to create tables: %w", err)
+		}
+	}
+	return nil
+}
+
+// Reset deletes the store records and sets the seqnums back to 1
+func (store *pgxStore) Reset() error {
+	return store.ResetContext(context.Background())
+}
+
+// ResetContext is like Reset, but the database operations are bounded by ctx
+func (store *pgxStore) ResetContext(ctx context.Context) (err error) {
+	defer wrapStoreError("pgx", store.sessionID, "reset", 0, &err)
+
+	tx, err := store.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE session_id=$1`, store.messagesTable), store.sessionID); err != nil {
+		return err
+	}
+
+	if err = store.cache.Reset(); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(ctx, store.upsertSessionSQL("creation_time", "incoming_seqnum", "outgoing_seqnum"),
+		store.sessionID, store.cache.CreationTime(), store.cache.NextTargetMsgSeqNum(), store.cache.NextSenderMsgSeqNum()); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// upsertSessionSQL returns a statement writing updateColumns of the session row, inserting the whole row if it has gone missing
+func (store *pgxStore) upsertSessionSQL(updateColumns ...string) string {
+	var sets string
+	for i, c := range updateColumns {
+		if i > 0 {
+			sets += ", "
+		}
+		sets += c + "=excluded." + c
+	}
+	return fmt.Sprintf(`INSERT INTO %s (session_id, creation_time, incoming_seqnum, outgoing_seqnum) VALUES($1, $2, $3, $4) ON CONFLICT (session_id) DO UPDATE SET %s`,
+		store.sessionsTable, sets)
+}
+
+// Refresh reloads the store from the database
+func (store *pgxStore) Refresh() error {
+	return store.RefreshContext(context.Background())
+}
+
+// RefreshContext is like Refresh, but the database operations are bounded by ctx
+func (store *pgxStore) RefreshContext(ctx context.Context) (err error) {
+	defer wrapStoreError("pgx", store.sessionID, "refresh", 0, &err)
+
+	before := snapshotSession(store)
+	if err := store.cache.Reset(); err != nil {
+		return err
+	}
+	if err := store.populateCache(ctx); err != nil {
+		return err
+	}
+
+	// postgres holds the creation time to the microsecond
+	if store.detectConflicts {
+		if err := before.detectConflict(store.sessionID, snapshotSession(store), time.Microsecond); err != nil {
+			before.restore(store.cache)
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *pgxStore) populateCache(ctx context.Context) error {
+	var creationTime time.Time
+	var incomingSeqNum, outgoingSeqNum int
+	row := store.pool.QueryRow(ctx, fmt.Sprintf(`SELECT creation_time, incoming_seqnum, outgoing_seqnum FROM %s WHERE session_id=$1`, store.sessionsTable), store.sessionID)
+	err := row.Scan(&creationTime, &incomingSeqNum, &outgoingSeqNum)
+
+	// session record found, load it
+	if err == nil {
+		store.cache.creationTime = creationTime
+		store.cache.SetNextTargetMsgSeqNum(incomingSeqNum)
+		store.cache.SetNextSenderMsgSeqNum(outgoingSeqNum)
+		return nil
+	}
+
+	// fatal error, give up
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	// session record not found, create it
+	_, err = store.pool.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (creation_time, incoming_seqnum, outgoing_seqnum, session_id) VALUES($1, $2, $3, $4)`, store.sessionsTable),
+		store.cache.creationTime, store.cache.NextTargetMsgSeqNum(), store.cache.NextSenderMsgSeqNum(), store.sessionID)
+	return err
+}
+
+// NextSenderMsgSeqNum returns the next MsgSeqNum that will be sent
+func (store *pgxStore) NextSenderMsgSeqNum() int {
+	return store.cache.NextSenderMsgSeqNum()
+}
+
+// NextTargetMsgSeqNum returns the next MsgSeqNum that should be received
+func (store *pgxStore) NextTargetMsgSeqNum() int {
+	return store.cache.NextTargetMsgSeqNum()
+}
+
+// SetNextSenderMsgSeqNum sets the next MsgSeqNum that will be sent
+func (store *pgxStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.SetNextSenderMsgSeqNumContext(context.Background(), next)
+}
+
+// SetNextSenderMsgSeqNumContext is like SetNextSenderMsgSeqNum, but the database operation is bounded by ctx
+func (store *pgxStore) SetNextSenderMsgSeqNumContext(ctx context.Context, next int) (err error) {
+	defer wrapStoreError("pgx", store.sessionID, "set_next_sender_seqnum", 0, &err)
+
+	_, err = store.pool.Exec(ctx, store.upsertSessionSQL("outgoing_seqnum"), store.sessionID, store.cache.CreationTime(), store.cache.NextTargetMsgSeqNum(), next)
+	if err != nil {
+		return err
+	}
+	return store.cache.SetNextSenderMsgSeqNum(next)
+}
+
+// SetNextTargetMsgSeqNum sets the next MsgSeqNum that should be received
+func (store *pgxStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.SetNextTargetMsgSeqNumContext(context.Background(), next)
+}
+
+// SetNextTargetMsgSeqNumContext is like SetNextTargetMsgSeqNum, but the database operation is bounded by ctx
+func (store *pgxStore) SetNextTargetMsgSeqNumContext(ctx context.Context, next int) (err error) {
+	defer wrapStoreError("pgx", store.sessionID, "set_next_target_seqnum", 0, &err)
+
+	_, err = store.pool.Exec(ctx, store.upsertSessionSQL("incoming_seqnum"), store.sessionID, store.cache.CreationTime(), next, store.cache.NextSenderMsgSeqNum())
+	if err != nil {
+		return err
+	}
+	return store.cache.SetNextTargetMsgSeqNum(next)
+}
+
+// IncrNextSenderMsgSeqNum increments the next MsgSeqNum that will be sent
+func (store *pgxStore) IncrNextSenderMsgSeqNum() error {
+	return store.IncrNextSenderMsgSeqNumContext(context.Background())
+}
+
+// IncrNextSenderMsgSeqNumContext is like IncrNextSenderMsgSeqNum, but the database operation is bounded by ctx
+func (store *pgxStore) IncrNextSenderMsgSeqNumContext(ctx context.Context) error {
+	store.cache.IncrNextSenderMsgSeqNum()
+	return store.SetNextSenderMsgSeqNumContext(ctx, store.cache.NextSenderMsgSeqNum())
+}
+
+// IncrNextTargetMsgSeqNum increments the next MsgSeqNum that should be received
+func (store *pgxStore) IncrNextTargetMsgSeqNum() error {
+	return store.IncrNextTargetMsgSeqNumContext(context.Background())
+}
+
+// IncrNextTargetMsgSeqNumContext is like IncrNextTargetMsgSeqNum, but the database operation is bounded by ctx
+func (store *pgxStore) IncrNextTargetMsgSeqNumContext(ctx context.Context) error {
+	store.cache.IncrNextTargetMsgSeqNum()
+	return store.SetNextTargetMsgSeqNumContext(ctx, store.cache.NextTargetMsgSeqNum())
+}
+
+// CreationTime returns the creation time of the store
+func (store *pgxStore) CreationTime() time.Time {
+	return store.cache.CreationTime()
+}
+
+// SetCreationTime sets the creation time of the session
+func (store *pgxStore) SetCreationTime(t time.Time) error {
+	return store.SetCreationTimeContext(context.Background(), t)
+}
+
+// SetCreationTimeContext is like SetCreationTime, but the database operation is bounded by ctx
+func (store *pgxStore) SetCreationTimeContext(ctx context.Context, t time.Time) (err error) {
+	defer wrapStoreError("pgx", store.sessionID, "set_creation_time", 0, &err)
+
+	_, err = store.pool.Exec(ctx, store.upsertSessionSQL("creation_time"), store.sessionID, t, store.cache.NextTargetMsgSeqNum(), store.cache.NextSenderMsgSeqNum())
+	if err != nil {
+		return err
+	}
+	return store.cache.SetCreationTime(t)
+}
+
+// insertMessageSQL returns a statement inserting a message that resolves seqnum conflicts according to the store's DuplicateMessagePolicy
+func (store *pgxStore) insertMessageSQL() string {
+	stmt := fmt.Sprintf(`INSERT INTO %s (msgseqnum, message, session_id) VALUES($1, $2, $3)`, store.messagesTable)
+	switch store.duplicatePolicy {
+	case DuplicateMessageReplace:
+		return stmt + ` ON CONFLICT (session_id, msgseqnum) DO UPDATE SET message=excluded.message`
+	case DuplicateMessageIgnore:
+		return stmt + ` ON CONFLICT (session_id, msgseqnum) DO NOTHING`
+	}
+	return stmt
+}
+
+func (store *pgxStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.SaveMessageContext(context.Background(), seqNum, msg)
+}
+
+// SaveMessageContext is like SaveMessage, but the database operation is bounded by ctx
+func (store *pgxStore) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) (err error) {
+	defer wrapStoreError("pgx", store.sessionID, "save_message", seqNum, &err)
+
+	if msg, err = store.encodeMessage(seqNum, msg); err != nil {
+		return err
+	}
+	_, err = store.pool.Exec(ctx, store.insertMessageSQL(), seqNum, msg, store.sessionID)
+	return err
+}
+
+// encodeMessage returns msg as it is stored, serialized as a record if configured
+func (store *pgxStore) encodeMessage(seqNum int, msg []byte) ([]byte, error) {
+	if store.serializer == nil {
+		return msg, nil
+	}
+	return encodeRecord(store.serializer, MessageRecord{SessionID: store.sessionID, SeqNum: seqNum, StoredAt: store.cache.now(), Msg: msg})
+}
+
+// SaveMessages saves a batch of messages in a single transaction.  Under DuplicateMessageError they are streamed with COPY,
+// otherwise they are inserted one at a time so that conflicts can be resolved.
+func (store *pgxStore) SaveMessages(msgs []SeqMsg) error {
+	return store.SaveMessagesContext(context.Background(), msgs)
+}
+
+// SaveMessagesContext is like SaveMessages, but the database operations are bounded by ctx
+func (store *pgxStore) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) (err error) {
+	defer wrapStoreError("pgx", store.sessionID, "save_messages", 0, &err)
+
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	messages := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		if messages[i], err = store.encodeMessage(m.SeqNum, m.Msg); err != nil {
+			return err
+		}
+	}
+
+	if store.duplicatePolicy == DuplicateMessageError {
+		rows := make([][]interface{}, len(msgs))
+		for i, m := range msgs {
+			rows[i] = []interface{}{m.SeqNum, messages[i], store.sessionID}
+		}
+		_, err := store.pool.CopyFrom(ctx, store.messagesIdent, []string{"msgseqnum", "message", "session_id"}, pgx.CopyFromRows(rows))
+		return err
+	}
+
+	tx, err := store.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	stmt := store.insertMessageSQL()
+	for i, m := range msgs {
+		if _, err := tx.Exec(ctx, stmt, m.SeqNum, messages[i], store.sessionID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (store *pgxStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.GetMessagesContext(context.Background(), beginSeqNum, endSeqNum)
+}
+
+// GetMessagesContext is like GetMessages, but the database operation is bounded by ctx
+func (store *pgxStore) GetMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int) ([][]byte, error) {
+	var msgs [][]byte
+	err := store.IterateMessagesContext(ctx, beginSeqNum, endSeqNum, func(_ int, msg []byte) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	return msgs, err
+}
+
+// GetMessagesSince returns the messages stored for seqnums after seqNum, see GetMessagesAfter
+func (store *pgxStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return GetMessagesAfter(store, seqNum)
+}
+
+// GetMessagesDescending returns the messages in the range most recent first, see GetMessagesReversed
+func (store *pgxStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return GetMessagesReversed(store, beginSeqNum, endSeqNum)
+}
+
+// GetMessage returns the message stored for seqNum, reporting whether there is one
+func (store *pgxStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return store.GetMessageContext(context.Background(), seqNum)
+}
+
+// GetMessageContext is like GetMessage, but the database operation is bounded by ctx
+func (store *pgxStore) GetMessageContext(ctx context.Context, seqNum int) (msg []byte, found bool, err error) {
+	defer wrapStoreError("pgx", store.sessionID, "get_message", seqNum, &err)
+
+	row := store.pool.QueryRow(ctx, fmt.Sprintf(`SELECT message FROM %s WHERE session_id=$1 AND msgseqnum=$2`, store.messagesTable), store.sessionID, seqNum)
+	if err := row.Scan(&msg); errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if msg, err = decodeRecord(store.serializer, msg); err != nil {
+		return nil, false, err
+	}
+	return msg, true, nil
+}
+
+// IterateMessages calls fn with each message in the range in seqnum order, reading them from the open cursor one at a time.
+// Iteration stops at the first error fn returns, which is returned.
+func (store *pgxStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.IterateMessagesContext(context.Background(), beginSeqNum, endSeqNum, fn)
+}
+
+// IterateMessagesContext is like IterateMessages, but the whole iteration is bounded by ctx
+func (store *pgxStore) IterateMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	var fnErr error
+	err := store.iterateMessages(ctx, beginSeqNum, endSeqNum, func(seqNum int, msg []byte) error {
+		fnErr = fn(seqNum, msg)
+		return fnErr
+	})
+	// the error of fn is the caller's own, so is returned as it is rather than in a StoreError
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+// iterateMessages is IterateMessagesContext, with its errors wrapped in a StoreError
+func (store *pgxStore) iterateMessages(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) (err error) {
+	defer wrapStoreError("pgx", store.sessionID, "iterate_messages", 0, &err)
+
+	rows, err := store.pool.Query(ctx, fmt.Sprintf(`SELECT msgseqnum, message FROM %s WHERE session_id=$1 AND msgseqnum>=$2 AND msgseqnum<=$3 ORDER BY msgseqnum`, store.messagesTable),
+		store.sessionID, beginSeqNum, endSeqNum)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var seqNum int
+		var message []byte
+		if err := rows.Scan(&seqNum, &message); err != nil {
+			return err
+		}
+		if message, err = decodeRecord(store.serializer, message); err != nil {
+			return err
+		}
+		if err := fn(seqNum, message); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// StreamMessages streams the messages in the range in seqnum order, see StreamMessageStore
+func (store *pgxStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+// pgxStoreTx is a StoreTx in a database transaction
+type pgxStoreTx struct {
+	store      *pgxStore
+	ctx        context.Context
+	tx         pgx.Tx
+	nextSender int
+	nextTarget int
+	done       bool
+}
+
+// BeginTx starts a database transaction, see StoreTx
+func (store *pgxStore) BeginTx() (StoreTx, error) {
+	return store.BeginTxContext(context.Background())
+}
+
+// BeginTxContext is like BeginTx, but the database operations of the transaction are bounded by ctx
+func (store *pgxStore) BeginTxContext(ctx context.Context) (_ StoreTx, err error) {
+	defer wrapStoreError("pgx", store.sessionID, "begin_tx", 0, &err)
+
+	tx, err := store.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &pgxStoreTx{store: store, ctx: ctx, tx: tx, nextSender: store.cache.NextSenderMsgSeqNum(), nextTarget: store.cache.NextTargetMsgSeqNum()}, nil
+}
+
+func (t *pgxStoreTx) SaveMessage(seqNum int, msg []byte) (err error) {
+	defer wrapStoreError("pgx", t.store.sessionID, "save_message", seqNum, &err)
+
+	if t.done {
+		return ErrTxDone
+	}
+	if msg, err = t.store.encodeMessage(seqNum, msg); err != nil {
+		return err
+	}
+	_, err = t.tx.Exec(t.ctx, t.store.insertMessageSQL(), seqNum, msg, t.store.sessionID)
+	return err
+}
+
+func (t *pgxStoreTx) SetNextSenderMsgSeqNum(next int) (err error) {
+	defer wrapStoreError("pgx", t.store.sessionID, "set_next_sender_seqnum", 0, &err)
+
+	return t.setSeqNums(t.nextTarget, next, "outgoing_seqnum")
+}
+
+func (t *pgxStoreTx) SetNextTargetMsgSeqNum(next int) (err error) {
+	defer wrapStoreError("pgx", t.store.sessionID, "set_next_target_seqnum", 0, &err)
+
+	return t.setSeqNums(next, t.nextSender, "incoming_seqnum")
+}
+
+// setSeqNums writes the seqnums of the session row in the transaction
+func (t *pgxStoreTx) setSeqNums(nextTarget, nextSender int, updateColumn string) error {
+	if t.done {
+		return ErrTxDone
+	}
+	_, err := t.tx.Exec(t.ctx, t.store.upsertSessionSQL(updateColumn), t.store.sessionID, t.store.cache.CreationTime(), nextTarget, nextSender)
+	if err != nil {
+		return err
+	}
+	t.nextTarget, t.nextSender = nextTarget, nextSender
+	return nil
+}
+
+// Commit commits the database transaction, and then updates the store's seqnums
+func (t *pgxStoreTx) Commit() (err error) {
+	defer wrapStoreError("pgx", t.store.sessionID, "commit_tx", 0, &err)
+
+	if t.done {
+		return ErrTxDone
+	}
+	t.done = true
+
+	if err := t.tx.Commit(t.ctx); err != nil {
+		return err
+	}
+	t.store.cache.SetNextSenderMsgSeqNum(t.nextSender)
+	return t.store.cache.SetNextTargetMsgSeqNum(t.nextTarget)
+}
+
+func (t *pgxStoreTx) Rollback() (err error) {
+	if t.done {
+		return ErrTxDone
+	}
+	defer wrapStoreError("pgx", t.store.sessionID, "rollback_tx", 0, &err)
+
+	t.done = true
+	return t.tx.Rollback(t.ctx)
+}
+
+// SetSessionValue stores value under key in the session values table, see SessionValueStore
+func (store *pgxStore) SetSessionValue(key, value string) error {
+	return store.SetSessionValueContext(context.Background(), key, value)
+}
+
+// SetSessionValueContext is like SetSessionValue, but the database operation is bounded by ctx
+func (store *pgxStore) SetSessionValueContext(ctx context.Context, key, value string) (err error) {
+	defer wrapStoreError("pgx", store.sessionID, "set_session_value", 0, &err)
+
+	_, err = store.pool.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (session_id, name, value) VALUES($1, $2, $3) ON CONFLICT (session_id, name) DO UPDATE SET value=excluded.value`, store.valuesTable),
+		store.sessionID, key, value)
+	return err
+}
+
+// GetSessionValue returns the value stored under key, see SessionValueStore
+func (store *pgxStore) GetSessionValue(key string) (string, bool, error) {
+	return store.GetSessionValueContext(context.Background(), key)
+}
+
+// GetSessionValueContext is like GetSessionValue, but the database operation is bounded by ctx
+func (store *pgxStore) GetSessionValueContext(ctx context.Context, key string) (value string, found bool, err error) {
+	defer wrapStoreError("pgx", store.sessionID, "get_session_value", 0, &err)
+
+	row := store.pool.QueryRow(ctx, fmt.Sprintf(`SELECT value FROM %s WHERE session_id=$1 AND name=$2`, store.valuesTable), store.sessionID, key)
+	if err := row.Scan(&value); errors.Is(err, pgx.ErrNoRows) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// MessageCount returns the number of the session's messages, see MessageStats
+func (store *pgxStore) MessageCount() (int, error) {
+	return store.MessageCountContext(context.Background())
+}
+
+// MessageCountContext is like MessageCount, but the database operation is bounded by ctx
+func (store *pgxStore) MessageCountContext(ctx context.Context) (int, error) {
+	return store.messageStat(ctx, "message_count", "COUNT(*)")
+}
+
+// FirstSeqNum returns the lowest seqnum of the session's messages, or 0 if it has none, see MessageStats
+func (store *pgxStore) FirstSeqNum() (int, error) {
+	return store.FirstSeqNumContext(context.Background())
+}
+
+// FirstSeqNumContext is like FirstSeqNum, but the database operation is bounded by ctx
+func (store *pgxStore) FirstSeqNumContext(ctx context.Context) (int, error) {
+	return store.messageStat(ctx, "first_seqnum", "MIN(msgseqnum)")
+}
+
+// LastSeqNum returns the highest seqnum of the session's messages, or 0 if it has none, see MessageStats
+func (store *pgxStore) LastSeqNum() (int, error) {
+	return store.LastSeqNumContext(context.Background())
+}
+
+// LastSeqNumContext is like LastSeqNum, but the database operation is bounded by ctx
+func (store *pgxStore) LastSeqNumContext(ctx context.Context) (int, error) {
+	return store.messageStat(ctx, "last_seqnum", "MAX(msgseqnum)")
+}
+
+// messageStat computes aggregate over the session's messages, which the primary key index answers
+func (store *pgxStore) messageStat(ctx context.Context, operation, aggregate string) (stat int, err error) {
+	defer wrapStoreError("pgx", store.sessionID, operation, 0, &err)
+
+	var value int64
+	row := store.pool.QueryRow(ctx, fmt.Sprintf(`SELECT COALESCE(%s, 0) FROM %s WHERE session_id=$1`, aggregate, store.messagesTable), store.sessionID)
+	if err := row.Scan(&value); err != nil {
+		return 0, err
+	}
+	return int(value), nil
+}
+
+// DeleteMessagesUpTo deletes the session's messages up to and including seqNum, see MessageStore
+func (store *pgxStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.DeleteMessagesUpToContext(context.Background(), seqNum)
+}
+
+// DeleteMessagesUpToContext is like DeleteMessagesUpTo, but the database operation is bounded by ctx
+func (store *pgxStore) DeleteMessagesUpToContext(ctx context.Context, seqNum int) (err error) {
+	defer wrapStoreError("pgx", store.sessionID, "delete_messages", seqNum, &err)
+
+	_, err = store.pool.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE session_id=$1 AND msgseqnum<=$2`, store.messagesTable), store.sessionID, seqNum)
+	return err
+}
+
+// Ping verifies the database can be reached
+func (store *pgxStore) Ping() error {
+	return store.pool.Ping(context.Background())
+}
+
+// Backup writes the session to w as a portable archive, see BackupMessageStore
+func (store *pgxStore) Backup(w io.Writer) error {
+	return BackupMessageStore(store, w)
+}
+
+// Restore resets the session and restores into it an archive written by Backup, see RestoreMessageStore
+func (store *pgxStore) Restore(r io.Reader) error {
+	return RestoreMessageStore(store, r)
+}
+
+// HealthCheck verifies the database can be reached and the session's row can be read, see MessageStore
+func (store *pgxStore) HealthCheck(ctx context.Context) (err error) {
+	defer wrapStoreError("pgx", store.sessionID, "health_check", 0, &err)
+
+	if err := store.pool.Ping(ctx); err != nil {
+		return err
+	}
+	var outgoingSeqNum int
+	row := store.pool.QueryRow(ctx, fmt.Sprintf(`SELECT outgoing_seqnum FROM %s WHERE session_id=$1`, store.sessionsTable), store.sessionID)
+	if err := row.Scan(&outgoingSeqNum); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	return nil
+}
+
+// Flush does nothing, as every write is committed before it returns
+func (store *pgxStore) Flush() error {
+	return nil
+}
+
+// Close releases the store's share of the factory's connection pool
+func (store *pgxStore) Close() error {
+	if store.pool != nil {
+		store.releasePool()
+		store.pool = nil
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package msgstore
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// PgxStoreTestSuite runs all tests in the MessageStoreTestSuite against the pgx store, given a postgres database in PGX_TEST_CXN
+type PgxStoreTestSuite struct {
+	MessageStoreTestSuite
+	factory MessageStoreFactory
+}
+
+func TestPgxStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(PgxStoreTestSuite))
+}
+
+func (suite *PgxStoreTestSuite) SetupTest() {
+	cxn := os.Getenv("PGX_TEST_CXN")
+	if len(cxn) <= 0 {
+		log.Println("PGX_TEST_CXN environment arg is not provided, skipping...")
+		suite.T().SkipNow()
+	}
+
+	suite.factory = NewPgxStoreFactory(cxn, WithPgxTableNamePrefix("pgx_test_"), WithPgxCreateTables())
+	var err error
+	suite.msgStore, err = suite.factory.Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(suite.T(), err)
+	require.Nil(suite.T(), suite.msgStore.Reset())
+}
+
+func (suite *PgxStoreTestSuite) TearDownTest() {
+	if suite.msgStore != nil {
+		suite.msgStore.Close()
+	}
+}
+
+func (suite *PgxStoreTestSuite) TestPgxStore_SaveMessages() {
+	t := suite.T()
+	saver, ok := suite.msgStore.(MessageBatchSaver)
+	require.True(t, ok)
+
+	// When a batch is copied in
+	msgs := []SeqMsg{{SeqNum: 1, Msg: []byte("one")}, {SeqNum: 2, Msg: []byte{0x00, 0xff}}}
+	require.Nil(t, saver.SaveMessages(msgs))
+
+	// Then each message should be stored byte for byte
+	stored, err := suite.msgStore.(ContextMessageStore).GetMessagesContext(context.Background(), 1, 2)
+	require.Nil(t, err)
+	require.Len(t, stored, 2)
+	assert.Equal(t, []byte{0x00, 0xff}, stored[1])
+}
+
+func (suite *PgxStoreTestSuite) TestPgxStoreFactory_SharedPool() {
+	t := suite.T()
+
+	// Given a second session from the same factory
+	other, err := suite.factory.Create("FIX.4.4-SENDER-OTHER")
+	require.Nil(t, err)
+
+	// Then it should share the first session's pool
+	assert.Equal(t, suite.msgStore.(*pgxStore).pool, other.(*pgxStore).pool)
+
+	// And closing it should leave the first session usable
+	require.Nil(t, other.Close())
+	assert.Nil(t, suite.msgStore.Refresh())
+}
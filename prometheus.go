@@ -0,0 +1,74 @@
+package msgstore
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type prometheusStoreMetrics struct {
+	operations *prometheus.CounterVec
+	durations  *prometheus.HistogramVec
+}
+
+// NewPrometheusStoreMetrics returns a StoreMetrics registering two collectors with registerer, both labelled by session
+// and operation:
+//
+//	msgstore_<subsystem>_operations_total counts operations, with a result label of "success" or "error"
+//	msgstore_<subsystem>_operation_duration_seconds is a histogram of operation latency
+//
+// subsystem keeps the series of each backend apart, e.g. "sql" or "mongo"; an empty subsystem names them
+// msgstore_operations_total and msgstore_operation_duration_seconds, for factories of any backend to share.
+// Collectors already registered by an earlier call with the same subsystem are reused, so several factories can share
+// a registerer.
+func NewPrometheusStoreMetrics(registerer prometheus.Registerer, subsystem string) (StoreMetrics, error) {
+	kind := "message store"
+	if subsystem != "" {
+		kind = subsystem + " " + kind
+	}
+
+	operations := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "msgstore",
+		Subsystem: subsystem,
+		Name:      "operations_total",
+		Help:      "Number of " + kind + " operations by session, operation and result.",
+	}, []string{"session", "operation", "result"})
+
+	durations := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "msgstore",
+		Subsystem: subsystem,
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of " + kind + " operations by session and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"session", "operation"})
+
+	if err := registerer.Register(operations); err != nil {
+		existing, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		if operations, ok = existing.ExistingCollector.(*prometheus.CounterVec); !ok {
+			return nil, err
+		}
+	}
+	if err := registerer.Register(durations); err != nil {
+		existing, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		if durations, ok = existing.ExistingCollector.(*prometheus.HistogramVec); !ok {
+			return nil, err
+		}
+	}
+
+	return &prometheusStoreMetrics{operations: operations, durations: durations}, nil
+}
+
+func (m *prometheusStoreMetrics) ObserveOperation(sessionID, operation string, duration time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.operations.WithLabelValues(sessionID, operation, result).Inc()
+	m.durations.WithLabelValues(sessionID, operation).Observe(duration.Seconds())
+}
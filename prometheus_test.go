@@ -0,0 +1,53 @@
+package msgstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusStoreMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	// Given two factories' metrics sharing a registry
+	metrics1, err := NewPrometheusStoreMetrics(registry, "sql")
+	require.Nil(t, err)
+	metrics2, err := NewPrometheusStoreMetrics(registry, "sql")
+	require.Nil(t, err)
+
+	// When each observes operations
+	metrics1.ObserveOperation("FIX.4.4-SENDER-TARGET", "save_message", time.Millisecond, nil)
+	metrics2.ObserveOperation("FIX.4.4-SENDER-TARGET", "save_message", time.Millisecond, errors.New("disk full"))
+
+	// Then they should be recorded by the same collectors, by result
+	p1 := metrics1.(*prometheusStoreMetrics)
+	p2 := metrics2.(*prometheusStoreMetrics)
+	assert.True(t, p1.operations == p2.operations)
+	assert.True(t, p1.durations == p2.durations)
+	assert.Equal(t, 2, testutil.CollectAndCount(p1.operations))
+	assert.Equal(t, 1, testutil.CollectAndCount(p1.durations))
+}
+
+func TestPrometheusStoreMetrics_Subsystem(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	// Given the metrics of a sql and a mongo factory sharing a registry
+	sqlMetrics, err := NewPrometheusStoreMetrics(registry, "sql")
+	require.Nil(t, err)
+	mongoMetrics, err := NewPrometheusStoreMetrics(registry, "mongo")
+	require.Nil(t, err)
+
+	// When the mongo metrics observe an operation
+	mongoMetrics.ObserveOperation("FIX.4.4-SENDER-TARGET", "save_message", time.Millisecond, nil)
+
+	// Then it should be recorded under the mongo names only
+	operations := mongoMetrics.(*prometheusStoreMetrics).operations
+	assert.False(t, operations == sqlMetrics.(*prometheusStoreMetrics).operations)
+	assert.Equal(t, 1, testutil.CollectAndCount(operations, "msgstore_mongo_operations_total"))
+	assert.Equal(t, 0, testutil.CollectAndCount(sqlMetrics.(*prometheusStoreMetrics).operations))
+}
@@ -0,0 +1,414 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is matched by the QuotaError of every save a quota store refuses, see NewQuotaStore
+var ErrQuotaExceeded = errors.New("message store quota exceeded")
+
+// QuotaPolicy determines what a quota store does with a save that would exceed its quota
+type QuotaPolicy string
+
+const (
+	// QuotaReject refuses the save with a QuotaError
+	QuotaReject QuotaPolicy = "reject"
+	// QuotaEvictOldest deletes the oldest messages of the session until the save fits, refusing it with a QuotaError
+	// if it would not fit without deleting the messages it saves or those after them
+	QuotaEvictOldest QuotaPolicy = "evict_oldest"
+)
+
+// Quota limits the messages a quota store keeps for its session.  A limit of zero is no limit.
+type Quota struct {
+	// MaxMessages is the number of messages kept
+	MaxMessages int
+	// MaxBytes is the total size of the messages kept, as saved, not counting the overhead of the backend
+	MaxBytes int64
+	// Policy is applied to the saves that would exceed the quota.  Defaults to QuotaReject.
+	Policy QuotaPolicy
+	// LowWater is the fraction of the limits that QuotaEvictOldest evicts down to once a save would exceed them, so that
+	// the oldest messages are deleted a chunk at a time rather than with every save.  1 evicts only what the save needs.
+	// Defaults to 0.9.
+	LowWater float64
+}
+
+const defaultQuotaLowWater = 0.9
+
+// QuotaError is returned by the saves a quota store refuses
+type QuotaError struct {
+	SessionID string
+	// Limit is the limit the save would exceed, "messages" or "bytes"
+	Limit string
+	// Max is the value of the limit
+	Max int64
+	// Requested is the usage the save would have resulted in
+	Requested int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("msgstore: session %s: %s: %d %s requested, %d allowed", e.SessionID, ErrQuotaExceeded.Error(),
+		e.Requested, e.Limit, e.Max)
+}
+
+// Is reports whether target is ErrQuotaExceeded, so that callers can test for any refused save with errors.Is
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+type quotaStore struct {
+	storeDecorator
+	sessionID string
+	quota     Quota
+
+	mu sync.Mutex
+	// seqNums are the seqnums of the messages kept, in order, and sizes their sizes
+	seqNums []int
+	sizes   map[int]int
+	bytes   int64
+}
+
+// NewQuotaStore returns a MessageStore enforcing quota on the messages of inner, the store of sessionID, so that a
+// runaway session cannot exhaust a backend shared with others.  It reads the messages of inner to learn their usage,
+// and then keeps track of it, so inner must not be written other than through the returned store, except before a
+// Refresh.  Transactions are buffered, so that their Commit is held to the quota.  The optional interfaces of inner are
+// forwarded, see storeDecorator, holding the messages saved with their meta to the quota too.
+func NewQuotaStore(inner MessageStore, sessionID string, quota Quota) (MessageStore, error) {
+	if quota.Policy == "" {
+		quota.Policy = QuotaReject
+	}
+	if quota.Policy != QuotaReject && quota.Policy != QuotaEvictOldest {
+		return nil, fmt.Errorf("unknown quota policy %q", quota.Policy)
+	}
+	if quota.LowWater == 0 {
+		quota.LowWater = defaultQuotaLowWater
+	}
+	if quota.LowWater < 0 || quota.LowWater > 1 {
+		return nil, fmt.Errorf("quota low water %v is not a fraction of the limits", quota.LowWater)
+	}
+	store := &quotaStore{storeDecorator: newStoreDecorator(inner), sessionID: sessionID, quota: quota}
+	if err := store.scan(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// scan learns the usage of the inner store from its messages.  The store must be locked, or not yet shared.
+func (store *quotaStore) scan() error {
+	store.seqNums, store.sizes, store.bytes = nil, make(map[int]int), 0
+
+	first := 1
+	if stats, ok := store.inner.(MessageStats); ok {
+		var err error
+		if first, err = stats.FirstSeqNum(); err != nil {
+			return err
+		}
+		if first == 0 {
+			return nil
+		}
+	}
+	last, err := lastMessageSeqNum(store.inner)
+	if err != nil || last < first {
+		return err
+	}
+	return store.inner.IterateMessages(first, last, func(seqNum int, msg []byte) error {
+		store.track(seqNum, len(msg))
+		return nil
+	})
+}
+
+// track records the message of seqNum kept with size
+func (store *quotaStore) track(seqNum, size int) {
+	if old, ok := store.sizes[seqNum]; ok {
+		store.bytes -= int64(old)
+	} else {
+		i := sort.SearchInts(store.seqNums, seqNum)
+		store.seqNums = append(store.seqNums, 0)
+		copy(store.seqNums[i+1:], store.seqNums[i:])
+		store.seqNums[i] = seqNum
+	}
+	store.sizes[seqNum] = size
+	store.bytes += int64(size)
+}
+
+// untrack forgets the messages up to seqNum
+func (store *quotaStore) untrack(seqNum int) {
+	i := sort.SearchInts(store.seqNums, seqNum+1)
+	for _, s := range store.seqNums[:i] {
+		store.bytes -= int64(store.sizes[s])
+		delete(store.sizes, s)
+	}
+	store.seqNums = append(store.seqNums[:0], store.seqNums[i:]...)
+}
+
+// save saves msgs with save if they fit the quota, evicting the oldest messages to make them fit under
+// QuotaEvictOldest.  A message of a seqnum already kept is taken to replace it, although inner may keep the message
+// it has under its DuplicateMessagePolicy, so the size inner keeps is read back once it is saved.
+func (store *quotaStore) save(msgs []SeqMsg, save func() error) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	count, bytes := int64(len(store.seqNums)), store.bytes
+	minSeqNum := 0
+	batch := make(map[int]int, len(msgs))
+	// duplicates are the seqnums already kept, or saved more than once by msgs
+	duplicates := make(map[int]bool)
+	for _, msg := range msgs {
+		old, ok := batch[msg.SeqNum]
+		if !ok {
+			old, ok = store.sizes[msg.SeqNum]
+		}
+		if ok {
+			bytes -= int64(old)
+			duplicates[msg.SeqNum] = true
+		} else {
+			count++
+		}
+		bytes += int64(len(msg.Msg))
+		batch[msg.SeqNum] = len(msg.Msg)
+		if minSeqNum == 0 || msg.SeqNum < minSeqNum {
+			minSeqNum = msg.SeqNum
+		}
+	}
+
+	boundary := 0
+	if store.quota.Policy == QuotaEvictOldest && store.exceeds(count, bytes) {
+		for _, seqNum := range store.seqNums {
+			if seqNum >= minSeqNum || !store.exceedsLowWater(count, bytes) {
+				break
+			}
+			count--
+			bytes -= int64(store.sizes[seqNum])
+			boundary = seqNum
+		}
+	}
+	if err := store.quotaError(count, bytes); err != nil {
+		return err
+	}
+
+	if boundary > 0 {
+		if err := store.inner.DeleteMessagesUpTo(boundary); err != nil {
+			return err
+		}
+		store.untrack(boundary)
+	}
+	if err := save(); err != nil {
+		return err
+	}
+	for seqNum, size := range batch {
+		if duplicates[seqNum] {
+			stored, err := store.storedSize(seqNum)
+			if err != nil {
+				return err
+			}
+			size = stored
+		}
+		store.track(seqNum, size)
+	}
+	return nil
+}
+
+// storedSize returns the size of the message inner keeps for seqNum
+func (store *quotaStore) storedSize(seqNum int) (size int, err error) {
+	err = store.inner.IterateMessages(seqNum, seqNum, func(_ int, msg []byte) error {
+		size = len(msg)
+		return nil
+	})
+	return size, err
+}
+
+// exceeds reports whether count messages of bytes exceed the quota
+func (store *quotaStore) exceeds(count, bytes int64) bool {
+	return store.quotaError(count, bytes) != nil
+}
+
+// exceedsLowWater reports whether count messages of bytes exceed the low water fraction of the quota
+func (store *quotaStore) exceedsLowWater(count, bytes int64) bool {
+	if store.quota.MaxMessages > 0 && float64(count) > store.quota.LowWater*float64(store.quota.MaxMessages) {
+		return true
+	}
+	return store.quota.MaxBytes > 0 && float64(bytes) > store.quota.LowWater*float64(store.quota.MaxBytes)
+}
+
+// quotaError returns the QuotaError of count messages of bytes, or nil if they fit the quota
+func (store *quotaStore) quotaError(count, bytes int64) error {
+	if store.quota.MaxMessages > 0 && count > int64(store.quota.MaxMessages) {
+		return &QuotaError{SessionID: store.sessionID, Limit: "messages", Max: int64(store.quota.MaxMessages), Requested: count}
+	}
+	if store.quota.MaxBytes > 0 && bytes > store.quota.MaxBytes {
+		return &QuotaError{SessionID: store.sessionID, Limit: "bytes", Max: store.quota.MaxBytes, Requested: bytes}
+	}
+	return nil
+}
+
+// rescan runs op on the inner store, then learns its usage again
+func (store *quotaStore) rescan(op func() error) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	err := op()
+	if scanErr := store.scan(); err == nil {
+		err = scanErr
+	}
+	return err
+}
+
+func (store *quotaStore) NextSenderMsgSeqNum() int {
+	return store.inner.NextSenderMsgSeqNum()
+}
+
+func (store *quotaStore) NextTargetMsgSeqNum() int {
+	return store.inner.NextTargetMsgSeqNum()
+}
+
+func (store *quotaStore) IncrNextSenderMsgSeqNum() error {
+	return store.inner.IncrNextSenderMsgSeqNum()
+}
+
+func (store *quotaStore) IncrNextTargetMsgSeqNum() error {
+	return store.inner.IncrNextTargetMsgSeqNum()
+}
+
+func (store *quotaStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.inner.SetNextSenderMsgSeqNum(next)
+}
+
+func (store *quotaStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.inner.SetNextTargetMsgSeqNum(next)
+}
+
+func (store *quotaStore) CreationTime() time.Time {
+	return store.inner.CreationTime()
+}
+
+func (store *quotaStore) SetCreationTime(t time.Time) error {
+	return store.inner.SetCreationTime(t)
+}
+
+func (store *quotaStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.SaveMessageContext(context.Background(), seqNum, msg)
+}
+
+// SaveMessageContext refuses a message exceeding the quota with a QuotaError, unless the oldest messages are evicted
+// for it
+func (store *quotaStore) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) error {
+	return store.save([]SeqMsg{{SeqNum: seqNum, Msg: msg}}, func() error {
+		return store.storeDecorator.SaveMessageContext(ctx, seqNum, msg)
+	})
+}
+
+func (store *quotaStore) SaveMessageWithMeta(seqNum int, msg []byte, meta MessageMeta) error {
+	return store.save([]SeqMsg{{SeqNum: seqNum, Msg: msg}}, func() error {
+		return store.storeDecorator.SaveMessageWithMeta(seqNum, msg, meta)
+	})
+}
+
+func (store *quotaStore) SaveMessages(msgs []SeqMsg) error {
+	return store.SaveMessagesContext(context.Background(), msgs)
+}
+
+// SaveMessagesContext refuses messages exceeding the quota together with a QuotaError, unless the oldest messages are
+// evicted for them
+func (store *quotaStore) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) error {
+	return store.save(msgs, func() error { return store.storeDecorator.SaveMessagesContext(ctx, msgs) })
+}
+
+func (store *quotaStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.inner.GetMessages(beginSeqNum, endSeqNum)
+}
+
+func (store *quotaStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return store.inner.GetMessagesSince(seqNum)
+}
+
+func (store *quotaStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.inner.GetMessagesDescending(beginSeqNum, endSeqNum)
+}
+
+func (store *quotaStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return store.inner.GetMessage(seqNum)
+}
+
+func (store *quotaStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.inner.IterateMessages(beginSeqNum, endSeqNum, fn)
+}
+
+func (store *quotaStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+func (store *quotaStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.DeleteMessagesUpToContext(context.Background(), seqNum)
+}
+
+func (store *quotaStore) DeleteMessagesUpToContext(ctx context.Context, seqNum int) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.storeDecorator.DeleteMessagesUpToContext(ctx, seqNum); err != nil {
+		return err
+	}
+	store.untrack(seqNum)
+	return nil
+}
+
+func (store *quotaStore) BeginTx() (StoreTx, error) {
+	return BeginBufferedTx(store), nil
+}
+
+// BeginTxContext buffers the transaction like BeginTx, its Commit saving without a context
+func (store *quotaStore) BeginTxContext(ctx context.Context) (StoreTx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return store.BeginTx()
+}
+
+func (store *quotaStore) Backup(w io.Writer) error {
+	return store.inner.Backup(w)
+}
+
+// Restore restores inner and learns its usage again, without holding the restored messages to the quota
+func (store *quotaStore) Restore(r io.Reader) error {
+	return store.rescan(func() error { return store.inner.Restore(r) })
+}
+
+func (store *quotaStore) HealthCheck(ctx context.Context) error {
+	return store.inner.HealthCheck(ctx)
+}
+
+func (store *quotaStore) Flush() error {
+	return store.inner.Flush()
+}
+
+func (store *quotaStore) Refresh() error {
+	return store.RefreshContext(context.Background())
+}
+
+// RefreshContext refreshes inner and learns its usage again
+func (store *quotaStore) RefreshContext(ctx context.Context) error {
+	return store.rescan(func() error { return store.storeDecorator.RefreshContext(ctx) })
+}
+
+func (store *quotaStore) Reset() error {
+	return store.ResetContext(context.Background())
+}
+
+func (store *quotaStore) ResetContext(ctx context.Context) error {
+	return store.rescan(func() error { return store.storeDecorator.ResetContext(ctx) })
+}
+
+// ResetWithoutDeletingMessages resets inner keeping its messages, which no longer count against the quota once they
+// are not read
+func (store *quotaStore) ResetWithoutDeletingMessages() error {
+	return store.rescan(store.storeDecorator.ResetWithoutDeletingMessages)
+}
+
+func (store *quotaStore) Close() error {
+	return store.inner.Close()
+}
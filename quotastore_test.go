@@ -0,0 +1,134 @@
+package msgstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// QuotaStoreTestSuite runs all tests in the MessageStoreTestSuite against a quota store
+type QuotaStoreTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *QuotaStoreTestSuite) SetupTest() {
+	inner, err := NewMemoryStoreFactory().Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(suite.T(), err)
+	suite.msgStore, err = NewQuotaStore(inner, "FIX.4.4-SENDER-TARGET", Quota{MaxMessages: 1000, MaxBytes: 1 << 20})
+	require.Nil(suite.T(), err)
+}
+
+func TestQuotaStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(QuotaStoreTestSuite))
+}
+
+// newQuotaSession returns a store of a session with 5 messages of 5 bytes
+func newQuotaSession(t *testing.T) MessageStore {
+	store, err := NewMemoryStoreFactory().Create("FIX.4.4-A-B")
+	require.Nil(t, err)
+	for seqNum := 1; seqNum <= 5; seqNum++ {
+		require.Nil(t, store.SaveMessage(seqNum, []byte(fmt.Sprintf("msg%02d", seqNum))))
+	}
+	require.Nil(t, store.SetNextSenderMsgSeqNum(6))
+	return store
+}
+
+func TestQuotaStore_Reject(t *testing.T) {
+	// Given a quota store of 6 messages over a session of 5
+	store, err := NewQuotaStore(newQuotaSession(t), "FIX.4.4-A-B", Quota{MaxMessages: 6})
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessage(6, []byte("msg06")))
+
+	// When another message is saved
+	err = store.SaveMessage(7, []byte("msg07"))
+
+	// Then it should be refused
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	var quotaErr *QuotaError
+	require.True(t, errors.As(err, &quotaErr))
+	assert.Equal(t, QuotaError{SessionID: "FIX.4.4-A-B", Limit: "messages", Max: 6, Requested: 7}, *quotaErr)
+	_, found, _ := store.GetMessage(7)
+	assert.False(t, found)
+
+	// And a message overwriting another should still be saved
+	assert.Nil(t, store.SaveMessage(6, []byte("msg06")))
+
+	// And messages should be saved again once others are deleted
+	require.Nil(t, store.DeleteMessagesUpTo(2))
+	assert.Nil(t, store.SaveMessages([]SeqMsg{{SeqNum: 7, Msg: []byte("msg07")}, {SeqNum: 8, Msg: []byte("msg08")}}))
+}
+
+func TestQuotaStore_EvictOldest(t *testing.T) {
+	// Given a quota store of 20 bytes evicting the oldest messages only as needed, over a session of 25
+	store, err := NewQuotaStore(newQuotaSession(t), "FIX.4.4-A-B", Quota{MaxBytes: 20, Policy: QuotaEvictOldest, LowWater: 1})
+	require.Nil(t, err)
+
+	// When more messages are saved
+	require.Nil(t, store.SaveMessages([]SeqMsg{{SeqNum: 6, Msg: []byte("msg06")}, {SeqNum: 7, Msg: []byte("msg07")}}))
+
+	// Then the oldest messages should be evicted to make room
+	msgs, err := store.GetMessages(1, 7)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("msg04"), []byte("msg05"), []byte("msg06"), []byte("msg07")}, msgs)
+
+	// And a message that cannot fit should be refused
+	err = store.SaveMessage(8, make([]byte, 21))
+	assert.EqualError(t, err, "msgstore: session FIX.4.4-A-B: message store quota exceeded: 21 bytes requested, 20 allowed")
+}
+
+func TestQuotaStore_EvictToLowWater(t *testing.T) {
+	// Given a quota store of 5 messages evicting the oldest down to 60% of the quota, over a session of 5
+	store, err := NewQuotaStore(newQuotaSession(t), "FIX.4.4-A-B", Quota{MaxMessages: 5, Policy: QuotaEvictOldest, LowWater: 0.6})
+	require.Nil(t, err)
+
+	// When a message is saved past the quota
+	require.Nil(t, store.SaveMessage(6, []byte("msg06")))
+
+	// Then the oldest messages should be evicted down to the low water mark
+	msgs, err := store.GetMessages(1, 6)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("msg04"), []byte("msg05"), []byte("msg06")}, msgs)
+
+	// And the next saves should fit without evicting
+	require.Nil(t, store.SaveMessage(7, []byte("msg07")))
+	require.Nil(t, store.SaveMessage(8, []byte("msg08")))
+	msgs, err = store.GetMessages(1, 8)
+	require.Nil(t, err)
+	assert.Len(t, msgs, 5)
+}
+
+func TestQuotaStore_DuplicateIgnored(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("QuotaStoreDuplicateIgnored-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+
+	// Given a quota store of 10 bytes over a file store ignoring duplicates, holding a message of 5
+	inner, err := NewFileStoreFactory(map[string]string{FileStorePath: rootPath, FileStoreDuplicateMessagePolicy: string(DuplicateMessageIgnore)}).Create("FIX.4.4-A-B")
+	require.Nil(t, err)
+	defer inner.Close()
+	store, err := NewQuotaStore(inner, "FIX.4.4-A-B", Quota{MaxBytes: 10})
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessage(1, []byte("msg01")))
+
+	// When a smaller message is saved for its seqnum, and ignored by the file store
+	require.Nil(t, store.SaveMessage(1, []byte("m")))
+
+	// Then the quota should still count the message kept, refusing a message of 6 bytes
+	assert.True(t, errors.Is(store.SaveMessage(2, []byte("msg002")), ErrQuotaExceeded))
+	assert.Nil(t, store.SaveMessage(2, []byte("msg02")))
+}
+
+func TestNewQuotaStore_UnknownPolicy(t *testing.T) {
+	_, err := NewQuotaStore(newQuotaSession(t), "FIX.4.4-A-B", Quota{MaxMessages: 1, Policy: "evict_newest"})
+	assert.EqualError(t, err, `unknown quota policy "evict_newest"`)
+}
+
+func TestNewQuotaStore_LowWater(t *testing.T) {
+	_, err := NewQuotaStore(newQuotaSession(t), "FIX.4.4-A-B", Quota{MaxMessages: 1, LowWater: 1.5})
+	assert.EqualError(t, err, "quota low water 1.5 is not a fraction of the limits")
+}
@@ -0,0 +1,196 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrReadOnly is matched by the ReadOnlyError of every mutation of a read-only store, see NewReadOnlyStore
+var ErrReadOnly = errors.New("message store is read-only")
+
+// ReadOnlyError is returned by the mutations of a read-only store, which are refused without reaching its backend
+type ReadOnlyError struct {
+	// Op is the name of the refused operation, as reported to metrics, e.g. "save_message"
+	Op string
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("msgstore: %s: %s", e.Op, ErrReadOnly.Error())
+}
+
+// Is reports whether target is ErrReadOnly, so that callers can test for any refused mutation with errors.Is
+func (e *ReadOnlyError) Is(target error) bool {
+	return target == ErrReadOnly
+}
+
+type readOnlyStore struct {
+	storeDecorator
+}
+
+// NewReadOnlyStore returns a MessageStore that reads inner, and Refreshes it to pick up the writes of the engine owning
+// the session, but refuses every mutation with a ReadOnlyError, so that analysis tools and secondary processes cannot
+// write the session through it.  Transactions are refused too.  Close closes inner.  The reads of the optional
+// interfaces of inner are forwarded, see storeDecorator, and their mutations refused.
+//
+// Only the returned store is read-only: creating inner may itself write the backend, as the factories of the package
+// create the session's records or files when missing, and, as configured, migrate the schema, claim the session lease
+// or start pruning.  Point tools at production backends with those settings off, on sessions that exist.
+func NewReadOnlyStore(inner MessageStore) MessageStore {
+	return &readOnlyStore{storeDecorator: newStoreDecorator(inner)}
+}
+
+func (store *readOnlyStore) NextSenderMsgSeqNum() int {
+	return store.inner.NextSenderMsgSeqNum()
+}
+
+func (store *readOnlyStore) NextTargetMsgSeqNum() int {
+	return store.inner.NextTargetMsgSeqNum()
+}
+
+func (store *readOnlyStore) IncrNextSenderMsgSeqNum() error {
+	return &ReadOnlyError{Op: "incr_next_sender_seqnum"}
+}
+
+func (store *readOnlyStore) IncrNextTargetMsgSeqNum() error {
+	return &ReadOnlyError{Op: "incr_next_target_seqnum"}
+}
+
+func (store *readOnlyStore) SetNextSenderMsgSeqNum(next int) error {
+	return &ReadOnlyError{Op: "set_next_sender_seqnum"}
+}
+
+func (store *readOnlyStore) SetNextTargetMsgSeqNum(next int) error {
+	return &ReadOnlyError{Op: "set_next_target_seqnum"}
+}
+
+func (store *readOnlyStore) IncrNextSenderMsgSeqNumContext(ctx context.Context) error {
+	return store.IncrNextSenderMsgSeqNum()
+}
+
+func (store *readOnlyStore) IncrNextTargetMsgSeqNumContext(ctx context.Context) error {
+	return store.IncrNextTargetMsgSeqNum()
+}
+
+func (store *readOnlyStore) SetNextSenderMsgSeqNumContext(ctx context.Context, next int) error {
+	return store.SetNextSenderMsgSeqNum(next)
+}
+
+func (store *readOnlyStore) SetNextTargetMsgSeqNumContext(ctx context.Context, next int) error {
+	return store.SetNextTargetMsgSeqNum(next)
+}
+
+func (store *readOnlyStore) CreationTime() time.Time {
+	return store.inner.CreationTime()
+}
+
+func (store *readOnlyStore) SetCreationTime(t time.Time) error {
+	return &ReadOnlyError{Op: "set_creation_time"}
+}
+
+func (store *readOnlyStore) SetCreationTimeContext(ctx context.Context, t time.Time) error {
+	return store.SetCreationTime(t)
+}
+
+func (store *readOnlyStore) SaveMessage(seqNum int, msg []byte) error {
+	return &ReadOnlyError{Op: "save_message"}
+}
+
+func (store *readOnlyStore) SaveMessages(msgs []SeqMsg) error {
+	return &ReadOnlyError{Op: "save_messages"}
+}
+
+func (store *readOnlyStore) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) error {
+	return store.SaveMessage(seqNum, msg)
+}
+
+func (store *readOnlyStore) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) error {
+	return store.SaveMessages(msgs)
+}
+
+func (store *readOnlyStore) SaveMessageWithMeta(seqNum int, msg []byte, meta MessageMeta) error {
+	return &ReadOnlyError{Op: "save_message"}
+}
+
+func (store *readOnlyStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.inner.GetMessages(beginSeqNum, endSeqNum)
+}
+
+func (store *readOnlyStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return store.inner.GetMessagesSince(seqNum)
+}
+
+func (store *readOnlyStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.inner.GetMessagesDescending(beginSeqNum, endSeqNum)
+}
+
+func (store *readOnlyStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return store.inner.GetMessage(seqNum)
+}
+
+func (store *readOnlyStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.inner.IterateMessages(beginSeqNum, endSeqNum, fn)
+}
+
+func (store *readOnlyStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return store.inner.StreamMessages(ctx, beginSeqNum, endSeqNum)
+}
+
+func (store *readOnlyStore) DeleteMessagesUpTo(seqNum int) error {
+	return &ReadOnlyError{Op: "delete_messages"}
+}
+
+func (store *readOnlyStore) DeleteMessagesUpToContext(ctx context.Context, seqNum int) error {
+	return store.DeleteMessagesUpTo(seqNum)
+}
+
+func (store *readOnlyStore) BeginTx() (StoreTx, error) {
+	return nil, &ReadOnlyError{Op: "begin_tx"}
+}
+
+func (store *readOnlyStore) BeginTxContext(ctx context.Context) (StoreTx, error) {
+	return store.BeginTx()
+}
+
+func (store *readOnlyStore) Backup(w io.Writer) error {
+	return store.inner.Backup(w)
+}
+
+func (store *readOnlyStore) Restore(r io.Reader) error {
+	return &ReadOnlyError{Op: "restore"}
+}
+
+func (store *readOnlyStore) HealthCheck(ctx context.Context) error {
+	return store.inner.HealthCheck(ctx)
+}
+
+// Flush does nothing, as the store writes nothing
+func (store *readOnlyStore) Flush() error {
+	return nil
+}
+
+func (store *readOnlyStore) Refresh() error {
+	return store.inner.Refresh()
+}
+
+func (store *readOnlyStore) Reset() error {
+	return &ReadOnlyError{Op: "reset"}
+}
+
+func (store *readOnlyStore) ResetContext(ctx context.Context) error {
+	return store.Reset()
+}
+
+func (store *readOnlyStore) ResetWithoutDeletingMessages() error {
+	return &ReadOnlyError{Op: "reset"}
+}
+
+func (store *readOnlyStore) SetSessionValue(key, value string) error {
+	return &ReadOnlyError{Op: "set_session_value"}
+}
+
+func (store *readOnlyStore) Close() error {
+	return store.inner.Close()
+}
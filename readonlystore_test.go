@@ -0,0 +1,100 @@
+package msgstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnlyStore_Reads(t *testing.T) {
+	// Given a read-only store over a session written by its engine
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	require.Nil(t, inner.SaveMessage(1, []byte("one")))
+	require.Nil(t, inner.SaveMessage(2, []byte("two")))
+	require.Nil(t, inner.SetNextSenderMsgSeqNum(3))
+	store := NewReadOnlyStore(inner)
+
+	// When it is read
+	msgs, err := store.GetMessages(1, 2)
+	require.Nil(t, err)
+	msg, found, err := store.GetMessage(2)
+	require.Nil(t, err)
+	var archive bytes.Buffer
+	require.Nil(t, store.Backup(&archive))
+
+	// Then it should read the session
+	assert.Equal(t, [][]byte{[]byte("one"), []byte("two")}, msgs)
+	assert.True(t, found)
+	assert.Equal(t, []byte("two"), msg)
+	assert.Equal(t, 3, store.NextSenderMsgSeqNum())
+	assert.Nil(t, store.Refresh())
+	assert.Nil(t, store.Flush())
+}
+
+func TestReadOnlyStore_Mutations(t *testing.T) {
+	// Given a read-only store
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	require.Nil(t, inner.SaveMessage(1, []byte("one")))
+	store := NewReadOnlyStore(inner)
+
+	// When it is mutated
+	mutations := map[string]func() error{
+		"incr_next_sender_seqnum": store.IncrNextSenderMsgSeqNum,
+		"incr_next_target_seqnum": store.IncrNextTargetMsgSeqNum,
+		"set_next_sender_seqnum":  func() error { return store.SetNextSenderMsgSeqNum(5) },
+		"set_next_target_seqnum":  func() error { return store.SetNextTargetMsgSeqNum(5) },
+		"set_creation_time":       func() error { return store.SetCreationTime(time.Now()) },
+		"save_message":            func() error { return store.SaveMessage(2, []byte("two")) },
+		"save_messages":           func() error { return store.SaveMessages([]SeqMsg{{SeqNum: 2, Msg: []byte("two")}}) },
+		"delete_messages":         func() error { return store.DeleteMessagesUpTo(1) },
+		"begin_tx":                func() error { _, err := store.BeginTx(); return err },
+		"restore":                 func() error { return store.Restore(&bytes.Buffer{}) },
+		"reset":                   store.Reset,
+	}
+
+	// Then each mutation should be refused without reaching the session
+	for op, mutate := range mutations {
+		err := mutate()
+		var readOnlyErr *ReadOnlyError
+		require.True(t, errors.As(err, &readOnlyErr), op)
+		assert.Equal(t, op, readOnlyErr.Op)
+		assert.True(t, errors.Is(err, ErrReadOnly), op)
+	}
+	assert.Equal(t, 1, inner.NextSenderMsgSeqNum())
+	msgs, err := inner.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("one")}, msgs)
+}
+
+func TestReadOnlyStore_ForwardedMutations(t *testing.T) {
+	// Given a read-only store over a store implementing the optional interfaces
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	store := NewReadOnlyStore(inner)
+
+	// When it is mutated through them
+	mutations := []func() error{
+		func() error { return store.(SessionValueStore).SetSessionValue("key", "value") },
+		func() error { return store.(SeqNumResetter).ResetWithoutDeletingMessages() },
+		func() error { return store.(MessageMetaStore).SaveMessageWithMeta(1, []byte("one"), MessageMeta{}) },
+		func() error {
+			return store.(ContextMessageStore).SaveMessageContext(context.Background(), 1, []byte("one"))
+		},
+		func() error { return store.(ContextMessageStore).ResetContext(context.Background()) },
+	}
+
+	// Then each mutation should be refused without reaching the session
+	for i, mutate := range mutations {
+		assert.True(t, errors.Is(mutate(), ErrReadOnly), i)
+	}
+	_, found, err := inner.(SessionValueStore).GetSessionValue("key")
+	require.Nil(t, err)
+	assert.False(t, found)
+	_, found, err = inner.GetMessage(1)
+	require.Nil(t, err)
+	assert.False(t, found)
+}
@@ -0,0 +1,82 @@
+package msgstore
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// recordMessageMarker leads every message saved as a record, followed by the envelope the RecordSerializer wrapped it in
+const recordMessageMarker byte = 0x02
+
+// RecordSchemaVersion is the version of MessageRecord that stores stamp the records they save with, so that consumers of
+// the stored data can tell how to read them
+const RecordSchemaVersion = 1
+
+// ErrRecordChecksum is returned when the checksum of a record read from storage does not match its message.  It is
+// wrapped in a StoreError, so test for it with errors.Is.
+var ErrRecordChecksum = errors.New("record checksum mismatch")
+
+var recordChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// MessageRecord is a message along with the metadata a RecordSerializer wraps it in
+type MessageRecord struct {
+	// SchemaVersion is the RecordSchemaVersion the record was saved under
+	SchemaVersion int
+	SessionID     string
+	SeqNum        int
+	// Direction is MessageOutgoing for messages saved by SaveMessage
+	Direction MessageDirection
+	StoredAt  time.Time
+	// Checksum is the CRC-32C of Msg, which stores verify when they read the record
+	Checksum uint32
+	Msg      []byte
+}
+
+// RecordSerializer wraps each message a store saves in a self-describing envelope, e.g. protobuf or msgpack, so that
+// downstream consumers of the stored data need not know the store that saved it.  Records are stored behind a marker
+// byte, and compressed and encrypted where the backend is configured to, so messages saved without a serializer, before
+// or after it is set, are still read as is.
+type RecordSerializer interface {
+	// Marshal returns the envelope of record
+	Marshal(record MessageRecord) ([]byte, error)
+	// Unmarshal returns the record of an envelope returned by Marshal
+	Unmarshal(data []byte) (MessageRecord, error)
+}
+
+// encodeRecord returns record serialized behind the marker byte, completing its schema version and checksum
+func encodeRecord(serializer RecordSerializer, record MessageRecord) ([]byte, error) {
+	record.SchemaVersion = RecordSchemaVersion
+	if record.Direction == "" {
+		record.Direction = MessageOutgoing
+	}
+	record.StoredAt = record.StoredAt.UTC()
+	record.Checksum = crc32.Checksum(record.Msg, recordChecksumTable)
+
+	data, err := serializer.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal record: %w", err)
+	}
+	return append([]byte{recordMessageMarker}, data...), nil
+}
+
+// decodeRecord returns the message of a record serialized by encodeRecord after verifying its checksum, and returns
+// messages without the marker byte as is
+func decodeRecord(serializer RecordSerializer, message []byte) ([]byte, error) {
+	if len(message) == 0 || message[0] != recordMessageMarker {
+		return message, nil
+	}
+	if serializer == nil {
+		return nil, fmt.Errorf("unable to unmarshal record: no record serializer")
+	}
+
+	record, err := serializer.Unmarshal(message[1:])
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal record: %w", err)
+	}
+	if crc32.Checksum(record.Msg, recordChecksumTable) != record.Checksum {
+		return nil, fmt.Errorf("seqnum %d: %w", record.SeqNum, ErrRecordChecksum)
+	}
+	return record.Msg, nil
+}
@@ -0,0 +1,145 @@
+package msgstore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jsonRecordSerializer wraps messages in JSON envelopes
+type jsonRecordSerializer struct{}
+
+func (jsonRecordSerializer) Marshal(record MessageRecord) ([]byte, error) {
+	return json.Marshal(record)
+}
+
+func (jsonRecordSerializer) Unmarshal(data []byte) (record MessageRecord, err error) {
+	err = json.Unmarshal(data, &record)
+	return record, err
+}
+
+func TestEncodeRecord(t *testing.T) {
+	msg := []byte("8=FIX.4.4\x0135=D\x01")
+	storedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Given a message encoded as a record
+	encoded, err := encodeRecord(jsonRecordSerializer{}, MessageRecord{SessionID: "FIX.4.4-SENDER-TARGET", SeqNum: 3, StoredAt: storedAt, Msg: msg})
+	require.Nil(t, err)
+
+	// Then the envelope should follow the marker and carry the metadata
+	assert.Equal(t, recordMessageMarker, encoded[0])
+	record, err := jsonRecordSerializer{}.Unmarshal(encoded[1:])
+	require.Nil(t, err)
+	assert.Equal(t, RecordSchemaVersion, record.SchemaVersion)
+	assert.Equal(t, "FIX.4.4-SENDER-TARGET", record.SessionID)
+	assert.Equal(t, 3, record.SeqNum)
+	assert.Equal(t, MessageOutgoing, record.Direction)
+	assert.True(t, storedAt.Equal(record.StoredAt))
+	assert.NotEqual(t, uint32(0), record.Checksum)
+
+	// And it should decode to the message
+	decoded, err := decodeRecord(jsonRecordSerializer{}, encoded)
+	require.Nil(t, err)
+	assert.Equal(t, msg, decoded)
+
+	// And messages saved without a serializer should be read as is
+	decoded, err = decodeRecord(jsonRecordSerializer{}, msg)
+	require.Nil(t, err)
+	assert.Equal(t, msg, decoded)
+
+	// And records should not be read without a serializer
+	_, err = decodeRecord(nil, encoded)
+	assert.NotNil(t, err)
+
+	// And a record whose message does not match its checksum should be refused
+	record.Msg = []byte("8=FIX.4.4\x0135=F\x01")
+	tampered, err := jsonRecordSerializer{}.Marshal(record)
+	require.Nil(t, err)
+	_, err = decodeRecord(jsonRecordSerializer{}, append([]byte{recordMessageMarker}, tampered...))
+	assert.True(t, errors.Is(err, ErrRecordChecksum))
+}
+
+func TestFileStore_RecordSerializer(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("FileStoreRecordSerializer-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+	settings := map[string]string{FileStorePath: rootPath}
+
+	// Given a message saved before the serializer was set
+	store, err := NewFileStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessage(1, []byte("8=FIX.4.4\x0135=D\x01")))
+	require.Nil(t, store.Close())
+
+	// When a message is saved with the serializer
+	store, err = NewFileStoreFactory(settings, WithFileRecordSerializer(jsonRecordSerializer{})).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+	require.Nil(t, store.SaveMessage(2, []byte("8=FIX.4.4\x0135=8\x01")))
+
+	// Then it should be stored as a record
+	raw, found, err := store.(*fileStore).readMessage(2)
+	require.Nil(t, err)
+	require.True(t, found)
+	assert.Equal(t, recordMessageMarker, raw[0])
+
+	// And both messages should be read as saved, also after compaction
+	expected := [][]byte{[]byte("8=FIX.4.4\x0135=D\x01"), []byte("8=FIX.4.4\x0135=8\x01")}
+	msgs, err := store.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, expected, msgs)
+	require.Nil(t, store.SaveMessage(3, []byte("8=FIX.4.4\x0135=0\x01")))
+	require.Nil(t, store.DeleteMessagesUpTo(2))
+	msgs, err = store.GetMessages(1, 3)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("8=FIX.4.4\x0135=0\x01")}, msgs)
+}
+
+func TestSQLStore_RecordSerializer(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreRecordSerializer-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	settings := map[string]string{
+		SQLStoreDriver:             "sqlite3",
+		SQLStoreDataSourceName:     path.Join(rootPath, "records.db"),
+		SQLStoreAutoMigrate:        "Y",
+		SQLStoreMessageColumnType:  "binary",
+		SQLStoreMessageCompression: "zstd",
+	}
+	store, err := NewSQLStoreFactory(settings, WithSQLStoreRecordSerializer(jsonRecordSerializer{})).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Given a saved message
+	msg := []byte("8=FIX.4.4\x0135=D\x01")
+	require.Nil(t, store.SaveMessage(1, msg))
+
+	// Then the store should read it back
+	msgs, err := store.GetMessages(1, 1)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{msg}, msgs)
+
+	// And the database should hold it as a compressed record
+	db, err := sql.Open("sqlite3", settings[SQLStoreDataSourceName])
+	require.Nil(t, err)
+	defer db.Close()
+	var raw []byte
+	require.Nil(t, db.QueryRow(`SELECT message FROM messages`).Scan(&raw))
+	decompressed, err := decompressMessage(raw)
+	require.Nil(t, err)
+	assert.Equal(t, recordMessageMarker, decompressed[0])
+
+	// And the serializer should require a binary message column
+	delete(settings, SQLStoreMessageColumnType)
+	delete(settings, SQLStoreMessageCompression)
+	_, err = NewSQLStoreFactory(settings, WithSQLStoreRecordSerializer(jsonRecordSerializer{})).Create("FIX.4.4-SENDER-TARGET")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,154 @@
+package msgstore
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	// StoreType is the name of the backend that CreateFromConfig creates stores with, as registered with Register,
+	// e.g. "file" or "sql"
+	StoreType string = "StoreType"
+
+	// MongoStoreURL is the connection string of the "mongo" backend of CreateFromConfig
+	MongoStoreURL string = "MongoStoreURL"
+	// MongoStoreDatabase is the database of the "mongo" backend of CreateFromConfig
+	MongoStoreDatabase string = "MongoStoreDatabase"
+	// MongoStoreTableNamePrefix will be prepended to the names of the collections.  Optional.
+	MongoStoreTableNamePrefix string = "MongoStoreTableNamePrefix"
+	// MongoStoreDuplicateMessagePolicy is one of "error", "replace" or "ignore", see DuplicateMessagePolicy.  Optional, defaults to "error".
+	MongoStoreDuplicateMessagePolicy string = "MongoStoreDuplicateMessagePolicy"
+
+	// PgxStoreConnString is the connection string of the "pgx" backend of CreateFromConfig
+	PgxStoreConnString string = "PgxStoreConnString"
+	// PgxStoreTableNamePrefix will be prepended to the names of the database tables.  Optional.
+	PgxStoreTableNamePrefix string = "PgxStoreTableNamePrefix"
+	// PgxStoreDuplicateMessagePolicy is one of "error", "replace" or "ignore", see DuplicateMessagePolicy.  Optional, defaults to "error".
+	PgxStoreDuplicateMessagePolicy string = "PgxStoreDuplicateMessagePolicy"
+	// PgxStoreCreateTables, when set to "Y", creates the tables at startup if they don't exist.  Optional, defaults to "N".
+	PgxStoreCreateTables string = "PgxStoreCreateTables"
+)
+
+// StoreFactoryFunc returns the MessageStoreFactory of a backend configured by settings
+type StoreFactoryFunc func(settings map[string]string) (MessageStoreFactory, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]StoreFactoryFunc)
+)
+
+func init() {
+	Register(string(BackendMemory), func(map[string]string) (MessageStoreFactory, error) { return NewMemoryStoreFactory(), nil })
+	Register(string(BackendFile), func(settings map[string]string) (MessageStoreFactory, error) {
+		return NewFileStoreFactory(settings), nil
+	})
+	Register(string(BackendSQL), func(settings map[string]string) (MessageStoreFactory, error) {
+		return NewSQLStoreFactory(settings), nil
+	})
+	Register(string(BackendWAL), func(settings map[string]string) (MessageStoreFactory, error) {
+		return NewWALStoreFactory(settings), nil
+	})
+	Register(string(BackendPgx), newPgxStoreFactoryFromConfig)
+	Register(string(BackendMongo), newMongoStoreFactoryFromConfig)
+}
+
+// Register makes a backend available to CreateFromConfig under name, so that third-party backends can be selected by
+// configuration like the built-in "memory", "file", "wal", "sql", "pgx" and "mongo".  It is meant to be called from the
+// init function of the backend's package, and panics if name is already registered or factory is nil.
+func Register(name string, factory StoreFactoryFunc) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("msgstore: Register factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("msgstore: Register called twice for store type " + name)
+	}
+	registry[name] = factory
+}
+
+// StoreTypes returns the sorted names of the registered backends
+func StoreTypes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewFactoryFromConfig returns the MessageStoreFactory of the backend named by the StoreType setting, configured by the
+// other settings.  Stores sharing connections should be created from one factory rather than with CreateFromConfig.
+func NewFactoryFromConfig(settings map[string]string) (MessageStoreFactory, error) {
+	storeType, ok := settings[StoreType]
+	if !ok {
+		return nil, fmt.Errorf("required setting not found: %s", StoreType)
+	}
+
+	registryMu.RLock()
+	factory, ok := registry[storeType]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("invalid setting: %s: unknown store type: %s", StoreType, storeType)
+	}
+	return factory(settings)
+}
+
+// CreateFromConfig creates the MessageStore of a session with the backend named by the StoreType setting, see
+// NewFactoryFromConfig
+func CreateFromConfig(sessionID string, settings map[string]string) (MessageStore, error) {
+	factory, err := NewFactoryFromConfig(settings)
+	if err != nil {
+		return nil, fmt.Errorf("sessionID: %s: %w", sessionID, err)
+	}
+	return factory.Create(sessionID)
+}
+
+func newPgxStoreFactoryFromConfig(settings map[string]string) (MessageStoreFactory, error) {
+	connString, ok := settings[PgxStoreConnString]
+	if !ok {
+		return nil, fmt.Errorf("required setting not found: %s", PgxStoreConnString)
+	}
+
+	opts := []PgxStoreOption{WithPgxTableNamePrefix(settings[PgxStoreTableNamePrefix])}
+	if policyStr, ok := settings[PgxStoreDuplicateMessagePolicy]; ok {
+		policy, err := parseDuplicateMessagePolicy(policyStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid setting: %s: %w", PgxStoreDuplicateMessagePolicy, err)
+		}
+		opts = append(opts, WithPgxDuplicateMessagePolicy(policy))
+	}
+	if createStr, ok := settings[PgxStoreCreateTables]; ok {
+		create, err := parseBoolSetting(createStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid setting: %s: %w", PgxStoreCreateTables, err)
+		}
+		if create {
+			opts = append(opts, WithPgxCreateTables())
+		}
+	}
+	return NewPgxStoreFactory(connString, opts...), nil
+}
+
+func newMongoStoreFactoryFromConfig(settings map[string]string) (MessageStoreFactory, error) {
+	for _, required := range []string{MongoStoreURL, MongoStoreDatabase} {
+		if _, ok := settings[required]; !ok {
+			return nil, fmt.Errorf("required setting not found: %s", required)
+		}
+	}
+
+	var opts []MongoStoreOption
+	if policyStr, ok := settings[MongoStoreDuplicateMessagePolicy]; ok {
+		policy, err := parseDuplicateMessagePolicy(policyStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid setting: %s: %w", MongoStoreDuplicateMessagePolicy, err)
+		}
+		opts = append(opts, WithMongoDuplicateMessagePolicy(policy))
+	}
+	return NewMongoStoreFactoryWithTablePrefix(settings[MongoStoreURL], settings[MongoStoreDatabase], settings[MongoStoreTableNamePrefix], opts...), nil
+}
@@ -0,0 +1,71 @@
+package msgstore
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateFromConfig(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("RegistryFileStore-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+
+	// Given settings selecting the file backend
+	settings := map[string]string{StoreType: "file", FileStorePath: rootPath}
+
+	// When a store is created from them
+	store, err := CreateFromConfig("FIX.4.4-SENDER-TARGET", settings)
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Then it should be a file store
+	assert.IsType(t, &fileStore{}, store)
+}
+
+func TestCreateFromConfig_InvalidSettings(t *testing.T) {
+	testCases := []map[string]string{
+		{},
+		{StoreType: "bogus"},
+		{StoreType: "pgx"},
+		{StoreType: "pgx", PgxStoreConnString: "postgres://localhost", PgxStoreCreateTables: "maybe"},
+		{StoreType: "mongo", MongoStoreURL: "mongodb://localhost"},
+		{StoreType: "mongo", MongoStoreURL: "mongodb://localhost", MongoStoreDatabase: "fix", MongoStoreDuplicateMessagePolicy: "bogus"},
+	}
+
+	for _, settings := range testCases {
+		_, err := CreateFromConfig("FIX.4.4-SENDER-TARGET", settings)
+		assert.NotNil(t, err, "settings: %v", settings)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	// Given a third-party backend
+	var created map[string]string
+	Register("test-registry", func(settings map[string]string) (MessageStoreFactory, error) {
+		created = settings
+		return NewMemoryStoreFactory(), nil
+	})
+	defer func() {
+		registryMu.Lock()
+		delete(registry, "test-registry")
+		registryMu.Unlock()
+	}()
+
+	// When a store is created with it
+	settings := map[string]string{StoreType: "test-registry", "TestSetting": "Y"}
+	store, err := CreateFromConfig("FIX.4.4-SENDER-TARGET", settings)
+	require.Nil(t, err)
+
+	// Then it should have been given the settings
+	assert.NotNil(t, store)
+	assert.Equal(t, settings, created)
+	assert.Contains(t, StoreTypes(), "test-registry")
+
+	// And registering a nil factory or a registered name should panic
+	assert.Panics(t, func() { Register("test-registry", nil) })
+	assert.Panics(t, func() { Register("file", func(map[string]string) (MessageStoreFactory, error) { return nil, nil }) })
+}
@@ -0,0 +1,376 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ReplicationPolicy is what the stores of NewReplicatingStoreFactory do when a write to the secondary store fails
+type ReplicationPolicy int
+
+const (
+	// ReplicationFail returns the failure of the secondary store.  The write has already been made on the primary.
+	ReplicationFail ReplicationPolicy = iota
+	// ReplicationBestEffort reports the failure of the secondary store to the Logger and carries on
+	ReplicationBestEffort
+)
+
+// ReplicationOption configures the stores of NewReplicatingStoreFactory
+type ReplicationOption func(*replicatingStoreFactory)
+
+// WithReplicationLogger reports the failures of the secondary stores to logger.  Defaults to discarding them.
+func WithReplicationLogger(logger Logger) ReplicationOption {
+	return func(f *replicatingStoreFactory) { f.logger = logger }
+}
+
+type replicatingStoreFactory struct {
+	primaryFactory, secondaryFactory MessageStoreFactory
+	policy                           ReplicationPolicy
+	logger                           Logger
+}
+
+// replicatingStore decorates the primary store, forwarding its optional interfaces, and replicates the writes of them
+// to secondary, the decorator of the secondary store
+type replicatingStore struct {
+	storeDecorator
+	sessionID string
+	secondary storeDecorator
+	policy    ReplicationPolicy
+	logger    Logger
+}
+
+// NewReplicatingStoreFactory returns a MessageStoreFactory whose stores write to the stores of both primaryFactory and
+// secondaryFactory, e.g. the file backend for a local fast path and the sql backend for a central archive, and read
+// from the primary ones only.  Writes go to the primary store first, and policy decides whether a failure of the
+// secondary fails them.  The secondary store is given the primary's creation time and seqnums when it is created,
+// reset and refreshed, and the seqnums after every change, so that one missed under ReplicationBestEffort does not
+// leave it behind; missed messages are not replayed.  Under ReplicationBestEffort, Create returns the bare primary store
+// of a session whose secondary store cannot be created: the session is then not replicated at all, not even once the
+// secondary backend recovers, until its store is created again, e.g. when the process restarts.  The optional
+// interfaces of the primary stores are forwarded, see storeDecorator, their writes replicated too.
+func NewReplicatingStoreFactory(primaryFactory, secondaryFactory MessageStoreFactory, policy ReplicationPolicy, opts ...ReplicationOption) MessageStoreFactory {
+	f := &replicatingStoreFactory{primaryFactory: primaryFactory, secondaryFactory: secondaryFactory, policy: policy}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// Create creates a new replicating store of the MessageStore interface
+func (f *replicatingStoreFactory) Create(sessionID string) (MessageStore, error) {
+	primary, err := f.primaryFactory.Create(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	secondary, err := f.secondaryFactory.Create(sessionID)
+	if err != nil {
+		if f.policy != ReplicationBestEffort {
+			primary.Close()
+			return nil, err
+		}
+		// the session runs on the primary alone until it is recreated
+		f.logf("msgstore: unable to create the secondary store of session %s: %s", sessionID, err.Error())
+		return primary, nil
+	}
+
+	store := &replicatingStore{
+		storeDecorator: newStoreDecorator(primary),
+		sessionID:      sessionID,
+		secondary:      newStoreDecorator(secondary),
+		policy:         f.policy,
+		logger:         f.logger,
+	}
+	if err := store.replicateSession(context.Background()); err != nil {
+		primary.Close()
+		secondary.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// Close closes both factories, returning the first error
+func (f *replicatingStoreFactory) Close() error {
+	primaryErr := f.primaryFactory.Close()
+	if err := f.secondaryFactory.Close(); err != nil && primaryErr == nil {
+		return err
+	}
+	return primaryErr
+}
+
+// CloneSession copies the session srcID from the primary backend to the session dstID of both backends, see
+// SessionCloner
+func (f *replicatingStoreFactory) CloneSession(srcID, dstID string) error {
+	return CloneMessageStoreSession(f, srcID, dstID)
+}
+
+// ListSessions lists the sessions of the primary backend, if its factory is a SessionLister
+func (f *replicatingStoreFactory) ListSessions() ([]SessionInfo, error) {
+	lister, ok := f.primaryFactory.(SessionLister)
+	if !ok {
+		return nil, errors.New("the primary backend cannot list its sessions")
+	}
+	return lister.ListSessions()
+}
+
+func (f *replicatingStoreFactory) logf(format string, v ...interface{}) {
+	if f.logger != nil {
+		f.logger.Printf(format, v...)
+	}
+}
+
+// writeBoth applies op to primary and then to secondary, the stores of the two backends written by the replicating and
+// migration stores, returning the failure of secondary as handled by secondaryFailed
+func writeBoth(primary, secondary *storeDecorator, op func(d *storeDecorator) error, secondaryFailed func(err error) error) error {
+	if err := op(primary); err != nil {
+		return err
+	}
+	if err := op(secondary); err != nil {
+		return secondaryFailed(err)
+	}
+	return nil
+}
+
+// syncSession gives d the creation time and seqnums of src, so that the stores of the two backends written by the
+// replicating and migration stores agree on the session as they are created and reset
+func syncSession(ctx context.Context, d *storeDecorator, src MessageStore) error {
+	if err := d.SetCreationTimeContext(ctx, src.CreationTime()); err != nil {
+		return err
+	}
+	if err := d.SetNextSenderMsgSeqNumContext(ctx, src.NextSenderMsgSeqNum()); err != nil {
+		return err
+	}
+	return d.SetNextTargetMsgSeqNumContext(ctx, src.NextTargetMsgSeqNum())
+}
+
+// replicationFailed handles the failure of the secondary store to replicate operation by the policy
+func (store *replicatingStore) replicationFailed(operation string, err error) error {
+	if store.policy == ReplicationBestEffort {
+		if store.logger != nil {
+			store.logger.Printf("msgstore: unable to replicate %s of session %s: %s", operation, store.sessionID, err.Error())
+		}
+		return nil
+	}
+	return fmt.Errorf("unable to replicate %s: %w", operation, err)
+}
+
+// replicate applies op to the secondary store, handling its failure by the policy
+func (store *replicatingStore) replicate(operation string, op func(d *storeDecorator) error) error {
+	if err := op(&store.secondary); err != nil {
+		return store.replicationFailed(operation, err)
+	}
+	return nil
+}
+
+// write applies op to the primary store and then to the secondary
+func (store *replicatingStore) write(operation string, op func(d *storeDecorator) error) error {
+	return writeBoth(&store.storeDecorator, &store.secondary, op, func(err error) error { return store.replicationFailed(operation, err) })
+}
+
+// replicateSession gives the secondary store the creation time and seqnums of the primary
+func (store *replicatingStore) replicateSession(ctx context.Context) error {
+	return store.replicate("session", func(d *storeDecorator) error { return syncSession(ctx, d, store.inner) })
+}
+
+func (store *replicatingStore) NextSenderMsgSeqNum() int {
+	return store.inner.NextSenderMsgSeqNum()
+}
+
+func (store *replicatingStore) NextTargetMsgSeqNum() int {
+	return store.inner.NextTargetMsgSeqNum()
+}
+
+func (store *replicatingStore) IncrNextSenderMsgSeqNum() error {
+	return store.IncrNextSenderMsgSeqNumContext(context.Background())
+}
+
+// IncrNextSenderMsgSeqNumContext increments the next sender seqnum of the primary store, and sets the secondary's to it
+func (store *replicatingStore) IncrNextSenderMsgSeqNumContext(ctx context.Context) error {
+	if err := store.storeDecorator.IncrNextSenderMsgSeqNumContext(ctx); err != nil {
+		return err
+	}
+	return store.replicate("incr_next_sender_seqnum", func(d *storeDecorator) error {
+		return d.SetNextSenderMsgSeqNumContext(ctx, store.inner.NextSenderMsgSeqNum())
+	})
+}
+
+func (store *replicatingStore) IncrNextTargetMsgSeqNum() error {
+	return store.IncrNextTargetMsgSeqNumContext(context.Background())
+}
+
+// IncrNextTargetMsgSeqNumContext increments the next target seqnum of the primary store, and sets the secondary's to it
+func (store *replicatingStore) IncrNextTargetMsgSeqNumContext(ctx context.Context) error {
+	if err := store.storeDecorator.IncrNextTargetMsgSeqNumContext(ctx); err != nil {
+		return err
+	}
+	return store.replicate("incr_next_target_seqnum", func(d *storeDecorator) error {
+		return d.SetNextTargetMsgSeqNumContext(ctx, store.inner.NextTargetMsgSeqNum())
+	})
+}
+
+func (store *replicatingStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.SetNextSenderMsgSeqNumContext(context.Background(), next)
+}
+
+func (store *replicatingStore) SetNextSenderMsgSeqNumContext(ctx context.Context, next int) error {
+	return store.write("set_next_sender_seqnum", func(d *storeDecorator) error {
+		return d.SetNextSenderMsgSeqNumContext(ctx, next)
+	})
+}
+
+func (store *replicatingStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.SetNextTargetMsgSeqNumContext(context.Background(), next)
+}
+
+func (store *replicatingStore) SetNextTargetMsgSeqNumContext(ctx context.Context, next int) error {
+	return store.write("set_next_target_seqnum", func(d *storeDecorator) error {
+		return d.SetNextTargetMsgSeqNumContext(ctx, next)
+	})
+}
+
+func (store *replicatingStore) CreationTime() time.Time {
+	return store.inner.CreationTime()
+}
+
+func (store *replicatingStore) SetCreationTime(t time.Time) error {
+	return store.SetCreationTimeContext(context.Background(), t)
+}
+
+func (store *replicatingStore) SetCreationTimeContext(ctx context.Context, t time.Time) error {
+	return store.write("set_creation_time", func(d *storeDecorator) error { return d.SetCreationTimeContext(ctx, t) })
+}
+
+func (store *replicatingStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.SaveMessageContext(context.Background(), seqNum, msg)
+}
+
+func (store *replicatingStore) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) error {
+	return store.write("save_message", func(d *storeDecorator) error { return d.SaveMessageContext(ctx, seqNum, msg) })
+}
+
+func (store *replicatingStore) SaveMessageWithMeta(seqNum int, msg []byte, meta MessageMeta) error {
+	return store.write("save_message", func(d *storeDecorator) error { return d.SaveMessageWithMeta(seqNum, msg, meta) })
+}
+
+func (store *replicatingStore) SaveMessages(msgs []SeqMsg) error {
+	return store.SaveMessagesContext(context.Background(), msgs)
+}
+
+func (store *replicatingStore) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) error {
+	return store.write("save_messages", func(d *storeDecorator) error { return d.SaveMessagesContext(ctx, msgs) })
+}
+
+func (store *replicatingStore) SetSessionValue(key, value string) error {
+	return store.write("set_session_value", func(d *storeDecorator) error { return d.SetSessionValue(key, value) })
+}
+
+func (store *replicatingStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.inner.GetMessages(beginSeqNum, endSeqNum)
+}
+
+func (store *replicatingStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return store.inner.GetMessagesSince(seqNum)
+}
+
+func (store *replicatingStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.inner.GetMessagesDescending(beginSeqNum, endSeqNum)
+}
+
+func (store *replicatingStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return store.inner.GetMessage(seqNum)
+}
+
+func (store *replicatingStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.inner.IterateMessages(beginSeqNum, endSeqNum, fn)
+}
+
+func (store *replicatingStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return store.inner.StreamMessages(ctx, beginSeqNum, endSeqNum)
+}
+
+// BeginTx starts a transaction buffered until Commit, which writes to both stores like the store's other writes, see
+// BeginBufferedTx
+func (store *replicatingStore) BeginTx() (StoreTx, error) {
+	return BeginBufferedTx(store), nil
+}
+
+// BeginTxContext buffers the transaction like BeginTx, its Commit writing without a context
+func (store *replicatingStore) BeginTxContext(ctx context.Context) (StoreTx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return store.BeginTx()
+}
+
+func (store *replicatingStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.DeleteMessagesUpToContext(context.Background(), seqNum)
+}
+
+func (store *replicatingStore) DeleteMessagesUpToContext(ctx context.Context, seqNum int) error {
+	return store.write("delete_messages", func(d *storeDecorator) error { return d.DeleteMessagesUpToContext(ctx, seqNum) })
+}
+
+// Backup writes the session of the primary store to w
+func (store *replicatingStore) Backup(w io.Writer) error {
+	return store.inner.Backup(w)
+}
+
+// Restore restores the archive into the replicating store, and so into both stores
+func (store *replicatingStore) Restore(r io.Reader) error {
+	return RestoreMessageStore(store, r)
+}
+
+// HealthCheck checks the primary store, and the secondary under ReplicationFail
+func (store *replicatingStore) HealthCheck(ctx context.Context) error {
+	return store.write("health_check", func(d *storeDecorator) error { return d.inner.HealthCheck(ctx) })
+}
+
+func (store *replicatingStore) Flush() error {
+	return store.write("flush", func(d *storeDecorator) error { return d.inner.Flush() })
+}
+
+func (store *replicatingStore) Refresh() error {
+	return store.RefreshContext(context.Background())
+}
+
+// RefreshContext reloads both stores, and then gives the secondary the primary's creation time and seqnums
+func (store *replicatingStore) RefreshContext(ctx context.Context) error {
+	if err := store.write("refresh", func(d *storeDecorator) error { return d.RefreshContext(ctx) }); err != nil {
+		return err
+	}
+	return store.replicateSession(ctx)
+}
+
+func (store *replicatingStore) Reset() error {
+	return store.ResetContext(context.Background())
+}
+
+// ResetContext resets both stores, and then gives the secondary the primary's new creation time
+func (store *replicatingStore) ResetContext(ctx context.Context) error {
+	if err := store.write("reset", func(d *storeDecorator) error { return d.ResetContext(ctx) }); err != nil {
+		return err
+	}
+	return store.replicateSession(ctx)
+}
+
+// ResetWithoutDeletingMessages resets both stores like ResetContext, keeping their messages
+func (store *replicatingStore) ResetWithoutDeletingMessages() error {
+	err := store.write("reset_without_deleting_messages", func(d *storeDecorator) error {
+		return d.ResetWithoutDeletingMessages()
+	})
+	if err != nil {
+		return err
+	}
+	return store.replicateSession(context.Background())
+}
+
+// Close closes both stores, returning the first error
+func (store *replicatingStore) Close() error {
+	primaryErr := store.inner.Close()
+	if secondaryErr := store.secondary.inner.Close(); primaryErr == nil {
+		return secondaryErr
+	}
+	return primaryErr
+}
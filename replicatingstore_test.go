@@ -0,0 +1,138 @@
+package msgstore
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// ReplicatingStoreTestSuite runs all tests in the MessageStoreTestSuite against a replicating store
+type ReplicatingStoreTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *ReplicatingStoreTestSuite) SetupTest() {
+	store, err := NewReplicatingStoreFactory(NewMemoryStoreFactory(), NewMemoryStoreFactory(), ReplicationFail).Create("session")
+	require.Nil(suite.T(), err)
+	suite.msgStore = store
+}
+
+func TestReplicatingStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(ReplicatingStoreTestSuite))
+}
+
+func TestReplicatingStore_Replicates(t *testing.T) {
+	// Given a replicating store over two backends, the secondary ahead of the primary
+	primary, _ := NewMemoryStoreFactory().Create("session")
+	secondary, _ := NewMemoryStoreFactory().Create("session")
+	require.Nil(t, secondary.SetNextSenderMsgSeqNum(10))
+	store, err := NewReplicatingStoreFactory(sessionFactory{primary}, sessionFactory{secondary}, ReplicationFail).Create("session")
+	require.Nil(t, err)
+
+	// Then the secondary should be given the primary's seqnums
+	assert.Equal(t, 1, secondary.NextSenderMsgSeqNum())
+
+	// When a message is saved
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	require.Nil(t, store.SetNextTargetMsgSeqNum(5))
+
+	// Then it should be written to both
+	for _, s := range []MessageStore{primary, secondary} {
+		msg, found, err := s.GetMessage(1)
+		require.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, []byte("one"), msg)
+		assert.Equal(t, 2, s.NextSenderMsgSeqNum())
+		assert.Equal(t, 5, s.NextTargetMsgSeqNum())
+	}
+}
+
+func TestReplicatingStore_CreationTime(t *testing.T) {
+	// Given a replicating store over two backends created at different times
+	primary, _ := NewMemoryStoreFactory().Create("session")
+	secondary, _ := NewMemoryStoreFactory().Create("session")
+	require.Nil(t, secondary.SetCreationTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)))
+	store, err := NewReplicatingStoreFactory(sessionFactory{primary}, sessionFactory{secondary}, ReplicationFail).Create("session")
+	require.Nil(t, err)
+
+	// Then the secondary should be given the primary's creation time
+	assert.True(t, primary.CreationTime().Equal(secondary.CreationTime()))
+
+	// When the session is reset
+	require.Nil(t, store.Reset())
+
+	// Then the secondary should be given the primary's new creation time
+	assert.True(t, primary.CreationTime().Equal(secondary.CreationTime()))
+}
+
+func TestReplicatingStore_SecondaryFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ReplicationPolicy
+		fails  bool
+	}{
+		{"ReplicationFail", ReplicationFail, true},
+		{"ReplicationBestEffort", ReplicationBestEffort, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Given a replicating store whose secondary cannot save messages
+			primary, _ := NewMemoryStoreFactory().Create("session")
+			secondary, _ := NewMemoryStoreFactory().Create("session")
+			var logs bytes.Buffer
+			store, err := NewReplicatingStoreFactory(sessionFactory{primary}, sessionFactory{failingSaveStore{secondary}}, tt.policy,
+				WithReplicationLogger(log.New(&logs, "", 0))).Create("session")
+			require.Nil(t, err)
+
+			// When messages are saved
+			err = store.SaveMessages([]SeqMsg{{SeqNum: 1, Msg: []byte("one")}})
+
+			// Then the failure should be returned or logged by the policy
+			if tt.fails {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), "disk full")
+				assert.Empty(t, logs.String())
+			} else {
+				require.Nil(t, err)
+				assert.Contains(t, logs.String(), "unable to replicate save_messages of session session: disk full")
+			}
+
+			// And the primary should hold the messages either way
+			_, found, err := primary.GetMessage(1)
+			require.Nil(t, err)
+			assert.True(t, found)
+		})
+	}
+}
+
+// failingFactory fails to create every store
+type failingFactory struct{}
+
+func (failingFactory) Create(string) (MessageStore, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (failingFactory) Close() error {
+	return nil
+}
+
+func TestReplicatingStoreFactory_SecondaryUnavailable(t *testing.T) {
+	// Given a secondary backend that is down
+	primary, _ := NewMemoryStoreFactory().Create("session")
+
+	// When stores are created under each policy
+	_, err := NewReplicatingStoreFactory(sessionFactory{primary}, failingFactory{}, ReplicationFail).Create("session")
+	assert.NotNil(t, err)
+	store, err := NewReplicatingStoreFactory(sessionFactory{primary}, failingFactory{}, ReplicationBestEffort).Create("session")
+
+	// Then only the best effort one should be created, on the primary alone
+	require.Nil(t, err)
+	assert.Equal(t, primary, store)
+}
@@ -0,0 +1,246 @@
+package msgstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultResetCheckInterval is how often a started ResetScheduler checks for due resets
+const defaultResetCheckInterval = time.Second
+
+// ResetSchedule is when a session's seqnums are reset, daily or weekly at a time of day in a time zone
+type ResetSchedule struct {
+	Hour, Minute int
+	// Weekly resets only on Weekday rather than every day
+	Weekly  bool
+	Weekday time.Weekday
+	// Location is the time zone of the reset time.  Defaults to UTC.
+	Location *time.Location
+	// KeepMessages resets with ResetWithoutDeletingMessages, see SeqNumResetter, rather than Reset
+	KeepMessages bool
+}
+
+// DailyReset returns the ResetSchedule of a reset every day at hour:minute in loc
+func DailyReset(hour, minute int, loc *time.Location) ResetSchedule {
+	return ResetSchedule{Hour: hour, Minute: minute, Location: loc}
+}
+
+// WeeklyReset returns the ResetSchedule of a reset every week on day at hour:minute in loc
+func WeeklyReset(day time.Weekday, hour, minute int, loc *time.Location) ResetSchedule {
+	return ResetSchedule{Hour: hour, Minute: minute, Weekly: true, Weekday: day, Location: loc}
+}
+
+// Next returns the first reset of the schedule after t.  Reset times skipped by a daylight saving change fall at the
+// time the clocks changed to.
+func (s ResetSchedule) Next(t time.Time) time.Time {
+	loc := s.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	local := t.In(loc)
+	for day := 0; ; day++ {
+		next := time.Date(local.Year(), local.Month(), local.Day()+day, s.Hour, s.Minute, 0, 0, loc)
+		if next.After(t) && (!s.Weekly || next.Weekday() == s.Weekday) {
+			return next
+		}
+	}
+}
+
+// previous returns the last reset of the schedule up to and including t
+func (s ResetSchedule) previous(t time.Time) time.Time {
+	prev := s.Next(t.AddDate(0, 0, -8))
+	for {
+		next := s.Next(prev)
+		if next.After(t) {
+			return prev
+		}
+		prev = next
+	}
+}
+
+// ResetSchedulerOption configures a ResetScheduler
+type ResetSchedulerOption func(*ResetScheduler)
+
+// WithResetSchedulerClock tells the time by clock.  Defaults to the system clock.
+func WithResetSchedulerClock(clock Clock) ResetSchedulerOption {
+	return func(s *ResetScheduler) { s.clock = clock }
+}
+
+// WithResetSchedulerLogger reports the resets and their failures to logger.  Defaults to discarding them.
+func WithResetSchedulerLogger(logger Logger) ResetSchedulerOption {
+	return func(s *ResetScheduler) { s.logger = logger }
+}
+
+// WithResetSchedulerAuditSink records each reset to sink, as an audit store does, with the reason "scheduled reset"
+func WithResetSchedulerAuditSink(sink SeqNumAuditSink) ResetSchedulerOption {
+	return func(s *ResetScheduler) { s.sink = sink }
+}
+
+// WithResetSchedulerInterval checks for due resets every interval once started.  Defaults to every second.
+func WithResetSchedulerInterval(interval time.Duration) ResetSchedulerOption {
+	return func(s *ResetScheduler) { s.interval = interval }
+}
+
+// scheduledReset is a store registered with a ResetScheduler, with the time of its next reset
+type scheduledReset struct {
+	store    MessageStore
+	schedule ResetSchedule
+	next     time.Time
+}
+
+// ResetScheduler resets the seqnums of the stores registered with it on their schedules, replacing the end of day
+// reset jobs of engines.  It is safe for concurrent use, but the stores are reset from the goroutine of Start or the
+// caller of RunDue, so they must be safe for concurrent use unless the engine is idle at the reset times.
+type ResetScheduler struct {
+	clock    Clock
+	logger   Logger
+	sink     SeqNumAuditSink
+	interval time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*scheduledReset
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewResetScheduler returns a ResetScheduler without stores, which resets none until started or RunDue is called
+func NewResetScheduler(opts ...ResetSchedulerOption) *ResetScheduler {
+	s := &ResetScheduler{interval: defaultResetCheckInterval, sessions: make(map[string]*scheduledReset)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Register resets store, the store of sessionID, on schedule, replacing any store registered for sessionID.  A store
+// created before the last reset of its schedule, as when the engine was down at the reset time, is reset at the next
+// check.
+func (s *ResetScheduler) Register(sessionID string, store MessageStore, schedule ResetSchedule) {
+	now := clockNow(s.clock)
+	next := schedule.Next(now)
+	if last := schedule.previous(now); store.CreationTime().Before(last) {
+		next = last
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[sessionID] = &scheduledReset{store: store, schedule: schedule, next: next}
+}
+
+// Unregister stops resetting the store of sessionID
+func (s *ResetScheduler) Unregister(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, sessionID)
+}
+
+// NextReset returns the time of the next reset of the store of sessionID, reporting whether one is registered
+func (s *ResetScheduler) NextReset(sessionID string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reset, ok := s.sessions[sessionID]
+	if !ok {
+		return time.Time{}, false
+	}
+	return reset.next, true
+}
+
+// RunDue resets the stores whose reset is due, returning the first failure.  A store failing to reset is retried at
+// the next call.
+func (s *ResetScheduler) RunDue() error {
+	now := clockNow(s.clock)
+
+	s.mu.Lock()
+	due := make(map[string]*scheduledReset)
+	for sessionID, reset := range s.sessions {
+		if !now.Before(reset.next) {
+			due[sessionID] = reset
+		}
+	}
+	s.mu.Unlock()
+
+	var firstErr error
+	for sessionID, reset := range due {
+		if err := s.reset(sessionID, reset); err != nil {
+			s.logf("msgstore: unable to reset session %s on schedule: %s", sessionID, err.Error())
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		s.logf("msgstore: reset session %s on schedule", sessionID)
+
+		s.mu.Lock()
+		reset.next = reset.schedule.Next(now)
+		s.mu.Unlock()
+	}
+	return firstErr
+}
+
+// reset resets the store of sessionID, recording it to the audit sink
+func (s *ResetScheduler) reset(sessionID string, reset *scheduledReset) error {
+	op, fn := "reset", reset.store.Reset
+	if reset.schedule.KeepMessages {
+		resetter, ok := reset.store.(SeqNumResetter)
+		if !ok {
+			return fmt.Errorf("store of session %s cannot reset without deleting messages", sessionID)
+		}
+		op, fn = "reset_without_deleting_messages", resetter.ResetWithoutDeletingMessages
+	}
+	if s.sink == nil {
+		return fn()
+	}
+
+	audit := &auditStore{inner: AdaptMessageStore(reset.store), sessionID: sessionID, sink: s.sink, clock: s.clock}
+	return audit.audit(WithAuditReason(context.Background(), "scheduled reset"), op, fn)
+}
+
+// Start checks for due resets in the background until Stop
+func (s *ResetScheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stop != nil {
+		return
+	}
+	s.stop, s.done = make(chan struct{}), make(chan struct{})
+	go s.run(s.stop, s.done)
+}
+
+func (s *ResetScheduler) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.RunDue()
+		}
+	}
+}
+
+// Stop stops the background checks of Start, waiting for any reset in progress
+func (s *ResetScheduler) Stop() {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (s *ResetScheduler) logf(format string, v ...interface{}) {
+	if s.logger != nil {
+		s.logger.Printf(format, v...)
+	}
+}
@@ -0,0 +1,125 @@
+package msgstore
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// manualClock tells the time it is set to
+type manualClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *manualClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = t
+}
+
+// keepingResetStore resets its seqnums without deleting its messages
+type keepingResetStore struct {
+	MessageStore
+}
+
+func (s keepingResetStore) ResetWithoutDeletingMessages() error {
+	if err := s.SetNextSenderMsgSeqNum(1); err != nil {
+		return err
+	}
+	return s.SetNextTargetMsgSeqNum(1)
+}
+
+func TestResetSchedule_Next(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.Nil(t, err)
+
+	daily := DailyReset(17, 0, newYork)
+	assert.Equal(t, time.Date(2024, 3, 1, 17, 0, 0, 0, newYork), daily.Next(time.Date(2024, 3, 1, 9, 0, 0, 0, newYork)))
+	assert.Equal(t, time.Date(2024, 3, 2, 17, 0, 0, 0, newYork), daily.Next(time.Date(2024, 3, 1, 17, 0, 0, 0, newYork)))
+	// across the change to daylight saving time, 17:00 is 21:00 UTC rather than 22:00
+	assert.True(t, time.Date(2024, 3, 10, 21, 0, 0, 0, time.UTC).Equal(daily.Next(time.Date(2024, 3, 9, 23, 0, 0, 0, time.UTC))))
+
+	weekly := WeeklyReset(time.Sunday, 17, 30, nil)
+	assert.Equal(t, time.Date(2024, 3, 3, 17, 30, 0, 0, time.UTC), weekly.Next(time.Date(2024, 2, 27, 0, 0, 0, 0, time.UTC)))
+	assert.Equal(t, time.Date(2024, 3, 10, 17, 30, 0, 0, time.UTC), weekly.Next(time.Date(2024, 3, 3, 17, 30, 0, 0, time.UTC)))
+}
+
+func TestResetScheduler(t *testing.T) {
+	// Given a store registered for a daily reset at 17:00, with a sink auditing the resets
+	clock := &manualClock{t: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)}
+	sink := &recordingAuditSink{}
+	scheduler := NewResetScheduler(WithResetSchedulerClock(clock), WithResetSchedulerAuditSink(sink))
+	store, _ := NewMemoryStoreFactory(WithMemoryClock(clock)).Create("session")
+	require.Nil(t, store.SetNextSenderMsgSeqNum(100))
+	scheduler.Register("session", store, DailyReset(17, 0, time.UTC))
+
+	// When the scheduler checks before and at the reset time
+	clock.Set(time.Date(2024, 3, 1, 16, 59, 0, 0, time.UTC))
+	require.Nil(t, scheduler.RunDue())
+	assert.Equal(t, 100, store.NextSenderMsgSeqNum())
+	clock.Set(time.Date(2024, 3, 1, 17, 0, 1, 0, time.UTC))
+	require.Nil(t, scheduler.RunDue())
+
+	// Then the store should be reset once, at the reset time, and the reset audited
+	assert.Equal(t, 1, store.NextSenderMsgSeqNum())
+	require.Len(t, sink.entries, 1)
+	assert.Equal(t, "reset", sink.entries[0].Op)
+	assert.Equal(t, "scheduled reset", sink.entries[0].Reason)
+	assert.Equal(t, 100, sink.entries[0].OldNextSenderMsgSeqNum)
+	next, ok := scheduler.NextReset("session")
+	require.True(t, ok)
+	assert.Equal(t, time.Date(2024, 3, 2, 17, 0, 0, 0, time.UTC), next)
+	require.Nil(t, scheduler.RunDue())
+	assert.Len(t, sink.entries, 1)
+}
+
+func TestResetScheduler_MissedReset(t *testing.T) {
+	// Given a store created before the last reset time, as when the engine was down at it
+	clock := &manualClock{t: time.Date(2024, 2, 28, 12, 0, 0, 0, time.UTC)}
+	store, _ := NewMemoryStoreFactory(WithMemoryClock(clock)).Create("session")
+	require.Nil(t, store.SetNextSenderMsgSeqNum(100))
+	clock.Set(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+
+	// When it is registered and the scheduler checks
+	scheduler := NewResetScheduler(WithResetSchedulerClock(clock))
+	scheduler.Register("session", store, DailyReset(17, 0, time.UTC))
+	require.Nil(t, scheduler.RunDue())
+
+	// Then it should be reset straight away
+	assert.Equal(t, 1, store.NextSenderMsgSeqNum())
+}
+
+func TestResetScheduler_KeepMessages(t *testing.T) {
+	// Given stores registered to reset without deleting their messages, only one of which can
+	clock := &manualClock{t: time.Date(2024, 3, 3, 12, 0, 0, 0, time.UTC)}
+	inner, _ := NewMemoryStoreFactory(WithMemoryClock(clock)).Create("keeping")
+	require.Nil(t, inner.SaveMessage(1, []byte("one")))
+	require.Nil(t, inner.SetNextSenderMsgSeqNum(2))
+	other, _ := NewMemoryStoreFactory(WithMemoryClock(clock)).Create("other")
+	scheduler := NewResetScheduler(WithResetSchedulerClock(clock), WithResetSchedulerInterval(time.Millisecond))
+	scheduler.Register("keeping", keepingResetStore{inner}, ResetSchedule{Hour: 17, Weekly: true, Weekday: time.Sunday, KeepMessages: true})
+	scheduler.Register("other", other, ResetSchedule{Hour: 17, Weekly: true, Weekday: time.Sunday, KeepMessages: true})
+
+	// When the reset time passes while the scheduler is started
+	scheduler.Start()
+	clock.Set(time.Date(2024, 3, 3, 17, 0, 0, 0, time.UTC))
+	time.Sleep(50 * time.Millisecond)
+	scheduler.Stop()
+
+	// Then the seqnums should be reset keeping the messages, and the store unable to keep them left to retry
+	assert.Equal(t, 1, inner.NextSenderMsgSeqNum())
+	_, found, err := inner.GetMessage(1)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.EqualError(t, scheduler.RunDue(), "store of session other cannot reset without deleting messages")
+}
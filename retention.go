@@ -0,0 +1,292 @@
+package msgstore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// RetentionMaxAge is the age, as a duration such as "720h", past which a RetentionManager deletes messages.
+	// Optional.
+	RetentionMaxAge string = "RetentionMaxAge"
+	// RetentionKeepMessages is the number of the most recent messages of each session a RetentionManager keeps,
+	// deleting those before.  Optional.
+	RetentionKeepMessages string = "RetentionKeepMessages"
+	// RetentionInterval is how often, as a duration such as "1h", a started RetentionManager applies retention.
+	// Optional, defaults to "1h".
+	RetentionInterval string = "RetentionInterval"
+)
+
+// defaultRetentionInterval is how often a started RetentionManager applies retention unless RetentionInterval is set
+const defaultRetentionInterval = time.Hour
+
+// RetentionReport is what a RetentionManager reclaimed from the store of a session
+type RetentionReport struct {
+	SessionID string
+	// DeletedMessages is the number of messages deleted
+	DeletedMessages int
+	// ReclaimedBytes is the size of the messages deleted, not counting the overhead of the backend, nor the messages
+	// deleted by age with MongoMessagePurger, which are not read
+	ReclaimedBytes int64
+}
+
+// RetentionOption configures a RetentionManager
+type RetentionOption func(*RetentionManager)
+
+// WithRetentionClock tells the age of messages by clock.  Defaults to the system clock.
+func WithRetentionClock(clock Clock) RetentionOption {
+	return func(m *RetentionManager) { m.clock = clock }
+}
+
+// WithRetentionLogger reports what retention reclaimed, and its failures, to logger.  Defaults to discarding them.
+func WithRetentionLogger(logger Logger) RetentionOption {
+	return func(m *RetentionManager) { m.logger = logger }
+}
+
+// WithRetentionReporter calls report with what retention reclaimed from each session, e.g. to export it as metrics
+func WithRetentionReporter(report func(RetentionReport)) RetentionOption {
+	return func(m *RetentionManager) { m.report = report }
+}
+
+// RetentionManager deletes the messages of the stores registered with it past an age or beyond a count, on a schedule
+// or on demand, for every backend: messages are deleted with DeleteMessagesUpTo, and their age is told by
+// MessageMetaStore or TimedMessageStore where the store implements them, or else deleted by age with
+// MongoMessagePurger.  It is safe for concurrent use, but the stores are pruned from the goroutine of Start or the caller
+// of Apply, so they must be safe for concurrent use.
+type RetentionManager struct {
+	maxAge       time.Duration
+	keepMessages int
+	interval     time.Duration
+	clock        Clock
+	logger       Logger
+	report       func(RetentionReport)
+
+	mu     sync.Mutex
+	stores map[string]MessageStore
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewRetentionManager returns a RetentionManager applying the retention configured by settings, the settings map of a
+// backend or one of its own, with RetentionMaxAge, RetentionKeepMessages and RetentionInterval.  At least one of
+// RetentionMaxAge and RetentionKeepMessages is required.
+func NewRetentionManager(settings map[string]string, opts ...RetentionOption) (m *RetentionManager, err error) {
+	m = &RetentionManager{interval: defaultRetentionInterval, stores: make(map[string]MessageStore)}
+
+	if durationStr, ok := settings[RetentionMaxAge]; ok {
+		if m.maxAge, err = time.ParseDuration(durationStr); err != nil {
+			return nil, fmt.Errorf("invalid setting: %s: %w", RetentionMaxAge, err)
+		}
+	}
+	if keepStr, ok := settings[RetentionKeepMessages]; ok {
+		if m.keepMessages, err = strconv.Atoi(keepStr); err != nil || m.keepMessages < 0 {
+			return nil, fmt.Errorf("invalid setting: %s: must be a number that is not negative", RetentionKeepMessages)
+		}
+	}
+	if durationStr, ok := settings[RetentionInterval]; ok {
+		if m.interval, err = time.ParseDuration(durationStr); err != nil || m.interval <= 0 {
+			return nil, fmt.Errorf("invalid setting: %s: must be a positive duration", RetentionInterval)
+		}
+	}
+	if m.maxAge <= 0 && m.keepMessages <= 0 {
+		return nil, fmt.Errorf("retention requires %s or %s", RetentionMaxAge, RetentionKeepMessages)
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m, nil
+}
+
+// Register applies retention to store, the store of sessionID, replacing any store registered for sessionID
+func (m *RetentionManager) Register(sessionID string, store MessageStore) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stores[sessionID] = store
+}
+
+// Unregister stops applying retention to the store of sessionID
+func (m *RetentionManager) Unregister(sessionID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.stores, sessionID)
+}
+
+// Apply applies retention to every registered store, returning what was reclaimed from each in session order and the
+// first failure.  A store failing is left for the next run, without stopping the others.
+func (m *RetentionManager) Apply() ([]RetentionReport, error) {
+	m.mu.Lock()
+	stores := make(map[string]MessageStore, len(m.stores))
+	sessionIDs := make([]string, 0, len(m.stores))
+	for sessionID, store := range m.stores {
+		stores[sessionID] = store
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	m.mu.Unlock()
+	sort.Strings(sessionIDs)
+
+	var reports []RetentionReport
+	var firstErr error
+	for _, sessionID := range sessionIDs {
+		report, err := m.apply(sessionID, stores[sessionID])
+		if err != nil {
+			m.logf("msgstore: applying retention to session %s failed: %s", sessionID, err.Error())
+			if firstErr == nil {
+				firstErr = fmt.Errorf("session %s: %w", sessionID, err)
+			}
+			continue
+		}
+		if report.DeletedMessages > 0 {
+			m.logf("msgstore: retention deleted %d messages of session %s, reclaiming %d bytes", report.DeletedMessages, sessionID, report.ReclaimedBytes)
+		}
+		if m.report != nil {
+			m.report(report)
+		}
+		reports = append(reports, report)
+	}
+	return reports, firstErr
+}
+
+// apply deletes the messages of store past the age or beyond the count to keep
+func (m *RetentionManager) apply(sessionID string, store MessageStore) (report RetentionReport, err error) {
+	report.SessionID = sessionID
+
+	var boundary int
+	if m.maxAge > 0 {
+		cutoff := clockNow(m.clock).Add(-m.maxAge)
+		var supported bool
+		if boundary, supported, err = retentionAgeBoundary(store, cutoff); err != nil {
+			return report, err
+		}
+		if !supported {
+			purger, ok := store.(MongoMessagePurger)
+			if !ok {
+				return report, errors.New("store does not record when messages were stored")
+			}
+			deleted, err := purger.DeleteMessagesBefore(cutoff)
+			if err != nil {
+				return report, err
+			}
+			report.DeletedMessages += int(deleted)
+		}
+	}
+
+	if m.keepMessages > 0 {
+		last, err := lastMessageSeqNum(store)
+		if err != nil {
+			return report, err
+		}
+		if last-m.keepMessages > boundary {
+			boundary = last - m.keepMessages
+		}
+	}
+	if boundary < 1 {
+		return report, nil
+	}
+
+	first := 1
+	if stats, ok := store.(MessageStats); ok {
+		if first, err = stats.FirstSeqNum(); err != nil {
+			return report, err
+		}
+		if first == 0 || first > boundary {
+			return report, nil
+		}
+	}
+
+	err = store.IterateMessages(first, boundary, func(seqNum int, msg []byte) error {
+		report.DeletedMessages++
+		report.ReclaimedBytes += int64(len(msg))
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	return report, store.DeleteMessagesUpTo(boundary)
+}
+
+// retentionAgeBoundary returns the highest seqnum of the outgoing messages of store stored before cutoff, reporting
+// whether the store records when messages were stored.  It is told by MessageTimeStats where the store implements it,
+// rather than by reading the messages.
+func retentionAgeBoundary(store MessageStore, cutoff time.Time) (seqNum int, supported bool, err error) {
+	if stats, ok := store.(MessageTimeStats); ok {
+		seqNum, err = stats.LastSeqNumStoredBefore(MessageOutgoing, cutoff)
+		if !errors.Is(err, ErrUnsupported) {
+			return seqNum, true, err
+		}
+	}
+
+	var msgs []StoredMessage
+	switch s := store.(type) {
+	case MessageMetaStore:
+		msgs, err = s.GetStoredMessages(MessageFilter{Direction: MessageOutgoing, To: cutoff})
+	case TimedMessageStore:
+		msgs, err = s.GetMessagesByTime(time.Time{}, cutoff)
+	default:
+		return 0, false, nil
+	}
+	if errors.Is(err, ErrUnsupported) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, true, err
+	}
+	for _, msg := range msgs {
+		if msg.Direction != MessageIncoming && msg.SeqNum > seqNum {
+			seqNum = msg.SeqNum
+		}
+	}
+	return seqNum, true, nil
+}
+
+// Start applies retention every RetentionInterval in the background until Stop
+func (m *RetentionManager) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stop != nil {
+		return
+	}
+	m.stop, m.done = make(chan struct{}), make(chan struct{})
+	go m.run(m.stop, m.done)
+}
+
+func (m *RetentionManager) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.Apply()
+		}
+	}
+}
+
+// Stop stops the background runs of Start, waiting for any run in progress
+func (m *RetentionManager) Stop() {
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	m.stop, m.done = nil, nil
+	m.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (m *RetentionManager) logf(format string, v ...interface{}) {
+	if m.logger != nil {
+		m.logger.Printf(format, v...)
+	}
+}
@@ -0,0 +1,144 @@
+package msgstore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// timedStore records the time each message is saved at by its clock
+type timedStore struct {
+	MessageStore
+	clock    Clock
+	storedAt map[int]time.Time
+}
+
+func (s *timedStore) SaveMessage(seqNum int, msg []byte) error {
+	s.storedAt[seqNum] = s.clock.Now()
+	return s.MessageStore.SaveMessage(seqNum, msg)
+}
+
+func (s *timedStore) SaveMessageWithDirection(seqNum int, msg []byte, direction MessageDirection) error {
+	return s.SaveMessage(seqNum, msg)
+}
+
+func (s *timedStore) GetMessagesByTime(from, to time.Time) ([]StoredMessage, error) {
+	var msgs []StoredMessage
+	for seqNum, storedAt := range s.storedAt {
+		if !storedAt.Before(from) && storedAt.Before(to) {
+			msgs = append(msgs, StoredMessage{SeqNum: seqNum, Direction: MessageOutgoing, StoredAt: storedAt})
+		}
+	}
+	return msgs, nil
+}
+
+// timeStatsStore is a timedStore telling the last seqnum stored before a time without reading the messages
+type timeStatsStore struct {
+	*timedStore
+}
+
+func (s timeStatsStore) GetMessagesByTime(from, to time.Time) ([]StoredMessage, error) {
+	return nil, errors.New("messages read")
+}
+
+func (s timeStatsStore) LastSeqNumStoredBefore(direction MessageDirection, t time.Time) (last int, err error) {
+	msgs, _ := s.timedStore.GetMessagesByTime(time.Time{}, t)
+	for _, msg := range msgs {
+		if msg.SeqNum > last {
+			last = msg.SeqNum
+		}
+	}
+	return last, nil
+}
+
+func TestNewRetentionManager_Settings(t *testing.T) {
+	_, err := NewRetentionManager(map[string]string{RetentionMaxAge: "720h", RetentionKeepMessages: "1000", RetentionInterval: "10m"})
+	assert.Nil(t, err)
+
+	_, err = NewRetentionManager(map[string]string{RetentionInterval: "10m"})
+	assert.EqualError(t, err, "retention requires RetentionMaxAge or RetentionKeepMessages")
+	_, err = NewRetentionManager(map[string]string{RetentionKeepMessages: "-1"})
+	assert.EqualError(t, err, "invalid setting: RetentionKeepMessages: must be a number that is not negative")
+	_, err = NewRetentionManager(map[string]string{RetentionMaxAge: "a month"})
+	assert.NotNil(t, err)
+}
+
+func TestRetentionManager_KeepMessages(t *testing.T) {
+	// Given a manager keeping the last 3 messages, and a session of 10
+	manager, err := NewRetentionManager(map[string]string{RetentionKeepMessages: "3"})
+	require.Nil(t, err)
+	store, _ := NewMemoryStoreFactory().Create("session")
+	for seqNum := 1; seqNum <= 10; seqNum++ {
+		require.Nil(t, store.SaveMessage(seqNum, []byte(fmt.Sprintf("msg%02d", seqNum))))
+	}
+	require.Nil(t, store.SetNextSenderMsgSeqNum(11))
+	manager.Register("session", store)
+
+	// When retention is applied, twice
+	reports, err := manager.Apply()
+	require.Nil(t, err)
+	again, err := manager.Apply()
+	require.Nil(t, err)
+
+	// Then the first 7 messages should be deleted once, and their size reported
+	assert.Equal(t, []RetentionReport{{SessionID: "session", DeletedMessages: 7, ReclaimedBytes: 35}}, reports)
+	assert.Equal(t, []RetentionReport{{SessionID: "session"}}, again)
+	msgs, err := store.GetMessages(1, 10)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("msg08"), []byte("msg09"), []byte("msg10")}, msgs)
+}
+
+func TestRetentionManager_MaxAge(t *testing.T) {
+	// Given a manager deleting messages older than a day, and sessions with messages stored over three days
+	clock := &manualClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	var reported []RetentionReport
+	manager, err := NewRetentionManager(map[string]string{RetentionMaxAge: "24h"}, WithRetentionClock(clock),
+		WithRetentionReporter(func(r RetentionReport) { reported = append(reported, r) }))
+	require.Nil(t, err)
+	inner, _ := NewMemoryStoreFactory().Create("timed")
+	timed := &timedStore{MessageStore: inner, clock: clock, storedAt: make(map[int]time.Time)}
+	for seqNum := 1; seqNum <= 3; seqNum++ {
+		require.Nil(t, timed.SaveMessage(seqNum, []byte("msg")))
+		clock.Set(clock.Now().Add(24 * time.Hour))
+	}
+	untimed, _ := NewMemoryStoreFactory().Create("untimed")
+	manager.Register("timed", timed)
+	manager.Register("untimed", untimed)
+
+	// When retention is applied
+	reports, err := manager.Apply()
+
+	// Then the messages older than a day should be deleted, and the store unable to tell their age reported
+	assert.EqualError(t, err, "session untimed: store does not record when messages were stored")
+	assert.Equal(t, []RetentionReport{{SessionID: "timed", DeletedMessages: 2, ReclaimedBytes: 6}}, reports)
+	assert.Equal(t, reports, reported)
+	_, found, _ := timed.GetMessage(2)
+	assert.False(t, found)
+	_, found, _ = timed.GetMessage(3)
+	assert.True(t, found)
+}
+
+func TestRetentionManager_MaxAgeStats(t *testing.T) {
+	// Given a manager deleting messages older than a day, and a session telling the seqnums stored before a time
+	clock := &manualClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	manager, err := NewRetentionManager(map[string]string{RetentionMaxAge: "24h"}, WithRetentionClock(clock))
+	require.Nil(t, err)
+	inner, _ := NewMemoryStoreFactory().Create("timed")
+	timed := timeStatsStore{&timedStore{MessageStore: inner, clock: clock, storedAt: make(map[int]time.Time)}}
+	for seqNum := 1; seqNum <= 3; seqNum++ {
+		require.Nil(t, timed.SaveMessage(seqNum, []byte("msg")))
+		clock.Set(clock.Now().Add(24 * time.Hour))
+	}
+	manager.Register("timed", timed)
+
+	// When retention is applied
+	reports, err := manager.Apply()
+
+	// Then the messages older than a day should be deleted, without reading them to find their age
+	require.Nil(t, err)
+	assert.Equal(t, []RetentionReport{{SessionID: "timed", DeletedMessages: 2, ReclaimedBytes: 6}}, reports)
+}
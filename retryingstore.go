@@ -0,0 +1,231 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+)
+
+const (
+	// defaultRetryMaxAttempts, defaultRetryBackoff and defaultRetryMaxBackoff retry for around 3s
+	defaultRetryMaxAttempts = 5
+	defaultRetryBackoff     = 200 * time.Millisecond
+	defaultRetryMaxBackoff  = 2 * time.Second
+	defaultRetryJitter      = 0.2
+)
+
+// RetryPolicy determines which failures a retrying store retries, how often and how far apart, see NewRetryingStore
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts made at an operation, including the first.  Defaults to 5.
+	MaxAttempts int
+	// Backoff returns the wait before the given retry, 1 being the second attempt.  Defaults to an ExponentialBackoff
+	// from 200ms up to 2s with 20% jitter.
+	Backoff func(retry int) time.Duration
+	// IsTransient reports whether a failure is likely to succeed if retried.  Defaults to IsTransientError.
+	IsTransient func(err error) bool
+}
+
+// ExponentialBackoff returns a RetryPolicy Backoff waiting initial before the first retry and doubling the wait each
+// retry up to max, varying each wait randomly by up to the fraction jitter of it either way, so that the sessions
+// failing together do not retry together
+func ExponentialBackoff(initial, max time.Duration, jitter float64) func(retry int) time.Duration {
+	return func(retry int) time.Duration {
+		backoff := initial
+		for i := 1; i < retry && backoff < max; i++ {
+			backoff *= 2
+		}
+		if backoff > max {
+			backoff = max
+		}
+		if jitter > 0 {
+			backoff += time.Duration((rand.Float64()*2 - 1) * jitter * float64(backoff))
+		}
+		return backoff
+	}
+}
+
+// IsTransientError reports whether err, a failure of a store of the package, is likely to succeed if the operation is
+// retried, e.g. a dropped connection, a deadlock or a replica set election.  It classifies the error of a StoreError
+// as its backend does for its own retries.  The failures IsBackendFailure rejects, and timeouts, are not transient.
+func IsTransientError(err error) bool {
+	if !IsBackendFailure(err) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var storeErr *StoreError
+	if errors.As(err, &storeErr) {
+		if storeErr.Backend == "mongo" {
+			return isTransientMongoError(storeErr.Err)
+		}
+		err = storeErr.Err
+	}
+	return isTransientSQLError(err)
+}
+
+type retryingStore struct {
+	inner  MessageStore
+	policy RetryPolicy
+}
+
+// NewRetryingStore returns a MessageStore retrying the idempotent operations of inner that fail transiently, according
+// to policy, so that stores need not retry themselves.  The reads, SetNext*, SetCreationTime, saves, deletes, Flush,
+// Refresh, Reset and BeginTx are retried, as is IterateMessages until it has passed fn a message.  The seqnum
+// increments, Commit, Backup and Restore are not, nor is HealthCheck, which is to report the backend as it is.  A save
+// whose acknowledgement was lost is retried like any other, so under DuplicateMessageError it may fail with
+// ErrDuplicateMessage although it was stored.  The last failure of an operation is returned.
+func NewRetryingStore(inner MessageStore, policy RetryPolicy) MessageStore {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if policy.Backoff == nil {
+		policy.Backoff = ExponentialBackoff(defaultRetryBackoff, defaultRetryMaxBackoff, defaultRetryJitter)
+	}
+	if policy.IsTransient == nil {
+		policy.IsTransient = IsTransientError
+	}
+	return &retryingStore{inner: inner, policy: policy}
+}
+
+// retry runs the idempotent op until it succeeds, fails with an error that isn't transient, or runs out of attempts
+func (store *retryingStore) retry(op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= store.policy.MaxAttempts || !store.policy.IsTransient(err) {
+			return err
+		}
+		time.Sleep(store.policy.Backoff(attempt))
+	}
+}
+
+func (store *retryingStore) NextSenderMsgSeqNum() int {
+	return store.inner.NextSenderMsgSeqNum()
+}
+
+func (store *retryingStore) NextTargetMsgSeqNum() int {
+	return store.inner.NextTargetMsgSeqNum()
+}
+
+func (store *retryingStore) IncrNextSenderMsgSeqNum() error {
+	return store.inner.IncrNextSenderMsgSeqNum()
+}
+
+func (store *retryingStore) IncrNextTargetMsgSeqNum() error {
+	return store.inner.IncrNextTargetMsgSeqNum()
+}
+
+func (store *retryingStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.retry(func() error { return store.inner.SetNextSenderMsgSeqNum(next) })
+}
+
+func (store *retryingStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.retry(func() error { return store.inner.SetNextTargetMsgSeqNum(next) })
+}
+
+func (store *retryingStore) CreationTime() time.Time {
+	return store.inner.CreationTime()
+}
+
+func (store *retryingStore) SetCreationTime(t time.Time) error {
+	return store.retry(func() error { return store.inner.SetCreationTime(t) })
+}
+
+func (store *retryingStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.retry(func() error { return store.inner.SaveMessage(seqNum, msg) })
+}
+
+func (store *retryingStore) SaveMessages(msgs []SeqMsg) error {
+	return store.retry(func() error { return store.inner.SaveMessages(msgs) })
+}
+
+func (store *retryingStore) GetMessages(beginSeqNum, endSeqNum int) (msgs [][]byte, err error) {
+	err = store.retry(func() error {
+		msgs, err = store.inner.GetMessages(beginSeqNum, endSeqNum)
+		return err
+	})
+	return msgs, err
+}
+
+func (store *retryingStore) GetMessagesSince(seqNum int) (msgs [][]byte, err error) {
+	err = store.retry(func() error {
+		msgs, err = store.inner.GetMessagesSince(seqNum)
+		return err
+	})
+	return msgs, err
+}
+
+func (store *retryingStore) GetMessagesDescending(beginSeqNum, endSeqNum int) (msgs [][]byte, err error) {
+	err = store.retry(func() error {
+		msgs, err = store.inner.GetMessagesDescending(beginSeqNum, endSeqNum)
+		return err
+	})
+	return msgs, err
+}
+
+func (store *retryingStore) GetMessage(seqNum int) (msg []byte, found bool, err error) {
+	err = store.retry(func() error {
+		msg, found, err = store.inner.GetMessage(seqNum)
+		return err
+	})
+	return msg, found, err
+}
+
+// IterateMessages retries the iteration only while fn has not been passed a message, which it is not passed twice
+func (store *retryingStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	started := false
+	for attempt := 1; ; attempt++ {
+		err := store.inner.IterateMessages(beginSeqNum, endSeqNum, func(seqNum int, msg []byte) error {
+			started = true
+			return fn(seqNum, msg)
+		})
+		if err == nil || started || attempt >= store.policy.MaxAttempts || !store.policy.IsTransient(err) {
+			return err
+		}
+		time.Sleep(store.policy.Backoff(attempt))
+	}
+}
+
+func (store *retryingStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+func (store *retryingStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.retry(func() error { return store.inner.DeleteMessagesUpTo(seqNum) })
+}
+
+func (store *retryingStore) BeginTx() (tx StoreTx, err error) {
+	err = store.retry(func() error {
+		tx, err = store.inner.BeginTx()
+		return err
+	})
+	return tx, err
+}
+
+func (store *retryingStore) Backup(w io.Writer) error {
+	return store.inner.Backup(w)
+}
+
+func (store *retryingStore) Restore(r io.Reader) error {
+	return store.inner.Restore(r)
+}
+
+func (store *retryingStore) HealthCheck(ctx context.Context) error {
+	return store.inner.HealthCheck(ctx)
+}
+
+func (store *retryingStore) Flush() error {
+	return store.retry(store.inner.Flush)
+}
+
+func (store *retryingStore) Refresh() error {
+	return store.retry(store.inner.Refresh)
+}
+
+func (store *retryingStore) Reset() error {
+	return store.retry(store.inner.Reset)
+}
+
+func (store *retryingStore) Close() error {
+	return store.inner.Close()
+}
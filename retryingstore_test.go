@@ -0,0 +1,124 @@
+package msgstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// RetryingStoreTestSuite runs all tests in the MessageStoreTestSuite against a retrying store over the MemoryStore
+type RetryingStoreTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *RetryingStoreTestSuite) SetupTest() {
+	inner, err := NewMemoryStoreFactory().Create("session")
+	require.Nil(suite.T(), err)
+	suite.msgStore = NewRetryingStore(inner, RetryPolicy{})
+}
+
+func TestRetryingStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(RetryingStoreTestSuite))
+}
+
+// noBackoff retries immediately
+func noBackoff(retry int) time.Duration { return 0 }
+
+func TestRetryingStore_Transient(t *testing.T) {
+	// Given a retrying store over a store whose saves drop the connection twice
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	faults := NewFaultStore(inner, WithFault(Fault{Ops: []string{"save_message"}, Err: &StoreError{Backend: "sql", SessionID: "session", Op: "save_message", Err: errors.New("connection reset by peer")}, Times: 2}))
+	store := NewRetryingStore(faults, RetryPolicy{MaxAttempts: 3, Backoff: noBackoff})
+
+	// When a message is saved
+	err := store.SaveMessage(1, []byte("one"))
+
+	// Then it should be saved on the third attempt
+	require.Nil(t, err)
+	_, found, err := inner.GetMessage(1)
+	require.Nil(t, err)
+	assert.True(t, found)
+}
+
+func TestRetryingStore_OutOfAttempts(t *testing.T) {
+	// Given a retrying store over a store whose reads keep dropping the connection
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	faults := NewFaultStore(inner, WithFault(Fault{Ops: []string{"get_messages"}, Err: errors.New("broken pipe")}))
+	attempts := 0
+	store := NewRetryingStore(faults, RetryPolicy{MaxAttempts: 3, Backoff: func(retry int) time.Duration {
+		attempts = retry + 1
+		return 0
+	}})
+
+	// When messages are read
+	_, err := store.GetMessages(1, 2)
+
+	// Then the last failure should be returned after all attempts
+	assert.EqualError(t, err, "broken pipe")
+	assert.Equal(t, 3, attempts)
+}
+
+func TestRetryingStore_NotRetried(t *testing.T) {
+	// Given a retrying store over a store whose increments drop the connection once and whose saves fail permanently
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	faults := NewFaultStore(inner,
+		WithFault(Fault{Ops: []string{"incr_next_sender_seqnum"}, Err: errors.New("connection reset"), Times: 1}),
+		WithFault(Fault{Ops: []string{"save_message"}, Err: &StoreError{Backend: "memory", SessionID: "session", Op: "save_message", Err: ErrDuplicateMessage}, Times: 1}),
+	)
+	store := NewRetryingStore(faults, RetryPolicy{Backoff: noBackoff})
+
+	// When the seqnum is incremented and a message saved
+	incrErr := store.IncrNextSenderMsgSeqNum()
+	saveErr := store.SaveMessage(1, []byte("one"))
+
+	// Then neither should be retried
+	assert.EqualError(t, incrErr, "connection reset")
+	assert.Equal(t, 1, store.NextSenderMsgSeqNum())
+	assert.True(t, errors.Is(saveErr, ErrDuplicateMessage))
+}
+
+func TestRetryingStore_IterateMessages(t *testing.T) {
+	// Given a retrying store over a store whose iteration fails once
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	require.Nil(t, inner.SaveMessage(1, []byte("one")))
+	require.Nil(t, inner.SaveMessage(2, []byte("two")))
+	faults := NewFaultStore(inner, WithFault(Fault{Ops: []string{"iterate_messages"}, Err: errors.New("bad connection"), Times: 1}))
+	store := NewRetryingStore(faults, RetryPolicy{Backoff: noBackoff})
+
+	// When the messages are iterated
+	var seqNums []int
+	err := store.IterateMessages(1, 2, func(seqNum int, msg []byte) error {
+		seqNums = append(seqNums, seqNum)
+		return nil
+	})
+
+	// Then each should be passed once
+	require.Nil(t, err)
+	assert.Equal(t, []int{1, 2}, seqNums)
+}
+
+func TestIsTransientError(t *testing.T) {
+	assert.True(t, IsTransientError(&StoreError{Backend: "pgx", Op: "save_message", Err: errors.New("deadlock detected")}))
+	assert.True(t, IsTransientError(errors.New("connection refused")))
+	assert.False(t, IsTransientError(&StoreError{Backend: "sql", Op: "save_message", Err: ErrDuplicateMessage}))
+	assert.False(t, IsTransientError(&ReadOnlyError{Op: "reset"}))
+	assert.False(t, IsTransientError(errors.New("disk full")))
+	assert.False(t, IsTransientError(nil))
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(100*time.Millisecond, time.Second, 0)
+	assert.Equal(t, 100*time.Millisecond, backoff(1))
+	assert.Equal(t, 400*time.Millisecond, backoff(3))
+	assert.Equal(t, time.Second, backoff(10))
+
+	jittered := ExponentialBackoff(100*time.Millisecond, time.Second, 0.5)
+	for i := 0; i < 100; i++ {
+		wait := jittered(1)
+		assert.True(t, wait >= 50*time.Millisecond && wait <= 150*time.Millisecond, wait)
+	}
+}
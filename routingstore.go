@@ -0,0 +1,152 @@
+package msgstore
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+)
+
+// RoutingRule routes the sessions whose sessionIDs match Pattern to the stores of Factory, see NewRoutingStoreFactory
+type RoutingRule struct {
+	// Pattern is matched against whole sessionIDs with the syntax of path.Match, where * matches any run of
+	// characters other than "/" and ? any one of them, e.g. "FIX.4.4-PROD-*" or "*-UAT-*"
+	Pattern string
+	Factory MessageStoreFactory
+}
+
+// routingStoreFactory keeps each distinct factory routed to once in backends, which the rules and the fallback refer to
+// by index, so that the route of a session identifies its backend whether or not its factory can be compared
+type routingStoreFactory struct {
+	rules []RoutingRule
+	// ruleBackends holds the index in backends of the factory of each rule, and fallbackBackend that of the fallback, or
+	// -1 if there is none
+	ruleBackends    []int
+	fallbackBackend int
+	backends        []MessageStoreFactory
+}
+
+// NewRoutingStoreFactory returns a MessageStoreFactory creating the store of each session with the factory of the first
+// of rules whose pattern matches its sessionID, or else with fallback, so that one engine can keep its production
+// sessions in one backend and its test sessions in another.  Create fails for a session no rule matches if fallback is
+// nil.  It fails if a pattern is malformed.
+func NewRoutingStoreFactory(rules []RoutingRule, fallback MessageStoreFactory) (MessageStoreFactory, error) {
+	f := &routingStoreFactory{rules: append([]RoutingRule(nil), rules...), fallbackBackend: -1}
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid routing pattern %q: %w", rule.Pattern, err)
+		}
+		if rule.Factory == nil {
+			return nil, fmt.Errorf("routing pattern %q has no factory", rule.Pattern)
+		}
+		f.ruleBackends = append(f.ruleBackends, f.addBackend(rule.Factory))
+	}
+	if fallback != nil {
+		f.fallbackBackend = f.addBackend(fallback)
+	}
+	return f, nil
+}
+
+// addBackend returns the index in backends of factory, adding it unless it is already there
+func (f *routingStoreFactory) addBackend(factory MessageStoreFactory) int {
+	for i, backend := range f.backends {
+		if sameFactory(factory, backend) {
+			return i
+		}
+	}
+	f.backends = append(f.backends, factory)
+	return len(f.backends) - 1
+}
+
+// sameFactory reports whether a and b are the same factory.  Factories of types that cannot be compared, such as the
+// file store factories holding their settings, are the same if they are deeply equal.
+func sameFactory(a, b MessageStoreFactory) bool {
+	if reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return false
+	}
+	if !reflect.TypeOf(a).Comparable() {
+		return reflect.DeepEqual(a, b)
+	}
+	return a == b
+}
+
+// route returns the index in backends of the factory of the session sessionID
+func (f *routingStoreFactory) route(sessionID string) (int, error) {
+	for i, rule := range f.rules {
+		if matched, _ := path.Match(rule.Pattern, sessionID); matched {
+			return f.ruleBackends[i], nil
+		}
+	}
+	if f.fallbackBackend < 0 {
+		return 0, fmt.Errorf("no routing rule matches session %s", sessionID)
+	}
+	return f.fallbackBackend, nil
+}
+
+// Create creates the store of sessionID with the factory it is routed to
+func (f *routingStoreFactory) Create(sessionID string) (MessageStore, error) {
+	backend, err := f.route(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return f.backends[backend].Create(sessionID)
+}
+
+// Close closes every factory routed to, returning the first failure
+func (f *routingStoreFactory) Close() (err error) {
+	for _, factory := range f.backends {
+		if closeErr := factory.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// CloneSession copies the session srcID to the session dstID, across backends if they are routed to different ones,
+// see SessionCloner
+func (f *routingStoreFactory) CloneSession(srcID, dstID string) error {
+	return CloneMessageStoreSession(f, srcID, dstID)
+}
+
+// RenameSession renames the session oldID to newID within the backend both are routed to, see SessionRenamer
+func (f *routingStoreFactory) RenameSession(oldID, newID string) error {
+	oldBackend, err := f.route(oldID)
+	if err != nil {
+		return err
+	}
+	newBackend, err := f.route(newID)
+	if err != nil {
+		return err
+	}
+	if oldBackend != newBackend {
+		return fmt.Errorf("sessions %s and %s are routed to different backends", oldID, newID)
+	}
+	renamer, ok := f.backends[oldBackend].(SessionRenamer)
+	if !ok {
+		return fmt.Errorf("the backend of session %s cannot rename its sessions", oldID)
+	}
+	return renamer.RenameSession(oldID, newID)
+}
+
+// ListSessions lists the sessions of every backend that is a SessionLister and that they are routed to, ordered by
+// sessionID, see SessionLister
+func (f *routingStoreFactory) ListSessions() ([]SessionInfo, error) {
+	var sessions []SessionInfo
+	for backend, factory := range f.backends {
+		lister, ok := factory.(SessionLister)
+		if !ok {
+			continue
+		}
+		listed, err := lister.ListSessions()
+		if err != nil {
+			return nil, err
+		}
+		for _, session := range listed {
+			if routed, err := f.route(session.SessionID); err == nil && routed == backend {
+				sessions = append(sessions, session)
+			}
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].SessionID < sessions[j].SessionID })
+	return sessions, nil
+}
@@ -0,0 +1,137 @@
+package msgstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingFactory creates memory stores, recording the sessions it creates them for and how often it is closed
+type recordingFactory struct {
+	created  []string
+	closed   int
+	closeErr error
+}
+
+func (f *recordingFactory) Create(sessionID string) (MessageStore, error) {
+	f.created = append(f.created, sessionID)
+	return NewMemoryStoreFactory().Create(sessionID)
+}
+
+func (f *recordingFactory) Close() error {
+	f.closed++
+	return f.closeErr
+}
+
+func (f *recordingFactory) ListSessions() ([]SessionInfo, error) {
+	var sessions []SessionInfo
+	for _, sessionID := range f.created {
+		sessions = append(sessions, SessionInfo{SessionID: sessionID})
+	}
+	return sessions, nil
+}
+
+func TestRoutingStoreFactory(t *testing.T) {
+	// Given a factory routing production sessions to one backend, test sessions to another, and the rest to a fallback
+	prod, uat, fallback := &recordingFactory{}, &recordingFactory{}, &recordingFactory{}
+	factory, err := NewRoutingStoreFactory([]RoutingRule{
+		{Pattern: "FIX.4.4-PROD-*", Factory: prod},
+		{Pattern: "*-UAT-*", Factory: uat},
+	}, fallback)
+	require.Nil(t, err)
+
+	// When stores are created
+	for _, sessionID := range []string{"FIX.4.4-PROD-A", "FIX.4.4-UAT-B", "FIX.4.2-PROD-C", "FIX.4.4-PROD-UAT-D"} {
+		_, err := factory.Create(sessionID)
+		require.Nil(t, err)
+	}
+
+	// Then each should be created by the backend of the first rule matching its session
+	assert.Equal(t, []string{"FIX.4.4-PROD-A", "FIX.4.4-PROD-UAT-D"}, prod.created)
+	assert.Equal(t, []string{"FIX.4.4-UAT-B"}, uat.created)
+	assert.Equal(t, []string{"FIX.4.2-PROD-C"}, fallback.created)
+
+	// And the sessions of every backend should be listed in order
+	sessions, err := factory.(SessionLister).ListSessions()
+	require.Nil(t, err)
+	var sessionIDs []string
+	for _, session := range sessions {
+		sessionIDs = append(sessionIDs, session.SessionID)
+	}
+	assert.Equal(t, []string{"FIX.4.2-PROD-C", "FIX.4.4-PROD-A", "FIX.4.4-PROD-UAT-D", "FIX.4.4-UAT-B"}, sessionIDs)
+}
+
+func TestRoutingStoreFactory_NoFallback(t *testing.T) {
+	// Given a factory routing production sessions only
+	factory, err := NewRoutingStoreFactory([]RoutingRule{{Pattern: "*-PROD-*", Factory: &recordingFactory{}}}, nil)
+	require.Nil(t, err)
+
+	// When the store of another session is created
+	_, err = factory.Create("FIX.4.4-UAT-A")
+
+	// Then it should fail
+	assert.EqualError(t, err, "no routing rule matches session FIX.4.4-UAT-A")
+}
+
+func TestRoutingStoreFactory_Close(t *testing.T) {
+	// Given a factory routing two patterns to one failing backend, and the rest to a fallback
+	shared, fallback := &recordingFactory{closeErr: errors.New("close failed")}, &recordingFactory{}
+	factory, err := NewRoutingStoreFactory([]RoutingRule{
+		{Pattern: "*-PROD-*", Factory: shared},
+		{Pattern: "*-DR-*", Factory: shared},
+	}, fallback)
+	require.Nil(t, err)
+
+	// When it is closed
+	err = factory.Close()
+
+	// Then each backend should be closed once, and the failure returned
+	assert.EqualError(t, err, "close failed")
+	assert.Equal(t, 1, shared.closed)
+	assert.Equal(t, 1, fallback.closed)
+}
+
+func TestNewRoutingStoreFactory_InvalidPattern(t *testing.T) {
+	_, err := NewRoutingStoreFactory([]RoutingRule{{Pattern: "FIX-[", Factory: &recordingFactory{}}}, nil)
+	assert.NotNil(t, err)
+
+	_, err = NewRoutingStoreFactory([]RoutingRule{{Pattern: "*"}}, nil)
+	assert.EqualError(t, err, `routing pattern "*" has no factory`)
+}
+
+func TestRoutingStoreFactory_FileBackend(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("RoutingFileBackend-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+
+	// Given two patterns routed to the same file backend
+	files := NewFileStoreFactory(map[string]string{FileStorePath: rootPath})
+	factory, err := NewRoutingStoreFactory([]RoutingRule{
+		{Pattern: "*-PROD-*", Factory: files},
+		{Pattern: "*-DR-*", Factory: files},
+	}, &recordingFactory{})
+	require.Nil(t, err)
+	store, err := factory.Create("FIX.4.4-PROD-A")
+	require.Nil(t, err)
+	require.Nil(t, store.Close())
+
+	// Then its sessions should be listed
+	sessions, err := factory.(SessionLister).ListSessions()
+	require.Nil(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "FIX.4.4-PROD-A", sessions[0].SessionID)
+
+	// And renamed within it, across the patterns
+	require.Nil(t, factory.(SessionRenamer).RenameSession("FIX.4.4-PROD-A", "FIX.4.4-DR-A"))
+	sessions, err = factory.(SessionLister).ListSessions()
+	require.Nil(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "FIX.4.4-DR-A", sessions[0].SessionID)
+
+	// But not to another backend
+	assert.EqualError(t, factory.(SessionRenamer).RenameSession("FIX.4.4-DR-A", "FIX.4.4-UAT-A"), "sessions FIX.4.4-DR-A and FIX.4.4-UAT-A are routed to different backends")
+}
@@ -0,0 +1,138 @@
+package msgstore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The session values a SessionStateStore keeps the state of a session under, named so as not to collide with those of
+// applications
+const (
+	sessionStateLoggedOn        = "msgstore.session_state.logged_on"
+	sessionStateLastLogon       = "msgstore.session_state.last_logon"
+	sessionStateLastLogout      = "msgstore.session_state.last_logout"
+	sessionStateLastHeartbeat   = "msgstore.session_state.last_heartbeat"
+	sessionStateLastReset       = "msgstore.session_state.last_reset"
+	sessionStateLastResetReason = "msgstore.session_state.last_reset_reason"
+)
+
+// SessionState is the state of a session an engine keeps beyond its seqnums, to decide how to recover after a restart,
+// e.g. whether the session was logged on when the engine stopped.  The times are zero if never recorded.
+type SessionState struct {
+	// LoggedOn reports whether the session was last logged on rather than logged out
+	LoggedOn bool
+	// LastLogon and LastLogout are the times of the last logon and logout
+	LastLogon  time.Time
+	LastLogout time.Time
+	// LastHeartbeat is the time of the last heartbeat recorded
+	LastHeartbeat time.Time
+	// LastReset and LastResetReason are the time of the last reset of the seqnums and the reason given for it
+	LastReset       time.Time
+	LastResetReason string
+}
+
+// SessionStateOption configures a SessionStateStore
+type SessionStateOption func(*SessionStateStore)
+
+// WithSessionStateClock stamps the recorded events with the time told by clock.  Defaults to the system clock.
+func WithSessionStateClock(clock Clock) SessionStateOption {
+	return func(s *SessionStateStore) { s.clock = clock }
+}
+
+// SessionStateStore persists the SessionState of a session in the backend of its MessageStore, as session values, so
+// that it survives restarts alongside the seqnums and is kept across Reset like them.  It is as safe for concurrent
+// use as its store.
+type SessionStateStore struct {
+	values SessionValueStore
+	clock  Clock
+}
+
+// NewSessionStateStore returns the SessionStateStore of the session of store, which must implement SessionValueStore,
+// as the stores of the backends of the package do, and the wrappers around them forward
+func NewSessionStateStore(store MessageStore, opts ...SessionStateOption) (*SessionStateStore, error) {
+	values, ok := store.(SessionValueStore)
+	if ok {
+		_, _, err := values.GetSessionValue(sessionStateLoggedOn)
+		ok = !errors.Is(err, ErrUnsupported)
+	}
+	if !ok {
+		return nil, errors.New("store does not persist session values")
+	}
+	s := &SessionStateStore{values: values}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// Load returns the state of the session as last recorded
+func (s *SessionStateStore) Load() (state SessionState, err error) {
+	var loggedOn string
+	if loggedOn, _, err = s.values.GetSessionValue(sessionStateLoggedOn); err != nil {
+		return state, err
+	}
+	state.LoggedOn = loggedOn == "Y"
+	if state.LastLogon, err = s.loadTime(sessionStateLastLogon); err != nil {
+		return state, err
+	}
+	if state.LastLogout, err = s.loadTime(sessionStateLastLogout); err != nil {
+		return state, err
+	}
+	if state.LastHeartbeat, err = s.loadTime(sessionStateLastHeartbeat); err != nil {
+		return state, err
+	}
+	if state.LastReset, err = s.loadTime(sessionStateLastReset); err != nil {
+		return state, err
+	}
+	state.LastResetReason, _, err = s.values.GetSessionValue(sessionStateLastResetReason)
+	return state, err
+}
+
+// loadTime returns the time stored under key, or the zero time if none is
+func (s *SessionStateStore) loadTime(key string) (time.Time, error) {
+	value, found, err := s.values.GetSessionValue(key)
+	if err != nil || !found {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid session state: %s: %w", key, err)
+	}
+	return t, nil
+}
+
+// storeTime stores the time of the clock under key
+func (s *SessionStateStore) storeTime(key string) error {
+	return s.values.SetSessionValue(key, clockNow(s.clock).UTC().Format(time.RFC3339Nano))
+}
+
+// RecordLogon records that the session logged on now
+func (s *SessionStateStore) RecordLogon() error {
+	if err := s.storeTime(sessionStateLastLogon); err != nil {
+		return err
+	}
+	return s.values.SetSessionValue(sessionStateLoggedOn, "Y")
+}
+
+// RecordLogout records that the session logged out now
+func (s *SessionStateStore) RecordLogout() error {
+	if err := s.storeTime(sessionStateLastLogout); err != nil {
+		return err
+	}
+	return s.values.SetSessionValue(sessionStateLoggedOn, "N")
+}
+
+// RecordHeartbeat records that the session exchanged a heartbeat now.  Each is a write to the backend, so engines with
+// short heartbeat intervals may prefer to record every few.
+func (s *SessionStateStore) RecordHeartbeat() error {
+	return s.storeTime(sessionStateLastHeartbeat)
+}
+
+// RecordReset records that the seqnums of the session were reset now, for reason
+func (s *SessionStateStore) RecordReset(reason string) error {
+	if err := s.values.SetSessionValue(sessionStateLastResetReason, reason); err != nil {
+		return err
+	}
+	return s.storeTime(sessionStateLastReset)
+}
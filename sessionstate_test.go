@@ -0,0 +1,77 @@
+package msgstore
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionStateStore(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SessionStateStore-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+
+	// Given the session state of a WAL store, recorded through a logon, heartbeat, reset and logout
+	clock := &manualClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	factory := NewWALStoreFactory(map[string]string{WALStorePath: rootPath}, WithWALClock(clock))
+	store, err := factory.Create("FIX.4.4-A-B")
+	require.Nil(t, err)
+	state, err := NewSessionStateStore(store, WithSessionStateClock(clock))
+	require.Nil(t, err)
+	require.Nil(t, state.RecordLogon())
+	clock.Set(clock.Now().Add(30 * time.Second))
+	require.Nil(t, state.RecordHeartbeat())
+	clock.Set(clock.Now().Add(time.Minute))
+	require.Nil(t, state.RecordReset("sequence reset requested"))
+	require.Nil(t, store.Reset())
+	require.Nil(t, state.RecordLogon())
+
+	// When the store is created again after a restart, having checkpointed
+	require.Nil(t, store.Close())
+	store, err = factory.Create("FIX.4.4-A-B")
+	require.Nil(t, err)
+	defer store.Close()
+	state, err = NewSessionStateStore(store)
+	require.Nil(t, err)
+	loaded, err := state.Load()
+
+	// Then the state should be as last recorded, kept across the reset
+	require.Nil(t, err)
+	assert.True(t, loaded.LoggedOn)
+	assert.True(t, loaded.LastLogon.Equal(time.Date(2024, 3, 1, 12, 1, 30, 0, time.UTC)))
+	assert.True(t, loaded.LastLogout.IsZero())
+	assert.True(t, loaded.LastHeartbeat.Equal(time.Date(2024, 3, 1, 12, 0, 30, 0, time.UTC)))
+	assert.True(t, loaded.LastReset.Equal(time.Date(2024, 3, 1, 12, 1, 30, 0, time.UTC)))
+	assert.Equal(t, "sequence reset requested", loaded.LastResetReason)
+
+	// And a logout should be recorded
+	require.Nil(t, state.RecordLogout())
+	loaded, err = state.Load()
+	require.Nil(t, err)
+	assert.False(t, loaded.LoggedOn)
+	assert.False(t, loaded.LastLogout.IsZero())
+}
+
+func TestSessionStateStore_Empty(t *testing.T) {
+	store, err := NewMemoryStoreFactory().Create("FIX.4.4-A-B")
+	require.Nil(t, err)
+	state, err := NewSessionStateStore(store)
+	require.Nil(t, err)
+
+	loaded, err := state.Load()
+	require.Nil(t, err)
+	assert.Equal(t, SessionState{}, loaded)
+}
+
+func TestNewSessionStateStore_Unsupported(t *testing.T) {
+	inner, err := NewMemoryStoreFactory().Create("FIX.4.4-A-B")
+	require.Nil(t, err)
+
+	// a wrapper forwards session values, so wrap a store hiding those of the memory store
+	_, err = NewSessionStateStore(NewReadOnlyStore(struct{ MessageStore }{inner}))
+	assert.EqualError(t, err, "store does not persist session values")
+}
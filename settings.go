@@ -0,0 +1,247 @@
+package msgstore
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Backend names the kind of MessageStore a Settings creates
+type Backend string
+
+const (
+	// BackendMemory keeps the stores in memory, see NewMemoryStoreFactory
+	BackendMemory Backend = "memory"
+	// BackendFile keeps the stores in files, see NewFileStoreFactory
+	BackendFile Backend = "file"
+	// BackendSQL keeps the stores in a database/sql database, see NewSQLStoreFactory
+	BackendSQL Backend = "sql"
+	// BackendPgx keeps the stores in postgres through pgx, see NewPgxStoreFactory
+	BackendPgx Backend = "pgx"
+	// BackendMongo keeps the stores in mongo, see NewMongoStoreFactory
+	BackendMongo Backend = "mongo"
+	// BackendWAL keeps the stores in memory, made durable by write-ahead logs in files, see NewWALStoreFactory
+	BackendWAL Backend = "wal"
+)
+
+// Clock tells the stores the time, which they stamp session creation and stored messages with, so that tests and
+// deterministic replays can substitute a fake clock.  It is given to NewStoreFactory with WithClock, or to the backends'
+// factories with WithMemoryClock, WithFileClock, WithSQLStoreClock, WithPgxClock and WithMongoClock.
+type Clock interface {
+	Now() time.Time
+}
+
+// Logger receives the diagnostic output of the stores, such as failed background pruning or slow operations.
+// *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Settings configures a MessageStoreFactory of any backend for NewStoreFactory.  Fields not used by the backend are
+// ignored, other than those set by options, which are rejected by backends that cannot honor them.
+type Settings struct {
+	Backend Backend
+
+	// Path is the directory of the file and wal backends
+	Path string
+	// Driver is the database/sql driver of the sql backend
+	Driver string
+	// DataSource is the data source name of the sql backend, the connection string of the pgx backend or the URL of
+	// the mongo backend
+	DataSource string
+	// Database is the database of the mongo backend
+	Database string
+	// TablePrefix is prepended to the names of the tables or collections of the sql, pgx and mongo backends
+	TablePrefix string
+	// DuplicateMessagePolicy is what SaveMessage does when a message is already stored for the seqnum.  Defaults to the
+	// backend's default.
+	DuplicateMessagePolicy DuplicateMessagePolicy
+
+	// Extra holds further settings of the file and sql backends, named as in their settings maps, e.g.
+	// SQLStoreAutoMigrate.  The fields above take precedence.
+	Extra map[string]string
+	// SQLOptions, PgxOptions and MongoOptions configure the sql, pgx and mongo backends further
+	SQLOptions   []SQLStoreOption
+	PgxOptions   []PgxStoreOption
+	MongoOptions []MongoStoreOption
+
+	// SlowOperationThreshold is the duration from which the mongo backend reports operations to the Logger.  Defaults to
+	// reporting none.
+	SlowOperationThreshold time.Duration
+
+	logger     Logger
+	clock      Clock
+	tls        *tls.Config
+	serializer RecordSerializer
+}
+
+// Option configures the concerns that Settings share across backends
+type Option func(*Settings)
+
+// WithLogger sends the stores' diagnostic output to logger.  Defaults to discarding it.
+func WithLogger(logger Logger) Option {
+	return func(s *Settings) { s.logger = logger }
+}
+
+// WithClock stamps session creation and stored messages with the time told by clock.  Defaults to the system clock.
+func WithClock(clock Clock) Option {
+	return func(s *Settings) { s.clock = clock }
+}
+
+// WithTLS connects the pgx and mongo backends to their servers over TLS configured by config.  The sql backend takes
+// its TLS settings in the data source name of its driver instead.
+func WithTLS(config *tls.Config) Option {
+	return func(s *Settings) { s.tls = config }
+}
+
+// WithRecordSerializer saves each message of the file, sql, pgx and mongo backends as a record wrapped by serializer in
+// an envelope carrying its metadata, see RecordSerializer.  The sql backend requires SQLStoreMessageColumnType "binary".
+func WithRecordSerializer(serializer RecordSerializer) Option {
+	return func(s *Settings) { s.serializer = serializer }
+}
+
+// systemClock tells the time of the system
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// clockNow returns the time told by clock, or the system time if it is nil
+func clockNow(clock Clock) time.Time {
+	if clock == nil {
+		return time.Now()
+	}
+	return clock.Now()
+}
+
+// NewStoreFactory returns the MessageStoreFactory of the backend configured by settings and opts.  The backend
+// constructors, such as NewFileStoreFactory and NewMongoStoreFactory, remain for existing code.
+func NewStoreFactory(settings Settings, opts ...Option) (MessageStoreFactory, error) {
+	for _, opt := range opts {
+		opt(&settings)
+	}
+	if settings.clock == nil {
+		settings.clock = systemClock{}
+	}
+
+	switch settings.Backend {
+	case BackendMemory:
+		if settings.tls != nil {
+			return nil, errors.New("the memory backend does not connect over TLS")
+		}
+		if settings.serializer != nil {
+			return nil, errors.New("the memory backend does not serialize records")
+		}
+		return NewMemoryStoreFactory(WithMemoryClock(settings.clock)), nil
+
+	case BackendFile:
+		if settings.tls != nil {
+			return nil, errors.New("the file backend does not connect over TLS")
+		}
+		extra := settings.extra()
+		if settings.Path != "" {
+			extra[FileStorePath] = settings.Path
+		}
+		if _, ok := extra[FileStorePath]; !ok {
+			return nil, errors.New("the file backend requires a path")
+		}
+		if settings.DuplicateMessagePolicy != "" {
+			extra[FileStoreDuplicateMessagePolicy] = string(settings.DuplicateMessagePolicy)
+		}
+		return NewFileStoreFactory(extra, WithFileClock(settings.clock), WithFileRecordSerializer(settings.serializer)), nil
+
+	case BackendWAL:
+		if settings.tls != nil {
+			return nil, errors.New("the wal backend does not connect over TLS")
+		}
+		if settings.serializer != nil {
+			return nil, errors.New("the wal backend does not serialize records")
+		}
+		if settings.DuplicateMessagePolicy != "" && settings.DuplicateMessagePolicy != DuplicateMessageReplace {
+			return nil, errors.New("the wal backend replaces duplicate messages")
+		}
+		extra := settings.extra()
+		if settings.Path != "" {
+			extra[WALStorePath] = settings.Path
+		}
+		if _, ok := extra[WALStorePath]; !ok {
+			return nil, errors.New("the wal backend requires a path")
+		}
+		return NewWALStoreFactory(extra, WithWALClock(settings.clock)), nil
+
+	case BackendSQL:
+		if settings.tls != nil {
+			return nil, errors.New("the sql backend takes its TLS settings in the data source name")
+		}
+		extra := settings.extra()
+		if settings.Driver != "" {
+			extra[SQLStoreDriver] = settings.Driver
+		}
+		if settings.DataSource != "" {
+			extra[SQLStoreDataSourceName] = settings.DataSource
+		}
+		if settings.TablePrefix != "" {
+			extra[SQLStoreTableNamePrefix] = settings.TablePrefix
+		}
+		if settings.DuplicateMessagePolicy != "" {
+			extra[SQLStoreDuplicateMessagePolicy] = string(settings.DuplicateMessagePolicy)
+		}
+		sqlOpts := append(append([]SQLStoreOption(nil), settings.SQLOptions...), WithSQLStoreClock(settings.clock), func(f *sqlStoreFactory) {
+			f.logger = settings.logger
+		})
+		if settings.serializer != nil {
+			sqlOpts = append(sqlOpts, WithSQLStoreRecordSerializer(settings.serializer))
+		}
+		return NewSQLStoreFactory(extra, sqlOpts...), nil
+
+	case BackendPgx:
+		if settings.DataSource == "" {
+			return nil, errors.New("the pgx backend requires a data source")
+		}
+		if len(settings.Extra) > 0 {
+			return nil, errors.New("the pgx backend takes no extra settings, only options")
+		}
+		pgxOpts := append([]PgxStoreOption{WithPgxTableNamePrefix(settings.TablePrefix)}, settings.PgxOptions...)
+		if settings.DuplicateMessagePolicy != "" {
+			pgxOpts = append(pgxOpts, WithPgxDuplicateMessagePolicy(settings.DuplicateMessagePolicy))
+		}
+		pgxOpts = append(pgxOpts, WithPgxClock(settings.clock), func(f *pgxStoreFactory) { f.tlsConfig = settings.tls })
+		if settings.serializer != nil {
+			pgxOpts = append(pgxOpts, WithPgxRecordSerializer(settings.serializer))
+		}
+		return NewPgxStoreFactory(settings.DataSource, pgxOpts...), nil
+
+	case BackendMongo:
+		if settings.DataSource == "" || settings.Database == "" {
+			return nil, errors.New("the mongo backend requires a data source and a database")
+		}
+		if len(settings.Extra) > 0 {
+			return nil, errors.New("the mongo backend takes no extra settings, only options")
+		}
+		mongoOpts := append([]MongoStoreOption(nil), settings.MongoOptions...)
+		if settings.DuplicateMessagePolicy != "" {
+			mongoOpts = append(mongoOpts, WithMongoDuplicateMessagePolicy(settings.DuplicateMessagePolicy))
+		}
+		if settings.tls != nil {
+			mongoOpts = append(mongoOpts, WithMongoTLSConfig(settings.tls))
+		}
+		if settings.logger != nil && settings.SlowOperationThreshold > 0 {
+			mongoOpts = append(mongoOpts, WithMongoSlowOperationLog(settings.logger, settings.SlowOperationThreshold))
+		}
+		if settings.serializer != nil {
+			mongoOpts = append(mongoOpts, WithMongoRecordSerializer(settings.serializer))
+		}
+		mongoOpts = append(mongoOpts, WithMongoClock(settings.clock))
+		return NewMongoStoreFactoryWithTablePrefix(settings.DataSource, settings.Database, settings.TablePrefix, mongoOpts...), nil
+	}
+	return nil, fmt.Errorf("unknown backend: %s", settings.Backend)
+}
+
+// extra returns a copy of the extra settings, for the fields to be added to
+func (s Settings) extra() map[string]string {
+	extra := make(map[string]string, len(s.Extra)+4)
+	for k, v := range s.Extra {
+		extra[k] = v
+	}
+	return extra
+}
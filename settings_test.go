@@ -0,0 +1,81 @@
+package msgstore
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fixedClock always tells the same time
+type fixedClock struct {
+	t time.Time
+}
+
+func (c fixedClock) Now() time.Time { return c.t }
+
+func TestNewStoreFactory_Memory(t *testing.T) {
+	// Given a memory backend with a fixed clock
+	clock := fixedClock{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	factory, err := NewStoreFactory(Settings{Backend: BackendMemory}, WithClock(clock))
+	require.Nil(t, err)
+
+	// When a store is created
+	store, err := factory.Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+
+	// Then its creation time should be told by the clock
+	assert.Equal(t, clock.t, store.CreationTime())
+}
+
+func TestNewStoreFactory_File(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SettingsFileStore-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+
+	// Given a file backend configured by its fields
+	clock := fixedClock{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	factory, err := NewStoreFactory(Settings{Backend: BackendFile, Path: rootPath, DuplicateMessagePolicy: DuplicateMessageError},
+		WithClock(clock))
+	require.Nil(t, err)
+
+	// When a store is created
+	store, err := factory.Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Then it should be stamped by the clock and honor the settings
+	assert.True(t, clock.t.Equal(store.CreationTime()))
+	require.Nil(t, store.SaveMessage(1, []byte("hello")))
+	assert.True(t, errors.Is(store.SaveMessage(1, []byte("hello")), ErrDuplicateMessage))
+}
+
+func TestNewStoreFactory_Invalid(t *testing.T) {
+	testCases := []struct {
+		name     string
+		settings Settings
+		opts     []Option
+	}{
+		{name: "unknown backend", settings: Settings{Backend: "bogus"}},
+		{name: "file without path", settings: Settings{Backend: BackendFile}},
+		{name: "wal without path", settings: Settings{Backend: BackendWAL}},
+		{name: "sql with tls", settings: Settings{Backend: BackendSQL}, opts: []Option{WithTLS(&tls.Config{})}},
+		{name: "memory with record serializer", settings: Settings{Backend: BackendMemory}, opts: []Option{WithRecordSerializer(jsonRecordSerializer{})}},
+		{name: "pgx without data source", settings: Settings{Backend: BackendPgx}},
+		{name: "mongo without database", settings: Settings{Backend: BackendMongo, DataSource: "mongodb://localhost"}},
+		{name: "mongo with extra settings", settings: Settings{Backend: BackendMongo, DataSource: "mongodb://localhost",
+			Database: "fix", Extra: map[string]string{"foo": "bar"}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewStoreFactory(tc.settings, tc.opts...)
+			assert.NotNil(t, err)
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package msgstore
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdMessageMarker leads every compressed message.  FIX messages begin with "8=", so it never leads an uncompressed one.
+const zstdMessageMarker byte = 0x00
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// zstdCodec returns the encoder and decoder shared by all stores, whose EncodeAll and DecodeAll are safe for concurrent use
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// compressMessage returns msg compressed behind the marker byte
+func compressMessage(msg []byte) []byte {
+	encoder, _ := zstdCodec()
+	return encoder.EncodeAll(msg, []byte{zstdMessageMarker})
+}
+
+// decodeMessage decrypts, decompresses and unwraps a message read from a binary column according to its marker bytes,
+// returning messages without a marker as is
+func (store *sqlStore) decodeMessage(message []byte) ([]byte, error) {
+	if !store.binaryMessages || len(message) == 0 {
+		return message, nil
+	}
+
+	if message[0] == encryptedMessageMarker {
+		if store.keyProvider == nil {
+			return nil, fmt.Errorf("unable to decrypt message: no key provider")
+		}
+		var err error
+		if message, err = decryptMessage(store.keyProvider, message); err != nil {
+			return nil, err
+		}
+		if len(message) == 0 {
+			return message, nil
+		}
+	}
+
+	message, err := decompressMessage(message)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecord(store.serializer, message)
+}
+
+// decompressMessage returns message decompressed if it leads with the marker byte, and as is otherwise
+func decompressMessage(message []byte) ([]byte, error) {
+	if len(message) == 0 || message[0] != zstdMessageMarker {
+		return message, nil
+	}
+
+	_, decoder := zstdCodec()
+	msg, err := decoder.DecodeAll(message[1:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress message: %w", err)
+	}
+	return msg, nil
+}
@@ -0,0 +1,79 @@
+package msgstore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLStore_DecodeMessage(t *testing.T) {
+	store := &sqlStore{binaryMessages: true}
+	msg := []byte("8=FIX.4.4\x019=5\x0135=0\x0110=000\x01")
+
+	// compressed messages are marked and decompressed on read
+	compressed := compressMessage(msg)
+	assert.Equal(t, zstdMessageMarker, compressed[0])
+	decoded, err := store.decodeMessage(compressed)
+	require.Nil(t, err)
+	assert.Equal(t, msg, decoded)
+
+	// legacy uncompressed rows are returned as is
+	decoded, err = store.decodeMessage(msg)
+	require.Nil(t, err)
+	assert.Equal(t, msg, decoded)
+
+	// corrupt compressed rows are reported
+	_, err = store.decodeMessage([]byte{zstdMessageMarker, 'x'})
+	assert.NotNil(t, err)
+}
+
+func TestSQLStore_MessageCompression(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreCompression-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	settings := map[string]string{
+		SQLStoreDriver:            "sqlite3",
+		SQLStoreDataSourceName:    path.Join(rootPath, "compression.db"),
+		SQLStoreAutoMigrate:       "Y",
+		SQLStoreMessageColumnType: "binary",
+	}
+
+	// Given a message written before compression was enabled
+	legacy := []byte("8=FIX.4.4\x0135=D\x01")
+	store, err := NewSQLStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessage(1, legacy))
+	require.Nil(t, store.Close())
+
+	// When a message is written with compression
+	settings[SQLStoreMessageCompression] = "zstd"
+	store, err = NewSQLStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+	verbose := bytes.Repeat([]byte("58=lorem ipsum dolor sit amet\x01"), 50)
+	require.Nil(t, store.SaveMessage(2, verbose))
+
+	// Then both should be read back intact
+	msgs, err := store.GetMessages(1, 2)
+	require.Nil(t, err)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, legacy, msgs[0])
+	assert.Equal(t, verbose, msgs[1])
+}
+
+func TestSQLStoreFactory_MessageCompressionRequiresBinary(t *testing.T) {
+	f := NewSQLStoreFactory(map[string]string{
+		SQLStoreDriver:             "sqlite3",
+		SQLStoreDataSourceName:     "",
+		SQLStoreMessageCompression: "zstd",
+	}).(*sqlStoreFactory)
+
+	_, err := f.parseSettings()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,275 @@
+package msgstore
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// sqlDialect captures the placeholder and identifier quoting conventions of a particular database
+type sqlDialect struct {
+	name          string
+	placeholder   func(n int) string
+	quoteIdent    func(ident string) string
+	textType      string
+	binaryType    string
+	timestampType string
+	createTable   func(table, columns string) string
+	addColumn     func(table, column string) string
+	maxParams     int
+	upsert        func(table string, keyColumns, columns, updateColumns []string, rows int) string
+	// selectForUpdate builds a SELECT of columns from the rows of table matching condition, locking them until the end of
+	// the transaction
+	selectForUpdate func(columns, table, condition string) string
+	// conflictCodes are the vendor error codes for deadlocks and serialization failures, which succeed when retried
+	conflictCodes []string
+}
+
+func questionPlaceholder(n int) string { return "?" }
+func dollarPlaceholder(n int) string   { return "$" + strconv.Itoa(n) }
+func colonPlaceholder(n int) string    { return ":" + strconv.Itoa(n) }
+func atPlaceholder(n int) string       { return "@p" + strconv.Itoa(n) }
+
+func doubleQuoteIdent(ident string) string {
+	return `"` + strings.Replace(ident, `"`, `""`, -1) + `"`
+}
+
+// oracleQuoteIdent upper-cases the plain identifiers it quotes, as oracle folds unquoted identifiers to upper case, so
+// that they resolve to the tables and columns created by unquoted DDL.  Other identifiers are quoted as they are.
+func oracleQuoteIdent(ident string) string {
+	if !isPlainSQLIdent(ident) {
+		return doubleQuoteIdent(ident)
+	}
+	return doubleQuoteIdent(strings.ToUpper(ident))
+}
+
+// isPlainSQLIdent reports whether ident is a letter followed by letters, digits and underscores, which databases
+// accept unquoted
+func isPlainSQLIdent(ident string) bool {
+	for i, r := range ident {
+		letter := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+		if !letter && (i == 0 || r != '_' && (r < '0' || r > '9')) {
+			return false
+		}
+	}
+	return ident != ""
+}
+
+func backtickQuoteIdent(ident string) string {
+	return "`" + strings.Replace(ident, "`", "``", -1) + "`"
+}
+
+func bracketQuoteIdent(ident string) string {
+	return "[" + strings.Replace(ident, "]", "]]", -1) + "]"
+}
+
+func createTableIfNotExists(table, columns string) string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (%s)`, table, columns)
+}
+
+func mssqlCreateTable(table, columns string) string {
+	return fmt.Sprintf(`IF OBJECT_ID(N'%s', N'U') IS NULL CREATE TABLE %s (%s)`, strings.Replace(table, "'", "''", -1), table, columns)
+}
+
+func alterTableAddColumn(table, column string) string {
+	return fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s`, table, column)
+}
+
+// mssqlAddColumn leaves out the COLUMN keyword, which T-SQL does not accept
+func mssqlAddColumn(table, column string) string {
+	return fmt.Sprintf(`ALTER TABLE %s ADD %s`, table, column)
+}
+
+func forUpdateSelect(columns, table, condition string) string {
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE %s FOR UPDATE`, columns, table, condition)
+}
+
+// mssqlSelectForUpdate locks the rows with a table hint, as T-SQL has no FOR UPDATE clause on SELECT
+func mssqlSelectForUpdate(columns, table, condition string) string {
+	return fmt.Sprintf(`SELECT %s FROM %s WITH (UPDLOCK, ROWLOCK) WHERE %s`, columns, table, condition)
+}
+
+// sqliteSelectForUpdate leaves the rows unlocked, as sqlite has no row locks: the transaction locks the whole database
+// as it first writes, failing with SQLITE_BUSY, which is retried, if another transaction wrote in between
+func sqliteSelectForUpdate(columns, table, condition string) string {
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE %s`, columns, table, condition)
+}
+
+// onConflictUpsert builds an upsert using the ON CONFLICT clause understood by postgres and sqlite 3.24+
+func onConflictUpsert(table string, keyColumns, columns, updateColumns []string, rows int) string {
+	action := "DO NOTHING"
+	if len(updateColumns) > 0 {
+		sets := make([]string, len(updateColumns))
+		for i, c := range updateColumns {
+			sets[i] = fmt.Sprintf("%s=excluded.%s", c, c)
+		}
+		action = "DO UPDATE SET " + strings.Join(sets, ", ")
+	}
+	return fmt.Sprintf(`INSERT INTO %s (%s) VALUES%s ON CONFLICT (%s) %s`,
+		table, strings.Join(columns, ", "), valuesList(len(columns), rows), strings.Join(keyColumns, ", "), action)
+}
+
+// onDuplicateKeyUpsert builds a mysql upsert
+func onDuplicateKeyUpsert(table string, keyColumns, columns, updateColumns []string, rows int) string {
+	sets := make([]string, len(updateColumns))
+	for i, c := range updateColumns {
+		sets[i] = fmt.Sprintf("%s=VALUES(%s)", c, c)
+	}
+	if len(sets) == 0 {
+		// assigning a key column to itself turns the conflicting insert into a no-op
+		sets = []string{fmt.Sprintf("%s=%s", keyColumns[0], keyColumns[0])}
+	}
+	return fmt.Sprintf(`INSERT INTO %s (%s) VALUES%s ON DUPLICATE KEY UPDATE %s`,
+		table, strings.Join(columns, ", "), valuesList(len(columns), rows), strings.Join(sets, ", "))
+}
+
+// mergeUpsert returns a builder for MERGE based upserts, as used by mssql and oracle.
+// sourceSuffix completes each SELECT that provides a source row, e.g. " FROM dual" for oracle.
+func mergeUpsert(sourceSuffix, terminator string) func(table string, keyColumns, columns, updateColumns []string, rows int) string {
+	return func(table string, keyColumns, columns, updateColumns []string, rows int) string {
+		source := make([]string, len(columns))
+		values := make([]string, len(columns))
+		for i, c := range columns {
+			source[i] = "? AS " + c
+			values[i] = "source." + c
+		}
+		selects := make([]string, rows)
+		for i := range selects {
+			selects[i] = "SELECT " + strings.Join(source, ", ") + sourceSuffix
+		}
+		on := make([]string, len(keyColumns))
+		for i, c := range keyColumns {
+			on[i] = fmt.Sprintf("target.%s=source.%s", c, c)
+		}
+
+		matched := ""
+		if len(updateColumns) > 0 {
+			sets := make([]string, len(updateColumns))
+			for i, c := range updateColumns {
+				sets[i] = fmt.Sprintf("target.%s=source.%s", c, c)
+			}
+			matched = " WHEN MATCHED THEN UPDATE SET " + strings.Join(sets, ", ")
+		}
+
+		return fmt.Sprintf(`MERGE INTO %s target USING (%s) source ON (%s)%s WHEN NOT MATCHED THEN INSERT (%s) VALUES(%s)%s`,
+			table, strings.Join(selects, " UNION ALL "), strings.Join(on, " AND "), matched, strings.Join(columns, ", "), strings.Join(values, ", "), terminator)
+	}
+}
+
+// valuesList returns the placeholder tuples for a multi-row VALUES clause, e.g. "(?, ?), (?, ?)"
+func valuesList(columns, rows int) string {
+	tuple := "(" + strings.TrimSuffix(strings.Repeat("?, ", columns), ", ") + ")"
+	return strings.TrimSuffix(strings.Repeat(tuple+", ", rows), ", ")
+}
+
+// oracle has no CREATE TABLE IF NOT EXISTS, so it is left without a createTable and cannot be auto-migrated.
+// It also lacks multi-row VALUES lists, so maxParams is left at zero and batches are inserted a row at a time.
+var sqlDialects = map[string]sqlDialect{
+	"sqlite3": {
+		name: "sqlite3", placeholder: questionPlaceholder, quoteIdent: doubleQuoteIdent,
+		textType: "TEXT", binaryType: "BLOB", timestampType: "DATETIME", createTable: createTableIfNotExists, addColumn: alterTableAddColumn, maxParams: 999,
+		upsert: onConflictUpsert, selectForUpdate: sqliteSelectForUpdate, conflictCodes: []string{"5", "6"}, // SQLITE_BUSY, SQLITE_LOCKED
+	},
+	"mysql": {
+		name: "mysql", placeholder: questionPlaceholder, quoteIdent: backtickQuoteIdent,
+		textType: "TEXT", binaryType: "LONGBLOB", timestampType: "DATETIME", createTable: createTableIfNotExists, addColumn: alterTableAddColumn, maxParams: 65535,
+		upsert: onDuplicateKeyUpsert, selectForUpdate: forUpdateSelect, conflictCodes: []string{"1213", "1205"}, // ER_LOCK_DEADLOCK, ER_LOCK_WAIT_TIMEOUT
+	},
+	"postgres": {
+		name: "postgres", placeholder: dollarPlaceholder, quoteIdent: doubleQuoteIdent,
+		textType: "TEXT", binaryType: "BYTEA", timestampType: "TIMESTAMP", createTable: createTableIfNotExists, addColumn: alterTableAddColumn, maxParams: 65535,
+		upsert: onConflictUpsert, selectForUpdate: forUpdateSelect, conflictCodes: []string{"40001", "40P01"}, // serialization_failure, deadlock_detected
+	},
+	"mssql": {
+		name: "mssql", placeholder: atPlaceholder, quoteIdent: bracketQuoteIdent,
+		textType: "NVARCHAR(MAX)", binaryType: "VARBINARY(MAX)", timestampType: "DATETIME2", createTable: mssqlCreateTable, addColumn: mssqlAddColumn, maxParams: 2100,
+		upsert: mergeUpsert("", ";"), selectForUpdate: mssqlSelectForUpdate, conflictCodes: []string{"1205"}, // deadlock victim
+	},
+	"oracle": {
+		name: "oracle", placeholder: colonPlaceholder, quoteIdent: oracleQuoteIdent,
+		textType: "CLOB", binaryType: "BLOB", timestampType: "TIMESTAMP",
+		upsert: mergeUpsert(" FROM dual", ""), selectForUpdate: forUpdateSelect, conflictCodes: []string{"60", "8177"}, // ORA-00060 deadlock, ORA-08177 can't serialize
+	},
+}
+
+// sqlDriverDialects maps well-known database/sql driver names to the dialect they speak
+var sqlDriverDialects = map[string]string{
+	"sqlite":    "sqlite3",
+	"sqlite3":   "sqlite3",
+	"mysql":     "mysql",
+	"postgres":  "postgres",
+	"pgx":       "postgres",
+	"sqlserver": "mssql",
+	"mssql":     "mssql",
+	"oracle":    "oracle",
+	"godror":    "oracle",
+	"goracle":   "oracle",
+	"oci8":      "oracle",
+}
+
+// sqlDriverPackages maps the import paths of well-known database/sql drivers to the driver names they register
+var sqlDriverPackages = map[string]string{
+	"github.com/mattn/go-sqlite3":      "sqlite3",
+	"modernc.org/sqlite":               "sqlite",
+	"github.com/go-sql-driver/mysql":   "mysql",
+	"github.com/lib/pq":                "postgres",
+	"github.com/jackc/pgx":             "pgx",
+	"github.com/denisenkom/go-mssqldb": "sqlserver",
+	"github.com/microsoft/go-mssqldb":  "sqlserver",
+	"github.com/godror/godror":         "godror",
+	"github.com/mattn/go-oci8":         "oci8",
+}
+
+// sqlDriverName infers the driver name db was opened with from the package of its driver, or returns "" if it is not well-known
+func sqlDriverName(db *sql.DB) string {
+	t := reflect.TypeOf(db.Driver())
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	pkgPath := t.PkgPath()
+	for pkg, driver := range sqlDriverPackages {
+		if pkgPath == pkg || strings.HasPrefix(pkgPath, pkg+"/") {
+			return driver
+		}
+	}
+	return ""
+}
+
+// lookupSQLDialect returns the dialect with the given name, or infers it from the driver name when dialectName is empty.
+// Unknown drivers fall back to the sqlite3 dialect, which uses the plain `?` placeholder syntax.
+func lookupSQLDialect(driver, dialectName string) (sqlDialect, error) {
+	if dialectName == "" {
+		if dialectName = sqlDriverDialects[driver]; dialectName == "" {
+			dialectName = "sqlite3"
+		}
+	}
+
+	dialect, ok := sqlDialects[dialectName]
+	if !ok {
+		return sqlDialect{}, fmt.Errorf("unsupported sql dialect: %s", dialectName)
+	}
+	return dialect, nil
+}
+
+// rebind rewrites the `?` placeholders in query into the dialect's native placeholder syntax.
+// Queries must not contain literal question marks.
+func (d sqlDialect) rebind(query string) string {
+	if d.placeholder(1) == "?" {
+		return query
+	}
+
+	var b bytes.Buffer
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(d.placeholder(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
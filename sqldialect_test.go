@@ -0,0 +1,89 @@
+package msgstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupSQLDialect(t *testing.T) {
+	var testCases = []struct {
+		driver, dialectName, expected string
+	}{
+		{driver: "sqlite3", expected: "sqlite3"},
+		{driver: "mysql", expected: "mysql"},
+		{driver: "postgres", expected: "postgres"},
+		{driver: "pgx", expected: "postgres"},
+		{driver: "sqlserver", expected: "mssql"},
+		{driver: "godror", expected: "oracle"},
+		{driver: "somethingelse", expected: "sqlite3"},
+		{driver: "somethingelse", dialectName: "postgres", expected: "postgres"},
+		{driver: "mysql", dialectName: "mssql", expected: "mssql"},
+	}
+
+	for _, tc := range testCases {
+		dialect, err := lookupSQLDialect(tc.driver, tc.dialectName)
+		require.Nil(t, err)
+		assert.Equal(t, tc.expected, dialect.name)
+	}
+
+	_, err := lookupSQLDialect("sqlite3", "nosuchdialect")
+	assert.NotNil(t, err)
+}
+
+func TestSQLDialect_Rebind(t *testing.T) {
+	query := `UPDATE t SET a=?, b=? WHERE c=?`
+	var testCases = []struct {
+		dialectName, expected string
+	}{
+		{dialectName: "sqlite3", expected: `UPDATE t SET a=?, b=? WHERE c=?`},
+		{dialectName: "mysql", expected: `UPDATE t SET a=?, b=? WHERE c=?`},
+		{dialectName: "postgres", expected: `UPDATE t SET a=$1, b=$2 WHERE c=$3`},
+		{dialectName: "mssql", expected: `UPDATE t SET a=@p1, b=@p2 WHERE c=@p3`},
+		{dialectName: "oracle", expected: `UPDATE t SET a=:1, b=:2 WHERE c=:3`},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, sqlDialects[tc.dialectName].rebind(query))
+	}
+}
+
+func TestSQLDialect_QuoteIdent(t *testing.T) {
+	assert.Equal(t, `"fix_messages"`, sqlDialects["postgres"].quoteIdent("fix_messages"))
+	assert.Equal(t, "`fix_messages`", sqlDialects["mysql"].quoteIdent("fix_messages"))
+	assert.Equal(t, `[fix_messages]`, sqlDialects["mssql"].quoteIdent("fix_messages"))
+	assert.Equal(t, `"a""b"`, sqlDialects["sqlite3"].quoteIdent(`a"b`))
+	assert.Equal(t, `"FIX_MESSAGES"`, sqlDialects["oracle"].quoteIdent("fix_messages"))
+	assert.Equal(t, `"fix-messages"`, sqlDialects["oracle"].quoteIdent("fix-messages"))
+}
+
+func TestSQLDialect_OracleTableNames(t *testing.T) {
+	// Given oracle stores with and without a schema and a table name prefix
+	prefixed := &sqlStore{dialect: sqlDialects["oracle"], sqlSchemaName: "msgstore", sqlTableNamePrefix: "fix_"}
+	plain := &sqlStore{dialect: sqlDialects["oracle"]}
+
+	// Then their statements should name the upper-case tables created by unquoted DDL
+	assert.Equal(t, `DELETE FROM "MSGSTORE"."FIX_MESSAGES" WHERE session_id=:1`,
+		prefixed.sqlf(`DELETE FROM %s WHERE session_id=?`, prefixed.tableName("messages")))
+	assert.Equal(t, `SELECT creation_time FROM "SESSIONS" WHERE session_id=:1`,
+		plain.sqlf(`SELECT creation_time FROM %s WHERE session_id=?`, plain.tableName("sessions")))
+}
+
+func TestSQLDialect_Upsert(t *testing.T) {
+	keys := []string{"id"}
+	cols := []string{"id", "a", "b"}
+	update := []string{"b"}
+
+	assert.Equal(t, `INSERT INTO t (id, a, b) VALUES(?, ?, ?) ON CONFLICT (id) DO UPDATE SET b=excluded.b`, sqlDialects["postgres"].upsert("t", keys, cols, update, 1))
+	assert.Equal(t, `INSERT INTO t (id, a, b) VALUES(?, ?, ?), (?, ?, ?) ON CONFLICT (id) DO NOTHING`, sqlDialects["sqlite3"].upsert("t", keys, cols, nil, 2))
+	assert.Equal(t, `INSERT INTO t (id, a, b) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE b=VALUES(b)`, sqlDialects["mysql"].upsert("t", keys, cols, update, 1))
+	assert.Equal(t, `INSERT INTO t (id, a, b) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE id=id`, sqlDialects["mysql"].upsert("t", keys, cols, nil, 1))
+	assert.Equal(t, `MERGE INTO t target USING (SELECT ? AS id, ? AS a, ? AS b) source ON (target.id=source.id) WHEN MATCHED THEN UPDATE SET target.b=source.b WHEN NOT MATCHED THEN INSERT (id, a, b) VALUES(source.id, source.a, source.b);`, sqlDialects["mssql"].upsert("t", keys, cols, update, 1))
+	assert.Equal(t, `MERGE INTO t target USING (SELECT ? AS id, ? AS a, ? AS b FROM dual UNION ALL SELECT ? AS id, ? AS a, ? AS b FROM dual) source ON (target.id=source.id) WHEN NOT MATCHED THEN INSERT (id, a, b) VALUES(source.id, source.a, source.b)`, sqlDialects["oracle"].upsert("t", keys, cols, nil, 2))
+}
+
+func TestSQLDialect_AddColumn(t *testing.T) {
+	assert.Equal(t, `ALTER TABLE "t" ADD COLUMN c INT NULL`, sqlDialects["postgres"].addColumn(`"t"`, "c INT NULL"))
+	assert.Equal(t, `ALTER TABLE [t] ADD c INT NULL`, sqlDialects["mssql"].addColumn(`[t]`, "c INT NULL"))
+}
@@ -0,0 +1,73 @@
+package msgstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// encryptedMessageMarker leads every encrypted message, followed by the length and bytes of the key ID, the nonce and the
+// AES-GCM sealed message
+const encryptedMessageMarker byte = 0x01
+
+func newMessageAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("data key must be 32 bytes, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptMessage seals msg under the provider's current data key
+func encryptMessage(provider MessageKeyProvider, msg []byte) ([]byte, error) {
+	keyID, key, err := provider.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get data key: %w", err)
+	}
+	if len(keyID) > 255 {
+		return nil, fmt.Errorf("data key ID is longer than 255 bytes: %s", keyID)
+	}
+	aead, err := newMessageAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", keyID, err)
+	}
+
+	header := append([]byte{encryptedMessageMarker, byte(len(keyID))}, keyID...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(append(header, nonce...), nonce, msg, nil), nil
+}
+
+// decryptMessage opens a message sealed by encryptMessage with the data key it records the ID of
+func decryptMessage(provider MessageKeyProvider, message []byte) ([]byte, error) {
+	if len(message) < 2 || len(message) < 2+int(message[1]) {
+		return nil, fmt.Errorf("unable to decrypt message: truncated header")
+	}
+	keyID := string(message[2 : 2+int(message[1])])
+	sealed := message[2+int(message[1]):]
+
+	key, err := provider.Key(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get data key: %s: %w", keyID, err)
+	}
+	aead, err := newMessageAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", keyID, err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("unable to decrypt message: truncated nonce")
+	}
+
+	msg, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt message with key %s: %w", keyID, err)
+	}
+	return msg, nil
+}
@@ -0,0 +1,130 @@
+package msgstore
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticKeyProvider serves fixed keys, encrypting with the one named by current
+type staticKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (p *staticKeyProvider) CurrentKey() (string, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *staticKeyProvider) Key(keyID string) ([]byte, error) {
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key")
+	}
+	return key, nil
+}
+
+func newStaticKeyProvider() *staticKeyProvider {
+	return &staticKeyProvider{current: "k1", keys: map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 32),
+	}}
+}
+
+func TestEncryptMessage(t *testing.T) {
+	provider := newStaticKeyProvider()
+	msg := []byte("8=FIX.4.4\x0135=D\x0111=order1\x01")
+
+	// Given a message encrypted under the first key
+	sealed, err := encryptMessage(provider, msg)
+	require.Nil(t, err)
+	assert.Equal(t, encryptedMessageMarker, sealed[0])
+	assert.False(t, bytes.Contains(sealed, []byte("order1")))
+
+	// When the keys are rotated
+	provider.current = "k2"
+	rotated, err := encryptMessage(provider, msg)
+	require.Nil(t, err)
+
+	// Then messages under either key should decrypt
+	opened, err := decryptMessage(provider, sealed)
+	require.Nil(t, err)
+	assert.Equal(t, msg, opened)
+	opened, err = decryptMessage(provider, rotated)
+	require.Nil(t, err)
+	assert.Equal(t, msg, opened)
+
+	// And tampered or truncated messages should not
+	sealed[len(sealed)-1] ^= 0xff
+	_, err = decryptMessage(provider, sealed)
+	assert.NotNil(t, err)
+	_, err = decryptMessage(provider, sealed[:4])
+	assert.NotNil(t, err)
+
+	// And a key that isn't 256 bits should be refused
+	provider.keys["short"] = []byte("too short")
+	provider.current = "short"
+	_, err = encryptMessage(provider, msg)
+	assert.NotNil(t, err)
+}
+
+func TestSQLStore_DecodeEncryptedMessage(t *testing.T) {
+	store := &sqlStore{binaryMessages: true, compressMessages: true, keyProvider: newStaticKeyProvider()}
+	msg := []byte("8=FIX.4.4\x0135=0\x01")
+
+	// compressed and encrypted
+	row, err := store.messageRow(1, msg)
+	require.Nil(t, err)
+	decoded, err := store.decodeMessage(row[1].([]byte))
+	require.Nil(t, err)
+	assert.Equal(t, msg, decoded)
+
+	// legacy plaintext
+	decoded, err = store.decodeMessage(msg)
+	require.Nil(t, err)
+	assert.Equal(t, msg, decoded)
+
+	// without the key provider
+	_, err = (&sqlStore{binaryMessages: true}).decodeMessage(row[1].([]byte))
+	assert.NotNil(t, err)
+}
+
+func TestSQLStore_MessageEncryption(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreEncryption-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	settings := map[string]string{
+		SQLStoreDriver:            "sqlite3",
+		SQLStoreDataSourceName:    path.Join(rootPath, "encryption.db"),
+		SQLStoreAutoMigrate:       "Y",
+		SQLStoreMessageColumnType: "binary",
+	}
+	store, err := NewSQLStoreFactory(settings, WithSQLStoreKeyProvider(newStaticKeyProvider())).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Given a saved message
+	msg := []byte("8=FIX.4.4\x0135=D\x0111=secret\x01")
+	require.Nil(t, store.SaveMessage(1, msg))
+
+	// Then the store should read it back
+	msgs, err := store.GetMessages(1, 1)
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, msg, msgs[0])
+
+	// And the database should not hold it in plaintext
+	db, err := sql.Open("sqlite3", settings[SQLStoreDataSourceName])
+	require.Nil(t, err)
+	defer db.Close()
+	var raw []byte
+	require.Nil(t, db.QueryRow(`SELECT message FROM messages`).Scan(&raw))
+	assert.False(t, bytes.Contains(raw, []byte("secret")))
+}
@@ -0,0 +1,105 @@
+package msgstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Ping verifies the database can be reached
+func (store *sqlStore) Ping() error {
+	return store.PingContext(context.Background())
+}
+
+// PingContext is like Ping, but the database operation is bounded by ctx
+func (store *sqlStore) PingContext(ctx context.Context) (err error) {
+	defer store.observe("ping", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	return store.db.PingContext(ctx)
+}
+
+// Healthy verifies the database can be reached and has the tables and columns the store uses
+func (store *sqlStore) Healthy() error {
+	return store.HealthyContext(context.Background())
+}
+
+// HealthyContext is like Healthy, but the database operations are bounded by ctx
+func (store *sqlStore) HealthyContext(ctx context.Context) (err error) {
+	defer store.observe("healthy", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	if err := store.db.PingContext(ctx); err != nil {
+		return err
+	}
+	return store.verifySchema(ctx)
+}
+
+// HealthCheck verifies the database can be reached and the session's row and messages can be read, see MessageStore
+func (store *sqlStore) HealthCheck(ctx context.Context) (err error) {
+	defer store.observe("health_check", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	return store.withRetry(ctx, func() error {
+		if err := store.db.PingContext(ctx); err != nil {
+			return err
+		}
+		var outgoingSeqNum int
+		row := store.db.QueryRowContext(ctx, store.sqlf(`SELECT outgoing_seqnum FROM %s WHERE session_id=?`, store.sessionsTable), store.sessionID)
+		if err := row.Scan(&outgoingSeqNum); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		var lastSeqNum sql.NullInt64
+		row = store.db.QueryRowContext(ctx, store.sqlf(`SELECT MAX(msgseqnum) FROM %s WHERE session_id=?`, store.messagesTable), store.sessionID)
+		return row.Scan(&lastSeqNum)
+	})
+}
+
+// verifySchema selects no rows from each table, which fails if the table or any of the columns the store uses are missing
+func (store *sqlStore) verifySchema(ctx context.Context) error {
+	sessionColumns := []string{"session_id", "creation_time", "incoming_seqnum", "outgoing_seqnum"}
+	if store.leaseTTL > 0 {
+		sessionColumns = append(sessionColumns, "lease_owner", "lease_expires")
+	}
+	if store.archiveOnReset {
+		sessionColumns = append(sessionColumns, "reset_generation")
+	}
+
+	tables := []struct {
+		table   string
+		columns []string
+	}{
+		{store.sessionsTable, sessionColumns},
+		{store.messagesTable, store.messageColumns()},
+	}
+	for _, t := range tables {
+		if err := store.selectNoRows(ctx, t.table, t.columns); err != nil {
+			return fmt.Errorf("table %s is missing or lacks columns (%s), create it from the _sql scripts or set %s: %w",
+				t.table, strings.Join(t.columns, ", "), SQLStoreAutoMigrate, err)
+		}
+	}
+	return nil
+}
+
+// selectNoRows runs a query of columns from table matching no rows, stepping its cursor, as some drivers, e.g.
+// go-sqlite3, only report a table dropped by another connection once the statement is stepped
+func (store *sqlStore) selectNoRows(ctx context.Context, table string, columns []string) error {
+	rows, err := store.db.QueryContext(ctx, fmt.Sprintf(`SELECT %s FROM %s WHERE 1=0`, strings.Join(columns, ", "), table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+	}
+	return rows.Err()
+}
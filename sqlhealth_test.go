@@ -0,0 +1,52 @@
+package msgstore
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLStore_Healthy(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreHealthy-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	settings := map[string]string{
+		SQLStoreDriver:         "sqlite3",
+		SQLStoreDataSourceName: path.Join(rootPath, "healthy.db"),
+		SQLStoreAutoMigrate:    "Y",
+	}
+	store, err := NewSQLStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Given a store with its schema in place
+	checker, ok := store.(HealthChecker)
+	require.True(t, ok)
+
+	// Then it should be healthy
+	assert.Nil(t, checker.Ping())
+	assert.Nil(t, checker.Healthy())
+
+	// When the messages table is dropped
+	db, err := sql.Open("sqlite3", settings[SQLStoreDataSourceName])
+	require.Nil(t, err)
+	defer db.Close()
+	_, err = db.Exec(`DROP TABLE messages`)
+	require.Nil(t, err)
+
+	// Then it should be reported unhealthy
+	assert.Nil(t, checker.Ping())
+	assert.NotNil(t, checker.Healthy())
+
+	// And a factory verifying the schema should refuse to create stores
+	settings[SQLStoreAutoMigrate] = "N"
+	settings[SQLStoreVerifySchema] = "Y"
+	_, err = NewSQLStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	assert.NotNil(t, err)
+}
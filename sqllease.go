@@ -0,0 +1,199 @@
+package msgstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var errSQLLeaseDisabled = errors.New("session leasing is not enabled, see SQLStoreLeaseTTL")
+
+// defaultSQLLeaseOwner identifies the running process as hostname:pid
+func defaultSQLLeaseOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+// claimInitialLease takes the lease at startup if it is available.  A store finding the lease held by another store
+// starts in standby, able to read but not to update the session until it acquires the lease.
+func (store *sqlStore) claimInitialLease(ctx context.Context) error {
+	if store.leaseTTL <= 0 {
+		return nil
+	}
+	err := store.renewLease(ctx)
+	if errors.Is(err, ErrSessionLeaseHeld) {
+		return nil
+	}
+	return err
+}
+
+// updateLeasedSession sets columns of the session row to values and renews the store's lease, provided the lease is
+// free, expired or already held by the store.  With force the lease is taken regardless.  The session row is locked
+// while the lease is checked, so that two stores cannot both take it, and inserted if it has gone missing.  Given a
+// *sql.DB, the row is locked in a transaction of its own; given a *sql.Tx, it stays locked until the end of the tx.
+func (store *sqlStore) updateLeasedSession(ctx context.Context, db sqlExecer, force bool, columns []string, values []interface{}) error {
+	if sqlDB, ok := db.(*sql.DB); ok {
+		tx, err := sqlDB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := store.updateLeasedSession(ctx, tx, force, columns, values); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	now := store.cache.now().UTC()
+	var owner sql.NullString
+	var expires sql.NullTime
+	lock := store.dialect.rebind(store.dialect.selectForUpdate("lease_owner, lease_expires", store.sessionsTable, "session_id=?"))
+	err := db.QueryRowContext(ctx, lock, store.sessionID).Scan(&owner, &expires)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if err := store.insertLeasedSession(ctx, db, now); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case !force && owner.Valid && owner.String != store.leaseOwner && !(expires.Valid && expires.Time.Before(now)):
+		return ErrSessionLeaseHeld
+	}
+
+	var sets bytes.Buffer
+	for _, c := range columns {
+		sets.WriteString(c + "=?, ")
+	}
+	args := append(append([]interface{}{}, values...), store.leaseOwner, now.Add(store.leaseTTL), store.sessionID)
+	_, err = db.ExecContext(ctx, store.sqlf(`UPDATE %s SET `+sets.String()+`lease_owner=?, lease_expires=? WHERE session_id=?`, store.sessionsTable), args...)
+	return err
+}
+
+// insertLeasedSession inserts the missing session row with the store's seqnums, holding the lease
+func (store *sqlStore) insertLeasedSession(ctx context.Context, db sqlExecer, now time.Time) error {
+	columns := "session_id, creation_time, incoming_seqnum, outgoing_seqnum, lease_owner, lease_expires"
+	args := []interface{}{store.sessionID, store.cache.CreationTime(), store.cache.NextTargetMsgSeqNum(), store.cache.NextSenderMsgSeqNum(), store.leaseOwner, now.Add(store.leaseTTL)}
+	if store.archiveOnReset {
+		columns += ", reset_generation"
+		args = append(args, store.resetGeneration)
+	}
+	_, err := db.ExecContext(ctx, store.sqlf(`INSERT INTO %s (%s) VALUES%s`, store.sessionsTable, columns, valuesList(len(args), 1)), args...)
+	return err
+}
+
+// renewLease renews the store's lease, failing with ErrSessionLeaseHeld if another store holds it
+func (store *sqlStore) renewLease(ctx context.Context) error {
+	return store.withRetry(ctx, func() error { return store.updateLeasedSession(ctx, store.db, false, nil, nil) })
+}
+
+// withLease runs fn in a transaction that first renews the store's lease, keeping the session row locked until fn's
+// writes are committed so that a standby cannot write the session meanwhile.  Without lease mode fn runs on its own.
+func (store *sqlStore) withLease(ctx context.Context, fn func(db sqlExecer) error) error {
+	if store.leaseTTL <= 0 {
+		return fn(store.db)
+	}
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := store.updateLeasedSession(ctx, tx, false, nil, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// AcquireLease takes the session lease if it is free, expired or already held, and reloads the seqnums
+func (store *sqlStore) AcquireLease() error {
+	return store.AcquireLeaseContext(context.Background())
+}
+
+// AcquireLeaseContext is like AcquireLease, but the database operations are bounded by ctx
+func (store *sqlStore) AcquireLeaseContext(ctx context.Context) (err error) {
+	defer store.observe("acquire_lease", time.Now(), &err)
+
+	return store.claimLease(ctx, false)
+}
+
+// TakeoverLease takes the session lease even if another store holds it, and reloads the seqnums.
+// It is intended for operator initiated failover when the active engine is known to be down.
+func (store *sqlStore) TakeoverLease() error {
+	return store.TakeoverLeaseContext(context.Background())
+}
+
+// TakeoverLeaseContext is like TakeoverLease, but the database operations are bounded by ctx
+func (store *sqlStore) TakeoverLeaseContext(ctx context.Context) (err error) {
+	defer store.observe("takeover_lease", time.Now(), &err)
+
+	return store.claimLease(ctx, true)
+}
+
+func (store *sqlStore) claimLease(ctx context.Context, force bool) error {
+	if store.leaseTTL <= 0 {
+		return errSQLLeaseDisabled
+	}
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	if err := store.withRetry(ctx, func() error { return store.updateLeasedSession(ctx, store.db, force, nil, nil) }); err != nil {
+		return err
+	}
+
+	// the previous holder may have advanced the seqnums since they were loaded
+	if err := store.cache.Reset(); err != nil {
+		return err
+	}
+	return store.populateCache(ctx)
+}
+
+// RenewLease extends the session lease held by the store, failing with ErrSessionLeaseHeld if it has been taken over
+func (store *sqlStore) RenewLease() error {
+	return store.RenewLeaseContext(context.Background())
+}
+
+// RenewLeaseContext is like RenewLease, but the database operation is bounded by ctx
+func (store *sqlStore) RenewLeaseContext(ctx context.Context) (err error) {
+	defer store.observe("renew_lease", time.Now(), &err)
+
+	if store.leaseTTL <= 0 {
+		return errSQLLeaseDisabled
+	}
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	return store.renewLease(ctx)
+}
+
+// ReleaseLease gives up the session lease if the store holds it
+func (store *sqlStore) ReleaseLease() error {
+	return store.ReleaseLeaseContext(context.Background())
+}
+
+// ReleaseLeaseContext is like ReleaseLease, but the database operation is bounded by ctx
+func (store *sqlStore) ReleaseLeaseContext(ctx context.Context) (err error) {
+	defer store.observe("release_lease", time.Now(), &err)
+
+	if store.leaseTTL <= 0 {
+		return errSQLLeaseDisabled
+	}
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	_, err = store.exec(ctx, store.sqlf(`UPDATE %s SET lease_owner=NULL, lease_expires=NULL WHERE session_id=? AND lease_owner=?`, store.sessionsTable),
+		store.sessionID, store.leaseOwner)
+	return err
+}
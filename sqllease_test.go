@@ -0,0 +1,147 @@
+package msgstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newLeaseTestStores(t *testing.T, ttl string) (primary, standby MessageStore, cleanup func()) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreLease-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	dsn := path.Join(rootPath, fmt.Sprintf("%d.db", time.Now().UnixNano()))
+
+	settings := func(owner string) map[string]string {
+		return map[string]string{
+			SQLStoreDriver:         "sqlite3",
+			SQLStoreDataSourceName: dsn,
+			SQLStoreAutoMigrate:    "Y",
+			SQLStoreLeaseTTL:       ttl,
+			SQLStoreLeaseOwner:     owner,
+		}
+	}
+
+	primary, err := NewSQLStoreFactory(settings("primary")).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	standby, err = NewSQLStoreFactory(settings("standby")).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+
+	return primary, standby, func() {
+		primary.Close()
+		standby.Close()
+		os.RemoveAll(rootPath)
+	}
+}
+
+func TestSQLStore_Lease(t *testing.T) {
+	primary, standby, cleanup := newLeaseTestStores(t, "1m")
+	defer cleanup()
+
+	// Given a primary that took the lease at startup
+	require.Nil(t, primary.IncrNextSenderMsgSeqNum())
+
+	// Then the standby cannot advance the seqnums or reset the session
+	assert.True(t, errors.Is(standby.IncrNextSenderMsgSeqNum(), ErrSessionLeaseHeld))
+	assert.True(t, errors.Is(standby.Reset(), ErrSessionLeaseHeld))
+	assert.True(t, errors.Is(standby.(SessionLeaser).AcquireLease(), ErrSessionLeaseHeld))
+
+	// When the standby takes over
+	require.Nil(t, standby.(SessionLeaser).TakeoverLease())
+
+	// Then it should have the primary's seqnums
+	assert.Equal(t, 2, standby.NextSenderMsgSeqNum())
+	require.Nil(t, standby.IncrNextSenderMsgSeqNum())
+
+	// And the primary should have lost the lease
+	assert.True(t, errors.Is(primary.IncrNextSenderMsgSeqNum(), ErrSessionLeaseHeld))
+	assert.True(t, errors.Is(primary.(SessionLeaser).RenewLease(), ErrSessionLeaseHeld))
+
+	// When the standby releases the lease
+	require.Nil(t, standby.(SessionLeaser).ReleaseLease())
+
+	// Then the primary can acquire it again and continue from the standby's seqnums
+	require.Nil(t, primary.(SessionLeaser).AcquireLease())
+	assert.Equal(t, 3, primary.NextSenderMsgSeqNum())
+	require.Nil(t, primary.IncrNextSenderMsgSeqNum())
+}
+
+func TestSQLStore_LeaseExpiry(t *testing.T) {
+	primary, standby, cleanup := newLeaseTestStores(t, "50ms")
+	defer cleanup()
+
+	// Given a primary whose lease is live
+	require.Nil(t, primary.IncrNextSenderMsgSeqNum())
+	assert.True(t, errors.Is(standby.IncrNextTargetMsgSeqNum(), ErrSessionLeaseHeld))
+
+	// When the primary stops renewing it
+	time.Sleep(100 * time.Millisecond)
+
+	// Then the standby can acquire it
+	require.Nil(t, standby.(SessionLeaser).AcquireLease())
+	assert.Equal(t, 2, standby.NextSenderMsgSeqNum())
+	assert.True(t, errors.Is(primary.IncrNextSenderMsgSeqNum(), ErrSessionLeaseHeld))
+}
+
+func TestSQLStore_LeaseGuardsMessages(t *testing.T) {
+	primary, standby, cleanup := newLeaseTestStores(t, "1m")
+	defer cleanup()
+
+	// Given a primary holding the lease, with a message saved
+	require.Nil(t, primary.SaveMessage(1, []byte("hello")))
+
+	// Then the standby cannot save or delete messages
+	assert.True(t, errors.Is(standby.SaveMessage(2, []byte("world")), ErrSessionLeaseHeld))
+	assert.True(t, errors.Is(standby.SaveMessages([]SeqMsg{{SeqNum: 2, Msg: []byte("world")}}), ErrSessionLeaseHeld))
+	assert.True(t, errors.Is(standby.DeleteMessagesUpTo(1), ErrSessionLeaseHeld))
+
+	// And the primary's messages should be untouched
+	msgs, err := primary.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("hello")}, msgs)
+}
+
+func TestSQLStore_LeaseMissingSession(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreLeaseMissingSession-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+	dsn := path.Join(rootPath, "lease.db")
+
+	// Given a store holding the lease whose session row has been deleted
+	store, err := NewSQLStoreFactory(map[string]string{
+		SQLStoreDriver:         "sqlite3",
+		SQLStoreDataSourceName: dsn,
+		SQLStoreAutoMigrate:    "Y",
+		SQLStoreLeaseTTL:       "1m",
+	}).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	db, err := sql.Open("sqlite3", dsn)
+	require.Nil(t, err)
+	defer db.Close()
+	_, err = db.Exec(`DELETE FROM sessions`)
+	require.Nil(t, err)
+
+	// When the lease is renewed
+	require.Nil(t, store.(SessionLeaser).RenewLease())
+
+	// Then the session row should be inserted again, with the store's seqnums and lease
+	var outgoing int
+	var owner string
+	require.Nil(t, db.QueryRow(`SELECT outgoing_seqnum, lease_owner FROM sessions`).Scan(&outgoing, &owner))
+	assert.Equal(t, 2, outgoing)
+	assert.Equal(t, defaultSQLLeaseOwner(), owner)
+}
+
+func TestSQLStore_LeaseDisabled(t *testing.T) {
+	store := &sqlStore{}
+	assert.NotNil(t, store.AcquireLease())
+	assert.NotNil(t, store.RenewLease())
+}
@@ -0,0 +1,29 @@
+package msgstore
+
+import "time"
+
+// WithSQLStoreMetrics reports the latency and outcome of every operation of the factory's stores to metrics, see
+// NewPrometheusStoreMetrics for a Prometheus implementation.  The operations are "reset", "refresh",
+// "set_next_sender_seqnum", "set_next_target_seqnum", "set_creation_time", "save_message", "save_messages",
+// "get_message", "get_messages", "iterate_messages", "get_messages_by_time", "get_stored_messages", "message_count",
+// "first_seqnum", "last_seqnum", "delete_messages", "set_session_value", "get_session_value", "prune", "acquire_lease",
+// "takeover_lease", "renew_lease", "release_lease", "ping", "healthy", "health_check" and "list_sessions", which
+// factories report with an empty sessionID; the Incr seqnum methods report as their Set counterparts.
+func WithSQLStoreMetrics(metrics StoreMetrics) SQLStoreOption {
+	return func(f *sqlStoreFactory) { f.metrics = metrics }
+}
+
+// observe reports an operation started at start to the store's metrics, if any, and then wraps its error in a
+// StoreError.  It is deferred by each operation with a pointer to its named error result, so that the outcome is known
+// when it is called.
+func (store *sqlStore) observe(operation string, start time.Time, err *error) {
+	store.observeSeqNum(operation, 0, start, err)
+}
+
+// observeSeqNum is like observe, for the operations on the message of seqNum
+func (store *sqlStore) observeSeqNum(operation string, seqNum int, start time.Time, err *error) {
+	if store.metrics != nil {
+		store.metrics.ObserveOperation(store.sessionID, operation, time.Since(start), *err)
+	}
+	wrapStoreError("sql", store.sessionID, operation, seqNum, err)
+}
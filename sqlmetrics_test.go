@@ -0,0 +1,64 @@
+package msgstore
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordedOperation struct {
+	sessionID string
+	operation string
+	err       error
+}
+
+type recordingStoreMetrics struct {
+	mu         sync.Mutex
+	operations []recordedOperation
+}
+
+func (m *recordingStoreMetrics) ObserveOperation(sessionID, operation string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.operations = append(m.operations, recordedOperation{sessionID, operation, err})
+}
+
+func TestSQLStore_Metrics(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreMetrics-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	metrics := &recordingStoreMetrics{}
+	store, err := NewSQLStoreFactory(map[string]string{
+		SQLStoreDriver:         "sqlite3",
+		SQLStoreDataSourceName: path.Join(rootPath, "metrics.db"),
+		SQLStoreAutoMigrate:    "Y",
+	}, WithSQLStoreMetrics(metrics)).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// When the session persists a message and its seqnum
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	_, err = store.GetMessages(1, 1)
+	require.Nil(t, err)
+
+	// And saves a duplicate
+	assert.NotNil(t, store.SaveMessage(1, []byte("one")))
+
+	// Then each operation should be observed once, with its outcome
+	assert.Equal(t, []recordedOperation{
+		{"FIX.4.4-SENDER-TARGET", "save_message", nil},
+		{"FIX.4.4-SENDER-TARGET", "set_next_sender_seqnum", nil},
+		{"FIX.4.4-SENDER-TARGET", "get_messages", nil},
+	}, metrics.operations[:3])
+	require.Len(t, metrics.operations, 4)
+	assert.Equal(t, "save_message", metrics.operations[3].operation)
+	assert.NotNil(t, metrics.operations[3].err)
+}
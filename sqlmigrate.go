@@ -0,0 +1,180 @@
+package msgstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// sqlMigration upgrades the store schema to version by executing the statements generated for the store's dialect
+type sqlMigration struct {
+	version    int
+	statements func(store *sqlStore) []string
+}
+
+// sqlMigrations lists every schema version in ascending order.  New versions must only ever be appended.
+var sqlMigrations = []sqlMigration{
+	{version: 1, statements: createSQLTables},
+	{version: 2, statements: addSQLLeaseColumns},
+	{version: 3, statements: addSQLResetGenerationColumn},
+	{version: 4, statements: createSQLSessionValuesTable},
+}
+
+func createSQLTables(store *sqlStore) []string {
+	d := store.dialect
+	return []string{
+		d.createTable(store.sessionsTable, fmt.Sprintf(`session_id VARCHAR(128) NOT NULL, creation_time %s NOT NULL, incoming_seqnum INT NOT NULL, outgoing_seqnum INT NOT NULL, PRIMARY KEY (session_id)`, d.timestampType)),
+		messagesTableDDL(store, false),
+	}
+}
+
+// createMessagesTable returns the DDL creating the store's messages table, with the columns and key its settings require
+func createMessagesTable(store *sqlStore) string {
+	return messagesTableDDL(store, store.archiveOnReset)
+}
+
+// messagesTableDDL returns the DDL creating the store's messages table, leaving out the reset_generation column unless
+// withGeneration, as the tables created before version 3 of the schema did
+func messagesTableDDL(store *sqlStore, withGeneration bool) string {
+	d := store.dialect
+	messageType := d.textType
+	if store.binaryMessages {
+		messageType = d.binaryType
+	}
+	extraColumns := ""
+	if store.partitionBy == sqlPartitionBySessionDate {
+		extraColumns += "session_date DATE NOT NULL, "
+	}
+	if withGeneration {
+		extraColumns += "reset_generation INT NOT NULL, "
+	}
+	if store.messageDetails {
+		extraColumns += fmt.Sprintf("direction VARCHAR(3) NOT NULL, stored_at %s NOT NULL, ", d.timestampType)
+	}
+	keyColumns := store.messageKeyColumns()
+	if !withGeneration {
+		keyColumns = withoutColumn(keyColumns, "reset_generation")
+	}
+	return d.createTable(store.messagesTable, fmt.Sprintf(`session_id VARCHAR(128) NOT NULL, msgseqnum INT NOT NULL, message %s NOT NULL, %sPRIMARY KEY (%s)`,
+		messageType, extraColumns, strings.Join(keyColumns, ", "))) + store.partitionClause()
+}
+
+// withoutColumn returns columns without column
+func withoutColumn(columns []string, column string) []string {
+	kept := make([]string, 0, len(columns))
+	for _, c := range columns {
+		if c != column {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// addSQLLeaseColumns adds the sessions columns recording which store holds the session lease, see SQLStoreLeaseTTL
+func addSQLLeaseColumns(store *sqlStore) []string {
+	d := store.dialect
+	return []string{
+		d.addColumn(store.sessionsTable, `lease_owner VARCHAR(128) NULL`),
+		d.addColumn(store.sessionsTable, fmt.Sprintf(`lease_expires %s NULL`, d.timestampType)),
+	}
+}
+
+// addSQLResetGenerationColumn adds the sessions column counting the Resets archived by SQLStoreResetMode and, for stores
+// archiving them, the messages column recording the generation of each message, with which it widens the primary key
+func addSQLResetGenerationColumn(store *sqlStore) []string {
+	stmts := []string{store.dialect.addColumn(store.sessionsTable, `reset_generation INT NOT NULL DEFAULT 0`)}
+	if store.archiveOnReset {
+		stmts = append(stmts, addSQLMessagesResetGeneration(store)...)
+	}
+	return stmts
+}
+
+// addSQLMessagesResetGeneration adds the reset_generation column to the messages table and its primary key, the
+// existing messages falling in generation 0, which the sessions column starts at
+func addSQLMessagesResetGeneration(store *sqlStore) []string {
+	d := store.dialect
+	keyColumns := strings.Join(store.messageKeyColumns(), ", ")
+	addColumn := d.addColumn(store.messagesTable, `reset_generation INT NOT NULL DEFAULT 0`)
+	switch d.name {
+	case "sqlite3":
+		// sqlite cannot alter a primary key, so the table is rebuilt
+		upgradeTable := store.messagesTableName() + "_upgrade"
+		columns := strings.Join(withoutColumn(store.messageColumns(), "reset_generation"), ", ")
+		return []string{
+			fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, store.messagesTable, d.quoteIdent(store.sqlTableNamePrefix+upgradeTable)),
+			createMessagesTable(store),
+			fmt.Sprintf(`INSERT INTO %s (%s, reset_generation) SELECT %s, 0 FROM %s`, store.messagesTable, columns, columns, store.tableName(upgradeTable)),
+			fmt.Sprintf(`DROP TABLE %s`, store.tableName(upgradeTable)),
+		}
+
+	case "mysql":
+		return []string{addColumn, fmt.Sprintf(`ALTER TABLE %s DROP PRIMARY KEY, ADD PRIMARY KEY (%s)`, store.messagesTable, keyColumns)}
+
+	case "postgres":
+		// the key constraint is named after the table by CREATE TABLE
+		constraint := d.quoteIdent(store.sqlTableNamePrefix + store.messagesTableName() + "_pkey")
+		return []string{addColumn, fmt.Sprintf(`ALTER TABLE %s DROP CONSTRAINT %s, ADD PRIMARY KEY (%s)`, store.messagesTable, constraint, keyColumns)}
+
+	case "mssql":
+		// the key constraint is given a generated name by CREATE TABLE, so it is looked up
+		table := strings.Replace(store.messagesTable, "'", "''", -1)
+		return []string{addColumn, fmt.Sprintf(`DECLARE @pk NVARCHAR(128) = (SELECT name FROM sys.key_constraints WHERE type = 'PK' AND parent_object_id = OBJECT_ID(N'%s')); `+
+			`EXEC(N'ALTER TABLE %s DROP CONSTRAINT ' + QUOTENAME(@pk)); ALTER TABLE %s ADD PRIMARY KEY (%s)`, table, table, store.messagesTable, keyColumns)}
+	}
+	return []string{addColumn}
+}
+
+// createSQLSessionValuesTable creates the table of the values stored by SetSessionValue
+func createSQLSessionValuesTable(store *sqlStore) []string {
+	d := store.dialect
+	return []string{
+		d.createTable(store.sessionValuesTable, fmt.Sprintf(`session_id VARCHAR(128) NOT NULL, name VARCHAR(128) NOT NULL, value %s NOT NULL, PRIMARY KEY (session_id, name)`, d.textType)),
+	}
+}
+
+// migrate creates the store tables if they are missing and applies any schema upgrades not yet recorded in the schema_version table
+func (store *sqlStore) migrate(ctx context.Context) error {
+	if store.dialect.createTable == nil {
+		return fmt.Errorf("automatic schema migration is not supported for sql dialect: %s", store.dialect.name)
+	}
+
+	if _, err := store.db.ExecContext(ctx, store.dialect.createTable(store.schemaVersionTable, `version INT NOT NULL`)); err != nil {
+		return fmt.Errorf("unable to create table: %s: %w", store.schemaVersionTable, err)
+	}
+
+	var current sql.NullInt64
+	if err := store.db.QueryRowContext(ctx, store.sqlf(`SELECT MAX(version) FROM %s`, store.schemaVersionTable)).Scan(&current); err != nil {
+		return fmt.Errorf("unable to read schema version: %w", err)
+	}
+
+	for _, m := range sqlMigrations {
+		if int64(m.version) <= current.Int64 {
+			continue
+		}
+		if err := store.applyMigration(ctx, m); err != nil {
+			return fmt.Errorf("unable to migrate schema to version %d: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+func (store *sqlStore) applyMigration(ctx context.Context, m sqlMigration) error {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range m.statements(store) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, store.sqlf(`INSERT INTO %s (version) VALUES(?)`, store.schemaVersionTable), m.version); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,120 @@
+package msgstore
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// SQLStoreAutoMigrateTestSuite runs all tests in the MessageStoreTestSuite against a SqlStore whose tables were created by SQLStoreAutoMigrate
+type SQLStoreAutoMigrateTestSuite struct {
+	MessageStoreTestSuite
+	sqlStoreRootPath string
+	settings         map[string]string
+}
+
+func (suite *SQLStoreAutoMigrateTestSuite) SetupTest() {
+	suite.sqlStoreRootPath = path.Join(os.TempDir(), fmt.Sprintf("SqlStoreAutoMigrateTestSuite-%d", os.Getpid()))
+	err := os.MkdirAll(suite.sqlStoreRootPath, os.ModePerm)
+	require.Nil(suite.T(), err)
+	sqlDsn := path.Join(suite.sqlStoreRootPath, fmt.Sprintf("%d.db", time.Now().UnixNano()))
+
+	// create settings
+	suite.settings = map[string]string{SQLStoreDriver: "sqlite3", SQLStoreDataSourceName: sqlDsn, SQLStoreAutoMigrate: "Y", SQLStoreTableNamePrefix: "fix_"}
+
+	// create store
+	suite.msgStore, err = NewSQLStoreFactory(suite.settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(suite.T(), err)
+}
+
+func (suite *SQLStoreAutoMigrateTestSuite) TearDownTest() {
+	suite.msgStore.Close()
+	os.RemoveAll(suite.sqlStoreRootPath)
+}
+
+func (suite *SQLStoreAutoMigrateTestSuite) TestAutoMigrate_Idempotent() {
+	t := suite.T()
+
+	// Given a message saved with the migrated schema
+	require.Nil(t, suite.msgStore.SaveMessage(1, []byte("hello")))
+
+	// When another store is created against the same database
+	other, err := NewSQLStoreFactory(suite.settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer other.Close()
+
+	// Then the existing data should be untouched
+	msgs, err := other.GetMessages(1, 1)
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "hello", string(msgs[0]))
+
+	// And each schema version should only have been recorded once
+	db, err := sql.Open("sqlite3", suite.settings[SQLStoreDataSourceName])
+	require.Nil(t, err)
+	defer db.Close()
+	var count, version int
+	require.Nil(t, db.QueryRow(`SELECT COUNT(*), MAX(version) FROM fix_schema_version`).Scan(&count, &version))
+	assert.Equal(t, len(sqlMigrations), count)
+	assert.Equal(t, sqlMigrations[len(sqlMigrations)-1].version, version)
+}
+
+func TestSQLStoreAutoMigrateTestSuite(t *testing.T) {
+	suite.Run(t, new(SQLStoreAutoMigrateTestSuite))
+}
+
+func TestSQLStore_MigrateArchiveFromVersion2(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreMigrateArchive-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+	dsn := path.Join(rootPath, "upgrade.db")
+
+	// Given a database at version 2 of the schema, before reset generations, holding a message
+	db, err := sql.Open("sqlite3", dsn)
+	require.Nil(t, err)
+	for _, stmt := range []string{
+		`CREATE TABLE fix_schema_version (version INT NOT NULL)`,
+		`INSERT INTO fix_schema_version (version) VALUES(1), (2)`,
+		`CREATE TABLE fix_sessions (session_id VARCHAR(128) NOT NULL, creation_time DATETIME NOT NULL, incoming_seqnum INT NOT NULL, outgoing_seqnum INT NOT NULL, ` +
+			`lease_owner VARCHAR(128) NULL, lease_expires DATETIME NULL, PRIMARY KEY (session_id))`,
+		`INSERT INTO fix_sessions (session_id, creation_time, incoming_seqnum, outgoing_seqnum) VALUES('FIX.4.4-SENDER-TARGET', '2024-03-01 12:00:00', 1, 2)`,
+		`CREATE TABLE fix_messages (session_id VARCHAR(128) NOT NULL, msgseqnum INT NOT NULL, message TEXT NOT NULL, PRIMARY KEY (session_id, msgseqnum))`,
+		`INSERT INTO fix_messages (session_id, msgseqnum, message) VALUES('FIX.4.4-SENDER-TARGET', 1, 'hello')`,
+	} {
+		_, err = db.Exec(stmt)
+		require.Nil(t, err, stmt)
+	}
+	require.Nil(t, db.Close())
+
+	// When a store archiving resets migrates it
+	store, err := NewSQLStoreFactory(map[string]string{
+		SQLStoreDriver:          "sqlite3",
+		SQLStoreDataSourceName:  dsn,
+		SQLStoreAutoMigrate:     "Y",
+		SQLStoreTableNamePrefix: "fix_",
+		SQLStoreResetMode:       "archive",
+	}).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Then the existing message should be kept in the current generation
+	msgs, err := store.GetMessages(1, 1)
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "hello", string(msgs[0]))
+
+	// And its seqnum should be reusable after a reset, the primary key having been widened
+	require.Nil(t, store.Reset())
+	require.Nil(t, store.SaveMessage(1, []byte("again")))
+	msgs, err = store.GetMessages(1, 1)
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "again", string(msgs[0]))
+}
@@ -0,0 +1,116 @@
+package msgstore
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+const (
+	// sqlPartitionBySessionID list-partitions the messages table with one partition per session
+	sqlPartitionBySessionID = "session_id"
+	// sqlPartitionBySessionDate range-partitions the messages table by the UTC date of the session's creation time,
+	// which the store records in a session_date column
+	sqlPartitionBySessionDate = "session_date"
+)
+
+// sessionDateLayout is the format of the session_date column values and the suffix of the partitions holding them
+const sessionDateLayout = "2006-01-02"
+
+// sanitizeSessionID turns a sessionID into a string usable within a table name.
+// Long IDs are truncated and suffixed with a hash so that they stay unique within identifier length limits.
+func sanitizeSessionID(sessionID string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return '_'
+	}, sessionID)
+
+	if len(sanitized) <= 40 {
+		return sanitized
+	}
+	h := fnv.New32a()
+	h.Write([]byte(sessionID))
+	return fmt.Sprintf("%s_%08x", sanitized[:31], h.Sum32())
+}
+
+func sqlQuoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// sessionDate returns the session_date partition key for the store's current creation time
+func (store *sqlStore) sessionDate() string {
+	return store.cache.CreationTime().UTC().Format(sessionDateLayout)
+}
+
+// partitionClause returns the PARTITION BY clause completing the messages table DDL, if the store is partitioned
+func (store *sqlStore) partitionClause() string {
+	switch store.partitionBy {
+	case sqlPartitionBySessionID:
+		return " PARTITION BY LIST (session_id)"
+	case sqlPartitionBySessionDate:
+		return " PARTITION BY RANGE (session_date)"
+	}
+	return ""
+}
+
+// partitionDDL returns the statement creating the partition that the store's current messages are written to
+func (store *sqlStore) partitionDDL() string {
+	switch store.partitionBy {
+	case sqlPartitionBySessionID:
+		partition := store.tableName("messages_" + sanitizeSessionID(store.sessionID))
+		return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES IN (%s)`, partition, store.messagesTable, sqlQuoteLiteral(store.sessionID))
+
+	case sqlPartitionBySessionDate:
+		from := store.cache.CreationTime().UTC()
+		to := from.AddDate(0, 0, 1)
+		partition := store.tableName("messages_" + from.Format("20060102"))
+		return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM (%s) TO (%s)`,
+			partition, store.messagesTable, sqlQuoteLiteral(from.Format(sessionDateLayout)), sqlQuoteLiteral(to.Format(sessionDateLayout)))
+	}
+	return ""
+}
+
+// ensurePartition creates the partition for the store's current messages if it doesn't exist yet.
+// It is called at startup, and again after each Reset since a new creation time may fall on a new session_date.
+func (store *sqlStore) ensurePartition(ctx context.Context) error {
+	if store.partitionBy == "" {
+		return nil
+	}
+	if _, err := store.exec(ctx, store.partitionDDL()); err != nil {
+		return fmt.Errorf("unable to create messages partition: %w", err)
+	}
+	return nil
+}
+
+// ensureSessionTable creates the session's own messages table under SQLStoreTablePerSession if it doesn't exist yet
+func (store *sqlStore) ensureSessionTable(ctx context.Context) error {
+	if !store.tablePerSession {
+		return nil
+	}
+	if store.dialect.createTable == nil {
+		return fmt.Errorf("table per session is not supported for sql dialect: %s", store.dialect.name)
+	}
+	if _, err := store.exec(ctx, createMessagesTable(store)); err != nil {
+		return fmt.Errorf("unable to create table: %s: %w", store.messagesTable, err)
+	}
+	return nil
+}
+
+func validateSQLPartitioning(partitionBy string, dialect sqlDialect) error {
+	switch partitionBy {
+	case "":
+		return nil
+	case sqlPartitionBySessionID, sqlPartitionBySessionDate:
+		if dialect.name != "postgres" {
+			return fmt.Errorf("partitioning is only supported for the postgres dialect, not %s", dialect.name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown partitioning: %s", partitionBy)
+}
@@ -0,0 +1,68 @@
+package msgstore
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeSessionID(t *testing.T) {
+	assert.Equal(t, "fix_4_4_sender_target", sanitizeSessionID("FIX.4.4-SENDER-TARGET"))
+
+	long := sanitizeSessionID("FIX.4.4-" + strings.Repeat("SENDER", 10) + "-TARGET")
+	assert.Len(t, long, 40)
+	assert.NotEqual(t, long, sanitizeSessionID("FIX.4.4-"+strings.Repeat("SENDER", 10)+"-OTHER"))
+}
+
+func TestValidateSQLPartitioning(t *testing.T) {
+	assert.Nil(t, validateSQLPartitioning("", sqlDialects["mysql"]))
+	assert.Nil(t, validateSQLPartitioning(sqlPartitionBySessionID, sqlDialects["postgres"]))
+	assert.Nil(t, validateSQLPartitioning(sqlPartitionBySessionDate, sqlDialects["postgres"]))
+	assert.NotNil(t, validateSQLPartitioning(sqlPartitionBySessionID, sqlDialects["mysql"]))
+	assert.NotNil(t, validateSQLPartitioning("bogus", sqlDialects["postgres"]))
+}
+
+func newPartitionedTestStore(partitionBy string) *sqlStore {
+	d := sqlDialects["postgres"]
+	store := &sqlStore{
+		sessionID:          "FIX.4.4-SEND'ER-TARGET",
+		cache:              &memoryStore{creationTime: time.Date(2018, 3, 31, 23, 30, 0, 0, time.UTC)},
+		sqlTableNamePrefix: "fix_",
+		dialect:            d,
+		partitionBy:        partitionBy,
+		sessionsTable:      d.quoteIdent("fix_sessions"),
+		messagesTable:      d.quoteIdent("fix_messages"),
+	}
+	return store
+}
+
+func TestSQLStore_PartitionDDL(t *testing.T) {
+	store := newPartitionedTestStore(sqlPartitionBySessionID)
+	assert.Equal(t, `CREATE TABLE IF NOT EXISTS "fix_messages_fix_4_4_send_er_target" PARTITION OF "fix_messages" FOR VALUES IN ('FIX.4.4-SEND''ER-TARGET')`, store.partitionDDL())
+	assert.True(t, strings.HasSuffix(createSQLTables(store)[1], `PRIMARY KEY (session_id, msgseqnum)) PARTITION BY LIST (session_id)`))
+
+	store = newPartitionedTestStore(sqlPartitionBySessionDate)
+	assert.Equal(t, `CREATE TABLE IF NOT EXISTS "fix_messages_20180331" PARTITION OF "fix_messages" FOR VALUES FROM ('2018-03-31') TO ('2018-04-01')`, store.partitionDDL())
+	assert.True(t, strings.HasSuffix(createSQLTables(store)[1], `session_date DATE NOT NULL, PRIMARY KEY (session_id, msgseqnum, session_date)) PARTITION BY RANGE (session_date)`))
+	row, err := store.messageRow(7, []byte("msg"))
+	require.Nil(t, err)
+	assert.Equal(t, []interface{}{7, "msg", store.sessionID, "2018-03-31"}, row)
+
+	store = newPartitionedTestStore("")
+	assert.Equal(t, "", store.partitionDDL())
+	row, err = store.messageRow(7, []byte("msg"))
+	require.Nil(t, err)
+	assert.Equal(t, []interface{}{7, "msg", store.sessionID}, row)
+}
+
+func TestSQLStore_PartitionDDLSchemaName(t *testing.T) {
+	store := newPartitionedTestStore(sqlPartitionBySessionID)
+	store.sqlSchemaName = "fix"
+	store.messagesTable = store.tableName("messages")
+
+	// Then the partition should be created in the parent table's schema
+	assert.Equal(t, `CREATE TABLE IF NOT EXISTS "fix"."fix_messages_fix_4_4_send_er_target" PARTITION OF "fix"."fix_messages" FOR VALUES IN ('FIX.4.4-SEND''ER-TARGET')`, store.partitionDDL())
+}
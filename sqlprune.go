@@ -0,0 +1,179 @@
+package msgstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// sqlPruneConfig holds the parsed SQLStorePrune settings
+type sqlPruneConfig struct {
+	interval     time.Duration
+	maxAge       time.Duration
+	keepMessages int
+	batchSize    int
+}
+
+func (f *sqlStoreFactory) parsePruneSettings(messageDetails bool) (config sqlPruneConfig, err error) {
+	if durationStr, ok := f.settings[SQLStorePruneInterval]; ok {
+		if config.interval, err = time.ParseDuration(durationStr); err != nil {
+			return config, fmt.Errorf("invalid setting: %s: %w", SQLStorePruneInterval, err)
+		}
+	}
+
+	if durationStr, ok := f.settings[SQLStorePruneMaxAge]; ok {
+		if config.maxAge, err = time.ParseDuration(durationStr); err != nil {
+			return config, fmt.Errorf("invalid setting: %s: %w", SQLStorePruneMaxAge, err)
+		}
+		if !messageDetails {
+			return config, fmt.Errorf("invalid setting: %s: requires %s", SQLStorePruneMaxAge, SQLStoreRecordMessageDetails)
+		}
+	}
+
+	if keepStr, ok := f.settings[SQLStorePruneKeepMessages]; ok {
+		if config.keepMessages, err = strconv.Atoi(keepStr); err != nil {
+			return config, fmt.Errorf("invalid setting: %s: %w", SQLStorePruneKeepMessages, err)
+		}
+	}
+
+	config.batchSize = 1000
+	if batchStr, ok := f.settings[SQLStorePruneBatchSize]; ok {
+		if config.batchSize, err = strconv.Atoi(batchStr); err != nil || config.batchSize < 1 {
+			return config, fmt.Errorf("invalid setting: %s: must be a positive number", SQLStorePruneBatchSize)
+		}
+	}
+
+	if config.interval > 0 && config.maxAge <= 0 && config.keepMessages <= 0 {
+		return config, fmt.Errorf("invalid setting: %s: requires %s or %s", SQLStorePruneInterval, SQLStorePruneMaxAge, SQLStorePruneKeepMessages)
+	}
+	return config, nil
+}
+
+// startPruning runs Prune every SQLStorePruneInterval until the store is closed.
+// Errors are left for the next run to retry; callers wanting them can call Prune themselves.
+func (store *sqlStore) startPruning() {
+	if store.prune.interval <= 0 {
+		return
+	}
+	store.stopPruning = make(chan struct{})
+	store.pruningDone = make(chan struct{})
+
+	go func() {
+		defer close(store.pruningDone)
+		ticker := time.NewTicker(store.prune.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-store.stopPruning:
+				return
+			case <-ticker.C:
+				if _, err := store.Prune(); err != nil && store.logger != nil {
+					store.logger.Printf("msgstore: pruning session %s failed: %s", store.sessionID, err.Error())
+				}
+			}
+		}
+	}()
+}
+
+func (store *sqlStore) stopPruningAndWait() {
+	if store.stopPruning == nil {
+		return
+	}
+	close(store.stopPruning)
+	<-store.pruningDone
+	store.stopPruning = nil
+}
+
+// Prune deletes the session's messages that are older than SQLStorePruneMaxAge or further than SQLStorePruneKeepMessages
+// below the next sender seqnum, returning how many were deleted.  It is safe to call while the session is running.
+func (store *sqlStore) Prune() (int64, error) {
+	return store.PruneContext(context.Background())
+}
+
+// PruneContext is like Prune, but the database operations are bounded by ctx
+func (store *sqlStore) PruneContext(ctx context.Context) (deleted int64, err error) {
+	defer store.observe("prune", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	if store.prune.keepMessages > 0 {
+		// read the seqnum from the database rather than the cache, which belongs to the session's goroutine
+		var outgoingSeqNum int
+		err = store.withRetry(ctx, func() error {
+			row := store.db.QueryRowContext(ctx, store.sqlf(`SELECT outgoing_seqnum FROM %s WHERE session_id=?`, store.sessionsTable), store.sessionID)
+			return row.Scan(&outgoingSeqNum)
+		})
+		if err != nil {
+			return deleted, err
+		}
+
+		n, err := store.pruneBatches(ctx, ` AND msgseqnum<?`, outgoingSeqNum-store.prune.keepMessages)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	if store.prune.maxAge > 0 {
+		n, err := store.pruneBatches(ctx, ` AND stored_at<?`, store.cache.now().UTC().Add(-store.prune.maxAge))
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// DeleteMessagesUpTo deletes the session's messages up to and including seqNum, see MessageStore
+func (store *sqlStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.DeleteMessagesUpToContext(context.Background(), seqNum)
+}
+
+// DeleteMessagesUpToContext is like DeleteMessagesUpTo, but the database operations are bounded by ctx
+func (store *sqlStore) DeleteMessagesUpToContext(ctx context.Context, seqNum int) (err error) {
+	defer store.observeSeqNum("delete_messages", seqNum, time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	// in lease mode, make sure of the lease before deleting anything, as Reset does
+	if store.leaseTTL > 0 {
+		if err := store.renewLease(ctx); err != nil {
+			return err
+		}
+	}
+
+	// only the messages GetMessages reads, not the incoming ones or those of archived generations sharing the seqnums
+	condition, args := store.currentMessages()
+	_, err = store.pruneBatches(ctx, ` AND msgseqnum<=?`+condition, append([]interface{}{seqNum}, args...)...)
+	return err
+}
+
+// pruneBatches deletes the session's messages matching condition, with its args, a span of SQLStorePruneBatchSize seqnums at a time so
+// that no single statement holds its locks for long
+func (store *sqlStore) pruneBatches(ctx context.Context, condition string, args ...interface{}) (deleted int64, err error) {
+	selectMin := store.sqlf(`SELECT MIN(msgseqnum) FROM %s WHERE session_id=?`+condition, store.messagesTable)
+	deleteSpan := store.sqlf(`DELETE FROM %s WHERE session_id=? AND msgseqnum>=? AND msgseqnum<?`+condition, store.messagesTable)
+
+	for {
+		var min sql.NullInt64
+		err = store.withRetry(ctx, func() error {
+			return store.db.QueryRowContext(ctx, selectMin, append([]interface{}{store.sessionID}, args...)...).Scan(&min)
+		})
+		if err != nil || !min.Valid {
+			return deleted, err
+		}
+
+		result, err := store.exec(ctx, deleteSpan, append([]interface{}{store.sessionID, min.Int64, min.Int64 + int64(store.prune.batchSize)}, args...)...)
+		if err != nil {
+			return deleted, err
+		}
+		if n, err := result.RowsAffected(); err == nil {
+			deleted += n
+		}
+	}
+}
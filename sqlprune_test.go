@@ -0,0 +1,101 @@
+package msgstore
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLStoreFactory_ParsePruneSettings(t *testing.T) {
+	var testCases = []struct {
+		settings       map[string]string
+		messageDetails bool
+		valid          bool
+	}{
+		{settings: map[string]string{}, valid: true},
+		{settings: map[string]string{SQLStorePruneInterval: "1h", SQLStorePruneKeepMessages: "100"}, valid: true},
+		{settings: map[string]string{SQLStorePruneInterval: "1h", SQLStorePruneMaxAge: "24h"}, messageDetails: true, valid: true},
+		{settings: map[string]string{SQLStorePruneInterval: "1h", SQLStorePruneMaxAge: "24h"}},
+		{settings: map[string]string{SQLStorePruneInterval: "1h"}},
+		{settings: map[string]string{SQLStorePruneInterval: "soon", SQLStorePruneKeepMessages: "100"}},
+		{settings: map[string]string{SQLStorePruneKeepMessages: "100", SQLStorePruneBatchSize: "0"}},
+	}
+
+	for _, tc := range testCases {
+		f := &sqlStoreFactory{settings: tc.settings}
+		_, err := f.parsePruneSettings(tc.messageDetails)
+		assert.Equal(t, tc.valid, err == nil, "%v", tc.settings)
+	}
+}
+
+func TestSQLStore_Prune(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStorePrune-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	settings := map[string]string{
+		SQLStoreDriver:            "sqlite3",
+		SQLStoreDataSourceName:    path.Join(rootPath, "prune.db"),
+		SQLStoreAutoMigrate:       "Y",
+		SQLStorePruneKeepMessages: "3",
+		SQLStorePruneBatchSize:    "2",
+	}
+	store, err := NewSQLStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Given ten messages sent
+	for seqNum := 1; seqNum <= 10; seqNum++ {
+		require.Nil(t, store.SaveMessage(seqNum, []byte(fmt.Sprintf("msg %d", seqNum))))
+		require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	}
+
+	// When the store is pruned
+	deleted, err := store.(MessagePruner).Prune()
+	require.Nil(t, err)
+
+	// Then only the last three messages should remain
+	assert.Equal(t, int64(7), deleted)
+	msgs, err := store.GetMessages(1, 10)
+	require.Nil(t, err)
+	require.Len(t, msgs, 3)
+	assert.Equal(t, "msg 8", string(msgs[0]))
+}
+
+func TestSQLStore_DeleteMessagesUpToKeepsIncoming(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreDeleteIncoming-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	settings := map[string]string{
+		SQLStoreDriver:               "sqlite3",
+		SQLStoreDataSourceName:       path.Join(rootPath, "delete.db"),
+		SQLStoreAutoMigrate:          "Y",
+		SQLStoreRecordMessageDetails: "Y",
+	}
+	store, err := NewSQLStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+	timed := store.(TimedMessageStore)
+
+	// Given sent and received messages with the same seqnums
+	for seqNum := 1; seqNum <= 3; seqNum++ {
+		require.Nil(t, store.SaveMessage(seqNum, []byte(fmt.Sprintf("sent %d", seqNum))))
+		require.Nil(t, timed.SaveMessageWithDirection(seqNum, []byte(fmt.Sprintf("received %d", seqNum)), MessageIncoming))
+	}
+
+	// When the messages up to 2 are deleted
+	require.Nil(t, store.DeleteMessagesUpTo(2))
+
+	// Then only the sent messages should be deleted
+	msgs, err := store.GetMessages(1, 3)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("sent 3")}, msgs)
+	received, err := store.(MessageMetaStore).GetStoredMessages(MessageFilter{Direction: MessageIncoming, BeginSeqNum: 1, EndSeqNum: 3})
+	require.Nil(t, err)
+	assert.Len(t, received, 3)
+}
@@ -0,0 +1,184 @@
+package msgstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transientSQLErrorFragments are matched case-insensitively against error text from drivers that don't expose typed errors
+var transientSQLErrorFragments = []string{
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"bad connection",
+	"invalid connection",
+	"server has gone away",
+	"lost connection",
+	"deadlock",
+	"database is locked",
+}
+
+// isTransientSQLError reports whether err, or an error it wraps, is likely to succeed if the operation is retried, e.g. a
+// dropped connection or a deadlock
+func isTransientSQLError(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, permanent := range []error{sql.ErrNoRows, sql.ErrTxDone, context.Canceled, context.DeadlineExceeded} {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+	for _, transient := range []error{driver.ErrBadConn, io.EOF, io.ErrUnexpectedEOF} {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, fragment := range transientSQLErrorFragments {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// sqlErrorCode returns the vendor error code of a driver error, found through the methods or fields the well-known drivers
+// expose it with, e.g. SQLState() for postgres, SQLErrorNumber() for mssql or the Number field of mysql errors
+func sqlErrorCode(err error) string {
+	switch e := err.(type) {
+	case interface{ SQLState() string }:
+		return e.SQLState()
+	case interface{ SQLErrorNumber() int32 }:
+		return strconv.Itoa(int(e.SQLErrorNumber()))
+	case interface{ Code() int }:
+		return strconv.Itoa(e.Code())
+	}
+
+	v := reflect.Indirect(reflect.ValueOf(err))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	for _, name := range []string{"Number", "Code"} {
+		switch f := v.FieldByName(name); f.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return strconv.FormatInt(f.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return strconv.FormatUint(f.Uint(), 10)
+		case reflect.String:
+			return f.String()
+		}
+	}
+	return ""
+}
+
+// isSQLConflictError reports whether err is a deadlock or serialization failure according to the dialect's error codes
+func isSQLConflictError(err error, dialect sqlDialect) bool {
+	if err == nil {
+		return false
+	}
+	code := sqlErrorCode(err)
+	if code == "" {
+		return false
+	}
+	for _, c := range dialect.conflictCodes {
+		if code == c {
+			return true
+		}
+	}
+	return false
+}
+
+// withRetry runs op until it succeeds, fails with an error that isn't transient, or runs out of attempts:
+// SQLStoreConflictRetryMaxAttempts for deadlocks and serialization failures, SQLStoreRetryMaxAttempts for other transient errors.
+// The wait between attempts starts at SQLStoreRetryBackoff and doubles each time.
+func (store *sqlStore) withRetry(ctx context.Context, op func() error) error {
+	backoff := store.sqlRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		if isSQLConflictError(err, store.dialect) {
+			if attempt >= store.sqlConflictAttempts {
+				return err
+			}
+		} else if attempt >= store.sqlRetryMaxAttempts || !isTransientSQLError(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// withInsertRetry is withRetry for op inserting msgs in direction.  Under DuplicateMessageError such an insert is not
+// idempotent: an attempt committed just before its connection dropped fails the next one as a duplicate.  An attempt
+// after the first that fails is then taken to have succeeded if every message is found stored with the same body.
+func (store *sqlStore) withInsertRetry(ctx context.Context, direction MessageDirection, msgs []SeqMsg, op func() error) error {
+	attempt := 0
+	return store.withRetry(ctx, func() error {
+		attempt++
+		err := op()
+		if err != nil && attempt > 1 && store.duplicatePolicy == DuplicateMessageError && store.messagesStored(ctx, direction, msgs) {
+			return nil
+		}
+		return err
+	})
+}
+
+// messagesStored reports whether each of msgs is stored in direction with the same body
+func (store *sqlStore) messagesStored(ctx context.Context, direction MessageDirection, msgs []SeqMsg) bool {
+	for _, m := range msgs {
+		var stored []byte
+		found := false
+		if direction == MessageOutgoing {
+			if err := store.iterateMessages(ctx, m.SeqNum, m.SeqNum, func(_ int, msg []byte) error {
+				stored, found = msg, true
+				return nil
+			}); err != nil {
+				return false
+			}
+		} else {
+			got, err := store.GetStoredMessagesContext(ctx, MessageFilter{Direction: direction, BeginSeqNum: m.SeqNum, EndSeqNum: m.SeqNum})
+			if err != nil {
+				return false
+			}
+			if len(got) == 1 {
+				stored, found = got[0].Msg, true
+			}
+		}
+		if !found || !bytes.Equal(stored, m.Msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// exec runs a statement through withRetry
+func (store *sqlStore) exec(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
+	err = store.withRetry(ctx, func() error {
+		result, err = store.db.ExecContext(ctx, query, args...)
+		return err
+	})
+	return result, err
+}
@@ -0,0 +1,184 @@
+package msgstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsTransientSQLError(t *testing.T) {
+	var testCases = []struct {
+		err       error
+		transient bool
+	}{
+		{err: nil, transient: false},
+		{err: sql.ErrNoRows, transient: false},
+		{err: context.DeadlineExceeded, transient: false},
+		{err: errors.New("UNIQUE constraint failed: messages.session_id, messages.msgseqnum"), transient: false},
+		{err: driver.ErrBadConn, transient: true},
+		{err: errors.New("read tcp 10.0.0.1:5432: connection reset by peer"), transient: true},
+		{err: errors.New("Error 1213: Deadlock found when trying to get lock"), transient: true},
+		{err: errors.New("database is locked"), transient: true},
+		{err: fmt.Errorf("unable to save message: %w", driver.ErrBadConn), transient: true},
+		{err: fmt.Errorf("unable to read session: %w", io.ErrUnexpectedEOF), transient: true},
+		{err: fmt.Errorf("dial: %w", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("i/o timeout")}), transient: true},
+		{err: fmt.Errorf("connection reset during query: %w", context.Canceled), transient: false},
+		{err: fmt.Errorf("query: %w", context.DeadlineExceeded), transient: false},
+		{err: fmt.Errorf("unable to read session: %w", sql.ErrNoRows), transient: false},
+		{err: &StoreError{Backend: "sql", Op: "save_message", Err: driver.ErrBadConn}, transient: true},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.transient, isTransientSQLError(tc.err), "%v", tc.err)
+	}
+}
+
+func TestSQLStore_WithRetry(t *testing.T) {
+	store := &sqlStore{sqlRetryMaxAttempts: 3, sqlRetryBackoff: time.Millisecond}
+
+	// transient errors are retried until the attempts run out
+	attempts := 0
+	err := store.withRetry(context.Background(), func() error {
+		attempts++
+		return driver.ErrBadConn
+	})
+	assert.Equal(t, driver.ErrBadConn, err)
+	assert.Equal(t, 3, attempts)
+
+	// success after a transient failure
+	attempts = 0
+	err = store.withRetry(context.Background(), func() error {
+		if attempts++; attempts < 2 {
+			return driver.ErrBadConn
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+
+	// other errors are returned immediately
+	attempts = 0
+	permanent := errors.New("syntax error")
+	err = store.withRetry(context.Background(), func() error {
+		attempts++
+		return permanent
+	})
+	assert.Equal(t, permanent, err)
+	assert.Equal(t, 1, attempts)
+
+	// a cancelled context stops further attempts
+	attempts = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = store.withRetry(ctx, func() error {
+		attempts++
+		return driver.ErrBadConn
+	})
+	assert.Equal(t, driver.ErrBadConn, err)
+	assert.Equal(t, 1, attempts)
+}
+
+type pgTestError struct{ code string }
+
+func (e pgTestError) Error() string    { return "pq: could not serialize access" }
+func (e pgTestError) SQLState() string { return e.code }
+
+type mysqlTestError struct {
+	Number  uint16
+	Message string
+}
+
+func (e *mysqlTestError) Error() string { return e.Message }
+
+func TestIsSQLConflictError(t *testing.T) {
+	var testCases = []struct {
+		err      error
+		dialect  string
+		conflict bool
+	}{
+		{err: pgTestError{"40001"}, dialect: "postgres", conflict: true},
+		{err: pgTestError{"40P01"}, dialect: "postgres", conflict: true},
+		{err: pgTestError{"23505"}, dialect: "postgres", conflict: false},
+		{err: &mysqlTestError{Number: 1213, Message: "Deadlock found"}, dialect: "mysql", conflict: true},
+		{err: &mysqlTestError{Number: 1062, Message: "Duplicate entry"}, dialect: "mysql", conflict: false},
+		{err: &mysqlTestError{Number: 1213}, dialect: "postgres", conflict: false},
+		{err: errors.New("deadlock"), dialect: "mysql", conflict: false},
+		{err: nil, dialect: "mysql", conflict: false},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.conflict, isSQLConflictError(tc.err, sqlDialects[tc.dialect]), "%v", tc.err)
+	}
+}
+
+func TestSQLStore_WithRetry_Conflicts(t *testing.T) {
+	store := &sqlStore{sqlRetryMaxAttempts: 1, sqlConflictAttempts: 3, sqlRetryBackoff: time.Millisecond, dialect: sqlDialects["postgres"]}
+
+	// deadlocks are retried even when other transient errors are not
+	attempts := 0
+	err := store.withRetry(context.Background(), func() error {
+		if attempts++; attempts < 3 {
+			return pgTestError{"40P01"}
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+
+	// until their own attempts run out
+	attempts = 0
+	err = store.withRetry(context.Background(), func() error {
+		attempts++
+		return pgTestError{"40001"}
+	})
+	assert.Equal(t, pgTestError{"40001"}, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestSQLStore_WithInsertRetry(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreWithInsertRetry-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+	msgStore, err := NewSQLStoreFactory(map[string]string{
+		SQLStoreDriver:         "sqlite3",
+		SQLStoreDataSourceName: path.Join(rootPath, "retry.db"),
+		SQLStoreAutoMigrate:    "Y",
+	}).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer msgStore.Close()
+	store := msgStore.(*sqlStore)
+	store.sqlRetryMaxAttempts, store.sqlRetryBackoff = 3, time.Millisecond
+
+	// Given a message whose insert was committed as its connection dropped
+	require.Nil(t, store.SaveMessage(1, []byte("hello")))
+	duplicate := errors.New("UNIQUE constraint failed: messages.session_id, messages.msgseqnum")
+	lostCommit := func() func() error {
+		attempts := 0
+		return func() error {
+			if attempts++; attempts == 1 {
+				return driver.ErrBadConn
+			}
+			return duplicate
+		}
+	}
+
+	// When the insert is retried, then the duplicate should be taken for the earlier attempt
+	assert.Nil(t, store.withInsertRetry(context.Background(), MessageOutgoing, []SeqMsg{{SeqNum: 1, Msg: []byte("hello")}}, lostCommit()))
+
+	// But not if another body is stored under the seqnum
+	assert.Equal(t, duplicate, store.withInsertRetry(context.Background(), MessageOutgoing, []SeqMsg{{SeqNum: 1, Msg: []byte("world")}}, lostCommit()))
+
+	// Nor on the first attempt
+	assert.Equal(t, duplicate, store.withInsertRetry(context.Background(), MessageOutgoing, []SeqMsg{{SeqNum: 1, Msg: []byte("hello")}}, func() error { return duplicate }))
+}
@@ -0,0 +1,156 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CloneSession copies the session srcID to the session dstID, see SessionCloner
+func (f *sqlStoreFactory) CloneSession(srcID, dstID string) error {
+	return CloneMessageStoreSession(f, srcID, dstID)
+}
+
+// RenameSession moves the session oldID to the session newID in one transaction, see SessionRenamer.  Sessions
+// stored in their own tables or partitions cannot be renamed.
+func (f *sqlStoreFactory) RenameSession(oldID, newID string) error {
+	return f.RenameSessionContext(context.Background(), oldID, newID)
+}
+
+// RenameSessionContext is like RenameSession, but the database operations are bounded by ctx
+func (f *sqlStoreFactory) RenameSessionContext(ctx context.Context, oldID, newID string) (err error) {
+	config, err := f.parseSettings()
+	if err != nil {
+		return err
+	}
+	if config.tablePerSession || config.partitionBy == sqlPartitionBySessionID {
+		return errors.New("sessions stored in their own tables or partitions cannot be renamed")
+	}
+	db, releaseDB, err := f.openDB(config)
+	if err != nil {
+		return err
+	}
+	defer releaseDB()
+
+	renamer := buildSQLStore(oldID, config, db, releaseDB)
+	defer renamer.observe("rename_session", time.Now(), &err)
+
+	ctx, cancel := renamer.withTimeout(ctx)
+	defer cancel()
+
+	return renamer.withRetry(ctx, func() error { return renamer.renameSessionTx(ctx, newID) })
+}
+
+// renameSessionTx rebinds the rows of the store's session to newID, provided newID has no session row yet
+func (store *sqlStore) renameSessionTx(ctx context.Context, newID string) error {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRowContext(ctx, store.sqlf(`SELECT COUNT(*) FROM %s WHERE session_id=?`, store.sessionsTable), newID).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("unable to rename session: %s: already stored", newID)
+	}
+
+	result, err := tx.ExecContext(ctx, store.sqlf(`UPDATE %s SET session_id=? WHERE session_id=?`, store.sessionsTable), newID, store.sessionID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("unable to rename session: %s: not found", store.sessionID)
+	}
+	for _, table := range []string{store.messagesTable, store.sessionValuesTable} {
+		if _, err := tx.ExecContext(ctx, store.sqlf(`UPDATE %s SET session_id=? WHERE session_id=?`, table), newID, store.sessionID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListSessions returns every session in the factory's sessions table, see SessionLister.  The message count of a session
+// excludes the messages it archived on earlier resets.
+func (f *sqlStoreFactory) ListSessions() ([]SessionInfo, error) {
+	return f.ListSessionsContext(context.Background())
+}
+
+// ListSessionsContext is like ListSessions, but the database operations are bounded by ctx
+func (f *sqlStoreFactory) ListSessionsContext(ctx context.Context) (infos []SessionInfo, err error) {
+	config, err := f.parseSettings()
+	if err != nil {
+		return nil, err
+	}
+	db, releaseDB, err := f.openDB(config)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseDB()
+
+	lister := buildSQLStore("", config, db, releaseDB)
+	defer lister.observe("list_sessions", time.Now(), &err)
+
+	ctx, cancel := lister.withTimeout(ctx)
+	defer cancel()
+
+	err = lister.withRetry(ctx, func() (err error) {
+		infos, err = lister.listSessions(ctx)
+		return err
+	})
+	return infos, err
+}
+
+// listSessions reads the sessions table, and then counts the messages of each session in its messages table
+func (store *sqlStore) listSessions(ctx context.Context) ([]SessionInfo, error) {
+	query := store.sqlf(`SELECT session_id, creation_time, incoming_seqnum, outgoing_seqnum FROM %s ORDER BY session_id`, store.sessionsTable)
+	if store.archiveOnReset {
+		query = store.sqlf(`SELECT session_id, creation_time, incoming_seqnum, outgoing_seqnum, reset_generation FROM %s ORDER BY session_id`, store.sessionsTable)
+	}
+	rows, err := store.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var infos []SessionInfo
+	var resetGenerations []int
+	for rows.Next() {
+		var info SessionInfo
+		var resetGeneration int
+		if store.archiveOnReset {
+			err = rows.Scan(&info.SessionID, &info.CreationTime, &info.NextTargetMsgSeqNum, &info.NextSenderMsgSeqNum, &resetGeneration)
+		} else {
+			err = rows.Scan(&info.SessionID, &info.CreationTime, &info.NextTargetMsgSeqNum, &info.NextSenderMsgSeqNum)
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+		resetGenerations = append(resetGenerations, resetGeneration)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range infos {
+		messagesTable := store.messagesTable
+		if store.tablePerSession {
+			messagesTable = store.tableName("messages_" + sanitizeSessionID(infos[i].SessionID))
+		}
+		query := store.sqlf(`SELECT COUNT(*) FROM %s WHERE session_id=?`, messagesTable)
+		args := []interface{}{infos[i].SessionID}
+		if store.archiveOnReset {
+			query = store.sqlf(`SELECT COUNT(*) FROM %s WHERE session_id=? AND reset_generation=?`, messagesTable)
+			args = append(args, resetGenerations[i])
+		}
+		if err = store.db.QueryRowContext(ctx, query, args...).Scan(&infos[i].MessageCount); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
@@ -0,0 +1,55 @@
+package msgstore
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// MessageCount returns the number of the session's messages, see MessageStats
+func (store *sqlStore) MessageCount() (int, error) {
+	return store.MessageCountContext(context.Background())
+}
+
+// MessageCountContext is like MessageCount, but the database operation is bounded by ctx
+func (store *sqlStore) MessageCountContext(ctx context.Context) (int, error) {
+	return store.messageStat(ctx, "message_count", "COUNT(*)")
+}
+
+// FirstSeqNum returns the lowest seqnum of the session's messages, or 0 if it has none, see MessageStats
+func (store *sqlStore) FirstSeqNum() (int, error) {
+	return store.FirstSeqNumContext(context.Background())
+}
+
+// FirstSeqNumContext is like FirstSeqNum, but the database operation is bounded by ctx
+func (store *sqlStore) FirstSeqNumContext(ctx context.Context) (int, error) {
+	return store.messageStat(ctx, "first_seqnum", "MIN(msgseqnum)")
+}
+
+// LastSeqNum returns the highest seqnum of the session's messages, or 0 if it has none, see MessageStats
+func (store *sqlStore) LastSeqNum() (int, error) {
+	return store.LastSeqNumContext(context.Background())
+}
+
+// LastSeqNumContext is like LastSeqNum, but the database operation is bounded by ctx
+func (store *sqlStore) LastSeqNumContext(ctx context.Context) (int, error) {
+	return store.messageStat(ctx, "last_seqnum", "MAX(msgseqnum)")
+}
+
+// messageStat computes aggregate over the messages that GetMessages reads, which the primary key index answers
+func (store *sqlStore) messageStat(ctx context.Context, operation, aggregate string) (stat int, err error) {
+	defer store.observe(operation, time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	condition, args := store.currentMessages()
+	query := `SELECT ` + aggregate + ` FROM %s WHERE session_id=?` + condition
+	args = append([]interface{}{store.sessionID}, args...)
+
+	var value sql.NullInt64
+	err = store.withRetry(ctx, func() error {
+		return store.db.QueryRowContext(ctx, store.sqlf(query, store.messagesTable), args...).Scan(&value)
+	})
+	return int(value.Int64), err
+}
@@ -1,8 +1,14 @@
 package msgstore
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,113 +21,786 @@ const (
 	SQLStoreConnMaxLifetime string = "SQLStoreConnMaxLifetime"
 	// SQLStoreTableNamePrefix will be prepended to the names of the database tables.  Optional.
 	SQLStoreTableNamePrefix string = "SQLStoreTableNamePrefix"
+	// SQLStoreSchemaName qualifies every table the store uses with this schema, e.g. "fix" for "fix.messages", so that
+	// tenants sharing a database can keep their FIX state apart.  The schema must already exist.  Optional, defaults to
+	// the connection's default schema.
+	SQLStoreSchemaName string = "SQLStoreSchemaName"
+	// SQLStoreDialect selects the placeholder and quoting syntax, e.g. "sqlite3", "mysql", "postgres", "mssql", "oracle".
+	// Optional, inferred from SQLStoreDriver when not set.
+	SQLStoreDialect string = "SQLStoreDialect"
+	// SQLStoreAutoMigrate, when set to "Y", creates and upgrades the database tables at startup.  Optional, defaults to "N".
+	SQLStoreAutoMigrate string = "SQLStoreAutoMigrate"
+	// SQLStoreQueryTimeout bounds every database operation, e.g. "5s".  Optional, defaults to no timeout.
+	SQLStoreQueryTimeout string = "SQLStoreQueryTimeout"
+	// SQLStoreRetryMaxAttempts is the number of times an operation failing with a transient error, such as a dropped
+	// connection or deadlock, is attempted before the error is returned.  Optional, defaults to 1 (no retries).
+	SQLStoreRetryMaxAttempts string = "SQLStoreRetryMaxAttempts"
+	// SQLStoreConflictRetryMaxAttempts is the number of times an operation failing with a deadlock or serialization failure,
+	// recognized by the dialect's error codes, is attempted before the error is returned.  Optional, defaults to 3.
+	SQLStoreConflictRetryMaxAttempts string = "SQLStoreConflictRetryMaxAttempts"
+	// SQLStoreRetryBackoff is the wait before the first retry, doubling for each retry after it.  Optional, defaults to 100ms.
+	SQLStoreRetryBackoff string = "SQLStoreRetryBackoff"
+	// SQLStoreDuplicateMessagePolicy is one of "error", "replace" or "ignore", see DuplicateMessagePolicy.  Optional, defaults to "error".
+	SQLStoreDuplicateMessagePolicy string = "SQLStoreDuplicateMessagePolicy"
+	// SQLStoreMessageColumnType is "text" to store messages as character data, or "binary" to store the raw bytes in a
+	// BLOB/BYTEA column so that they are not subject to charset conversion.  Optional, defaults to "text".
+	SQLStoreMessageColumnType string = "SQLStoreMessageColumnType"
+	// SQLStorePartitionBy selects a postgres partitioned messages table: "session_id" for a list partition per session, or
+	// "session_date" for range partitions by the UTC date of the session creation time.  Partitions are created by the
+	// store as needed; with SQLStoreAutoMigrate the partitioned parent table is created too.  Optional, defaults to none.
+	SQLStorePartitionBy string = "SQLStorePartitionBy"
+	// SQLStoreMessageCompression is "zstd" to compress messages before they are written, cutting the size of verbose
+	// messages severalfold.  Compressed messages are marked by a leading byte, so rows written without compression are
+	// still read as is.  Requires SQLStoreMessageColumnType "binary".  Optional, defaults to no compression.
+	SQLStoreMessageCompression string = "SQLStoreMessageCompression"
+	// SQLStoreLeaseTTL enables lease mode for active/standby deployments, e.g. "30s".  A store holding the lease on its
+	// session renews it with each seqnum update and message write; other stores cannot update the seqnums, write the
+	// messages or Reset the session until the lease is released, expires or is taken over, see SessionLeaser.  The lease
+	// is checked and written under a lock of the session row.  Should comfortably exceed the heartbeat interval.
+	// Optional, defaults to no leasing.
+	SQLStoreLeaseTTL string = "SQLStoreLeaseTTL"
+	// SQLStoreLeaseOwner identifies this engine instance in the lease columns.  Optional, defaults to hostname:pid.
+	SQLStoreLeaseOwner string = "SQLStoreLeaseOwner"
+	// SQLStoreResetMode is "delete" for Reset to delete the session's messages, or "archive" for Reset to keep them and
+	// start a new reset generation, so that nothing is ever physically deleted by the store.  GetMessages only returns
+	// messages of the current generation.  Archiving requires a reset_generation column in the messages table primary key,
+	// which SQLStoreAutoMigrate creates for new tables and adds to those created by earlier versions.  Optional, defaults
+	// to "delete".
+	SQLStoreResetMode string = "SQLStoreResetMode"
+	// SQLStoreTablePerSession, when set to "Y", stores each session's messages in its own table, named after the
+	// messages table with the sanitized sessionID appended, e.g. "messages_fix_4_4_sender_target".  The table is created
+	// by the store at startup.  Cannot be combined with SQLStorePartitionBy.  Optional, defaults to "N".
+	SQLStoreTablePerSession string = "SQLStoreTablePerSession"
+	// SQLStoreRecordMessageDetails, when set to "Y", records the direction and store time of each message in direction
+	// and stored_at columns, with direction added to the messages table primary key, see TimedMessageStore.
+	// SQLStoreAutoMigrate creates the columns for new tables.  Optional, defaults to "N".
+	SQLStoreRecordMessageDetails string = "SQLStoreRecordMessageDetails"
+	// SQLStorePruneInterval starts a background job deleting the session's old messages at this interval, e.g. "1h".
+	// Messages are deleted in batches, each in its own short transaction.  Optional, defaults to no pruning.
+	SQLStorePruneInterval string = "SQLStorePruneInterval"
+	// SQLStorePruneMaxAge prunes messages stored longer ago than this, e.g. "168h".  Requires SQLStoreRecordMessageDetails.
+	SQLStorePruneMaxAge string = "SQLStorePruneMaxAge"
+	// SQLStorePruneKeepMessages prunes messages whose seqnum is more than this many below the next sender seqnum
+	SQLStorePruneKeepMessages string = "SQLStorePruneKeepMessages"
+	// SQLStorePruneBatchSize is the span of seqnums deleted by each pruning statement.  Optional, defaults to 1000.
+	SQLStorePruneBatchSize string = "SQLStorePruneBatchSize"
+	// SQLStoreVerifySchema, when set to "Y", makes Create fail with a descriptive error if the tables or columns the store
+	// needs are missing, rather than the first write failing later.  Optional, defaults to "N".
+	SQLStoreVerifySchema string = "SQLStoreVerifySchema"
+	// SQLStoreDetectConflicts, when set to "Y", makes Refresh fail with an error matching ErrExternallyModified if the
+	// stored seqnums moved backward or the creation time changed by a second or more since the store last loaded or
+	// wrote them, leaving the store as it was rather than adopting them.  Optional, defaults to "N".
+	SQLStoreDetectConflicts string = "SQLStoreDetectConflicts"
 )
 
+// The SQLStoreStatement settings replace a statement generated by the store with one of the user's, e.g. to write
+// through a view or call a stored procedure.  Placeholders are written as `?` and rebound for the dialect.
+// A replacement receives the arguments listed below, followed by the values of any columns called for by
+// SQLStorePartitionBy, SQLStoreResetMode and SQLStoreRecordMessageDetails, in that order.  All are optional.
+const (
+	// SQLStoreStatementSelectSession args: session_id.  Must return creation_time, incoming_seqnum, outgoing_seqnum
+	// and, when archiving resets, reset_generation.
+	SQLStoreStatementSelectSession string = "SQLStoreStatementSelectSession"
+	// SQLStoreStatementInsertSession args: creation_time, incoming_seqnum, outgoing_seqnum, session_id
+	SQLStoreStatementInsertSession string = "SQLStoreStatementInsertSession"
+	// SQLStoreStatementUpdateSession writes the whole session row, inserting it if missing.
+	// Args: session_id, creation_time, incoming_seqnum, outgoing_seqnum.  Not used with SQLStoreLeaseTTL.
+	SQLStoreStatementUpdateSession string = "SQLStoreStatementUpdateSession"
+	// SQLStoreStatementInsertMessage args: msgseqnum, message, session_id.  Batches are saved a message at a time with it.
+	SQLStoreStatementInsertMessage string = "SQLStoreStatementInsertMessage"
+	// SQLStoreStatementSelectMessages args: session_id, begin msgseqnum, end msgseqnum.  Must return msgseqnum and message,
+	// ordered by msgseqnum.
+	SQLStoreStatementSelectMessages string = "SQLStoreStatementSelectMessages"
+	// SQLStoreStatementDeleteMessages args: session_id
+	SQLStoreStatementDeleteMessages string = "SQLStoreStatementDeleteMessages"
+)
+
+// sqlStoreStatementSettings lists the settings that may replace generated statements
+var sqlStoreStatementSettings = []string{
+	SQLStoreStatementSelectSession,
+	SQLStoreStatementInsertSession,
+	SQLStoreStatementUpdateSession,
+	SQLStoreStatementInsertMessage,
+	SQLStoreStatementSelectMessages,
+	SQLStoreStatementDeleteMessages,
+}
+
+// sqlMaxBatchRows caps the number of rows written by a single multi-row INSERT
+const sqlMaxBatchRows = 500
+
 type sqlStoreFactory struct {
 	settings map[string]string
+
+	// db is the application's connection pool given to NewSQLStoreFactoryFromDB, which the stores never close
+	db *sql.DB
+
+	keyProvider MessageKeyProvider
+	serializer  RecordSerializer
+	metrics     StoreMetrics
+	clock       Clock
+	logger      Logger
+
+	mu     sync.Mutex
+	dbs    map[sqlDBKey]*sqlDBRef
+	closed bool
+}
+
+// sqlDBKey identifies a connection pool shared by the stores of a factory
+type sqlDBKey struct {
+	driver         string
+	dataSourceName string
+}
+
+// sqlDBRef counts the open stores using a shared connection pool
+type sqlDBRef struct {
+	db   *sql.DB
+	refs int
+}
+
+// sqlStoreConfig holds the factory settings after they have been parsed and validated
+type sqlStoreConfig struct {
+	driver           string
+	dataSourceName   string
+	connMaxLifetime  time.Duration
+	tableNamePrefix  string
+	schemaName       string
+	dialect          sqlDialect
+	autoMigrate      bool
+	queryTimeout     time.Duration
+	retryMaxAttempts int
+	conflictAttempts int
+	retryBackoff     time.Duration
+	duplicatePolicy  DuplicateMessagePolicy
+	binaryMessages   bool
+	compressMessages bool
+	keyProvider      MessageKeyProvider
+	serializer       RecordSerializer
+	metrics          StoreMetrics
+	clock            Clock
+	logger           Logger
+	partitionBy      string
+	leaseTTL         time.Duration
+	leaseOwner       string
+	archiveOnReset   bool
+	tablePerSession  bool
+	statements       map[string]string
+	messageDetails   bool
+	prune            sqlPruneConfig
+	verifySchema     bool
+	detectConflicts  bool
 }
 
 type sqlStore struct {
-	sessionID          string
-	cache              *memoryStore
-	sqlDriver          string
-	sqlDataSourceName  string
-	sqlConnMaxLifetime time.Duration
-	sqlTableNamePrefix string
-	db                 *sql.DB
+	sessionID           string
+	cache               *memoryStore
+	sqlDriver           string
+	sqlDataSourceName   string
+	sqlConnMaxLifetime  time.Duration
+	sqlTableNamePrefix  string
+	sqlSchemaName       string
+	sqlQueryTimeout     time.Duration
+	sqlRetryMaxAttempts int
+	sqlConflictAttempts int
+	sqlRetryBackoff     time.Duration
+	duplicatePolicy     DuplicateMessagePolicy
+	binaryMessages      bool
+	compressMessages    bool
+	keyProvider         MessageKeyProvider
+	serializer          RecordSerializer
+	metrics             StoreMetrics
+	logger              Logger
+	partitionBy         string
+	leaseTTL            time.Duration
+	leaseOwner          string
+	archiveOnReset      bool
+	tablePerSession     bool
+	statements          map[string]string
+	messageDetails      bool
+	prune               sqlPruneConfig
+	detectConflicts     bool
+	stopPruning         chan struct{}
+	pruningDone         chan struct{}
+	resetGeneration     int
+	dialect             sqlDialect
+	sessionsTable       string
+	messagesTable       string
+	schemaVersionTable  string
+	sessionValuesTable  string
+	db                  *sql.DB
+	releaseDB           func() error
+}
+
+// SQLStoreOption configures optional behavior of the stores created by a sql MessageStoreFactory
+type SQLStoreOption func(*sqlStoreFactory)
+
+// WithSQLStoreKeyProvider encrypts messages with AES-256-GCM under the data keys supplied by provider, so that they cannot be
+// read from the database in plaintext.  Each message records the ID of its key, so keys can be rotated, and messages
+// written without encryption are still read as is.  Requires SQLStoreMessageColumnType "binary".
+func WithSQLStoreKeyProvider(provider MessageKeyProvider) SQLStoreOption {
+	return func(f *sqlStoreFactory) { f.keyProvider = provider }
+}
+
+// WithSQLStoreRecordSerializer saves each message as a record wrapped by serializer in an envelope carrying its
+// metadata, before compressing and encrypting it as configured, see RecordSerializer.  Requires SQLStoreMessageColumnType
+// "binary".
+func WithSQLStoreRecordSerializer(serializer RecordSerializer) SQLStoreOption {
+	return func(f *sqlStoreFactory) { f.serializer = serializer }
+}
+
+// WithSQLStoreClock stamps the creation time, stored messages and leases of the stores with the time told by clock, and
+// prunes by SQLStorePruneMaxAge against it.  Defaults to the system clock.
+func WithSQLStoreClock(clock Clock) SQLStoreOption {
+	return func(f *sqlStoreFactory) { f.clock = clock }
 }
 
-// NewSQLStoreFactory returns a sql-based implementation of MessageStoreFactory
-func NewSQLStoreFactory(settings map[string]string) MessageStoreFactory {
-	return sqlStoreFactory{settings: settings}
+// WithSQLStoreSettings applies the SQLStore* settings, other than SQLStoreDriver, SQLStoreDataSourceName and
+// SQLStoreConnMaxLifetime which are the application's concern when it provides the *sql.DB
+func WithSQLStoreSettings(settings map[string]string) SQLStoreOption {
+	return func(f *sqlStoreFactory) {
+		for k, v := range settings {
+			f.settings[k] = v
+		}
+	}
+}
+
+// NewSQLStoreFactory returns a sql-based implementation of MessageStoreFactory.  settings is copied, so that the
+// options do not change the caller's map.
+func NewSQLStoreFactory(settings map[string]string, opts ...SQLStoreOption) MessageStoreFactory {
+	copied := make(map[string]string, len(settings))
+	for k, v := range settings {
+		copied[k] = v
+	}
+	f := &sqlStoreFactory{settings: copied, dbs: make(map[sqlDBKey]*sqlDBRef)}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// NewSQLStoreFactoryFromDB returns a sql-based implementation of MessageStoreFactory whose stores use db, for applications
+// managing their own connection pool.  The stores never close db.  The dialect is inferred from well-known drivers, other
+// drivers need SQLStoreDialect set with WithSQLStoreSettings.
+func NewSQLStoreFactoryFromDB(db *sql.DB, opts ...SQLStoreOption) MessageStoreFactory {
+	f := &sqlStoreFactory{settings: make(map[string]string), db: db}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
 }
 
 // Create creates a new SQLStore implementation of the MessageStore interface
-func (f sqlStoreFactory) Create(sessionID string) (msgStore MessageStore, err error) {
-	sqlDriver, ok := f.settings[SQLStoreDriver]
-	if !ok {
-		return nil, fmt.Errorf("sessionID: %s: required setting not found: %s", sessionID, SQLStoreDriver)
+func (f *sqlStoreFactory) Create(sessionID string) (msgStore MessageStore, err error) {
+	config, err := f.parseSettings()
+	if err != nil {
+		return nil, fmt.Errorf("sessionID: %s: %w", sessionID, err)
+	}
+
+	db, releaseDB, err := f.openDB(config)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newSQLStore(sessionID, config, db, releaseDB)
+	if err != nil {
+		releaseDB()
+		return nil, err
+	}
+	return store, nil
+}
+
+// Close stops the factory from creating stores.  The connection pools are shared by reference count, so each is closed
+// with the last store using it, and an application's pool given to NewSQLStoreFactoryFromDB is never closed.
+func (f *sqlStoreFactory) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	return nil
+}
+
+// openDB returns the connection pool for config and the function releasing it, which never closes an application's pool
+func (f *sqlStoreFactory) openDB(config sqlStoreConfig) (*sql.DB, func() error, error) {
+	f.mu.Lock()
+	closed := f.closed
+	f.mu.Unlock()
+	if closed {
+		return nil, nil, ErrFactoryClosed
 	}
 
-	sqlDataSourceName, ok := f.settings[SQLStoreDataSourceName]
+	if f.db != nil {
+		return f.db, func() error { return nil }, nil
+	}
+
+	key := sqlDBKey{driver: config.driver, dataSourceName: config.dataSourceName}
+	db, err := f.acquireDB(key, config.connMaxLifetime)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, func() error { return f.releaseDB(key) }, nil
+}
+
+// acquireDB returns the factory's connection pool for key, opening it if no open store is using it
+func (f *sqlStoreFactory) acquireDB(key sqlDBKey, connMaxLifetime time.Duration) (*sql.DB, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if ref, ok := f.dbs[key]; ok {
+		ref.refs++
+		return ref.db, nil
+	}
+
+	db, err := sql.Open(key.driver, key.dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	db.SetConnMaxLifetime(connMaxLifetime)
+
+	f.dbs[key] = &sqlDBRef{db: db, refs: 1}
+	return db, nil
+}
+
+// releaseDB drops a reference to the connection pool for key, closing it once the last store using it is closed
+func (f *sqlStoreFactory) releaseDB(key sqlDBKey) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ref, ok := f.dbs[key]
 	if !ok {
-		return nil, fmt.Errorf("sessionID: %s: required setting not found: %s", sessionID, SQLStoreDataSourceName)
+		return nil
+	}
+	if ref.refs--; ref.refs > 0 {
+		return nil
+	}
+	delete(f.dbs, key)
+	return ref.db.Close()
+}
+
+func (f *sqlStoreFactory) parseSettings() (config sqlStoreConfig, err error) {
+	var ok bool
+	if f.db != nil {
+		// the pool is already open, so only the driver's dialect matters
+		config.driver = sqlDriverName(f.db)
+		if config.driver == "" && f.settings[SQLStoreDialect] == "" {
+			return config, fmt.Errorf("unable to infer sql dialect, required setting not found: %s", SQLStoreDialect)
+		}
+	} else if config.driver, ok = f.settings[SQLStoreDriver]; !ok {
+		return config, fmt.Errorf("required setting not found: %s", SQLStoreDriver)
+	} else if config.dataSourceName, ok = f.settings[SQLStoreDataSourceName]; !ok {
+		return config, fmt.Errorf("required setting not found: %s", SQLStoreDataSourceName)
 	}
 
-	sqlConnMaxLifetime := 0 * time.Second
 	if durationStr, ok := f.settings[SQLStoreConnMaxLifetime]; ok {
-		sqlConnMaxLifetime, err = time.ParseDuration(durationStr)
-		if err != nil {
-			return nil, err
+		if config.connMaxLifetime, err = time.ParseDuration(durationStr); err != nil {
+			return config, err
 		}
 	}
 
-	sqlTableNamePrefix, ok := f.settings[SQLStoreTableNamePrefix]
-	if !ok {
-		sqlTableNamePrefix = ""
+	config.tableNamePrefix = f.settings[SQLStoreTableNamePrefix]
+	config.schemaName = f.settings[SQLStoreSchemaName]
+
+	if config.dialect, err = lookupSQLDialect(config.driver, f.settings[SQLStoreDialect]); err != nil {
+		return config, err
+	}
+
+	if autoMigrateStr, ok := f.settings[SQLStoreAutoMigrate]; ok {
+		if config.autoMigrate, err = parseBoolSetting(autoMigrateStr); err != nil {
+			return config, fmt.Errorf("invalid setting: %s: %w", SQLStoreAutoMigrate, err)
+		}
+	}
+
+	if durationStr, ok := f.settings[SQLStoreQueryTimeout]; ok {
+		if config.queryTimeout, err = time.ParseDuration(durationStr); err != nil {
+			return config, fmt.Errorf("invalid setting: %s: %w", SQLStoreQueryTimeout, err)
+		}
+	}
+
+	config.retryMaxAttempts = 1
+	if attemptsStr, ok := f.settings[SQLStoreRetryMaxAttempts]; ok {
+		if config.retryMaxAttempts, err = strconv.Atoi(attemptsStr); err != nil {
+			return config, fmt.Errorf("invalid setting: %s: %w", SQLStoreRetryMaxAttempts, err)
+		}
+	}
+
+	config.conflictAttempts = 3
+	if attemptsStr, ok := f.settings[SQLStoreConflictRetryMaxAttempts]; ok {
+		if config.conflictAttempts, err = strconv.Atoi(attemptsStr); err != nil {
+			return config, fmt.Errorf("invalid setting: %s: %w", SQLStoreConflictRetryMaxAttempts, err)
+		}
+	}
+
+	config.retryBackoff = 100 * time.Millisecond
+	if durationStr, ok := f.settings[SQLStoreRetryBackoff]; ok {
+		if config.retryBackoff, err = time.ParseDuration(durationStr); err != nil {
+			return config, fmt.Errorf("invalid setting: %s: %w", SQLStoreRetryBackoff, err)
+		}
+	}
+
+	config.duplicatePolicy = DuplicateMessageError
+	if policyStr, ok := f.settings[SQLStoreDuplicateMessagePolicy]; ok {
+		if config.duplicatePolicy, err = parseDuplicateMessagePolicy(policyStr); err != nil {
+			return config, fmt.Errorf("invalid setting: %s: %w", SQLStoreDuplicateMessagePolicy, err)
+		}
+	}
+
+	switch columnType := f.settings[SQLStoreMessageColumnType]; columnType {
+	case "", "text":
+	case "binary":
+		config.binaryMessages = true
+	default:
+		return config, fmt.Errorf("invalid setting: %s: unknown column type: %s", SQLStoreMessageColumnType, columnType)
 	}
 
-	return newSQLStore(sessionID, sqlDriver, sqlDataSourceName, sqlConnMaxLifetime, sqlTableNamePrefix)
+	switch compression := f.settings[SQLStoreMessageCompression]; compression {
+	case "":
+	case "zstd":
+		if !config.binaryMessages {
+			return config, fmt.Errorf("invalid setting: %s: requires %s binary", SQLStoreMessageCompression, SQLStoreMessageColumnType)
+		}
+		config.compressMessages = true
+	default:
+		return config, fmt.Errorf("invalid setting: %s: unknown compression: %s", SQLStoreMessageCompression, compression)
+	}
+
+	if config.keyProvider = f.keyProvider; config.keyProvider != nil && !config.binaryMessages {
+		return config, fmt.Errorf("message encryption requires %s binary", SQLStoreMessageColumnType)
+	}
+	if config.serializer = f.serializer; config.serializer != nil && !config.binaryMessages {
+		return config, fmt.Errorf("record serialization requires %s binary", SQLStoreMessageColumnType)
+	}
+	config.metrics = f.metrics
+	config.clock = f.clock
+	config.logger = f.logger
+
+	config.partitionBy = f.settings[SQLStorePartitionBy]
+	if err = validateSQLPartitioning(config.partitionBy, config.dialect); err != nil {
+		return config, fmt.Errorf("invalid setting: %s: %w", SQLStorePartitionBy, err)
+	}
+
+	if durationStr, ok := f.settings[SQLStoreLeaseTTL]; ok {
+		if config.leaseTTL, err = time.ParseDuration(durationStr); err != nil {
+			return config, fmt.Errorf("invalid setting: %s: %w", SQLStoreLeaseTTL, err)
+		}
+	}
+
+	if config.leaseOwner = f.settings[SQLStoreLeaseOwner]; config.leaseOwner == "" {
+		config.leaseOwner = defaultSQLLeaseOwner()
+	}
+
+	switch resetMode := f.settings[SQLStoreResetMode]; resetMode {
+	case "", "delete":
+	case "archive":
+		config.archiveOnReset = true
+	default:
+		return config, fmt.Errorf("invalid setting: %s: unknown reset mode: %s", SQLStoreResetMode, resetMode)
+	}
+
+	if tablePerSessionStr, ok := f.settings[SQLStoreTablePerSession]; ok {
+		if config.tablePerSession, err = parseBoolSetting(tablePerSessionStr); err != nil {
+			return config, fmt.Errorf("invalid setting: %s: %w", SQLStoreTablePerSession, err)
+		}
+	}
+	if config.tablePerSession && config.partitionBy != "" {
+		return config, fmt.Errorf("invalid setting: %s: cannot be combined with %s", SQLStoreTablePerSession, SQLStorePartitionBy)
+	}
+
+	if detailsStr, ok := f.settings[SQLStoreRecordMessageDetails]; ok {
+		if config.messageDetails, err = parseBoolSetting(detailsStr); err != nil {
+			return config, fmt.Errorf("invalid setting: %s: %w", SQLStoreRecordMessageDetails, err)
+		}
+	}
+
+	if verifyStr, ok := f.settings[SQLStoreVerifySchema]; ok {
+		if config.verifySchema, err = parseBoolSetting(verifyStr); err != nil {
+			return config, fmt.Errorf("invalid setting: %s: %w", SQLStoreVerifySchema, err)
+		}
+	}
+
+	if detectStr, ok := f.settings[SQLStoreDetectConflicts]; ok {
+		if config.detectConflicts, err = parseBoolSetting(detectStr); err != nil {
+			return config, fmt.Errorf("invalid setting: %s: %w", SQLStoreDetectConflicts, err)
+		}
+	}
+
+	if config.prune, err = f.parsePruneSettings(config.messageDetails); err != nil {
+		return config, err
+	}
+
+	config.statements = make(map[string]string)
+	for _, name := range sqlStoreStatementSettings {
+		if stmt, ok := f.settings[name]; ok {
+			config.statements[name] = config.dialect.rebind(stmt)
+		}
+	}
+
+	return config, nil
 }
 
-func newSQLStore(sessionID string, driver string, dataSourceName string, connMaxLifetime time.Duration, tableNamePrefix string) (store *sqlStore, err error) {
-	store = &sqlStore{
-		sessionID:          sessionID,
-		cache:              &memoryStore{},
-		sqlDriver:          driver,
-		sqlDataSourceName:  dataSourceName,
-		sqlConnMaxLifetime: connMaxLifetime,
-		sqlTableNamePrefix: tableNamePrefix,
+// parseBoolSetting accepts the "Y"/"N" convention used by FIX engine settings as well as anything strconv.ParseBool does
+func parseBoolSetting(value string) (bool, error) {
+	switch value {
+	case "Y":
+		return true, nil
+	case "N":
+		return false, nil
 	}
+	return strconv.ParseBool(value)
+}
+
+func newSQLStore(sessionID string, config sqlStoreConfig, db *sql.DB, releaseDB func() error) (store *sqlStore, err error) {
+	store = buildSQLStore(sessionID, config, db, releaseDB)
 	store.cache.Reset()
 
-	if store.db, err = sql.Open(store.sqlDriver, store.sqlDataSourceName); err != nil {
+	ctx, cancel := store.withTimeout(context.Background())
+	defer cancel()
+
+	if err = store.withRetry(ctx, func() error { return store.db.PingContext(ctx) }); err != nil { // ensure immediate connection
 		return nil, err
 	}
-	store.db.SetConnMaxLifetime(store.sqlConnMaxLifetime)
-
-	if err = store.db.Ping(); err != nil { // ensure immediate connection
+	if config.autoMigrate {
+		if err = store.migrate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err = store.ensureSessionTable(ctx); err != nil {
+		return nil, err
+	}
+	if config.verifySchema {
+		if err = store.verifySchema(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err = store.populateCache(ctx); err != nil {
 		return nil, err
 	}
-	if err = store.populateCache(); err != nil {
+	if err = store.ensurePartition(ctx); err != nil {
 		return nil, err
 	}
+	if err = store.claimInitialLease(ctx); err != nil {
+		return nil, err
+	}
+	store.startPruning()
 
 	return store, nil
 }
 
+// buildSQLStore returns the store of a session without touching the database
+func buildSQLStore(sessionID string, config sqlStoreConfig, db *sql.DB, releaseDB func() error) *sqlStore {
+	store := &sqlStore{
+		sessionID:           sessionID,
+		cache:               &memoryStore{clock: config.clock},
+		sqlDriver:           config.driver,
+		sqlDataSourceName:   config.dataSourceName,
+		sqlConnMaxLifetime:  config.connMaxLifetime,
+		sqlTableNamePrefix:  config.tableNamePrefix,
+		sqlSchemaName:       config.schemaName,
+		sqlQueryTimeout:     config.queryTimeout,
+		sqlRetryMaxAttempts: config.retryMaxAttempts,
+		sqlConflictAttempts: config.conflictAttempts,
+		sqlRetryBackoff:     config.retryBackoff,
+		duplicatePolicy:     config.duplicatePolicy,
+		binaryMessages:      config.binaryMessages,
+		compressMessages:    config.compressMessages,
+		keyProvider:         config.keyProvider,
+		serializer:          config.serializer,
+		metrics:             config.metrics,
+		logger:              config.logger,
+		partitionBy:         config.partitionBy,
+		leaseTTL:            config.leaseTTL,
+		leaseOwner:          config.leaseOwner,
+		archiveOnReset:      config.archiveOnReset,
+		tablePerSession:     config.tablePerSession,
+		statements:          config.statements,
+		messageDetails:      config.messageDetails,
+		prune:               config.prune,
+		detectConflicts:     config.detectConflicts,
+		dialect:             config.dialect,
+		db:                  db,
+		releaseDB:           releaseDB,
+	}
+	store.sessionsTable = store.tableName("sessions")
+	store.messagesTable = store.tableName(store.messagesTableName())
+	store.schemaVersionTable = store.tableName("schema_version")
+	store.sessionValuesTable = store.tableName("session_values")
+	return store
+}
+
+// messagesTableName returns the name of the table of the session's messages, before it is prefixed and quoted by tableName
+func (store *sqlStore) messagesTableName() string {
+	if store.tablePerSession {
+		return "messages_" + sanitizeSessionID(store.sessionID)
+	}
+	return "messages"
+}
+
+// withTimeout bounds ctx by the store's SQLStoreQueryTimeout, if one is configured
+func (store *sqlStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if store.sqlQueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, store.sqlQueryTimeout)
+}
+
+// tableName returns the quoted name of one of the store's tables, with the table name prefix and, if set, the schema
+func (store *sqlStore) tableName(name string) string {
+	table := store.dialect.quoteIdent(store.sqlTableNamePrefix + name)
+	if store.sqlSchemaName == "" {
+		return table
+	}
+	return store.dialect.quoteIdent(store.sqlSchemaName) + "." + table
+}
+
+// sqlf formats a statement template and rebinds its placeholders for the store's dialect
+func (store *sqlStore) sqlf(format string, args ...interface{}) string {
+	return store.dialect.rebind(fmt.Sprintf(format, args...))
+}
+
+// statement returns the user's replacement for a generated statement, if one is configured by the named setting
+func (store *sqlStore) statement(name, generated string) string {
+	if stmt, ok := store.statements[name]; ok {
+		return stmt
+	}
+	return generated
+}
+
 // Reset deletes the store records and sets the seqnums back to 1
 func (store *sqlStore) Reset() error {
-	_, err := store.db.Exec(fmt.Sprintf(`DELETE FROM %smessages WHERE session_id=?`, store.sqlTableNamePrefix), store.sessionID)
-	if err != nil {
+	return store.ResetContext(context.Background())
+}
+
+// ResetContext is like Reset, but the database operations are bounded by ctx
+func (store *sqlStore) ResetContext(ctx context.Context) (err error) {
+	defer store.observe("reset", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	// in lease mode, make sure of the lease before deleting anything so that a standby cannot wipe the active store's messages
+	if store.leaseTTL > 0 {
+		if err := store.renewLease(ctx); err != nil {
+			return err
+		}
+	}
+
+	updateColumns := []string{"creation_time", "incoming_seqnum", "outgoing_seqnum"}
+	if store.archiveOnReset {
+		// the old generation's messages stay where they are, hidden from GetMessages
+		store.resetGeneration++
+		updateColumns = append(updateColumns, "reset_generation")
+	} else {
+		_, err = store.exec(ctx, store.statement(SQLStoreStatementDeleteMessages, store.sqlf(`DELETE FROM %s WHERE session_id=?`, store.messagesTable)), store.sessionID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := store.cache.Reset(); err != nil {
 		return err
 	}
 
-	if err = store.cache.Reset(); err != nil {
+	if err = store.upsertSession(ctx, store.cache.CreationTime(), store.cache.NextTargetMsgSeqNum(), store.cache.NextSenderMsgSeqNum(), updateColumns...); err != nil {
+		if store.archiveOnReset {
+			store.resetGeneration--
+		}
 		return err
 	}
+	return store.ensurePartition(ctx)
+}
+
+// ResetWithoutDeletingMessages resets the session into a new reset generation, see SeqNumResetter.  It requires
+// SQLStoreResetMode "archive", in which it is the same as Reset.
+func (store *sqlStore) ResetWithoutDeletingMessages() error {
+	return store.ResetWithoutDeletingMessagesContext(context.Background())
+}
+
+// ResetWithoutDeletingMessagesContext is like ResetWithoutDeletingMessages, but the database operations are bounded by ctx
+func (store *sqlStore) ResetWithoutDeletingMessagesContext(ctx context.Context) error {
+	if !store.archiveOnReset {
+		return fmt.Errorf("resetting without deleting messages requires setting: %s: archive", SQLStoreResetMode)
+	}
+	return store.ResetContext(ctx)
+}
+
+// sqlExecer runs statements on a *sql.DB, or in a *sql.Tx
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// upsertSession writes updateColumns of the session row, inserting the whole row if it has gone missing.
+// In lease mode the row is only updated if the store holds or can take the lease.
+func (store *sqlStore) upsertSession(ctx context.Context, creationTime time.Time, incomingSeqNum, outgoingSeqNum int, updateColumns ...string) error {
+	return store.withRetry(ctx, func() error {
+		return store.writeSession(ctx, store.db, creationTime, incomingSeqNum, outgoingSeqNum, updateColumns...)
+	})
+}
 
-	_, err = store.db.Exec(fmt.Sprintf(`UPDATE %ssessions SET creation_time=?, incoming_seqnum=?, outgoing_seqnum=? WHERE session_id=?`, store.sqlTableNamePrefix), store.cache.CreationTime(), store.cache.NextTargetMsgSeqNum(), store.cache.NextSenderMsgSeqNum(), store.sessionID)
+// writeSession is upsertSession without the retries, on db
+func (store *sqlStore) writeSession(ctx context.Context, db sqlExecer, creationTime time.Time, incomingSeqNum, outgoingSeqNum int, updateColumns ...string) error {
+	if store.leaseTTL > 0 {
+		values := map[string]interface{}{"creation_time": creationTime, "incoming_seqnum": incomingSeqNum, "outgoing_seqnum": outgoingSeqNum, "reset_generation": store.resetGeneration}
+		args := make([]interface{}, len(updateColumns))
+		for i, c := range updateColumns {
+			args[i] = values[c]
+		}
+		return store.updateLeasedSession(ctx, db, false, updateColumns, args)
+	}
 
+	columns := []string{"session_id", "creation_time", "incoming_seqnum", "outgoing_seqnum"}
+	args := []interface{}{store.sessionID, creationTime, incomingSeqNum, outgoingSeqNum}
+	if store.archiveOnReset {
+		columns = append(columns, "reset_generation")
+		args = append(args, store.resetGeneration)
+	}
+	stmt := store.statement(SQLStoreStatementUpdateSession, store.dialect.rebind(store.dialect.upsert(store.sessionsTable, []string{"session_id"}, columns, updateColumns, 1)))
+	_, err := db.ExecContext(ctx, stmt, args...)
 	return err
 }
 
 // Refresh reloads the store from the database
 func (store *sqlStore) Refresh() error {
+	return store.RefreshContext(context.Background())
+}
+
+// RefreshContext is like Refresh, but the database operations are bounded by ctx
+func (store *sqlStore) RefreshContext(ctx context.Context) (err error) {
+	defer store.observe("refresh", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	before := snapshotSession(store)
 	if err := store.cache.Reset(); err != nil {
 		return err
 	}
-	return store.populateCache()
+	if err := store.populateCache(ctx); err != nil {
+		return err
+	}
+
+	// the database may hold the creation time to the second only
+	if store.detectConflicts {
+		if err := before.detectConflict(store.sessionID, snapshotSession(store), time.Second); err != nil {
+			before.restore(store.cache)
+			return err
+		}
+	}
+	return nil
 }
 
-func (store *sqlStore) populateCache() (err error) {
+func (store *sqlStore) populateCache(ctx context.Context) (err error) {
 	var creationTime time.Time
-	var incomingSeqNum, outgoingSeqNum int
-	row := store.db.QueryRow(fmt.Sprintf(`SELECT creation_time, incoming_seqnum, outgoing_seqnum FROM %ssessions WHERE session_id=?`, store.sqlTableNamePrefix), store.sessionID)
-	err = row.Scan(&creationTime, &incomingSeqNum, &outgoingSeqNum)
+	var incomingSeqNum, outgoingSeqNum, resetGeneration int
+	err = store.withRetry(ctx, func() error {
+		if store.archiveOnReset {
+			stmt := store.statement(SQLStoreStatementSelectSession, store.sqlf(`SELECT creation_time, incoming_seqnum, outgoing_seqnum, reset_generation FROM %s WHERE session_id=?`, store.sessionsTable))
+			return store.db.QueryRowContext(ctx, stmt, store.sessionID).Scan(&creationTime, &incomingSeqNum, &outgoingSeqNum, &resetGeneration)
+		}
+		stmt := store.statement(SQLStoreStatementSelectSession, store.sqlf(`SELECT creation_time, incoming_seqnum, outgoing_seqnum FROM %s WHERE session_id=?`, store.sessionsTable))
+		return store.db.QueryRowContext(ctx, stmt, store.sessionID).Scan(&creationTime, &incomingSeqNum, &outgoingSeqNum)
+	})
 
 	// session record found, load it
 	if err == nil {
+		store.resetGeneration = resetGeneration
 		store.cache.creationTime = creationTime
 		store.cache.SetNextTargetMsgSeqNum(incomingSeqNum)
 		store.cache.SetNextSenderMsgSeqNum(outgoingSeqNum)
@@ -129,12 +808,14 @@ func (store *sqlStore) populateCache() (err error) {
 	}
 
 	// fatal error, give up
-	if err != sql.ErrNoRows {
+	if !errors.Is(err, sql.ErrNoRows) {
 		return err
 	}
 
 	// session record not found, create it
-	_, err = store.db.Exec(fmt.Sprintf(`INSERT INTO %ssessions (creation_time, incoming_seqnum, outgoing_seqnum, session_id) VALUES(?, ?, ?, ?)`, store.sqlTableNamePrefix), store.cache.creationTime, store.cache.NextTargetMsgSeqNum(), store.cache.NextSenderMsgSeqNum(), store.sessionID)
+	store.resetGeneration = 0
+	stmt := store.statement(SQLStoreStatementInsertSession, store.sqlf(`INSERT INTO %s (creation_time, incoming_seqnum, outgoing_seqnum, session_id) VALUES(?, ?, ?, ?)`, store.sessionsTable))
+	_, err = store.exec(ctx, stmt, store.cache.creationTime, store.cache.NextTargetMsgSeqNum(), store.cache.NextSenderMsgSeqNum(), store.sessionID)
 
 	return err
 }
@@ -151,7 +832,17 @@ func (store *sqlStore) NextTargetMsgSeqNum() int {
 
 // SetNextSenderMsgSeqNum sets the next MsgSeqNum that will be sent
 func (store *sqlStore) SetNextSenderMsgSeqNum(next int) error {
-	_, err := store.db.Exec(fmt.Sprintf(`UPDATE %ssessions SET outgoing_seqnum = ? WHERE session_id=?`, store.sqlTableNamePrefix), next, store.sessionID)
+	return store.SetNextSenderMsgSeqNumContext(context.Background(), next)
+}
+
+// SetNextSenderMsgSeqNumContext is like SetNextSenderMsgSeqNum, but the database operation is bounded by ctx
+func (store *sqlStore) SetNextSenderMsgSeqNumContext(ctx context.Context, next int) (err error) {
+	defer store.observe("set_next_sender_seqnum", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	err = store.upsertSession(ctx, store.cache.CreationTime(), store.cache.NextTargetMsgSeqNum(), next, "outgoing_seqnum")
 	if err != nil {
 		return err
 	}
@@ -160,7 +851,17 @@ func (store *sqlStore) SetNextSenderMsgSeqNum(next int) error {
 
 // SetNextTargetMsgSeqNum sets the next MsgSeqNum that should be received
 func (store *sqlStore) SetNextTargetMsgSeqNum(next int) error {
-	_, err := store.db.Exec(fmt.Sprintf(`UPDATE %ssessions SET incoming_seqnum = ? WHERE session_id=?`, store.sqlTableNamePrefix), next, store.sessionID)
+	return store.SetNextTargetMsgSeqNumContext(context.Background(), next)
+}
+
+// SetNextTargetMsgSeqNumContext is like SetNextTargetMsgSeqNum, but the database operation is bounded by ctx
+func (store *sqlStore) SetNextTargetMsgSeqNumContext(ctx context.Context, next int) (err error) {
+	defer store.observe("set_next_target_seqnum", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	err = store.upsertSession(ctx, store.cache.CreationTime(), next, store.cache.NextSenderMsgSeqNum(), "incoming_seqnum")
 	if err != nil {
 		return err
 	}
@@ -169,14 +870,24 @@ func (store *sqlStore) SetNextTargetMsgSeqNum(next int) error {
 
 // IncrNextSenderMsgSeqNum increments the next MsgSeqNum that will be sent
 func (store *sqlStore) IncrNextSenderMsgSeqNum() error {
+	return store.IncrNextSenderMsgSeqNumContext(context.Background())
+}
+
+// IncrNextSenderMsgSeqNumContext is like IncrNextSenderMsgSeqNum, but the database operation is bounded by ctx
+func (store *sqlStore) IncrNextSenderMsgSeqNumContext(ctx context.Context) error {
 	store.cache.IncrNextSenderMsgSeqNum()
-	return store.SetNextSenderMsgSeqNum(store.cache.NextSenderMsgSeqNum())
+	return store.SetNextSenderMsgSeqNumContext(ctx, store.cache.NextSenderMsgSeqNum())
 }
 
 // IncrNextTargetMsgSeqNum increments the next MsgSeqNum that should be received
 func (store *sqlStore) IncrNextTargetMsgSeqNum() error {
+	return store.IncrNextTargetMsgSeqNumContext(context.Background())
+}
+
+// IncrNextTargetMsgSeqNumContext is like IncrNextTargetMsgSeqNum, but the database operation is bounded by ctx
+func (store *sqlStore) IncrNextTargetMsgSeqNumContext(ctx context.Context) error {
 	store.cache.IncrNextTargetMsgSeqNum()
-	return store.SetNextTargetMsgSeqNum(store.cache.NextTargetMsgSeqNum())
+	return store.SetNextTargetMsgSeqNumContext(ctx, store.cache.NextTargetMsgSeqNum())
 }
 
 // CreationTime returns the creation time of the store
@@ -184,25 +895,502 @@ func (store *sqlStore) CreationTime() time.Time {
 	return store.cache.CreationTime()
 }
 
+// SetCreationTime sets the creation time of the session
+func (store *sqlStore) SetCreationTime(t time.Time) error {
+	return store.SetCreationTimeContext(context.Background(), t)
+}
+
+// SetCreationTimeContext is like SetCreationTime, but the database operation is bounded by ctx
+func (store *sqlStore) SetCreationTimeContext(ctx context.Context, t time.Time) (err error) {
+	defer store.observe("set_creation_time", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	err = store.upsertSession(ctx, t, store.cache.NextTargetMsgSeqNum(), store.cache.NextSenderMsgSeqNum(), "creation_time")
+	if err != nil {
+		return err
+	}
+	return store.cache.SetCreationTime(t)
+}
+
 func (store *sqlStore) SaveMessage(seqNum int, msg []byte) error {
-	_, err := store.db.Exec(fmt.Sprintf(`INSERT INTO %smessages (msgseqnum, message, session_id) VALUES(?, ?, ?)`, store.sqlTableNamePrefix), seqNum, string(msg), store.sessionID)
-	return err
+	return store.SaveMessageContext(context.Background(), seqNum, msg)
+}
+
+// SaveMessageContext is like SaveMessage, but the database operation is bounded by ctx
+func (store *sqlStore) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) error {
+	return store.SaveMessageWithDirectionContext(ctx, seqNum, msg, MessageOutgoing)
+}
+
+// SaveMessageWithDirection is like SaveMessage, but records the given direction under SQLStoreRecordMessageDetails
+func (store *sqlStore) SaveMessageWithDirection(seqNum int, msg []byte, direction MessageDirection) error {
+	return store.SaveMessageWithDirectionContext(context.Background(), seqNum, msg, direction)
+}
+
+// SaveMessageWithDirectionContext is like SaveMessageWithDirection, but the database operation is bounded by ctx
+func (store *sqlStore) SaveMessageWithDirectionContext(ctx context.Context, seqNum int, msg []byte, direction MessageDirection) error {
+	return store.SaveMessageWithMetaContext(ctx, seqNum, msg, MessageMeta{Direction: direction})
+}
+
+// SaveMessageWithMeta is like SaveMessage, but records meta under SQLStoreRecordMessageDetails
+func (store *sqlStore) SaveMessageWithMeta(seqNum int, msg []byte, meta MessageMeta) error {
+	return store.SaveMessageWithMetaContext(context.Background(), seqNum, msg, meta)
+}
+
+// SaveMessageWithMetaContext is like SaveMessageWithMeta, but the database operation is bounded by ctx
+func (store *sqlStore) SaveMessageWithMetaContext(ctx context.Context, seqNum int, msg []byte, meta MessageMeta) (err error) {
+	defer store.observeSeqNum("save_message", seqNum, time.Now(), &err)
+
+	if meta.Direction == "" {
+		meta.Direction = MessageOutgoing
+	}
+	if meta.Direction != MessageOutgoing && !store.messageDetails {
+		return fmt.Errorf("recording incoming messages requires %s", SQLStoreRecordMessageDetails)
+	}
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	var row []interface{}
+	row, err = store.messageRowWithMeta(seqNum, msg, meta)
+	if err != nil {
+		return err
+	}
+	// in lease mode, the message is inserted under the locked session row so that a standby cannot write it
+	return store.withInsertRetry(ctx, meta.Direction, []SeqMsg{{SeqNum: seqNum, Msg: msg}}, func() error {
+		return store.withLease(ctx, func(db sqlExecer) error {
+			_, err := db.ExecContext(ctx, store.insertMessagesSQL(1), row...)
+			return err
+		})
+	})
+}
+
+// messageColumns returns the columns written for each message, in the order of the values returned by messageRow
+func (store *sqlStore) messageColumns() []string {
+	columns := []string{"msgseqnum", "message", "session_id"}
+	if store.partitionBy == sqlPartitionBySessionDate {
+		columns = append(columns, "session_date")
+	}
+	if store.archiveOnReset {
+		columns = append(columns, "reset_generation")
+	}
+	if store.messageDetails {
+		columns = append(columns, "direction", "stored_at")
+	}
+	return columns
+}
+
+// messageKeyColumns returns the columns of the messages table primary key, which partitioned tables must extend with the
+// partition key, archiving tables with the reset generation, and tables recording incoming messages with the direction
+func (store *sqlStore) messageKeyColumns() []string {
+	columns := []string{"session_id", "msgseqnum"}
+	if store.partitionBy == sqlPartitionBySessionDate {
+		columns = append(columns, "session_date")
+	}
+	if store.archiveOnReset {
+		columns = append(columns, "reset_generation")
+	}
+	if store.messageDetails {
+		columns = append(columns, "direction")
+	}
+	return columns
+}
+
+// messageRow returns the statement arguments for an outgoing message
+func (store *sqlStore) messageRow(seqNum int, msg []byte) ([]interface{}, error) {
+	return store.messageRowWithMeta(seqNum, msg, MessageMeta{Direction: MessageOutgoing})
+}
+
+// messageRowWithMeta returns the statement arguments for a message, converting msg to the type matching the message column
+// and serializing, compressing and encrypting it as configured
+func (store *sqlStore) messageRowWithMeta(seqNum int, msg []byte, meta MessageMeta) ([]interface{}, error) {
+	storedAt := meta.StoredAt
+	if storedAt.IsZero() && (store.messageDetails || store.serializer != nil) {
+		storedAt = store.cache.now()
+	}
+
+	var message interface{} = string(msg)
+	if store.binaryMessages {
+		if store.serializer != nil {
+			var err error
+			record := MessageRecord{SessionID: store.sessionID, SeqNum: seqNum, Direction: meta.Direction, StoredAt: storedAt, Msg: msg}
+			if msg, err = encodeRecord(store.serializer, record); err != nil {
+				return nil, err
+			}
+		}
+		if store.compressMessages {
+			msg = compressMessage(msg)
+		}
+		if store.keyProvider != nil {
+			var err error
+			if msg, err = encryptMessage(store.keyProvider, msg); err != nil {
+				return nil, err
+			}
+		}
+		message = msg
+	}
+
+	row := []interface{}{seqNum, message, store.sessionID}
+	if store.partitionBy == sqlPartitionBySessionDate {
+		row = append(row, store.sessionDate())
+	}
+	if store.archiveOnReset {
+		row = append(row, store.resetGeneration)
+	}
+	if store.messageDetails {
+		row = append(row, string(meta.Direction), storedAt.UTC())
+	}
+	return row, nil
+}
+
+// insertMessagesSQL returns a statement inserting rows messages that resolves seqnum conflicts according to the store's DuplicateMessagePolicy.
+// A SQLStoreStatementInsertMessage replacement is returned as is, and only ever asked for a single row.
+func (store *sqlStore) insertMessagesSQL(rows int) string {
+	if stmt, ok := store.statements[SQLStoreStatementInsertMessage]; ok {
+		return stmt
+	}
+
+	keyColumns := store.messageKeyColumns()
+	columns := store.messageColumns()
+
+	switch store.duplicatePolicy {
+	case DuplicateMessageReplace:
+		return store.dialect.rebind(store.dialect.upsert(store.messagesTable, keyColumns, columns, []string{"message"}, rows))
+	case DuplicateMessageIgnore:
+		return store.dialect.rebind(store.dialect.upsert(store.messagesTable, keyColumns, columns, nil, rows))
+	}
+	return store.sqlf(`INSERT INTO %s (%s) VALUES%s`, store.messagesTable, strings.Join(columns, ", "), valuesList(len(columns), rows))
+}
+
+// SaveMessages saves a batch of messages in a single transaction, using multi-row inserts where the dialect allows
+func (store *sqlStore) SaveMessages(msgs []SeqMsg) error {
+	return store.SaveMessagesContext(context.Background(), msgs)
+}
+
+// SaveMessagesContext is like SaveMessages, but the database operations are bounded by ctx
+func (store *sqlStore) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) (err error) {
+	defer store.observe("save_messages", time.Now(), &err)
+
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	return store.withInsertRetry(ctx, MessageOutgoing, msgs, func() error { return store.saveMessagesTx(ctx, msgs) })
+}
+
+func (store *sqlStore) saveMessagesTx(ctx context.Context, msgs []SeqMsg) error {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if store.leaseTTL > 0 {
+		if err := store.updateLeasedSession(ctx, tx, false, nil, nil); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	rowsPerInsert := store.dialect.maxParams / len(store.messageColumns())
+	if _, ok := store.statements[SQLStoreStatementInsertMessage]; ok {
+		rowsPerInsert = 1
+	} else if rowsPerInsert > sqlMaxBatchRows {
+		rowsPerInsert = sqlMaxBatchRows
+	} else if rowsPerInsert < 1 {
+		rowsPerInsert = 1
+	}
+
+	for len(msgs) > 0 {
+		n := rowsPerInsert
+		if n > len(msgs) {
+			n = len(msgs)
+		}
+
+		var args []interface{}
+		for _, m := range msgs[:n] {
+			row, err := store.messageRow(m.SeqNum, m.Msg)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			args = append(args, row...)
+		}
+
+		if _, err := tx.ExecContext(ctx, store.insertMessagesSQL(n), args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+		msgs = msgs[n:]
+	}
+
+	return tx.Commit()
 }
 
 func (store *sqlStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
-	var msgs [][]byte
-	rows, err := store.db.Query(fmt.Sprintf(`SELECT message FROM %smessages WHERE session_id=? AND msgseqnum>=? AND msgseqnum<=? ORDER BY msgseqnum`, store.sqlTableNamePrefix), store.sessionID, beginSeqNum, endSeqNum)
+	return store.GetMessagesContext(context.Background(), beginSeqNum, endSeqNum)
+}
+
+// GetMessagesContext is like GetMessages, but the database operation is bounded by ctx
+func (store *sqlStore) GetMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int) (msgs [][]byte, err error) {
+	defer store.observe("get_messages", time.Now(), &err)
+
+	err = store.iterateMessagesRetried(ctx, beginSeqNum, endSeqNum, func(_ int, msg []byte) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	return msgs, err
+}
+
+// GetMessagesSince returns the messages stored for seqnums after seqNum, see GetMessagesAfter
+func (store *sqlStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return GetMessagesAfter(store, seqNum)
+}
+
+// GetMessagesDescending returns the messages in the range most recent first, see GetMessagesReversed
+func (store *sqlStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return GetMessagesReversed(store, beginSeqNum, endSeqNum)
+}
+
+// GetMessage returns the outgoing message stored for seqNum, reporting whether there is one
+func (store *sqlStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return store.GetMessageContext(context.Background(), seqNum)
+}
+
+// GetMessageContext is like GetMessage, but the database operation is bounded by ctx
+func (store *sqlStore) GetMessageContext(ctx context.Context, seqNum int) (msg []byte, found bool, err error) {
+	defer store.observeSeqNum("get_message", seqNum, time.Now(), &err)
+
+	err = store.iterateMessagesRetried(ctx, seqNum, seqNum, func(_ int, m []byte) error {
+		msg, found = m, true
+		return nil
+	})
+	return msg, found, err
+}
+
+// errStopIteration ends iterateMessages when the caller's function fails, and is never retried
+var errStopIteration = errors.New("iteration stopped")
+
+// IterateMessages calls fn with each message in the range in seqnum order, reading them from the open cursor one at a time
+// rather than holding them all in memory.  Iteration stops at the first error fn returns, which is returned.
+func (store *sqlStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.IterateMessagesContext(context.Background(), beginSeqNum, endSeqNum, fn)
+}
+
+// IterateMessagesContext is like IterateMessages, but the whole iteration is bounded by ctx
+func (store *sqlStore) IterateMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	var fnErr error
+	err := store.iterateMessagesObserved(ctx, beginSeqNum, endSeqNum, func(seqNum int, msg []byte) error {
+		fnErr = fn(seqNum, msg)
+		return fnErr
+	})
+	// the error of fn is the caller's own, so is returned as it is rather than in a StoreError
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+// iterateMessagesObserved is IterateMessagesContext, observed and with its errors wrapped in a StoreError
+func (store *sqlStore) iterateMessagesObserved(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) (err error) {
+	defer store.observe("iterate_messages", time.Now(), &err)
+
+	return store.iterateMessagesRetried(ctx, beginSeqNum, endSeqNum, fn)
+}
+
+// StreamMessages streams the messages in the range in seqnum order, see StreamMessageStore
+func (store *sqlStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+// iterateMessagesRetried runs iterateMessages under the retry policy
+func (store *sqlStore) iterateMessagesRetried(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	// a retried query resumes after the last message fn was given
+	next := beginSeqNum
+	var fnErr error
+	err := store.withRetry(ctx, func() error {
+		return store.iterateMessages(ctx, next, endSeqNum, func(seqNum int, msg []byte) error {
+			if fnErr = fn(seqNum, msg); fnErr != nil {
+				return errStopIteration
+			}
+			next = seqNum + 1
+			return nil
+		})
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+// currentMessages returns the condition, and its arguments, restricting a query of the session's messages to those
+// GetMessages reads: the outgoing messages of the current reset generation and, when partitioned by session date, of
+// the current session date
+func (store *sqlStore) currentMessages() (condition string, args []interface{}) {
+	if store.partitionBy == sqlPartitionBySessionDate {
+		// restricting on the partition key lets postgres prune every other day's partition
+		condition += ` AND session_date=?`
+		args = append(args, store.sessionDate())
+	}
+	if store.archiveOnReset {
+		condition += ` AND reset_generation=?`
+		args = append(args, store.resetGeneration)
+	}
+	if store.messageDetails {
+		condition += ` AND direction=?`
+		args = append(args, string(MessageOutgoing))
+	}
+	return condition, args
+}
+
+func (store *sqlStore) iterateMessages(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	condition, args := store.currentMessages()
+	query := `SELECT msgseqnum, message FROM %s WHERE session_id=? AND msgseqnum>=? AND msgseqnum<=?` + condition + ` ORDER BY msgseqnum`
+	args = append([]interface{}{store.sessionID, beginSeqNum, endSeqNum}, args...)
+
+	rows, err := store.db.QueryContext(ctx, store.statement(SQLStoreStatementSelectMessages, store.sqlf(query, store.messagesTable)), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var seqNum int
+		var message []byte
+		if err := rows.Scan(&seqNum, &message); err != nil {
+			return err
+		}
+		if message, err = store.decodeMessage(message); err != nil {
+			return err
+		}
+		if err := fn(seqNum, message); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// GetMessagesByTime returns the messages of either direction stored in [from, to), oldest first.
+// It requires SQLStoreRecordMessageDetails, and searches every reset generation of the session.
+func (store *sqlStore) GetMessagesByTime(from, to time.Time) ([]StoredMessage, error) {
+	return store.GetMessagesByTimeContext(context.Background(), from, to)
+}
+
+// GetMessagesByTimeContext is like GetMessagesByTime, but the database operation is bounded by ctx
+func (store *sqlStore) GetMessagesByTimeContext(ctx context.Context, from, to time.Time) (msgs []StoredMessage, err error) {
+	defer store.observe("get_messages_by_time", time.Now(), &err)
+
+	if !store.messageDetails {
+		return nil, fmt.Errorf("querying messages by time requires %s", SQLStoreRecordMessageDetails)
+	}
+	return store.getStoredMessagesRetried(ctx, MessageFilter{From: from, To: to})
+}
+
+// GetStoredMessages returns the messages of the session selected by filter, ordered by store time and then seqnum.
+// It requires SQLStoreRecordMessageDetails, and searches every reset generation of the session.
+func (store *sqlStore) GetStoredMessages(filter MessageFilter) ([]StoredMessage, error) {
+	return store.GetStoredMessagesContext(context.Background(), filter)
+}
+
+// GetStoredMessagesContext is like GetStoredMessages, but the database operation is bounded by ctx
+func (store *sqlStore) GetStoredMessagesContext(ctx context.Context, filter MessageFilter) (msgs []StoredMessage, err error) {
+	defer store.observe("get_stored_messages", time.Now(), &err)
+
+	if !store.messageDetails {
+		return nil, fmt.Errorf("querying stored messages requires %s", SQLStoreRecordMessageDetails)
+	}
+	return store.getStoredMessagesRetried(ctx, filter)
+}
+
+func (store *sqlStore) getStoredMessagesRetried(ctx context.Context, filter MessageFilter) (msgs []StoredMessage, err error) {
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	err = store.withRetry(ctx, func() (err error) {
+		msgs, err = store.getStoredMessages(ctx, filter)
+		return err
+	})
+	return msgs, err
+}
+
+// LastSeqNumStoredBefore returns the highest seqnum of the messages of direction stored before t, see MessageTimeStats.
+// It requires SQLStoreRecordMessageDetails, and searches every reset generation of the session.
+func (store *sqlStore) LastSeqNumStoredBefore(direction MessageDirection, t time.Time) (int, error) {
+	return store.LastSeqNumStoredBeforeContext(context.Background(), direction, t)
+}
+
+// LastSeqNumStoredBeforeContext is like LastSeqNumStoredBefore, but the database operation is bounded by ctx
+func (store *sqlStore) LastSeqNumStoredBeforeContext(ctx context.Context, direction MessageDirection, t time.Time) (seqNum int, err error) {
+	defer store.observe("last_seqnum_stored_before", time.Now(), &err)
+
+	if !store.messageDetails {
+		return 0, fmt.Errorf("querying stored messages requires %s", SQLStoreRecordMessageDetails)
+	}
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	conditions, args := store.storedMessagesConditions(MessageFilter{Direction: direction, To: t})
+	var last sql.NullInt64
+	err = store.withRetry(ctx, func() error {
+		return store.db.QueryRowContext(ctx, store.sqlf(`SELECT MAX(msgseqnum) FROM %s WHERE %s`, store.messagesTable, conditions), args...).Scan(&last)
+	})
+	return int(last.Int64), err
+}
+
+// storedMessagesConditions returns the WHERE conditions selecting the messages of filter, with their args
+func (store *sqlStore) storedMessagesConditions(filter MessageFilter) (string, []interface{}) {
+	conditions := "session_id=?"
+	args := []interface{}{store.sessionID}
+	if filter.Direction != "" {
+		conditions += " AND direction=?"
+		args = append(args, string(filter.Direction))
+	}
+	if !filter.From.IsZero() {
+		conditions += " AND stored_at>=?"
+		args = append(args, filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		conditions += " AND stored_at<?"
+		args = append(args, filter.To.UTC())
+	}
+	if filter.BeginSeqNum > 0 {
+		conditions += " AND msgseqnum>=?"
+		args = append(args, filter.BeginSeqNum)
+	}
+	if filter.EndSeqNum > 0 {
+		conditions += " AND msgseqnum<=?"
+		args = append(args, filter.EndSeqNum)
+	}
+	return conditions, args
+}
+
+func (store *sqlStore) getStoredMessages(ctx context.Context, filter MessageFilter) ([]StoredMessage, error) {
+	conditions, args := store.storedMessagesConditions(filter)
+	rows, err := store.db.QueryContext(ctx, store.sqlf(`SELECT msgseqnum, direction, stored_at, message FROM %s WHERE %s ORDER BY stored_at, msgseqnum`, store.messagesTable, conditions), args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	var msgs []StoredMessage
 	for rows.Next() {
-		var message string
-		if err := rows.Scan(&message); err != nil {
+		var m StoredMessage
+		var direction string
+		if err := rows.Scan(&m.SeqNum, &direction, &m.StoredAt, &m.Msg); err != nil {
 			return nil, err
 		}
-		msgs = append(msgs, []byte(message))
+		if m.Msg, err = store.decodeMessage(m.Msg); err != nil {
+			return nil, err
+		}
+		m.Direction = MessageDirection(direction)
+		msgs = append(msgs, m)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -212,11 +1400,31 @@ func (store *sqlStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error)
 	return msgs, nil
 }
 
-// Close closes the store's database connection
-func (store *sqlStore) Close() error {
+// Backup writes the session to w as a portable archive, see BackupMessageStore
+func (store *sqlStore) Backup(w io.Writer) error {
+	return BackupMessageStore(store, w)
+}
+
+// Restore resets the session and restores into it an archive written by Backup, see RestoreMessageStore
+func (store *sqlStore) Restore(r io.Reader) error {
+	return RestoreMessageStore(store, r)
+}
+
+// Flush does nothing, as every write is committed before it returns
+func (store *sqlStore) Flush() error {
+	return nil
+}
+
+// Close releases the store's database connection, closing the pool once no other store from the factory is using it.
+// In lease mode the session lease is released first.
+func (store *sqlStore) Close() (err error) {
 	if store.db != nil {
-		store.db.Close()
+		store.stopPruningAndWait()
+		if store.leaseTTL > 0 {
+			err = store.ReleaseLease()
+		}
+		store.releaseDB()
 		store.db = nil
 	}
-	return nil
+	return err
 }
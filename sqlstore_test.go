@@ -1,7 +1,9 @@
 package msgstore
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -11,6 +13,7 @@ import (
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
@@ -19,6 +22,7 @@ import (
 type SQLStoreTestSuite struct {
 	MessageStoreTestSuite
 	sqlStoreRootPath string
+	factory          MessageStoreFactory
 }
 
 func (suite *SQLStoreTestSuite) SetupTest() {
@@ -45,7 +49,8 @@ func (suite *SQLStoreTestSuite) SetupTest() {
 	settings := map[string]string{SQLStoreDriver: sqlDriver, SQLStoreDataSourceName: sqlDsn, SQLStoreConnMaxLifetime: "14400s"}
 
 	// create store
-	suite.msgStore, err = NewSQLStoreFactory(settings).Create(sessionID)
+	suite.factory = NewSQLStoreFactory(settings)
+	suite.msgStore, err = suite.factory.Create(sessionID)
 	require.Nil(suite.T(), err)
 }
 
@@ -54,6 +59,647 @@ func (suite *SQLStoreTestSuite) TearDownTest() {
 	os.RemoveAll(suite.sqlStoreRootPath)
 }
 
+func (suite *SQLStoreTestSuite) TestSQLStore_Context() {
+	t := suite.T()
+	ctxStore, ok := suite.msgStore.(ContextMessageStore)
+	require.True(t, ok)
+
+	// When an operation is issued with a live context
+	require.Nil(t, ctxStore.SaveMessageContext(context.Background(), 1, []byte("hello")))
+
+	// Then it should succeed
+	msgs, err := ctxStore.GetMessagesContext(context.Background(), 1, 1)
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+
+	// When an operation is issued with a cancelled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Then it should fail without touching the store
+	assert.NotNil(t, ctxStore.SaveMessageContext(ctx, 2, []byte("world")))
+	assert.NotNil(t, ctxStore.SetNextSenderMsgSeqNumContext(ctx, 10))
+	assert.Equal(t, 1, suite.msgStore.NextSenderMsgSeqNum())
+}
+
+func (suite *SQLStoreTestSuite) TestSQLStore_SaveMessages() {
+	t := suite.T()
+	batchSaver, ok := suite.msgStore.(MessageBatchSaver)
+	require.True(t, ok)
+
+	// Given a batch larger than a single multi-row insert
+	var batch []SeqMsg
+	for seqNum := 1; seqNum <= 2*sqlMaxBatchRows+1; seqNum++ {
+		batch = append(batch, SeqMsg{SeqNum: seqNum, Msg: []byte(fmt.Sprintf("msg %d", seqNum))})
+	}
+
+	// When the batch is saved
+	require.Nil(t, batchSaver.SaveMessages(batch))
+
+	// Then every message should be retrievable in order
+	msgs, err := suite.msgStore.GetMessages(1, len(batch))
+	require.Nil(t, err)
+	require.Len(t, msgs, len(batch))
+	for i, m := range batch {
+		assert.Equal(t, string(m.Msg), string(msgs[i]))
+	}
+
+	// When a batch conflicts with an existing message
+	err = batchSaver.SaveMessages([]SeqMsg{{SeqNum: len(batch) + 1, Msg: []byte("new")}, {SeqNum: 1, Msg: []byte("dup")}})
+
+	// Then nothing from the batch should be saved
+	require.NotNil(t, err)
+	msgs, err = suite.msgStore.GetMessages(len(batch)+1, len(batch)+1)
+	require.Nil(t, err)
+	assert.Empty(t, msgs)
+}
+
+func (suite *SQLStoreTestSuite) TestSQLStore_SetNextMsgSeqNum_MissingSessionRow() {
+	t := suite.T()
+	store := suite.msgStore.(*sqlStore)
+
+	// Given the session row has been deleted out-of-band
+	_, err := store.db.Exec(`DELETE FROM sessions`)
+	require.Nil(t, err)
+
+	// When the seqnums are set
+	require.Nil(t, suite.msgStore.SetNextSenderMsgSeqNum(42))
+	require.Nil(t, suite.msgStore.SetNextTargetMsgSeqNum(24))
+
+	// Then the session row should have been recreated with them
+	require.Nil(t, suite.msgStore.Refresh())
+	assert.Equal(t, 42, suite.msgStore.NextSenderMsgSeqNum())
+	assert.Equal(t, 24, suite.msgStore.NextTargetMsgSeqNum())
+}
+
+func (suite *SQLStoreTestSuite) TestSQLStoreFactory_SharedDB() {
+	t := suite.T()
+
+	// When another session is created from the same factory
+	other, err := suite.factory.Create("FIX.4.4-OTHER-TARGET")
+	require.Nil(t, err)
+
+	// Then both stores should share one connection pool
+	db := suite.msgStore.(*sqlStore).db
+	assert.True(t, db == other.(*sqlStore).db)
+
+	// When one of the stores is closed
+	require.Nil(t, other.Close())
+
+	// Then the pool should remain usable by the other
+	require.Nil(t, db.Ping())
+	require.Nil(t, suite.msgStore.SaveMessage(1, []byte("hello")))
+
+	// When the last store is closed
+	require.Nil(t, suite.msgStore.Close())
+
+	// Then the pool should be closed
+	assert.NotNil(t, db.Ping())
+}
+
+func (suite *SQLStoreTestSuite) TestSQLStore_DuplicateMessagePolicy() {
+	t := suite.T()
+	store := suite.msgStore.(*sqlStore)
+
+	var testCases = []struct {
+		policy      DuplicateMessagePolicy
+		expectErr   bool
+		expectedMsg string
+	}{
+		{policy: DuplicateMessageError, expectErr: true, expectedMsg: "first"},
+		{policy: DuplicateMessageReplace, expectErr: false, expectedMsg: "second"},
+		{policy: DuplicateMessageIgnore, expectErr: false, expectedMsg: "first"},
+	}
+
+	for _, tc := range testCases {
+		require.Nil(t, suite.msgStore.Reset())
+		store.duplicatePolicy = tc.policy
+
+		// Given a saved message
+		require.Nil(t, suite.msgStore.SaveMessage(1, []byte("first")))
+
+		// When another message is saved with the same seqnum, singly and in a batch
+		err := suite.msgStore.SaveMessage(1, []byte("second"))
+		assert.Equal(t, tc.expectErr, err != nil, string(tc.policy))
+		err = store.SaveMessages([]SeqMsg{{SeqNum: 1, Msg: []byte("second")}, {SeqNum: 2, Msg: []byte("other")}})
+		assert.Equal(t, tc.expectErr, err != nil, string(tc.policy))
+
+		// Then the stored message should follow the policy
+		msgs, err := suite.msgStore.GetMessages(1, 1)
+		require.Nil(t, err)
+		require.Len(t, msgs, 1)
+		assert.Equal(t, tc.expectedMsg, string(msgs[0]), string(tc.policy))
+	}
+}
+
 func TestSqlStoreTestSuite(t *testing.T) {
 	suite.Run(t, new(SQLStoreTestSuite))
 }
+
+func TestSQLStore_BinaryMessages(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreBinaryMessages-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	settings := map[string]string{
+		SQLStoreDriver:            "sqlite3",
+		SQLStoreDataSourceName:    path.Join(rootPath, "binary.db"),
+		SQLStoreAutoMigrate:       "Y",
+		SQLStoreMessageColumnType: "binary",
+	}
+	store, err := NewSQLStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Given a message that is not valid text
+	msg := []byte{'8', '=', 0x00, 0xff, 0xfe, 0x01, '\x01'}
+	require.Nil(t, store.SaveMessage(1, msg))
+
+	// Then it should be returned byte for byte
+	msgs, err := store.GetMessages(1, 1)
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, msg, msgs[0])
+}
+
+func TestSQLStore_ArchiveOnReset(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreArchiveOnReset-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	settings := map[string]string{
+		SQLStoreDriver:         "sqlite3",
+		SQLStoreDataSourceName: path.Join(rootPath, "archive.db"),
+		SQLStoreAutoMigrate:    "Y",
+		SQLStoreResetMode:      "archive",
+	}
+	store, err := NewSQLStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Given messages saved before a reset
+	require.Nil(t, store.SaveMessage(1, []byte("hello")))
+	require.Nil(t, store.SaveMessage(2, []byte("world")))
+
+	// When the store is reset
+	require.Nil(t, store.Reset())
+
+	// Then the old messages should be hidden
+	msgs, err := store.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Empty(t, msgs)
+
+	// And the seqnums can be reused
+	require.Nil(t, store.SaveMessage(1, []byte("again")))
+	msgs, err = store.GetMessages(1, 2)
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "again", string(msgs[0]))
+
+	// And a refreshed store should stay on the new generation
+	require.Nil(t, store.Refresh())
+	msgs, err = store.GetMessages(1, 2)
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+
+	// And nothing should have been deleted
+	db, err := sql.Open("sqlite3", settings[SQLStoreDataSourceName])
+	require.Nil(t, err)
+	defer db.Close()
+	var count int
+	require.Nil(t, db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&count))
+	assert.Equal(t, 3, count)
+}
+
+func TestSQLStore_ResetWithoutDeletingMessages(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreResetWithoutDeletingMessages-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	settings := map[string]string{
+		SQLStoreDriver:         "sqlite3",
+		SQLStoreDataSourceName: path.Join(rootPath, "resetwithoutdeleting.db"),
+		SQLStoreAutoMigrate:    "Y",
+	}
+	store, err := NewSQLStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+
+	// Given a store that deletes its messages on reset
+	// Then it should refuse to reset without deleting them
+	require.Nil(t, store.SaveMessage(1, []byte("hello")))
+	assert.NotNil(t, store.(SeqNumResetter).ResetWithoutDeletingMessages())
+	msgs, err := store.GetMessages(1, 1)
+	require.Nil(t, err)
+	assert.Len(t, msgs, 1)
+	store.Close()
+
+	// Given a store that archives its messages on reset
+	settings[SQLStoreResetMode] = "archive"
+	settings[SQLStoreDataSourceName] = path.Join(rootPath, "resetwithoutdeleting_archive.db")
+	store, err = NewSQLStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+	require.Nil(t, store.SaveMessage(1, []byte("hello")))
+	require.Nil(t, store.SetNextSenderMsgSeqNum(2))
+
+	// When it is reset without deleting its messages
+	require.Nil(t, store.(SeqNumResetter).ResetWithoutDeletingMessages())
+
+	// Then the seqnums should be back to 1 and the old message hidden, but kept
+	assert.Equal(t, 1, store.NextSenderMsgSeqNum())
+	msgs, err = store.GetMessages(1, 1)
+	require.Nil(t, err)
+	assert.Empty(t, msgs)
+	db, err := sql.Open("sqlite3", settings[SQLStoreDataSourceName])
+	require.Nil(t, err)
+	defer db.Close()
+	var count int
+	require.Nil(t, db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&count))
+	assert.Equal(t, 1, count)
+}
+
+func TestSQLStore_TablePerSession(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreTablePerSession-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	settings := map[string]string{
+		SQLStoreDriver:          "sqlite3",
+		SQLStoreDataSourceName:  path.Join(rootPath, "tablepersession.db"),
+		SQLStoreAutoMigrate:     "Y",
+		SQLStoreTablePerSession: "Y",
+	}
+	factory := NewSQLStoreFactory(settings)
+	store1, err := factory.Create("FIX.4.4-SENDER-TARGET1")
+	require.Nil(t, err)
+	defer store1.Close()
+	store2, err := factory.Create("FIX.4.4-SENDER-TARGET2")
+	require.Nil(t, err)
+	defer store2.Close()
+
+	// Given a message saved by each session
+	require.Nil(t, store1.SaveMessage(1, []byte("one")))
+	require.Nil(t, store2.SaveMessage(1, []byte("two")))
+
+	// Then each session should only see its own message
+	msgs, err := store1.GetMessages(1, 1)
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "one", string(msgs[0]))
+
+	// And each message should be in its session's table
+	db, err := sql.Open("sqlite3", settings[SQLStoreDataSourceName])
+	require.Nil(t, err)
+	defer db.Close()
+	var message string
+	require.Nil(t, db.QueryRow(`SELECT message FROM messages_fix_4_4_sender_target2`).Scan(&message))
+	assert.Equal(t, "two", message)
+
+	// And table per session cannot be combined with partitioning
+	settings[SQLStorePartitionBy] = sqlPartitionBySessionID
+	settings[SQLStoreDialect] = "postgres"
+	_, err = NewSQLStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET1")
+	assert.NotNil(t, err)
+}
+
+func TestSQLStore_SchemaName(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreSchemaName-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	// Given a store whose tables are qualified with sqlite's main schema
+	store, err := NewSQLStoreFactory(map[string]string{
+		SQLStoreDriver:          "sqlite3",
+		SQLStoreDataSourceName:  path.Join(rootPath, "schemaname.db"),
+		SQLStoreAutoMigrate:     "Y",
+		SQLStoreTableNamePrefix: "fix_",
+		SQLStoreSchemaName:      "main",
+	}).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Then every table reference should carry the schema
+	sqlStore := store.(*sqlStore)
+	assert.Equal(t, `"main"."fix_sessions"`, sqlStore.sessionsTable)
+	assert.Equal(t, `"main"."fix_messages"`, sqlStore.messagesTable)
+	assert.Equal(t, `"main"."fix_schema_version"`, sqlStore.schemaVersionTable)
+
+	// And the store should work against the qualified tables
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	require.Nil(t, store.Refresh())
+	assert.Equal(t, 2, store.NextSenderMsgSeqNum())
+	msgs, err := store.GetMessages(1, 1)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("one")}, msgs)
+}
+
+func TestSQLStoreFactory_FromDB(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreFromDB-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	// Given a connection pool managed by the application
+	db, err := sql.Open("sqlite3", path.Join(rootPath, "fromdb.db"))
+	require.Nil(t, err)
+	defer db.Close()
+	assert.Equal(t, "sqlite3", sqlDriverName(db))
+
+	// When a store is created and closed with it
+	factory := NewSQLStoreFactoryFromDB(db, WithSQLStoreSettings(map[string]string{SQLStoreAutoMigrate: "Y"}))
+	store, err := factory.Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessage(1, []byte("hello")))
+	require.Nil(t, store.Close())
+
+	// Then the pool should still be open for the application
+	require.Nil(t, db.Ping())
+	var count int
+	require.Nil(t, db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&count))
+	assert.Equal(t, 1, count)
+}
+
+func TestSQLStoreFactory_SettingsOption(t *testing.T) {
+	// Given the caller's settings, and none at all
+	settings := map[string]string{SQLStoreDriver: "sqlite3"}
+
+	// When factories are given more settings as an option
+	f := NewSQLStoreFactory(settings, WithSQLStoreSettings(map[string]string{SQLStoreAutoMigrate: "Y"})).(*sqlStoreFactory)
+	nilFactory := NewSQLStoreFactory(nil, WithSQLStoreSettings(map[string]string{SQLStoreAutoMigrate: "Y"})).(*sqlStoreFactory)
+
+	// Then the factories should hold them, leaving the caller's map untouched
+	assert.Equal(t, "Y", f.settings[SQLStoreAutoMigrate])
+	assert.Equal(t, "sqlite3", f.settings[SQLStoreDriver])
+	assert.Equal(t, map[string]string{SQLStoreDriver: "sqlite3"}, settings)
+	assert.Equal(t, "Y", nilFactory.settings[SQLStoreAutoMigrate])
+}
+
+func TestSQLStore_StatementOverrides(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreStatementOverrides-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	// Given messages kept in a table of the application's own design
+	dsn := path.Join(rootPath, "overrides.db")
+	db, err := sql.Open("sqlite3", dsn)
+	require.Nil(t, err)
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE fix_log (sid VARCHAR(128), seq INT, body TEXT)`)
+	require.Nil(t, err)
+
+	settings := map[string]string{
+		SQLStoreDriver:                  "sqlite3",
+		SQLStoreDataSourceName:          dsn,
+		SQLStoreAutoMigrate:             "Y",
+		SQLStoreStatementInsertMessage:  `INSERT INTO fix_log (seq, body, sid) VALUES(?, ?, ?)`,
+		SQLStoreStatementSelectMessages: `SELECT seq, body FROM fix_log WHERE sid=? AND seq BETWEEN ? AND ? ORDER BY seq`,
+	}
+	store, err := NewSQLStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// When messages are saved
+	require.Nil(t, store.SaveMessage(1, []byte("hello")))
+	require.Nil(t, store.(MessageBatchSaver).SaveMessages([]SeqMsg{{SeqNum: 2, Msg: []byte("cruel")}, {SeqNum: 3, Msg: []byte("world")}}))
+
+	// Then they should be written and read through the replacement statements
+	msgs, err := store.GetMessages(1, 3)
+	require.Nil(t, err)
+	require.Len(t, msgs, 3)
+	assert.Equal(t, "world", string(msgs[2]))
+
+	var count int
+	require.Nil(t, db.QueryRow(`SELECT COUNT(*) FROM fix_log`).Scan(&count))
+	assert.Equal(t, 3, count)
+}
+
+func TestSQLStoreFactory_StatementOverridesRebound(t *testing.T) {
+	f := NewSQLStoreFactory(map[string]string{
+		SQLStoreDriver:                  "postgres",
+		SQLStoreDataSourceName:          "",
+		SQLStoreStatementDeleteMessages: `SELECT archive_messages(?)`,
+	}).(*sqlStoreFactory)
+
+	config, err := f.parseSettings()
+	require.Nil(t, err)
+	assert.Equal(t, `SELECT archive_messages($1)`, config.statements[SQLStoreStatementDeleteMessages])
+}
+
+func TestSQLStore_RecordMessageDetails(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreMessageDetails-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	settings := map[string]string{
+		SQLStoreDriver:               "sqlite3",
+		SQLStoreDataSourceName:       path.Join(rootPath, "details.db"),
+		SQLStoreAutoMigrate:          "Y",
+		SQLStoreRecordMessageDetails: "Y",
+	}
+	store, err := NewSQLStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+	timed, ok := store.(TimedMessageStore)
+	require.True(t, ok)
+
+	// Given a sent and a received message with the same seqnum
+	before := time.Now()
+	require.Nil(t, store.SaveMessage(1, []byte("sent")))
+	require.Nil(t, timed.SaveMessageWithDirection(1, []byte("received"), MessageIncoming))
+	after := time.Now().Add(time.Second)
+
+	// Then only the sent message should be available for resend
+	msgs, err := store.GetMessages(1, 1)
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "sent", string(msgs[0]))
+
+	// And both should be found by time
+	stored, err := timed.GetMessagesByTime(before, after)
+	require.Nil(t, err)
+	require.Len(t, stored, 2)
+	assert.Equal(t, MessageOutgoing, stored[0].Direction)
+	assert.Equal(t, MessageIncoming, stored[1].Direction)
+	assert.Equal(t, "received", string(stored[1].Msg))
+
+	// And nothing should be found outside the window
+	stored, err = timed.GetMessagesByTime(after, after.Add(time.Hour))
+	require.Nil(t, err)
+	assert.Empty(t, stored)
+}
+
+func TestSQLStore_SaveMessageWithMeta(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreMessageMeta-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	settings := map[string]string{
+		SQLStoreDriver:               "sqlite3",
+		SQLStoreDataSourceName:       path.Join(rootPath, "meta.db"),
+		SQLStoreAutoMigrate:          "Y",
+		SQLStoreRecordMessageDetails: "Y",
+	}
+	store, err := NewSQLStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+	metaStore, ok := store.(MessageMetaStore)
+	require.True(t, ok)
+
+	// Given messages saved with their direction and the time they were sent or received
+	sentAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.Nil(t, metaStore.SaveMessageWithMeta(1, []byte("sent"), MessageMeta{StoredAt: sentAt}))
+	require.Nil(t, metaStore.SaveMessageWithMeta(1, []byte("received"), MessageMeta{Direction: MessageIncoming, StoredAt: sentAt.Add(time.Second)}))
+	require.Nil(t, metaStore.SaveMessageWithMeta(2, []byte("received later"), MessageMeta{Direction: MessageIncoming}))
+
+	// When the incoming messages are selected
+	stored, err := metaStore.GetStoredMessages(MessageFilter{Direction: MessageIncoming})
+	require.Nil(t, err)
+
+	// Then both should be found in store time order, with their times
+	require.Len(t, stored, 2)
+	assert.Equal(t, "received", string(stored[0].Msg))
+	assert.True(t, sentAt.Add(time.Second).Equal(stored[0].StoredAt))
+	assert.Equal(t, "received later", string(stored[1].Msg))
+
+	// And filters should combine
+	stored, err = metaStore.GetStoredMessages(MessageFilter{To: sentAt.Add(time.Hour), BeginSeqNum: 1, EndSeqNum: 1})
+	require.Nil(t, err)
+	require.Len(t, stored, 2)
+	assert.Equal(t, MessageOutgoing, stored[0].Direction)
+	assert.Equal(t, MessageIncoming, stored[1].Direction)
+}
+
+func TestSQLStoreFactory_ListSessions(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreListSessions-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	factory := NewSQLStoreFactory(map[string]string{
+		SQLStoreDriver:         "sqlite3",
+		SQLStoreDataSourceName: path.Join(rootPath, "list.db"),
+		SQLStoreAutoMigrate:    "Y",
+	})
+
+	// Given two sessions, one with messages
+	first, err := factory.Create("FIX.4.4-FIRST-TARGET")
+	require.Nil(t, err)
+	defer first.Close()
+	require.Nil(t, first.SaveMessage(1, []byte("hello")))
+	require.Nil(t, first.SetNextTargetMsgSeqNum(4))
+	second, err := factory.Create("FIX.4.4-SECOND-TARGET")
+	require.Nil(t, err)
+	defer second.Close()
+
+	// When the factory lists the sessions
+	infos, err := factory.(SessionLister).ListSessions()
+	require.Nil(t, err)
+
+	// Then both should be listed in order, as stored
+	require.Len(t, infos, 2)
+	assert.Equal(t, "FIX.4.4-FIRST-TARGET", infos[0].SessionID)
+	assert.Equal(t, 4, infos[0].NextTargetMsgSeqNum)
+	assert.Equal(t, int64(1), infos[0].MessageCount)
+	assert.Equal(t, "FIX.4.4-SECOND-TARGET", infos[1].SessionID)
+	assert.Equal(t, int64(0), infos[1].MessageCount)
+}
+
+func (suite *SQLStoreTestSuite) TestSQLStore_IterateMessages() {
+	t := suite.T()
+	iterator, ok := suite.msgStore.(MessageIterator)
+	require.True(t, ok)
+
+	// Given three saved messages
+	for seqNum := 1; seqNum <= 3; seqNum++ {
+		require.Nil(t, suite.msgStore.SaveMessage(seqNum, []byte(fmt.Sprintf("msg %d", seqNum))))
+	}
+
+	// When they are iterated
+	var seqNums []int
+	err := iterator.IterateMessages(1, 3, func(seqNum int, msg []byte) error {
+		assert.Equal(t, fmt.Sprintf("msg %d", seqNum), string(msg))
+		seqNums = append(seqNums, seqNum)
+		return nil
+	})
+
+	// Then each should be given in order
+	require.Nil(t, err)
+	assert.Equal(t, []int{1, 2, 3}, seqNums)
+
+	// And an error from the callback should stop the iteration and be returned
+	stop := errors.New("stop")
+	seqNums = nil
+	err = iterator.IterateMessages(1, 3, func(seqNum int, msg []byte) error {
+		seqNums = append(seqNums, seqNum)
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, []int{1}, seqNums)
+}
+
+func TestSQLStoreFactory_Close(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreFactoryClose-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	settings := map[string]string{
+		SQLStoreDriver:         "sqlite3",
+		SQLStoreDataSourceName: path.Join(rootPath, "close.db"),
+		SQLStoreAutoMigrate:    "Y",
+	}
+	factory := NewSQLStoreFactory(settings)
+	store, err := factory.Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+
+	// When the factory is closed while one of its stores is open
+	require.Nil(t, factory.Close())
+
+	// Then it should create no more stores
+	_, err = factory.Create("FIX.4.4-OTHER-TARGET")
+	assert.Equal(t, ErrFactoryClosed, err)
+
+	// And the open store should keep its connection pool until it is closed
+	require.Nil(t, store.SaveMessage(1, []byte("hello")))
+	require.Nil(t, store.Close())
+	assert.Empty(t, factory.(*sqlStoreFactory).dbs)
+}
+
+func TestSQLStoreFactory_RenameSession(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreFactoryRenameSession-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	settings := map[string]string{
+		SQLStoreDriver:         "sqlite3",
+		SQLStoreDataSourceName: path.Join(rootPath, "rename.db"),
+		SQLStoreAutoMigrate:    "Y",
+	}
+	factory := NewSQLStoreFactory(settings)
+	defer factory.Close()
+
+	// Given a session with messages and a session value
+	store, err := factory.Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessage(1, []byte("hello")))
+	require.Nil(t, store.SetNextSenderMsgSeqNum(2))
+	require.Nil(t, store.(SessionValueStore).SetSessionValue("key", "value"))
+	require.Nil(t, store.Close())
+
+	// When it is renamed
+	require.Nil(t, factory.(SessionRenamer).RenameSession("FIX.4.4-SENDER-TARGET", "FIX.4.4-SENDER-NEWTARGET"))
+
+	// Then its state should be stored under the new sessionID
+	renamed, err := factory.Create("FIX.4.4-SENDER-NEWTARGET")
+	require.Nil(t, err)
+	defer renamed.Close()
+	assert.Equal(t, 2, renamed.NextSenderMsgSeqNum())
+	msgs, err := renamed.GetMessages(1, 1)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("hello")}, msgs)
+	value, ok, err := renamed.(SessionValueStore).GetSessionValue("key")
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "value", value)
+
+	// And renaming it again onto a stored session should fail
+	assert.NotNil(t, factory.(SessionRenamer).RenameSession("FIX.4.4-SENDER-TARGET", "FIX.4.4-SENDER-NEWTARGET"))
+}
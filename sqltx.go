@@ -0,0 +1,113 @@
+package msgstore
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// sqlStoreTx is a StoreTx in a database transaction
+type sqlStoreTx struct {
+	store      *sqlStore
+	ctx        context.Context
+	tx         *sql.Tx
+	nextSender int
+	nextTarget int
+	done       bool
+}
+
+// BeginTx starts a database transaction, see StoreTx
+func (store *sqlStore) BeginTx() (StoreTx, error) {
+	return store.BeginTxContext(context.Background())
+}
+
+// BeginTxContext is like BeginTx, but the database transaction is bounded by ctx, and each of its statements by the query
+// timeout
+func (store *sqlStore) BeginTxContext(ctx context.Context) (_ StoreTx, err error) {
+	defer store.observe("begin_tx", time.Now(), &err)
+
+	var tx *sql.Tx
+	err = store.withRetry(ctx, func() (err error) {
+		tx, err = store.db.BeginTx(ctx, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStoreTx{store: store, ctx: ctx, tx: tx, nextSender: store.cache.NextSenderMsgSeqNum(), nextTarget: store.cache.NextTargetMsgSeqNum()}, nil
+}
+
+func (t *sqlStoreTx) SaveMessage(seqNum int, msg []byte) (err error) {
+	defer t.store.observeSeqNum("save_message", seqNum, time.Now(), &err)
+
+	if t.done {
+		return ErrTxDone
+	}
+	ctx, cancel := t.store.withTimeout(t.ctx)
+	defer cancel()
+
+	row, err := t.store.messageRow(seqNum, msg)
+	if err != nil {
+		return err
+	}
+	if t.store.leaseTTL > 0 {
+		if err := t.store.updateLeasedSession(ctx, t.tx, false, nil, nil); err != nil {
+			return err
+		}
+	}
+	_, err = t.tx.ExecContext(ctx, t.store.insertMessagesSQL(1), row...)
+	return err
+}
+
+func (t *sqlStoreTx) SetNextSenderMsgSeqNum(next int) (err error) {
+	defer t.store.observe("set_next_sender_seqnum", time.Now(), &err)
+
+	return t.setSeqNums(t.nextTarget, next, "outgoing_seqnum")
+}
+
+func (t *sqlStoreTx) SetNextTargetMsgSeqNum(next int) (err error) {
+	defer t.store.observe("set_next_target_seqnum", time.Now(), &err)
+
+	return t.setSeqNums(next, t.nextSender, "incoming_seqnum")
+}
+
+// setSeqNums writes the seqnums of the session row in the transaction
+func (t *sqlStoreTx) setSeqNums(nextTarget, nextSender int, updateColumn string) error {
+	if t.done {
+		return ErrTxDone
+	}
+	ctx, cancel := t.store.withTimeout(t.ctx)
+	defer cancel()
+
+	if err := t.store.writeSession(ctx, t.tx, t.store.cache.CreationTime(), nextTarget, nextSender, updateColumn); err != nil {
+		return err
+	}
+	t.nextTarget, t.nextSender = nextTarget, nextSender
+	return nil
+}
+
+// Commit commits the database transaction, and then updates the store's seqnums
+func (t *sqlStoreTx) Commit() (err error) {
+	defer t.store.observe("commit_tx", time.Now(), &err)
+
+	if t.done {
+		return ErrTxDone
+	}
+	t.done = true
+
+	if err := t.tx.Commit(); err != nil {
+		return err
+	}
+	t.store.cache.SetNextSenderMsgSeqNum(t.nextSender)
+	return t.store.cache.SetNextTargetMsgSeqNum(t.nextTarget)
+}
+
+func (t *sqlStoreTx) Rollback() (err error) {
+	if t.done {
+		return ErrTxDone
+	}
+	defer t.store.observe("rollback_tx", time.Now(), &err)
+
+	t.done = true
+	return t.tx.Rollback()
+}
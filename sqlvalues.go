@@ -0,0 +1,52 @@
+package msgstore
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SetSessionValue stores value under key in the session values table, see SessionValueStore
+func (store *sqlStore) SetSessionValue(key, value string) error {
+	return store.SetSessionValueContext(context.Background(), key, value)
+}
+
+// SetSessionValueContext is like SetSessionValue, but the database operation is bounded by ctx
+func (store *sqlStore) SetSessionValueContext(ctx context.Context, key, value string) (err error) {
+	defer store.observe("set_session_value", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	stmt := store.dialect.rebind(store.dialect.upsert(store.sessionValuesTable, []string{"session_id", "name"}, []string{"session_id", "name", "value"}, []string{"value"}, 1))
+	_, err = store.exec(ctx, stmt, store.sessionID, key, value)
+	return err
+}
+
+// GetSessionValue returns the value stored under key, see SessionValueStore
+func (store *sqlStore) GetSessionValue(key string) (string, bool, error) {
+	return store.GetSessionValueContext(context.Background(), key)
+}
+
+// GetSessionValueContext is like GetSessionValue, but the database operation is bounded by ctx
+func (store *sqlStore) GetSessionValueContext(ctx context.Context, key string) (value string, found bool, err error) {
+	defer store.observe("get_session_value", time.Now(), &err)
+
+	ctx, cancel := store.withTimeout(ctx)
+	defer cancel()
+
+	err = store.withRetry(ctx, func() error {
+		row := store.db.QueryRowContext(ctx, store.sqlf(`SELECT value FROM %s WHERE session_id=? AND name=?`, store.sessionValuesTable), store.sessionID, key)
+		switch err := row.Scan(&value); err {
+		case nil:
+			found = true
+			return nil
+		case sql.ErrNoRows:
+			value, found = "", false
+			return nil
+		default:
+			return err
+		}
+	})
+	return value, found, err
+}
@@ -1,8 +1,15 @@
 package msgstore
 
-import "time"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
 
-//The MessageStore interface provides methods to record and retrieve messages for resend purposes
+// The MessageStore interface provides methods to record and retrieve messages for resend purposes
 type MessageStore interface {
 	NextSenderMsgSeqNum() int
 	NextTargetMsgSeqNum() int
@@ -14,25 +21,388 @@ type MessageStore interface {
 	SetNextTargetMsgSeqNum(next int) error
 
 	CreationTime() time.Time
+	// SetCreationTime sets the creation time of the session, e.g. when recovering it from an external source or
+	// synchronizing with a counterparty's reset, without resetting its seqnums or messages
+	SetCreationTime(t time.Time) error
 
 	SaveMessage(seqNum int, msg []byte) error
 	GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error)
+	// GetMessagesSince returns the messages stored for seqnums after seqNum in seqnum order, without the caller having to
+	// know the highest one, see GetMessagesAfter
+	GetMessagesSince(seqNum int) ([][]byte, error)
+	// GetMessagesDescending is like GetMessages, but returns the range most recent first, see GetMessagesReversed
+	GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error)
+	// GetMessage returns the message stored for seqNum, reporting whether there is one
+	GetMessage(seqNum int) (msg []byte, found bool, err error)
+	// IterateMessages calls fn with each message in the range in seqnum order, stopping at the first error fn returns,
+	// which is returned.  Backends stream the range rather than holding it all in memory.
+	IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error
+	// StreamMessages streams the messages in the range in seqnum order, so that a resend can start while the store is
+	// still reading.  The message channel must be drained, after which the error channel yields the failure, if any, or
+	// ctx cancelled to abandon the stream, see StreamMessageStore.
+	StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error)
+	// SaveMessages saves a batch of messages, in a single round trip or sync where the backend allows.  Stores without
+	// native batching can implement it with SaveMessagesIndividually.
+	SaveMessages(msgs []SeqMsg) error
+	// DeleteMessagesUpTo deletes the messages stored for seqnums up to and including seqNum, so that engines can prune
+	// the resend buffer once messages are no longer resendable.  The seqnums are left as they are.
+	DeleteMessagesUpTo(seqNum int) error
+	// BeginTx starts a transaction whose writes are persisted together on Commit, natively where the backend supports
+	// transactions, and otherwise buffered until Commit, see BeginBufferedTx
+	BeginTx() (StoreTx, error)
 
+	// Backup writes the seqnums, creation time and messages of the session to w as a portable, versioned archive that
+	// Restore can restore into a store of any backend, see BackupMessageStore
+	Backup(w io.Writer) error
+	// Restore resets the session and restores into it an archive written by Backup, see RestoreMessageStore
+	Restore(r io.Reader) error
+
+	// HealthCheck verifies that the backend can be reached and the session's records read, without writing anything,
+	// for the liveness probes of engines
+	HealthCheck(ctx context.Context) error
+	// Flush forces any buffered writes of the store to durable storage, so that engines can rely on them at well
+	// defined points such as before sending a Logout or a SequenceReset.  Stores that write synchronously do nothing.
+	Flush() error
 	Refresh() error
 	Reset() error
 
 	Close() error
 }
 
-//The MessageStoreFactory interface is used by session to create a session specific message store
+// SeqMsg pairs a message with its MsgSeqNum for batch operations
+type SeqMsg struct {
+	SeqNum int
+	Msg    []byte
+}
+
+// MessageSaver saves a single message, as MessageStore and StoreTx do
+type MessageSaver interface {
+	SaveMessage(seqNum int, msg []byte) error
+}
+
+// SaveMessagesIndividually saves msgs one SaveMessage at a time, stopping at the first error, for MessageStores
+// without native batching
+func SaveMessagesIndividually(store MessageSaver, msgs []SeqMsg) error {
+	for _, m := range msgs {
+		if err := store.SaveMessage(m.SeqNum, m.Msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetMessagesAfter returns the messages stored for seqnums after seqNum up to the highest stored, which is told by
+// MessageStats where the store implements it, or else by the seqnums sent.  It implements GetMessagesSince for every
+// MessageStore of the package, and is exported for other implementations.
+func GetMessagesAfter(store MessageStore, seqNum int) ([][]byte, error) {
+	lastSeqNum, err := lastMessageSeqNum(store)
+	if err != nil {
+		return nil, err
+	}
+	if lastSeqNum <= seqNum {
+		return nil, nil
+	}
+	return store.GetMessages(seqNum+1, lastSeqNum)
+}
+
+// lastMessageSeqNum returns the highest seqnum a message of store may be stored for, told by MessageStats where the
+// store implements it, or else by the seqnums sent
+func lastMessageSeqNum(store MessageStore) (int, error) {
+	lastSeqNum := store.NextSenderMsgSeqNum() - 1
+	if stats, ok := store.(MessageStats); ok {
+		last, err := stats.LastSeqNum()
+		if err != nil {
+			return 0, err
+		}
+		if last > lastSeqNum {
+			lastSeqNum = last
+		}
+	}
+	return lastSeqNum, nil
+}
+
+// GetMessagesReversed returns the messages of GetMessages most recent first.  It implements GetMessagesDescending for
+// every MessageStore of the package, and is exported for other implementations.
+func GetMessagesReversed(store MessageStore, beginSeqNum, endSeqNum int) ([][]byte, error) {
+	msgs, err := store.GetMessages(beginSeqNum, endSeqNum)
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, err
+}
+
+// DuplicateMessagePolicy determines what SaveMessage does when a message is already stored for the seqnum
+type DuplicateMessagePolicy string
+
+const (
+	// DuplicateMessageError fails the save
+	DuplicateMessageError DuplicateMessagePolicy = "error"
+	// DuplicateMessageReplace overwrites the stored message
+	DuplicateMessageReplace DuplicateMessagePolicy = "replace"
+	// DuplicateMessageIgnore keeps the stored message and reports success
+	DuplicateMessageIgnore DuplicateMessagePolicy = "ignore"
+)
+
+// ErrDuplicateMessage is returned under DuplicateMessageError by stores that detect the duplicate themselves,
+// rather than relying on a database constraint.  It is wrapped in a StoreError, so test for it with errors.Is.
+var ErrDuplicateMessage = errors.New("message already stored for seqnum")
+
+func parseDuplicateMessagePolicy(value string) (DuplicateMessagePolicy, error) {
+	switch policy := DuplicateMessagePolicy(value); policy {
+	case DuplicateMessageError, DuplicateMessageReplace, DuplicateMessageIgnore:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown duplicate message policy: %s", value)
+}
+
+// MessageDirection records whether a stored message was sent or received
+type MessageDirection string
+
+const (
+	// MessageOutgoing marks messages sent by the session, which are the ones GetMessages returns for resend
+	MessageOutgoing MessageDirection = "out"
+	// MessageIncoming marks messages received by the session
+	MessageIncoming MessageDirection = "in"
+)
+
+// StoredMessage is a message along with the details recorded when it was saved
+type StoredMessage struct {
+	SeqNum    int
+	Direction MessageDirection
+	StoredAt  time.Time
+	Msg       []byte
+}
+
+// TimedMessageStore is implemented by MessageStores that record the direction and time of each message
+type TimedMessageStore interface {
+	// SaveMessageWithDirection is like SaveMessage, which saves MessageOutgoing messages
+	SaveMessageWithDirection(seqNum int, msg []byte, direction MessageDirection) error
+	// GetMessagesByTime returns the messages of either direction stored at or after from and before to, oldest first
+	GetMessagesByTime(from, to time.Time) ([]StoredMessage, error)
+}
+
+// MessageMeta is the detail recorded with a message by SaveMessageWithMeta
+type MessageMeta struct {
+	// Direction defaults to MessageOutgoing
+	Direction MessageDirection
+	// StoredAt defaults to the time of the save, and may be set to e.g. the time the message was sent or received
+	StoredAt time.Time
+}
+
+// MessageFilter selects stored messages by their detail.  Zero fields select every message.
+type MessageFilter struct {
+	Direction MessageDirection
+	// From and To bound the store times of the messages to [From, To)
+	From, To time.Time
+	// BeginSeqNum and EndSeqNum bound the seqnums of the messages, inclusively
+	BeginSeqNum, EndSeqNum int
+}
+
+// ErrUnsupported is returned by the methods of an optional interface that a store implements only to forward to
+// another, such as the wrappers of the package, when the store it forwards to does not implement the interface
+var ErrUnsupported = errors.New("operation is not supported by the message store")
+
+// MessageMetaStore is implemented by MessageStores that record the detail of each message, so that the resend buffer
+// of outgoing messages can be told apart from the archive of incoming ones
+type MessageMetaStore interface {
+	// SaveMessageWithMeta is like SaveMessage, recording meta along with the message
+	SaveMessageWithMeta(seqNum int, msg []byte, meta MessageMeta) error
+	// GetStoredMessages returns the messages selected by filter, ordered by store time and then seqnum
+	GetStoredMessages(filter MessageFilter) ([]StoredMessage, error)
+}
+
+// MessageTimeStats is implemented by MessageMetaStores that can tell the messages stored before a time without reading
+// them
+type MessageTimeStats interface {
+	// LastSeqNumStoredBefore returns the highest seqnum of the messages of direction stored before t, or 0 if there are
+	// none
+	LastSeqNumStoredBefore(direction MessageDirection, t time.Time) (int, error)
+}
+
+// MessagePruner is implemented by MessageStores that can delete old messages according to a configured retention
+type MessagePruner interface {
+	// Prune deletes the messages past retention, returning how many were deleted
+	Prune() (int64, error)
+}
+
+// SeqNumResetter is implemented by MessageStores that can reset a session without losing its history, as with FIX
+// ResetSeqNumFlag where the messages must survive the reset
+type SeqNumResetter interface {
+	// ResetWithoutDeletingMessages sets the seqnums back to 1 and renews the creation time like Reset, but keeps the
+	// stored messages tagged with the reset generation they were sent in.  Only the new generation's messages are read.
+	ResetWithoutDeletingMessages() error
+}
+
+// MessageStats is implemented by MessageStores that can describe their stored messages from their indexes, without
+// reading the messages, so that monitoring can report the depth of the resend buffer and detect gaps in it
+type MessageStats interface {
+	// MessageCount returns the number of messages stored
+	MessageCount() (int, error)
+	// FirstSeqNum returns the lowest seqnum a message is stored for, or 0 if none is
+	FirstSeqNum() (int, error)
+	// LastSeqNum returns the highest seqnum a message is stored for, or 0 if none is
+	LastSeqNum() (int, error)
+}
+
+// SessionValueStore is implemented by MessageStores that can persist small values of session state alongside the
+// seqnums, such as the last logon time or the reason for the last reset, so that engines need not keep side files.
+// The values are kept across Reset.
+type SessionValueStore interface {
+	// SetSessionValue stores value under key, replacing any value stored under it
+	SetSessionValue(key, value string) error
+	// GetSessionValue returns the value stored under key, reporting whether there is one
+	GetSessionValue(key string) (value string, found bool, err error)
+}
+
+// HealthChecker is implemented by MessageStores that can report on the health of their backend without modifying it
+type HealthChecker interface {
+	// Ping verifies the backend can be reached
+	Ping() error
+	// Healthy verifies the backend can be reached and holds the schema the store expects
+	Healthy() error
+}
+
+// MessageKeyProvider supplies the data keys that stores encrypt messages with, typically by unwrapping keys with a KMS.
+// Keys are 32 bytes for AES-256.  Stores ask for keys often, so providers should cache them.
+type MessageKeyProvider interface {
+	// CurrentKey returns the ID and plaintext of the key new messages should be encrypted with
+	CurrentKey() (keyID string, key []byte, err error)
+	// Key returns the plaintext of the key with the given ID, to decrypt messages written under it
+	Key(keyID string) ([]byte, error)
+}
+
+// MessageIterator is implemented by every MessageStore, and kept for code asserting it
+type MessageIterator interface {
+	// IterateMessages calls fn with each message in the range in seqnum order, stopping at the first error fn returns
+	IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error
+}
+
+// ErrSessionLeaseHeld is returned by stores holding session leases when another store's lease on the session is live.
+// It is wrapped in a StoreError, so test for it with errors.Is.
+var ErrSessionLeaseHeld = errors.New("session is leased by another store")
+
+// SessionLeaser is implemented by MessageStores that can hold an exclusive, expiring lease on their session,
+// so that of an active/standby pair of engines only the active one can advance the seqnums
+type SessionLeaser interface {
+	// AcquireLease takes the lease if it is free, expired or already held by the store, and reloads the store
+	AcquireLease() error
+	// RenewLease extends the lease held by the store
+	RenewLease() error
+	// TakeoverLease takes the lease even if another store holds it, and reloads the store
+	TakeoverLease() error
+	// ReleaseLease gives up the lease so that a standby can acquire it without waiting for it to expire
+	ReleaseLease() error
+}
+
+// MessageBatchSaver is implemented by every MessageStore, and kept for code asserting it
+type MessageBatchSaver interface {
+	SaveMessages(msgs []SeqMsg) error
+}
+
+// AtomicMessageSaver is implemented by MessageStores that can save an outgoing message and advance the next sender seqnum
+// as a single atomic operation, so that after a crash the stored messages and seqnums cannot disagree
+type AtomicMessageSaver interface {
+	SaveMessageAndIncrNextSenderMsgSeqNum(seqNum int, msg []byte) error
+}
+
+// ContextMessageStore is implemented by MessageStores whose backend operations can be bounded by a caller supplied context
+type ContextMessageStore interface {
+	MessageStore
+
+	IncrNextSenderMsgSeqNumContext(ctx context.Context) error
+	IncrNextTargetMsgSeqNumContext(ctx context.Context) error
+
+	SetNextSenderMsgSeqNumContext(ctx context.Context, next int) error
+	SetNextTargetMsgSeqNumContext(ctx context.Context, next int) error
+
+	SetCreationTimeContext(ctx context.Context, t time.Time) error
+
+	SaveMessageContext(ctx context.Context, seqNum int, msg []byte) error
+	SaveMessagesContext(ctx context.Context, msgs []SeqMsg) error
+	GetMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int) ([][]byte, error)
+	GetMessageContext(ctx context.Context, seqNum int) ([]byte, bool, error)
+	IterateMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error
+	DeleteMessagesUpToContext(ctx context.Context, seqNum int) error
+	// BeginTxContext is like BeginTx, but the operations of the transaction, up to its Commit or Rollback, are bounded
+	// by ctx
+	BeginTxContext(ctx context.Context) (StoreTx, error)
+
+	RefreshContext(ctx context.Context) error
+	ResetContext(ctx context.Context) error
+}
+
+// The MessageStoreFactory interface is used by session to create a session specific message store
 type MessageStoreFactory interface {
 	Create(sessionID string) (MessageStore, error)
+	// Close releases the resources the factory shares between its stores, such as connection pools, at shutdown.  Those
+	// still used by open stores are released as the last of them is closed.  Create fails with ErrFactoryClosed after.
+	Close() error
+}
+
+// ErrFactoryClosed is returned by the Create of a MessageStoreFactory that has been closed
+var ErrFactoryClosed = errors.New("message store factory is closed")
+
+// factoryClosed records that a factory has been closed, shared by the copies of those factories that are passed by value
+type factoryClosed struct {
+	closed int32
+}
+
+func (c *factoryClosed) close() {
+	atomic.StoreInt32(&c.closed, 1)
+}
+
+func (c *factoryClosed) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// SessionInfo describes a session known to a backend
+type SessionInfo struct {
+	SessionID           string
+	CreationTime        time.Time
+	NextSenderMsgSeqNum int
+	NextTargetMsgSeqNum int
+	// MessageCount is the number of messages stored for the session
+	MessageCount int64
+}
+
+// SessionLister is implemented by the MessageStoreFactories of persistent backends, so that operational tooling can
+// enumerate the sessions of a backend without querying it directly
+type SessionLister interface {
+	// ListSessions returns every session known to the backend, ordered by sessionID
+	ListSessions() ([]SessionInfo, error)
+}
+
+// SessionCloner is implemented by the MessageStoreFactories of persistent backends, so that a session can be copied to a
+// new session identity, e.g. when a counterparty renames its comp IDs or to stand up a UAT mirror of a production session
+type SessionCloner interface {
+	// CloneSession copies the seqnums, creation time and messages of the session srcID to the session dstID, replacing
+	// whatever dstID stored
+	CloneSession(srcID, dstID string) error
+}
+
+// SessionRenamer is implemented by the MessageStoreFactories of persistent backends, so that the stored state of a session
+// can be rebound to a new sessionID when a counterparty changes its comp IDs, rather than editing files or rows by hand
+type SessionRenamer interface {
+	// RenameSession moves the seqnums, creation time, messages and values of the session oldID to the session newID.  It
+	// fails if oldID is unknown or newID is already stored, and must not be called while either session has an open store.
+	RenameSession(oldID, newID string) error
 }
 
 type memoryStore struct {
 	senderMsgSeqNum, targetMsgSeqNum int
 	creationTime                     time.Time
 	messageMap                       map[int][]byte
+	sessionValues                    map[string]string
+	clock                            Clock
+
+	// maxMessages bounds messageMap, evicting from lowSeqNum up, which is at or below the lowest seqnum stored
+	maxMessages int
+	lowSeqNum   int
+}
+
+// now returns the time told by the store's clock
+func (store *memoryStore) now() time.Time {
+	return clockNow(store.clock)
 }
 
 func (store *memoryStore) NextSenderMsgSeqNum() int {
@@ -66,10 +436,15 @@ func (store *memoryStore) CreationTime() time.Time {
 	return store.creationTime
 }
 
+func (store *memoryStore) SetCreationTime(t time.Time) error {
+	store.creationTime = t
+	return nil
+}
+
 func (store *memoryStore) Reset() error {
 	store.senderMsgSeqNum = 0
 	store.targetMsgSeqNum = 0
-	store.creationTime = time.Now()
+	store.creationTime = store.now()
 	store.messageMap = nil
 	return nil
 }
@@ -79,6 +454,23 @@ func (store *memoryStore) Refresh() error {
 	return nil
 }
 
+func (store *memoryStore) Backup(w io.Writer) error {
+	return BackupMessageStore(store, w)
+}
+
+func (store *memoryStore) Restore(r io.Reader) error {
+	return RestoreMessageStore(store, r)
+}
+
+func (store *memoryStore) HealthCheck(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (store *memoryStore) Flush() error {
+	//nop, nothing to flush
+	return nil
+}
+
 func (store *memoryStore) Close() error {
 	//nop, nothing to close
 	return nil
@@ -89,10 +481,34 @@ func (store *memoryStore) SaveMessage(seqNum int, msg []byte) error {
 		store.messageMap = make(map[int][]byte)
 	}
 
+	if len(store.messageMap) == 0 || seqNum < store.lowSeqNum {
+		store.lowSeqNum = seqNum
+	}
 	store.messageMap[seqNum] = msg
+	store.evictMessages()
 	return nil
 }
 
+// evictMessages deletes the lowest seqnum messages until the store holds no more than its maximum, if it has one
+func (store *memoryStore) evictMessages() {
+	if store.maxMessages <= 0 {
+		return
+	}
+	for len(store.messageMap) > store.maxMessages {
+		for {
+			if _, ok := store.messageMap[store.lowSeqNum]; ok {
+				break
+			}
+			store.lowSeqNum++
+		}
+		delete(store.messageMap, store.lowSeqNum)
+	}
+}
+
+func (store *memoryStore) SaveMessages(msgs []SeqMsg) error {
+	return SaveMessagesIndividually(store, msgs)
+}
+
 func (store *memoryStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
 	var msgs [][]byte
 	for seqNum := beginSeqNum; seqNum <= endSeqNum; seqNum++ {
@@ -103,13 +519,137 @@ func (store *memoryStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, err
 	return msgs, nil
 }
 
-type memoryStoreFactory struct{}
+// GetMessagesSince returns the messages stored for seqnums after seqNum, see GetMessagesAfter
+func (store *memoryStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return GetMessagesAfter(store, seqNum)
+}
+
+// GetMessagesDescending returns the messages in the range most recent first, see GetMessagesReversed
+func (store *memoryStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return GetMessagesReversed(store, beginSeqNum, endSeqNum)
+}
+
+func (store *memoryStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	for seqNum := beginSeqNum; seqNum <= endSeqNum; seqNum++ {
+		if m, ok := store.messageMap[seqNum]; ok {
+			if err := fn(seqNum, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StreamMessages streams the messages in the range in seqnum order, see StreamMessageStore.  The range is copied
+// before the stream starts, so that the store can be written to while it is read.
+func (store *memoryStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	snapshot := &memoryStore{messageMap: make(map[int][]byte)}
+	for seqNum, msg := range store.messageMap {
+		if seqNum >= beginSeqNum && seqNum <= endSeqNum {
+			snapshot.messageMap[seqNum] = msg
+		}
+	}
+	return StreamMessageStore(ctx, snapshot, beginSeqNum, endSeqNum)
+}
+
+// BeginTx starts a transaction buffered until Commit, see BeginBufferedTx
+func (store *memoryStore) BeginTx() (StoreTx, error) {
+	return BeginBufferedTx(store), nil
+}
+
+func (store *memoryStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	m, ok := store.messageMap[seqNum]
+	return m, ok, nil
+}
+
+func (store *memoryStore) SetSessionValue(key, value string) error {
+	if store.sessionValues == nil {
+		store.sessionValues = make(map[string]string)
+	}
+
+	store.sessionValues[key] = value
+	return nil
+}
+
+func (store *memoryStore) GetSessionValue(key string) (string, bool, error) {
+	value, ok := store.sessionValues[key]
+	return value, ok, nil
+}
+
+func (store *memoryStore) MessageCount() (int, error) {
+	return len(store.messageMap), nil
+}
+
+func (store *memoryStore) FirstSeqNum() (int, error) {
+	first := 0
+	for seqNum := range store.messageMap {
+		if first == 0 || seqNum < first {
+			first = seqNum
+		}
+	}
+	return first, nil
+}
+
+func (store *memoryStore) LastSeqNum() (int, error) {
+	last := 0
+	for seqNum := range store.messageMap {
+		if seqNum > last {
+			last = seqNum
+		}
+	}
+	return last, nil
+}
+
+func (store *memoryStore) DeleteMessagesUpTo(seqNum int) error {
+	for n := range store.messageMap {
+		if n <= seqNum {
+			delete(store.messageMap, n)
+		}
+	}
+	return nil
+}
+
+type memoryStoreFactory struct {
+	clock       Clock
+	maxMessages int
+	closed      *factoryClosed
+}
+
+// Close only makes Create fail, as the memory stores share nothing
+func (f memoryStoreFactory) Close() error {
+	f.closed.close()
+	return nil
+}
 
 func (f memoryStoreFactory) Create(sessionID string) (MessageStore, error) {
-	m := new(memoryStore)
+	if f.closed.isClosed() {
+		return nil, ErrFactoryClosed
+	}
+	m := &memoryStore{clock: f.clock, maxMessages: f.maxMessages}
 	m.Reset()
 	return m, nil
 }
 
-//NewMemoryStoreFactory returns a MessageStoreFactory instance that created in-memory MessageStores
-func NewMemoryStoreFactory() MessageStoreFactory { return memoryStoreFactory{} }
+// MemoryStoreOption configures optional behavior of the stores created by a memory MessageStoreFactory
+type MemoryStoreOption func(*memoryStoreFactory)
+
+// WithMemoryClock stamps the creation time of the stores with the time told by clock.  Defaults to the system clock.
+func WithMemoryClock(clock Clock) MemoryStoreOption {
+	return func(f *memoryStoreFactory) { f.clock = clock }
+}
+
+// WithMemoryMaxMessages bounds each store to the max most recent messages, evicting the lowest seqnums as new messages
+// are saved, so that long-running sessions that need no durability keep a fixed resend window.  Resend requests beyond
+// it are gap filled.  Defaults to keeping every message.
+func WithMemoryMaxMessages(max int) MemoryStoreOption {
+	return func(f *memoryStoreFactory) { f.maxMessages = max }
+}
+
+// NewMemoryStoreFactory returns a MessageStoreFactory instance that created in-memory MessageStores
+func NewMemoryStoreFactory(opts ...MemoryStoreOption) MessageStoreFactory {
+	f := memoryStoreFactory{closed: &factoryClosed{}}
+	for _, opt := range opts {
+		opt(&f)
+	}
+	return f
+}
@@ -0,0 +1,264 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrSeqNumOverflow is returned when a 64-bit seqnum is passed to a store whose int cannot hold it, as on 32-bit platforms
+var ErrSeqNumOverflow = errors.New("seqnum overflows int")
+
+// MessageStore64 is MessageStore with 64-bit seqnums, for counterparties and long-lived sessions whose seqnums may
+// outgrow int on 32-bit platforms.  It matches the 19 digits the file store writes seqnums with.
+type MessageStore64 interface {
+	NextSenderMsgSeqNum() int64
+	NextTargetMsgSeqNum() int64
+
+	IncrNextSenderMsgSeqNum() error
+	IncrNextTargetMsgSeqNum() error
+
+	SetNextSenderMsgSeqNum(next int64) error
+	SetNextTargetMsgSeqNum(next int64) error
+
+	CreationTime() time.Time
+	SetCreationTime(t time.Time) error
+
+	SaveMessage(seqNum int64, msg []byte) error
+	SaveMessages(msgs []SeqMsg64) error
+	GetMessages(beginSeqNum, endSeqNum int64) ([][]byte, error)
+	GetMessagesSince(seqNum int64) ([][]byte, error)
+	GetMessagesDescending(beginSeqNum, endSeqNum int64) ([][]byte, error)
+	GetMessage(seqNum int64) (msg []byte, found bool, err error)
+	IterateMessages(beginSeqNum, endSeqNum int64, fn func(seqNum int64, msg []byte) error) error
+	DeleteMessagesUpTo(seqNum int64) error
+
+	Backup(w io.Writer) error
+	Restore(r io.Reader) error
+
+	HealthCheck(ctx context.Context) error
+	Flush() error
+	Refresh() error
+	Reset() error
+
+	Close() error
+}
+
+// SeqMsg64 pairs a message with its 64-bit MsgSeqNum for batch operations
+type SeqMsg64 struct {
+	SeqNum int64
+	Msg    []byte
+}
+
+// AdaptMessageStoreTo64 returns store as a MessageStore64.  Seqnums that the store's int cannot hold fail with
+// ErrSeqNumOverflow, except for the ends of ranges, which are clamped so that the range is read as far as it can be.
+func AdaptMessageStoreTo64(store MessageStore) MessageStore64 {
+	if s, ok := store.(messageStoreFrom64); ok {
+		return s.store
+	}
+	return messageStoreTo64{store}
+}
+
+// AdaptMessageStoreFrom64 returns store as a MessageStore for engines still on int seqnums.  Its seqnum accessors
+// truncate seqnums that int cannot hold, so on 32-bit platforms such sessions must use the MessageStore64.
+func AdaptMessageStoreFrom64(store MessageStore64) MessageStore {
+	if s, ok := store.(messageStoreTo64); ok {
+		return s.store
+	}
+	return messageStoreFrom64{store}
+}
+
+const (
+	maxInt = int(^uint(0) >> 1)
+	minInt = -maxInt - 1
+)
+
+// seqNumToInt converts a 64-bit seqnum, failing if int cannot hold it
+func seqNumToInt(seqNum int64) (int, error) {
+	if seqNum > int64(maxInt) || seqNum < int64(minInt) {
+		return 0, ErrSeqNumOverflow
+	}
+	return int(seqNum), nil
+}
+
+// clampSeqNum converts a 64-bit seqnum to the nearest int
+func clampSeqNum(seqNum int64) int {
+	if seqNum > int64(maxInt) {
+		return maxInt
+	} else if seqNum < int64(minInt) {
+		return minInt
+	}
+	return int(seqNum)
+}
+
+// messageStoreTo64 adapts a MessageStore for the MessageStore64 interface
+type messageStoreTo64 struct {
+	store MessageStore
+}
+
+func (s messageStoreTo64) NextSenderMsgSeqNum() int64        { return int64(s.store.NextSenderMsgSeqNum()) }
+func (s messageStoreTo64) NextTargetMsgSeqNum() int64        { return int64(s.store.NextTargetMsgSeqNum()) }
+func (s messageStoreTo64) IncrNextSenderMsgSeqNum() error    { return s.store.IncrNextSenderMsgSeqNum() }
+func (s messageStoreTo64) IncrNextTargetMsgSeqNum() error    { return s.store.IncrNextTargetMsgSeqNum() }
+func (s messageStoreTo64) CreationTime() time.Time           { return s.store.CreationTime() }
+func (s messageStoreTo64) SetCreationTime(t time.Time) error { return s.store.SetCreationTime(t) }
+func (s messageStoreTo64) Flush() error                      { return s.store.Flush() }
+func (s messageStoreTo64) Refresh() error                    { return s.store.Refresh() }
+func (s messageStoreTo64) Reset() error                      { return s.store.Reset() }
+func (s messageStoreTo64) Close() error                      { return s.store.Close() }
+
+func (s messageStoreTo64) Backup(w io.Writer) error  { return s.store.Backup(w) }
+func (s messageStoreTo64) Restore(r io.Reader) error { return s.store.Restore(r) }
+
+func (s messageStoreTo64) HealthCheck(ctx context.Context) error {
+	return s.store.HealthCheck(ctx)
+}
+
+func (s messageStoreTo64) SetNextSenderMsgSeqNum(next int64) error {
+	n, err := seqNumToInt(next)
+	if err != nil {
+		return err
+	}
+	return s.store.SetNextSenderMsgSeqNum(n)
+}
+
+func (s messageStoreTo64) SetNextTargetMsgSeqNum(next int64) error {
+	n, err := seqNumToInt(next)
+	if err != nil {
+		return err
+	}
+	return s.store.SetNextTargetMsgSeqNum(n)
+}
+
+func (s messageStoreTo64) SaveMessage(seqNum int64, msg []byte) error {
+	n, err := seqNumToInt(seqNum)
+	if err != nil {
+		return err
+	}
+	return s.store.SaveMessage(n, msg)
+}
+
+func (s messageStoreTo64) SaveMessages(msgs []SeqMsg64) error {
+	converted := make([]SeqMsg, len(msgs))
+	for i, m := range msgs {
+		n, err := seqNumToInt(m.SeqNum)
+		if err != nil {
+			return err
+		}
+		converted[i] = SeqMsg{SeqNum: n, Msg: m.Msg}
+	}
+	return s.store.SaveMessages(converted)
+}
+
+func (s messageStoreTo64) GetMessages(beginSeqNum, endSeqNum int64) ([][]byte, error) {
+	return s.store.GetMessages(clampSeqNum(beginSeqNum), clampSeqNum(endSeqNum))
+}
+
+func (s messageStoreTo64) GetMessagesSince(seqNum int64) ([][]byte, error) {
+	return s.store.GetMessagesSince(clampSeqNum(seqNum))
+}
+
+func (s messageStoreTo64) GetMessagesDescending(beginSeqNum, endSeqNum int64) ([][]byte, error) {
+	return s.store.GetMessagesDescending(clampSeqNum(beginSeqNum), clampSeqNum(endSeqNum))
+}
+
+func (s messageStoreTo64) GetMessage(seqNum int64) ([]byte, bool, error) {
+	n, err := seqNumToInt(seqNum)
+	if err != nil {
+		// no message can be stored for a seqnum the store cannot hold
+		return nil, false, nil
+	}
+	return s.store.GetMessage(n)
+}
+
+func (s messageStoreTo64) IterateMessages(beginSeqNum, endSeqNum int64, fn func(seqNum int64, msg []byte) error) error {
+	return s.store.IterateMessages(clampSeqNum(beginSeqNum), clampSeqNum(endSeqNum), func(seqNum int, msg []byte) error {
+		return fn(int64(seqNum), msg)
+	})
+}
+
+func (s messageStoreTo64) DeleteMessagesUpTo(seqNum int64) error {
+	return s.store.DeleteMessagesUpTo(clampSeqNum(seqNum))
+}
+
+// messageStoreFrom64 adapts a MessageStore64 for the MessageStore interface
+type messageStoreFrom64 struct {
+	store MessageStore64
+}
+
+func (s messageStoreFrom64) NextSenderMsgSeqNum() int          { return int(s.store.NextSenderMsgSeqNum()) }
+func (s messageStoreFrom64) NextTargetMsgSeqNum() int          { return int(s.store.NextTargetMsgSeqNum()) }
+func (s messageStoreFrom64) IncrNextSenderMsgSeqNum() error    { return s.store.IncrNextSenderMsgSeqNum() }
+func (s messageStoreFrom64) IncrNextTargetMsgSeqNum() error    { return s.store.IncrNextTargetMsgSeqNum() }
+func (s messageStoreFrom64) CreationTime() time.Time           { return s.store.CreationTime() }
+func (s messageStoreFrom64) SetCreationTime(t time.Time) error { return s.store.SetCreationTime(t) }
+func (s messageStoreFrom64) Flush() error                      { return s.store.Flush() }
+func (s messageStoreFrom64) Refresh() error                    { return s.store.Refresh() }
+func (s messageStoreFrom64) Reset() error                      { return s.store.Reset() }
+func (s messageStoreFrom64) Close() error                      { return s.store.Close() }
+
+func (s messageStoreFrom64) Backup(w io.Writer) error  { return s.store.Backup(w) }
+func (s messageStoreFrom64) Restore(r io.Reader) error { return s.store.Restore(r) }
+
+func (s messageStoreFrom64) HealthCheck(ctx context.Context) error {
+	return s.store.HealthCheck(ctx)
+}
+
+func (s messageStoreFrom64) SetNextSenderMsgSeqNum(next int) error {
+	return s.store.SetNextSenderMsgSeqNum(int64(next))
+}
+
+func (s messageStoreFrom64) SetNextTargetMsgSeqNum(next int) error {
+	return s.store.SetNextTargetMsgSeqNum(int64(next))
+}
+
+func (s messageStoreFrom64) SaveMessage(seqNum int, msg []byte) error {
+	return s.store.SaveMessage(int64(seqNum), msg)
+}
+
+func (s messageStoreFrom64) SaveMessages(msgs []SeqMsg) error {
+	converted := make([]SeqMsg64, len(msgs))
+	for i, m := range msgs {
+		converted[i] = SeqMsg64{SeqNum: int64(m.SeqNum), Msg: m.Msg}
+	}
+	return s.store.SaveMessages(converted)
+}
+
+func (s messageStoreFrom64) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return s.store.GetMessages(int64(beginSeqNum), int64(endSeqNum))
+}
+
+func (s messageStoreFrom64) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return s.store.GetMessagesSince(int64(seqNum))
+}
+
+func (s messageStoreFrom64) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return s.store.GetMessagesDescending(int64(beginSeqNum), int64(endSeqNum))
+}
+
+func (s messageStoreFrom64) GetMessage(seqNum int) ([]byte, bool, error) {
+	return s.store.GetMessage(int64(seqNum))
+}
+
+func (s messageStoreFrom64) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return s.store.IterateMessages(int64(beginSeqNum), int64(endSeqNum), func(seqNum int64, msg []byte) error {
+		n, err := seqNumToInt(seqNum)
+		if err != nil {
+			return err
+		}
+		return fn(n, msg)
+	})
+}
+
+func (s messageStoreFrom64) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, s, beginSeqNum, endSeqNum)
+}
+
+func (s messageStoreFrom64) BeginTx() (StoreTx, error) {
+	return BeginBufferedTx(s), nil
+}
+
+func (s messageStoreFrom64) DeleteMessagesUpTo(seqNum int) error {
+	return s.store.DeleteMessagesUpTo(int64(seqNum))
+}
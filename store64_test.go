@@ -0,0 +1,63 @@
+package msgstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// MessageStore64AdapterTestSuite runs all tests in the MessageStoreTestSuite against a memory store adapted to
+// MessageStore64 and back
+type MessageStore64AdapterTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *MessageStore64AdapterTestSuite) SetupTest() {
+	store, err := NewMemoryStoreFactory().Create("XYZZY")
+	require.Nil(suite.T(), err)
+	// unwrapped, so that the adapters themselves are exercised
+	suite.msgStore = messageStoreFrom64{AdaptMessageStoreTo64(store)}
+}
+
+func TestMessageStore64AdapterTestSuite(t *testing.T) {
+	suite.Run(t, new(MessageStore64AdapterTestSuite))
+}
+
+func TestAdaptMessageStoreTo64(t *testing.T) {
+	// Given a store adapted to MessageStore64
+	memStore, err := NewMemoryStoreFactory().Create("XYZZY")
+	require.Nil(t, err)
+	store := AdaptMessageStoreTo64(memStore)
+
+	// When seqnums are set and messages saved through it
+	require.Nil(t, store.SetNextSenderMsgSeqNum(1<<31))
+	require.Nil(t, store.SaveMessages([]SeqMsg64{{SeqNum: 1 << 31, Msg: []byte("hello")}}))
+
+	// Then they should be read back through it
+	assert.Equal(t, int64(1<<31), store.NextSenderMsgSeqNum())
+	msg, found, err := store.GetMessage(1 << 31)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("hello"), msg)
+
+	// And adapting it back should return the original store
+	assert.Equal(t, memStore, AdaptMessageStoreFrom64(store))
+}
+
+func TestSeqNumConversions(t *testing.T) {
+	assert.Equal(t, maxInt, clampSeqNum(int64(maxInt)))
+	assert.Equal(t, minInt, clampSeqNum(int64(minInt)))
+
+	n, err := seqNumToInt(42)
+	require.Nil(t, err)
+	assert.Equal(t, 42, n)
+
+	if int64(maxInt) < 1<<62 {
+		// 32-bit platforms
+		_, err = seqNumToInt(1 << 40)
+		assert.Equal(t, ErrSeqNumOverflow, err)
+		assert.Equal(t, maxInt, clampSeqNum(1<<40))
+	}
+}
@@ -1,6 +1,11 @@
 package msgstore
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"testing"
 	"time"
 
@@ -82,6 +87,30 @@ func (suite *MessageStoreTestSuite) TestMessageStore_Reset() {
 	assert.Equal(t, 1, suite.msgStore.NextTargetMsgSeqNum())
 }
 
+func (suite *MessageStoreTestSuite) TestMessageStore_Reset_SaveMessage() {
+	t := suite.T()
+
+	// Given a saved message
+	require.Nil(t, suite.msgStore.SaveMessage(1, []byte("before reset")))
+
+	// When the store is reset
+	require.Nil(t, suite.msgStore.Reset())
+
+	// Then the message should be gone
+	msgs, err := suite.msgStore.GetMessages(1, 1)
+	require.Nil(t, err)
+	require.Empty(t, msgs)
+
+	// When the seqnum is reused
+	require.Nil(t, suite.msgStore.SaveMessage(1, []byte("after reset")))
+
+	// Then only the new message should be returned
+	msgs, err = suite.msgStore.GetMessages(1, 1)
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "after reset", string(msgs[0]))
+}
+
 func (suite *MessageStoreTestSuite) TestMessageStore_SaveMessage_GetMessage() {
 	t := suite.T()
 
@@ -128,6 +157,385 @@ func (suite *MessageStoreTestSuite) TestMessageStore_GetMessages_EmptyStore() {
 	require.Empty(suite.T(), messages, "Did not expect messages from empty store")
 }
 
+func (suite *MessageStoreTestSuite) TestMessageStore_GetMessage() {
+	t := suite.T()
+
+	// Given a saved message
+	require.Nil(t, suite.msgStore.SaveMessage(2, []byte("hello")))
+
+	// Then it should be found by its seqnum
+	msg, found, err := suite.msgStore.GetMessage(2)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "hello", string(msg))
+
+	// And other seqnums should find nothing
+	msg, found, err = suite.msgStore.GetMessage(1)
+	require.Nil(t, err)
+	assert.False(t, found)
+	assert.Nil(t, msg)
+}
+
+func (suite *MessageStoreTestSuite) TestMessageStore_SetCreationTime() {
+	t := suite.T()
+
+	// Given a store with seqnums set
+	require.Nil(t, suite.msgStore.SetNextSenderMsgSeqNum(5))
+
+	// When its creation time is set
+	creationTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.Nil(t, suite.msgStore.SetCreationTime(creationTime))
+
+	// Then the creation time should be kept across a refresh, leaving the seqnums as they were
+	require.Nil(t, suite.msgStore.Refresh())
+	assert.True(t, creationTime.Equal(suite.msgStore.CreationTime()))
+	assert.Equal(t, 5, suite.msgStore.NextSenderMsgSeqNum())
+}
+
+func (suite *MessageStoreTestSuite) TestMessageStore_GetMessagesSinceAndDescending() {
+	t := suite.T()
+
+	// Given messages saved for seqnums 1 to 4
+	for seqNum, msg := range []string{"one", "two", "three", "four"} {
+		require.Nil(t, suite.msgStore.SaveMessage(seqNum+1, []byte(msg)))
+	}
+	require.Nil(t, suite.msgStore.SetNextSenderMsgSeqNum(5))
+
+	// When the messages after seqnum 2 are read
+	msgs, err := suite.msgStore.GetMessagesSince(2)
+
+	// Then they should be returned in seqnum order
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("three"), []byte("four")}, msgs)
+
+	// And none should be returned after the last
+	msgs, err = suite.msgStore.GetMessagesSince(4)
+	require.Nil(t, err)
+	assert.Empty(t, msgs)
+
+	// And a range read descending should be returned most recent first
+	msgs, err = suite.msgStore.GetMessagesDescending(2, 4)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("four"), []byte("three"), []byte("two")}, msgs)
+}
+
+func (suite *MessageStoreTestSuite) TestMessageStore_StreamMessages() {
+	t := suite.T()
+
+	// Given messages saved for seqnums 1 to 4
+	for seqNum, msg := range []string{"one", "two", "three", "four"} {
+		require.Nil(t, suite.msgStore.SaveMessage(seqNum+1, []byte(msg)))
+	}
+
+	// When a range of them is streamed
+	msgs, errs := suite.msgStore.StreamMessages(context.Background(), 2, 3)
+
+	// Then they should be received in seqnum order, and the stream should end without error
+	var received []StoredMessage
+	for msg := range msgs {
+		received = append(received, msg)
+	}
+	require.Nil(t, <-errs)
+	require.Len(t, received, 2)
+	assert.Equal(t, 2, received[0].SeqNum)
+	assert.Equal(t, []byte("two"), received[0].Msg)
+	assert.Equal(t, 3, received[1].SeqNum)
+	assert.Equal(t, []byte("three"), received[1].Msg)
+}
+
+func (suite *MessageStoreTestSuite) TestMessageStore_StreamMessagesCancelled() {
+	t := suite.T()
+
+	// Given messages saved for seqnums 1 to 4
+	for seqNum, msg := range []string{"one", "two", "three", "four"} {
+		require.Nil(t, suite.msgStore.SaveMessage(seqNum+1, []byte(msg)))
+	}
+
+	// When a stream of them is abandoned after the first message
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs, errs := suite.msgStore.StreamMessages(ctx, 1, 4)
+	<-msgs
+	cancel()
+
+	// Then the stream should end with the cancellation rather than block its producer
+	for range msgs {
+	}
+	err := <-errs
+	if err != nil {
+		assert.True(t, errors.Is(err, context.Canceled))
+	}
+
+	// And the store should still be usable
+	require.Nil(t, suite.msgStore.SaveMessage(5, []byte("five")))
+}
+
+func (suite *MessageStoreTestSuite) TestMessageStore_BeginTx() {
+	t := suite.T()
+	require.Nil(t, suite.msgStore.SetNextSenderMsgSeqNum(5))
+	require.Nil(t, suite.msgStore.SetNextTargetMsgSeqNum(7))
+
+	// Given a transaction saving a message and changing both seqnums
+	tx, err := suite.msgStore.BeginTx()
+	require.Nil(t, err)
+	require.Nil(t, tx.SaveMessage(5, []byte("logon")))
+	require.Nil(t, tx.SetNextSenderMsgSeqNum(6))
+	require.Nil(t, tx.SetNextTargetMsgSeqNum(8))
+
+	// When it is committed
+	require.Nil(t, tx.Commit())
+
+	// Then the writes should be made
+	assert.Equal(t, 6, suite.msgStore.NextSenderMsgSeqNum())
+	assert.Equal(t, 8, suite.msgStore.NextTargetMsgSeqNum())
+	msg, found, err := suite.msgStore.GetMessage(5)
+	require.Nil(t, err)
+	require.True(t, found)
+	assert.Equal(t, []byte("logon"), msg)
+
+	// And persisted
+	require.Nil(t, suite.msgStore.Refresh())
+	assert.Equal(t, 6, suite.msgStore.NextSenderMsgSeqNum())
+	assert.Equal(t, 8, suite.msgStore.NextTargetMsgSeqNum())
+
+	// And the transaction should be done
+	assert.True(t, errors.Is(tx.Rollback(), ErrTxDone))
+	assert.True(t, errors.Is(tx.SaveMessage(6, []byte("late")), ErrTxDone))
+
+	// And the writes of a rolled back transaction should not be made
+	tx, err = suite.msgStore.BeginTx()
+	require.Nil(t, err)
+	require.Nil(t, tx.SaveMessage(6, []byte("heartbeat")))
+	require.Nil(t, tx.SetNextSenderMsgSeqNum(7))
+	require.Nil(t, tx.Rollback())
+	require.Nil(t, suite.msgStore.Refresh())
+	assert.Equal(t, 6, suite.msgStore.NextSenderMsgSeqNum())
+	_, found, err = suite.msgStore.GetMessage(6)
+	require.Nil(t, err)
+	assert.False(t, found)
+}
+
+func (suite *MessageStoreTestSuite) TestMessageStore_DeleteMessagesUpTo() {
+	t := suite.T()
+
+	// Given messages saved for seqnums 1 to 4
+	for seqNum, msg := range []string{"one", "two", "three", "four"} {
+		require.Nil(t, suite.msgStore.SaveMessage(seqNum+1, []byte(msg)))
+	}
+	require.Nil(t, suite.msgStore.SetNextSenderMsgSeqNum(5))
+
+	// When the messages up to seqnum 2 are deleted
+	require.Nil(t, suite.msgStore.DeleteMessagesUpTo(2))
+
+	// Then only the later messages should remain, across a refresh, with the seqnums as they were
+	require.Nil(t, suite.msgStore.Refresh())
+	msgs, err := suite.msgStore.GetMessages(1, 4)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("three"), []byte("four")}, msgs)
+	assert.Equal(t, 5, suite.msgStore.NextSenderMsgSeqNum())
+
+	// And new messages can still be saved after them
+	require.Nil(t, suite.msgStore.SaveMessage(5, []byte("five")))
+	msg, found, err := suite.msgStore.GetMessage(5)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("five"), msg)
+}
+
+func (suite *MessageStoreTestSuite) TestMessageStore_MessageStats() {
+	t := suite.T()
+	stats, ok := suite.msgStore.(MessageStats)
+	if !ok {
+		t.Skip("store does not implement MessageStats")
+	}
+
+	// Given an empty store
+	// Then it should report no messages
+	count, err := stats.MessageCount()
+	require.Nil(t, err)
+	assert.Equal(t, 0, count)
+	first, err := stats.FirstSeqNum()
+	require.Nil(t, err)
+	assert.Equal(t, 0, first)
+	last, err := stats.LastSeqNum()
+	require.Nil(t, err)
+	assert.Equal(t, 0, last)
+
+	// When messages are saved for seqnums 2, 3 and 5
+	for _, seqNum := range []int{2, 3, 5} {
+		require.Nil(t, suite.msgStore.SaveMessage(seqNum, []byte("msg")))
+	}
+
+	// Then the store should report them, and so the gap at 4
+	count, err = stats.MessageCount()
+	require.Nil(t, err)
+	assert.Equal(t, 3, count)
+	first, err = stats.FirstSeqNum()
+	require.Nil(t, err)
+	assert.Equal(t, 2, first)
+	last, err = stats.LastSeqNum()
+	require.Nil(t, err)
+	assert.Equal(t, 5, last)
+}
+
+func (suite *MessageStoreTestSuite) TestMessageStore_SessionValues() {
+	t := suite.T()
+	values, ok := suite.msgStore.(SessionValueStore)
+	if !ok {
+		t.Skip("store does not implement SessionValueStore")
+	}
+
+	// Given a value that was never set
+	// Then it should not be found
+	_, found, err := values.GetSessionValue("ResetReason")
+	require.Nil(t, err)
+	assert.False(t, found)
+
+	// When values are set, one of them twice
+	require.Nil(t, values.SetSessionValue("ResetReason", "logout"))
+	require.Nil(t, values.SetSessionValue("LastLogon", "20200102-03:04:05"))
+	require.Nil(t, values.SetSessionValue("ResetReason", "sequence reset"))
+
+	// Then the latest values should be kept across a refresh and a reset
+	require.Nil(t, suite.msgStore.Refresh())
+	require.Nil(t, suite.msgStore.Reset())
+	value, found, err := values.GetSessionValue("ResetReason")
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "sequence reset", value)
+	value, found, err = values.GetSessionValue("LastLogon")
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "20200102-03:04:05", value)
+}
+
+func (suite *MessageStoreTestSuite) TestMessageStore_BackupAndRestore() {
+	t := suite.T()
+
+	// Given a store with messages, seqnums and a creation time
+	require.Nil(t, suite.msgStore.SaveMessage(1, []byte("hello")))
+	require.Nil(t, suite.msgStore.SaveMessage(2, []byte("world")))
+	require.Nil(t, suite.msgStore.SetNextSenderMsgSeqNum(3))
+	require.Nil(t, suite.msgStore.SetNextTargetMsgSeqNum(4))
+	creationTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.Nil(t, suite.msgStore.SetCreationTime(creationTime))
+
+	// When it is backed up, reset and restored from the backup
+	var archive bytes.Buffer
+	require.Nil(t, suite.msgStore.Backup(&archive))
+	require.Nil(t, suite.msgStore.Reset())
+	require.Nil(t, suite.msgStore.Restore(&archive))
+
+	// Then it should be as it was backed up
+	require.Nil(t, suite.msgStore.Refresh())
+	assert.Equal(t, 3, suite.msgStore.NextSenderMsgSeqNum())
+	assert.Equal(t, 4, suite.msgStore.NextTargetMsgSeqNum())
+	assert.True(t, creationTime.Equal(suite.msgStore.CreationTime()))
+	msgs, err := suite.msgStore.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("hello"), []byte("world")}, msgs)
+}
+
+func (suite *MessageStoreTestSuite) TestMessageStore_HealthCheck() {
+	t := suite.T()
+
+	// Given a store with a message saved
+	require.Nil(t, suite.msgStore.SaveMessage(1, []byte("hello")))
+
+	// When its health is checked
+	// Then it should be healthy
+	assert.Nil(t, suite.msgStore.HealthCheck(context.Background()))
+
+	// And a cancelled check should fail
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NotNil(t, suite.msgStore.HealthCheck(ctx))
+}
+
+func (suite *MessageStoreTestSuite) TestMessageStore_Flush() {
+	t := suite.T()
+
+	// Given a message saved and seqnums set
+	require.Nil(t, suite.msgStore.SaveMessage(1, []byte("hello")))
+	require.Nil(t, suite.msgStore.SetNextSenderMsgSeqNum(2))
+
+	// When the store is flushed
+	require.Nil(t, suite.msgStore.Flush())
+
+	// Then the writes should be kept across a refresh
+	require.Nil(t, suite.msgStore.Refresh())
+	assert.Equal(t, 2, suite.msgStore.NextSenderMsgSeqNum())
+	msg, found, err := suite.msgStore.GetMessage(1)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("hello"), msg)
+}
+
+func (suite *MessageStoreTestSuite) TestMessageStore_SaveMessages() {
+	t := suite.T()
+
+	// Given a batch of messages saved at once
+	require.Nil(t, suite.msgStore.SaveMessages([]SeqMsg{{SeqNum: 1, Msg: []byte("hello")}, {SeqNum: 2, Msg: []byte("world")}}))
+
+	// When the messages are retrieved
+	msgs, err := suite.msgStore.GetMessages(1, 2)
+	require.Nil(t, err)
+
+	// Then they should be the batch
+	require.Len(t, msgs, 2)
+	assert.Equal(t, []byte("hello"), msgs[0])
+	assert.Equal(t, []byte("world"), msgs[1])
+}
+
+func (suite *MessageStoreTestSuite) TestMessageStore_IterateMessages() {
+	t := suite.T()
+
+	// Given the following saved messages
+	require.Nil(t, suite.msgStore.SaveMessage(1, []byte("hello")))
+	require.Nil(t, suite.msgStore.SaveMessage(3, []byte("cruel")))
+	require.Nil(t, suite.msgStore.SaveMessage(4, []byte("world")))
+
+	// When a range is iterated
+	var seqNums []int
+	require.Nil(t, suite.msgStore.IterateMessages(1, 3, func(seqNum int, msg []byte) error {
+		seqNums = append(seqNums, seqNum)
+		return nil
+	}))
+
+	// Then the messages in it should be given in order
+	assert.Equal(t, []int{1, 3}, seqNums)
+
+	// And an error from fn should stop the iteration and be returned
+	stop := errors.New("stop")
+	seqNums = nil
+	assert.Equal(t, stop, suite.msgStore.IterateMessages(1, 4, func(seqNum int, msg []byte) error {
+		seqNums = append(seqNums, seqNum)
+		return stop
+	}))
+	assert.Equal(t, []int{1}, seqNums)
+}
+
+func (suite *MessageStoreTestSuite) TestMessageStore_IterateMessages_ReturnsFnError() {
+	t := suite.T()
+
+	// Given a saved message
+	require.Nil(t, suite.msgStore.SaveMessage(1, []byte("hello")))
+
+	// When fn fails with an error of its own
+	stop := fmt.Errorf("resend aborted: %w", io.ErrClosedPipe)
+	err := suite.msgStore.IterateMessages(1, 1, func(int, []byte) error { return stop })
+
+	// Then that error should be returned unchanged, rather than as a failure of the store
+	assert.True(t, err == stop, "%#v", err)
+	var storeErr *StoreError
+	assert.False(t, errors.As(err, &storeErr))
+
+	// And so should it be by IterateMessagesContext
+	if ctxStore, ok := suite.msgStore.(ContextMessageStore); ok {
+		err = ctxStore.IterateMessagesContext(context.Background(), 1, 1, func(int, []byte) error { return stop })
+		assert.True(t, err == stop, "%#v", err)
+	}
+}
+
 func (suite *MessageStoreTestSuite) TestMessageStore_GetMessages_VariousRanges() {
 	t := suite.T()
 
@@ -172,3 +580,44 @@ func (suite *MessageStoreTestSuite) TestMessageStore_CreationTime() {
 	require.True(suite.T(), suite.msgStore.CreationTime().After(t0))
 	require.True(suite.T(), suite.msgStore.CreationTime().Before(t1))
 }
+
+func TestMemoryStoreFactory_WithMemoryClock(t *testing.T) {
+	// Given a memory store factory with a fixed clock
+	clock := fixedClock{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	store, err := NewMemoryStoreFactory(WithMemoryClock(clock)).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+
+	// When the store is reset
+	require.Nil(t, store.Reset())
+
+	// Then its creation time should be told by the clock
+	assert.Equal(t, clock.t, store.CreationTime())
+}
+
+func TestMemoryStoreFactory_Close(t *testing.T) {
+	// Given a memory store factory that has been closed
+	factory := NewMemoryStoreFactory()
+	require.Nil(t, factory.Close())
+
+	// When a store is created
+	_, err := factory.Create("FIX.4.4-SENDER-TARGET")
+
+	// Then it should be refused
+	assert.Equal(t, ErrFactoryClosed, err)
+}
+
+func TestMemoryStoreFactory_WithMemoryMaxMessages(t *testing.T) {
+	// Given a memory store bounded to 3 messages
+	store, err := NewMemoryStoreFactory(WithMemoryMaxMessages(3)).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+
+	// When 5 messages are saved
+	for seqNum := 1; seqNum <= 5; seqNum++ {
+		require.Nil(t, store.SaveMessage(seqNum, []byte(fmt.Sprintf("msg%d", seqNum))))
+	}
+
+	// Then only the 3 most recent should be kept
+	msgs, err := store.GetMessages(1, 5)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("msg3"), []byte("msg4"), []byte("msg5")}, msgs)
+}
@@ -0,0 +1,465 @@
+package msgstore
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// MessageStoreV2 is the context-aware successor of MessageStore.  Every method that may reach the backend takes a
+// context, whose deadline and cancellation the network backends honor for their in-flight operations.  The seqnum and
+// creation time accessors only read the store's cache.
+type MessageStoreV2 interface {
+	NextSenderMsgSeqNum() int
+	NextTargetMsgSeqNum() int
+
+	IncrNextSenderMsgSeqNum(ctx context.Context) error
+	IncrNextTargetMsgSeqNum(ctx context.Context) error
+
+	SetNextSenderMsgSeqNum(ctx context.Context, next int) error
+	SetNextTargetMsgSeqNum(ctx context.Context, next int) error
+
+	CreationTime() time.Time
+	SetCreationTime(ctx context.Context, t time.Time) error
+
+	SaveMessage(ctx context.Context, seqNum int, msg []byte) error
+	SaveMessages(ctx context.Context, msgs []SeqMsg) error
+	GetMessages(ctx context.Context, beginSeqNum, endSeqNum int) ([][]byte, error)
+	GetMessagesSince(ctx context.Context, seqNum int) ([][]byte, error)
+	GetMessagesDescending(ctx context.Context, beginSeqNum, endSeqNum int) ([][]byte, error)
+	GetMessage(ctx context.Context, seqNum int) (msg []byte, found bool, err error)
+	IterateMessages(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error
+	// StreamMessages is like the StreamMessages of MessageStore, and cancelling ctx abandons the stream
+	StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error)
+	DeleteMessagesUpTo(ctx context.Context, seqNum int) error
+	// BeginTx is like the BeginTx of MessageStore, and the operations of the transaction are bounded by ctx
+	BeginTx(ctx context.Context) (StoreTx, error)
+
+	Backup(ctx context.Context, w io.Writer) error
+	Restore(ctx context.Context, r io.Reader) error
+
+	HealthCheck(ctx context.Context) error
+	Flush(ctx context.Context) error
+	Refresh(ctx context.Context) error
+	Reset(ctx context.Context) error
+
+	Close() error
+}
+
+// MessageStoreFactoryV2 creates the MessageStoreV2 of a session
+type MessageStoreFactoryV2 interface {
+	Create(ctx context.Context, sessionID string) (MessageStoreV2, error)
+	Close() error
+}
+
+// AdaptMessageStore returns store as a MessageStoreV2.  Stores implementing ContextMessageStore, such as the sql and
+// mongo stores, are given each context; others can only be kept from starting an operation once its context is done.
+func AdaptMessageStore(store MessageStore) MessageStoreV2 {
+	if v1, ok := store.(v1MessageStore); ok {
+		return v1.store
+	}
+	if ctxStore, ok := store.(ContextMessageStore); ok {
+		return contextMessageStoreV2{ctxStore}
+	}
+	return messageStoreV2{store}
+}
+
+// AdaptMessageStoreV2 returns store as a MessageStore, whose operations run with context.Background(), for engines
+// still on the MessageStore interface
+func AdaptMessageStoreV2(store MessageStoreV2) MessageStore {
+	if v2, ok := store.(contextMessageStoreV2); ok {
+		return v2.store
+	}
+	if v2, ok := store.(messageStoreV2); ok {
+		return v2.store
+	}
+	return v1MessageStore{store}
+}
+
+// AdaptMessageStoreFactory returns factory as a MessageStoreFactoryV2 creating adapted stores, see AdaptMessageStore
+func AdaptMessageStoreFactory(factory MessageStoreFactory) MessageStoreFactoryV2 {
+	return messageStoreFactoryV2{factory}
+}
+
+// AdaptMessageStoreFactoryV2 returns factory as a MessageStoreFactory creating adapted stores, see AdaptMessageStoreV2
+func AdaptMessageStoreFactoryV2(factory MessageStoreFactoryV2) MessageStoreFactory {
+	return v1MessageStoreFactory{factory}
+}
+
+type messageStoreFactoryV2 struct {
+	factory MessageStoreFactory
+}
+
+func (f messageStoreFactoryV2) Create(ctx context.Context, sessionID string) (MessageStoreV2, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	store, err := f.factory.Create(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return AdaptMessageStore(store), nil
+}
+
+func (f messageStoreFactoryV2) Close() error { return f.factory.Close() }
+
+type v1MessageStoreFactory struct {
+	factory MessageStoreFactoryV2
+}
+
+func (f v1MessageStoreFactory) Create(sessionID string) (MessageStore, error) {
+	store, err := f.factory.Create(context.Background(), sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return AdaptMessageStoreV2(store), nil
+}
+
+func (f v1MessageStoreFactory) Close() error { return f.factory.Close() }
+
+// contextMessageStoreV2 adapts a ContextMessageStore, passing each context on
+type contextMessageStoreV2 struct {
+	store ContextMessageStore
+}
+
+func (s contextMessageStoreV2) NextSenderMsgSeqNum() int { return s.store.NextSenderMsgSeqNum() }
+func (s contextMessageStoreV2) NextTargetMsgSeqNum() int { return s.store.NextTargetMsgSeqNum() }
+func (s contextMessageStoreV2) CreationTime() time.Time  { return s.store.CreationTime() }
+func (s contextMessageStoreV2) Close() error             { return s.store.Close() }
+
+func (s contextMessageStoreV2) IncrNextSenderMsgSeqNum(ctx context.Context) error {
+	return s.store.IncrNextSenderMsgSeqNumContext(ctx)
+}
+
+func (s contextMessageStoreV2) IncrNextTargetMsgSeqNum(ctx context.Context) error {
+	return s.store.IncrNextTargetMsgSeqNumContext(ctx)
+}
+
+func (s contextMessageStoreV2) SetNextSenderMsgSeqNum(ctx context.Context, next int) error {
+	return s.store.SetNextSenderMsgSeqNumContext(ctx, next)
+}
+
+func (s contextMessageStoreV2) SetNextTargetMsgSeqNum(ctx context.Context, next int) error {
+	return s.store.SetNextTargetMsgSeqNumContext(ctx, next)
+}
+
+func (s contextMessageStoreV2) SetCreationTime(ctx context.Context, t time.Time) error {
+	return s.store.SetCreationTimeContext(ctx, t)
+}
+
+func (s contextMessageStoreV2) SaveMessage(ctx context.Context, seqNum int, msg []byte) error {
+	return s.store.SaveMessageContext(ctx, seqNum, msg)
+}
+
+func (s contextMessageStoreV2) SaveMessages(ctx context.Context, msgs []SeqMsg) error {
+	return s.store.SaveMessagesContext(ctx, msgs)
+}
+
+func (s contextMessageStoreV2) GetMessages(ctx context.Context, beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return s.store.GetMessagesContext(ctx, beginSeqNum, endSeqNum)
+}
+
+func (s contextMessageStoreV2) GetMessagesSince(ctx context.Context, seqNum int) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.store.GetMessagesSince(seqNum)
+}
+
+func (s contextMessageStoreV2) GetMessagesDescending(ctx context.Context, beginSeqNum, endSeqNum int) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.store.GetMessagesDescending(beginSeqNum, endSeqNum)
+}
+
+func (s contextMessageStoreV2) GetMessage(ctx context.Context, seqNum int) ([]byte, bool, error) {
+	return s.store.GetMessageContext(ctx, seqNum)
+}
+
+func (s contextMessageStoreV2) IterateMessages(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return s.store.IterateMessagesContext(ctx, beginSeqNum, endSeqNum, fn)
+}
+
+func (s contextMessageStoreV2) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return s.store.StreamMessages(ctx, beginSeqNum, endSeqNum)
+}
+
+func (s contextMessageStoreV2) DeleteMessagesUpTo(ctx context.Context, seqNum int) error {
+	return s.store.DeleteMessagesUpToContext(ctx, seqNum)
+}
+
+func (s contextMessageStoreV2) BeginTx(ctx context.Context) (StoreTx, error) {
+	return s.store.BeginTxContext(ctx)
+}
+
+func (s contextMessageStoreV2) Backup(ctx context.Context, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.Backup(w)
+}
+
+func (s contextMessageStoreV2) Restore(ctx context.Context, r io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.Restore(r)
+}
+
+func (s contextMessageStoreV2) HealthCheck(ctx context.Context) error {
+	return s.store.HealthCheck(ctx)
+}
+
+func (s contextMessageStoreV2) Flush(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.Flush()
+}
+
+func (s contextMessageStoreV2) Refresh(ctx context.Context) error { return s.store.RefreshContext(ctx) }
+func (s contextMessageStoreV2) Reset(ctx context.Context) error   { return s.store.ResetContext(ctx) }
+
+// messageStoreV2 adapts a MessageStore that cannot be given a context, checking it before each operation
+type messageStoreV2 struct {
+	store MessageStore
+}
+
+func (s messageStoreV2) NextSenderMsgSeqNum() int { return s.store.NextSenderMsgSeqNum() }
+func (s messageStoreV2) NextTargetMsgSeqNum() int { return s.store.NextTargetMsgSeqNum() }
+func (s messageStoreV2) CreationTime() time.Time  { return s.store.CreationTime() }
+func (s messageStoreV2) Close() error             { return s.store.Close() }
+
+func (s messageStoreV2) IncrNextSenderMsgSeqNum(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.IncrNextSenderMsgSeqNum()
+}
+
+func (s messageStoreV2) IncrNextTargetMsgSeqNum(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.IncrNextTargetMsgSeqNum()
+}
+
+func (s messageStoreV2) SetNextSenderMsgSeqNum(ctx context.Context, next int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.SetNextSenderMsgSeqNum(next)
+}
+
+func (s messageStoreV2) SetNextTargetMsgSeqNum(ctx context.Context, next int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.SetNextTargetMsgSeqNum(next)
+}
+
+func (s messageStoreV2) SetCreationTime(ctx context.Context, t time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.SetCreationTime(t)
+}
+
+func (s messageStoreV2) SaveMessage(ctx context.Context, seqNum int, msg []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.SaveMessage(seqNum, msg)
+}
+
+func (s messageStoreV2) SaveMessages(ctx context.Context, msgs []SeqMsg) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.SaveMessages(msgs)
+}
+
+func (s messageStoreV2) GetMessages(ctx context.Context, beginSeqNum, endSeqNum int) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.store.GetMessages(beginSeqNum, endSeqNum)
+}
+
+func (s messageStoreV2) GetMessagesSince(ctx context.Context, seqNum int) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.store.GetMessagesSince(seqNum)
+}
+
+func (s messageStoreV2) GetMessagesDescending(ctx context.Context, beginSeqNum, endSeqNum int) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.store.GetMessagesDescending(beginSeqNum, endSeqNum)
+}
+
+func (s messageStoreV2) GetMessage(ctx context.Context, seqNum int) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	return s.store.GetMessage(seqNum)
+}
+
+// IterateMessages checks ctx before each message, so that a cancelled iteration stops early
+func (s messageStoreV2) IterateMessages(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.IterateMessages(beginSeqNum, endSeqNum, func(seqNum int, msg []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(seqNum, msg)
+	})
+}
+
+func (s messageStoreV2) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return s.store.StreamMessages(ctx, beginSeqNum, endSeqNum)
+}
+
+func (s messageStoreV2) DeleteMessagesUpTo(ctx context.Context, seqNum int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.DeleteMessagesUpTo(seqNum)
+}
+
+func (s messageStoreV2) BeginTx(ctx context.Context) (StoreTx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.store.BeginTx()
+}
+
+func (s messageStoreV2) Backup(ctx context.Context, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.Backup(w)
+}
+
+func (s messageStoreV2) Restore(ctx context.Context, r io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.Restore(r)
+}
+
+func (s messageStoreV2) HealthCheck(ctx context.Context) error {
+	return s.store.HealthCheck(ctx)
+}
+
+func (s messageStoreV2) Flush(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.Flush()
+}
+
+func (s messageStoreV2) Refresh(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.Refresh()
+}
+
+func (s messageStoreV2) Reset(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.Reset()
+}
+
+// v1MessageStore adapts a MessageStoreV2 for the MessageStore interface
+type v1MessageStore struct {
+	store MessageStoreV2
+}
+
+func (s v1MessageStore) NextSenderMsgSeqNum() int { return s.store.NextSenderMsgSeqNum() }
+func (s v1MessageStore) NextTargetMsgSeqNum() int { return s.store.NextTargetMsgSeqNum() }
+func (s v1MessageStore) CreationTime() time.Time  { return s.store.CreationTime() }
+func (s v1MessageStore) Close() error             { return s.store.Close() }
+
+func (s v1MessageStore) IncrNextSenderMsgSeqNum() error {
+	return s.store.IncrNextSenderMsgSeqNum(context.Background())
+}
+
+func (s v1MessageStore) IncrNextTargetMsgSeqNum() error {
+	return s.store.IncrNextTargetMsgSeqNum(context.Background())
+}
+
+func (s v1MessageStore) SetNextSenderMsgSeqNum(next int) error {
+	return s.store.SetNextSenderMsgSeqNum(context.Background(), next)
+}
+
+func (s v1MessageStore) SetNextTargetMsgSeqNum(next int) error {
+	return s.store.SetNextTargetMsgSeqNum(context.Background(), next)
+}
+
+func (s v1MessageStore) SetCreationTime(t time.Time) error {
+	return s.store.SetCreationTime(context.Background(), t)
+}
+
+func (s v1MessageStore) SaveMessage(seqNum int, msg []byte) error {
+	return s.store.SaveMessage(context.Background(), seqNum, msg)
+}
+
+func (s v1MessageStore) SaveMessages(msgs []SeqMsg) error {
+	return s.store.SaveMessages(context.Background(), msgs)
+}
+
+func (s v1MessageStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return s.store.GetMessages(context.Background(), beginSeqNum, endSeqNum)
+}
+
+func (s v1MessageStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return s.store.GetMessagesSince(context.Background(), seqNum)
+}
+
+func (s v1MessageStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return s.store.GetMessagesDescending(context.Background(), beginSeqNum, endSeqNum)
+}
+
+func (s v1MessageStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return s.store.GetMessage(context.Background(), seqNum)
+}
+
+func (s v1MessageStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return s.store.IterateMessages(context.Background(), beginSeqNum, endSeqNum, fn)
+}
+
+func (s v1MessageStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return s.store.StreamMessages(ctx, beginSeqNum, endSeqNum)
+}
+
+func (s v1MessageStore) DeleteMessagesUpTo(seqNum int) error {
+	return s.store.DeleteMessagesUpTo(context.Background(), seqNum)
+}
+
+func (s v1MessageStore) BeginTx() (StoreTx, error) {
+	return s.store.BeginTx(context.Background())
+}
+
+func (s v1MessageStore) Backup(w io.Writer) error {
+	return s.store.Backup(context.Background(), w)
+}
+
+func (s v1MessageStore) Restore(r io.Reader) error {
+	return s.store.Restore(context.Background(), r)
+}
+
+func (s v1MessageStore) HealthCheck(ctx context.Context) error {
+	return s.store.HealthCheck(ctx)
+}
+
+func (s v1MessageStore) Flush() error   { return s.store.Flush(context.Background()) }
+func (s v1MessageStore) Refresh() error { return s.store.Refresh(context.Background()) }
+func (s v1MessageStore) Reset() error   { return s.store.Reset(context.Background()) }
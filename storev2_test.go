@@ -0,0 +1,78 @@
+package msgstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// MessageStoreV2AdapterTestSuite runs all tests in the MessageStoreTestSuite against a memory store adapted to
+// MessageStoreV2 and back
+type MessageStoreV2AdapterTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *MessageStoreV2AdapterTestSuite) SetupTest() {
+	store, err := AdaptMessageStoreFactoryV2(AdaptMessageStoreFactory(NewMemoryStoreFactory())).Create("XYZZY")
+	require.Nil(suite.T(), err)
+	// unwrapped, so that the adapters themselves are exercised
+	suite.msgStore = v1MessageStore{AdaptMessageStore(store)}
+}
+
+func TestMessageStoreV2AdapterTestSuite(t *testing.T) {
+	suite.Run(t, new(MessageStoreV2AdapterTestSuite))
+}
+
+func TestAdaptMessageStore(t *testing.T) {
+	// Given a store without context support, adapted to MessageStoreV2
+	memStore, err := NewMemoryStoreFactory().Create("XYZZY")
+	require.Nil(t, err)
+	store := AdaptMessageStore(memStore)
+
+	// When its context is already done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Then no operation should start
+	assert.Equal(t, context.Canceled, store.SaveMessage(ctx, 1, []byte("msg")))
+	assert.Equal(t, context.Canceled, store.IncrNextSenderMsgSeqNum(ctx))
+	_, err = store.GetMessages(ctx, 1, 1)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, memStore.NextSenderMsgSeqNum())
+
+	// And adapting it back should return the original store
+	assert.Equal(t, memStore, AdaptMessageStoreV2(store))
+}
+
+func TestAdaptMessageStore_Context(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("SqlStoreV2-%d", os.Getpid()))
+	require.Nil(t, os.MkdirAll(rootPath, os.ModePerm))
+	defer os.RemoveAll(rootPath)
+
+	// Given a store supporting contexts, adapted to MessageStoreV2
+	factory := AdaptMessageStoreFactory(NewSQLStoreFactory(map[string]string{
+		SQLStoreDriver:         "sqlite3",
+		SQLStoreDataSourceName: path.Join(rootPath, "v2.db"),
+		SQLStoreAutoMigrate:    "Y",
+	}))
+	store, err := factory.Create(context.Background(), "FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Then it should be given the contexts
+	assert.IsType(t, contextMessageStoreV2{}, store)
+	require.Nil(t, store.SaveMessage(context.Background(), 1, []byte("msg")))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NotNil(t, store.SaveMessage(ctx, 2, []byte("msg")))
+
+	msgs, err := store.GetMessages(context.Background(), 1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("msg")}, msgs)
+}
@@ -0,0 +1,57 @@
+package msgstore
+
+import "context"
+
+// streamBufferSize is the number of messages StreamMessageStore reads ahead of its consumer
+const streamBufferSize = 256
+
+// StreamMessageStore streams the messages of store in the range in seqnum order over the returned message channel,
+// reading ahead of the consumer by a bounded buffer so that a replay can start before the range is read, and without
+// holding it in memory.  The message channel is closed once the range is read or reading fails, after which the error
+// channel yields the failure, if any, and is closed.  Cancelling ctx abandons the stream, which consumers that stop
+// early must do to release the reader.  Stores that bound their reads by a context are read with ctx.  As the store is
+// read from another goroutine, it must not be written to until the stream ends unless it is safe for concurrent use;
+// the memory and file stores, which are not, snapshot the range in their StreamMessages instead.
+//
+// The messages are those GetMessages returns, so their Direction is MessageOutgoing and their StoredAt is not read.
+// It implements StreamMessages for every MessageStore of the package, and is exported for other implementations.
+func StreamMessageStore(ctx context.Context, store MessageStore, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	msgs := make(chan StoredMessage, streamBufferSize)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(msgs)
+
+		send := func(seqNum int, msg []byte) error {
+			select {
+			case msgs <- StoredMessage{SeqNum: seqNum, Direction: MessageOutgoing, Msg: msg}:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		var err error
+		if contextStore, ok := store.(ContextMessageStore); ok {
+			err = contextStore.IterateMessagesContext(ctx, beginSeqNum, endSeqNum, send)
+		} else {
+			err = store.IterateMessages(beginSeqNum, endSeqNum, send)
+		}
+		if err != nil {
+			errs <- err
+		}
+	}()
+
+	return msgs, errs
+}
+
+// failedStream returns a stream of no messages failing with err, for stores that cannot start one
+func failedStream(err error) (<-chan StoredMessage, <-chan error) {
+	msgs := make(chan StoredMessage)
+	errs := make(chan error, 1)
+	close(msgs)
+	errs <- err
+	close(errs)
+	return msgs, errs
+}
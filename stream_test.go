@@ -0,0 +1,55 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamMessageStore_Cancel(t *testing.T) {
+	// Given a store with more messages than the stream reads ahead
+	store, err := NewMemoryStoreFactory().Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	for seqNum := 1; seqNum <= streamBufferSize*2; seqNum++ {
+		require.Nil(t, store.SaveMessage(seqNum, []byte("msg")))
+	}
+
+	// When the consumer cancels the stream after the first message
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs, errs := StreamMessageStore(ctx, store, 1, streamBufferSize*2)
+	first := <-msgs
+	cancel()
+	for range msgs {
+	}
+
+	// Then the stream should end with the cancellation
+	assert.Equal(t, 1, first.SeqNum)
+	assert.True(t, errors.Is(<-errs, context.Canceled))
+}
+
+func TestStreamMessageStore_Error(t *testing.T) {
+	// Given a store failing to read
+	store := failingIterateStore{err: errors.New("disk on fire")}
+
+	// When its messages are streamed
+	msgs, errs := StreamMessageStore(context.Background(), store, 1, 10)
+
+	// Then no messages should be received, and the stream should end with the failure
+	for range msgs {
+		t.Fatal("unexpected message")
+	}
+	assert.Equal(t, store.err, <-errs)
+}
+
+// failingIterateStore fails every IterateMessages
+type failingIterateStore struct {
+	MessageStore
+	err error
+}
+
+func (s failingIterateStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return s.err
+}
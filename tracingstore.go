@@ -0,0 +1,306 @@
+package msgstore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans of the tracing stores
+const tracerName = "github.com/connamara/go-msgstore"
+
+type tracingStore struct {
+	inner     MessageStoreV2
+	sessionID string
+	backend   string
+	tracer    trace.Tracer
+}
+
+// NewTracingStore returns a ContextMessageStore that starts an OpenTelemetry span from provider for every operation of
+// inner, a store of sessionID on backend, e.g. "sql".  Spans are named after the operation, as in the metrics of the
+// backends, e.g. "msgstore.save_message", and carry the msgstore.session_id and msgstore.backend attributes, and the
+// msgstore.seqnum, or msgstore.begin_seqnum and msgstore.end_seqnum, of the messages the operation is given.  The spans
+// of the Context methods are children of the span of the caller's context, which is passed on to inner if it is a
+// ContextMessageStore, so that store latency shows in end-to-end traces; the other methods start root spans.
+func NewTracingStore(inner MessageStore, sessionID, backend string, provider trace.TracerProvider) ContextMessageStore {
+	return &tracingStore{inner: AdaptMessageStore(inner), sessionID: sessionID, backend: backend, tracer: provider.Tracer(tracerName)}
+}
+
+// start starts the span of an operation as a child of the span of ctx
+func (store *tracingStore) start(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("msgstore.session_id", store.sessionID), attribute.String("msgstore.backend", store.backend))
+	return store.tracer.Start(ctx, "msgstore."+operation, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the failure of an operation on its span and ends it, to be deferred
+func endSpan(span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+func seqNumAttr(seqNum int) attribute.KeyValue {
+	return attribute.Int("msgstore.seqnum", seqNum)
+}
+
+func rangeAttrs(beginSeqNum, endSeqNum int) []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.Int("msgstore.begin_seqnum", beginSeqNum), attribute.Int("msgstore.end_seqnum", endSeqNum)}
+}
+
+func (store *tracingStore) NextSenderMsgSeqNum() int {
+	return store.inner.NextSenderMsgSeqNum()
+}
+
+func (store *tracingStore) NextTargetMsgSeqNum() int {
+	return store.inner.NextTargetMsgSeqNum()
+}
+
+func (store *tracingStore) IncrNextSenderMsgSeqNum() error {
+	return store.IncrNextSenderMsgSeqNumContext(context.Background())
+}
+
+func (store *tracingStore) IncrNextSenderMsgSeqNumContext(ctx context.Context) (err error) {
+	ctx, span := store.start(ctx, "incr_next_sender_seqnum")
+	defer endSpan(span, &err)
+	return store.inner.IncrNextSenderMsgSeqNum(ctx)
+}
+
+func (store *tracingStore) IncrNextTargetMsgSeqNum() error {
+	return store.IncrNextTargetMsgSeqNumContext(context.Background())
+}
+
+func (store *tracingStore) IncrNextTargetMsgSeqNumContext(ctx context.Context) (err error) {
+	ctx, span := store.start(ctx, "incr_next_target_seqnum")
+	defer endSpan(span, &err)
+	return store.inner.IncrNextTargetMsgSeqNum(ctx)
+}
+
+func (store *tracingStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.SetNextSenderMsgSeqNumContext(context.Background(), next)
+}
+
+func (store *tracingStore) SetNextSenderMsgSeqNumContext(ctx context.Context, next int) (err error) {
+	ctx, span := store.start(ctx, "set_next_sender_seqnum", seqNumAttr(next))
+	defer endSpan(span, &err)
+	return store.inner.SetNextSenderMsgSeqNum(ctx, next)
+}
+
+func (store *tracingStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.SetNextTargetMsgSeqNumContext(context.Background(), next)
+}
+
+func (store *tracingStore) SetNextTargetMsgSeqNumContext(ctx context.Context, next int) (err error) {
+	ctx, span := store.start(ctx, "set_next_target_seqnum", seqNumAttr(next))
+	defer endSpan(span, &err)
+	return store.inner.SetNextTargetMsgSeqNum(ctx, next)
+}
+
+func (store *tracingStore) CreationTime() time.Time {
+	return store.inner.CreationTime()
+}
+
+func (store *tracingStore) SetCreationTime(t time.Time) error {
+	return store.SetCreationTimeContext(context.Background(), t)
+}
+
+func (store *tracingStore) SetCreationTimeContext(ctx context.Context, t time.Time) (err error) {
+	ctx, span := store.start(ctx, "set_creation_time")
+	defer endSpan(span, &err)
+	return store.inner.SetCreationTime(ctx, t)
+}
+
+func (store *tracingStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.SaveMessageContext(context.Background(), seqNum, msg)
+}
+
+func (store *tracingStore) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) (err error) {
+	ctx, span := store.start(ctx, "save_message", seqNumAttr(seqNum))
+	defer endSpan(span, &err)
+	return store.inner.SaveMessage(ctx, seqNum, msg)
+}
+
+func (store *tracingStore) SaveMessages(msgs []SeqMsg) error {
+	return store.SaveMessagesContext(context.Background(), msgs)
+}
+
+func (store *tracingStore) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) (err error) {
+	var attrs []attribute.KeyValue
+	if len(msgs) > 0 {
+		attrs = rangeAttrs(msgs[0].SeqNum, msgs[len(msgs)-1].SeqNum)
+	}
+	ctx, span := store.start(ctx, "save_messages", attrs...)
+	defer endSpan(span, &err)
+	return store.inner.SaveMessages(ctx, msgs)
+}
+
+func (store *tracingStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.GetMessagesContext(context.Background(), beginSeqNum, endSeqNum)
+}
+
+func (store *tracingStore) GetMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int) (_ [][]byte, err error) {
+	ctx, span := store.start(ctx, "get_messages", rangeAttrs(beginSeqNum, endSeqNum)...)
+	defer endSpan(span, &err)
+	return store.inner.GetMessages(ctx, beginSeqNum, endSeqNum)
+}
+
+func (store *tracingStore) GetMessagesSince(seqNum int) (_ [][]byte, err error) {
+	ctx, span := store.start(context.Background(), "get_messages_since", seqNumAttr(seqNum))
+	defer endSpan(span, &err)
+	return store.inner.GetMessagesSince(ctx, seqNum)
+}
+
+func (store *tracingStore) GetMessagesDescending(beginSeqNum, endSeqNum int) (_ [][]byte, err error) {
+	ctx, span := store.start(context.Background(), "get_messages_descending", rangeAttrs(beginSeqNum, endSeqNum)...)
+	defer endSpan(span, &err)
+	return store.inner.GetMessagesDescending(ctx, beginSeqNum, endSeqNum)
+}
+
+func (store *tracingStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return store.GetMessageContext(context.Background(), seqNum)
+}
+
+func (store *tracingStore) GetMessageContext(ctx context.Context, seqNum int) (_ []byte, _ bool, err error) {
+	ctx, span := store.start(ctx, "get_message", seqNumAttr(seqNum))
+	defer endSpan(span, &err)
+	return store.inner.GetMessage(ctx, seqNum)
+}
+
+func (store *tracingStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.IterateMessagesContext(context.Background(), beginSeqNum, endSeqNum, fn)
+}
+
+func (store *tracingStore) IterateMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) (err error) {
+	ctx, span := store.start(ctx, "iterate_messages", rangeAttrs(beginSeqNum, endSeqNum)...)
+	defer endSpan(span, &err)
+	return store.inner.IterateMessages(ctx, beginSeqNum, endSeqNum, fn)
+}
+
+func (store *tracingStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+func (store *tracingStore) BeginTx() (StoreTx, error) {
+	return store.BeginTxContext(context.Background())
+}
+
+// BeginTxContext starts a transaction of inner, whose operations are traced as children of the span of ctx
+func (store *tracingStore) BeginTxContext(ctx context.Context) (_ StoreTx, err error) {
+	txCtx, span := store.start(ctx, "begin_tx")
+	defer endSpan(span, &err)
+
+	tx, err := store.inner.BeginTx(txCtx)
+	if err != nil {
+		return nil, err
+	}
+	return &tracingTx{StoreTx: tx, store: store, ctx: ctx}, nil
+}
+
+func (store *tracingStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.DeleteMessagesUpToContext(context.Background(), seqNum)
+}
+
+func (store *tracingStore) DeleteMessagesUpToContext(ctx context.Context, seqNum int) (err error) {
+	ctx, span := store.start(ctx, "delete_messages", seqNumAttr(seqNum))
+	defer endSpan(span, &err)
+	return store.inner.DeleteMessagesUpTo(ctx, seqNum)
+}
+
+func (store *tracingStore) Backup(w io.Writer) (err error) {
+	ctx, span := store.start(context.Background(), "backup")
+	defer endSpan(span, &err)
+	return store.inner.Backup(ctx, w)
+}
+
+func (store *tracingStore) Restore(r io.Reader) (err error) {
+	ctx, span := store.start(context.Background(), "restore")
+	defer endSpan(span, &err)
+	return store.inner.Restore(ctx, r)
+}
+
+func (store *tracingStore) HealthCheck(ctx context.Context) (err error) {
+	ctx, span := store.start(ctx, "health_check")
+	defer endSpan(span, &err)
+	return store.inner.HealthCheck(ctx)
+}
+
+func (store *tracingStore) Flush() (err error) {
+	ctx, span := store.start(context.Background(), "flush")
+	defer endSpan(span, &err)
+	return store.inner.Flush(ctx)
+}
+
+func (store *tracingStore) Refresh() error {
+	return store.RefreshContext(context.Background())
+}
+
+func (store *tracingStore) RefreshContext(ctx context.Context) (err error) {
+	ctx, span := store.start(ctx, "refresh")
+	defer endSpan(span, &err)
+	return store.inner.Refresh(ctx)
+}
+
+func (store *tracingStore) Reset() error {
+	return store.ResetContext(context.Background())
+}
+
+func (store *tracingStore) ResetContext(ctx context.Context) (err error) {
+	ctx, span := store.start(ctx, "reset")
+	defer endSpan(span, &err)
+	return store.inner.Reset(ctx)
+}
+
+func (store *tracingStore) Close() error {
+	return store.inner.Close()
+}
+
+// tracingTx is a transaction of the inner store of a tracingStore, tracing its operations as children of the span of
+// the context it was begun with
+type tracingTx struct {
+	StoreTx
+	store *tracingStore
+	ctx   context.Context
+	done  bool
+}
+
+func (tx *tracingTx) SaveMessage(seqNum int, msg []byte) (err error) {
+	_, span := tx.store.start(tx.ctx, "save_message", seqNumAttr(seqNum))
+	defer endSpan(span, &err)
+	return tx.StoreTx.SaveMessage(seqNum, msg)
+}
+
+func (tx *tracingTx) SetNextSenderMsgSeqNum(next int) (err error) {
+	_, span := tx.store.start(tx.ctx, "set_next_sender_seqnum", seqNumAttr(next))
+	defer endSpan(span, &err)
+	return tx.StoreTx.SetNextSenderMsgSeqNum(next)
+}
+
+func (tx *tracingTx) SetNextTargetMsgSeqNum(next int) (err error) {
+	_, span := tx.store.start(tx.ctx, "set_next_target_seqnum", seqNumAttr(next))
+	defer endSpan(span, &err)
+	return tx.StoreTx.SetNextTargetMsgSeqNum(next)
+}
+
+func (tx *tracingTx) Commit() (err error) {
+	_, span := tx.store.start(tx.ctx, "commit_tx")
+	defer endSpan(span, &err)
+	tx.done = true
+	return tx.StoreTx.Commit()
+}
+
+// Rollback traces the rollback of a transaction that has not ended, so that the deferred Rollback after a Commit does
+// not show as a failure
+func (tx *tracingTx) Rollback() (err error) {
+	if tx.done {
+		return tx.StoreTx.Rollback()
+	}
+	tx.done = true
+	_, span := tx.store.start(tx.ctx, "rollback_tx")
+	defer endSpan(span, &err)
+	return tx.StoreTx.Rollback()
+}
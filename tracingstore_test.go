@@ -0,0 +1,72 @@
+package msgstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// TracingStoreTestSuite runs all tests in the MessageStoreTestSuite against a tracing store over the MemoryStore
+type TracingStoreTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *TracingStoreTestSuite) SetupTest() {
+	inner, err := NewMemoryStoreFactory().Create("session")
+	require.Nil(suite.T(), err)
+	suite.msgStore = NewTracingStore(inner, "session", "memory", sdktrace.NewTracerProvider())
+}
+
+func TestTracingStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(TracingStoreTestSuite))
+}
+
+// spanAttr returns the value of the attribute of span with the given key
+func spanAttr(span sdktrace.ReadOnlySpan, key string) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestTracingStore(t *testing.T) {
+	// Given a tracing store
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	memStore, _ := NewMemoryStoreFactory().Create("FIX.4.4-SENDER-TARGET")
+	store := NewTracingStore(failingSaveStore{memStore}, "FIX.4.4-SENDER-TARGET", "memory", provider)
+
+	// When a message is saved within the caller's trace, and a batch fails
+	ctx, parent := provider.Tracer("engine").Start(context.Background(), "send")
+	require.Nil(t, store.SaveMessageContext(ctx, 7, []byte("msg")))
+	parent.End()
+	assert.NotNil(t, store.SaveMessages([]SeqMsg{{SeqNum: 8, Msg: []byte("msg")}}))
+
+	// Then the save should be a child span carrying the session, backend and seqnum
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	assert.Equal(t, "msgstore.save_message", spans[0].Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	session, _ := spanAttr(spans[0], "msgstore.session_id")
+	assert.Equal(t, "FIX.4.4-SENDER-TARGET", session.AsString())
+	backend, _ := spanAttr(spans[0], "msgstore.backend")
+	assert.Equal(t, "memory", backend.AsString())
+	seqNum, _ := spanAttr(spans[0], "msgstore.seqnum")
+	assert.Equal(t, int64(7), seqNum.AsInt64())
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+
+	// And the failed batch a root span marked as an error
+	assert.Equal(t, "msgstore.save_messages", spans[2].Name())
+	assert.False(t, spans[2].Parent().IsValid())
+	assert.Equal(t, codes.Error, spans[2].Status().Code)
+	assert.Equal(t, "disk full", spans[2].Status().Description)
+}
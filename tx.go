@@ -0,0 +1,94 @@
+package msgstore
+
+import "errors"
+
+// ErrTxDone is returned by the operations of a StoreTx that has already been committed or rolled back
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// StoreTx groups writes to a MessageStore so that they are persisted together on Commit, or not at all on Rollback, e.g.
+// an admin message and the two seqnum changes of a logon exchange.  The store's seqnums are only updated once Commit
+// succeeds.  A StoreTx is not safe for concurrent use, and the store must not be written to outside the transaction
+// until it ends.
+type StoreTx interface {
+	SaveMessage(seqNum int, msg []byte) error
+	SetNextSenderMsgSeqNum(next int) error
+	SetNextTargetMsgSeqNum(next int) error
+
+	Commit() error
+	// Rollback discards the writes of the transaction.  It returns ErrTxDone after Commit, so it can be deferred.
+	Rollback() error
+}
+
+// bufferedTx holds the writes of a transaction until Commit makes them on its store
+type bufferedTx struct {
+	store      MessageStore
+	msgs       []SeqMsg
+	nextSender int
+	nextTarget int
+	done       bool
+}
+
+// BeginBufferedTx returns a StoreTx that holds its writes in memory until Commit, which saves the messages in a single
+// SaveMessages and then sets the seqnums.  Commit is only as atomic as those writes of the store are, so a failure part
+// way leaves the earlier ones made.  It implements BeginTx for the MessageStores of the package without native
+// transactions, and is exported for other implementations.
+func BeginBufferedTx(store MessageStore) StoreTx {
+	return &bufferedTx{store: store}
+}
+
+func (tx *bufferedTx) SaveMessage(seqNum int, msg []byte) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.msgs = append(tx.msgs, SeqMsg{SeqNum: seqNum, Msg: msg})
+	return nil
+}
+
+func (tx *bufferedTx) SetNextSenderMsgSeqNum(next int) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.nextSender = next
+	return nil
+}
+
+func (tx *bufferedTx) SetNextTargetMsgSeqNum(next int) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.nextTarget = next
+	return nil
+}
+
+func (tx *bufferedTx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	if len(tx.msgs) > 0 {
+		if err := tx.store.SaveMessages(tx.msgs); err != nil {
+			return err
+		}
+	}
+	if tx.nextSender > 0 {
+		if err := tx.store.SetNextSenderMsgSeqNum(tx.nextSender); err != nil {
+			return err
+		}
+	}
+	if tx.nextTarget > 0 {
+		if err := tx.store.SetNextTargetMsgSeqNum(tx.nextTarget); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *bufferedTx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.msgs = nil
+	return nil
+}
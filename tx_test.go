@@ -0,0 +1,62 @@
+package msgstore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingSaveStore fails every batch save
+type failingSaveStore struct {
+	MessageStore
+}
+
+func (failingSaveStore) SaveMessages([]SeqMsg) error {
+	return errors.New("disk full")
+}
+
+func TestBeginBufferedTx(t *testing.T) {
+	store, err := NewMemoryStoreFactory().Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+
+	// Given a buffered transaction with writes
+	tx := BeginBufferedTx(store)
+	require.Nil(t, tx.SaveMessage(1, []byte("logon")))
+	require.Nil(t, tx.SetNextSenderMsgSeqNum(2))
+	require.Nil(t, tx.SetNextTargetMsgSeqNum(3))
+
+	// Then nothing should be written before Commit
+	assert.Equal(t, 1, store.NextSenderMsgSeqNum())
+	_, found, err := store.GetMessage(1)
+	require.Nil(t, err)
+	assert.False(t, found)
+
+	// And everything on it
+	require.Nil(t, tx.Commit())
+	assert.Equal(t, 2, store.NextSenderMsgSeqNum())
+	assert.Equal(t, 3, store.NextTargetMsgSeqNum())
+	_, found, err = store.GetMessage(1)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, ErrTxDone, tx.Commit())
+}
+
+func TestBeginBufferedTx_CommitFailure(t *testing.T) {
+	memStore, err := NewMemoryStoreFactory().Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(t, err)
+	store := failingSaveStore{memStore}
+
+	// Given a buffered transaction whose messages cannot be saved
+	tx := BeginBufferedTx(store)
+	require.Nil(t, tx.SaveMessage(1, []byte("logon")))
+	require.Nil(t, tx.SetNextSenderMsgSeqNum(2))
+
+	// When it is committed
+	err = tx.Commit()
+
+	// Then the failure should be returned, and the seqnums left as they were
+	assert.EqualError(t, err, "disk full")
+	assert.Equal(t, 1, store.NextSenderMsgSeqNum())
+}
@@ -0,0 +1,75 @@
+package msgstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+)
+
+// creationTimePrecision is the coarsest resolution a backend persists creation times at, the sql store's, to which
+// Verify truncates them so that a creation time copied to such a backend still matches the original
+const creationTimePrecision = time.Second
+
+// Verify compares the seqnums, creation times and messages of the sessions of stores a and b, e.g. the source and
+// destination of Migrate or the two backends of a dual-write deployment, returning the differences found in seqnum
+// order, the session's first.  The messages of both are streamed side by side rather than held in memory.  Neither
+// store must be written to until the comparison ends, unless it is safe for concurrent use.  Creation times are compared
+// to the second, as not every backend keeps them more precisely.
+func Verify(a, b MessageStore) ([]MigrationDifference, error) {
+	var differences []MigrationDifference
+	if aNext, bNext := a.NextSenderMsgSeqNum(), b.NextSenderMsgSeqNum(); aNext != bNext {
+		differences = append(differences, MigrationDifference{Description: fmt.Sprintf("next sender seqnum is %d in store a, %d in store b", aNext, bNext)})
+	}
+	if aNext, bNext := a.NextTargetMsgSeqNum(), b.NextTargetMsgSeqNum(); aNext != bNext {
+		differences = append(differences, MigrationDifference{Description: fmt.Sprintf("next target seqnum is %d in store a, %d in store b", aNext, bNext)})
+	}
+	if aTime, bTime := a.CreationTime(), b.CreationTime(); !aTime.Truncate(creationTimePrecision).Equal(bTime.Truncate(creationTimePrecision)) {
+		differences = append(differences, MigrationDifference{Description: fmt.Sprintf("creation time is %s in store a, %s in store b", aTime, bTime)})
+	}
+
+	endSeqNum, err := lastMessageSeqNum(a)
+	if err != nil {
+		return nil, err
+	}
+	if bEnd, err := lastMessageSeqNum(b); err != nil {
+		return nil, err
+	} else if bEnd > endSeqNum {
+		endSeqNum = bEnd
+	}
+	if endSeqNum < 1 {
+		return differences, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aMsgs, aErrs := StreamMessageStore(ctx, a, 1, endSeqNum)
+	bMsgs, bErrs := StreamMessageStore(ctx, b, 1, endSeqNum)
+
+	aMsg, aOK := <-aMsgs
+	bMsg, bOK := <-bMsgs
+	for aOK || bOK {
+		switch {
+		case aOK && (!bOK || aMsg.SeqNum < bMsg.SeqNum):
+			differences = append(differences, MigrationDifference{SeqNum: aMsg.SeqNum, Description: "message missing from store b"})
+			aMsg, aOK = <-aMsgs
+		case bOK && (!aOK || bMsg.SeqNum < aMsg.SeqNum):
+			differences = append(differences, MigrationDifference{SeqNum: bMsg.SeqNum, Description: "message missing from store a"})
+			bMsg, bOK = <-bMsgs
+		default:
+			if !bytes.Equal(aMsg.Msg, bMsg.Msg) {
+				differences = append(differences, MigrationDifference{SeqNum: aMsg.SeqNum, Description: "message differs between the stores"})
+			}
+			aMsg, aOK = <-aMsgs
+			bMsg, bOK = <-bMsgs
+		}
+	}
+
+	if err := <-aErrs; err != nil {
+		return nil, err
+	}
+	if err := <-bErrs; err != nil {
+		return nil, err
+	}
+	return differences, nil
+}
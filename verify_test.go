@@ -0,0 +1,65 @@
+package msgstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify_Migrated(t *testing.T) {
+	// Given a session migrated to another store
+	src := newMigrationSource(t, 10)
+	dst, _ := NewMemoryStoreFactory().Create("session")
+	require.Nil(t, Migrate(context.Background(), src, dst))
+
+	// When the stores are verified
+	differences, err := Verify(src, dst)
+
+	// Then they should agree
+	require.Nil(t, err)
+	assert.Empty(t, differences)
+}
+
+func TestVerify_CreationTimePrecision(t *testing.T) {
+	// Given a creation time copied to a store that keeps it to the second only
+	a, _ := NewMemoryStoreFactory().Create("session")
+	b, _ := NewMemoryStoreFactory().Create("session")
+	created := time.Date(2024, 3, 1, 12, 0, 0, 123456789, time.UTC)
+	require.Nil(t, a.SetCreationTime(created))
+	require.Nil(t, b.SetCreationTime(created.Truncate(time.Second)))
+
+	// When the stores are verified
+	differences, err := Verify(a, b)
+
+	// Then the creation times should agree
+	require.Nil(t, err)
+	assert.Empty(t, differences)
+}
+
+func TestVerify_Differences(t *testing.T) {
+	// Given two stores that disagree
+	a := newMigrationSource(t, 5)
+	b, _ := NewMemoryStoreFactory().Create("session")
+	require.Nil(t, Migrate(context.Background(), a, b))
+	require.Nil(t, b.SetNextTargetMsgSeqNum(40))
+	require.Nil(t, b.SetCreationTime(time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)))
+	require.Nil(t, b.SaveMessage(2, []byte("altered")))
+	require.Nil(t, b.SaveMessage(7, []byte("extra")))
+	require.Nil(t, b.DeleteMessagesUpTo(1))
+
+	// When they are verified
+	differences, err := Verify(a, b)
+
+	// Then each disagreement should be reported
+	require.Nil(t, err)
+	assert.Equal(t, []MigrationDifference{
+		{Description: "next target seqnum is 42 in store a, 40 in store b"},
+		{Description: "creation time is 2024-03-01 12:00:00 +0000 UTC in store a, 2024-03-02 12:00:00 +0000 UTC in store b"},
+		{SeqNum: 1, Description: "message missing from store b"},
+		{SeqNum: 2, Description: "message differs between the stores"},
+		{SeqNum: 7, Description: "message missing from store a"},
+	}, differences)
+}
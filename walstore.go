@@ -0,0 +1,776 @@
+package msgstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// WALStorePath is the name of the filesystem directory that will hold the logs and checkpoints
+	WALStorePath string = "WALStorePath"
+	// WALStoreCheckpointInterval is how often, as a duration such as "5m", the stores write a checkpoint of their
+	// sessions and truncate their logs, checked as they are written.  Optional, defaults to "5m".
+	WALStoreCheckpointInterval string = "WALStoreCheckpointInterval"
+	// WALStoreSync, when set to "N", leaves the writes to the logs to the operating system to flush, rather than
+	// syncing each to disk before it is acknowledged, trading the writes of the last moments before a crash of the host
+	// for latency.  Flush syncs them.  Optional, defaults to "Y".
+	WALStoreSync string = "WALStoreSync"
+)
+
+// defaultWALCheckpointInterval is how often the stores write a checkpoint unless WALStoreCheckpointInterval is set
+const defaultWALCheckpointInterval = 5 * time.Minute
+
+// walRecord is a mutation written to the log of a WAL store, one per line
+type walRecord struct {
+	// Op is the mutation, named as the operations in the metrics of the backends, e.g. "save_messages" or "commit_tx"
+	Op   string          `json:"op"`
+	Msgs []backupMessage `json:"msgs,omitempty"`
+	// SeqNum is the seqnum up to which "delete_messages" deletes
+	SeqNum int `json:"seq_num,omitempty"`
+	// NextSenderMsgSeqNum and NextTargetMsgSeqNum are the seqnums set, or zero if left as they are
+	NextSenderMsgSeqNum int `json:"next_sender_msg_seq_num,omitempty"`
+	NextTargetMsgSeqNum int `json:"next_target_msg_seq_num,omitempty"`
+	// CreationTime is the creation time set by "set_creation_time" and "reset"
+	CreationTime *time.Time `json:"creation_time,omitempty"`
+	// Key and Value are the session value set by "set_session_value"
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// WALCheckpointer is implemented by the WAL stores, so that applications can checkpoint them when suits them, e.g.
+// before a planned restart
+type WALCheckpointer interface {
+	// Checkpoint writes the session to its checkpoint file and truncates its log
+	Checkpoint() error
+}
+
+type walStoreFactory struct {
+	settings map[string]string
+	clock    Clock
+}
+
+// WALStoreOption configures optional behavior of the stores created by a WAL MessageStoreFactory
+type WALStoreOption func(*walStoreFactory)
+
+// WithWALClock stamps the creation time of the stores with the time told by clock, and times their checkpoints by it.
+// Defaults to the system clock.
+func WithWALClock(clock Clock) WALStoreOption {
+	return func(f *walStoreFactory) { f.clock = clock }
+}
+
+// NewWALStoreFactory returns a MessageStoreFactory of stores that keep their sessions in memory, like the memory
+// stores, and make them durable by appending each mutation to a write-ahead log before applying it.  A store replays
+// its checkpoint and log when it is created, and periodically writes a new checkpoint and truncates its log, so that
+// replay stays short.  The periodic checkpoints are written in the background, the write that finds one due only
+// setting the log aside for a new one.  They are a middle ground between the file stores, which write each message in
+// place, and the memory stores: writes are a single append, and reads never touch the disk.  A torn record at the end
+// of a log, left by a crash during its append, is discarded on replay.
+func NewWALStoreFactory(settings map[string]string, opts ...WALStoreOption) MessageStoreFactory {
+	f := walStoreFactory{settings: settings}
+	for _, opt := range opts {
+		opt(&f)
+	}
+	return f
+}
+
+// Create creates the WAL store of sessionID, replaying its checkpoint and log
+func (f walStoreFactory) Create(sessionID string) (msgStore MessageStore, err error) {
+	dirname, ok := f.settings[WALStorePath]
+	if !ok {
+		return nil, fmt.Errorf("sessionID: %s: required setting not found: %s", sessionID, WALStorePath)
+	}
+	checkpointInterval := defaultWALCheckpointInterval
+	if intervalStr, ok := f.settings[WALStoreCheckpointInterval]; ok {
+		if checkpointInterval, err = time.ParseDuration(intervalStr); err != nil || checkpointInterval <= 0 {
+			return nil, fmt.Errorf("sessionID: %s: invalid setting: %s: must be a positive duration", sessionID, WALStoreCheckpointInterval)
+		}
+	}
+	syncWrites := true
+	if syncStr, ok := f.settings[WALStoreSync]; ok {
+		if syncWrites, err = parseBoolSetting(syncStr); err != nil {
+			return nil, fmt.Errorf("sessionID: %s: invalid setting: %s: %w", sessionID, WALStoreSync, err)
+		}
+	}
+
+	if err := os.MkdirAll(dirname, os.ModePerm); err != nil {
+		return nil, err
+	}
+	store := &walStore{
+		sessionID:          sessionID,
+		cache:              &memoryStore{clock: f.clock},
+		clock:              f.clock,
+		logFname:           path.Join(dirname, fmt.Sprintf("%s.%s", sessionID, "wal")),
+		oldLogFname:        path.Join(dirname, fmt.Sprintf("%s.%s", sessionID, "wal.old")),
+		checkpointFname:    path.Join(dirname, fmt.Sprintf("%s.%s", sessionID, "checkpoint")),
+		valuesFname:        path.Join(dirname, fmt.Sprintf("%s.%s", sessionID, "values")),
+		checkpointInterval: checkpointInterval,
+		syncWrites:         syncWrites,
+	}
+	if err := store.open(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Close is a no-op, the stores having no resources shared between them
+func (f walStoreFactory) Close() error {
+	return nil
+}
+
+type walStore struct {
+	sessionID          string
+	cache              *memoryStore
+	clock              Clock
+	logFname           string
+	oldLogFname        string
+	checkpointFname    string
+	valuesFname        string
+	checkpointInterval time.Duration
+	syncWrites         bool
+
+	mu        sync.Mutex
+	logFile   *os.File
+	logOffset int64
+	// oldLog reports whether the log set aside by the last checkpoint is yet to be removed, and checkpointDone is
+	// closed once the checkpoint being written in the background, if any, is done
+	oldLog         bool
+	checkpointDone chan struct{}
+	lastCheckpoint time.Time
+}
+
+// open replays the checkpoint and log of the session into the cache, and opens the log for appending
+func (store *walStore) open() error {
+	store.cache.Reset()
+
+	checkpointed := false
+	if f, err := os.Open(store.checkpointFname); err == nil {
+		err = RestoreMessageStore(store.cache, bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("unable to replay checkpoint: %s: %w", store.checkpointFname, err)
+		}
+		checkpointed = true
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if valuesBytes, err := ioutil.ReadFile(store.valuesFname); err == nil {
+		if err := json.Unmarshal(valuesBytes, &store.cache.sessionValues); err != nil {
+			return fmt.Errorf("unable to replay file: %s: %w", store.valuesFname, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// the log set aside by a checkpoint interrupted before it was removed precedes the log
+	if oldLogFile, err := os.OpenFile(store.oldLogFname, os.O_RDWR, 0660); err == nil {
+		_, _, err = store.replay(oldLogFile)
+		oldLogFile.Close()
+		if err != nil {
+			return err
+		}
+		store.oldLog = true
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	logFile, err := openOrCreateFile(store.logFname, 0660)
+	if err != nil {
+		return err
+	}
+	logged, offset, err := store.replay(logFile)
+	if err != nil {
+		logFile.Close()
+		return err
+	}
+	store.logFile = logFile
+	store.logOffset = offset
+
+	// a new session is checkpointed straight away, for its creation time to survive a restart, as is one whose
+	// checkpoint was interrupted
+	if (!checkpointed && !logged) || store.oldLog {
+		return store.checkpoint()
+	}
+	store.lastCheckpoint = clockNow(store.clock)
+	return nil
+}
+
+// replay applies the records of the log to the cache, reporting whether it had any and the offset of its end.  A torn
+// record at the end of the log is truncated, for the records appended after it to be replayed.
+func (store *walStore) replay(logFile *os.File) (logged bool, offset int64, err error) {
+	r := bufio.NewReader(logFile)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				if err := logFile.Truncate(offset); err != nil {
+					return logged, offset, fmt.Errorf("unable to truncate file: %s: %w", logFile.Name(), err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			return logged, offset, fmt.Errorf("unable to read file: %s: %w", logFile.Name(), err)
+		}
+
+		var record walRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return logged, offset, fmt.Errorf("unable to replay file: %s: corrupt record at offset %d: %w", logFile.Name(), offset, err)
+		}
+		if err := store.apply(record); err != nil {
+			return logged, offset, fmt.Errorf("unable to replay file: %s: %w", logFile.Name(), err)
+		}
+		offset += int64(len(line))
+		logged = true
+	}
+	_, err = logFile.Seek(offset, io.SeekStart)
+	return logged, offset, err
+}
+
+// apply makes the mutation of record on the cache
+func (store *walStore) apply(record walRecord) error {
+	msgs := make([]SeqMsg, len(record.Msgs))
+	for i, msg := range record.Msgs {
+		msgs[i] = SeqMsg{SeqNum: msg.SeqNum, Msg: msg.Message}
+	}
+
+	switch record.Op {
+	case "save_messages", "commit_tx", "set_next_sender_seqnum", "set_next_target_seqnum":
+		if len(msgs) > 0 {
+			if err := store.cache.SaveMessages(msgs); err != nil {
+				return err
+			}
+		}
+		if record.NextSenderMsgSeqNum > 0 {
+			if err := store.cache.SetNextSenderMsgSeqNum(record.NextSenderMsgSeqNum); err != nil {
+				return err
+			}
+		}
+		if record.NextTargetMsgSeqNum > 0 {
+			return store.cache.SetNextTargetMsgSeqNum(record.NextTargetMsgSeqNum)
+		}
+		return nil
+	case "set_creation_time":
+		return store.cache.SetCreationTime(*record.CreationTime)
+	case "set_session_value":
+		return store.cache.SetSessionValue(record.Key, record.Value)
+	case "delete_messages":
+		return store.cache.DeleteMessagesUpTo(record.SeqNum)
+	case "reset":
+		if err := store.cache.Reset(); err != nil {
+			return err
+		}
+		return store.cache.SetCreationTime(*record.CreationTime)
+	}
+	return fmt.Errorf("unknown record: %s", record.Op)
+}
+
+// write appends record to the log, then applies it to the cache, and checkpoints the session if it is due
+func (store *walStore) write(record walRecord) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.writeLocked(record)
+}
+
+// writeLocked is write for a locked store.  A record that fails to be appended or synced is truncated from the log, so
+// that the records appended after it are not lost behind a torn one on replay.
+func (store *walStore) writeLocked(record walRecord) error {
+	if store.logFile == nil {
+		return fmt.Errorf("store is closed: %s", store.sessionID)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := store.logFile.Write(append(line, '\n')); err != nil {
+		return store.discardWrite(fmt.Errorf("unable to write to file: %s: %w", store.logFname, err))
+	}
+	if store.syncWrites {
+		if err := store.logFile.Sync(); err != nil {
+			return store.discardWrite(fmt.Errorf("unable to flush file: %s: %w", store.logFname, err))
+		}
+	}
+	store.logOffset += int64(len(line)) + 1
+	if err := store.apply(record); err != nil {
+		return err
+	}
+
+	if store.checkpointDone == nil && clockNow(store.clock).Sub(store.lastCheckpoint) >= store.checkpointInterval {
+		// the log set aside by a checkpoint that failed in the background is still needed, so it is retried in place
+		if store.oldLog {
+			return store.checkpoint()
+		}
+		return store.startCheckpoint()
+	}
+	return nil
+}
+
+// discardWrite truncates the log back to the end of its last record after err failed a write.  Should the log not be
+// truncated, it is closed, for no record to be appended after the torn one.
+func (store *walStore) discardWrite(err error) error {
+	if truncErr := store.logFile.Truncate(store.logOffset); truncErr == nil {
+		if _, truncErr = store.logFile.Seek(store.logOffset, io.SeekStart); truncErr == nil {
+			return err
+		}
+	}
+	store.logFile.Close()
+	store.logFile = nil
+	return fmt.Errorf("%w, closing the store: unable to truncate file: %s", err, store.logFname)
+}
+
+// snapshot returns the session values and the cache as written to the checkpoint files, the values nil if there are
+// none.  The store must be locked.
+func (store *walStore) snapshot() (values, checkpoint []byte, err error) {
+	if len(store.cache.sessionValues) > 0 {
+		if values, err = json.Marshal(store.cache.sessionValues); err != nil {
+			return nil, nil, err
+		}
+	}
+	var buf bytes.Buffer
+	if err := BackupMessageStore(store.cache, &buf); err != nil {
+		return nil, nil, err
+	}
+	return values, buf.Bytes(), nil
+}
+
+// writeCheckpoint writes values and checkpoint to new files, replacing the last, and syncs the directory so that the
+// renames are durable before the logs they replace are truncated or removed.  Should it stop after a rename, the
+// records left in the logs replay to the same state over the files.
+func (store *walStore) writeCheckpoint(values, checkpoint []byte) error {
+	if values != nil {
+		tmpValuesFname := store.valuesFname + ".tmp"
+		if err := writeFileSync(tmpValuesFname, values); err != nil {
+			return err
+		}
+		if err := os.Rename(tmpValuesFname, store.valuesFname); err != nil {
+			return fmt.Errorf("unable to rename file: %s: %w", tmpValuesFname, err)
+		}
+	}
+
+	tmpFname := store.checkpointFname + ".tmp"
+	if err := writeFileSync(tmpFname, checkpoint); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFname, store.checkpointFname); err != nil {
+		return fmt.Errorf("unable to rename file: %s: %w", tmpFname, err)
+	}
+	return syncDir(path.Dir(store.checkpointFname))
+}
+
+// checkpoint writes the session to the checkpoint files, then removes any log set aside and truncates the log.  The
+// store must be locked, with no checkpoint being written in the background.
+func (store *walStore) checkpoint() error {
+	values, checkpoint, err := store.snapshot()
+	if err != nil {
+		return err
+	}
+	if err := store.writeCheckpoint(values, checkpoint); err != nil {
+		return err
+	}
+
+	if err := removeFile(store.oldLogFname); err != nil {
+		return err
+	}
+	store.oldLog = false
+	if err := store.logFile.Truncate(0); err != nil {
+		return fmt.Errorf("unable to truncate file: %s: %w", store.logFname, err)
+	}
+	if _, err := store.logFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	store.logOffset = 0
+	store.lastCheckpoint = clockNow(store.clock)
+	return nil
+}
+
+// startCheckpoint snapshots the session and sets its log aside for a new one, then writes the snapshot to the
+// checkpoint files in the background, removing the log set aside once they are durable.  The store must be locked.
+func (store *walStore) startCheckpoint() error {
+	values, checkpoint, err := store.snapshot()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(store.logFname, store.oldLogFname); err != nil {
+		return fmt.Errorf("unable to rename file: %s: %w", store.logFname, err)
+	}
+	logFile, err := openOrCreateFile(store.logFname, 0660)
+	if err == nil {
+		if err = syncDir(path.Dir(store.logFname)); err != nil {
+			logFile.Close()
+		}
+	}
+	if err != nil {
+		if renameErr := os.Rename(store.oldLogFname, store.logFname); renameErr != nil {
+			return fmt.Errorf("unable to rename file: %s: %w", store.oldLogFname, renameErr)
+		}
+		return err
+	}
+	store.logFile.Close()
+	store.logFile = logFile
+	store.logOffset = 0
+	store.oldLog = true
+
+	done := make(chan struct{})
+	store.checkpointDone = done
+	go func() {
+		err := store.writeCheckpoint(values, checkpoint)
+
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		if err == nil && removeFile(store.oldLogFname) == nil {
+			store.oldLog = false
+			store.lastCheckpoint = clockNow(store.clock)
+		}
+		store.checkpointDone = nil
+		close(done)
+	}()
+	return nil
+}
+
+// lockIdle locks the store once no checkpoint is being written in the background
+func (store *walStore) lockIdle() {
+	store.mu.Lock()
+	for store.checkpointDone != nil {
+		done := store.checkpointDone
+		store.mu.Unlock()
+		<-done
+		store.mu.Lock()
+	}
+}
+
+// Checkpoint writes the session to its checkpoint file and truncates its log, see WALCheckpointer
+func (store *walStore) Checkpoint() (err error) {
+	defer wrapStoreError("wal", store.sessionID, "checkpoint", 0, &err)
+
+	store.lockIdle()
+	defer store.mu.Unlock()
+
+	if store.logFile == nil {
+		return fmt.Errorf("store is closed: %s", store.sessionID)
+	}
+	return store.checkpoint()
+}
+
+// msgRecords returns msgs as the records of the log
+func msgRecords(msgs []SeqMsg) []backupMessage {
+	records := make([]backupMessage, len(msgs))
+	for i, msg := range msgs {
+		records[i] = backupMessage{SeqNum: msg.SeqNum, Message: msg.Msg}
+	}
+	return records
+}
+
+func (store *walStore) NextSenderMsgSeqNum() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.cache.NextSenderMsgSeqNum()
+}
+
+func (store *walStore) NextTargetMsgSeqNum() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.cache.NextTargetMsgSeqNum()
+}
+
+// IncrNextSenderMsgSeqNum logs the seqnum it sets, so that replaying it twice does not increment it twice
+func (store *walStore) IncrNextSenderMsgSeqNum() (err error) {
+	defer wrapStoreError("wal", store.sessionID, "incr_next_sender_seqnum", 0, &err)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.writeLocked(walRecord{Op: "set_next_sender_seqnum", NextSenderMsgSeqNum: store.cache.NextSenderMsgSeqNum() + 1})
+}
+
+// IncrNextTargetMsgSeqNum logs the seqnum it sets, so that replaying it twice does not increment it twice
+func (store *walStore) IncrNextTargetMsgSeqNum() (err error) {
+	defer wrapStoreError("wal", store.sessionID, "incr_next_target_seqnum", 0, &err)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.writeLocked(walRecord{Op: "set_next_target_seqnum", NextTargetMsgSeqNum: store.cache.NextTargetMsgSeqNum() + 1})
+}
+
+func (store *walStore) SetNextSenderMsgSeqNum(next int) (err error) {
+	defer wrapStoreError("wal", store.sessionID, "set_next_sender_seqnum", 0, &err)
+
+	return store.write(walRecord{Op: "set_next_sender_seqnum", NextSenderMsgSeqNum: next})
+}
+
+func (store *walStore) SetNextTargetMsgSeqNum(next int) (err error) {
+	defer wrapStoreError("wal", store.sessionID, "set_next_target_seqnum", 0, &err)
+
+	return store.write(walRecord{Op: "set_next_target_seqnum", NextTargetMsgSeqNum: next})
+}
+
+func (store *walStore) CreationTime() time.Time {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.cache.CreationTime()
+}
+
+func (store *walStore) SetCreationTime(t time.Time) (err error) {
+	defer wrapStoreError("wal", store.sessionID, "set_creation_time", 0, &err)
+
+	return store.write(walRecord{Op: "set_creation_time", CreationTime: &t})
+}
+
+func (store *walStore) SaveMessage(seqNum int, msg []byte) (err error) {
+	defer wrapStoreError("wal", store.sessionID, "save_message", seqNum, &err)
+
+	return store.write(walRecord{Op: "save_messages", Msgs: []backupMessage{{SeqNum: seqNum, Message: msg}}})
+}
+
+func (store *walStore) SaveMessages(msgs []SeqMsg) (err error) {
+	defer wrapStoreError("wal", store.sessionID, "save_messages", 0, &err)
+
+	if len(msgs) == 0 {
+		return nil
+	}
+	return store.write(walRecord{Op: "save_messages", Msgs: msgRecords(msgs)})
+}
+
+func (store *walStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.cache.GetMessages(beginSeqNum, endSeqNum)
+}
+
+func (store *walStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return GetMessagesAfter(store, seqNum)
+}
+
+func (store *walStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return GetMessagesReversed(store, beginSeqNum, endSeqNum)
+}
+
+func (store *walStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.cache.GetMessage(seqNum)
+}
+
+// IterateMessages passes fn the messages of a copy of the range, so that fn may use the store
+func (store *walStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	var msgs []SeqMsg
+	store.mu.Lock()
+	err := store.cache.IterateMessages(beginSeqNum, endSeqNum, func(seqNum int, msg []byte) error {
+		msgs = append(msgs, SeqMsg{SeqNum: seqNum, Msg: msg})
+		return nil
+	})
+	store.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		if err := fn(msg.SeqNum, msg.Msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *walStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+func (store *walStore) MessageCount() (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.cache.MessageCount()
+}
+
+func (store *walStore) FirstSeqNum() (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.cache.FirstSeqNum()
+}
+
+func (store *walStore) LastSeqNum() (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.cache.LastSeqNum()
+}
+
+func (store *walStore) DeleteMessagesUpTo(seqNum int) (err error) {
+	defer wrapStoreError("wal", store.sessionID, "delete_messages", seqNum, &err)
+
+	return store.write(walRecord{Op: "delete_messages", SeqNum: seqNum})
+}
+
+// SetSessionValue stores value under key, see SessionValueStore
+func (store *walStore) SetSessionValue(key, value string) (err error) {
+	defer wrapStoreError("wal", store.sessionID, "set_session_value", 0, &err)
+
+	return store.write(walRecord{Op: "set_session_value", Key: key, Value: value})
+}
+
+// GetSessionValue returns the value stored under key, see SessionValueStore
+func (store *walStore) GetSessionValue(key string) (string, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.cache.GetSessionValue(key)
+}
+
+// BeginTx returns a transaction holding its writes until Commit logs them as a single record, so that they are
+// replayed together or not at all
+func (store *walStore) BeginTx() (StoreTx, error) {
+	return &walTx{bufferedTx: &bufferedTx{store: store}, store: store}, nil
+}
+
+func (store *walStore) Backup(w io.Writer) error {
+	return BackupMessageStore(store, w)
+}
+
+// Restore restores the archive into the cache and checkpoints it, so that it is not logged
+func (store *walStore) Restore(r io.Reader) (err error) {
+	defer wrapStoreError("wal", store.sessionID, "restore", 0, &err)
+
+	store.lockIdle()
+	defer store.mu.Unlock()
+
+	if err := RestoreMessageStore(store.cache, r); err != nil {
+		return err
+	}
+	return store.checkpoint()
+}
+
+func (store *walStore) HealthCheck(ctx context.Context) (err error) {
+	defer wrapStoreError("wal", store.sessionID, "health_check", 0, &err)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.logFile == nil {
+		return fmt.Errorf("store is closed: %s", store.sessionID)
+	}
+	if _, err := store.logFile.Stat(); err != nil {
+		return fmt.Errorf("unable to stat file: %s: %w", store.logFname, err)
+	}
+	return nil
+}
+
+// Flush syncs the log to disk, which matters only under WALStoreSync "N"
+func (store *walStore) Flush() (err error) {
+	defer wrapStoreError("wal", store.sessionID, "flush", 0, &err)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.logFile == nil {
+		return nil
+	}
+	if err := store.logFile.Sync(); err != nil {
+		return fmt.Errorf("unable to flush file: %s: %w", store.logFname, err)
+	}
+	return nil
+}
+
+// Refresh is a no-op, the log being written by this store alone
+func (store *walStore) Refresh() error {
+	return nil
+}
+
+func (store *walStore) Reset() (err error) {
+	defer wrapStoreError("wal", store.sessionID, "reset", 0, &err)
+
+	t := clockNow(store.clock)
+	return store.write(walRecord{Op: "reset", CreationTime: &t})
+}
+
+// Close checkpoints the session, so that the next store of the session need not replay its log, and closes the log
+func (store *walStore) Close() error {
+	store.lockIdle()
+	defer store.mu.Unlock()
+
+	if store.logFile == nil {
+		return nil
+	}
+	err := store.checkpoint()
+	if closeErr := store.logFile.Close(); err == nil {
+		err = closeErr
+	}
+	store.logFile = nil
+	return err
+}
+
+// walTx is a buffered transaction of a walStore, whose Commit logs its writes as a single record
+type walTx struct {
+	*bufferedTx
+	store *walStore
+}
+
+func (tx *walTx) Commit() (err error) {
+	defer wrapStoreError("wal", tx.store.sessionID, "commit_tx", 0, &err)
+
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	if len(tx.msgs) == 0 && tx.nextSender == 0 && tx.nextTarget == 0 {
+		return nil
+	}
+	return tx.store.write(walRecord{
+		Op:                  "commit_tx",
+		Msgs:                msgRecords(tx.msgs),
+		NextSenderMsgSeqNum: tx.nextSender,
+		NextTargetMsgSeqNum: tx.nextTarget,
+	})
+}
+
+// writeFileSync writes data to the file fname, replacing its contents, and syncs it to disk
+func writeFileSync(fname string, data []byte) error {
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return fmt.Errorf("unable to create file: %s: %w", fname, err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("unable to write to file: %s: %w", fname, err)
+	}
+	return nil
+}
+
+// syncDir syncs the directory dirname to disk, making durable the files created, renamed or removed in it
+func syncDir(dirname string) error {
+	dir, err := os.Open(dirname)
+	if err != nil {
+		return fmt.Errorf("unable to open directory: %s: %w", dirname, err)
+	}
+	err = dir.Sync()
+	dir.Close()
+	if err != nil {
+		return fmt.Errorf("unable to flush directory: %s: %w", dirname, err)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package msgstore
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// WALStoreTestSuite runs all tests in the MessageStoreTestSuite against the WAL store implementation
+type WALStoreTestSuite struct {
+	MessageStoreTestSuite
+	walStoreRootPath string
+}
+
+func (suite *WALStoreTestSuite) SetupTest() {
+	suite.walStoreRootPath = path.Join(os.TempDir(), fmt.Sprintf("WALStoreTestSuite-%d", os.Getpid()))
+	settings := map[string]string{WALStorePath: path.Join(suite.walStoreRootPath, fmt.Sprintf("%d", time.Now().UnixNano()))}
+
+	var err error
+	suite.msgStore, err = NewWALStoreFactory(settings).Create("FIX.4.4-SENDER-TARGET")
+	require.Nil(suite.T(), err)
+}
+
+func (suite *WALStoreTestSuite) TearDownTest() {
+	suite.msgStore.Close()
+	os.RemoveAll(suite.walStoreRootPath)
+}
+
+func TestWALStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(WALStoreTestSuite))
+}
+
+func TestWALStore_Replay(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("WALStoreReplay-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+
+	// Given a WAL store written to without being closed
+	clock := &manualClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	factory := NewWALStoreFactory(map[string]string{WALStorePath: rootPath, WALStoreSync: "N"}, WithWALClock(clock))
+	store, err := factory.Create("FIX.4.4-A-B")
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessage(1, []byte("msg1")))
+	require.Nil(t, store.IncrNextSenderMsgSeqNum())
+	tx, err := store.BeginTx()
+	require.Nil(t, err)
+	require.Nil(t, tx.SaveMessage(2, []byte("msg2")))
+	require.Nil(t, tx.SetNextSenderMsgSeqNum(3))
+	require.Nil(t, tx.SetNextTargetMsgSeqNum(5))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, store.DeleteMessagesUpTo(1))
+	require.Nil(t, store.Flush())
+
+	// And a record torn by a crash during its append
+	f, err := os.OpenFile(path.Join(rootPath, "FIX.4.4-A-B.wal"), os.O_WRONLY|os.O_APPEND, 0660)
+	require.Nil(t, err)
+	_, err = f.WriteString(`{"op":"save_messages","msgs":[{"seq_num":3,`)
+	require.Nil(t, err)
+	f.Close()
+
+	// When the session is created again
+	clock.Set(clock.Now().Add(time.Hour))
+	replayed, err := factory.Create("FIX.4.4-A-B")
+	require.Nil(t, err)
+	defer replayed.Close()
+
+	// Then its state should be replayed from the log, without the torn record
+	assert.Equal(t, 3, replayed.NextSenderMsgSeqNum())
+	assert.Equal(t, 5, replayed.NextTargetMsgSeqNum())
+	assert.True(t, replayed.CreationTime().Equal(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)))
+	msgs, err := replayed.GetMessages(1, 3)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("msg2")}, msgs)
+
+	// And it should be appended to after the last complete record
+	require.Nil(t, replayed.SaveMessage(3, []byte("msg3")))
+	msg, found, err := replayed.GetMessage(3)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("msg3"), msg)
+}
+
+func TestWALStore_Checkpoint(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("WALStoreCheckpoint-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+
+	// Given a WAL store checkpointing every minute
+	clock := &manualClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	factory := NewWALStoreFactory(map[string]string{WALStorePath: rootPath, WALStoreCheckpointInterval: "1m"}, WithWALClock(clock))
+	store, err := factory.Create("FIX.4.4-A-B")
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessage(1, []byte("msg1")))
+	logInfo, err := os.Stat(path.Join(rootPath, "FIX.4.4-A-B.wal"))
+	require.Nil(t, err)
+	assert.NotEqual(t, int64(0), logInfo.Size())
+
+	// When it is written after a minute
+	clock.Set(clock.Now().Add(time.Minute))
+	require.Nil(t, store.SaveMessage(2, []byte("msg2")))
+
+	// Then its log should be set aside for a checkpoint written in the background, and removed once it is
+	logInfo, err = os.Stat(path.Join(rootPath, "FIX.4.4-A-B.wal"))
+	require.Nil(t, err)
+	assert.Equal(t, int64(0), logInfo.Size())
+	store.(*walStore).lockIdle()
+	store.(*walStore).mu.Unlock()
+	_, err = os.Stat(path.Join(rootPath, "FIX.4.4-A-B.wal.old"))
+	assert.True(t, os.IsNotExist(err))
+
+	// And the session should be replayed from the checkpoint and the records logged after it
+	require.Nil(t, store.SetNextTargetMsgSeqNum(7))
+	replayed, err := factory.Create("FIX.4.4-A-B")
+	require.Nil(t, err)
+	defer replayed.Close()
+	assert.Equal(t, 7, replayed.NextTargetMsgSeqNum())
+	msgs, err := replayed.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("msg1"), []byte("msg2")}, msgs)
+}
+
+func TestWALStore_InterruptedCheckpoint(t *testing.T) {
+	rootPath := path.Join(os.TempDir(), fmt.Sprintf("WALStoreInterruptedCheckpoint-%d", os.Getpid()))
+	defer os.RemoveAll(rootPath)
+
+	// Given a log set aside for a checkpoint that was never written, and records logged after it
+	factory := NewWALStoreFactory(map[string]string{WALStorePath: rootPath})
+	store, err := factory.Create("FIX.4.4-A-B")
+	require.Nil(t, err)
+	require.Nil(t, store.SaveMessage(1, []byte("msg1")))
+	require.Nil(t, os.Rename(path.Join(rootPath, "FIX.4.4-A-B.wal"), path.Join(rootPath, "FIX.4.4-A-B.wal.old")))
+	logFile, err := os.Create(path.Join(rootPath, "FIX.4.4-A-B.wal"))
+	require.Nil(t, err)
+	store.(*walStore).logFile = logFile
+	store.(*walStore).logOffset = 0
+	require.Nil(t, store.SaveMessage(2, []byte("msg2")))
+
+	// When the session is created again
+	replayed, err := factory.Create("FIX.4.4-A-B")
+	require.Nil(t, err)
+	defer replayed.Close()
+
+	// Then both logs should be replayed, in order, into a new checkpoint
+	msgs, err := replayed.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("msg1"), []byte("msg2")}, msgs)
+	_, err = os.Stat(path.Join(rootPath, "FIX.4.4-A-B.wal.old"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWALStoreFactory_Settings(t *testing.T) {
+	_, err := NewWALStoreFactory(map[string]string{}).Create("FIX.4.4-A-B")
+	assert.EqualError(t, err, "sessionID: FIX.4.4-A-B: required setting not found: WALStorePath")
+
+	_, err = NewWALStoreFactory(map[string]string{WALStorePath: os.TempDir(), WALStoreCheckpointInterval: "0s"}).Create("FIX.4.4-A-B")
+	assert.EqualError(t, err, "sessionID: FIX.4.4-A-B: invalid setting: WALStoreCheckpointInterval: must be a positive duration")
+}
@@ -0,0 +1,276 @@
+package msgstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// authenticatedMessageMarker leads every message stored by a WORM store, followed by the length and bytes of the ID of
+// the key it is authenticated under, its HMAC-SHA256 and the message
+const authenticatedMessageMarker byte = 0x05
+
+var (
+	// ErrWriteOnce is matched by the WriteOnceError of every operation a WORM store refuses, see NewWORMStore
+	ErrWriteOnce = errors.New("message store is write-once")
+	// ErrMessageTampered is returned, wrapped, by the reads of a WORM store for a message failing its integrity check
+	ErrMessageTampered = errors.New("message failed its integrity check")
+)
+
+// WriteOnceError is returned by the operations of a WORM store that would overwrite or destroy stored data, which are
+// refused without reaching its backend
+type WriteOnceError struct {
+	// Op is the name of the refused operation, as reported to metrics, e.g. "save_message"
+	Op string
+	// SeqNum is the seqnum of the message already stored, or 0 if the operation was given none
+	SeqNum int
+}
+
+func (e *WriteOnceError) Error() string {
+	if e.SeqNum > 0 {
+		return fmt.Sprintf("msgstore: %s of seqnum %d: %s", e.Op, e.SeqNum, ErrWriteOnce.Error())
+	}
+	return fmt.Sprintf("msgstore: %s: %s", e.Op, ErrWriteOnce.Error())
+}
+
+// Is reports whether target is ErrWriteOnce, so that callers can test for any refused operation with errors.Is
+func (e *WriteOnceError) Is(target error) bool {
+	return target == ErrWriteOnce
+}
+
+type wormStore struct {
+	inner     MessageStore
+	sessionID string
+	provider  MessageKeyProvider
+}
+
+// NewWORMStore returns a MessageStore enforcing write-once semantics on inner, a store of sessionID, for retention
+// regimes such as SEC 17a-4: saves for a seqnum a message is stored for, Reset, DeleteMessagesUpTo and Restore are
+// refused with a WriteOnceError.  A session is instead reset with ResetWithoutDeletingMessages, see SeqNumResetter,
+// where inner implements it.  Each message is stored behind an HMAC-SHA256 of the session, its seqnum and itself under
+// the current key of provider, which every read verifies, failing with ErrMessageTampered for a message that was
+// altered, moved or stored without one.  The seqnums and creation time are kept by inner as they are.
+//
+// Saves check for a stored message before saving, which does not exclude a concurrent writer of the session; give inner
+// the DuplicateMessageError policy to have the backend refuse overwrites too.
+func NewWORMStore(inner MessageStore, sessionID string, provider MessageKeyProvider) MessageStore {
+	return &wormStore{inner: inner, sessionID: sessionID, provider: provider}
+}
+
+// mac returns the HMAC-SHA256 of msg stored for seqNum under key
+func (store *wormStore) mac(key []byte, seqNum int, msg []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	var lengths [12]byte
+	binary.BigEndian.PutUint32(lengths[:4], uint32(len(store.sessionID)))
+	binary.BigEndian.PutUint64(lengths[4:], uint64(seqNum))
+	h.Write(lengths[:4])
+	h.Write([]byte(store.sessionID))
+	h.Write(lengths[4:])
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// seal returns msg behind the marker, key ID and HMAC under the provider's current key
+func (store *wormStore) seal(seqNum int, msg []byte) ([]byte, error) {
+	keyID, key, err := store.provider.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get HMAC key: %w", err)
+	}
+	if len(keyID) > 255 {
+		return nil, fmt.Errorf("HMAC key ID is longer than 255 bytes: %s", keyID)
+	}
+
+	sealed := append([]byte{authenticatedMessageMarker, byte(len(keyID))}, keyID...)
+	sealed = append(sealed, store.mac(key, seqNum, msg)...)
+	return append(sealed, msg...), nil
+}
+
+// open verifies a message sealed by seal for seqNum, returning the message
+func (store *wormStore) open(seqNum int, sealed []byte) ([]byte, error) {
+	if len(sealed) < 2 || sealed[0] != authenticatedMessageMarker || len(sealed) < 2+int(sealed[1])+sha256.Size {
+		return nil, fmt.Errorf("seqnum %d: %w", seqNum, ErrMessageTampered)
+	}
+	keyID := string(sealed[2 : 2+int(sealed[1])])
+	mac := sealed[2+int(sealed[1]) : 2+int(sealed[1])+sha256.Size]
+	msg := sealed[2+int(sealed[1])+sha256.Size:]
+
+	key, err := store.provider.Key(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get HMAC key: %s: %w", keyID, err)
+	}
+	if !hmac.Equal(mac, store.mac(key, seqNum, msg)) {
+		return nil, fmt.Errorf("seqnum %d: %w", seqNum, ErrMessageTampered)
+	}
+	return msg, nil
+}
+
+// checkUnwritten refuses op if a message is stored for seqNum
+func (store *wormStore) checkUnwritten(op string, seqNum int) error {
+	_, found, err := store.inner.GetMessage(seqNum)
+	if err != nil {
+		return err
+	}
+	if found {
+		return &WriteOnceError{Op: op, SeqNum: seqNum}
+	}
+	return nil
+}
+
+func (store *wormStore) NextSenderMsgSeqNum() int {
+	return store.inner.NextSenderMsgSeqNum()
+}
+
+func (store *wormStore) NextTargetMsgSeqNum() int {
+	return store.inner.NextTargetMsgSeqNum()
+}
+
+func (store *wormStore) IncrNextSenderMsgSeqNum() error {
+	return store.inner.IncrNextSenderMsgSeqNum()
+}
+
+func (store *wormStore) IncrNextTargetMsgSeqNum() error {
+	return store.inner.IncrNextTargetMsgSeqNum()
+}
+
+func (store *wormStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.inner.SetNextSenderMsgSeqNum(next)
+}
+
+func (store *wormStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.inner.SetNextTargetMsgSeqNum(next)
+}
+
+func (store *wormStore) CreationTime() time.Time {
+	return store.inner.CreationTime()
+}
+
+func (store *wormStore) SetCreationTime(t time.Time) error {
+	return store.inner.SetCreationTime(t)
+}
+
+func (store *wormStore) SaveMessage(seqNum int, msg []byte) error {
+	if err := store.checkUnwritten("save_message", seqNum); err != nil {
+		return err
+	}
+	sealed, err := store.seal(seqNum, msg)
+	if err != nil {
+		return err
+	}
+	return store.inner.SaveMessage(seqNum, sealed)
+}
+
+// SaveMessages refuses the whole batch if any of its seqnums is stored, or repeated within it
+func (store *wormStore) SaveMessages(msgs []SeqMsg) error {
+	sealed := make([]SeqMsg, len(msgs))
+	seen := make(map[int]bool, len(msgs))
+	for i, m := range msgs {
+		if seen[m.SeqNum] {
+			return &WriteOnceError{Op: "save_messages", SeqNum: m.SeqNum}
+		}
+		seen[m.SeqNum] = true
+		if err := store.checkUnwritten("save_messages", m.SeqNum); err != nil {
+			return err
+		}
+		msg, err := store.seal(m.SeqNum, m.Msg)
+		if err != nil {
+			return err
+		}
+		sealed[i] = SeqMsg{SeqNum: m.SeqNum, Msg: msg}
+	}
+	return store.inner.SaveMessages(sealed)
+}
+
+func (store *wormStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	var msgs [][]byte
+	err := store.IterateMessages(beginSeqNum, endSeqNum, func(seqNum int, msg []byte) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	return msgs, err
+}
+
+func (store *wormStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	return GetMessagesAfter(store, seqNum)
+}
+
+func (store *wormStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return GetMessagesReversed(store, beginSeqNum, endSeqNum)
+}
+
+func (store *wormStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	sealed, found, err := store.inner.GetMessage(seqNum)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	msg, err := store.open(seqNum, sealed)
+	if err != nil {
+		return nil, false, err
+	}
+	return msg, true, nil
+}
+
+func (store *wormStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.inner.IterateMessages(beginSeqNum, endSeqNum, func(seqNum int, sealed []byte) error {
+		msg, err := store.open(seqNum, sealed)
+		if err != nil {
+			return err
+		}
+		return fn(seqNum, msg)
+	})
+}
+
+func (store *wormStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+func (store *wormStore) DeleteMessagesUpTo(seqNum int) error {
+	return &WriteOnceError{Op: "delete_messages"}
+}
+
+func (store *wormStore) BeginTx() (StoreTx, error) {
+	return BeginBufferedTx(store), nil
+}
+
+// Backup writes the archive of inner, in which the messages keep their HMACs
+func (store *wormStore) Backup(w io.Writer) error {
+	return store.inner.Backup(w)
+}
+
+func (store *wormStore) Restore(r io.Reader) error {
+	return &WriteOnceError{Op: "restore"}
+}
+
+func (store *wormStore) HealthCheck(ctx context.Context) error {
+	return store.inner.HealthCheck(ctx)
+}
+
+func (store *wormStore) Flush() error {
+	return store.inner.Flush()
+}
+
+func (store *wormStore) Refresh() error {
+	return store.inner.Refresh()
+}
+
+func (store *wormStore) Reset() error {
+	return &WriteOnceError{Op: "reset"}
+}
+
+// ResetWithoutDeletingMessages resets the session keeping its messages, where inner implements SeqNumResetter, and is
+// refused otherwise
+func (store *wormStore) ResetWithoutDeletingMessages() error {
+	resetter, ok := store.inner.(SeqNumResetter)
+	if !ok {
+		return &WriteOnceError{Op: "reset"}
+	}
+	return resetter.ResetWithoutDeletingMessages()
+}
+
+func (store *wormStore) Close() error {
+	return store.inner.Close()
+}
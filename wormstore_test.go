@@ -0,0 +1,90 @@
+package msgstore
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWORMStore(t *testing.T) {
+	// Given a WORM store
+	provider := newStaticKeyProvider()
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	store := NewWORMStore(inner, "session", provider)
+
+	// When messages are saved, under rotated keys
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+	provider.current = "k2"
+	require.Nil(t, store.SaveMessages([]SeqMsg{{SeqNum: 2, Msg: []byte("two")}, {SeqNum: 3, Msg: []byte("three")}}))
+	require.Nil(t, store.SetNextSenderMsgSeqNum(4))
+
+	// Then they should be stored authenticated and read back verified
+	stored, _, _ := inner.GetMessage(1)
+	assert.Equal(t, authenticatedMessageMarker, stored[0])
+	msgs, err := store.GetMessages(1, 3)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("one"), []byte("two"), []byte("three")}, msgs)
+	msg, found, err := store.GetMessage(2)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("two"), msg)
+}
+
+func TestWORMStore_Refused(t *testing.T) {
+	// Given a WORM store holding a message
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	store := NewWORMStore(inner, "session", newStaticKeyProvider())
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+
+	// When the message would be overwritten or destroyed
+	refusals := map[string]error{
+		"save_message":    store.SaveMessage(1, []byte("forged")),
+		"save_messages":   store.SaveMessages([]SeqMsg{{SeqNum: 2, Msg: []byte("two")}, {SeqNum: 1, Msg: []byte("forged")}}),
+		"delete_messages": store.DeleteMessagesUpTo(1),
+		"restore":         store.Restore(&bytes.Buffer{}),
+		"reset":           store.Reset(),
+	}
+
+	// Then each should be refused, leaving the message as it was
+	for op, err := range refusals {
+		var writeOnceErr *WriteOnceError
+		require.True(t, errors.As(err, &writeOnceErr), op)
+		assert.Equal(t, op, writeOnceErr.Op)
+		assert.True(t, errors.Is(err, ErrWriteOnce), op)
+	}
+	msgs, err := store.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("one")}, msgs)
+}
+
+func TestWORMStore_Tampered(t *testing.T) {
+	// Given a WORM store holding messages
+	inner, _ := NewMemoryStoreFactory().Create("session")
+	store := NewWORMStore(inner, "session", newStaticKeyProvider())
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+	require.Nil(t, store.SaveMessage(2, []byte("two")))
+
+	// When the backend is tampered with, altering one message, moving another and adding one without an HMAC
+	sealed, _, _ := inner.GetMessage(1)
+	altered := append([]byte{}, sealed...)
+	altered[len(altered)-1] = 'X'
+	moved, _, _ := inner.GetMessage(2)
+	require.Nil(t, inner.SaveMessage(1, altered))
+	require.Nil(t, inner.SaveMessage(3, moved))
+	require.Nil(t, inner.SaveMessage(4, []byte("forged")))
+
+	// Then reading any of them should fail the integrity check
+	for seqNum := 1; seqNum <= 4; seqNum++ {
+		_, _, err := store.GetMessage(seqNum)
+		if seqNum == 2 {
+			assert.Nil(t, err)
+			continue
+		}
+		assert.True(t, errors.Is(err, ErrMessageTampered), seqNum)
+	}
+	_, err := store.GetMessages(1, 4)
+	assert.True(t, errors.Is(err, ErrMessageTampered))
+}
@@ -0,0 +1,372 @@
+package msgstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrStoreClosed is returned by the writes of a write-behind store after Close
+var ErrStoreClosed = errors.New("message store is closed")
+
+type writeBehindStore struct {
+	storeDecorator
+	queue chan SeqMsg
+	// stopped is closed by the worker once it has drained the closed queue
+	stopped chan struct{}
+
+	// closeMu is held for reading by the senders to the queue, and for writing by Close when closing it
+	closeMu sync.RWMutex
+	closed  bool
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// pending is the number of messages queued but not yet persisted
+	pending int
+	// err is the first failure of the worker not yet returned
+	err error
+}
+
+// NewWriteBehindStore returns a MessageStore that acknowledges SaveMessage and SaveMessages once the messages are queued
+// in a buffer of queueSize messages, and saves them to inner in batches from a background worker, for sessions that
+// put send latency before durability.  Saves block while the buffer is full.  Flush returns once every message queued
+// before it is persisted, and so are the messages read, backed up or deleted, and those of the session reset or
+// refreshed.  The first failure of the worker is returned by the next save or Flush, and the messages of the failed
+// batch are lost.  Seqnums are written through to inner.  The optional interfaces of inner are forwarded, see
+// storeDecorator, their reads and their message writes waiting for the queued messages to be persisted first.
+func NewWriteBehindStore(inner MessageStore, queueSize int) MessageStore {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	store := &writeBehindStore{storeDecorator: newStoreDecorator(inner), queue: make(chan SeqMsg, queueSize), stopped: make(chan struct{})}
+	store.cond = sync.NewCond(&store.mu)
+	go store.persist()
+	return store
+}
+
+// persist saves the queued messages to the inner store, in batches of those queued by the time the worker gets to them
+func (store *writeBehindStore) persist() {
+	defer close(store.stopped)
+
+	for m := range store.queue {
+		batch := []SeqMsg{m}
+	drain:
+		for len(batch) < cap(store.queue) {
+			select {
+			case m, ok := <-store.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, m)
+			default:
+				break drain
+			}
+		}
+		err := store.inner.SaveMessages(batch)
+
+		store.mu.Lock()
+		store.pending -= len(batch)
+		if err != nil && store.err == nil {
+			store.err = err
+		}
+		store.cond.Broadcast()
+		store.mu.Unlock()
+	}
+}
+
+// takeErr returns and clears the failure of the worker
+func (store *writeBehindStore) takeErr() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	err := store.err
+	store.err = nil
+	return err
+}
+
+// enqueue queues msgs for the worker, blocking while the queue is full
+func (store *writeBehindStore) enqueue(msgs ...SeqMsg) error {
+	store.closeMu.RLock()
+	defer store.closeMu.RUnlock()
+
+	if store.closed {
+		return ErrStoreClosed
+	}
+	if err := store.takeErr(); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	store.pending += len(msgs)
+	store.mu.Unlock()
+	for _, m := range msgs {
+		store.queue <- m
+	}
+	return nil
+}
+
+// drain waits until every queued message is persisted, returning the failure of the worker
+func (store *writeBehindStore) drain() error {
+	store.mu.Lock()
+	for store.pending > 0 {
+		store.cond.Wait()
+	}
+	store.mu.Unlock()
+	return store.takeErr()
+}
+
+func (store *writeBehindStore) NextSenderMsgSeqNum() int {
+	return store.inner.NextSenderMsgSeqNum()
+}
+
+func (store *writeBehindStore) NextTargetMsgSeqNum() int {
+	return store.inner.NextTargetMsgSeqNum()
+}
+
+func (store *writeBehindStore) IncrNextSenderMsgSeqNum() error {
+	return store.inner.IncrNextSenderMsgSeqNum()
+}
+
+func (store *writeBehindStore) IncrNextTargetMsgSeqNum() error {
+	return store.inner.IncrNextTargetMsgSeqNum()
+}
+
+func (store *writeBehindStore) SetNextSenderMsgSeqNum(next int) error {
+	return store.inner.SetNextSenderMsgSeqNum(next)
+}
+
+func (store *writeBehindStore) SetNextTargetMsgSeqNum(next int) error {
+	return store.inner.SetNextTargetMsgSeqNum(next)
+}
+
+func (store *writeBehindStore) CreationTime() time.Time {
+	return store.inner.CreationTime()
+}
+
+func (store *writeBehindStore) SetCreationTime(t time.Time) error {
+	return store.inner.SetCreationTime(t)
+}
+
+// SaveMessage queues a copy of the message, which the caller may reuse, for the worker, see NewWriteBehindStore
+func (store *writeBehindStore) SaveMessage(seqNum int, msg []byte) error {
+	return store.SaveMessageContext(context.Background(), seqNum, msg)
+}
+
+// SaveMessageContext is like SaveMessage, failing if ctx is done before the message is queued
+func (store *writeBehindStore) SaveMessageContext(ctx context.Context, seqNum int, msg []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.enqueue(SeqMsg{SeqNum: seqNum, Msg: append([]byte(nil), msg...)})
+}
+
+// SaveMessageWithMeta waits until every queued message is persisted, and then saves the message to inner
+func (store *writeBehindStore) SaveMessageWithMeta(seqNum int, msg []byte, meta MessageMeta) error {
+	if err := store.drain(); err != nil {
+		return err
+	}
+	return store.storeDecorator.SaveMessageWithMeta(seqNum, msg, meta)
+}
+
+// SaveMessages queues copies of the messages, which the caller may reuse, for the worker, see NewWriteBehindStore
+func (store *writeBehindStore) SaveMessages(msgs []SeqMsg) error {
+	return store.SaveMessagesContext(context.Background(), msgs)
+}
+
+// SaveMessagesContext is like SaveMessages, failing if ctx is done before the messages are queued
+func (store *writeBehindStore) SaveMessagesContext(ctx context.Context, msgs []SeqMsg) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	copies := make([]SeqMsg, len(msgs))
+	for i, m := range msgs {
+		copies[i] = SeqMsg{SeqNum: m.SeqNum, Msg: append([]byte(nil), m.Msg...)}
+	}
+	return store.enqueue(copies...)
+}
+
+func (store *writeBehindStore) GetMessages(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	return store.GetMessagesContext(context.Background(), beginSeqNum, endSeqNum)
+}
+
+func (store *writeBehindStore) GetMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int) ([][]byte, error) {
+	if err := store.drain(); err != nil {
+		return nil, err
+	}
+	return store.storeDecorator.GetMessagesContext(ctx, beginSeqNum, endSeqNum)
+}
+
+func (store *writeBehindStore) GetMessagesSince(seqNum int) ([][]byte, error) {
+	if err := store.drain(); err != nil {
+		return nil, err
+	}
+	return store.inner.GetMessagesSince(seqNum)
+}
+
+func (store *writeBehindStore) GetMessagesDescending(beginSeqNum, endSeqNum int) ([][]byte, error) {
+	if err := store.drain(); err != nil {
+		return nil, err
+	}
+	return store.inner.GetMessagesDescending(beginSeqNum, endSeqNum)
+}
+
+func (store *writeBehindStore) GetMessage(seqNum int) ([]byte, bool, error) {
+	return store.GetMessageContext(context.Background(), seqNum)
+}
+
+func (store *writeBehindStore) GetMessageContext(ctx context.Context, seqNum int) ([]byte, bool, error) {
+	if err := store.drain(); err != nil {
+		return nil, false, err
+	}
+	return store.storeDecorator.GetMessageContext(ctx, seqNum)
+}
+
+func (store *writeBehindStore) GetStoredMessages(filter MessageFilter) ([]StoredMessage, error) {
+	if err := store.drain(); err != nil {
+		return nil, err
+	}
+	return store.storeDecorator.GetStoredMessages(filter)
+}
+
+func (store *writeBehindStore) LastSeqNumStoredBefore(direction MessageDirection, t time.Time) (int, error) {
+	if err := store.drain(); err != nil {
+		return 0, err
+	}
+	return store.storeDecorator.LastSeqNumStoredBefore(direction, t)
+}
+
+func (store *writeBehindStore) MessageCount() (int, error) {
+	if err := store.drain(); err != nil {
+		return 0, err
+	}
+	return store.storeDecorator.MessageCount()
+}
+
+func (store *writeBehindStore) FirstSeqNum() (int, error) {
+	if err := store.drain(); err != nil {
+		return 0, err
+	}
+	return store.storeDecorator.FirstSeqNum()
+}
+
+func (store *writeBehindStore) LastSeqNum() (int, error) {
+	if err := store.drain(); err != nil {
+		return 0, err
+	}
+	return store.storeDecorator.LastSeqNum()
+}
+
+func (store *writeBehindStore) IterateMessages(beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	return store.IterateMessagesContext(context.Background(), beginSeqNum, endSeqNum, fn)
+}
+
+func (store *writeBehindStore) IterateMessagesContext(ctx context.Context, beginSeqNum, endSeqNum int, fn func(seqNum int, msg []byte) error) error {
+	if err := store.drain(); err != nil {
+		return err
+	}
+	return store.storeDecorator.IterateMessagesContext(ctx, beginSeqNum, endSeqNum, fn)
+}
+
+func (store *writeBehindStore) StreamMessages(ctx context.Context, beginSeqNum, endSeqNum int) (<-chan StoredMessage, <-chan error) {
+	return StreamMessageStore(ctx, store, beginSeqNum, endSeqNum)
+}
+
+// BeginTx starts a transaction buffered until Commit, which queues its messages like SaveMessages, see BeginBufferedTx
+func (store *writeBehindStore) BeginTx() (StoreTx, error) {
+	return store.BeginTxContext(context.Background())
+}
+
+// BeginTxContext is like BeginTx, failing if ctx is done
+func (store *writeBehindStore) BeginTxContext(ctx context.Context) (StoreTx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return BeginBufferedTx(store), nil
+}
+
+func (store *writeBehindStore) DeleteMessagesUpTo(seqNum int) error {
+	return store.DeleteMessagesUpToContext(context.Background(), seqNum)
+}
+
+func (store *writeBehindStore) DeleteMessagesUpToContext(ctx context.Context, seqNum int) error {
+	if err := store.drain(); err != nil {
+		return err
+	}
+	return store.storeDecorator.DeleteMessagesUpToContext(ctx, seqNum)
+}
+
+func (store *writeBehindStore) Backup(w io.Writer) error {
+	if err := store.drain(); err != nil {
+		return err
+	}
+	return store.inner.Backup(w)
+}
+
+func (store *writeBehindStore) Restore(r io.Reader) error {
+	if err := store.drain(); err != nil {
+		return err
+	}
+	return store.inner.Restore(r)
+}
+
+func (store *writeBehindStore) HealthCheck(ctx context.Context) error {
+	return store.inner.HealthCheck(ctx)
+}
+
+// Flush waits until every message queued is persisted, and then flushes inner
+func (store *writeBehindStore) Flush() error {
+	if err := store.drain(); err != nil {
+		return err
+	}
+	return store.inner.Flush()
+}
+
+func (store *writeBehindStore) Refresh() error {
+	return store.RefreshContext(context.Background())
+}
+
+func (store *writeBehindStore) RefreshContext(ctx context.Context) error {
+	if err := store.drain(); err != nil {
+		return err
+	}
+	return store.storeDecorator.RefreshContext(ctx)
+}
+
+func (store *writeBehindStore) Reset() error {
+	return store.ResetContext(context.Background())
+}
+
+func (store *writeBehindStore) ResetContext(ctx context.Context) error {
+	if err := store.drain(); err != nil {
+		return err
+	}
+	return store.storeDecorator.ResetContext(ctx)
+}
+
+func (store *writeBehindStore) ResetWithoutDeletingMessages() error {
+	if err := store.drain(); err != nil {
+		return err
+	}
+	return store.storeDecorator.ResetWithoutDeletingMessages()
+}
+
+// Close persists the queued messages, stops the worker and closes inner
+func (store *writeBehindStore) Close() error {
+	store.closeMu.Lock()
+	if store.closed {
+		store.closeMu.Unlock()
+		return nil
+	}
+	store.closed = true
+	close(store.queue)
+	store.closeMu.Unlock()
+
+	<-store.stopped
+	err := store.takeErr()
+	if closeErr := store.inner.Close(); err == nil {
+		return closeErr
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package msgstore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// WriteBehindStoreTestSuite runs all tests in the MessageStoreTestSuite against a write-behind store
+type WriteBehindStoreTestSuite struct {
+	MessageStoreTestSuite
+}
+
+func (suite *WriteBehindStoreTestSuite) SetupTest() {
+	inner, err := NewMemoryStoreFactory().Create("session")
+	require.Nil(suite.T(), err)
+	suite.msgStore = NewWriteBehindStore(inner, 4)
+}
+
+func (suite *WriteBehindStoreTestSuite) TearDownTest() {
+	suite.msgStore.Close()
+}
+
+func TestWriteBehindStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(WriteBehindStoreTestSuite))
+}
+
+// blockingSaveStore saves messages once released
+type blockingSaveStore struct {
+	MessageStore
+	release chan struct{}
+}
+
+func (store blockingSaveStore) SaveMessages(msgs []SeqMsg) error {
+	<-store.release
+	return store.MessageStore.SaveMessages(msgs)
+}
+
+func TestWriteBehindStore_Flush(t *testing.T) {
+	// Given a write-behind store whose inner store is stalled
+	memStore, _ := NewMemoryStoreFactory().Create("session")
+	release := make(chan struct{})
+	store := NewWriteBehindStore(blockingSaveStore{memStore, release}, 10)
+	defer store.Close()
+
+	// When messages are saved
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+	require.Nil(t, store.SaveMessage(2, []byte("two")))
+
+	// Then they should be acknowledged before they are persisted
+	_, found, err := memStore.GetMessage(1)
+	require.Nil(t, err)
+	assert.False(t, found)
+
+	// And be persisted by Flush once the inner store recovers
+	close(release)
+	require.Nil(t, store.Flush())
+	msgs, err := memStore.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("one"), []byte("two")}, msgs)
+}
+
+func TestWriteBehindStore_Failure(t *testing.T) {
+	// Given a write-behind store whose inner store cannot save
+	memStore, _ := NewMemoryStoreFactory().Create("session")
+	store := NewWriteBehindStore(failingSaveStore{memStore}, 10)
+	defer store.Close()
+
+	// When a message is saved
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+
+	// Then the failure should be returned by the next Flush, once
+	assert.EqualError(t, store.Flush(), "disk full")
+	assert.Nil(t, store.Flush())
+}
+
+func TestWriteBehindStore_Close(t *testing.T) {
+	// Given a write-behind store with queued messages
+	memStore, _ := NewMemoryStoreFactory().Create("session")
+	store := NewWriteBehindStore(memStore, 10)
+	require.Nil(t, store.SaveMessage(1, []byte("one")))
+
+	// When it is closed
+	require.Nil(t, store.Close())
+
+	// Then the messages should have been persisted, and further saves refused
+	_, found, err := memStore.GetMessage(1)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.True(t, errors.Is(store.SaveMessage(2, []byte("two")), ErrStoreClosed))
+}
+
+func TestWriteBehindStore_CopiesSavedMessages(t *testing.T) {
+	// Given a write-behind store whose inner store is stalled
+	memStore, _ := NewMemoryStoreFactory().Create("session")
+	release := make(chan struct{})
+	store := NewWriteBehindStore(blockingSaveStore{memStore, release}, 10)
+	defer store.Close()
+
+	// When messages are saved, and their buffers then reused by the caller before they are persisted
+	buf := []byte("one")
+	require.Nil(t, store.SaveMessage(1, buf))
+	batch := []SeqMsg{{SeqNum: 2, Msg: []byte("two")}}
+	require.Nil(t, store.SaveMessages(batch))
+	copy(buf, "xxx")
+	copy(batch[0].Msg, "yyy")
+
+	// Then the messages persisted should be the ones saved
+	close(release)
+	require.Nil(t, store.Flush())
+	msgs, err := memStore.GetMessages(1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("one"), []byte("two")}, msgs)
+}